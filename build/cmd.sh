@@ -350,6 +350,8 @@ function build_internal {
     go build -i -o "${project_dir}/_output/virtlet" ./cmd/virtlet
     go build -i -o "${project_dir}/_output/vmwrapper" ./cmd/vmwrapper
     go build -i -o "${project_dir}/_output/flexvolume_driver" ./cmd/flexvolume_driver
+    go build -i -o "${project_dir}/_output/virtletctl" ./cmd/virtletctl
+    go build -i -o "${project_dir}/_output/virtlet-controller" ./cmd/virtlet-controller
     go test -i -c -o "${project_dir}/_output/virtlet-e2e-tests" ./tests/e2e
 }
 
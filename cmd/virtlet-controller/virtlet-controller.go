@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	k8sclientset "k8s.io/kubernetes/pkg/client/clientset_generated/clientset"
+
+	"github.com/Mirantis/virtlet/pkg/controller"
+	"github.com/Mirantis/virtlet/pkg/imagetranslation"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/vmrequest"
+)
+
+var (
+	namespace = flag.String("namespace", "kube-system",
+		"Namespace of virtlet resources and the controller's ConfigMaps")
+	lockName = flag.String("lock-name", "virtlet-controller",
+		"Name of the ConfigMap used for leader election")
+	leaseDuration = flag.Duration("lease-duration", 15*time.Second,
+		"Time the non-leader instances wait before trying to take over the leadership")
+	renewDeadline = flag.Duration("renew-deadline", 10*time.Second,
+		"Time the leader keeps trying to renew the lease before giving up the leadership")
+	retryPeriod = flag.Duration("retry-period", 2*time.Second,
+		"Interval between attempts to acquire or renew the leadership")
+	resyncPeriod = flag.Duration("resync-period", 5*time.Minute,
+		"Interval of full resync of the watched resources")
+)
+
+func identity() string {
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		return podName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		glog.Errorf("Can't get hostname: %v", err)
+		os.Exit(1)
+	}
+	return hostname
+}
+
+func main() {
+	flag.Parse()
+
+	if err := imagetranslation.RegisterCustomResourceType(); err != nil {
+		glog.Errorf("Error registering VirtletImageMapping resource type: %v", err)
+		os.Exit(1)
+	}
+	if err := vmrequest.RegisterCustomResourceTypes(); err != nil {
+		glog.Errorf("Error registering VM request resource types: %v", err)
+		os.Exit(1)
+	}
+
+	cfg, err := utils.GetK8sClientConfig("")
+	if err != nil {
+		glog.Errorf("Can't get k8s client config: %v", err)
+		os.Exit(1)
+	}
+	clientset, err := utils.GetK8sClientset(cfg)
+	if err != nil {
+		glog.Errorf("Can't create k8s clientset: %v", err)
+		os.Exit(1)
+	}
+	// the leader election code works with the objects
+	// from k8s.io/kubernetes
+	lockClientset, err := k8sclientset.NewForConfig(cfg)
+	if err != nil {
+		glog.Errorf("Can't create k8s clientset for leader election: %v", err)
+		os.Exit(1)
+	}
+	imageMappingClient, err := imagetranslation.GetCRDRestClient(cfg)
+	if err != nil {
+		glog.Errorf("Can't create CRD client: %v", err)
+		os.Exit(1)
+	}
+	requestClient, err := vmrequest.GetCRDRestClient(cfg)
+	if err != nil {
+		glog.Errorf("Can't create CRD client: %v", err)
+		os.Exit(1)
+	}
+
+	c := controller.NewController(clientset, lockClientset.CoreV1(), imageMappingClient, requestClient, controller.Config{
+		Namespace:    *namespace,
+		ResyncPeriod: *resyncPeriod,
+		LeaderElection: controller.LeaderElectionConfig{
+			LockName:      *lockName,
+			Identity:      identity(),
+			LeaseDuration: *leaseDuration,
+			RenewDeadline: *renewDeadline,
+			RetryPeriod:   *retryPeriod,
+		},
+	})
+	if err := c.Run(); err != nil {
+		glog.Errorf("Error running the controller: %v", err)
+		os.Exit(1)
+	}
+	// exit so the pod is restarted and the instance
+	// becomes a candidate again
+	glog.Errorf("Lost the leadership, exiting")
+	os.Exit(1)
+}
@@ -18,22 +18,43 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
+	"os/user"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
 
+	"github.com/Mirantis/virtlet/pkg/audit"
 	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/csi"
+	"github.com/Mirantis/virtlet/pkg/flexvolume"
+	"github.com/Mirantis/virtlet/pkg/health"
+	"github.com/Mirantis/virtlet/pkg/instance"
 	"github.com/Mirantis/virtlet/pkg/libvirttools"
 	"github.com/Mirantis/virtlet/pkg/manager"
 	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/nodecheck"
+	"github.com/Mirantis/virtlet/pkg/nodestate"
 	"github.com/Mirantis/virtlet/pkg/stream"
 	"github.com/Mirantis/virtlet/pkg/tapmanager"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/version"
 )
 
 var (
+	instanceName = flag.String("instance-name", "",
+		"Name of Virtlet instance that makes it possible to run several Virtlet DaemonSets on the same node, e.g. stable and canary ones. The data directory, sockets, network namespace names and libvirt object names of a named instance don't clash with those of other instances")
 	libvirtUri = flag.String("libvirt-uri", "qemu:///system",
 		"Libvirt connection URI")
 	pool = flag.String("pool", "default",
@@ -42,6 +63,12 @@ var (
 		"Libvirt storage pool type/backend")
 	boltPath = flag.String("bolt-path", "/var/lib/virtlet/virtlet.db",
 		"Path to the bolt database file")
+	metadataDurability = flag.String("metadata-durability", string(metadata.DurabilitySync),
+		"Durability level of the metadata store writes: 'sync' (sync each write separately), 'batch' (coalesce concurrent writes into a single transaction) or 'relaxed' (sync the database once per flush interval)")
+	metadataBackend = flag.String("metadata-backend", "bolt",
+		"Metadata store backend: 'bolt' (keep the metadata in the local bolt database only) or 'crd' (also keep a copy in VirtletNodeState object named after the node)")
+	metadataFlushInterval = flag.Duration("metadata-flush-interval", metadata.DefaultFlushInterval,
+		"Maximum delay of a metadata store write waiting for a batch in 'batch' durability mode, or the interval between the syncs of the database in 'relaxed' mode")
 	listen = flag.String("listen", "/run/virtlet.sock",
 		"The unix socket to listen on, e.g. /run/virtlet.sock")
 	cniPluginsDir = flag.String("cni-bin-dir", "/opt/cni/bin",
@@ -54,18 +81,155 @@ var (
 		"Comma separated list of raw device glob patterns to which VM can have an access (with skipped /dev/ prefix)")
 	fdServerSocketPath = flag.String("fd-server-socket-path", "/var/lib/virtlet/tapfdserver.sock",
 		"Path to fd server socket")
+	fdServerSocketMode = flag.String("fd-server-socket-mode", "0660",
+		"Permissions of fd server socket (octal). Empty value means that the permissions are determined by umask")
+	fdServerSocketGroup = flag.String("fd-server-socket-group", "",
+		"Group that owns fd server socket. Empty value means the group of the emulator user")
 	imageTranslationConfigsDir = flag.String("image-translations-dir", "",
 		"Image name translation configs directory")
+	fdAddTimeout = flag.Duration("fd-add-timeout", 100*time.Second,
+		"Time limit for setting up pod networking. Should be less than kubelet's --runtime-request-timeout. 0 means no limit")
+	fdServerHandoff = flag.Bool("fd-server-handoff", false,
+		"Take over the fd server socket and the tap devices of the running tapmanager process of the previous Virtlet pod on startup, so that the VMs keep their network connectivity during the upgrade. The previous Virtlet process exits after the handoff. If there's nothing to take over, tapmanager starts from scratch")
+	fdCompression = flag.Bool("fd-compression", true,
+		"Compress large payloads such as CNI results passed between virtlet and tapmanager")
+	networkSetupTimeout = flag.Duration("network-setup-timeout", 90*time.Second,
+		"Time limit for CNI and network namespace operations during pod network setup, after which the setup is rolled back. Should be less than -fd-add-timeout. 0 means no limit")
+	cniMaxConcurrentOps = flag.Int("cni-max-concurrent-ops", 0,
+		"Maximum number of concurrent CNI plugin invocations. The rest are queued and executed in the order of arrival. 0 means no limit")
+	addressConflictTimeout = flag.Duration("address-conflict-timeout", 0,
+		"Time to wait for the responses to ARP probes that are sent for VM IPv4 addresses before starting the VM. VM startup fails if another host uses any of these addresses. 0 disables the check")
+	pathMTUCheck = flag.String("path-mtu-check", "",
+		"Probe the path MTU between the pod network namespace and the gateway using do-not-fragment ICMP packets of the interface MTU size before starting the VM: 'warn' (log a warning if the interface MTU exceeds the path MTU), 'enforce' (fail the VM startup in this case) or empty string (disable the probes)")
+	pathMTUProbeTimeout = flag.Duration("path-mtu-probe-timeout", time.Second,
+		"Time to wait for the reply to each path MTU probe")
+	cniResultHook = flag.String("cni-result-hook", "",
+		"Path to the program that's used to adjust CNI results before they're applied to VM pod networks. The program gets the result as JSON on its stdin and writes the adjusted result to its stdout. Empty value disables the hook")
+	netBootDir = flag.String("netboot-dir", "/var/lib/virtlet/netboot",
+		"Directory with the boot files for the VMs that boot over the network. The files are served to the VMs via TFTP and HTTP")
+	pendingCNIDelDir = flag.String("pending-cni-del-dir", "/var/lib/virtlet/pending-cni-del",
+		"Directory for keeping the records of failed CNI DEL operations that are retried periodically so the IP addresses are returned to the pool. Empty value makes pod network teardown fail upon CNI DEL errors")
+	pendingCNIDelInterval = flag.Duration("pending-cni-del-interval", time.Minute,
+		"Interval between the retries of failed CNI DEL operations")
+	tapManagerMetricsAddr = flag.String("tapmanager-metrics-address", "",
+		"Address to serve tapmanager metrics on, e.g. 127.0.0.1:10355. Empty value disables the metrics")
+	tapManagerAPIAddr = flag.String("tapmanager-api-address", "",
+		"Address to serve the tapmanager API for VM pod networks on, either a loopback address such as 127.0.0.1:10359 or a unix socket path such as /run/virtlet-tapmanager.sock. The requests must carry a bearer token of a user that's allowed to create the corresponding subresource of the pod. Empty value disables the API")
+	enablePcap = flag.Bool("enable-pcap", false,
+		"Serve packet capture API for VM pod interfaces (/pcap path) on -tapmanager-api-address. The users must be allowed to create pods/pcap subresource")
+	tapManagerDebugAddr = flag.String("tapmanager-debug-address", "",
+		"Address to serve the JSON dump of tapmanager state on, either a loopback address such as 127.0.0.1:10356 or a unix socket path such as /run/virtlet-tapmanager-debug.sock. Empty value disables the endpoint")
+	enableNICHotplug = flag.Bool("enable-nic-hotplug", false,
+		"Serve network attach/detach API for running VMs (/attach-network and /detach-network paths) on -tapmanager-api-address. The users must be allowed to create pods/network subresource")
+	fileCopyAddr = flag.String("file-copy-address", "",
+		"Address to serve the API for copying files into and out of running VMs via QEMU guest agent (/cp path) and exporting VM volume snapshots to S3-compatible object storage (/export-volume path) on, either a loopback address such as 127.0.0.1:10357 or a unix socket path such as /run/virtlet-file-copy.sock. The requests must carry a bearer token of a user that's allowed to create pods/cp or pods/export subresource of the pod, respectively. Empty value disables the API")
+	debugAddr = flag.String("debug-address", "",
+		"Address to serve the debug API that returns rendered libvirt domain definitions of VM pods (/debug/domain-xml path) and host storage usage of VM volumes (/debug/volume-usage path) and the images in the image store (/debug/images path), pulls images in advance (/debug/pull path), manages node maintenance mode (/debug/maintenance path), dumps the metadata store contents (/debug/metadata path), passes the allowed QMP commands through to the VMs (/qmp path) and serves libvirt API call metrics (/metrics path) on. The API isn't authenticated, so only a loopback address such as 127.0.0.1:10358 or a unix socket path such as /run/virtlet-debug.sock is accepted. Empty value disables the API")
+	fstrimInterval = flag.Duration("fstrim-interval", 0,
+		"Interval between the requests to trim the filesystems sent to QEMU guest agents of the running VMs, which makes the space freed inside the VMs available on the host. 0 disables periodic trimming")
+	memoryReclaimInterval = flag.Duration("memory-reclaim-interval", 0,
+		"Interval between the adjustments of the balloon targets of the running VMs that have VirtletMinMemory annotation according to their memory usage. 0 disables memory reclaim")
+	vmPoolSyncInterval = flag.Duration("vm-pool-sync-interval", 0,
+		"Interval between the syncs of the standby VMs with VirtualMachinePool objects. Claiming standby VMs requires -enable-nic-hotplug. 0 disables VM pools")
+	vmSlots = flag.Int("vm-slots", 0,
+		"Fixed number of VM slots advertised for the node as virtlet.cloud/vm-slots extended resource. 0 means that the number of slots is calculated using -vm-slot-memory and -vm-slot-cpu")
+	vmSlotMemory = flag.String("vm-slot-memory", "",
+		"Amount of node's allocatable memory per VM slot, e.g. 1Gi. Empty value means that memory doesn't limit the number of VM slots")
+	vmSlotCPU = flag.String("vm-slot-cpu", "",
+		"Amount of node's allocatable CPU per VM slot, e.g. 500m. Empty value means that CPU doesn't limit the number of VM slots. If neither -vm-slots, -vm-slot-memory nor -vm-slot-cpu is set, VM slots aren't advertised")
+	healthAddr = flag.String("health-address", "",
+		"Address to serve the health checks of libvirt connectivity, tapmanager and metadata store on (/healthz and /readyz paths), e.g. 127.0.0.1:10359. Empty value disables the health endpoints")
+	slowLibvirtCallThreshold = flag.Duration("slow-libvirt-call-threshold", 5*time.Second,
+		"Duration after which libvirt API calls are logged as slow ones along with the domain or other libvirt object involved. 0 disables slow call logging")
+	csiEndpoint = flag.String("csi-endpoint", "",
+		"Unix socket path to serve CSI node plugin on, e.g. /var/lib/kubelet/plugins/virtlet.cloud/csi.sock, so Virtlet volumes can be used as CSI persistent volumes. Empty value disables the plugin")
+	minFreeImageSpace = flag.Uint64("min-free-image-space", nodecheck.DefaultMinFreeImageSpace,
+		"Minimum amount of free space in bytes in the image store that's required by node check")
+	crashDumpDir = flag.String("crash-dump-dir", "/var/lib/virtlet/crash-dumps",
+		"Directory to write the memory dumps of the crashed VMs that have VirtletCrashDump annotation to")
+	crashDumpSpoolSize = flag.Uint64("crash-dump-spool-size", 0,
+		"Maximum total size in bytes of the memory dumps of the crashed VMs, the oldest dumps being removed to make room for new ones. 0 disables the dumps")
+	crashReportDir = flag.String("crash-report-dir", "/var/lib/virtlet/crash-reports",
+		"Directory to write the reports with the stack traces and the state of Virtlet upon a panic to. Empty value disables crash reports")
+	crashCoreDump = flag.Bool("crash-core-dump", false,
+		"Make Virtlet process abort producing a core dump after a panic. The location of the dump is determined by the node's core_pattern")
+	consoleLogRateLimit = flag.Int("console-log-rate-limit", 100,
+		"Maximum sustained number of VM console lines per second written to the container log, the excess lines being dropped. 0 disables the limit")
+	consoleLogBurst = flag.Int("console-log-burst", 1000,
+		"Maximum number of VM console lines that may be written to the container log at once exceeding console-log-rate-limit")
+	auditLogPath = flag.String("audit-log", "",
+		"Path to the append-only audit log file which records the mutating CRI calls, the pod network setup and teardown requests handled by tapmanager, image pulls and QMP passthrough commands along with the requester identity and the outcome. '-' makes the records go to stdout. Empty value disables the audit log")
+	checkNetwork = flag.Bool("check-network", false,
+		"Set up and tear down the network for a temporary pod on startup, refusing to start if the CNI configuration is broken")
 )
 
 const (
 	WantTapManagerEnv         = "WANT_TAP_MANAGER"
 	TapManagerConnectInterval = 200 * time.Millisecond
 	TapManagerAttemptCount    = 50
+	// tapManagerReadyFD is the file descriptor of the pipe
+	// which is closed by tapmanager process once it's serving
+	tapManagerReadyFD      = 3
+	crashDumpCheckInterval = 5 * time.Second
+	vmSlotsSyncInterval    = time.Minute
+	snapshotRequestResync  = 5 * time.Minute
+	// shutdownTimeout is the time limit for completing the CRI
+	// requests and for tapmanager process to exit upon SIGTERM
+	shutdownTimeout = 10 * time.Second
 )
 
-func runVirtlet() {
+// checkNode checks the node prerequisites and returns the list
+// of the problems found
+func checkNode() []nodecheck.Problem {
+	config := nodecheck.Config{
+		CNIPluginsDir:     *cniPluginsDir,
+		CNIConfigsDir:     *cniConfigsDir,
+		ImageDir:          "/var/lib/libvirt/images",
+		MinFreeImageSpace: *minFreeImageSpace,
+		SkipKVM:           os.Getenv("VIRTLET_DISABLE_KVM") != "",
+	}
+	conn, err := libvirttools.NewConnection(*libvirtUri)
+	if err != nil {
+		config.LibvirtVersion = func() (uint32, error) { return 0, err }
+	} else {
+		config.LibvirtVersion = conn.LibVersion
+	}
+	return nodecheck.Run(config)
+}
+
+// runNodeCheck implements 'virtlet check-node' command
+func runNodeCheck() {
+	problems := checkNode()
+	for _, p := range problems {
+		fmt.Printf("ERROR: %s\n", p)
+	}
+	if len(problems) != 0 {
+		fmt.Printf("Node check failed: %d problem(s) found\n", len(problems))
+		os.Exit(1)
+	}
+	fmt.Println("Node check passed")
+}
+
+func runVirtlet(tapManager *exec.Cmd, tapManagerReady *os.File) {
+	if err := version.EnsureDataLayout(instance.DataDir()); err != nil {
+		glog.Errorf("Can't use the data directory: %v", err)
+		os.Exit(1)
+	}
+	if *crashCoreDump {
+		enableCoreDumps()
+	}
+	for _, p := range checkNode() {
+		glog.Errorf("Node check: %s", p)
+	}
+
+	// if tapmanager is taking over the socket of the previous
+	// tapmanager, connecting too early would make us talk
+	// to the old process
+	waitForTapManager(tapManagerReady)
 	c := tapmanager.NewFDClient(*fdServerSocketPath)
+	c.SetComponent("virtlet")
+	c.SetAddTimeout(*fdAddTimeout)
+	c.SetCompression(*fdCompression)
 	var err error
 	for i := 0; i < TapManagerAttemptCount; i++ {
 		time.Sleep(TapManagerConnectInterval)
@@ -79,7 +243,53 @@ func runVirtlet() {
 		os.Exit(1)
 	}
 
-	metadataStore, err := metadata.NewMetadataStore(*boltPath)
+	if *checkNetwork {
+		report, err := tapmanager.CheckNetwork(c)
+		if err != nil {
+			glog.Errorf("Network check failed: %v", err)
+			os.Exit(1)
+		}
+		glog.V(1).Infof("Network check: interfaces %v, ips %v, routes %v", report.Interfaces, report.IPs, report.Routes)
+		if !report.OK() {
+			glog.Errorf("Network check failed: %v", report.Problems)
+			os.Exit(1)
+		}
+	}
+
+	libvirttools.SetSlowLibvirtCallThreshold(*slowLibvirtCallThreshold)
+
+	vmSlotsPolicy, err := manager.ParseVMSlotsPolicy(*vmSlots, *vmSlotMemory, *vmSlotCPU)
+	if err != nil {
+		glog.Errorf("Invalid VM slots settings: %v", err)
+		os.Exit(1)
+	}
+
+	durability, err := metadata.ParseDurability(*metadataDurability)
+	if err != nil {
+		glog.Errorf("Invalid -metadata-durability: %v", err)
+		os.Exit(1)
+	}
+	metadataOpts := metadata.Options{
+		Durability:    durability,
+		FlushInterval: *metadataFlushInterval,
+	}
+	switch *metadataBackend {
+	case "bolt":
+	case "crd":
+		if err := nodestate.RegisterCustomResourceType(); err != nil {
+			glog.Errorf("Failed to register VirtletNodeState CRD: %v", err)
+			os.Exit(1)
+		}
+		metadataOpts.Backend, err = nodestate.NewStateBackend(os.Getenv("KUBE_NODE_NAME"))
+		if err != nil {
+			glog.Errorf("Failed to create metadata store backend: %v", err)
+			os.Exit(1)
+		}
+	default:
+		glog.Errorf("Invalid -metadata-backend %q (must be 'bolt' or 'crd')", *metadataBackend)
+		os.Exit(1)
+	}
+	metadataStore, err := metadata.NewMetadataStoreWithOptions(*boltPath, metadataOpts)
 	if err != nil {
 		glog.Errorf("Failed to create metadata store: %v", err)
 		os.Exit(1)
@@ -90,60 +300,430 @@ func runVirtlet() {
 		glog.Errorf("Initializing server failed: %v", err)
 		os.Exit(1)
 	}
+	if *crashReportDir != "" {
+		server.EnableCrashReports(*crashReportDir)
+	}
+	server.SetAuditLog(openAuditLog("virtlet"))
+	if report, err := cni.CheckPluginVersions(*cniPluginsDir, *cniConfigsDir); err != nil {
+		glog.Warningf("Can't check CNI plugin versions: %v", err)
+	} else {
+		glog.V(1).Infof("CNI spec versions supported by Virtlet: %s", strings.Join(report.RuntimeVersions, ", "))
+		for _, pvi := range report.Plugins {
+			glog.V(1).Infof("CNI plugin: %s", pvi)
+		}
+		for _, problem := range report.Problems() {
+			glog.Warningf("CNI plugin version mismatch: %s", problem)
+		}
+		server.SetCNIPluginVersionReport(report)
+	}
+	defer server.RecoverPanic()
 
 	kubernetesDir := os.Getenv("KUBERNETES_POD_LOGS")
 	if kubernetesDir == "" {
 		glog.Infoln("KUBERNETES_POD_LOGS environment variables must be set")
 		os.Exit(1)
 	}
-	streamServer, err := stream.NewServer(kubernetesDir, "/var/lib/libvirt/streamer.sock", metadataStore)
+	streamServer, err := stream.NewServer(kubernetesDir, instance.SocketPath(libvirttools.StreamerSocketPath), metadataStore)
 	if err != nil {
 		glog.V(1).Infoln("Could not create stream server:", err)
 		os.Exit(2)
 	}
+	streamServer.SetLogRateLimit(stream.LogRateLimit{
+		LinesPerSecond: *consoleLogRateLimit,
+		Burst:          *consoleLogBurst,
+	})
 	server.StreamServer = streamServer
 	err = server.StreamServer.Start()
 	if err != nil {
 		glog.V(1).Infoln("Could not start stream server: %s", err)
 
 	}
+	if *fileCopyAddr != "" {
+		// the API gives access to the filesystems of the VMs,
+		// so it must not be reachable from outside of the node
+		if err := checkLocalAddress(*fileCopyAddr); err != nil {
+			glog.Errorf("Bad -file-copy-address: %v", err)
+			os.Exit(1)
+		}
+		authorizer := manager.NewK8sPodAuthorizer()
+		mux := http.NewServeMux()
+		mux.Handle("/cp", manager.NewFileCopyHandler(server, authorizer))
+		mux.Handle("/export-volume", manager.NewVolumeExportHandler(server, authorizer))
+		if err := serveHTTP(*fileCopyAddr, mux, "file copy API"); err != nil {
+			glog.Errorf("Error serving file copy API: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *debugAddr != "" {
+		// apart from /qmp, the debug API isn't authenticated and
+		// it can shut down all the VMs on the node, so it must not
+		// be reachable from outside of the node
+		if err := checkLocalAddress(*debugAddr); err != nil {
+			glog.Errorf("Bad -debug-address: %v", err)
+			os.Exit(1)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/debug/domain-xml", manager.NewDomainXMLHandler(server))
+		mux.Handle("/debug/volume-usage", manager.NewVolumeUsageHandler(server))
+		mux.Handle("/debug/maintenance", manager.NewMaintenanceHandler(server))
+		mux.Handle("/debug/images", manager.NewImageInfoHandler(server))
+		mux.Handle("/debug/pull", manager.NewImagePullHandler(server))
+		mux.Handle("/debug/foreign-domains", manager.NewForeignDomainsHandler(server))
+		mux.Handle("/debug/metadata", manager.NewMetadataDumpHandler(server))
+		mux.Handle("/debug/network-check", manager.NewNetworkCheckHandler(server))
+		mux.Handle("/debug/reopen-logs", manager.NewConsoleLogHandler(server))
+		mux.Handle("/qmp", manager.NewQMPHandler(server, manager.NewK8sPodAuthorizer()))
+		mux.Handle("/metrics", manager.NewLibvirtMetricsHandler())
+		if err := serveHTTP(*debugAddr, mux, "debug API"); err != nil {
+			glog.Errorf("Error serving debug API: %v", err)
+			os.Exit(1)
+		}
+	}
+	checker := health.NewChecker(health.DefaultCheckTimeout, server.HealthChecks()...)
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", checker.HealthzHandler())
+		mux.Handle("/readyz", checker.ReadyzHandler())
+		if err := serveHTTP(*healthAddr, mux, "health checks"); err != nil {
+			glog.Errorf("Error serving health checks: %v", err)
+			os.Exit(1)
+		}
+	}
+	if interval := health.WatchdogInterval(); interval > 0 {
+		go checker.RunWatchdog(interval, nil)
+	}
+	if *fstrimInterval > 0 {
+		go server.RunFSTrim(*fstrimInterval, nil)
+	}
+	if *memoryReclaimInterval > 0 {
+		go server.RunMemoryReclaim(*memoryReclaimInterval, nil)
+	}
+	if *crashDumpSpoolSize > 0 {
+		server.EnableCrashDumps(*crashDumpDir, int64(*crashDumpSpoolSize))
+		go server.RunCrashDumpCollector(crashDumpCheckInterval, nil)
+	}
+	if *vmPoolSyncInterval > 0 {
+		go server.RunStandbyPools(*vmPoolSyncInterval, nil)
+	}
+	go server.RunSnapshotRequests(snapshotRequestResync, nil)
+	if vmSlotsPolicy.Enabled() {
+		go server.RunVMSlotsAdvertiser(vmSlotsPolicy, vmSlotsSyncInterval, nil)
+	}
+	if *csiEndpoint != "" {
+		startCSINodePlugin(*csiEndpoint)
+	}
 	glog.V(1).Infof("Starting server on socket %s", *listen)
+	checker.SetReady(true)
+	if err := health.Notify("READY=1"); err != nil {
+		glog.Warningf("Failed to notify systemd: %v", err)
+	}
+	shutdownDone := shutdownOnSignal(server, tapManager)
 	if err = server.Serve(*listen); err != nil {
 		glog.Errorf("Serving failed: %v", err)
 		os.Exit(1)
 	}
+	<-shutdownDone
+}
+
+// shutdownOnSignal makes Virtlet shut down cleanly upon SIGTERM or
+// SIGINT, leaving the VMs running. It returns a channel that's
+// closed once the shutdown is complete
+func shutdownOnSignal(server *manager.VirtletManager, tapManager *exec.Cmd) <-chan struct{} {
+	doneCh := make(chan struct{})
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-sigCh
+		glog.Infof("Got %v, shutting down", sig)
+		server.Shutdown(shutdownTimeout)
+		stopTapManager(tapManager)
+		glog.Flush()
+		close(doneCh)
+	}()
+	return doneCh
+}
+
+// stopTapManager asks tapmanager process to exit and waits for it
+func stopTapManager(cmd *exec.Cmd) {
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		glog.Warningf("Can't stop tapmanager: %v", err)
+		return
+	}
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- cmd.Wait()
+	}()
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			glog.Warningf("Tapmanager exited with error: %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		glog.Warningf("Timed out waiting for tapmanager to exit")
+	}
+}
+
+// enableCoreDumps makes the Go runtime abort the process with
+// SIGABRT upon an unrecovered panic and lifts the core size limit
+// so the kernel writes a core dump
+func enableCoreDumps() {
+	debug.SetTraceback("crash")
+	// syscall.RLIM_INFINITY is -1 and can't be used as uint64
+	unlimited := ^uint64(0)
+	limit := &syscall.Rlimit{Cur: unlimited, Max: unlimited}
+	if err := syscall.Setrlimit(syscall.RLIMIT_CORE, limit); err != nil {
+		glog.Warningf("Can't lift the core size limit: %v", err)
+	}
+}
+
+// openAuditLog opens the audit log specified using -audit-log
+// flag for the component. It returns nil if auditing is disabled
+func openAuditLog(component string) *audit.Log {
+	if *auditLogPath == "" {
+		return nil
+	}
+	l, err := audit.Open(*auditLogPath, component)
+	if err != nil {
+		glog.Errorf("Error opening the audit log: %v", err)
+		os.Exit(1)
+	}
+	return l
+}
+
+// fdServerSocketPermissions returns the mode and the owner for fd
+// server socket. The socket is owned by the emulator user so vmwrapper
+// can connect to it
+func fdServerSocketPermissions() (os.FileMode, int, int, error) {
+	var mode os.FileMode
+	if *fdServerSocketMode != "" {
+		m, err := strconv.ParseUint(*fdServerSocketMode, 8, 32)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("bad socket mode %q: %v", *fdServerSocketMode, err)
+		}
+		mode = os.FileMode(m)
+	}
+	uid, gid, err := libvirttools.EmulatorUserIDs()
+	if err != nil {
+		glog.Warningf("Couldn't find the emulator user, not changing the owner of tapmanager socket: %v", err)
+		uid, gid = -1, -1
+	}
+	if *fdServerSocketGroup != "" {
+		g, err := user.LookupGroup(*fdServerSocketGroup)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return 0, 0, 0, fmt.Errorf("bad gid %q for group %q: %v", g.Gid, *fdServerSocketGroup, err)
+		}
+	}
+	return mode, uid, gid, nil
 }
 
 func runTapManager() {
+	var cniClient cni.CNIClient
 	cniClient, err := cni.NewClient(*cniPluginsDir, *cniConfigsDir)
 	if err != nil {
 		glog.Errorf("Error initializing CNI client: %v", err)
 		os.Exit(1)
 	}
+	if *cniMaxConcurrentOps > 0 {
+		cniClient = cni.NewLimitedClient(cniClient, *cniMaxConcurrentOps)
+	}
 	src, err := tapmanager.NewTapFDSource(cniClient)
 	if err != nil {
 		glog.Errorf("Error creating tap fd source: %v", err)
 		os.Exit(1)
 	}
-	os.Remove(*fdServerSocketPath) // FIXME
-	s := tapmanager.NewFDServer(*fdServerSocketPath, src)
-	if err = s.Serve(); err != nil {
-		glog.Errorf("FD server returned error: %v", err)
+	src.SetSetupTimeout(*networkSetupTimeout)
+	src.SetAddressConflictTimeout(*addressConflictTimeout)
+	pathMTUCheckMode, err := tapmanager.ParsePathMTUCheckMode(*pathMTUCheck)
+	if err != nil {
+		glog.Errorf("Invalid -path-mtu-check: %v", err)
 		os.Exit(1)
 	}
-	if err := libvirttools.ChownForEmulator(*fdServerSocketPath); err != nil {
-		glog.Warningf("couldn't set tapmanager socket permissions: %v", err)
+	src.SetPathMTUCheck(pathMTUCheckMode, *pathMTUProbeTimeout)
+	if *cniResultHook != "" {
+		src.SetCNIResultHook(tapmanager.NewExecCNIResultHook(*cniResultHook))
+	}
+	src.SetNetBootDir(*netBootDir)
+	if *pendingCNIDelDir != "" {
+		src.SetPendingCNIDelDir(*pendingCNIDelDir)
+		go src.RunCNIDelReconciler(*pendingCNIDelInterval, nil)
+	}
+	mode, uid, gid, err := fdServerSocketPermissions()
+	if err != nil {
+		glog.Errorf("Bad fd server socket settings: %v", err)
+		os.Exit(1)
+	}
+	s := tapmanager.NewFDServer(*fdServerSocketPath, src)
+	s.SetSocketPermissions(mode, uid, gid)
+	auditLog := openAuditLog("tapmanager")
+	s.SetAuditLog(auditLog)
+	serving := false
+	if *fdServerHandoff {
+		if err := s.TakeOver(); err != nil {
+			glog.Warningf("Can't take over fd server socket, starting from scratch: %v", err)
+		} else {
+			serving = true
+		}
+	}
+	if !serving {
+		if err = s.Serve(); err != nil {
+			glog.Errorf("FD server returned error: %v", err)
+			os.Exit(1)
+		}
+	}
+	go exitAfterHandoff(s)
+	os.NewFile(tapManagerReadyFD, "tapmanager-ready").Close()
+	if *tapManagerMetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", tapmanager.NewMetricsHandler(src))
+		go func() {
+			if err := http.ListenAndServe(*tapManagerMetricsAddr, mux); err != nil {
+				glog.Errorf("Error serving tapmanager metrics: %v", err)
+			}
+		}()
+	}
+	if *enableNICHotplug {
+		// vmwrapper only enables QMP sockets for the VMs
+		// if this directory exists
+		if err := os.MkdirAll(tapmanager.QMPSocketDir, 0770); err != nil {
+			glog.Errorf("Can't create QMP socket dir: %v", err)
+			os.Exit(1)
+		}
+		if err := os.Chown(tapmanager.QMPSocketDir, uid, gid); err != nil {
+			glog.Errorf("Can't set QMP socket dir owner: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *enablePcap && *tapManagerAPIAddr == "" {
+		glog.Warning("-enable-pcap has no effect without -tapmanager-api-address")
+	}
+	if *tapManagerAPIAddr != "" && (*enablePcap || *enableNICHotplug) {
+		// the API gives access to the traffic and the NICs of
+		// the VMs, so it must not be reachable from outside of
+		// the node
+		if err := checkLocalAddress(*tapManagerAPIAddr); err != nil {
+			glog.Errorf("Bad -tapmanager-api-address: %v", err)
+			os.Exit(1)
+		}
+		authorizer := manager.NewK8sPodAuthorizer()
+		mux := http.NewServeMux()
+		if *enablePcap {
+			mux.Handle("/pcap", tapmanager.NewCaptureHandler(src, authorizer, auditLog))
+		}
+		if *enableNICHotplug {
+			mux.Handle("/attach-network", tapmanager.NewAttachNetworkHandler(src, s, authorizer, auditLog))
+			mux.Handle("/detach-network", tapmanager.NewDetachNetworkHandler(src, s, authorizer, auditLog))
+		}
+		if err := serveHTTP(*tapManagerAPIAddr, mux, "tapmanager API"); err != nil {
+			glog.Errorf("Error serving tapmanager API: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *tapManagerDebugAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/state", tapmanager.NewDebugHandler(src, s))
+		if err := serveHTTP(*tapManagerDebugAddr, mux, "tapmanager debug endpoint"); err != nil {
+			glog.Errorf("Error serving tapmanager debug endpoint: %v", err)
+			os.Exit(1)
+		}
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigCh
+	glog.Infof("Got %v, stopping tapmanager", sig)
+	// the pod networks are left intact for the running VMs,
+	// the next tapmanager process recovers them
+	src.Detach()
+	s.Stop()
+	glog.Flush()
+}
+
+// checkLocalAddress verifies that addr is either a unix socket
+// path or a loopback TCP address
+func checkLocalAddress(addr string) error {
+	if strings.HasPrefix(addr, "/") {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("%q is neither a unix socket path nor a loopback address", addr)
+	}
+	return nil
+}
+
+// serveHTTP serves the handler on the specified address in
+// background. Addresses starting with '/' are treated as unix
+// socket paths
+func serveHTTP(addr string, handler http.Handler, what string) error {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("can't remove stale socket %q: %v", addr, err)
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Chmod(addr, 0600); err != nil {
+			l.Close()
+			return fmt.Errorf("can't set the mode of %q: %v", addr, err)
+		}
+		// make the peer credentials available as
+		// the remote address for the audit log
+		l = audit.NewPeerListener(l)
 	}
-	for {
-		time.Sleep(1000 * time.Hour)
+	go func() {
+		if err := http.Serve(l, handler); err != nil {
+			glog.Errorf("Error serving %s: %v", what, err)
+		}
+	}()
+	return nil
+}
+
+func startCSINodePlugin(endpoint string) {
+	nodeId := os.Getenv("KUBE_NODE_NAME")
+	if nodeId == "" {
+		var err error
+		if nodeId, err = os.Hostname(); err != nil {
+			glog.Errorf("Can't get the hostname: %v", err)
+			os.Exit(1)
+		}
 	}
+	driver := flexvolume.NewFlexVolumeDriver(utils.NewUuid, flexvolume.NewLinuxMounter())
+	plugin := csi.NewNodePlugin(driver, nodeId)
+	go func() {
+		if err := plugin.Serve(endpoint); err != nil {
+			glog.Errorf("Error serving CSI node plugin: %v", err)
+			os.Exit(1)
+		}
+	}()
 }
 
-func startTapManagerProcess() {
+// startTapManagerProcess starts tapmanager in a child process and
+// returns it along with the pipe that's closed by it once it's serving
+func startTapManagerProcess() (*exec.Cmd, *os.File) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		glog.Errorf("error creating tapmanager pipe: %v", err)
+		os.Exit(1)
+	}
 	cmd := exec.Command(os.Args[0], os.Args[1:]...)
 	cmd.Env = append(os.Environ(), WantTapManagerEnv+"=1")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	// this becomes tapManagerReadyFD in the child process
+	cmd.ExtraFiles = []*os.File{w}
 	// Here we make this process die with the main Virtlet process.
 	// Note that this is Linux-specific, and also it may fail if virtlet is PID 1:
 	// https://github.com/golang/go/issues/9263
@@ -152,14 +732,89 @@ func startTapManagerProcess() {
 		glog.Errorf("error starting tapmanager process: %v", err)
 		os.Exit(1)
 	}
+	w.Close()
+	return cmd, r
+}
+
+// waitForTapManager waits till tapmanager process closes its end of
+// the pipe, which happens once it's serving or if it exits
+func waitForTapManager(tapManagerReady *os.File) {
+	doneCh := make(chan struct{})
+	go func() {
+		ioutil.ReadAll(tapManagerReady)
+		tapManagerReady.Close()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(TapManagerConnectInterval * TapManagerAttemptCount):
+		glog.Warningf("Timed out waiting for tapmanager to start")
+	}
+}
+
+// exitAfterHandoff makes both Virtlet processes exit after the fd
+// server is taken over by the tapmanager of the new Virtlet pod.
+// The file descriptors are not released so the VMs keep running
+// with their network intact
+func exitAfterHandoff(s *tapmanager.FDServer) {
+	<-s.HandedOff()
+	glog.Infof("The fd server is taken over by the new tapmanager, exiting")
+	glog.Flush()
+	if err := syscall.Kill(os.Getppid(), syscall.SIGTERM); err != nil {
+		glog.Errorf("Can't stop Virtlet process: %v", err)
+	}
+	os.Exit(0)
+}
+
+// instanceDataPaths maps the names of the flags that specify the
+// paths inside Virtlet data directory to the paths relative to it
+var instanceDataPaths = map[string]string{
+	"bolt-path":             "virtlet.db",
+	"fd-server-socket-path": "tapfdserver.sock",
+	"pending-cni-del-dir":   "pending-cni-del",
+	"crash-dump-dir":        "crash-dumps",
+	"crash-report-dir":      "crash-reports",
+}
+
+// applyInstance sets the name of Virtlet instance and moves the
+// paths that aren't set explicitly to the data directory of the
+// instance and makes the CRI socket name instance specific
+func applyInstance() error {
+	if err := instance.Set(*instanceName); err != nil {
+		return err
+	}
+	tapmanager.QMPSocketDir = instance.DataPath("qmp")
+	if instance.Name() == "" {
+		return nil
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, path := range instanceDataPaths {
+		if !explicit[name] {
+			flag.Set(name, instance.DataPath(path))
+		}
+	}
+	if !explicit["listen"] {
+		flag.Set("listen", instance.SocketPath(*listen))
+	}
+	return os.MkdirAll(instance.DataDir(), 0755)
 }
 
 func main() {
 	flag.Parse()
 	rand.Seed(time.Now().UnixNano())
+	if err := applyInstance(); err != nil {
+		glog.Errorf("Error setting Virtlet instance: %v", err)
+		os.Exit(1)
+	}
+	if flag.Arg(0) == "check-node" {
+		runNodeCheck()
+		return
+	}
 	if os.Getenv(WantTapManagerEnv) == "" {
-		startTapManagerProcess()
-		runVirtlet()
+		runVirtlet(startTapManagerProcess())
 	} else {
 		runTapManager()
 	}
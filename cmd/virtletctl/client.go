@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serviceAccountTokenFile is the path of the service account token
+// that's used by virtletctl commands if no -token is specified
+var serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// httpClient returns http client and base URL for the server which
+// is either http(s) URL or a path to unix socket
+func httpClient(server string) (*http.Client, string) {
+	if !strings.HasPrefix(server, "/") {
+		return http.DefaultClient, server
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", server)
+			},
+		},
+	}, "http://unix"
+}
+
+// authorizationHeader returns the value of Authorization header
+// for the requests to the Virtlet APIs that check the identity of
+// the user. If the token is empty, the service account token is used
+func authorizationHeader(token string) (string, error) {
+	if token == "" {
+		bs, err := ioutil.ReadFile(serviceAccountTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("-token not specified and service account token can't be read: %v", err)
+		}
+		token = strings.TrimSpace(string(bs))
+	}
+	return "Bearer " + token, nil
+}
+
+// checkResponse returns an error that includes the status and the
+// body of the response unless the request has succeeded. The error
+// message is prefixed with failure
+func checkResponse(resp *http.Response, failure string) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	msg, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%s: %s: %s", failure, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// splitPodName splits [NAMESPACE/]POD argument
+// into the namespace and the name of the pod
+func splitPodName(s, defaultNamespace string) (string, string) {
+	if parts := strings.SplitN(s, "/", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return defaultNamespace, s
+}
+
+// stringList is a flag.Value that collects the values of a
+// flag that can be specified multiple times
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
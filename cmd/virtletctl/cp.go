@@ -0,0 +1,132 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+)
+
+// vmPathRx matches [NAMESPACE/]POD:/PATH
+var vmPathRx = regexp.MustCompile(`^(?:([a-z0-9][a-z0-9.-]*)/)?([a-z0-9][a-z0-9.-]*):(/.*)$`)
+
+type vmPath struct {
+	namespace, pod, path string
+}
+
+// parseVMPath parses [NAMESPACE/]POD:/PATH, returning nil
+// if the argument denotes a local file
+func parseVMPath(s, defaultNamespace string) *vmPath {
+	m := vmPathRx.FindStringSubmatch(s)
+	if m == nil {
+		return nil
+	}
+	p := &vmPath{namespace: m[1], pod: m[2], path: m[3]}
+	if p.namespace == "" {
+		p.namespace = defaultNamespace
+	}
+	return p
+}
+
+func cp(args []string) error {
+	fs := newFlagSet("cp")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s cp [options] SRC DST\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "One of SRC and DST must be [NAMESPACE/]POD:/PATH, the other one is a local file ('-' means stdin/stdout).\n")
+		fmt.Fprintf(stderr, "The user must be allowed to create pods/cp subresource of the pod.\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", "/run/virtlet-file-copy.sock", "URL or unix socket path of the file copy API of the node (see file_copy_address in virtlet-config)")
+	namespace := fs.String("namespace", "default", "Namespace of the pod if it's not specified in SRC or DST")
+	token := fs.String("token", "", "Bearer token of the user. The service account token of the pod is used by default")
+	if err := parseArgs(fs, args, 2, 2); err != nil {
+		return err
+	}
+
+	src, dst := fs.Arg(0), fs.Arg(1)
+	srcVM, dstVM := parseVMPath(src, *namespace), parseVMPath(dst, *namespace)
+	var target *vmPath
+	switch {
+	case srcVM != nil && dstVM != nil:
+		return errors.New("copying between VMs is not supported")
+	case srcVM == nil && dstVM == nil:
+		return errors.New("either SRC or DST must be [NAMESPACE/]POD:/PATH")
+	case srcVM != nil:
+		target = srcVM
+	default:
+		target = dstVM
+	}
+	authHeader, err := authorizationHeader(*token)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("namespace", target.namespace)
+	q.Set("name", target.pod)
+	q.Set("path", target.path)
+	client, baseURL := httpClient(*server)
+	u := baseURL + "/cp?" + q.Encode()
+
+	var req *http.Request
+	if dstVM != nil {
+		var r io.Reader = os.Stdin
+		if src != "-" {
+			f, err := os.Open(src)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		req, err = http.NewRequest(http.MethodPut, u, r)
+	} else {
+		req, err = http.NewRequest(http.MethodGet, u, nil)
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authHeader)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "copy failed"); err != nil {
+		return err
+	}
+	if dstVM != nil {
+		return nil
+	}
+
+	w := stdout
+	if dst != "-" {
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
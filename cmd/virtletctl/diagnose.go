@@ -0,0 +1,107 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+)
+
+func diagnose(args []string) error {
+	fs := newFlagSet("diagnose")
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	asJSON := fs.Bool("json", false, "Output the network check report in JSON format")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	client, baseURL := httpClient(*server)
+	resp, err := client.Post(baseURL+"/debug/network-check", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+
+	var report struct {
+		Interfaces []struct {
+			Name         string `json:"name"`
+			HardwareAddr string `json:"hardwareAddr"`
+			MTU          int    `json:"mtu"`
+		} `json:"interfaces"`
+		IPs     []string `json:"ips"`
+		Routes  []string `json:"routes"`
+		PathMTU []struct {
+			Interface  int    `json:"interface"`
+			Gateway    string `json:"gateway"`
+			MTU        int    `json:"mtu"`
+			PathMTU    int    `json:"pathMTU"`
+			TooBigFrom string `json:"tooBigFrom"`
+		} `json:"pathMTU"`
+		Problems []string `json:"problems"`
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, &report); err != nil {
+		return fmt.Errorf("error decoding the response: %v", err)
+	}
+	if *asJSON {
+		if _, err := stdout.Write(body); err != nil {
+			return err
+		}
+	} else {
+		w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "INTERFACE\tNAME\tMAC\tMTU\tPATH MTU")
+		for n, iface := range report.Interfaces {
+			name, mac, pathMTU := iface.Name, iface.HardwareAddr, "-"
+			if name == "" {
+				name = "-"
+			}
+			if mac == "" {
+				mac = "-"
+			}
+			for _, pm := range report.PathMTU {
+				if pm.Interface == n && pm.PathMTU != 0 {
+					pathMTU = fmt.Sprintf("%d (%s)", pm.PathMTU, pm.Gateway)
+				}
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", n, name, mac, iface.MTU, pathMTU)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "IPs: %s\n", strings.Join(report.IPs, ", "))
+		fmt.Fprintf(stdout, "Routes: %s\n", strings.Join(report.Routes, ", "))
+		for _, problem := range report.Problems {
+			fmt.Fprintf(stdout, "Problem: %s\n", problem)
+		}
+	}
+	if len(report.Problems) != 0 {
+		return fmt.Errorf("%d problem(s) found in the network configuration", len(report.Problems))
+	}
+	if !*asJSON {
+		fmt.Fprintln(stdout, "The network configuration is ok")
+	}
+	return nil
+}
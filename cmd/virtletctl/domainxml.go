@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+)
+
+func domainXML(args []string) error {
+	fs := newFlagSet("domain-xml")
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	podId := fs.String("pod-id", "", "Id of the pod sandbox")
+	namespace := fs.String("namespace", "default", "Namespace of the pod")
+	podName := fs.String("pod", "", "Name of the pod (used if -pod-id is not specified)")
+	var annotations stringList
+	fs.Var(&annotations, "annotation", "Pod annotation to set as KEY=VALUE, KEY= removes the annotation. Can be specified multiple times")
+	show := fs.String("show", "", "What to show: 'defined' for the domain definition stored by libvirt, 'rendered' for the definition generated for the current annotations, 'proposed' for the definition generated for the updated annotations, 'diff' for the difference between 'rendered' and 'proposed'. The default is 'diff' if -annotation is specified and 'defined' otherwise")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	if *podId == "" && *podName == "" {
+		return errors.New("either -pod-id or -pod must be specified")
+	}
+	if *show == "" {
+		*show = "defined"
+		if len(annotations) != 0 {
+			*show = "diff"
+		}
+	}
+	switch *show {
+	case "defined", "rendered":
+	case "proposed", "diff":
+		if len(annotations) == 0 {
+			return fmt.Errorf("-show %s requires at least one -annotation", *show)
+		}
+	default:
+		return fmt.Errorf("bad -show value %q", *show)
+	}
+
+	q := url.Values{}
+	if *podId != "" {
+		q.Set("podId", *podId)
+	} else {
+		q.Set("namespace", *namespace)
+		q.Set("name", *podName)
+	}
+	for _, a := range annotations {
+		q.Add("annotation", a)
+	}
+	client, baseURL := httpClient(*server)
+	resp, err := client.Get(baseURL + "/debug/domain-xml?" + q.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+
+	var report struct {
+		Defined  string `json:"defined"`
+		Rendered string `json:"rendered"`
+		Proposed string `json:"proposed"`
+		Diff     string `json:"diff"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("error decoding the response: %v", err)
+	}
+	var out string
+	switch *show {
+	case "defined":
+		out = report.Defined
+	case "rendered":
+		out = report.Rendered
+	case "proposed":
+		out = report.Proposed
+	case "diff":
+		if report.Diff == "" {
+			fmt.Fprintln(stderr, "The annotations don't change the domain definition")
+			return nil
+		}
+		out = report.Diff
+	}
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	_, err = io.WriteString(stdout, out)
+	return err
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+func exportVolume(args []string) error {
+	fs := newFlagSet("export")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s export [options] [NAMESPACE/]POD OBJECT_URL\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Uploads a snapshot of a VM volume as a compressed qcow2 image to S3-compatible object storage.\n")
+		fmt.Fprintf(stderr, "The user must be allowed to create pods/export subresource of the pod.\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", "/run/virtlet-file-copy.sock", "URL or unix socket path of the file copy API of the node (see file_copy_address in virtlet-config)")
+	namespace := fs.String("namespace", "default", "Namespace of the pod if it's not specified")
+	volume := fs.String("volume", "root", "Name of the volume to export. 'root' denotes the root volume, other names refer to qcow2 flexvolumes")
+	secret := fs.String("secret", "", "Name of the secret in the namespace of the pod that contains accessKeyID, secretAccessKey and optionally region keys for the object storage")
+	token := fs.String("token", "", "Bearer token of the user. The service account token of the pod is used by default")
+	if err := parseArgs(fs, args, 2, 2); err != nil {
+		return err
+	}
+	if *secret == "" {
+		fs.Usage()
+		return errBadUsage
+	}
+	authHeader, err := authorizationHeader(*token)
+	if err != nil {
+		return err
+	}
+
+	ns, pod := splitPodName(fs.Arg(0), *namespace)
+	q := url.Values{}
+	q.Set("namespace", ns)
+	q.Set("name", pod)
+	q.Set("volume", *volume)
+	q.Set("url", fs.Arg(1))
+	q.Set("secret", *secret)
+	client, baseURL := httpClient(*server)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/export-volume?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authHeader)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "export failed"); err != nil {
+		return err
+	}
+	var result struct {
+		URL  string `json:"url"`
+		Size int64  `json:"size"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("error decoding the response: %v", err)
+	}
+	_, err = fmt.Fprintf(stdout, "Uploaded %d bytes to %s\n", result.Size, result.URL)
+	return err
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func images(args []string) error {
+	fs := newFlagSet("images")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s images [options] [IMAGE]\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Shows the images stored on the node, or only the specified image\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	asJSON := fs.Bool("json", false, "Output the image list in JSON format")
+	if err := parseArgs(fs, args, 0, 1); err != nil {
+		return err
+	}
+
+	client, baseURL := httpClient(*server)
+	u := baseURL + "/debug/images"
+	if fs.NArg() == 1 {
+		u += "?" + url.Values{"image": {fs.Arg(0)}}.Encode()
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+	if *asJSON {
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+
+	var imageList []struct {
+		Name        string     `json:"name"`
+		Format      string     `json:"format"`
+		VirtualSize uint64     `json:"virtualSize"`
+		DiskUsage   uint64     `json:"diskUsage"`
+		Arch        string     `json:"arch"`
+		LastUsed    *time.Time `json:"lastUsed"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&imageList); err != nil {
+		return fmt.Errorf("error decoding the response: %v", err)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tFORMAT\tVIRTUAL SIZE\tDISK USAGE\tARCH\tLAST USED")
+	for _, img := range imageList {
+		arch, lastUsed := img.Arch, "-"
+		if arch == "" {
+			arch = "-"
+		}
+		if img.LastUsed != nil {
+			lastUsed = img.LastUsed.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", img.Name, img.Format, img.VirtualSize, img.DiskUsage, arch, lastUsed)
+	}
+	return w.Flush()
+}
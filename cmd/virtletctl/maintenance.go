@@ -0,0 +1,88 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+func drainNode(args []string) error {
+	fs := newFlagSet("drain-node")
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	timeout := fs.Duration("timeout", 2*time.Minute, "Graceful shutdown timeout for each VM, after which it's powered off")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("action", "drain")
+	q.Set("timeout", timeout.String())
+	client, baseURL := httpClient(*server)
+	resp, err := client.Post(baseURL+"/debug/maintenance?"+q.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			ContainerId  string `json:"containerId"`
+			PodNamespace string `json:"podNamespace"`
+			PodName      string `json:"podName"`
+			Status       string `json:"status"`
+			Done         bool   `json:"done"`
+			Error        string `json:"error"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			return fmt.Errorf("error decoding the response: %v", err)
+		}
+		switch {
+		case event.Done && event.Error != "":
+			return fmt.Errorf("drain failed: %s", event.Error)
+		case event.Done:
+			fmt.Fprintln(stdout, "The node is in maintenance mode, all VMs are stopped")
+			return nil
+		case event.Error != "":
+			fmt.Fprintf(stdout, "%s/%s: %s: %s\n", event.PodNamespace, event.PodName, event.Status, event.Error)
+		default:
+			fmt.Fprintf(stdout, "%s/%s: %s\n", event.PodNamespace, event.PodName, event.Status)
+		}
+	}
+}
+
+func resumeNode(args []string) error {
+	fs := newFlagSet("resume-node")
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	client, baseURL := httpClient(*server)
+	resp, err := client.Post(baseURL+"/debug/maintenance?action=resume", "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return checkResponse(resp, "request failed")
+}
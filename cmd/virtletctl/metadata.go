@@ -0,0 +1,64 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+func metadataDump(args []string) error {
+	fs := newFlagSet("metadata")
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	asJSON := fs.Bool("json", false, "Output the full contents of the metadata store in JSON format")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	client, baseURL := httpClient(*server)
+	resp, err := client.Get(baseURL + "/debug/metadata")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+	if *asJSON {
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+
+	var state struct {
+		Sandboxes  map[string]json.RawMessage `json:"sandboxes"`
+		Containers map[string]json.RawMessage `json:"containers"`
+		Images     map[string]json.RawMessage `json:"images"`
+		VsockCIDs  map[string]uint32          `json:"vsockCIDs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+		return fmt.Errorf("error decoding the response: %v", err)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tCOUNT")
+	fmt.Fprintf(w, "sandboxes\t%d\n", len(state.Sandboxes))
+	fmt.Fprintf(w, "containers\t%d\n", len(state.Containers))
+	fmt.Fprintf(w, "images\t%d\n", len(state.Images))
+	fmt.Fprintf(w, "vsockCIDs\t%d\n", len(state.VsockCIDs))
+	return w.Flush()
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// networkAttachment implements attach-net and detach-net commands
+// that send the request to the specified path of the tapmanager API
+func networkAttachment(name, path string, args []string) error {
+	fs := newFlagSet(name)
+	server := fs.String("server", "/run/virtlet-tapmanager.sock", "URL or unix socket path of the tapmanager API of the node (see tapmanager_api_address in virtlet-config)")
+	token := fs.String("token", "", "Bearer token of the user that's allowed to create pods/network subresource of the pod. The service account token of the pod is used by default")
+	podId := fs.String("pod-id", "", "Id of the pod sandbox")
+	namespace := fs.String("namespace", "default", "Namespace of the pod")
+	podName := fs.String("pod", "", "Name of the pod (used if -pod-id is not specified)")
+	network := fs.String("network", "", "Name of CNI network (the name field of CNI config)")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	if *podId == "" && *podName == "" {
+		return errors.New("either -pod-id or -pod must be specified")
+	}
+	if *network == "" {
+		return errors.New("-network must be specified")
+	}
+	authHeader, err := authorizationHeader(*token)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if *podId != "" {
+		q.Set("podId", *podId)
+	} else {
+		q.Set("namespace", *namespace)
+		q.Set("name", *podName)
+	}
+	q.Set("network", *network)
+
+	client, baseURL := httpClient(*server)
+	req, err := http.NewRequest(http.MethodPost, baseURL+path+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authHeader)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+	_, err = io.Copy(stdout, resp.Body)
+	return err
+}
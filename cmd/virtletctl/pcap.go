@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func pcap(args []string) error {
+	fs := newFlagSet("pcap")
+	server := fs.String("server", "/run/virtlet-tapmanager.sock", "URL or unix socket path of the tapmanager API of the node (see tapmanager_api_address in virtlet-config)")
+	token := fs.String("token", "", "Bearer token of the user that's allowed to create pods/pcap subresource of the pod. The service account token of the pod is used by default")
+	podId := fs.String("pod-id", "", "Id of the pod sandbox")
+	namespace := fs.String("namespace", "default", "Namespace of the pod")
+	podName := fs.String("pod", "", "Name of the pod (used if -pod-id is not specified)")
+	iface := fs.Int("interface", 0, "Index of VM network interface")
+	side := fs.String("side", "tap", "Interface to capture the traffic on: 'tap' for VM's tap device, 'link' for CNI-provided link")
+	duration := fs.Duration("duration", 30*time.Second, "Capture duration")
+	maxBytes := fs.Int64("max-bytes", 0, "Capture size limit. 0 means the node default")
+	filter := fs.String("filter", "", "pcap filter expression")
+	output := fs.String("o", "-", "Output file. '-' means stdout")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	if *podId == "" && *podName == "" {
+		return errors.New("either -pod-id or -pod must be specified")
+	}
+	authHeader, err := authorizationHeader(*token)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	if *podId != "" {
+		q.Set("podId", *podId)
+	} else {
+		q.Set("namespace", *namespace)
+		q.Set("name", *podName)
+	}
+	q.Set("interface", strconv.Itoa(*iface))
+	q.Set("side", *side)
+	q.Set("duration", duration.String())
+	if *maxBytes != 0 {
+		q.Set("maxBytes", strconv.FormatInt(*maxBytes, 10))
+	}
+	if *filter != "" {
+		q.Set("filter", *filter)
+	}
+
+	client, baseURL := httpClient(*server)
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/pcap?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authHeader)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "capture failed"); err != nil {
+		return err
+	}
+
+	w := stdout
+	if *output != "-" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
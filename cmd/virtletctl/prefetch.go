@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// runKubectl runs kubectl with the specified arguments and returns its output
+func runKubectl(kubectl string, args ...string) (string, error) {
+	var errOut bytes.Buffer
+	cmd := exec.Command(kubectl, args...)
+	cmd.Stderr = &errOut
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %v: %s", kubectl, strings.Join(args, " "), err, strings.TrimSpace(errOut.String()))
+	}
+	return string(out), nil
+}
+
+// virtletPods returns a map from node names to the names of Virtlet
+// pods running on them, limited to the nodes matching nodeSelector
+// unless it's empty
+func virtletPods(kubectl, namespace, podSelector, nodeSelector string) (map[string]string, error) {
+	out, err := runKubectl(kubectl, "get", "pods", "-n", namespace, "-l", podSelector,
+		"-o", `jsonpath={range .items[*]}{.spec.nodeName}{" "}{.metadata.name}{"\n"}{end}`)
+	if err != nil {
+		return nil, err
+	}
+	pods := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		if parts := strings.Fields(line); len(parts) == 2 {
+			pods[parts[0]] = parts[1]
+		}
+	}
+	if nodeSelector == "" {
+		return pods, nil
+	}
+
+	out, err = runKubectl(kubectl, "get", "nodes", "-l", nodeSelector, "-o", "jsonpath={.items[*].metadata.name}")
+	if err != nil {
+		return nil, err
+	}
+	selected := make(map[string]string)
+	for _, node := range strings.Fields(out) {
+		if pod, found := pods[node]; found {
+			selected[node] = pod
+		}
+	}
+	return selected, nil
+}
+
+func prefetch(args []string) error {
+	fs := newFlagSet("prefetch")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s prefetch [options] IMAGE...\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Pulls the images on the nodes with Virtlet that match the node selector using kubectl.\n")
+		fmt.Fprintf(stderr, "The debug API must be enabled on the nodes (see debug_address in virtlet-config)\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	nodeSelector := fs.String("selector", "", "Label selector of the nodes. Empty value means all the nodes with Virtlet")
+	kubectl := fs.String("kubectl", "kubectl", "kubectl command to use")
+	namespace := fs.String("namespace", "kube-system", "Namespace of Virtlet pods")
+	podSelector := fs.String("pod-selector", "runtime=virtlet", "Label selector of Virtlet pods")
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API inside Virtlet pods")
+	if err := parseArgs(fs, args, 1, -1); err != nil {
+		return err
+	}
+
+	pods, err := virtletPods(*kubectl, *namespace, *podSelector, *nodeSelector)
+	if err != nil {
+		return err
+	}
+	if len(pods) == 0 {
+		return errors.New("no Virtlet pods found on the selected nodes")
+	}
+	var nodes []string
+	for node := range pods {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var outMutex sync.Mutex
+	var wg sync.WaitGroup
+	errs := make([]error, len(nodes))
+	for n, node := range nodes {
+		wg.Add(1)
+		go func(n int, node string) {
+			defer wg.Done()
+			cmdArgs := append([]string{"exec", "-n", *namespace, pods[node], "-c", "virtlet", "--", "virtletctl", "pull", "-server", *server}, fs.Args()...)
+			cmd := exec.Command(*kubectl, cmdArgs...)
+			pr, pw := io.Pipe()
+			cmd.Stdout = pw
+			cmd.Stderr = pw
+			go func() {
+				errs[n] = cmd.Run()
+				pw.Close()
+			}()
+			scanner := bufio.NewScanner(pr)
+			for scanner.Scan() {
+				outMutex.Lock()
+				fmt.Fprintf(stdout, "%s: %s\n", node, scanner.Text())
+				outMutex.Unlock()
+			}
+		}(n, node)
+	}
+	wg.Wait()
+
+	var failedNodes []string
+	for n, err := range errs {
+		if err != nil {
+			failedNodes = append(failedNodes, nodes[n])
+		}
+	}
+	if len(failedNodes) > 0 {
+		return fmt.Errorf("pulling the images failed on %d of %d nodes: %s", len(failedNodes), len(nodes), strings.Join(failedNodes, ", "))
+	}
+	fmt.Fprintf(stdout, "The images are pulled on %d nodes\n", len(nodes))
+	return nil
+}
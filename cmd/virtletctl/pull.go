@@ -0,0 +1,71 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+func pull(args []string) error {
+	fs := newFlagSet("pull")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s pull [options] IMAGE...\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Pulls the images into the image store of the node\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	if err := parseArgs(fs, args, 1, -1); err != nil {
+		return err
+	}
+
+	client, baseURL := httpClient(*server)
+	resp, err := client.Post(baseURL+"/debug/pull?"+url.Values{"image": fs.Args()}.Encode(), "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Image  string `json:"image"`
+			Status string `json:"status"`
+			Done   bool   `json:"done"`
+			Error  string `json:"error"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			return fmt.Errorf("error decoding the response: %v", err)
+		}
+		switch {
+		case event.Done && event.Error != "":
+			return errors.New(event.Error)
+		case event.Done:
+			return nil
+		case event.Error != "":
+			fmt.Fprintf(stdout, "%s: %s: %s\n", event.Image, event.Status, event.Error)
+		default:
+			fmt.Fprintf(stdout, "%s: %s\n", event.Image, event.Status)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+func qmp(args []string) error {
+	fs := newFlagSet("qmp")
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: %s qmp [options] [NAMESPACE/]POD COMMAND [ARGUMENTS_JSON]\n\n", os.Args[0])
+		fmt.Fprintf(stderr, "Runs a QMP command such as query-block using the QEMU monitor of a VM.\n")
+		fmt.Fprintf(stderr, "The user must be allowed to create pods/qmp subresource of the pod.\n\nOptions:\n")
+		fs.PrintDefaults()
+	}
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	namespace := fs.String("namespace", "default", "Namespace of the pod if it's not specified")
+	token := fs.String("token", "", "Bearer token of the user. The service account token of the pod is used by default")
+	if err := parseArgs(fs, args, 2, 3); err != nil {
+		return err
+	}
+
+	cmd := map[string]interface{}{"execute": fs.Arg(1)}
+	if fs.NArg() == 3 {
+		var cmdArgs map[string]interface{}
+		if err := json.Unmarshal([]byte(fs.Arg(2)), &cmdArgs); err != nil {
+			return fmt.Errorf("bad QMP command arguments: %v", err)
+		}
+		cmd["arguments"] = cmdArgs
+	}
+	body, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	authHeader, err := authorizationHeader(*token)
+	if err != nil {
+		return err
+	}
+
+	ns, pod := splitPodName(fs.Arg(0), *namespace)
+	q := url.Values{}
+	q.Set("namespace", ns)
+	q.Set("name", pod)
+	client, baseURL := httpClient(*server)
+	req, err := http.NewRequest(http.MethodPost, baseURL+"/qmp?"+q.Encode(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authHeader)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+	result, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, result, "", "  "); err != nil {
+		return fmt.Errorf("error decoding the response: %v", err)
+	}
+	out.WriteString("\n")
+	_, err = out.WriteTo(stdout)
+	return err
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"pcap": {
+		description: "capture the traffic of a VM pod network interface",
+		run:         pcap,
+	},
+	"attach-net": {
+		description: "attach a running VM to an additional CNI network",
+		run: func(args []string) error {
+			return networkAttachment("attach-net", "/attach-network", args)
+		},
+	},
+	"detach-net": {
+		description: "detach a VM from a network attached using attach-net",
+		run: func(args []string) error {
+			return networkAttachment("detach-net", "/detach-network", args)
+		},
+	},
+	"cp": {
+		description: "copy files into and out of a running VM using QEMU guest agent",
+		run:         cp,
+	},
+	"domain-xml": {
+		description: "show libvirt domain definition of a VM pod and how it changes with annotations",
+		run:         domainXML,
+	},
+	"volume-usage": {
+		description: "show host storage usage of VM volumes on the node",
+		run:         volumeUsage,
+	},
+	"pull": {
+		description: "pull images into the image store of the node in advance",
+		run:         pull,
+	},
+	"prefetch": {
+		description: "pull images in advance on the nodes selected by a label selector",
+		run:         prefetch,
+	},
+	"images": {
+		description: "show the images stored on the node with their format, sizes and last used time",
+		run:         images,
+	},
+	"metadata": {
+		description: "show the number of pod sandboxes, containers, images and vsock CIDs in Virtlet metadata store of the node",
+		run:         metadataDump,
+	},
+	"export": {
+		description: "upload a snapshot of a VM volume to S3-compatible object storage",
+		run:         exportVolume,
+	},
+	"qmp": {
+		description: "run an allowed QMP command using the QEMU monitor of a VM",
+		run:         qmp,
+	},
+	"drain-node": {
+		description: "put the node into maintenance mode and shut down its VMs",
+		run:         drainNode,
+	},
+	"resume-node": {
+		description: "turn off the maintenance mode of the node",
+		run:         resumeNode,
+	},
+	"diagnose": {
+		description: "verify the CNI configuration of the node by setting up the network for a temporary pod",
+		run:         diagnose,
+	},
+}
+
+// stdout and stderr are used for the output of the
+// commands so that it can be checked by the tests
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
+// errBadUsage is returned by the commands if their command line
+// is invalid. The usage of the command is printed in this case
+var errBadUsage = errors.New("bad command line")
+
+// newFlagSet returns the flag set for the command
+// that doesn't exit the program on errors
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	return fs
+}
+
+// parseArgs parses the command line of the command and checks that
+// the number of the positional arguments is between minArgs and
+// maxArgs. maxArgs < 0 means no upper limit
+func parseArgs(fs *flag.FlagSet, args []string, minArgs, maxArgs int) error {
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return err
+		}
+		// the flag package has already printed the usage
+		return errBadUsage
+	}
+	if fs.NArg() < minArgs || (maxArgs >= 0 && fs.NArg() > maxArgs) {
+		fs.Usage()
+		return errBadUsage
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(stderr, "Usage: %s COMMAND [options]\n\nCommands:\n", os.Args[0])
+	for name, cmd := range commands {
+		fmt.Fprintf(stderr, "  %-12s %s\n", name, cmd.description)
+	}
+	fmt.Fprintf(stderr, "\nUse %s COMMAND -h for the list of command options\n", os.Args[0])
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(1)
+	}
+	cmd, found := commands[os.Args[1]]
+	if !found {
+		usage()
+		os.Exit(1)
+	}
+	switch err := cmd.run(os.Args[2:]); err {
+	case nil, flag.ErrHelp:
+	case errBadUsage:
+		os.Exit(1)
+	default:
+		fmt.Fprintf(stderr, "%s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
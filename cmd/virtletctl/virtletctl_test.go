@@ -0,0 +1,525 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type fakeRequest struct {
+	method, uri, auth, body string
+}
+
+// fakeAPIServer records the requests and replies to them
+// with the specified status code and body
+type fakeAPIServer struct {
+	*httptest.Server
+	status   int
+	body     string
+	requests []fakeRequest
+}
+
+func newFakeAPIServer() *fakeAPIServer {
+	s := &fakeAPIServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.requests = append(s.requests, fakeRequest{
+			method: r.Method,
+			uri:    r.URL.RequestURI(),
+			auth:   r.Header.Get("Authorization"),
+			body:   string(body),
+		})
+		if s.status != http.StatusOK {
+			http.Error(w, s.body, s.status)
+			return
+		}
+		fmt.Fprint(w, s.body)
+	}))
+	return s
+}
+
+// runCommand runs virtletctl command with the specified arguments
+// and returns its output
+func runCommand(name string, args []string) (string, error) {
+	var out, errOut bytes.Buffer
+	oldStdout, oldStderr := stdout, stderr
+	stdout, stderr = &out, &errOut
+	defer func() {
+		stdout, stderr = oldStdout, oldStderr
+	}()
+	err := commands[name].run(args)
+	return out.String(), err
+}
+
+func withTempDir(t *testing.T, toCall func(tmpDir string)) {
+	tmpDir, err := ioutil.TempDir("", "virtletctl")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	toCall(tmpDir)
+}
+
+func TestParseVMPath(t *testing.T) {
+	for _, tc := range []struct {
+		arg      string
+		expected *vmPath
+	}{
+		{"cirros-vm:/etc/hostname", &vmPath{"default", "cirros-vm", "/etc/hostname"}},
+		{"kube-system/cirros-vm:/etc/hostname", &vmPath{"kube-system", "cirros-vm", "/etc/hostname"}},
+		{"cirros-vm:etc/hostname", nil},
+		{"/tmp/foo:/bar", nil},
+		{"hostname", nil},
+		{"-", nil},
+	} {
+		if p := parseVMPath(tc.arg, "default"); !reflect.DeepEqual(p, tc.expected) {
+			t.Errorf("parseVMPath(%q): %#v instead of %#v", tc.arg, p, tc.expected)
+		}
+	}
+}
+
+func TestCommandLineValidation(t *testing.T) {
+	srv := newFakeAPIServer()
+	defer srv.Close()
+	oldTokenFile := serviceAccountTokenFile
+	serviceAccountTokenFile = "/nonexistent/token"
+	defer func() { serviceAccountTokenFile = oldTokenFile }()
+
+	for _, tc := range []struct {
+		name string
+		cmd  string
+		args []string
+		err  error
+		msg  string
+	}{
+		{
+			name: "help",
+			cmd:  "images",
+			args: []string{"-h"},
+			err:  flag.ErrHelp,
+		},
+		{
+			name: "unknown flag",
+			cmd:  "volume-usage",
+			args: []string{"-foo"},
+			err:  errBadUsage,
+		},
+		{
+			name: "cp with a single argument",
+			cmd:  "cp",
+			args: []string{"-token", "foobar", "cirros-vm:/etc/hostname"},
+			err:  errBadUsage,
+		},
+		{
+			name: "cp between local files",
+			cmd:  "cp",
+			args: []string{"-token", "foobar", "foo", "bar"},
+			msg:  "either SRC or DST must be [NAMESPACE/]POD:/PATH",
+		},
+		{
+			name: "cp between VMs",
+			cmd:  "cp",
+			args: []string{"-token", "foobar", "vm1:/etc/hostname", "vm2:/etc/hostname"},
+			msg:  "copying between VMs is not supported",
+		},
+		{
+			name: "cp without a token",
+			cmd:  "cp",
+			args: []string{"cirros-vm:/etc/hostname", "-"},
+			msg:  "-token not specified and service account token can't be read",
+		},
+		{
+			name: "domain-xml without a pod",
+			cmd:  "domain-xml",
+			msg:  "either -pod-id or -pod must be specified",
+		},
+		{
+			name: "domain-xml diff without annotations",
+			cmd:  "domain-xml",
+			args: []string{"-pod", "cirros-vm", "-show", "diff"},
+			msg:  "-show diff requires at least one -annotation",
+		},
+		{
+			name: "domain-xml with bad -show",
+			cmd:  "domain-xml",
+			args: []string{"-pod", "cirros-vm", "-show", "foo"},
+			msg:  `bad -show value "foo"`,
+		},
+		{
+			name: "domain-xml with an extra argument",
+			cmd:  "domain-xml",
+			args: []string{"-pod", "cirros-vm", "foo"},
+			err:  errBadUsage,
+		},
+		{
+			name: "images with two images",
+			cmd:  "images",
+			args: []string{"cirros", "ubuntu"},
+			err:  errBadUsage,
+		},
+		{
+			name: "pull without images",
+			cmd:  "pull",
+			err:  errBadUsage,
+		},
+		{
+			name: "prefetch without images",
+			cmd:  "prefetch",
+			err:  errBadUsage,
+		},
+		{
+			name: "export without object URL",
+			cmd:  "export",
+			args: []string{"-token", "foobar", "-secret", "s3-creds", "cirros-vm"},
+			err:  errBadUsage,
+		},
+		{
+			name: "export without secret",
+			cmd:  "export",
+			args: []string{"-token", "foobar", "cirros-vm", "http://example.com/bucket/vm.qcow2"},
+			err:  errBadUsage,
+		},
+		{
+			name: "qmp without command",
+			cmd:  "qmp",
+			args: []string{"-token", "foobar", "cirros-vm"},
+			err:  errBadUsage,
+		},
+		{
+			name: "qmp with too many arguments",
+			cmd:  "qmp",
+			args: []string{"-token", "foobar", "cirros-vm", "query-block", "{}", "foo"},
+			err:  errBadUsage,
+		},
+		{
+			name: "qmp with bad command arguments",
+			cmd:  "qmp",
+			args: []string{"-token", "foobar", "cirros-vm", "dump-guest-memory", "{"},
+			msg:  "bad QMP command arguments",
+		},
+		{
+			name: "drain-node with an extra argument",
+			cmd:  "drain-node",
+			args: []string{"foo"},
+			err:  errBadUsage,
+		},
+		{
+			name: "pcap without a pod",
+			cmd:  "pcap",
+			args: []string{"-token", "foobar"},
+			msg:  "either -pod-id or -pod must be specified",
+		},
+		{
+			name: "attach-net without a network",
+			cmd:  "attach-net",
+			args: []string{"-token", "foobar", "-pod", "cirros-vm"},
+			msg:  "-network must be specified",
+		},
+		{
+			name: "detach-net without a pod",
+			cmd:  "detach-net",
+			args: []string{"-token", "foobar", "-network", "calico"},
+			msg:  "either -pod-id or -pod must be specified",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.requests = nil
+			_, err := runCommand(tc.cmd, append([]string{"-server", srv.URL}, tc.args...))
+			switch {
+			case err == nil:
+				t.Errorf("the command didn't fail")
+			case tc.err != nil && err != tc.err:
+				t.Errorf("bad error %q instead of %q", err, tc.err)
+			case tc.msg != "" && !strings.Contains(err.Error(), tc.msg):
+				t.Errorf("bad error %q, expected it to contain %q", err, tc.msg)
+			}
+			if len(srv.requests) != 0 {
+				t.Errorf("unexpected requests: %#v", srv.requests)
+			}
+		})
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	srv := newFakeAPIServer()
+	defer srv.Close()
+
+	withTempDir(t, func(tmpDir string) {
+		localFile := filepath.Join(tmpDir, "hostname")
+		if err := ioutil.WriteFile(localFile, []byte("foobar"), 0644); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+		for _, tc := range []struct {
+			name    string
+			cmd     string
+			args    []string
+			status  int
+			request fakeRequest
+			msg     string
+		}{
+			{
+				name:    "cp from VM",
+				cmd:     "cp",
+				args:    []string{"-token", "foobar", "cirros-vm:/etc/hostname", "-"},
+				status:  http.StatusForbidden,
+				request: fakeRequest{"GET", "/cp?name=cirros-vm&namespace=default&path=%2Fetc%2Fhostname", "Bearer foobar", ""},
+				msg:     "copy failed: 403 Forbidden: access denied",
+			},
+			{
+				name:    "cp to VM",
+				cmd:     "cp",
+				args:    []string{"-token", "foobar", localFile, "kube-system/cirros-vm:/etc/hostname"},
+				status:  http.StatusRequestEntityTooLarge,
+				request: fakeRequest{"PUT", "/cp?name=cirros-vm&namespace=kube-system&path=%2Fetc%2Fhostname", "Bearer foobar", "foobar"},
+				msg:     "copy failed: 413 Request Entity Too Large: access denied",
+			},
+			{
+				name:    "domain-xml",
+				cmd:     "domain-xml",
+				args:    []string{"-pod", "cirros-vm", "-annotation", "VirtletVCPUCount=2"},
+				status:  http.StatusNotFound,
+				request: fakeRequest{"GET", "/debug/domain-xml?annotation=VirtletVCPUCount%3D2&name=cirros-vm&namespace=default", "", ""},
+				msg:     "request failed: 404 Not Found: access denied",
+			},
+			{
+				name:    "volume-usage",
+				cmd:     "volume-usage",
+				status:  http.StatusInternalServerError,
+				request: fakeRequest{"GET", "/debug/volume-usage", "", ""},
+				msg:     "request failed: 500 Internal Server Error: access denied",
+			},
+			{
+				name:    "images",
+				cmd:     "images",
+				args:    []string{"cirros"},
+				status:  http.StatusInternalServerError,
+				request: fakeRequest{"GET", "/debug/images?image=cirros", "", ""},
+				msg:     "request failed: 500 Internal Server Error: access denied",
+			},
+			{
+				name:    "metadata",
+				cmd:     "metadata",
+				status:  http.StatusInternalServerError,
+				request: fakeRequest{"GET", "/debug/metadata", "", ""},
+				msg:     "request failed: 500 Internal Server Error: access denied",
+			},
+			{
+				name:    "pull",
+				cmd:     "pull",
+				args:    []string{"cirros", "ubuntu"},
+				status:  http.StatusServiceUnavailable,
+				request: fakeRequest{"POST", "/debug/pull?image=cirros&image=ubuntu", "", ""},
+				msg:     "request failed: 503 Service Unavailable: access denied",
+			},
+			{
+				name:    "export",
+				cmd:     "export",
+				args:    []string{"-token", "foobar", "-secret", "s3-creds", "kube-system/cirros-vm", "http://example.com/bucket/vm.qcow2"},
+				status:  http.StatusForbidden,
+				request: fakeRequest{"POST", "/export-volume?name=cirros-vm&namespace=kube-system&secret=s3-creds&url=http%3A%2F%2Fexample.com%2Fbucket%2Fvm.qcow2&volume=root", "Bearer foobar", ""},
+				msg:     "export failed: 403 Forbidden: access denied",
+			},
+			{
+				name:    "qmp",
+				cmd:     "qmp",
+				args:    []string{"-token", "foobar", "cirros-vm", "query-block"},
+				status:  http.StatusForbidden,
+				request: fakeRequest{"POST", "/qmp?name=cirros-vm&namespace=default", "Bearer foobar", `{"execute":"query-block"}`},
+				msg:     "request failed: 403 Forbidden: access denied",
+			},
+			{
+				name:    "drain-node",
+				cmd:     "drain-node",
+				args:    []string{"-timeout", "1m"},
+				status:  http.StatusConflict,
+				request: fakeRequest{"POST", "/debug/maintenance?action=drain&timeout=1m0s", "", ""},
+				msg:     "request failed: 409 Conflict: access denied",
+			},
+			{
+				name:    "resume-node",
+				cmd:     "resume-node",
+				status:  http.StatusConflict,
+				request: fakeRequest{"POST", "/debug/maintenance?action=resume", "", ""},
+				msg:     "request failed: 409 Conflict: access denied",
+			},
+			{
+				name:    "diagnose",
+				cmd:     "diagnose",
+				status:  http.StatusInternalServerError,
+				request: fakeRequest{"POST", "/debug/network-check", "", ""},
+				msg:     "request failed: 500 Internal Server Error: access denied",
+			},
+			{
+				name:    "pcap",
+				cmd:     "pcap",
+				args:    []string{"-token", "foobar", "-pod-id", "69eec606-0493-5825-73a4-c5e0c0236155", "-filter", "icmp"},
+				status:  http.StatusForbidden,
+				request: fakeRequest{"GET", "/pcap?duration=30s&filter=icmp&interface=0&podId=69eec606-0493-5825-73a4-c5e0c0236155&side=tap", "Bearer foobar", ""},
+				msg:     "capture failed: 403 Forbidden: access denied",
+			},
+			{
+				name:    "attach-net",
+				cmd:     "attach-net",
+				args:    []string{"-token", "foobar", "-pod", "cirros-vm", "-network", "calico"},
+				status:  http.StatusForbidden,
+				request: fakeRequest{"POST", "/attach-network?name=cirros-vm&namespace=default&network=calico", "Bearer foobar", ""},
+				msg:     "request failed: 403 Forbidden: access denied",
+			},
+			{
+				name:    "detach-net",
+				cmd:     "detach-net",
+				args:    []string{"-token", "foobar", "-pod", "cirros-vm", "-network", "calico"},
+				status:  http.StatusForbidden,
+				request: fakeRequest{"POST", "/detach-network?name=cirros-vm&namespace=default&network=calico", "Bearer foobar", ""},
+				msg:     "request failed: 403 Forbidden: access denied",
+			},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				srv.requests = nil
+				srv.status = tc.status
+				srv.body = "access denied"
+				out, err := runCommand(tc.cmd, append([]string{"-server", srv.URL}, tc.args...))
+				switch {
+				case err == nil:
+					t.Errorf("the command didn't fail")
+				case err.Error() != tc.msg:
+					t.Errorf("bad error %q instead of %q", err, tc.msg)
+				}
+				if out != "" {
+					t.Errorf("unexpected output %q", out)
+				}
+				expectedRequests := []fakeRequest{tc.request}
+				if !reflect.DeepEqual(srv.requests, expectedRequests) {
+					t.Errorf("bad requests: %#v instead of %#v", srv.requests, expectedRequests)
+				}
+			})
+		}
+	})
+}
+
+func TestResponseHandling(t *testing.T) {
+	srv := newFakeAPIServer()
+	defer srv.Close()
+	srv.status = http.StatusOK
+
+	for _, tc := range []struct {
+		name string
+		cmd  string
+		args []string
+		body string
+		out  string
+		msg  string
+	}{
+		{
+			name: "cp from VM to stdout",
+			cmd:  "cp",
+			args: []string{"-token", "foobar", "cirros-vm:/etc/hostname", "-"},
+			body: "cirros-vm\n",
+			out:  "cirros-vm\n",
+		},
+		{
+			name: "qmp",
+			cmd:  "qmp",
+			args: []string{"-token", "foobar", "cirros-vm", "query-status"},
+			body: `{"running":true,"status":"running"}`,
+			out:  "{\n  \"running\": true,\n  \"status\": \"running\"\n}\n",
+		},
+		{
+			name: "qmp with bad response",
+			cmd:  "qmp",
+			args: []string{"-token", "foobar", "cirros-vm", "query-status"},
+			body: "foobar",
+			msg:  "error decoding the response",
+		},
+		{
+			name: "pull",
+			cmd:  "pull",
+			args: []string{"cirros"},
+			body: `{"image":"cirros","status":"pulling"}` + "\n" + `{"done":true}`,
+			out:  "cirros: pulling\n",
+		},
+		{
+			name: "failed pull",
+			cmd:  "pull",
+			args: []string{"cirros"},
+			body: `{"image":"cirros","status":"pulling"}` + "\n" + `{"done":true,"error":"no such image"}`,
+			out:  "cirros: pulling\n",
+			msg:  "no such image",
+		},
+		{
+			name: "truncated pull response",
+			cmd:  "pull",
+			args: []string{"cirros"},
+			body: `{"image":"cirros","status":"pulling"}`,
+			out:  "cirros: pulling\n",
+			msg:  "error decoding the response",
+		},
+		{
+			name: "drain-node",
+			cmd:  "drain-node",
+			body: `{"podNamespace":"default","podName":"cirros-vm","status":"stopped"}` + "\n" + `{"done":true}`,
+			out:  "default/cirros-vm: stopped\nThe node is in maintenance mode, all VMs are stopped\n",
+		},
+		{
+			name: "failed drain-node",
+			cmd:  "drain-node",
+			body: `{"done":true,"error":"timed out"}`,
+			msg:  "drain failed: timed out",
+		},
+		{
+			name: "diagnose with problems",
+			cmd:  "diagnose",
+			args: []string{"-json"},
+			body: `{"problems":["no default route"]}`,
+			out:  `{"problems":["no default route"]}`,
+			msg:  "1 problem(s) found in the network configuration",
+		},
+		{
+			name: "export",
+			cmd:  "export",
+			args: []string{"-token", "foobar", "-secret", "s3-creds", "cirros-vm", "http://example.com/bucket/vm.qcow2"},
+			body: `{"url":"http://example.com/bucket/vm.qcow2","size":4096}`,
+			out:  "Uploaded 4096 bytes to http://example.com/bucket/vm.qcow2\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv.body = tc.body
+			out, err := runCommand(tc.cmd, append([]string{"-server", srv.URL}, tc.args...))
+			switch {
+			case tc.msg == "" && err != nil:
+				t.Errorf("the command failed: %v", err)
+			case tc.msg != "" && err == nil:
+				t.Errorf("the command didn't fail")
+			case tc.msg != "" && !strings.Contains(err.Error(), tc.msg):
+				t.Errorf("bad error %q, expected it to contain %q", err, tc.msg)
+			}
+			if out != tc.out {
+				t.Errorf("bad output %q instead of %q", out, tc.out)
+			}
+		})
+	}
+}
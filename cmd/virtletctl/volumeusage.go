@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+func volumeUsage(args []string) error {
+	fs := newFlagSet("volume-usage")
+	server := fs.String("server", "/run/virtlet-debug.sock", "URL or unix socket path of the debug API of the node (see debug_address in virtlet-config)")
+	asJSON := fs.Bool("json", false, "Output the report in JSON format")
+	if err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	client, baseURL := httpClient(*server)
+	resp, err := client.Get(baseURL + "/debug/volume-usage")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, "request failed"); err != nil {
+		return err
+	}
+	if *asJSON {
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+
+	var report struct {
+		Volumes []struct {
+			Pool       string `json:"pool"`
+			Name       string `json:"name"`
+			Capacity   uint64 `json:"capacity"`
+			Allocation uint64 `json:"allocation"`
+		} `json:"volumes"`
+		TotalCapacity   uint64 `json:"totalCapacity"`
+		TotalAllocation uint64 `json:"totalAllocation"`
+		Savings         uint64 `json:"savings"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return fmt.Errorf("error decoding the response: %v", err)
+	}
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "POOL\tVOLUME\tCAPACITY\tALLOCATION")
+	for _, v := range report.Volumes {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\n", v.Pool, v.Name, v.Capacity, v.Allocation)
+	}
+	fmt.Fprintf(w, "\tTOTAL\t%d\t%d\n", report.TotalCapacity, report.TotalAllocation)
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stdout, "Saved by thin provisioning: %d bytes\n", report.Savings)
+	return err
+}
@@ -17,19 +17,21 @@ limitations under the License.
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/golang/glog"
 
+	"github.com/Mirantis/virtlet/pkg/instance"
 	"github.com/Mirantis/virtlet/pkg/nettools"
 	"github.com/Mirantis/virtlet/pkg/tapmanager"
 	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/version"
 )
 
 // Here we use cgo constructor trick to avoid threading-related problems
@@ -129,13 +131,25 @@ __attribute__((constructor (200))) void vmwrapper_handle_reexec(void) {
 import "C"
 
 const (
-	fdSocketPath    = "/var/lib/virtlet/tapfdserver.sock"
-	defaultEmulator = "/usr/bin/qemu-system-x86_64" // FIXME
-	emulatorVar     = "VIRTLET_EMULATOR"
-	netKeyEnvVar    = "VIRTLET_NET_KEY"
-	vmsProcFile     = "/var/lib/virtlet/vms.procfile"
+	fdSocketFile  = "tapfdserver.sock"
+	emulatorVar   = "VIRTLET_EMULATOR"
+	netKeyEnvVar  = "VIRTLET_NET_KEY"
+	qmpKeyEnvVar  = "VIRTLET_QMP_KEY"
+	netBootEnvVar = "VIRTLET_NET_BOOT"
+	vsockCIDVar   = "VIRTLET_VSOCK_CID"
+	vmsProcFile   = "vms.procfile"
+	// maxPCISlot is the last slot of a PCI bus
+	maxPCISlot = 0x1f
 )
 
+// defaultEmulators maps GOARCH values to the emulators that are
+// used by libvirt for capability checks
+var defaultEmulators = map[string]string{
+	"amd64":   "/usr/bin/qemu-system-x86_64",
+	"arm64":   "/usr/bin/qemu-system-aarch64",
+	"ppc64le": "/usr/bin/qemu-system-ppc64",
+}
+
 func extractLastUsedPCIAddress(args []string) int {
 	var lastUsed int
 	for _, arg := range args {
@@ -149,6 +163,75 @@ func extractLastUsedPCIAddress(args []string) int {
 	return lastUsed
 }
 
+// usesPCIRootBus returns true if the devices added by libvirt
+// are placed directly on the PCI root bus (pci.0), which is the
+// case for i440FX-based machine types. For other machine types
+// such as q35, QEMU is left to pick the addresses of the NICs
+func usesPCIRootBus(args []string) bool {
+	for _, arg := range args {
+		if strings.Contains(arg, "bus=pci.0,") {
+			return true
+		}
+	}
+	return false
+}
+
+// nicDeviceAddr returns the device options that place the NIC
+// at the specified slot of the PCI root bus, so the guest sees
+// the NICs at the same addresses each time the VM starts,
+// which keeps the names of the interfaces stable
+func nicDeviceAddr(pciRootBus bool, slot int) string {
+	if !pciRootBus || slot > maxPCISlot {
+		return ""
+	}
+	return fmt.Sprintf(",bus=pci.0,addr=0x%x", slot)
+}
+
+// openVhostNet opens vhost-net device for a tap netdev. It returns
+// -1 if vhost-net acceleration is disabled or not available on the
+// node, in which case plain tap netdev is used
+func openVhostNet() int {
+	fd, err := utils.OpenVhostNet()
+	if err != nil {
+		glog.Warningf("Can't use vhost-net, falling back to plain tap netdev: %v", err)
+		return -1
+	}
+	return fd
+}
+
+// virtioNetOptions returns the options of virtio-net devices
+// specified for the VM, checking that they're supported by the
+// emulator
+func virtioNetOptions(emulator string) (string, error) {
+	opts, err := utils.ParseVirtioNetOptions(os.Getenv(utils.VirtioNetOptionsEnvVar))
+	if err != nil || len(opts) == 0 {
+		return "", err
+	}
+	qemuVersion, err := utils.EmulatorVersion(emulator)
+	if err != nil {
+		return "", err
+	}
+	if err := opts.CheckQEMUVersion(qemuVersion); err != nil {
+		return "", err
+	}
+	return opts.DeviceOptions(), nil
+}
+
+// qmpArgs returns the emulator arguments that enable QMP
+// monitor socket for the specified key, if NIC hot-plug is
+// enabled in tapmanager
+func qmpArgs(key string) []string {
+	if _, err := os.Stat(tapmanager.QMPSocketDir); err != nil {
+		return nil
+	}
+	return []string{
+		"-chardev",
+		fmt.Sprintf("socket,id=virtlet-qmp,path=%s,server,nowait", tapmanager.QMPSocketPath(key)),
+		"-mon",
+		"chardev=virtlet-qmp,mode=control",
+	}
+}
+
 func main() {
 	// configure glog (apparently no better way to do it ...)
 	flag.CommandLine.Parse([]string{"-v=3", "-alsologtostderr=true"})
@@ -160,13 +243,31 @@ func main() {
 		}
 	}
 
+	// the paths of the named Virtlet instances are
+	// placed in their own data directories
+	if err := instance.Set(os.Getenv(instance.EnvVar)); err != nil {
+		glog.Errorf("Can't set Virtlet instance: %v", err)
+		os.Exit(1)
+	}
+	tapmanager.QMPSocketDir = instance.DataPath("qmp")
+
+	// refuse to start the VMs defined by incompatible Virtlet
+	// versions instead of misinterpreting their settings
+	domainVersion, err := version.FromEnv(os.Getenv(version.ProtocolVersionEnvVar))
+	if err == nil {
+		err = version.CheckDomainVersion(domainVersion)
+	}
+	if err != nil {
+		glog.Errorf("Can't start the VM: %v", err)
+		os.Exit(1)
+	}
+
 	runInAnotherContainer := os.Getuid() != 0
 
 	var pid int
-	var err error
 	if runInAnotherContainer {
 		glog.V(0).Infof("Obtaining PID of the VM container process...")
-		pid, err = utils.WaitForProcess(vmsProcFile)
+		pid, err = utils.WaitForProcess(instance.DataPath(vmsProcFile))
 		if err != nil {
 			glog.Errorf("Can't obtain PID of the VM container process")
 			os.Exit(1)
@@ -179,14 +280,27 @@ func main() {
 	if emulator == "" {
 		// this happens during 'qemu -help' invocation by libvirt
 		// (capability check)
-		emulator = defaultEmulator
+		emulator = defaultEmulators[runtime.GOARCH]
+		if emulator == "" {
+			glog.Errorf("Unsupported architecture %q", runtime.GOARCH)
+			os.Exit(1)
+		}
 	} else {
 		netFdKey := os.Getenv(netKeyEnvVar)
 		nextToUsePCIAddress := extractLastUsedPCIAddress(os.Args[1:]) + 1
+		pciRootBus := usesPCIRootBus(os.Args[1:])
 		nextToUseHostdevNo := 0
+		netBoot := os.Getenv(netBootEnvVar) != ""
+		nicOpts, err := virtioNetOptions(emulator)
+		if err != nil {
+			glog.Errorf("Bad virtio-net options: %v", err)
+			os.Exit(1)
+		}
 
 		if netFdKey != "" {
-			c := tapmanager.NewFDClient(fdSocketPath)
+			c := tapmanager.NewFDClient(instance.DataPath(fdSocketFile))
+			c.SetComponent("vmwrapper")
+			c.SetCompression(true)
 			if err := c.Connect(); err != nil {
 				glog.Errorf("Can't connect to fd server: %v", err)
 				os.Exit(1)
@@ -197,21 +311,45 @@ func main() {
 				os.Exit(1)
 			}
 
-			var descriptions []tapmanager.InterfaceDescription
-			if err := json.Unmarshal(marshaledData, &descriptions); err != nil {
-				glog.Errorf("Failed to unmarshal network interface info", err)
+			descriptions, err := tapmanager.ParseInterfaceInfo(marshaledData)
+			if err != nil {
+				glog.Errorf("Failed to parse network interface info: %v", err)
 				os.Exit(1)
 			}
 
+			var report tapmanager.NetdevReport
 			for i, desc := range descriptions {
 				switch desc.Type {
 				case nettools.InterfaceTypeTap:
+					netdev := fmt.Sprintf("tap%d", desc.FdIndex)
+					device := fmt.Sprintf("net%d", i)
+					bootIndex := ""
+					if netBoot {
+						// libvirt gives the disks boot indices
+						// starting from 1, so the first NIC
+						// is tried before them
+						bootIndex = ",bootindex=0"
+						netBoot = false
+					}
+					netdevOpts := fmt.Sprintf("tap,id=%s,fd=%d", netdev, fds[desc.FdIndex])
+					vhostFd := openVhostNet()
+					if vhostFd >= 0 {
+						netdevOpts += fmt.Sprintf(",vhost=on,vhostfd=%d", vhostFd)
+					}
 					netArgs = append(netArgs,
 						"-netdev",
-						fmt.Sprintf("tap,id=tap%d,fd=%d", desc.FdIndex, fds[desc.FdIndex]),
+						netdevOpts,
 						"-device",
-						fmt.Sprintf("virtio-net-pci,netdev=tap%d,id=net%d,mac=%s", desc.FdIndex, i, desc.HardwareAddr),
+						fmt.Sprintf("virtio-net-pci,netdev=%s,id=%s,mac=%s%s%s%s", netdev, device, desc.HardwareAddr,
+							nicDeviceAddr(pciRootBus, nextToUsePCIAddress), bootIndex, nicOpts),
 					)
+					report.Netdevs = append(report.Netdevs, tapmanager.NetdevDescription{
+						FdIndex: desc.FdIndex,
+						Netdev:  netdev,
+						Device:  device,
+						Vhost:   vhostFd >= 0,
+					})
+					nextToUsePCIAddress += 1
 				case nettools.InterfaceTypeVF:
 					netArgs = append(netArgs,
 						"-device",
@@ -223,6 +361,10 @@ func main() {
 							nextToUsePCIAddress,
 						),
 					)
+					report.Netdevs = append(report.Netdevs, tapmanager.NetdevDescription{
+						FdIndex: desc.FdIndex,
+						Device:  fmt.Sprintf("hostdev%d", nextToUseHostdevNo),
+					})
 					nextToUseHostdevNo += 1
 					nextToUsePCIAddress += 1
 				default:
@@ -231,6 +373,28 @@ func main() {
 					os.Exit(1)
 				}
 			}
+
+			// tapmanager uses the ids for stats and hot-unplug,
+			// so failing to report them isn't fatal for the VM
+			if err := c.Report(netFdKey, &report); err != nil {
+				glog.Warningf("Failed to report netdev ids for key %q: %v", netFdKey, err)
+			}
+
+			// QMP monitor is used by tapmanager to hot-plug NICs
+			netArgs = append(netArgs, qmpArgs(netFdKey)...)
+		} else if qmpKey := os.Getenv(qmpKeyEnvVar); qmpKey != "" {
+			// standby VMs don't have the network until they're
+			// claimed by a pod, so the NICs are hot-plugged
+			netArgs = append(netArgs, qmpArgs(qmpKey)...)
+		}
+
+		// vsock device goes after the NICs so it doesn't
+		// take the PCI slot reserved for a VF above
+		if vsockCID := os.Getenv(vsockCIDVar); vsockCID != "" {
+			netArgs = append(netArgs,
+				"-device",
+				fmt.Sprintf("vhost-vsock-pci,id=vsock0,guest-cid=%s", vsockCID),
+			)
 		}
 	}
 
@@ -244,6 +408,21 @@ func main() {
 		args = append([]string{os.Args[0]}, args...)
 	}
 
+	// the priority settings are per-thread, so they must be
+	// applied on the thread that execs the emulator
+	runtime.LockOSThread()
+	priority, err := utils.ParseEmulatorPriority(
+		os.Getenv(utils.EmulatorNiceEnvVar),
+		os.Getenv(utils.EmulatorIOPrioEnvVar),
+		os.Getenv(utils.EmulatorSchedEnvVar))
+	if err == nil {
+		err = priority.Apply()
+	}
+	if err != nil {
+		glog.Errorf("Can't apply emulator priority settings: %v", err)
+		os.Exit(1)
+	}
+
 	// below log hides any possible error in returned by libvirt virError
 	// glog.V(0).Infof("Executing emulator: %s", strings.Join(args, " "))
 	if err := syscall.Exec(args[0], args, env); err != nil {
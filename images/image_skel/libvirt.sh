@@ -13,23 +13,42 @@ if [[ -f /dind/vmwrapper ]]; then
   ln -fs /dind/vmwrapper /vmwrapper
 fi
 
+function load_kvm_modules {
+  modprobe kvm || { echo "Missing kvm module on the host" >&2; return 1; }
+  if grep vmx /proc/cpuinfo &>/dev/null; then
+    modprobe kvm_intel || { echo "Missing kvm_intel module on the host" >&2; return 1; }
+  elif grep svm /proc/cpuinfo &>/dev/null; then
+    modprobe kvm_amd || { echo "Missing kvm_amd module on the host" >&2; return 1; }
+  fi
+}
+
 if [[ ! ${VIRTLET_DISABLE_KVM:-} ]]; then
   if ! kvm-ok >&/dev/null; then
     # try to fix the environment by loading appropriate modules
-    modprobe kvm || ((echo "Missing kvm module on the host" >&2 && exit 1))
-    if grep vmx /proc/cpuinfo &>/dev/null; then
-      modprobe kvm_intel || (echo "Missing kvm_intel module on the host" >&2 && exit 1)
-    elif grep svm /proc/cpuinfo &>/dev/null; then
-      modprobe kvm_amd || (echo "Missing kvm_amd module on the host" >&2 && exit 1)
+    if ! load_kvm_modules && [[ ! ${VIRTLET_ALLOW_TCG_FALLBACK:-} ]]; then
+      exit 1
     fi
   fi
   if ! kvm-ok; then
     echo "*** VIRTLET_DISABLE_KVM is not set but KVM extensions are not available ***" >&2
-    echo "*** Virtlet startup failed ***" >&2
-    exit 1
+    if [[ ! ${VIRTLET_ALLOW_TCG_FALLBACK:-} ]]; then
+      echo "*** Virtlet startup failed ***" >&2
+      exit 1
+    fi
+    echo "*** VIRTLET_ALLOW_TCG_FALLBACK is set, VMs will use TCG emulation ***" >&2
   fi
 fi
 
+# vmwrapper needs CAP_SYS_NICE and CAP_SYS_ADMIN to apply the emulator
+# priority settings before it execs the emulator, but libvirt drops
+# all of the capabilities of the emulator process by default. Only
+# keep them when the priority settings are used as it weakens the
+# isolation of the emulator processes
+if [[ ${VIRTLET_EMULATOR_NICE:-}${VIRTLET_EMULATOR_IOPRIO:-}${VIRTLET_EMULATOR_SCHED:-} ]] &&
+     ! grep -q '^clear_emulator_capabilities' /etc/libvirt/qemu.conf; then
+  echo 'clear_emulator_capabilities = 0' >>/etc/libvirt/qemu.conf
+fi
+
 chown root:root /etc/libvirt/libvirtd.conf
 chown root:root /etc/libvirt/qemu.conf
 chmod 644 /etc/libvirt/libvirtd.conf
@@ -52,7 +71,7 @@ if [[ ${novirtlet} ]]; then
   daemon="--daemon"
 fi
 
-if [[ ! ${VIRTLET_DISABLE_KVM:-} ]]; then
+if [[ ! ${VIRTLET_DISABLE_KVM:-} && -e /dev/kvm ]]; then
   chown root:kvm /dev/kvm
 fi
 
@@ -14,9 +14,80 @@ else
   RAW_DEVICES=""
 fi
 
+CHECK_NETWORK=""
+if [[ ${VIRTLET_CHECK_NETWORK:-} ]]; then
+  CHECK_NETWORK="-check-network"
+fi
+
+TAPMANAGER_METRICS_ADDRESS="${VIRTLET_TAPMANAGER_METRICS_ADDRESS:-}"
+TAPMANAGER_DEBUG_ADDRESS="${VIRTLET_TAPMANAGER_DEBUG_ADDRESS:-}"
+TAPMANAGER_API_ADDRESS="${VIRTLET_TAPMANAGER_API_ADDRESS:-}"
+FILE_COPY_ADDRESS="${VIRTLET_FILE_COPY_ADDRESS:-}"
+DEBUG_ADDRESS="${VIRTLET_DEBUG_ADDRESS:-}"
+HEALTH_ADDRESS="${VIRTLET_HEALTH_ADDRESS:-127.0.0.1:10359}"
+CNI_MAX_CONCURRENT_OPS="${VIRTLET_CNI_MAX_CONCURRENT_OPS:-0}"
+ADDRESS_CONFLICT_TIMEOUT="${VIRTLET_ADDRESS_CONFLICT_TIMEOUT:-0}"
+PATH_MTU_CHECK="${VIRTLET_PATH_MTU_CHECK:-}"
+CNI_RESULT_HOOK="${VIRTLET_CNI_RESULT_HOOK:-}"
+NETBOOT_DIR="${VIRTLET_NETBOOT_DIR:-/var/lib/virtlet/netboot}"
+FSTRIM_INTERVAL="${VIRTLET_FSTRIM_INTERVAL:-0}"
+MEMORY_RECLAIM_INTERVAL="${VIRTLET_MEMORY_RECLAIM_INTERVAL:-0}"
+VM_POOL_SYNC_INTERVAL="${VIRTLET_VM_POOL_SYNC_INTERVAL:-0}"
+VM_SLOTS="${VIRTLET_VM_SLOTS:-0}"
+VM_SLOT_MEMORY="${VIRTLET_VM_SLOT_MEMORY:-}"
+VM_SLOT_CPU="${VIRTLET_VM_SLOT_CPU:-}"
+SLOW_LIBVIRT_CALL_THRESHOLD="${VIRTLET_SLOW_LIBVIRT_CALL_THRESHOLD:-5s}"
+METADATA_DURABILITY="${VIRTLET_METADATA_DURABILITY:-sync}"
+METADATA_BACKEND="${VIRTLET_METADATA_BACKEND:-bolt}"
+METADATA_FLUSH_INTERVAL="${VIRTLET_METADATA_FLUSH_INTERVAL:-10ms}"
+CRASH_DUMP_SPOOL_SIZE="${VIRTLET_CRASH_DUMP_SPOOL_SIZE:-0}"
+INSTANCE_NAME="${VIRTLET_INSTANCE:-}"
+CONSOLE_LOG_RATE_LIMIT="${VIRTLET_CONSOLE_LOG_RATE_LIMIT:-100}"
+CONSOLE_LOG_BURST="${VIRTLET_CONSOLE_LOG_BURST:-1000}"
+CSI_ENDPOINT="${VIRTLET_CSI_ENDPOINT:-}"
+if [[ ${CSI_ENDPOINT} ]]; then
+  mkdir -p "$(dirname "${CSI_ENDPOINT}")"
+fi
+AUDIT_LOG="${VIRTLET_AUDIT_LOG:-}"
+
+ENABLE_PCAP=""
+if [[ ${VIRTLET_ENABLE_PCAP:-} ]]; then
+  ENABLE_PCAP="-enable-pcap"
+fi
+
+CRASH_CORE_DUMP=""
+if [[ ${VIRTLET_CRASH_CORE_DUMP:-} ]]; then
+  CRASH_CORE_DUMP="-crash-core-dump"
+fi
+
+ENABLE_NIC_HOTPLUG=""
+if [[ ${VIRTLET_ENABLE_NIC_HOTPLUG:-} ]]; then
+  ENABLE_NIC_HOTPLUG="-enable-nic-hotplug"
+fi
+
+FD_SERVER_HANDOFF=""
+if [[ ${VIRTLET_FD_SERVER_HANDOFF:-} ]]; then
+  FD_SERVER_HANDOFF="-fd-server-handoff"
+fi
+
 PROTOCOL="${VIRTLET_DOWNLOAD_PROTOCOL:-https}"
 IMAGE_TRANSLATIONS_DIR="${IMAGE_TRANSLATIONS_DIR:-}"
 
+# domain template is taken from the optional virtlet-domain-template configmap
+if [[ ! ${VIRTLET_DOMAIN_TEMPLATE:-} && -f /etc/virtlet/domain-template/domain.xml ]]; then
+  export VIRTLET_DOMAIN_TEMPLATE=/etc/virtlet/domain-template/domain.xml
+fi
+
+# per-URL-prefix download settings are taken from the optional
+# virtlet-download-config configmap
+if [[ ! ${VIRTLET_DOWNLOAD_CONFIG:-} && -f /etc/virtlet/download-config/downloads.yaml ]]; then
+  export VIRTLET_DOWNLOAD_CONFIG=/etc/virtlet/download-config/downloads.yaml
+fi
+
+# the image blobs must be on the same mount as the image pool so they
+# can be hard linked, empty value disables image deduplication
+export VIRTLET_IMAGE_BLOBS_DIR="${VIRTLET_IMAGE_BLOBS_DIR-/var/lib/libvirt/image-blobs}"
+
 FLEXVOLUME_DIR=/usr/libexec/kubernetes/kubelet-plugins/volume/exec
 if [ ! -d ${FLEXVOLUME_DIR}/virtlet~flexvolume_driver ]; then
     mkdir ${FLEXVOLUME_DIR}/virtlet~flexvolume_driver
@@ -24,10 +95,16 @@ if [ ! -d ${FLEXVOLUME_DIR}/virtlet~flexvolume_driver ]; then
 fi
 
 
-while [ ! -S /var/run/libvirt/libvirt-sock ] ; do
-  echo >&1 "Waiting for libvirt..."
-  sleep 0.3
-done
+LIBVIRT_URI="${VIRTLET_LIBVIRT_URI:-qemu:///system}"
+
+# only wait for the local libvirtd, the connection to a remote
+# one is retried by restarting the container
+if [[ ${LIBVIRT_URI} = "qemu:///system" ]]; then
+  while [ ! -S /var/run/libvirt/libvirt-sock ] ; do
+    echo >&1 "Waiting for libvirt..."
+    sleep 0.3
+  done
+fi
 
 # FIXME: make tapfdsource do netns stuff in a separate process
 if [ -d /opt/cni/bin.orig ]; then
@@ -39,4 +116,15 @@ if [ -d /opt/cni/bin.orig ]; then
   done
 fi
 
-/usr/local/bin/virtlet -v=${VIRTLET_LOGLEVEL:-3} -logtostderr=true -image-download-protocol="${PROTOCOL}" -image-translations-dir="${IMAGE_TRANSLATIONS_DIR}" "${RAW_DEVICES}"
+# virtlet is started in background so that SIGTERM can be passed to
+# it, letting it flush its state and exit cleanly. The wait is
+# interrupted when the signal is trapped, so it's repeated until
+# virtlet exits
+/usr/local/bin/virtlet -v=${VIRTLET_LOGLEVEL:-3} -logtostderr=true -instance-name="${INSTANCE_NAME}" -libvirt-uri="${LIBVIRT_URI}" -image-download-protocol="${PROTOCOL}" -image-translations-dir="${IMAGE_TRANSLATIONS_DIR}" -tapmanager-metrics-address="${TAPMANAGER_METRICS_ADDRESS}" -tapmanager-debug-address="${TAPMANAGER_DEBUG_ADDRESS}" -tapmanager-api-address="${TAPMANAGER_API_ADDRESS}" -file-copy-address="${FILE_COPY_ADDRESS}" -debug-address="${DEBUG_ADDRESS}" -health-address="${HEALTH_ADDRESS}" -cni-max-concurrent-ops="${CNI_MAX_CONCURRENT_OPS}" -address-conflict-timeout="${ADDRESS_CONFLICT_TIMEOUT}" -path-mtu-check="${PATH_MTU_CHECK}" -cni-result-hook="${CNI_RESULT_HOOK}" -netboot-dir="${NETBOOT_DIR}" -fstrim-interval="${FSTRIM_INTERVAL}" -memory-reclaim-interval="${MEMORY_RECLAIM_INTERVAL}" -vm-pool-sync-interval="${VM_POOL_SYNC_INTERVAL}" -vm-slots="${VM_SLOTS}" -vm-slot-memory="${VM_SLOT_MEMORY}" -vm-slot-cpu="${VM_SLOT_CPU}" -slow-libvirt-call-threshold="${SLOW_LIBVIRT_CALL_THRESHOLD}" -metadata-durability="${METADATA_DURABILITY}" -metadata-backend="${METADATA_BACKEND}" -metadata-flush-interval="${METADATA_FLUSH_INTERVAL}" -crash-dump-spool-size="${CRASH_DUMP_SPOOL_SIZE}" -console-log-rate-limit="${CONSOLE_LOG_RATE_LIMIT}" -console-log-burst="${CONSOLE_LOG_BURST}" -csi-endpoint="${CSI_ENDPOINT}" -audit-log="${AUDIT_LOG}" ${CHECK_NETWORK} ${ENABLE_PCAP} ${ENABLE_NIC_HOTPLUG} ${CRASH_CORE_DUMP} ${FD_SERVER_HANDOFF} "${RAW_DEVICES}" &
+VIRTLET_PID=$!
+trap 'kill -TERM "${VIRTLET_PID}" 2>/dev/null || true' TERM INT
+status=0
+while kill -0 "${VIRTLET_PID}" 2>/dev/null; do
+  wait "${VIRTLET_PID}" && status=0 || status=$?
+done
+exit "${status}"
@@ -11,5 +11,10 @@ elif [[ -e /dev/kvm ]]; then
   chown libvirt-qemu.kvm /dev/kvm
 fi
 
-echo "$$ $(cut -d' ' -f22 /proc/$$/stat)" >/var/lib/virtlet/vms.procfile
+data_dir=/var/lib/virtlet
+if [[ ${VIRTLET_INSTANCE:-} ]]; then
+  data_dir="${data_dir}/instances/${VIRTLET_INSTANCE}"
+  mkdir -p "${data_dir}"
+fi
+echo "$$ $(cut -d' ' -f22 /proc/$$/stat)" >"${data_dir}/vms.procfile"
 sleep Infinity
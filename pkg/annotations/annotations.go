@@ -0,0 +1,321 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package annotations implements a typed parser for the pod
+// annotations that configure the VMs. The annotations are described
+// by a versioned schema, and the values that can't be parsed, as well
+// as the unknown annotations that have the prefix of the schema,
+// produce errors that point at the offending annotation and, where
+// possible, the position within its value.
+package annotations
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// use this instead of "gopkg.in/yaml.v2" so we don't get
+	// map[interface{}]interface{} when unmarshalling
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// FieldError describes a bad annotation
+type FieldError struct {
+	// Key is the annotation key
+	Key string
+	// Line is the 1-based line number within the annotation
+	// value, 0 if not applicable
+	Line int
+	// Column is the 1-based column number within the line
+	// of the annotation value, 0 if not applicable
+	Column int
+	// Message describes the problem
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("%s (line %d, column %d): %s", e.Key, e.Line, e.Column, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("%s (line %d): %s", e.Key, e.Line, e.Message)
+	case e.Column > 0:
+		return fmt.Sprintf("%s (column %d): %s", e.Key, e.Column, e.Message)
+	default:
+		return fmt.Sprintf("%s: %s", e.Key, e.Message)
+	}
+}
+
+// ErrorList is a list of annotation errors
+type ErrorList []*FieldError
+
+func (l ErrorList) Error() string {
+	lines := make([]string, len(l))
+	for n, e := range l {
+		lines[n] = e.Error()
+	}
+	return fmt.Sprintf("bad virtlet annotations. Errors:\n%s", strings.Join(lines, "\n"))
+}
+
+// Add appends an error for the specified annotation key to the list
+func (l *ErrorList) Add(key, format string, args ...interface{}) {
+	*l = append(*l, &FieldError{Key: key, Message: fmt.Sprintf(format, args...)})
+}
+
+// Err returns the list as an error, or nil if it's empty
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+type field struct {
+	parse func(value string) *FieldError
+}
+
+// Schema describes the annotations that share a common key prefix
+type Schema struct {
+	prefix     string
+	versionKey string
+	version    string
+	fields     map[string]field
+}
+
+// NewSchema returns a schema for the annotations with the specified
+// key prefix. The annotation specified by versionKey, if present,
+// must match the schema version.
+func NewSchema(prefix, versionKey, version string) *Schema {
+	return &Schema{
+		prefix:     prefix,
+		versionKey: versionKey,
+		version:    version,
+		fields:     make(map[string]field),
+	}
+}
+
+// Version returns the version of the schema
+func (s *Schema) Version() string {
+	return s.version
+}
+
+func (s *Schema) add(key string, parse func(value string) *FieldError) {
+	if _, found := s.fields[key]; found || key == s.versionKey {
+		panic("duplicate annotation key: " + key)
+	}
+	s.fields[key] = field{parse: parse}
+}
+
+// Known marks the annotations that are handled elsewhere,
+// so they're not reported as unknown ones
+func (s *Schema) Known(keys ...string) {
+	for _, key := range keys {
+		s.add(key, nil)
+	}
+}
+
+// Custom adds an annotation that's parsed by the specified function
+func (s *Schema) Custom(key string, parse func(value string) error) {
+	s.add(key, func(value string) *FieldError {
+		if err := parse(value); err != nil {
+			return &FieldError{Message: err.Error()}
+		}
+		return nil
+	})
+}
+
+// String adds an annotation with a string value. The surrounding
+// whitespace is removed from the value
+func (s *Schema) String(key string, target *string) {
+	s.add(key, func(value string) *FieldError {
+		*target = strings.TrimSpace(value)
+		return nil
+	})
+}
+
+// Text adds an annotation with a string value that's used as-is
+func (s *Schema) Text(key string, target *string) {
+	s.add(key, func(value string) *FieldError {
+		*target = value
+		return nil
+	})
+}
+
+// Enum adds an annotation which value must be one of the
+// specified ones
+func (s *Schema) Enum(key string, target *string, values ...string) {
+	s.add(key, func(value string) *FieldError {
+		value = strings.TrimSpace(value)
+		for _, v := range values {
+			if value == v {
+				*target = value
+				return nil
+			}
+		}
+		quoted := make([]string, len(values))
+		for n, v := range values {
+			quoted[n] = strconv.Quote(v)
+		}
+		return &FieldError{
+			Message: fmt.Sprintf("bad value %q, must be one of %s", value, strings.Join(quoted, ", ")),
+		}
+	})
+}
+
+// Bool adds an annotation with a boolean value
+func (s *Schema) Bool(key string, target *bool) {
+	s.add(key, func(value string) *FieldError {
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return &FieldError{Message: fmt.Sprintf("bad value %q, must be \"true\" or \"false\"", value)}
+		}
+		*target = b
+		return nil
+	})
+}
+
+// Int adds an annotation with an integer value in the
+// specified range
+func (s *Schema) Int(key string, target *int, min, max int) {
+	s.add(key, func(value string) *FieldError {
+		trimmed := strings.TrimSpace(value)
+		n, err := strconv.Atoi(trimmed)
+		if err != nil {
+			offset := strings.Index(value, trimmed)
+			for i, c := range trimmed {
+				if (c < '0' || c > '9') && !(i == 0 && (c == '-' || c == '+')) {
+					offset += i
+					break
+				}
+			}
+			return &FieldError{
+				Column:  offset + 1,
+				Message: fmt.Sprintf("bad integer value %q", value),
+			}
+		}
+		if n < min || n > max {
+			return &FieldError{Message: fmt.Sprintf("value %d out of range, must be between %d and %d", n, min, max)}
+		}
+		*target = n
+		return nil
+	})
+}
+
+// Duration adds an annotation with a positive duration value
+// such as 5m or 1h30m
+func (s *Schema) Duration(key string, target *time.Duration) {
+	s.add(key, func(value string) *FieldError {
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d <= 0 {
+			return &FieldError{Message: fmt.Sprintf("bad duration %q", value)}
+		}
+		*target = d
+		return nil
+	})
+}
+
+// Quantity adds an annotation with a positive size value
+// such as 512Mi or 10G. The target is set to the number of bytes
+func (s *Schema) Quantity(key string, target *int64) {
+	s.add(key, func(value string) *FieldError {
+		q, err := resource.ParseQuantity(strings.TrimSpace(value))
+		if err != nil || q.Value() <= 0 {
+			return &FieldError{Message: fmt.Sprintf("bad size %q", value)}
+		}
+		*target = q.Value()
+		return nil
+	})
+}
+
+// Lines adds an annotation that contains a list of items, one per
+// line. Empty lines are skipped
+func (s *Schema) Lines(key string, target *[]string) {
+	s.add(key, func(value string) *FieldError {
+		*target = nil
+		for _, l := range strings.Split(value, "\n") {
+			if l = strings.TrimSpace(l); l != "" {
+				*target = append(*target, l)
+			}
+		}
+		return nil
+	})
+}
+
+var yamlErrorRx = regexp.MustCompile(`^(?:error converting YAML to JSON: )?yaml: line (\d+): (.*)$`)
+
+// YAML adds an annotation with a YAML (or JSON) mapping value
+func (s *Schema) YAML(key string, target *map[string]interface{}) {
+	s.add(key, func(value string) *FieldError {
+		var m map[string]interface{}
+		if err := yaml.Unmarshal([]byte(value), &m); err != nil {
+			if parts := yamlErrorRx.FindStringSubmatch(err.Error()); parts != nil {
+				line, _ := strconv.Atoi(parts[1])
+				return &FieldError{Line: line, Message: "bad YAML: " + parts[2]}
+			}
+			return &FieldError{Message: "bad YAML: the value must be a mapping"}
+		}
+		*target = m
+		return nil
+	})
+}
+
+// Parse parses the annotations according to the schema, setting
+// the targets of the annotations that are present. It returns
+// ErrorList if any of the annotations are bad
+func (s *Schema) Parse(annotations map[string]string) error {
+	var keys []string
+	for key := range annotations {
+		if strings.HasPrefix(key, s.prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var errs ErrorList
+	if version, found := annotations[s.versionKey]; found && strings.TrimSpace(version) != s.version {
+		errs.Add(s.versionKey, "unsupported annotation schema version %q, must be %q", version, s.version)
+		return errs
+	}
+	for _, key := range keys {
+		if key == s.versionKey {
+			continue
+		}
+		f, found := s.fields[key]
+		switch {
+		case !found:
+			errs = append(errs, s.unknownKeyError(key))
+		case f.parse != nil:
+			if err := f.parse(annotations[key]); err != nil {
+				err.Key = key
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs.Err()
+}
+
+func (s *Schema) unknownKeyError(key string) *FieldError {
+	for k := range s.fields {
+		if strings.EqualFold(k, key) {
+			return &FieldError{Key: key, Message: fmt.Sprintf("unknown annotation, did you mean %q?", k)}
+		}
+	}
+	return &FieldError{Key: key, Message: "unknown annotation"}
+}
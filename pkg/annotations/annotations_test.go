@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package annotations
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type sample struct {
+	Count    int
+	Mode     string
+	Name     string
+	Text     string
+	Enabled  bool
+	Timeout  time.Duration
+	Size     int64
+	Keys     []string
+	Data     map[string]interface{}
+	Internal string
+}
+
+func sampleSchema(s *sample) *Schema {
+	schema := NewSchema("Sample", "SampleSchemaVersion", "v1")
+	schema.Int("SampleCount", &s.Count, 1, 16)
+	schema.Enum("SampleMode", &s.Mode, "fast", "slow")
+	schema.String("SampleName", &s.Name)
+	schema.Text("SampleText", &s.Text)
+	schema.Bool("SampleEnabled", &s.Enabled)
+	schema.Duration("SampleTimeout", &s.Timeout)
+	schema.Quantity("SampleSize", &s.Size)
+	schema.Lines("SampleKeys", &s.Keys)
+	schema.YAML("SampleData", &s.Data)
+	schema.Known("SampleInternal")
+	return schema
+}
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		expected    sample
+		errors      []string
+	}{
+		{
+			name:     "no annotations",
+			expected: sample{Count: 1},
+		},
+		{
+			name: "all the values",
+			annotations: map[string]string{
+				"SampleSchemaVersion": "v1",
+				"SampleCount":         " 4",
+				"SampleMode":          "slow",
+				"SampleName":          " foo\n",
+				"SampleText":          " foo\n",
+				"SampleEnabled":       "true",
+				"SampleTimeout":       "1m30s",
+				"SampleSize":          "1Ki",
+				"SampleKeys":          "abc\n\n  def  \n",
+				"SampleData":          "a: b\nc: 42",
+				"SampleInternal":      "whatever",
+				"OtherAnnotation":     "is ignored",
+			},
+			expected: sample{
+				Count:   4,
+				Mode:    "slow",
+				Name:    "foo",
+				Text:    " foo\n",
+				Enabled: true,
+				Timeout: 90 * time.Second,
+				Size:    1024,
+				Keys:    []string{"abc", "def"},
+				Data:    map[string]interface{}{"a": "b", "c": float64(42)},
+			},
+		},
+		{
+			name:        "unsupported schema version",
+			annotations: map[string]string{"SampleSchemaVersion": "v2", "SampleCount": "4"},
+			expected:    sample{Count: 1},
+			errors: []string{
+				`SampleSchemaVersion: unsupported annotation schema version "v2", must be "v1"`,
+			},
+		},
+		{
+			name: "bad values",
+			annotations: map[string]string{
+				"SampleCount":   " 4x2",
+				"SampleMode":    "medium",
+				"SampleEnabled": "sure",
+				"SampleTimeout": "-1s",
+				"SampleSize":    "0",
+				"SampleData":    "a: b\nc: [",
+			},
+			expected: sample{Count: 1},
+			errors: []string{
+				`SampleCount (column 3): bad integer value " 4x2"`,
+				`SampleData (line 2): bad YAML: did not find expected node content`,
+				`SampleEnabled: bad value "sure", must be "true" or "false"`,
+				`SampleMode: bad value "medium", must be one of "fast", "slow"`,
+				`SampleSize: bad size "0"`,
+				`SampleTimeout: bad duration "-1s"`,
+			},
+		},
+		{
+			name:        "out of range",
+			annotations: map[string]string{"SampleCount": "17"},
+			expected:    sample{Count: 1},
+			errors:      []string{"SampleCount: value 17 out of range, must be between 1 and 16"},
+		},
+		{
+			name:        "not a mapping",
+			annotations: map[string]string{"SampleData": "- a\n- b"},
+			expected:    sample{Count: 1},
+			errors:      []string{"SampleData: bad YAML: the value must be a mapping"},
+		},
+		{
+			name:        "unknown annotations",
+			annotations: map[string]string{"Samplecount": "4", "SampleFoo": "bar"},
+			expected:    sample{Count: 1},
+			errors: []string{
+				"SampleFoo: unknown annotation",
+				`Samplecount: unknown annotation, did you mean "SampleCount"?`,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := sample{Count: 1}
+			err := sampleSchema(&s).Parse(tc.annotations)
+			var errs []string
+			if err != nil {
+				errList, ok := err.(ErrorList)
+				if !ok {
+					t.Fatalf("unexpected error type %T: %v", err, err)
+				}
+				for _, e := range errList {
+					errs = append(errs, e.Error())
+				}
+			}
+			if !reflect.DeepEqual(errs, tc.errors) {
+				t.Errorf("bad errors: got\n%#v\ninstead of\n%#v", errs, tc.errors)
+			}
+			if !reflect.DeepEqual(s, tc.expected) {
+				t.Errorf("bad result: got\n%#v\ninstead of\n%#v", s, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDuplicateKey(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("didn't panic on a duplicate key")
+		}
+	}()
+	var s string
+	schema := NewSchema("Sample", "SampleSchemaVersion", "v1")
+	schema.String("SampleName", &s)
+	schema.String("SampleName", &s)
+}
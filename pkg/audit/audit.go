@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package audit writes an append-only log of the operations that
+// change the state of the node, such as creating VMs, setting up
+// pod networking, pulling images and passing commands through to
+// the VMs, along with the identity of the requester and the outcome.
+// The log consists of JSON records, one per line.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// OutcomeSuccess denotes a successful operation
+	OutcomeSuccess = "success"
+	// OutcomeFailure denotes a failed or denied operation
+	OutcomeFailure = "failure"
+
+	// StdoutPath makes the records go to the standard output
+	// of the process instead of a file
+	StdoutPath = "-"
+)
+
+// Record describes an operation in the audit log
+type Record struct {
+	// Time is the time the operation has finished
+	Time time.Time `json:"time"`
+	// Component is the Virtlet component that has handled the
+	// operation, e.g. "virtlet" or "tapmanager"
+	Component string `json:"component"`
+	// Operation is the name of the operation, e.g. the CRI method
+	Operation string `json:"operation"`
+	// Requester identifies the client that has requested the
+	// operation, e.g. "uid=0,pid=1234" for the clients
+	// connected over unix sockets or the name of a k8s user
+	Requester string `json:"requester"`
+	// Target is the object of the operation such as the pod
+	// sandbox, the container or the image
+	Target string `json:"target,omitempty"`
+	// Outcome is either OutcomeSuccess or OutcomeFailure
+	Outcome string `json:"outcome"`
+	// Error is the error message for the failed operations
+	Error string `json:"error,omitempty"`
+}
+
+// Log writes the audit records. The methods of a nil Log do
+// nothing, so the callers don't need to check whether auditing
+// is enabled
+type Log struct {
+	sync.Mutex
+	component string
+	w         io.Writer
+	closer    io.Closer
+}
+
+// Open opens the audit log at the specified path for appending,
+// creating the file if it doesn't exist. The records are written
+// to the standard output if the path is StdoutPath. The component
+// is the name of the Virtlet component that writes the records.
+// Several processes may write to the same file as each record is
+// appended using a single write
+func Open(path, component string) (*Log, error) {
+	if path == StdoutPath {
+		return &Log{component: component, w: os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("can't open audit log: %v", err)
+	}
+	return &Log{component: component, w: f, closer: f}, nil
+}
+
+// Record writes a record for the operation with the specified
+// requester and target. err is the error returned by the operation
+func (l *Log) Record(operation, requester, target string, err error) {
+	if l == nil {
+		return
+	}
+	r := Record{
+		Time:      time.Now().UTC(),
+		Component: l.component,
+		Operation: operation,
+		Requester: requester,
+		Target:    target,
+		Outcome:   OutcomeSuccess,
+	}
+	if err != nil {
+		r.Outcome = OutcomeFailure
+		r.Error = err.Error()
+	}
+	data, err := json.Marshal(r)
+	if err != nil {
+		glog.Errorf("Error marshalling audit record: %v", err)
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	if _, err := l.w.Write(append(data, '\n')); err != nil {
+		glog.Errorf("Error writing audit record for %s: %v", operation, err)
+	}
+}
+
+// Close closes the audit log file
+func (l *Log) Close() error {
+	if l == nil || l.closer == nil {
+		return nil
+	}
+	return l.closer.Close()
+}
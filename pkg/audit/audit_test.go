@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	logPath := filepath.Join(tmpDir, "audit.log")
+
+	// make sure the records are appended to the existing file
+	for _, op := range []string{"RunPodSandbox", "RemovePodSandbox"} {
+		l, err := Open(logPath, "virtlet")
+		if err != nil {
+			t.Fatalf("Open(): %v", err)
+		}
+		var opErr error
+		if op == "RemovePodSandbox" {
+			opErr = errors.New("sandbox not found")
+		}
+		l.Record(op, "uid=0,pid=42", "pod-id", opErr)
+		if err := l.Close(); err != nil {
+			t.Fatalf("Close(): %v", err)
+		}
+	}
+	// nil Log must not do anything
+	var nilLog *Log
+	nilLog.Record("PullImage", "uid=0,pid=42", "cirros", nil)
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatalf("Open(): %v", err)
+	}
+	defer f.Close()
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("bad audit record %q: %v", scanner.Text(), err)
+		}
+		if r.Time.IsZero() {
+			t.Errorf("record time not set: %q", scanner.Text())
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("error reading audit log: %v", err)
+	}
+	expected := []Record{
+		{Component: "virtlet", Operation: "RunPodSandbox", Requester: "uid=0,pid=42", Target: "pod-id", Outcome: OutcomeSuccess},
+		{Component: "virtlet", Operation: "RemovePodSandbox", Requester: "uid=0,pid=42", Target: "pod-id", Outcome: OutcomeFailure, Error: "sandbox not found"},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("bad number of audit records: %d instead of %d", len(records), len(expected))
+	}
+	for n, r := range records {
+		r.Time = expected[n].Time
+		if r != expected[n] {
+			t.Errorf("bad audit record %d: %#v instead of %#v", n, r, expected[n])
+		}
+	}
+}
+
+func TestPeerListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only supported on Linux")
+	}
+	tmpDir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ln, err := net.Listen("unix", filepath.Join(tmpDir, "test.sock"))
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	l := NewPeerListener(ln)
+	defer l.Close()
+
+	addrCh := make(chan string, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			addrCh <- err.Error()
+			return
+		}
+		defer c.Close()
+		addrCh <- c.RemoteAddr().String()
+	}()
+	c, err := net.Dial("unix", filepath.Join(tmpDir, "test.sock"))
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer c.Close()
+	expected := fmt.Sprintf("uid=%d,pid=%d", os.Getuid(), os.Getpid())
+	if addr := <-addrCh; addr != expected {
+		t.Errorf("bad remote address: %q instead of %q", addr, expected)
+	}
+}
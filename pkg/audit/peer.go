@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"net"
+
+	"github.com/golang/glog"
+)
+
+// UnknownRequester is used when the identity of the requester
+// can't be determined
+const UnknownRequester = "unknown"
+
+// PeerCred returns the identity of the process on the other end of
+// a unix socket connection as "uid=...,pid=..."
+func PeerCred(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return UnknownRequester
+	}
+	requester, err := peerCred(uc)
+	if err != nil {
+		glog.Warningf("Can't get peer credentials: %v", err)
+		return UnknownRequester
+	}
+	return requester
+}
+
+// peerAddr is the remote address of a connection that
+// identifies the peer process
+type peerAddr string
+
+func (a peerAddr) Network() string { return "unix" }
+func (a peerAddr) String() string  { return string(a) }
+
+type peerConn struct {
+	net.Conn
+	addr peerAddr
+}
+
+func (c *peerConn) RemoteAddr() net.Addr { return c.addr }
+
+type peerListener struct {
+	net.Listener
+}
+
+// NewPeerListener wraps a unix socket listener so that the remote
+// addresses of the accepted connections identify the peer processes
+// in PeerCred() format. This makes it possible to find out the
+// requesters of gRPC calls using the address from the peer info
+// of the call context
+func NewPeerListener(l net.Listener) net.Listener {
+	return peerListener{l}
+}
+
+func (l peerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{Conn: c, addr: peerAddr(PeerCred(c))}, nil
+}
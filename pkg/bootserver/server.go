@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bootserver implements a minimal server for the files
+// that are used to boot VMs over the network. The files are
+// served from a directory over TFTP and HTTP.
+package bootserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const (
+	tftpPort = 69
+	httpPort = 80
+)
+
+// ListenPacketFunc opens a packet-oriented connection. It's used
+// to open the connections for TFTP transfers, which must happen
+// in the network namespace of the server
+type ListenPacketFunc func(network, address string) (net.PacketConn, error)
+
+// Server serves boot files from a directory over TFTP and HTTP
+type Server struct {
+	root         string
+	listenPacket ListenPacketFunc
+	ip           net.IP
+	tftpConn     net.PacketConn
+	httpListener net.Listener
+	httpServer   *http.Server
+	wg           sync.WaitGroup
+}
+
+// NewServer returns a Server for the specified root directory.
+// listenPacket is used to open TFTP transfer connections. If
+// it's nil, net.ListenPacket is used
+func NewServer(root string, listenPacket ListenPacketFunc) *Server {
+	if listenPacket == nil {
+		listenPacket = net.ListenPacket
+	}
+	return &Server{root: root, listenPacket: listenPacket}
+}
+
+// Listen opens TFTP and HTTP server sockets on the specified
+// address using the standard ports. It must be called from
+// within the network namespace in which the server should run
+func (s *Server) Listen(ip net.IP) error {
+	return s.listen(ip, tftpPort, httpPort)
+}
+
+func (s *Server) listen(ip net.IP, tftpPort, httpPort int) error {
+	tftpConn, err := net.ListenPacket("udp4", net.JoinHostPort(ip.String(), fmt.Sprint(tftpPort)))
+	if err != nil {
+		return fmt.Errorf("error opening TFTP server socket: %v", err)
+	}
+	httpListener, err := net.Listen("tcp4", net.JoinHostPort(ip.String(), fmt.Sprint(httpPort)))
+	if err != nil {
+		tftpConn.Close()
+		return fmt.Errorf("error opening HTTP server socket: %v", err)
+	}
+	s.ip = ip
+	s.tftpConn = tftpConn
+	s.httpListener = httpListener
+	return nil
+}
+
+// Serve starts serving the requests in the background
+func (s *Server) Serve() {
+	s.httpServer = &http.Server{Handler: http.FileServer(http.Dir(s.root))}
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		if err := s.httpServer.Serve(s.httpListener); err != nil && err != http.ErrServerClosed {
+			glog.Warningf("HTTP boot server error: %v", err)
+		}
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.serveTFTP()
+	}()
+}
+
+func (s *Server) serveTFTP() {
+	buf := make([]byte, tftpMaxRequestLength)
+	for {
+		n, client, err := s.tftpConn.ReadFrom(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				continue
+			}
+			// the connection was closed
+			return
+		}
+		packet := make([]byte, n)
+		copy(packet, buf[:n])
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveTFTPRequest(packet, client)
+		}()
+	}
+}
+
+// Close stops the server and waits for the transfers
+// that are in progress to complete
+func (s *Server) Close() error {
+	var errs []error
+	if err := s.tftpConn.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if s.httpServer != nil {
+		if err := s.httpServer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	} else if err := s.httpListener.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	s.wg.Wait()
+	if len(errs) != 0 {
+		return fmt.Errorf("error stopping boot server: %v", errs)
+	}
+	return nil
+}
+
+// openFile opens the file with the specified name relative
+// to the server root, making sure it doesn't escape the root
+func (s *Server) openFile(name string) (*os.File, int64, error) {
+	// path.Clean() on an absolute path removes any ".."
+	// elements that would lead outside the root
+	filePath := filepath.Join(s.root, filepath.FromSlash(path.Clean("/"+name)))
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, 0, errors.New("not a regular file")
+	}
+	return f, fi.Size(), nil
+}
+
+// ParseBootPath parses the path of a boot file, which has the
+// form of dir/file, where dir is the directory that's served
+// and file is the path of the boot file inside it. It returns
+// the directory and the file path
+func ParseBootPath(value string) (string, string, error) {
+	if value == "" || path.IsAbs(value) {
+		return "", "", fmt.Errorf("bad boot file path %q: must be a relative path", value)
+	}
+	if path.Clean(value) != value {
+		return "", "", fmt.Errorf("bad boot file path %q: the path must be clean", value)
+	}
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 || parts[0] == ".." || strings.HasPrefix(parts[1], "../") || parts[1] == ".." {
+		return "", "", fmt.Errorf("bad boot file path %q: must be in dir/file form", value)
+	}
+	return parts[0], parts[1], nil
+}
@@ -0,0 +1,325 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTFTPRequest(t *testing.T) {
+	rrq := func(fields ...string) []byte {
+		return append([]byte{0, tftpOpRRQ}, []byte(strings.Join(fields, "\x00")+"\x00")...)
+	}
+	for _, tc := range []struct {
+		name     string
+		packet   []byte
+		expected *tftpRequest
+	}{
+		{
+			name:   "plain request",
+			packet: rrq("pxelinux.0", "octet"),
+			expected: &tftpRequest{
+				filename:  "pxelinux.0",
+				blockSize: tftpDefaultBlockSize,
+				timeout:   tftpDefaultTimeout,
+			},
+		},
+		{
+			name:   "options",
+			packet: rrq("pxelinux.0", "OCTET", "tsize", "0", "BLKSIZE", "1432", "foo", "bar", "timeout", "3"),
+			expected: &tftpRequest{
+				filename:  "pxelinux.0",
+				blockSize: 1432,
+				timeout:   3 * time.Second,
+				options:   [][2]string{{"tsize", ""}, {"blksize", "1432"}, {"timeout", "3"}},
+			},
+		},
+		{
+			name:   "large block size",
+			packet: rrq("pxelinux.0", "octet", "blksize", "65464"),
+			expected: &tftpRequest{
+				filename:  "pxelinux.0",
+				blockSize: tftpMaxBlockSize,
+				timeout:   tftpDefaultTimeout,
+				options:   [][2]string{{"blksize", fmt.Sprint(tftpMaxBlockSize)}},
+			},
+		},
+		{
+			name:   "mail mode",
+			packet: rrq("pxelinux.0", "mail"),
+		},
+		{
+			name:   "bad block size",
+			packet: rrq("pxelinux.0", "octet", "blksize", "4"),
+		},
+		{
+			name:   "missing option value",
+			packet: rrq("pxelinux.0", "octet", "blksize"),
+		},
+		{
+			name:   "unterminated request",
+			packet: []byte("\x00\x01pxelinux.0\x00octet"),
+		},
+		{
+			name:   "write request",
+			packet: append([]byte{0, tftpOpWRQ}, "pxelinux.0\x00octet\x00"...),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := parseTFTPRequest(tc.packet)
+			switch {
+			case tc.expected == nil && err == nil:
+				t.Errorf("didn't get an error")
+			case tc.expected == nil:
+			case err != nil:
+				t.Errorf("parseTFTPRequest(): %v", err)
+			case !reflect.DeepEqual(req, tc.expected):
+				t.Errorf("bad request: expected %#v, got %#v", tc.expected, req)
+			}
+		})
+	}
+}
+
+func setupServer(t *testing.T) (*Server, string, func()) {
+	tmpDir, err := ioutil.TempDir("", "bootserver")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	root := filepath.Join(tmpDir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "pxelinux.cfg"), 0755); err != nil {
+		t.Fatalf("MkdirAll(): %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	s := NewServer(root, nil)
+	if err := s.listen(net.IPv4(127, 0, 0, 1), 0, 0); err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatalf("listen(): %v", err)
+	}
+	s.Serve()
+	return s, root, func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("Close(): %v", err)
+		}
+		os.RemoveAll(tmpDir)
+	}
+}
+
+// tftpGet fetches a file from TFTP server, acking each
+// packet as it comes
+func tftpGet(t *testing.T, serverAddr net.Addr, filename string, options ...string) ([]byte, map[string]string, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket(): %v", err)
+	}
+	defer conn.Close()
+	fields := append([]string{filename, "octet"}, options...)
+	req := append([]byte{0, tftpOpRRQ}, []byte(strings.Join(fields, "\x00")+"\x00")...)
+	if _, err := conn.WriteTo(req, serverAddr); err != nil {
+		t.Fatalf("WriteTo(): %v", err)
+	}
+
+	var data bytes.Buffer
+	var oack map[string]string
+	blockSize := tftpDefaultBlockSize
+	expectedBlock := uint16(1)
+	buf := make([]byte, 65536)
+	ack := func(block uint16, addr net.Addr) {
+		packet := []byte{0, tftpOpAck, 0, 0}
+		binary.BigEndian.PutUint16(packet[2:], block)
+		if _, err := conn.WriteTo(packet, addr); err != nil {
+			t.Fatalf("WriteTo(): %v", err)
+		}
+	}
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatalf("SetReadDeadline(): %v", err)
+		}
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom(): %v", err)
+		}
+		if addr.String() == serverAddr.String() {
+			t.Fatalf("the response came from the server port")
+		}
+		packet := buf[:n]
+		switch binary.BigEndian.Uint16(packet) {
+		case tftpOpError:
+			return nil, nil, fmt.Errorf("error %d: %s", binary.BigEndian.Uint16(packet[2:]), strings.TrimRight(string(packet[4:]), "\x00"))
+		case tftpOpOAck:
+			oack = make(map[string]string)
+			fields := strings.Split(strings.TrimRight(string(packet[2:]), "\x00"), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				oack[fields[i]] = fields[i+1]
+			}
+			if oack["blksize"] != "" {
+				fmt.Sscan(oack["blksize"], &blockSize)
+			}
+			ack(0, addr)
+		case tftpOpData:
+			block := binary.BigEndian.Uint16(packet[2:])
+			if block != expectedBlock {
+				t.Fatalf("bad block number %d, expected %d", block, expectedBlock)
+			}
+			data.Write(packet[4:])
+			ack(block, addr)
+			if len(packet)-4 < blockSize {
+				return data.Bytes(), oack, nil
+			}
+			expectedBlock++
+		default:
+			t.Fatalf("unexpected packet: %v", packet)
+		}
+	}
+}
+
+func TestTFTP(t *testing.T) {
+	s, root, cleanup := setupServer(t)
+	defer cleanup()
+	serverAddr := s.tftpConn.LocalAddr()
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	if err := ioutil.WriteFile(filepath.Join(root, "pxelinux.0"), content, 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "pxelinux.cfg", "default"), content[:512], 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		filename     string
+		options      []string
+		expected     []byte
+		expectedOAck map[string]string
+		err          string
+	}{
+		{
+			name:     "plain transfer",
+			filename: "pxelinux.0",
+			expected: content,
+		},
+		{
+			name:     "block size multiple",
+			filename: "/pxelinux.cfg/default",
+			expected: content[:512],
+		},
+		{
+			name:         "options",
+			filename:     "pxelinux.0",
+			options:      []string{"tsize", "0", "blksize", "100"},
+			expected:     content,
+			expectedOAck: map[string]string{"tsize": fmt.Sprint(len(content)), "blksize": "100"},
+		},
+		{
+			name:     "missing file",
+			filename: "nosuchfile",
+			err:      "error 1: file not found",
+		},
+		{
+			name:     "escaping the root",
+			filename: "../secret",
+			err:      "error 1: file not found",
+		},
+		{
+			name:     "directory",
+			filename: "pxelinux.cfg",
+			err:      "error 0: can't read the file",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, oack, err := tftpGet(t, serverAddr, tc.filename, tc.options...)
+			switch {
+			case tc.err != "" && err == nil:
+				t.Fatalf("didn't get an error")
+			case tc.err != "":
+				if err.Error() != tc.err {
+					t.Errorf("bad error: expected %q, got %q", tc.err, err)
+				}
+			case err != nil:
+				t.Fatalf("tftpGet(): %v", err)
+			default:
+				if !bytes.Equal(data, tc.expected) {
+					t.Errorf("bad data received: %q", data)
+				}
+				if !reflect.DeepEqual(oack, tc.expectedOAck) {
+					t.Errorf("bad OACK: expected %#v, got %#v", tc.expectedOAck, oack)
+				}
+			}
+		})
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	s, root, cleanup := setupServer(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(filepath.Join(root, "boot.ipxe"), []byte("#!ipxe\n"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/boot.ipxe", s.httpListener.Addr()))
+	if err != nil {
+		t.Fatalf("http.Get(): %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading the response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "#!ipxe\n" {
+		t.Errorf("bad response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestParseBootPath(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		dir   string
+		file  string
+	}{
+		{"debian/pxelinux.0", "debian", "pxelinux.0"},
+		{"debian/efi/bootx64.efi", "debian", "efi/bootx64.efi"},
+		{"pxelinux.0", "", ""},
+		{"/debian/pxelinux.0", "", ""},
+		{"../debian/pxelinux.0", "", ""},
+		{"debian/../pxelinux.0", "", ""},
+		{"debian//pxelinux.0", "", ""},
+		{"", "", ""},
+	} {
+		dir, file, err := ParseBootPath(tc.value)
+		switch {
+		case tc.dir == "" && err == nil:
+			t.Errorf("didn't get an error for %q", tc.value)
+		case tc.dir != "" && err != nil:
+			t.Errorf("ParseBootPath(%q): %v", tc.value, err)
+		case dir != tc.dir || file != tc.file:
+			t.Errorf("bad result for %q: expected %q, %q, got %q, %q", tc.value, tc.dir, tc.file, dir, file)
+		}
+	}
+}
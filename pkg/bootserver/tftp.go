@@ -0,0 +1,281 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// TFTP opcodes and error codes as defined in RFC 1350
+// and RFC 2347
+const (
+	tftpOpRRQ   = 1
+	tftpOpWRQ   = 2
+	tftpOpData  = 3
+	tftpOpAck   = 4
+	tftpOpError = 5
+	tftpOpOAck  = 6
+
+	tftpErrNotDefined       = 0
+	tftpErrFileNotFound     = 1
+	tftpErrAccessViolation  = 2
+	tftpErrIllegalOperation = 4
+	tftpErrUnknownTID       = 5
+
+	tftpDefaultBlockSize = 512
+	tftpMinBlockSize     = 8
+	// tftpMaxBlockSize is limited by Ethernet MTU, which is
+	// what the most of PXE firmware implementations expect
+	tftpMaxBlockSize     = 1468
+	tftpDefaultTimeout   = time.Second
+	tftpMaxRetransmits   = 5
+	tftpMaxRequestLength = 512
+)
+
+// tftpRequest describes a parsed TFTP read request
+type tftpRequest struct {
+	filename  string
+	blockSize int
+	timeout   time.Duration
+	// options contains the options to be acknowledged,
+	// in the order of their appearance in the request
+	options [][2]string
+}
+
+// parseTFTPRequest parses TFTP RRQ packet, handling blksize
+// (RFC 2348), timeout and tsize (RFC 2349) options. Unknown
+// options are ignored as required by RFC 2347. The value of
+// tsize option is filled in later when the file size is known
+func parseTFTPRequest(packet []byte) (*tftpRequest, error) {
+	if len(packet) < 2 {
+		return nil, errors.New("packet too short")
+	}
+	if op := binary.BigEndian.Uint16(packet); op != tftpOpRRQ {
+		return nil, fmt.Errorf("unexpected opcode %d", op)
+	}
+	fields := bytes.Split(packet[2:], []byte{0})
+	// the packet must end with a zero byte, which yields
+	// an empty field after the split
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, errors.New("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+	r := &tftpRequest{
+		filename:  string(fields[0]),
+		blockSize: tftpDefaultBlockSize,
+		timeout:   tftpDefaultTimeout,
+	}
+	if r.filename == "" {
+		return nil, errors.New("empty file name")
+	}
+	switch mode := strings.ToLower(string(fields[1])); mode {
+	case "octet", "netascii":
+		// netascii conversion isn't worth the trouble for
+		// boot files, which are always binary
+	default:
+		return nil, fmt.Errorf("unsupported transfer mode %q", mode)
+	}
+	opts := fields[2:]
+	if len(opts)%2 != 0 {
+		return nil, errors.New("malformed options")
+	}
+	for i := 0; i < len(opts); i += 2 {
+		name := strings.ToLower(string(opts[i]))
+		value := string(opts[i+1])
+		switch name {
+		case "blksize":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < tftpMinBlockSize {
+				return nil, fmt.Errorf("bad blksize value %q", value)
+			}
+			if n > tftpMaxBlockSize {
+				n = tftpMaxBlockSize
+			}
+			r.blockSize = n
+			r.options = append(r.options, [2]string{name, strconv.Itoa(n)})
+		case "timeout":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 255 {
+				return nil, fmt.Errorf("bad timeout value %q", value)
+			}
+			r.timeout = time.Duration(n) * time.Second
+			r.options = append(r.options, [2]string{name, value})
+		case "tsize":
+			r.options = append(r.options, [2]string{name, ""})
+		}
+	}
+	return r, nil
+}
+
+func tftpErrorPacket(code uint16, msg string) []byte {
+	packet := make([]byte, 4, 5+len(msg))
+	binary.BigEndian.PutUint16(packet, tftpOpError)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, msg...)
+	return append(packet, 0)
+}
+
+func tftpOAckPacket(options [][2]string) []byte {
+	packet := []byte{0, tftpOpOAck}
+	for _, opt := range options {
+		packet = append(packet, opt[0]...)
+		packet = append(packet, 0)
+		packet = append(packet, opt[1]...)
+		packet = append(packet, 0)
+	}
+	return packet
+}
+
+// tftpTransfer sends a file to a TFTP client using a dedicated
+// connection, as each transfer must have its own UDP port
+type tftpTransfer struct {
+	conn   net.PacketConn
+	client net.Addr
+	req    *tftpRequest
+}
+
+// exchange sends the packet to the client and waits for the ACK
+// with the specified block number, retransmitting the packet
+// upon timeout
+func (t *tftpTransfer) exchange(packet []byte, block uint16) error {
+	buf := make([]byte, tftpMaxRequestLength)
+	for attempt := 0; attempt <= tftpMaxRetransmits; attempt++ {
+		if _, err := t.conn.WriteTo(packet, t.client); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(t.req.timeout)
+		for {
+			if err := t.conn.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+			n, addr, err := t.conn.ReadFrom(buf)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return err
+			}
+			if addr.String() != t.client.String() {
+				// RFC 1350: packets from unknown TIDs get
+				// an error, and the transfer goes on
+				t.conn.WriteTo(tftpErrorPacket(tftpErrUnknownTID, "unknown transfer ID"), addr)
+				continue
+			}
+			if n < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(buf) {
+			case tftpOpAck:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+				// duplicate ACK for an earlier block,
+				// keep waiting
+			case tftpOpError:
+				return fmt.Errorf("client error: %s", strings.TrimRight(string(buf[4:n]), "\x00"))
+			}
+		}
+	}
+	return errors.New("timed out waiting for the client")
+}
+
+// send transfers the file contents to the client
+func (t *tftpTransfer) send(f io.Reader, size int64) error {
+	if len(t.req.options) != 0 {
+		var options [][2]string
+		for _, opt := range t.req.options {
+			if opt[0] == "tsize" {
+				opt[1] = strconv.FormatInt(size, 10)
+			}
+			options = append(options, opt)
+		}
+		if err := t.exchange(tftpOAckPacket(options), 0); err != nil {
+			return err
+		}
+	}
+	packet := make([]byte, 4+t.req.blockSize)
+	binary.BigEndian.PutUint16(packet, tftpOpData)
+	// block numbers wrap around for the files that are
+	// larger than 65535 blocks, which is supported by
+	// most clients
+	for block := uint16(1); ; block++ {
+		n, err := io.ReadFull(f, packet[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		binary.BigEndian.PutUint16(packet[2:], block)
+		if err := t.exchange(packet[:4+n], block); err != nil {
+			return err
+		}
+		if n < t.req.blockSize {
+			return nil
+		}
+	}
+}
+
+// serveTFTPRequest handles a single TFTP request received on
+// the server port
+func (s *Server) serveTFTPRequest(packet []byte, client net.Addr) {
+	conn, err := s.listenPacket("udp4", net.JoinHostPort(s.ip.String(), "0"))
+	if err != nil {
+		glog.Warningf("TFTP: failed to open a connection for %s: %v", client, err)
+		return
+	}
+	defer conn.Close()
+
+	if len(packet) >= 2 && binary.BigEndian.Uint16(packet) == tftpOpWRQ {
+		conn.WriteTo(tftpErrorPacket(tftpErrAccessViolation, "write requests aren't allowed"), client)
+		return
+	}
+	req, err := parseTFTPRequest(packet)
+	if err != nil {
+		glog.Warningf("TFTP: bad request from %s: %v", client, err)
+		conn.WriteTo(tftpErrorPacket(tftpErrIllegalOperation, err.Error()), client)
+		return
+	}
+
+	f, size, err := s.openFile(req.filename)
+	if err != nil {
+		glog.Warningf("TFTP: %s requested %q: %v", client, req.filename, err)
+		code := uint16(tftpErrNotDefined)
+		msg := "can't read the file"
+		if os.IsNotExist(err) {
+			code = tftpErrFileNotFound
+			msg = "file not found"
+		}
+		conn.WriteTo(tftpErrorPacket(code, msg), client)
+		return
+	}
+	defer f.Close()
+
+	glog.V(2).Infof("TFTP: sending %q (%d bytes) to %s", req.filename, size, client)
+	t := &tftpTransfer{conn: conn, client: client, req: req}
+	if err := t.send(f, size); err != nil {
+		glog.Warningf("TFTP: error sending %q to %s: %v", req.filename, client, err)
+	}
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package cni
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/containernetworking/cni/libcni"
@@ -27,20 +28,42 @@ import (
 	"github.com/Mirantis/virtlet/pkg/utils"
 )
 
-// CNIClient provides an interface to CNI
+// ifNameTemplate is used to make the names of
+// the interfaces in the pod network namespace
+const ifNameTemplate = "virtlet-eth%d"
+
+// CNIClient provides an interface to CNI. The plugins invoked by
+// the methods that take a context are killed when the context is
+// done, in which case the pod must still be removed from the network
+// to release the resources the plugins may have allocated
 type CNIClient interface {
 	// AddSandboxToNetwork adds a pod sandbox to the CNI network
-	AddSandboxToNetwork(podId, podName, podNs string) (*cnicurrent.Result, error)
+	AddSandboxToNetwork(ctx context.Context, podId, podName, podNs string) (*cnicurrent.Result, error)
 	// RemoveSandboxFromNetwork removes a pod sandbox from the CNI network
-	RemoveSandboxFromNetwork(podId, podName, podNs string) error
+	RemoveSandboxFromNetwork(ctx context.Context, podId, podName, podNs string) error
 	// GetDummyNetwork creates a dummy network using CNI plugin.
 	// It's used for making a dummy gateway for Calico CNI plugin
 	GetDummyNetwork() (*cnicurrent.Result, string, error)
+	// AddSandboxToNamedNetwork adds a pod sandbox to an additional
+	// CNI network with the specified name using ifName as the
+	// name of the interface in the pod network namespace
+	AddSandboxToNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) (*cnicurrent.Result, error)
+	// RemoveSandboxFromNamedNetwork removes a pod sandbox from
+	// an additional CNI network with the specified name
+	RemoveSandboxFromNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) error
+	// AddSandboxToNetworks adds a pod sandbox to the CNI networks
+	// defined in the specified configuration files, in order,
+	// instead of the default network. It returns the merged result
+	AddSandboxToNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) (*cnicurrent.Result, error)
+	// RemoveSandboxFromNetworks removes a pod sandbox from the CNI
+	// networks it was added to using AddSandboxToNetworks()
+	RemoveSandboxFromNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) error
 }
 
 type Client struct {
 	cniConfig     *libcni.CNIConfig
 	netConfigList *libcni.NetworkConfigList
+	configsDir    string
 }
 
 var _ CNIClient = &Client{}
@@ -55,6 +78,7 @@ func NewClient(pluginsDir, configsDir string) (*Client, error) {
 	return &Client{
 		cniConfig:     &libcni.CNIConfig{Path: []string{pluginsDir}},
 		netConfigList: netConfigList,
+		configsDir:    configsDir,
 	}, nil
 }
 
@@ -62,7 +86,7 @@ func (c *Client) cniRuntimeConf(podId, podName, podNs string) *libcni.RuntimeCon
 	r := &libcni.RuntimeConf{
 		ContainerID: podId,
 		NetNS:       PodNetNSPath(podId),
-		IfName:      "virtlet-eth0",
+		IfName:      fmt.Sprintf(ifNameTemplate, 0),
 	}
 	if podName != "" && podNs != "" {
 		r.Args = [][2]string{
@@ -85,7 +109,7 @@ func (c *Client) GetDummyNetwork() (*cnicurrent.Result, string, error) {
 	if err := CreateNetNS(podId); err != nil {
 		return nil, "", fmt.Errorf("couldn't create netns for fake pod %q: %v", podId, err)
 	}
-	r, err := c.AddSandboxToNetwork(podId, "", "")
+	r, err := c.AddSandboxToNetwork(context.Background(), podId, "", "")
 	if err != nil {
 		return nil, "", fmt.Errorf("couldn't set up CNI for fake pod %q: %v", podId, err)
 	}
@@ -93,7 +117,7 @@ func (c *Client) GetDummyNetwork() (*cnicurrent.Result, string, error) {
 }
 
 // AddSandboxToNetwork implements AddSandboxToNetwork method of CNIClient interface
-func (c *Client) AddSandboxToNetwork(podId, podName, podNs string) (*cnicurrent.Result, error) {
+func (c *Client) AddSandboxToNetwork(ctx context.Context, podId, podName, podNs string) (*cnicurrent.Result, error) {
 	rtConf := c.cniRuntimeConf(podId, podName, podNs)
 	// NOTE: this annotation is only need by CNI Genie
 	rtConf.Args = append(rtConf.Args, [2]string{
@@ -101,7 +125,7 @@ func (c *Client) AddSandboxToNetwork(podId, podName, podNs string) (*cnicurrent.
 	})
 	glog.V(3).Infof("AddSandboxToNetwork: podId %q, podName %q, podNs %q, runtime config:\n%s",
 		podId, podName, podNs, spew.Sdump(rtConf))
-	result, err := c.cniConfig.AddNetworkList(c.netConfigList, rtConf)
+	result, err := addNetworkList(ctx, c.cniConfig, c.netConfigList, rtConf)
 	if err == nil {
 		glog.V(3).Infof("AddSandboxToNetwork: podId %q, podName %q, podNs %q: result:\n%s",
 			podId, podName, podNs, spew.Sdump(result))
@@ -118,9 +142,9 @@ func (c *Client) AddSandboxToNetwork(podId, podName, podNs string) (*cnicurrent.
 }
 
 // RemoveSandboxFromNetwork implements RemoveSandboxFromNetwork method of CNIClient interface
-func (c *Client) RemoveSandboxFromNetwork(podId, podName, podNs string) error {
+func (c *Client) RemoveSandboxFromNetwork(ctx context.Context, podId, podName, podNs string) error {
 	glog.V(3).Infof("RemoveSandboxFromNetwork: podId %q, podName %q, podNs %q", podId, podName, podNs)
-	err := c.cniConfig.DelNetworkList(c.netConfigList, c.cniRuntimeConf(podId, podName, podNs))
+	err := delNetworkList(ctx, c.cniConfig, c.netConfigList, c.cniRuntimeConf(podId, podName, podNs))
 	if err == nil {
 		glog.V(3).Infof("RemoveSandboxFromNetwork: podId %q, podName %q, podNs %q: success",
 			podId, podName, podNs)
@@ -130,3 +154,91 @@ func (c *Client) RemoveSandboxFromNetwork(podId, podName, podNs string) error {
 	}
 	return err
 }
+
+// AddSandboxToNamedNetwork implements AddSandboxToNamedNetwork method of CNIClient interface
+func (c *Client) AddSandboxToNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	netConfigList, err := ReadNamedConfiguration(c.configsDir, network)
+	if err != nil {
+		return nil, err
+	}
+	return c.addSandboxToNetworkList(ctx, netConfigList, ifName, podId, podName, podNs)
+}
+
+func (c *Client) addSandboxToNetworkList(ctx context.Context, netConfigList *libcni.NetworkConfigList, ifName, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	rtConf := c.cniRuntimeConf(podId, podName, podNs)
+	rtConf.IfName = ifName
+	glog.V(3).Infof("Adding pod sandbox to network %q: podId %q, podName %q, podNs %q, runtime config:\n%s",
+		netConfigList.Name, podId, podName, podNs, spew.Sdump(rtConf))
+	result, err := addNetworkList(ctx, c.cniConfig, netConfigList, rtConf)
+	if err != nil {
+		glog.V(3).Infof("Adding pod sandbox to network %q: podId %q, podName %q, podNs %q: error: %v",
+			netConfigList.Name, podId, podName, podNs, err)
+		return nil, err
+	}
+	glog.V(3).Infof("Adding pod sandbox to network %q: podId %q, podName %q, podNs %q: result:\n%s",
+		netConfigList.Name, podId, podName, podNs, spew.Sdump(result))
+	r, err := cnicurrent.NewResultFromResult(result)
+	if err != nil {
+		return nil, fmt.Errorf("error converting CNI result to the current version: %v", err)
+	}
+	return r, nil
+}
+
+// RemoveSandboxFromNamedNetwork implements RemoveSandboxFromNamedNetwork method of CNIClient interface
+func (c *Client) RemoveSandboxFromNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) error {
+	netConfigList, err := ReadNamedConfiguration(c.configsDir, network)
+	if err != nil {
+		return err
+	}
+	return c.removeSandboxFromNetworkList(ctx, netConfigList, ifName, podId, podName, podNs)
+}
+
+func (c *Client) removeSandboxFromNetworkList(ctx context.Context, netConfigList *libcni.NetworkConfigList, ifName, podId, podName, podNs string) error {
+	rtConf := c.cniRuntimeConf(podId, podName, podNs)
+	rtConf.IfName = ifName
+	glog.V(3).Infof("Removing pod sandbox from network %q: podId %q, podName %q, podNs %q", netConfigList.Name, podId, podName, podNs)
+	if err := delNetworkList(ctx, c.cniConfig, netConfigList, rtConf); err != nil {
+		glog.V(3).Infof("Removing pod sandbox from network %q: podId %q, podName %q, podNs %q: error: %v",
+			netConfigList.Name, podId, podName, podNs, err)
+		return err
+	}
+	return nil
+}
+
+// AddSandboxToNetworks implements AddSandboxToNetworks method of CNIClient interface
+func (c *Client) AddSandboxToNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	var results []*cnicurrent.Result
+	for n, fileName := range configFiles {
+		netConfigList, err := ReadConfigurationFile(c.configsDir, fileName)
+		var r *cnicurrent.Result
+		if err == nil {
+			r, err = c.addSandboxToNetworkList(ctx, netConfigList, fmt.Sprintf(ifNameTemplate, n), podId, podName, podNs)
+		}
+		if err != nil {
+			// the rollback must not be interrupted by the context
+			if rmErr := c.RemoveSandboxFromNetworks(context.Background(), configFiles[:n], podId, podName, podNs); rmErr != nil {
+				glog.Errorf("Error removing pod sandbox %q from CNI networks during rollback: %v", podId, rmErr)
+			}
+			return nil, fmt.Errorf("error adding pod sandbox to network %q: %v", fileName, err)
+		}
+		results = append(results, r)
+	}
+	return MergeResults(results)
+}
+
+// RemoveSandboxFromNetworks implements RemoveSandboxFromNetworks method of CNIClient interface
+func (c *Client) RemoveSandboxFromNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) error {
+	// try to remove the pod from all of the networks
+	// in reverse order, returning the first error
+	var firstErr error
+	for n := len(configFiles) - 1; n >= 0; n-- {
+		netConfigList, err := ReadConfigurationFile(c.configsDir, configFiles[n])
+		if err == nil {
+			err = c.removeSandboxFromNetworkList(ctx, netConfigList, fmt.Sprintf(ifNameTemplate, n), podId, podName, podNs)
+		}
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("error removing pod sandbox from network %q: %v", configFiles[n], err)
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakePlugin logs the invocations and hangs upon ADD
+// for slow-pod, like a plugin waiting for an unavailable
+// IPAM backend would
+const fakePlugin = `#!/bin/sh
+echo "$CNI_COMMAND $CNI_CONTAINERID $$" >>"$(dirname "$0")/log"
+if [ "$CNI_COMMAND" = ADD ]; then
+  if [ "$CNI_CONTAINERID" = slow-pod ]; then
+    sleep 30
+  fi
+  echo '{"cniVersion": "0.3.1", "ips": [{"version": "4", "address": "10.1.90.5/24"}]}'
+fi
+`
+
+func TestClientContext(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni-client")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pluginsDir := filepath.Join(tmpDir, "bin")
+	configsDir := filepath.Join(tmpDir, "net.d")
+	for _, dir := range []string{pluginsDir, configsDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir(): %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(pluginsDir, "fake"), []byte(fakePlugin), 0755); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(configsDir, "10-fake.conf"), []byte(`{"cniVersion": "0.3.1", "name": "fake-net", "type": "fake"}`), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	readLog := func() []string {
+		bs, err := ioutil.ReadFile(filepath.Join(pluginsDir, "log"))
+		if err != nil {
+			t.Fatalf("ReadFile(): %v", err)
+		}
+		return strings.Split(strings.TrimSpace(string(bs)), "\n")
+	}
+
+	c, err := NewClient(pluginsDir, configsDir)
+	if err != nil {
+		t.Fatalf("NewClient(): %v", err)
+	}
+	r, err := c.AddSandboxToNetwork(context.Background(), "fast-pod", "vm1", "default")
+	if err != nil {
+		t.Fatalf("AddSandboxToNetwork(): %v", err)
+	}
+	if len(r.IPs) != 1 || r.IPs[0].Address.String() != "10.1.90.5/24" {
+		t.Errorf("bad CNI result: %#v", r)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.AddSandboxToNetwork(ctx, "slow-pod", "vm2", "default"); err == nil {
+		t.Errorf("AddSandboxToNetwork() didn't fail for a hanging plugin")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("the hanging plugin was not interrupted (took %v)", d)
+	}
+	// the plugin's children must be killed, too
+	logLines := readLog()
+	fields := strings.Fields(logLines[len(logLines)-1])
+	if len(fields) != 3 || fields[1] != "slow-pod" {
+		t.Fatalf("bad plugin log: %q", logLines)
+	}
+	pgid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		t.Fatalf("bad pid in the plugin log: %q", fields[2])
+	}
+	// the orphaned children may take a moment to be reaped
+	for n := 0; syscall.Kill(-pgid, 0) != syscall.ESRCH; n++ {
+		if n == 50 {
+			t.Errorf("the processes of the hanging plugin are still running")
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err := c.RemoveSandboxFromNetwork(context.Background(), "slow-pod", "vm2", "default"); err != nil {
+		t.Errorf("RemoveSandboxFromNetwork(): %v", err)
+	}
+	var cmds []string
+	for _, l := range readLog() {
+		cmds = append(cmds, strings.Join(strings.Fields(l)[:2], " "))
+	}
+	expectedCmds := "ADD fast-pod,ADD slow-pod,DEL slow-pod"
+	if strings.Join(cmds, ",") != expectedCmds {
+		t.Errorf("bad plugin invocations: %q instead of %q", strings.Join(cmds, ","), expectedCmds)
+	}
+}
@@ -34,6 +34,7 @@ package cni
 
 import (
 	"fmt"
+	"path/filepath"
 	"sort"
 	"strings"
 
@@ -42,6 +43,77 @@ import (
 )
 
 func ReadConfiguration(configDir string) (*libcni.NetworkConfigList, error) {
+	files, err := confFiles(configDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, confFile := range files {
+		if confList := loadConfList(confFile); confList != nil {
+			// TODO: vendor dir handling (see pkg/kubelet/network/cni/cni.go)
+			return confList, nil
+		}
+	}
+	return nil, fmt.Errorf("No valid networks found in %s", configDir)
+}
+
+// ReadNamedConfiguration returns the configuration of the CNI
+// network with the specified name from configDir
+func ReadNamedConfiguration(configDir, name string) (*libcni.NetworkConfigList, error) {
+	files, err := confFiles(configDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, confFile := range files {
+		if confList := loadConfList(confFile); confList != nil && confList.Name == name {
+			return confList, nil
+		}
+	}
+	return nil, fmt.Errorf("network %q not found in %s", name, configDir)
+}
+
+// ReadConfigurationFile returns the configuration of the CNI network
+// from the specified file in configDir. The file name may be
+// specified without the extension
+func ReadConfigurationFile(configDir, fileName string) (*libcni.NetworkConfigList, error) {
+	files, err := confFiles(configDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, confFile := range files {
+		baseName := filepath.Base(confFile)
+		if baseName != fileName && strings.TrimSuffix(baseName, filepath.Ext(baseName)) != fileName {
+			continue
+		}
+		if confList := loadConfList(confFile); confList != nil {
+			return confList, nil
+		}
+		return nil, fmt.Errorf("invalid CNI configuration in %s", confFile)
+	}
+	return nil, fmt.Errorf("CNI configuration file %q not found in %s", fileName, configDir)
+}
+
+// ParseNetworkList parses comma-separated list of CNI configuration
+// file names
+func ParseNetworkList(s string) ([]string, error) {
+	var r []string
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(s, ",") {
+		name := strings.TrimSpace(item)
+		switch {
+		case name == "":
+			return nil, fmt.Errorf("empty network name in %q", s)
+		case strings.Contains(name, "/") || name == "." || name == "..":
+			return nil, fmt.Errorf("bad CNI configuration file name %q", name)
+		case seen[name]:
+			return nil, fmt.Errorf("duplicate network %q", name)
+		}
+		seen[name] = true
+		r = append(r, name)
+	}
+	return r, nil
+}
+
+func confFiles(configDir string) ([]string, error) {
 	files, err := libcni.ConfFiles(configDir, []string{".conf", ".conflist", ".json"})
 	switch {
 	case err != nil:
@@ -49,41 +121,43 @@ func ReadConfiguration(configDir string) (*libcni.NetworkConfigList, error) {
 	case len(files) == 0:
 		return nil, fmt.Errorf("No networks found in %s", configDir)
 	}
-
 	sort.Strings(files)
-	for _, confFile := range files {
-		var confList *libcni.NetworkConfigList
-		if strings.HasSuffix(confFile, ".conflist") {
-			confList, err = libcni.ConfListFromFile(confFile)
-			if err != nil {
-				glog.Warningf("Error loading CNI config list file %s: %v", confFile, err)
-				continue
-			}
-		} else {
-			conf, err := libcni.ConfFromFile(confFile)
-			if err != nil {
-				glog.Warningf("Error loading CNI config file %s: %v", confFile, err)
-				continue
-			}
-			// Ensure the config has a "type" so we know what plugin to run.
-			// Also catches the case where somebody put a conflist into a conf file.
-			if conf.Network.Type == "" {
-				glog.Warningf("Error loading CNI config file %s: no 'type'; perhaps this is a .conflist?", confFile)
-				continue
-			}
-
-			confList, err = libcni.ConfListFromConf(conf)
-			if err != nil {
-				glog.Warningf("Error converting CNI config file %s to list: %v", confFile, err)
-				continue
-			}
+	return files, nil
+}
+
+// loadConfList loads CNI config list from the file, returning
+// nil if the file doesn't contain a valid configuration
+func loadConfList(confFile string) *libcni.NetworkConfigList {
+	var confList *libcni.NetworkConfigList
+	var err error
+	if strings.HasSuffix(confFile, ".conflist") {
+		confList, err = libcni.ConfListFromFile(confFile)
+		if err != nil {
+			glog.Warningf("Error loading CNI config list file %s: %v", confFile, err)
+			return nil
 		}
-		if len(confList.Plugins) == 0 {
-			glog.Warningf("CNI config list %s has no networks, skipping", confFile)
-			continue
+	} else {
+		conf, err := libcni.ConfFromFile(confFile)
+		if err != nil {
+			glog.Warningf("Error loading CNI config file %s: %v", confFile, err)
+			return nil
+		}
+		// Ensure the config has a "type" so we know what plugin to run.
+		// Also catches the case where somebody put a conflist into a conf file.
+		if conf.Network.Type == "" {
+			glog.Warningf("Error loading CNI config file %s: no 'type'; perhaps this is a .conflist?", confFile)
+			return nil
+		}
+
+		confList, err = libcni.ConfListFromConf(conf)
+		if err != nil {
+			glog.Warningf("Error converting CNI config file %s to list: %v", confFile, err)
+			return nil
 		}
-		// TODO: vendor dir handling (see pkg/kubelet/network/cni/cni.go)
-		return confList, err
 	}
-	return nil, fmt.Errorf("No valid networks found in %s", configDir)
+	if len(confList.Plugins) == 0 {
+		glog.Warningf("CNI config list %s has no networks, skipping", confFile)
+		return nil
+	}
+	return confList
 }
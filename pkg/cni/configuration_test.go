@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworkList(t *testing.T) {
+	for _, tc := range []struct {
+		in       string
+		expected []string
+	}{
+		{"calico", []string{"calico"}},
+		{"10-flannel.conflist, storage.conf,tenant-a", []string{"10-flannel.conflist", "storage.conf", "tenant-a"}},
+		{"", nil},
+		{"calico,,flannel", nil},
+		{"../etc/cni", nil},
+		{"..", nil},
+		{"calico,calico", nil},
+	} {
+		networks, err := ParseNetworkList(tc.in)
+		switch {
+		case tc.expected == nil && err == nil:
+			t.Errorf("%q: didn't get an expected error", tc.in)
+		case tc.expected != nil && err != nil:
+			t.Errorf("%q: ParseNetworkList(): %v", tc.in, err)
+		case tc.expected != nil && !reflect.DeepEqual(networks, tc.expected):
+			t.Errorf("%q: bad network list %#v instead of %#v", tc.in, networks, tc.expected)
+		}
+	}
+}
+
+func TestReadConfigurationFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni-config")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	for name, content := range map[string]string{
+		"10-bridge.conf":         `{"cniVersion": "0.3.1", "name": "bridge-net", "type": "bridge"}`,
+		"20-tenant.conflist":     `{"cniVersion": "0.3.1", "name": "tenant-net", "plugins": [{"type": "macvlan"}]}`,
+		"30-broken.conf":         `{"cniVersion": "0.3.1", "name": "broken-net"}`,
+		"not-a-config.txt":       `foobar`,
+		"40-other.json":          `{"cniVersion": "0.3.1", "name": "other-net", "type": "ptp"}`,
+		"50-no-plugins.conflist": `{"cniVersion": "0.3.1", "name": "empty-net", "plugins": []}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		fileName     string
+		expectedName string
+	}{
+		{"10-bridge.conf", "bridge-net"},
+		{"10-bridge", "bridge-net"},
+		{"20-tenant.conflist", "tenant-net"},
+		{"20-tenant", "tenant-net"},
+		{"40-other", "other-net"},
+		{"30-broken.conf", ""},
+		{"50-no-plugins", ""},
+		{"not-a-config.txt", ""},
+		{"nonexistent", ""},
+	} {
+		confList, err := ReadConfigurationFile(tmpDir, tc.fileName)
+		switch {
+		case tc.expectedName == "" && err == nil:
+			t.Errorf("%q: didn't get an expected error", tc.fileName)
+		case tc.expectedName != "" && err != nil:
+			t.Errorf("%q: ReadConfigurationFile(): %v", tc.fileName, err)
+		case tc.expectedName != "" && confList.Name != tc.expectedName:
+			t.Errorf("%q: bad network name %q instead of %q", tc.fileName, confList.Name, tc.expectedName)
+		}
+	}
+}
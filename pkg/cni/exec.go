@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// The vendored libcni can't interrupt the plugins, so the plugin
+// invocation is reimplemented here on top of invoke.PluginExec
+// making it possible to kill the plugins when the context is done.
+// The plugins that are killed halfway may leave some resources such
+// as IPAM allocations behind, so the callers must remove the pod
+// from the network after a cancelled ADD
+
+// contextRawExec runs the plugins killing their whole process
+// group when the context is done, so that the plugin's children
+// that hold its stdout don't keep the invocation going
+type contextRawExec struct {
+	ctx context.Context
+}
+
+func (e contextRawExec) ExecPlugin(pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	if err := e.ctx.Err(); err != nil {
+		return nil, err
+	}
+	stdout := &bytes.Buffer{}
+	c := exec.Cmd{
+		Env:         environ,
+		Path:        pluginPath,
+		Args:        []string{pluginPath},
+		Stdin:       bytes.NewBuffer(stdinData),
+		Stdout:      stdout,
+		Stderr:      os.Stderr,
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	exitCh := make(chan struct{})
+	killedCh := make(chan bool)
+	go func() {
+		select {
+		case <-e.ctx.Done():
+			syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+			killedCh <- true
+		case <-exitCh:
+			killedCh <- false
+		}
+	}()
+	err := c.Wait()
+	close(exitCh)
+	if <-killedCh {
+		return nil, fmt.Errorf("%s was killed: %v", pluginPath, e.ctx.Err())
+	}
+	if err != nil {
+		return nil, pluginErr(err, stdout.Bytes())
+	}
+	return stdout.Bytes(), nil
+}
+
+// pluginErr is the same as the unexported function from CNI's
+// invoke package that extracts the error message from the plugin
+// output
+func pluginErr(err error, output []byte) error {
+	if _, ok := err.(*exec.ExitError); ok {
+		emsg := types.Error{}
+		if perr := json.Unmarshal(output, &emsg); perr != nil {
+			return fmt.Errorf("netplugin failed but error parsing its diagnostic message %q: %v", string(output), perr)
+		}
+		details := ""
+		if emsg.Details != "" {
+			details = fmt.Sprintf("; %v", emsg.Details)
+		}
+		return fmt.Errorf("%v%v", emsg.Msg, details)
+	}
+	return err
+}
+
+func pluginExec(ctx context.Context) *invoke.PluginExec {
+	return &invoke.PluginExec{
+		RawExec:        contextRawExec{ctx},
+		VersionDecoder: &version.PluginDecoder{},
+	}
+}
+
+func pluginArgs(cniConfig *libcni.CNIConfig, action string, rt *libcni.RuntimeConf) *invoke.Args {
+	return &invoke.Args{
+		Command:     action,
+		ContainerID: rt.ContainerID,
+		NetNS:       rt.NetNS,
+		PluginArgs:  rt.Args,
+		IfName:      rt.IfName,
+		Path:        strings.Join(cniConfig.Path, string(os.PathListSeparator)),
+	}
+}
+
+func buildPluginConfig(list *libcni.NetworkConfigList, orig *libcni.NetworkConfig, prevResult types.Result) (*libcni.NetworkConfig, error) {
+	inject := map[string]interface{}{
+		"name":       list.Name,
+		"cniVersion": list.CNIVersion,
+	}
+	if prevResult != nil {
+		inject["prevResult"] = prevResult
+	}
+	return libcni.InjectConf(orig, inject)
+}
+
+// addNetworkList executes the plugins of the network configuration
+// list with the ADD command like libcni's AddNetworkList() does,
+// killing the plugin that's being run when the context is done
+func addNetworkList(ctx context.Context, cniConfig *libcni.CNIConfig, list *libcni.NetworkConfigList, rt *libcni.RuntimeConf) (types.Result, error) {
+	var prevResult types.Result
+	for _, net := range list.Plugins {
+		pluginPath, err := invoke.FindInPath(net.Network.Type, cniConfig.Path)
+		if err != nil {
+			return nil, err
+		}
+		conf, err := buildPluginConfig(list, net, prevResult)
+		if err != nil {
+			return nil, err
+		}
+		prevResult, err = pluginExec(ctx).WithResult(pluginPath, conf.Bytes, pluginArgs(cniConfig, "ADD", rt))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return prevResult, nil
+}
+
+// delNetworkList executes the plugins of the network configuration
+// list with the DEL command in reverse order like libcni's
+// DelNetworkList() does, killing the plugin that's being run when
+// the context is done
+func delNetworkList(ctx context.Context, cniConfig *libcni.CNIConfig, list *libcni.NetworkConfigList, rt *libcni.RuntimeConf) error {
+	for i := len(list.Plugins) - 1; i >= 0; i-- {
+		net := list.Plugins[i]
+		pluginPath, err := invoke.FindInPath(net.Network.Type, cniConfig.Path)
+		if err != nil {
+			return err
+		}
+		conf, err := buildPluginConfig(list, net, nil)
+		if err != nil {
+			return err
+		}
+		if err := pluginExec(ctx).WithoutResult(pluginPath, conf.Bytes, pluginArgs(cniConfig, "DEL", rt)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"sync"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+)
+
+// OpKind denotes the kind of CNI operation
+type OpKind string
+
+const (
+	// OpAdd denotes adding a pod sandbox to a network
+	OpAdd OpKind = "add"
+	// OpDel denotes removing a pod sandbox from a network
+	OpDel OpKind = "del"
+)
+
+// QueueStats contains the numbers of CNI operations
+// that are in progress or waiting for their turn
+type QueueStats struct {
+	// Running is the number of operations being executed
+	Running int
+	// Waiting maps operation kinds to the number
+	// of queued operations
+	Waiting map[OpKind]int
+}
+
+type waiter struct {
+	kind OpKind
+	ch   chan struct{}
+}
+
+// opLimiter is a semaphore that serves the waiters strictly
+// in the order of arrival, so a burst of pod creations can't
+// starve the removals and vice versa
+type opLimiter struct {
+	sync.Mutex
+	max     int
+	running int
+	queue   []waiter
+}
+
+// acquire waits for a free slot. If the context is done before
+// the slot is obtained, the waiter leaves the queue and the context
+// error is returned
+func (l *opLimiter) acquire(ctx context.Context, kind OpKind) error {
+	l.Lock()
+	if l.running < l.max && len(l.queue) == 0 {
+		l.running++
+		l.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	l.queue = append(l.queue, waiter{kind: kind, ch: ch})
+	l.Unlock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.Lock()
+	for n, w := range l.queue {
+		if w.ch == ch {
+			l.queue = append(l.queue[:n], l.queue[n+1:]...)
+			l.Unlock()
+			return ctx.Err()
+		}
+	}
+	l.Unlock()
+	// the slot was handed over to us while the context
+	// was being cancelled
+	l.release()
+	return ctx.Err()
+}
+
+func (l *opLimiter) release() {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.queue) == 0 {
+		l.running--
+		return
+	}
+	// hand the slot over to the first waiter
+	// without decrementing the running count
+	w := l.queue[0]
+	l.queue = l.queue[1:]
+	close(w.ch)
+}
+
+func (l *opLimiter) stats() QueueStats {
+	l.Lock()
+	defer l.Unlock()
+	r := QueueStats{
+		Running: l.running,
+		Waiting: map[OpKind]int{OpAdd: 0, OpDel: 0},
+	}
+	for _, w := range l.queue {
+		r.Waiting[w.kind]++
+	}
+	return r
+}
+
+// LimitedClient wraps a CNIClient limiting the number
+// of concurrent CNI plugin invocations. This is needed
+// for plugins that fail under high concurrency, such as
+// IPAM plugins that use etcd
+type LimitedClient struct {
+	client  CNIClient
+	limiter *opLimiter
+}
+
+var _ CNIClient = &LimitedClient{}
+
+// NewLimitedClient returns a LimitedClient that allows no more than
+// maxConcurrent CNI operations to be executed at the same time
+func NewLimitedClient(client CNIClient, maxConcurrent int) *LimitedClient {
+	return &LimitedClient{
+		client:  client,
+		limiter: &opLimiter{max: maxConcurrent},
+	}
+}
+
+// QueueStats returns the numbers of running and waiting CNI operations
+func (c *LimitedClient) QueueStats() QueueStats {
+	return c.limiter.stats()
+}
+
+// AddSandboxToNetwork implements AddSandboxToNetwork method of CNIClient interface
+func (c *LimitedClient) AddSandboxToNetwork(ctx context.Context, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	if err := c.limiter.acquire(ctx, OpAdd); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+	return c.client.AddSandboxToNetwork(ctx, podId, podName, podNs)
+}
+
+// RemoveSandboxFromNetwork implements RemoveSandboxFromNetwork method of CNIClient interface
+func (c *LimitedClient) RemoveSandboxFromNetwork(ctx context.Context, podId, podName, podNs string) error {
+	if err := c.limiter.acquire(ctx, OpDel); err != nil {
+		return err
+	}
+	defer c.limiter.release()
+	return c.client.RemoveSandboxFromNetwork(ctx, podId, podName, podNs)
+}
+
+// GetDummyNetwork implements GetDummyNetwork method of CNIClient interface
+func (c *LimitedClient) GetDummyNetwork() (*cnicurrent.Result, string, error) {
+	c.limiter.acquire(context.Background(), OpAdd)
+	defer c.limiter.release()
+	return c.client.GetDummyNetwork()
+}
+
+// AddSandboxToNamedNetwork implements AddSandboxToNamedNetwork method of CNIClient interface
+func (c *LimitedClient) AddSandboxToNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	if err := c.limiter.acquire(ctx, OpAdd); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+	return c.client.AddSandboxToNamedNetwork(ctx, network, ifName, podId, podName, podNs)
+}
+
+// RemoveSandboxFromNamedNetwork implements RemoveSandboxFromNamedNetwork method of CNIClient interface
+func (c *LimitedClient) RemoveSandboxFromNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) error {
+	if err := c.limiter.acquire(ctx, OpDel); err != nil {
+		return err
+	}
+	defer c.limiter.release()
+	return c.client.RemoveSandboxFromNamedNetwork(ctx, network, ifName, podId, podName, podNs)
+}
+
+// AddSandboxToNetworks implements AddSandboxToNetworks method of CNIClient interface
+func (c *LimitedClient) AddSandboxToNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	if err := c.limiter.acquire(ctx, OpAdd); err != nil {
+		return nil, err
+	}
+	defer c.limiter.release()
+	return c.client.AddSandboxToNetworks(ctx, configFiles, podId, podName, podNs)
+}
+
+// RemoveSandboxFromNetworks implements RemoveSandboxFromNetworks method of CNIClient interface
+func (c *LimitedClient) RemoveSandboxFromNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) error {
+	if err := c.limiter.acquire(ctx, OpDel); err != nil {
+		return err
+	}
+	defer c.limiter.release()
+	return c.client.RemoveSandboxFromNetworks(ctx, configFiles, podId, podName, podNs)
+}
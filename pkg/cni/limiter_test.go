@@ -0,0 +1,192 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+)
+
+// blockingClient is a CNIClient that records the order of the
+// calls and blocks each of them until it's told to proceed
+type blockingClient struct {
+	sync.Mutex
+	calls   []string
+	proceed chan struct{}
+}
+
+func (c *blockingClient) call(name string) {
+	c.Lock()
+	c.calls = append(c.calls, name)
+	c.Unlock()
+	<-c.proceed
+}
+
+func (c *blockingClient) getCalls() []string {
+	c.Lock()
+	defer c.Unlock()
+	return append([]string(nil), c.calls...)
+}
+
+func (c *blockingClient) AddSandboxToNetwork(ctx context.Context, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	c.call("add:" + podId)
+	return &cnicurrent.Result{}, nil
+}
+
+func (c *blockingClient) RemoveSandboxFromNetwork(ctx context.Context, podId, podName, podNs string) error {
+	c.call("del:" + podId)
+	return nil
+}
+
+func (c *blockingClient) GetDummyNetwork() (*cnicurrent.Result, string, error) {
+	c.call("dummy")
+	return &cnicurrent.Result{}, "", nil
+}
+
+func (c *blockingClient) AddSandboxToNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	c.call("add:" + network + ":" + podId)
+	return &cnicurrent.Result{}, nil
+}
+
+func (c *blockingClient) RemoveSandboxFromNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) error {
+	c.call("del:" + network + ":" + podId)
+	return nil
+}
+
+func (c *blockingClient) AddSandboxToNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) (*cnicurrent.Result, error) {
+	c.call(fmt.Sprintf("add:%v:%s", configFiles, podId))
+	return &cnicurrent.Result{}, nil
+}
+
+func (c *blockingClient) RemoveSandboxFromNetworks(ctx context.Context, configFiles []string, podId, podName, podNs string) error {
+	c.call(fmt.Sprintf("del:%v:%s", configFiles, podId))
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestLimitedClient(t *testing.T) {
+	bc := &blockingClient{proceed: make(chan struct{})}
+	c := NewLimitedClient(bc, 1)
+
+	var wg sync.WaitGroup
+	ops := []struct {
+		name string
+		run  func()
+	}{
+		{"add:pod1", func() { c.AddSandboxToNetwork(context.Background(), "pod1", "vm1", "default") }},
+		{"del:pod2", func() { c.RemoveSandboxFromNetwork(context.Background(), "pod2", "vm2", "default") }},
+		{"add:pod3", func() { c.AddSandboxToNetwork(context.Background(), "pod3", "vm3", "default") }},
+		{"del:extra:pod1", func() {
+			c.RemoveSandboxFromNamedNetwork(context.Background(), "extra", "virtlet-eth1", "pod1", "vm1", "default")
+		}},
+	}
+	for n, op := range ops {
+		wg.Add(1)
+		go func(run func()) {
+			defer wg.Done()
+			run()
+		}(op.run)
+		// make sure the operations are queued in the specified order
+		waitFor(t, op.name, func() bool {
+			st := c.QueueStats()
+			return st.Running == 1 && st.Waiting[OpAdd]+st.Waiting[OpDel] == n
+		})
+	}
+
+	expectedStats := QueueStats{
+		Running: 1,
+		Waiting: map[OpKind]int{OpAdd: 1, OpDel: 2},
+	}
+	if st := c.QueueStats(); !reflect.DeepEqual(st, expectedStats) {
+		t.Errorf("bad queue stats: %#v instead of %#v", st, expectedStats)
+	}
+
+	for n := range ops {
+		waitFor(t, "CNI call", func() bool { return len(bc.getCalls()) == n+1 })
+		if calls := bc.getCalls(); len(calls) != n+1 {
+			t.Fatalf("more than one concurrent CNI call: %v", calls)
+		}
+		bc.proceed <- struct{}{}
+	}
+	wg.Wait()
+
+	var expectedCalls []string
+	for _, op := range ops {
+		expectedCalls = append(expectedCalls, op.name)
+	}
+	if calls := bc.getCalls(); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("bad call order: %v instead of %v", calls, expectedCalls)
+	}
+	expectedStats = QueueStats{
+		Running: 0,
+		Waiting: map[OpKind]int{OpAdd: 0, OpDel: 0},
+	}
+	if st := c.QueueStats(); !reflect.DeepEqual(st, expectedStats) {
+		t.Errorf("bad queue stats after completion: %#v instead of %#v", st, expectedStats)
+	}
+}
+
+func TestLimitedClientCancel(t *testing.T) {
+	bc := &blockingClient{proceed: make(chan struct{})}
+	c := NewLimitedClient(bc, 1)
+
+	doneCh := make(chan error, 1)
+	go func() {
+		_, err := c.AddSandboxToNetwork(context.Background(), "pod1", "vm1", "default")
+		doneCh <- err
+	}()
+	waitFor(t, "CNI call", func() bool { return len(bc.getCalls()) == 1 })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.AddSandboxToNetwork(ctx, "pod2", "vm2", "default"); err != context.DeadlineExceeded {
+		t.Errorf("AddSandboxToNetwork() returned %v instead of %v", err, context.DeadlineExceeded)
+	}
+	expectedStats := QueueStats{
+		Running: 1,
+		Waiting: map[OpKind]int{OpAdd: 0, OpDel: 0},
+	}
+	if st := c.QueueStats(); !reflect.DeepEqual(st, expectedStats) {
+		t.Errorf("bad queue stats after cancellation: %#v instead of %#v", st, expectedStats)
+	}
+
+	bc.proceed <- struct{}{}
+	if err := <-doneCh; err != nil {
+		t.Errorf("AddSandboxToNetwork(): %v", err)
+	}
+	if calls, expectedCalls := bc.getCalls(), []string{"add:pod1"}; !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("bad calls: %v instead of %v", calls, expectedCalls)
+	}
+	if st := c.QueueStats(); st.Running != 0 {
+		t.Errorf("the slot was not released: %#v", st)
+	}
+}
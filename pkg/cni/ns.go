@@ -21,6 +21,8 @@ import (
 	"path"
 
 	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/instance"
 )
 
 // we are using "ip netns" command instead of cni/pkg/ns because usage
@@ -31,12 +33,16 @@ const (
 	netnsBasePath = "/var/run/netns"
 )
 
-func CreateNetNS(name string) error {
-	return callIpNetns("add", name)
+// CreateNetNS creates the network namespace for the pod.
+// The name of the namespace is prefixed with the name of
+// Virtlet instance if it's set
+func CreateNetNS(podId string) error {
+	return callIpNetns("add", instance.NetNSName(podId))
 }
 
-func DestroyNetNS(name string) error {
-	return callIpNetns("del", name)
+// DestroyNetNS removes the network namespace of the pod
+func DestroyNetNS(podId string) error {
+	return callIpNetns("del", instance.NetNSName(podId))
 }
 
 func callIpNetns(command, name string) error {
@@ -48,6 +54,7 @@ func callIpNetns(command, name string) error {
 	return err
 }
 
-func PodNetNSPath(name string) string {
-	return path.Join(netnsBasePath, name)
+// PodNetNSPath returns the path of the network namespace of the pod
+func PodNetNSPath(podId string) string {
+	return path.Join(netnsBasePath, instance.NetNSName(podId))
 }
@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+// defaultConfigVersion is the spec version that's assumed by CNI
+// for the configurations that don't specify cniVersion
+const defaultConfigVersion = "0.1.0"
+
+// PluginVersionInfo describes the spec versions supported by a CNI
+// plugin that's used by one of the configured networks
+type PluginVersionInfo struct {
+	// ConfigFile is the name of the network configuration file
+	// within the configuration directory
+	ConfigFile string
+	// Network is the name of the network
+	Network string
+	// Plugin is the type of the plugin
+	Plugin string
+	// Path is the path to the plugin binary. It's empty if
+	// the plugin could not be found
+	Path string
+	// ConfigVersion is the spec version used by the network
+	// configuration
+	ConfigVersion string
+	// SupportedVersions lists the spec versions reported by the
+	// plugin's VERSION command
+	SupportedVersions []string
+	// Problem describes the reason why the plugin can't be
+	// used with this network configuration, if any
+	Problem string
+}
+
+func (pvi PluginVersionInfo) String() string {
+	s := fmt.Sprintf("%s (network %q): plugin %q, config version %s", pvi.ConfigFile, pvi.Network, pvi.Plugin, pvi.ConfigVersion)
+	if len(pvi.SupportedVersions) != 0 {
+		s += fmt.Sprintf(", plugin supports %s", strings.Join(pvi.SupportedVersions, ", "))
+	}
+	return s
+}
+
+// PluginVersionReport contains the results of probing the CNI
+// plugins that are used by the configured networks
+type PluginVersionReport struct {
+	// RuntimeVersions lists the spec versions that
+	// Virtlet can use
+	RuntimeVersions []string
+	// Plugins describes the plugins in the order of the
+	// configuration files
+	Plugins []PluginVersionInfo
+}
+
+// Problems returns the list of the version mismatches and
+// other problems found during probing
+func (r *PluginVersionReport) Problems() []string {
+	var problems []string
+	for _, pvi := range r.Plugins {
+		if pvi.Problem != "" {
+			problems = append(problems, fmt.Sprintf("%s (network %q): %s", pvi.ConfigFile, pvi.Network, pvi.Problem))
+		}
+	}
+	return problems
+}
+
+// OK returns true if all of the plugins can be used
+// with their network configurations
+func (r *PluginVersionReport) OK() bool {
+	return len(r.Problems()) == 0
+}
+
+// CheckPluginVersions invokes VERSION command of the plugins that are
+// used by the networks defined in configsDir and checks that both the
+// plugins and Virtlet support the spec versions of the configurations.
+// Invalid configuration files are skipped the same way as when
+// the networks are looked up by name
+func CheckPluginVersions(pluginsDir, configsDir string) (*PluginVersionReport, error) {
+	files, err := confFiles(configsDir)
+	if err != nil {
+		return nil, err
+	}
+	runtimeVersions := version.All.SupportedVersions()
+	r := &PluginVersionReport{RuntimeVersions: runtimeVersions}
+	for _, confFile := range files {
+		confList := loadConfList(confFile)
+		if confList == nil {
+			continue
+		}
+		configVersion := confList.CNIVersion
+		if configVersion == "" {
+			configVersion = defaultConfigVersion
+		}
+		for _, plugin := range confList.Plugins {
+			pvi := PluginVersionInfo{
+				ConfigFile:    filepath.Base(confFile),
+				Network:       confList.Name,
+				Plugin:        plugin.Network.Type,
+				ConfigVersion: configVersion,
+			}
+			pvi.Path, pvi.SupportedVersions, pvi.Problem = probePlugin(pvi.Plugin, pluginsDir, configVersion, runtimeVersions)
+			r.Plugins = append(r.Plugins, pvi)
+		}
+	}
+	return r, nil
+}
+
+func probePlugin(plugin, pluginsDir, configVersion string, runtimeVersions []string) (string, []string, string) {
+	if !containsVersion(runtimeVersions, configVersion) {
+		return "", nil, fmt.Sprintf("spec version %s is not supported by Virtlet (supported versions: %s)", configVersion, strings.Join(runtimeVersions, ", "))
+	}
+	pluginPath, err := invoke.FindInPath(plugin, []string{pluginsDir})
+	if err != nil {
+		return "", nil, fmt.Sprintf("plugin %q not found: %v", plugin, err)
+	}
+	info, err := invoke.GetVersionInfo(pluginPath)
+	if err != nil {
+		return pluginPath, nil, fmt.Sprintf("can't get the version info of plugin %q: %v", plugin, err)
+	}
+	supportedVersions := info.SupportedVersions()
+	if !containsVersion(supportedVersions, configVersion) {
+		return pluginPath, supportedVersions, fmt.Sprintf("plugin %q doesn't support spec version %s (supported versions: %s)", plugin, configVersion, strings.Join(supportedVersions, ", "))
+	}
+	return pluginPath, supportedVersions, ""
+}
+
+func containsVersion(versions []string, v string) bool {
+	for _, item := range versions {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckPluginVersions(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni-versions")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pluginsDir := filepath.Join(tmpDir, "bin")
+	configsDir := filepath.Join(tmpDir, "net.d")
+	for _, dir := range []string{pluginsDir, configsDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir(): %v", err)
+		}
+	}
+	for name, output := range map[string]string{
+		"bridge": `{"cniVersion": "0.3.1", "supportedVersions": ["0.1.0", "0.2.0", "0.3.0", "0.3.1"]}`,
+		"legacy": `{"cniVersion": "0.2.0"}`,
+	} {
+		script := "#!/bin/sh\necho '" + output + "'\n"
+		if err := ioutil.WriteFile(filepath.Join(pluginsDir, name), []byte(script), 0755); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+	}
+	for name, content := range map[string]string{
+		"10-bridge.conf":     `{"cniVersion": "0.3.1", "name": "bridge-net", "type": "bridge"}`,
+		"20-legacy.conflist": `{"cniVersion": "0.3.1", "name": "legacy-net", "plugins": [{"type": "bridge"}, {"type": "legacy"}]}`,
+		"30-old.conf":        `{"name": "old-net", "type": "legacy"}`,
+		"40-future.conf":     `{"cniVersion": "0.4.0", "name": "future-net", "type": "bridge"}`,
+		"50-missing.conf":    `{"cniVersion": "0.3.1", "name": "missing-net", "type": "nonexistent"}`,
+		"60-broken.conf":     `{"cniVersion": "0.3.1", "name": "broken-net"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(configsDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+	}
+
+	report, err := CheckPluginVersions(pluginsDir, configsDir)
+	if err != nil {
+		t.Fatalf("CheckPluginVersions(): %v", err)
+	}
+	if report.OK() {
+		t.Errorf("the report is OK despite the problems")
+	}
+	type pluginResult struct {
+		configFile, plugin, configVersion string
+		found                             bool
+		problem                           string
+	}
+	var results []pluginResult
+	for _, pvi := range report.Plugins {
+		results = append(results, pluginResult{
+			configFile:    pvi.ConfigFile,
+			plugin:        pvi.Plugin,
+			configVersion: pvi.ConfigVersion,
+			found:         pvi.Path != "",
+			problem:       pvi.Problem,
+		})
+	}
+	expectedResults := []pluginResult{
+		{"10-bridge.conf", "bridge", "0.3.1", true, ""},
+		{"20-legacy.conflist", "bridge", "0.3.1", true, ""},
+		{"20-legacy.conflist", "legacy", "0.3.1", true, "doesn't support spec version 0.3.1"},
+		{"30-old.conf", "legacy", "0.1.0", true, ""},
+		{"40-future.conf", "bridge", "0.4.0", false, "not supported by Virtlet"},
+		{"50-missing.conf", "nonexistent", "0.3.1", false, "not found"},
+	}
+	if len(results) != len(expectedResults) {
+		t.Fatalf("bad plugin list:\n%#v\ninstead of\n%#v", results, expectedResults)
+	}
+	for i, r := range results {
+		expected := expectedResults[i]
+		problem := r.problem
+		if expected.problem != "" && strings.Contains(problem, expected.problem) {
+			problem = expected.problem
+		}
+		r.problem = problem
+		if !reflect.DeepEqual(r, expected) {
+			t.Errorf("bad result for plugin %d: %#v instead of %#v (problem: %q)", i, r, expected, report.Plugins[i].Problem)
+		}
+	}
+	if problems := report.Problems(); len(problems) != 3 {
+		t.Errorf("bad problem list: %#v", problems)
+	}
+}
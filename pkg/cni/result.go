@@ -17,6 +17,8 @@ limitations under the License.
 package cni
 
 import (
+	"fmt"
+
 	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
 )
 
@@ -45,3 +47,33 @@ func GetPodIP(result *cnicurrent.Result) string {
 	}
 	return ""
 }
+
+// MergeResults combines CNI results for several networks the pod
+// is attached to into a single result. The interfaces and the
+// addresses of all the networks are included, with the indices of
+// the interfaces adjusted accordingly. The DNS settings and the
+// default route are only taken from the first network
+func MergeResults(results []*cnicurrent.Result) (*cnicurrent.Result, error) {
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no CNI results to merge")
+	}
+	r := *results[0]
+	r.Interfaces = append([]*cnicurrent.Interface(nil), r.Interfaces...)
+	r.IPs = append([]*cnicurrent.IPConfig(nil), r.IPs...)
+	r.Routes = append(r.Routes[:0:0], r.Routes...)
+	for _, result := range results[1:] {
+		offset := len(r.Interfaces)
+		r.Interfaces = append(r.Interfaces, result.Interfaces...)
+		for _, ipConfig := range result.IPs {
+			c := *ipConfig
+			c.Interface += offset
+			r.IPs = append(r.IPs, &c)
+		}
+		for _, route := range result.Routes {
+			if ones, _ := route.Dst.Mask.Size(); ones != 0 {
+				r.Routes = append(r.Routes, route)
+			}
+		}
+	}
+	return &r, nil
+}
@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cni
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/Mirantis/virtlet/tests/cnifixture"
+)
+
+func mustParseCIDR(s string) net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	ipNet.IP = ip
+	return *ipNet
+}
+
+func TestMergeResults(t *testing.T) {
+	defaultRoute := &cnitypes.Route{Dst: mustParseCIDR("0.0.0.0/0"), GW: net.ParseIP("10.1.90.1")}
+	storageRoute := &cnitypes.Route{Dst: mustParseCIDR("10.20.0.0/16"), GW: net.ParseIP("10.2.0.1")}
+	first := &cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{Name: "cni0"},
+			{Name: "virtlet-eth0", Sandbox: "/var/run/netns/foo"},
+		},
+		IPs: []*cnicurrent.IPConfig{
+			{Version: "4", Interface: 1, Address: mustParseCIDR("10.1.90.5/24")},
+		},
+		Routes: []*cnitypes.Route{defaultRoute},
+		DNS:    cnitypes.DNS{Nameservers: []string{"10.96.0.10"}},
+	}
+	second := &cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{Name: "virtlet-eth1", Sandbox: "/var/run/netns/foo"},
+		},
+		IPs: []*cnicurrent.IPConfig{
+			{Version: "4", Interface: 0, Address: mustParseCIDR("10.2.0.5/24")},
+		},
+		Routes: []*cnitypes.Route{
+			{Dst: mustParseCIDR("0.0.0.0/0"), GW: net.ParseIP("10.2.0.1")},
+			storageRoute,
+		},
+		DNS: cnitypes.DNS{Nameservers: []string{"10.2.0.1"}},
+	}
+	r, err := MergeResults([]*cnicurrent.Result{first, second})
+	if err != nil {
+		t.Fatalf("MergeResults(): %v", err)
+	}
+	expected := &cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{Name: "cni0"},
+			{Name: "virtlet-eth0", Sandbox: "/var/run/netns/foo"},
+			{Name: "virtlet-eth1", Sandbox: "/var/run/netns/foo"},
+		},
+		IPs: []*cnicurrent.IPConfig{
+			{Version: "4", Interface: 1, Address: mustParseCIDR("10.1.90.5/24")},
+			{Version: "4", Interface: 2, Address: mustParseCIDR("10.2.0.5/24")},
+		},
+		Routes: []*cnitypes.Route{defaultRoute, storageRoute},
+		DNS:    cnitypes.DNS{Nameservers: []string{"10.96.0.10"}},
+	}
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("bad merged result: %s instead of %s", r, expected)
+	}
+	if second.IPs[0].Interface != 0 || len(first.Interfaces) != 2 || len(first.Routes) != 1 {
+		t.Errorf("the original results were modified")
+	}
+
+	if _, err := MergeResults(nil); err == nil {
+		t.Errorf("MergeResults() didn't fail for an empty list")
+	}
+}
+
+func TestGetPodIP(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		result *cnicurrent.Result
+		podIP  string
+	}{
+		{
+			name:   "nil result",
+			result: nil,
+			podIP:  "",
+		},
+		{
+			name:   "no addresses",
+			result: cnifixture.NewResult().Interface("eth0", cnifixture.MAC(0)).Result(),
+			podIP:  "",
+		},
+		{
+			name:   "single interface",
+			result: cnifixture.MultiInterfaceResult(1).Result(),
+			podIP:  "10.1.90.5",
+		},
+		{
+			name:   "multiple interfaces",
+			result: cnifixture.MultiInterfaceResult(3).Result(),
+			podIP:  "10.1.90.5",
+		},
+		{
+			name: "IPv6 only",
+			result: cnifixture.NewResult().
+				Interface("eth0", cnifixture.MAC(0)).
+				IP("fd00:1::5/64", "fd00:1::1").
+				DefaultRoute("fd00:1::1").
+				Result(),
+			podIP: "",
+		},
+		{
+			name: "IPv6 address first",
+			result: cnifixture.NewResult().
+				Interface("eth0", cnifixture.MAC(0)).
+				IP("fd00:1::5/64", "").
+				IP("10.1.90.5/24", "10.1.90.1").
+				Result(),
+			podIP: "10.1.90.5",
+		},
+		{
+			name: "host interface and missing gateway",
+			result: cnifixture.NewResult().
+				HostInterface("cni0", "ca:ce:8c:92:4d:4a").
+				Interface("eth0", cnifixture.MAC(0)).
+				IP("10.1.90.5/24", "").
+				Route("10.10.0.0/16", "").
+				Result(),
+			podIP: "10.1.90.5",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if podIP := GetPodIP(tc.result); podIP != tc.podIP {
+				t.Errorf("bad pod IP %q instead of %q", podIP, tc.podIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	k8sscheme "k8s.io/kubernetes/pkg/client/clientset_generated/clientset/scheme"
+	corev1client "k8s.io/kubernetes/pkg/client/clientset_generated/clientset/typed/core/v1"
+	"k8s.io/kubernetes/pkg/client/leaderelection"
+	"k8s.io/kubernetes/pkg/client/leaderelection/resourcelock"
+)
+
+const componentName = "virtlet-controller"
+
+// LeaderElectionConfig specifies the leader election settings
+type LeaderElectionConfig struct {
+	// LockName is the name of the ConfigMap used as the lock
+	LockName string
+	// Identity is the identity of this instance of the controller
+	Identity string
+	// LeaseDuration is the time the non-leader instances wait
+	// before trying to take over the leadership
+	LeaseDuration time.Duration
+	// RenewDeadline is the time the leader keeps trying to renew
+	// the lease before giving up the leadership
+	RenewDeadline time.Duration
+	// RetryPeriod is the interval between attempts to acquire
+	// or renew the leadership
+	RetryPeriod time.Duration
+}
+
+// Config specifies the settings of virtlet controller
+type Config struct {
+	// Namespace is the namespace that contains virtlet
+	// resources and the controller's ConfigMaps
+	Namespace string
+	// ResyncPeriod is the interval for full resync of
+	// the watched resources
+	ResyncPeriod time.Duration
+	// LeaderElection specifies leader election settings
+	LeaderElection LeaderElectionConfig
+}
+
+// Controller watches virtlet CRDs on behalf of all the nodes.
+// Only one instance of the controller is active at any
+// given time
+type Controller struct {
+	clientset          kubernetes.Interface
+	lockClient         corev1client.ConfigMapsGetter
+	imageMappingClient cache.Getter
+	requestClient      rest.Interface
+	config             Config
+}
+
+// NewController creates a new Controller. lockClient is used for
+// leader election, imageMappingClient and requestClient are the REST
+// clients for VirtletImageMapping and VM request CRDs, respectively
+func NewController(clientset kubernetes.Interface, lockClient corev1client.ConfigMapsGetter, imageMappingClient cache.Getter, requestClient rest.Interface, config Config) *Controller {
+	return &Controller{
+		clientset:          clientset,
+		lockClient:         lockClient,
+		imageMappingClient: imageMappingClient,
+		requestClient:      requestClient,
+		config:             config,
+	}
+}
+
+func (c *Controller) lead(stopCh <-chan struct{}) {
+	glog.V(1).Infof("Starting image mapping sync and VM request handling")
+	cmClient := c.clientset.CoreV1().ConfigMaps(c.config.Namespace)
+	go newImageMappingSyncer(cmClient, c.imageMappingClient, c.config.Namespace, c.config.ResyncPeriod).Run(stopCh)
+	newRequestHandler(c.clientset, c.requestClient, c.config.ResyncPeriod).Run(stopCh)
+}
+
+// Run runs the leader election and does the controller's work
+// while being the leader. It returns after the leadership is lost
+func (c *Controller) Run() error {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(glog.V(2).Infof)
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: c.clientset.CoreV1().Events(c.config.Namespace)})
+	recorder := broadcaster.NewRecorder(k8sscheme.Scheme, v1.EventSource{Component: componentName})
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.ConfigMapLock{
+			ConfigMapMeta: meta_v1.ObjectMeta{
+				Namespace: c.config.Namespace,
+				Name:      c.config.LeaderElection.LockName,
+			},
+			Client: c.lockClient,
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity:      c.config.LeaderElection.Identity,
+				EventRecorder: recorder,
+			},
+		},
+		LeaseDuration: c.config.LeaderElection.LeaseDuration,
+		RenewDeadline: c.config.LeaderElection.RenewDeadline,
+		RetryPeriod:   c.config.LeaderElection.RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: c.lead,
+			OnStoppedLeading: func() {
+				glog.Warningf("Leadership lost")
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	elector.Run()
+	return nil
+}
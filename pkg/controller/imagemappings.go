@@ -0,0 +1,172 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	yaml "gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/Mirantis/virtlet/pkg/imagetranslation"
+)
+
+const (
+	// ImageMappingsConfigMapName is the name of the ConfigMap that
+	// receives the contents of VirtletImageMapping objects.
+	// The ConfigMap is mounted into virtlet pods as a part
+	// of the image translations directory
+	ImageMappingsConfigMapName = "virtlet-image-mappings"
+	imageMappingKeyPrefix      = "crd-"
+	imageMappingKeySuffix      = ".yaml"
+	syncRetryInterval          = 10 * time.Second
+)
+
+// imageMappingsData converts a list of VirtletImageMapping objects
+// to ConfigMap data that can be read by the file based image
+// translation config source
+func imageMappingsData(objs []interface{}) (map[string]string, error) {
+	data := make(map[string]string)
+	for _, obj := range objs {
+		vim, ok := obj.(*imagetranslation.VirtletImageMapping)
+		if !ok {
+			return nil, fmt.Errorf("unexpected object type %T", obj)
+		}
+		out, err := yaml.Marshal(vim.Spec)
+		if err != nil {
+			return nil, fmt.Errorf("error marshalling image mapping %q: %v", vim.Name(), err)
+		}
+		data[imageMappingKeyPrefix+vim.Name()+imageMappingKeySuffix] = string(out)
+	}
+	return data, nil
+}
+
+// ConfigMapClient is the subset of the ConfigMap client
+// that's used for publishing the image mappings
+type ConfigMapClient interface {
+	Get(name string, options meta_v1.GetOptions) (*v1.ConfigMap, error)
+	Create(*v1.ConfigMap) (*v1.ConfigMap, error)
+	Update(*v1.ConfigMap) (*v1.ConfigMap, error)
+}
+
+// syncConfigMap makes sure that the ConfigMap with the specified
+// name exists and has the specified data
+func syncConfigMap(client ConfigMapClient, name string, data map[string]string) error {
+	cm, err := client.Get(name, meta_v1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		_, err = client.Create(&v1.ConfigMap{
+			ObjectMeta: meta_v1.ObjectMeta{Name: name},
+			Data:       data,
+		})
+		return err
+	case err != nil:
+		return err
+	case len(cm.Data) == 0 && len(data) == 0:
+		return nil
+	case reflect.DeepEqual(cm.Data, data):
+		return nil
+	}
+	cm.Data = data
+	_, err = client.Update(cm)
+	return err
+}
+
+// imageMappingSyncer publishes VirtletImageMapping objects from
+// the specified namespace in a ConfigMap, so virtlet nodes don't
+// need to list the objects upon each image pull
+type imageMappingSyncer struct {
+	cmClient  ConfigMapClient
+	crdClient cache.Getter
+	namespace string
+	resync    time.Duration
+	store     cache.Store
+	kickCh    chan struct{}
+}
+
+func newImageMappingSyncer(cmClient ConfigMapClient, crdClient cache.Getter, namespace string, resync time.Duration) *imageMappingSyncer {
+	return &imageMappingSyncer{
+		cmClient:  cmClient,
+		crdClient: crdClient,
+		namespace: namespace,
+		resync:    resync,
+		kickCh:    make(chan struct{}, 1),
+	}
+}
+
+func (s *imageMappingSyncer) kick() {
+	select {
+	case s.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *imageMappingSyncer) sync() error {
+	objs := s.store.List()
+	data, err := imageMappingsData(objs)
+	if err != nil {
+		return err
+	}
+	if err := syncConfigMap(s.cmClient, ImageMappingsConfigMapName, data); err != nil {
+		return fmt.Errorf("error updating ConfigMap %q: %v", ImageMappingsConfigMapName, err)
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	glog.V(2).Infof("Image mappings synced: %v", keys)
+	return nil
+}
+
+// Run watches VirtletImageMapping objects and updates the
+// ConfigMap until stopCh is closed
+func (s *imageMappingSyncer) Run(stopCh <-chan struct{}) {
+	lw := cache.NewListWatchFromClient(s.crdClient, "virtletimagemappings", s.namespace, fields.Everything())
+	store, informer := cache.NewInformer(lw, &imagetranslation.VirtletImageMapping{}, s.resync, cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { s.kick() },
+		UpdateFunc: func(interface{}, interface{}) { s.kick() },
+		DeleteFunc: func(interface{}) { s.kick() },
+	})
+	s.store = store
+	go informer.Run(stopCh)
+	if !cache.WaitForCacheSync(stopCh, informer.HasSynced) {
+		return
+	}
+	// make sure the ConfigMap is created even if there
+	// are no image mappings
+	s.kick()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-s.kickCh:
+		}
+		if err := s.sync(); err != nil {
+			glog.Errorf("Error syncing image mappings: %v", err)
+			time.AfterFunc(syncRetryInterval, s.kick)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/Mirantis/virtlet/pkg/imagetranslation"
+)
+
+var configMapResource = schema.GroupResource{Resource: "configmaps"}
+
+// fakeConfigMapClient is a ConfigMapClient that rejects
+// updates of stale objects like the apiserver does
+type fakeConfigMapClient struct {
+	configMaps map[string]*v1.ConfigMap
+	version    int
+}
+
+var _ ConfigMapClient = &fakeConfigMapClient{}
+
+func newFakeConfigMapClient() *fakeConfigMapClient {
+	return &fakeConfigMapClient{configMaps: make(map[string]*v1.ConfigMap)}
+}
+
+func copyConfigMap(cm *v1.ConfigMap) *v1.ConfigMap {
+	r := *cm
+	r.Annotations = make(map[string]string)
+	for k, v := range cm.Annotations {
+		r.Annotations[k] = v
+	}
+	if cm.Data != nil {
+		r.Data = make(map[string]string)
+		for k, v := range cm.Data {
+			r.Data[k] = v
+		}
+	}
+	return &r
+}
+
+func (c *fakeConfigMapClient) store(cm *v1.ConfigMap) *v1.ConfigMap {
+	c.version++
+	cm = copyConfigMap(cm)
+	cm.ResourceVersion = strconv.Itoa(c.version)
+	c.configMaps[cm.Name] = cm
+	return copyConfigMap(cm)
+}
+
+func (c *fakeConfigMapClient) Get(name string, options meta_v1.GetOptions) (*v1.ConfigMap, error) {
+	cm, found := c.configMaps[name]
+	if !found {
+		return nil, errors.NewNotFound(configMapResource, name)
+	}
+	return copyConfigMap(cm), nil
+}
+
+func (c *fakeConfigMapClient) Create(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	if _, found := c.configMaps[cm.Name]; found {
+		return nil, errors.NewAlreadyExists(configMapResource, cm.Name)
+	}
+	return c.store(cm), nil
+}
+
+func (c *fakeConfigMapClient) Update(cm *v1.ConfigMap) (*v1.ConfigMap, error) {
+	old, found := c.configMaps[cm.Name]
+	if !found {
+		return nil, errors.NewNotFound(configMapResource, cm.Name)
+	}
+	if old.ResourceVersion != cm.ResourceVersion {
+		return nil, errors.NewConflict(configMapResource, cm.Name, nil)
+	}
+	return c.store(cm), nil
+}
+
+func TestImageMappingsData(t *testing.T) {
+	data, err := imageMappingsData([]interface{}{
+		&imagetranslation.VirtletImageMapping{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "cirros"},
+			Spec: imagetranslation.ImageTranslation{
+				Prefix: "cirros",
+				Rules: []imagetranslation.TranslationRule{
+					{
+						Name: "0.3.5",
+						Url:  "https://github.com/mirantis/virtlet/releases/download/v0.9.3/cirros.img",
+					},
+				},
+			},
+		},
+		&imagetranslation.VirtletImageMapping{
+			ObjectMeta: meta_v1.ObjectMeta{Name: "empty"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("imageMappingsData(): %v", err)
+	}
+	expected := map[string]string{
+		"crd-cirros.yaml": "prefix: cirros\n" +
+			"translations:\n" +
+			"- name: 0.3.5\n" +
+			"  url: https://github.com/mirantis/virtlet/releases/download/v0.9.3/cirros.img\n" +
+			"transports: {}\n",
+		"crd-empty.yaml": "translations: []\ntransports: {}\n",
+	}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("bad image mappings data:\n%#v\ninstead of\n%#v", data, expected)
+	}
+
+	if _, err := imageMappingsData([]interface{}{"foobar"}); err == nil {
+		t.Errorf("imageMappingsData() didn't fail for an object of wrong type")
+	}
+}
+
+func TestSyncConfigMap(t *testing.T) {
+	client := newFakeConfigMapClient()
+	for _, step := range []struct {
+		name            string
+		data            map[string]string
+		expectedVersion string
+	}{
+		{
+			name:            "create empty ConfigMap",
+			expectedVersion: "1",
+		},
+		{
+			name:            "no update for the same empty data",
+			data:            map[string]string{},
+			expectedVersion: "1",
+		},
+		{
+			name:            "update data",
+			data:            map[string]string{"crd-foo.yaml": "prefix: foo\n"},
+			expectedVersion: "2",
+		},
+		{
+			name:            "no update for the same data",
+			data:            map[string]string{"crd-foo.yaml": "prefix: foo\n"},
+			expectedVersion: "2",
+		},
+		{
+			name:            "remove data",
+			data:            map[string]string{},
+			expectedVersion: "3",
+		},
+	} {
+		t.Run(step.name, func(t *testing.T) {
+			if err := syncConfigMap(client, ImageMappingsConfigMapName, step.data); err != nil {
+				t.Fatalf("syncConfigMap(): %v", err)
+			}
+			cm, err := client.Get(ImageMappingsConfigMapName, meta_v1.GetOptions{})
+			if err != nil {
+				t.Fatalf("Get(): %v", err)
+			}
+			if cm.ResourceVersion != step.expectedVersion {
+				t.Errorf("bad resource version %q instead of %q", cm.ResourceVersion, step.expectedVersion)
+			}
+			if len(cm.Data) != 0 || len(step.data) != 0 {
+				if !reflect.DeepEqual(cm.Data, step.data) {
+					t.Errorf("bad ConfigMap data %#v instead of %#v", cm.Data, step.data)
+				}
+			}
+		})
+	}
+}
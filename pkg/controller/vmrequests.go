@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/Mirantis/virtlet/pkg/vmrequest"
+)
+
+const migrationNotSupportedMessage = "live migration of VMs is not supported by Virtlet"
+
+type podGetter func(namespace, name string) (*v1.Pod, error)
+
+// assignSnapshotRequest returns an updated copy of a new snapshot
+// request that's assigned to the node which runs the VM pod, or
+// marked as failed if it can't be assigned. It returns nil if the
+// request is already assigned or completed
+func assignSnapshotRequest(r *vmrequest.VirtletSnapshotRequest, getPod podGetter) *vmrequest.VirtletSnapshotRequest {
+	if r.Status.Phase != "" {
+		return nil
+	}
+	updated := *r
+	err := r.Validate()
+	var pod *v1.Pod
+	if err == nil {
+		pod, err = getPod(r.Namespace, r.Spec.PodName)
+		if err == nil && pod.Spec.NodeName == "" {
+			err = fmt.Errorf("pod %q is not scheduled yet", r.Spec.PodName)
+		}
+	}
+	if err != nil {
+		updated.Status = vmrequest.SnapshotRequestStatus{
+			Phase:   vmrequest.PhaseFailed,
+			Message: err.Error(),
+		}
+		return &updated
+	}
+	updated.Labels = map[string]string{vmrequest.NodeLabel: pod.Spec.NodeName}
+	for k, v := range r.Labels {
+		if k != vmrequest.NodeLabel {
+			updated.Labels[k] = v
+		}
+	}
+	updated.Status = vmrequest.SnapshotRequestStatus{
+		Phase:    vmrequest.PhasePending,
+		NodeName: pod.Spec.NodeName,
+	}
+	return &updated
+}
+
+// rejectMigrationRequest returns an updated copy of a new migration
+// request that's marked as failed, as Virtlet can't migrate VMs
+// between the nodes. It returns nil if the request is already
+// handled
+func rejectMigrationRequest(r *vmrequest.VirtletMigrationRequest) *vmrequest.VirtletMigrationRequest {
+	if r.Status.Phase != "" {
+		return nil
+	}
+	updated := *r
+	updated.Status = vmrequest.MigrationRequestStatus{
+		Phase:   vmrequest.PhaseFailed,
+		Message: migrationNotSupportedMessage,
+	}
+	return &updated
+}
+
+// requestHandler handles new VM requests from all the namespaces.
+// The snapshot requests are assigned to the nodes where they're
+// executed by virtlet
+type requestHandler struct {
+	clientset kubernetes.Interface
+	client    rest.Interface
+	resync    time.Duration
+}
+
+func newRequestHandler(clientset kubernetes.Interface, client rest.Interface, resync time.Duration) *requestHandler {
+	return &requestHandler{
+		clientset: clientset,
+		client:    client,
+		resync:    resync,
+	}
+}
+
+func (h *requestHandler) getPod(namespace, name string) (*v1.Pod, error) {
+	return h.clientset.CoreV1().Pods(namespace).Get(name, meta_v1.GetOptions{})
+}
+
+func (h *requestHandler) handleSnapshotRequest(obj interface{}) {
+	r, ok := obj.(*vmrequest.VirtletSnapshotRequest)
+	if !ok {
+		return
+	}
+	updated := assignSnapshotRequest(r, h.getPod)
+	if updated == nil {
+		return
+	}
+	// upon an error, the request is handled again
+	// during the next resync
+	if err := vmrequest.UpdateSnapshotRequest(h.client, updated); err != nil {
+		glog.Errorf("Error updating snapshot request %s/%s: %v", r.Namespace, r.Name, err)
+		return
+	}
+	glog.V(1).Infof("Snapshot request %s/%s: phase %s, node %q, message %q", r.Namespace, r.Name, updated.Status.Phase, updated.Status.NodeName, updated.Status.Message)
+}
+
+func (h *requestHandler) handleMigrationRequest(obj interface{}) {
+	r, ok := obj.(*vmrequest.VirtletMigrationRequest)
+	if !ok {
+		return
+	}
+	updated := rejectMigrationRequest(r)
+	if updated == nil {
+		return
+	}
+	if err := vmrequest.UpdateMigrationRequest(h.client, updated); err != nil {
+		glog.Errorf("Error updating migration request %s/%s: %v", r.Namespace, r.Name, err)
+		return
+	}
+	glog.V(1).Infof("Migration request %s/%s rejected", r.Namespace, r.Name)
+}
+
+func (h *requestHandler) runInformer(resource string, objType runtime.Object, handle func(interface{}), stopCh <-chan struct{}) {
+	lw := cache.NewListWatchFromClient(h.client, resource, meta_v1.NamespaceAll, fields.Everything())
+	_, informer := cache.NewInformer(lw, objType, h.resync, cache.ResourceEventHandlerFuncs{
+		AddFunc:    handle,
+		UpdateFunc: func(_, obj interface{}) { handle(obj) },
+	})
+	informer.Run(stopCh)
+}
+
+// Run handles VM requests until stopCh is closed
+func (h *requestHandler) Run(stopCh <-chan struct{}) {
+	go h.runInformer(vmrequest.SnapshotRequestResource, &vmrequest.VirtletSnapshotRequest{}, h.handleSnapshotRequest, stopCh)
+	h.runInformer(vmrequest.MigrationRequestResource, &vmrequest.VirtletMigrationRequest{}, h.handleMigrationRequest, stopCh)
+}
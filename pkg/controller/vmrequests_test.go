@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/Mirantis/virtlet/pkg/vmrequest"
+)
+
+func fakePodGetter(pods ...*v1.Pod) podGetter {
+	return func(namespace, name string) (*v1.Pod, error) {
+		for _, pod := range pods {
+			if pod.Namespace == namespace && pod.Name == name {
+				return pod, nil
+			}
+		}
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, name)
+	}
+}
+
+func TestAssignSnapshotRequest(t *testing.T) {
+	getPod := fakePodGetter(
+		&v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Namespace: "default", Name: "vm"},
+			Spec:       v1.PodSpec{NodeName: "node1"},
+		},
+		&v1.Pod{
+			ObjectMeta: meta_v1.ObjectMeta{Namespace: "default", Name: "unscheduled-vm"},
+		})
+	spec := func(podName string) vmrequest.SnapshotRequestSpec {
+		return vmrequest.SnapshotRequestSpec{
+			PodName: podName,
+			URL:     "https://s3.example.com/bucket/vm.qcow2",
+			Secret:  "creds",
+		}
+	}
+	for _, tc := range []struct {
+		name           string
+		spec           vmrequest.SnapshotRequestSpec
+		status         vmrequest.SnapshotRequestStatus
+		labels         map[string]string
+		expectedLabels map[string]string
+		expectedStatus *vmrequest.SnapshotRequestStatus
+	}{
+		{
+			name:           "new request",
+			spec:           spec("vm"),
+			labels:         map[string]string{"foo": "bar"},
+			expectedLabels: map[string]string{"foo": "bar", vmrequest.NodeLabel: "node1"},
+			expectedStatus: &vmrequest.SnapshotRequestStatus{Phase: vmrequest.PhasePending, NodeName: "node1"},
+		},
+		{
+			name:           "invalid request",
+			spec:           vmrequest.SnapshotRequestSpec{PodName: "vm"},
+			expectedStatus: &vmrequest.SnapshotRequestStatus{Phase: vmrequest.PhaseFailed, Message: "secret name must be specified"},
+		},
+		{
+			name:           "nonexistent pod",
+			spec:           spec("foobar"),
+			expectedStatus: &vmrequest.SnapshotRequestStatus{Phase: vmrequest.PhaseFailed, Message: `pods "foobar" not found`},
+		},
+		{
+			name:           "unscheduled pod",
+			spec:           spec("unscheduled-vm"),
+			expectedStatus: &vmrequest.SnapshotRequestStatus{Phase: vmrequest.PhaseFailed, Message: `pod "unscheduled-vm" is not scheduled yet`},
+		},
+		{
+			name:   "assigned request",
+			spec:   spec("vm"),
+			status: vmrequest.SnapshotRequestStatus{Phase: vmrequest.PhasePending, NodeName: "node1"},
+		},
+		{
+			name:   "completed request",
+			spec:   spec("vm"),
+			status: vmrequest.SnapshotRequestStatus{Phase: vmrequest.PhaseDone, NodeName: "node1", Size: 4242},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &vmrequest.VirtletSnapshotRequest{
+				ObjectMeta: meta_v1.ObjectMeta{Namespace: "default", Name: "req", Labels: tc.labels},
+				Spec:       tc.spec,
+				Status:     tc.status,
+			}
+			updated := assignSnapshotRequest(r, getPod)
+			if tc.expectedStatus == nil {
+				if updated != nil {
+					t.Errorf("the request that's already handled was updated: %#v", updated)
+				}
+				return
+			}
+			if updated == nil {
+				t.Fatalf("the request wasn't updated")
+			}
+			if !reflect.DeepEqual(updated.Status, *tc.expectedStatus) {
+				t.Errorf("bad status: %#v instead of %#v", updated.Status, *tc.expectedStatus)
+			}
+			if len(updated.Labels) != 0 || len(tc.expectedLabels) != 0 {
+				if !reflect.DeepEqual(updated.Labels, tc.expectedLabels) {
+					t.Errorf("bad labels: %v instead of %v", updated.Labels, tc.expectedLabels)
+				}
+			}
+			if r.Status != tc.status || !reflect.DeepEqual(r.Labels, tc.labels) {
+				t.Errorf("the original request was modified")
+			}
+		})
+	}
+}
+
+func TestRejectMigrationRequest(t *testing.T) {
+	r := &vmrequest.VirtletMigrationRequest{
+		ObjectMeta: meta_v1.ObjectMeta{Namespace: "default", Name: "req"},
+		Spec:       vmrequest.MigrationRequestSpec{PodName: "vm", TargetNode: "node2"},
+	}
+	updated := rejectMigrationRequest(r)
+	if updated == nil {
+		t.Fatalf("the migration request wasn't updated")
+	}
+	expectedStatus := vmrequest.MigrationRequestStatus{Phase: vmrequest.PhaseFailed, Message: migrationNotSupportedMessage}
+	if updated.Status != expectedStatus {
+		t.Errorf("bad status: %#v instead of %#v", updated.Status, expectedStatus)
+	}
+	if r.Status.Phase != "" {
+		t.Errorf("the original request was modified")
+	}
+	if rejectMigrationRequest(updated) != nil {
+		t.Errorf("the request was rejected again")
+	}
+}
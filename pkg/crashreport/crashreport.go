@@ -0,0 +1,211 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package crashreport writes a report with the stack traces and a
+// snapshot of the process state when the process panics, so the
+// crash can be diagnosed from a single file.
+package crashreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DefaultMaxReports is the default number of crash
+	// reports kept in the crash directory
+	DefaultMaxReports = 10
+	reportPrefix      = "crash-"
+	reportSuffix      = ".json"
+	maxStackSize      = 16 * 1024 * 1024
+)
+
+// collectorTimeout limits the time each state collector may take so
+// a deadlocked component doesn't prevent the report from being
+// written. It's a var so it can be overridden in tests
+var collectorTimeout = 3 * time.Second
+
+// StateCollector returns a part of the process state
+// that's included in the crash report
+type StateCollector func() (interface{}, error)
+
+// Report is written to the crash directory upon a panic
+type Report struct {
+	// Time is the time of the crash
+	Time time.Time `json:"time"`
+	// Panic is the value passed to panic()
+	Panic string `json:"panic"`
+	// Stack contains the stack traces of all the goroutines
+	Stack string `json:"stack"`
+	// State contains the results of the state collectors
+	// keyed by their names
+	State map[string]interface{} `json:"state,omitempty"`
+	// Errors contains the errors returned by the
+	// state collectors keyed by their names
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+type namedCollector struct {
+	name string
+	fn   StateCollector
+}
+
+// Reporter writes crash reports to the crash directory
+type Reporter struct {
+	sync.Mutex
+	dir        string
+	maxReports int
+	collectors []namedCollector
+	now        func() time.Time
+}
+
+// NewReporter returns a Reporter that writes crash reports into the
+// specified directory, keeping at most DefaultMaxReports of them
+func NewReporter(dir string) *Reporter {
+	return &Reporter{dir: dir, maxReports: DefaultMaxReports, now: time.Now}
+}
+
+// AddStateCollector adds a function that's used to
+// collect a named part of the process state
+func (r *Reporter) AddStateCollector(name string, fn StateCollector) {
+	r.Lock()
+	defer r.Unlock()
+	r.collectors = append(r.collectors, namedCollector{name, fn})
+}
+
+func (r *Reporter) collect(c namedCollector) (interface{}, error) {
+	type result struct {
+		value interface{}
+		err   error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				resultCh <- result{err: fmt.Errorf("state collector panicked: %v", p)}
+			}
+		}()
+		value, err := c.fn()
+		resultCh <- result{value, err}
+	}()
+	select {
+	case res := <-resultCh:
+		return res.value, res.err
+	case <-time.After(collectorTimeout):
+		return nil, fmt.Errorf("timed out after %v", collectorTimeout)
+	}
+}
+
+// Write writes a crash report for the specified panic value
+// and stack traces, returning the path to the report
+func (r *Reporter) Write(panicValue interface{}, stack []byte) (string, error) {
+	r.Lock()
+	defer r.Unlock()
+	report := Report{
+		Time:   r.now().UTC(),
+		Panic:  fmt.Sprint(panicValue),
+		Stack:  string(stack),
+		State:  make(map[string]interface{}),
+		Errors: make(map[string]string),
+	}
+	for _, c := range r.collectors {
+		value, err := r.collect(c)
+		if err != nil {
+			report.Errors[c.name] = err.Error()
+		} else {
+			report.State[c.name] = value
+		}
+	}
+	bs, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("error marshalling the crash report: %v", err)
+	}
+	if err := os.MkdirAll(r.dir, 0700); err != nil {
+		return "", err
+	}
+	r.removeOldReports()
+	path := filepath.Join(r.dir, reportPrefix+report.Time.Format("20060102T150405.000Z")+reportSuffix)
+	if err := ioutil.WriteFile(path, bs, 0600); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// removeOldReports removes the oldest reports so there's
+// room for a new one. The names of the reports sort
+// in the order of their creation
+func (r *Reporter) removeOldReports() {
+	fis, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		glog.Warningf("Can't list the crash reports: %v", err)
+		return
+	}
+	var names []string
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), reportPrefix) && strings.HasSuffix(fi.Name(), reportSuffix) {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) >= r.maxReports && len(names) > 0 {
+		if err := os.Remove(filepath.Join(r.dir, names[0])); err != nil {
+			glog.Warningf("Can't remove old crash report: %v", err)
+		}
+		names = names[1:]
+	}
+}
+
+// Stack returns the stack traces of all the goroutines
+func Stack() []byte {
+	for size := 64 * 1024; ; size *= 2 {
+		buf := make([]byte, size)
+		if n := runtime.Stack(buf, true); n < size || size >= maxStackSize {
+			return buf[:n]
+		}
+	}
+}
+
+// Recover writes a crash report if the calling goroutine is
+// panicking and then continues panicking. It must be invoked
+// directly via defer, e.g. defer reporter.Recover()
+func (r *Reporter) Recover() {
+	if p := recover(); p != nil {
+		r.HandlePanic(p)
+		panic(p)
+	}
+}
+
+// HandlePanic writes a crash report for the panic value,
+// logging the result
+func (r *Reporter) HandlePanic(p interface{}) {
+	path, err := r.Write(p, Stack())
+	if err != nil {
+		glog.Errorf("Failed to write crash report: %v", err)
+	} else {
+		glog.Errorf("Panic: %v; crash report written to %s", p, path)
+	}
+	glog.Flush()
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crashreport
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCrashReport(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "crashreport-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	savedCollectorTimeout := collectorTimeout
+	collectorTimeout = 100 * time.Millisecond
+	defer func() { collectorTimeout = savedCollectorTimeout }()
+
+	r := NewReporter(filepath.Join(tmpDir, "crashes"))
+	r.maxReports = 2
+	ts := time.Date(2018, 5, 15, 10, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return ts }
+	r.AddStateCollector("sandboxes", func() (interface{}, error) {
+		return []string{"pod1", "pod2"}, nil
+	})
+	r.AddStateCollector("broken", func() (interface{}, error) {
+		return nil, errors.New("oops")
+	})
+	r.AddStateCollector("panicky", func() (interface{}, error) {
+		panic("oh no")
+	})
+	stuck := make(chan struct{})
+	defer close(stuck)
+	r.AddStateCollector("stuck", func() (interface{}, error) {
+		<-stuck
+		return nil, nil
+	})
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		func() {
+			defer func() {
+				if p := recover(); p != "test panic" {
+					t.Errorf("bad panic value after Recover(): %v", p)
+				}
+			}()
+			defer r.Recover()
+			panic("test panic")
+		}()
+		fis, err := ioutil.ReadDir(r.dir)
+		if err != nil {
+			t.Fatalf("ReadDir(): %v", err)
+		}
+		paths = append(paths, filepath.Join(r.dir, fis[len(fis)-1].Name()))
+		ts = ts.Add(time.Second)
+	}
+
+	fis, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		t.Fatalf("ReadDir(): %v", err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	expectedNames := []string{"crash-20180515T100001.000Z.json", "crash-20180515T100002.000Z.json"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("bad crash reports: %v instead of %v", names, expectedNames)
+	}
+
+	bs, err := ioutil.ReadFile(paths[2])
+	if err != nil {
+		t.Fatalf("ReadFile(): %v", err)
+	}
+	var report Report
+	if err := json.Unmarshal(bs, &report); err != nil {
+		t.Fatalf("error unmarshalling the crash report: %v", err)
+	}
+	if report.Panic != "test panic" {
+		t.Errorf("bad panic value in the report: %q", report.Panic)
+	}
+	if !report.Time.Equal(ts.Add(-time.Second)) {
+		t.Errorf("bad report time %v", report.Time)
+	}
+	if !strings.Contains(report.Stack, "TestCrashReport") {
+		t.Errorf("the stack traces don't include the test function:\n%s", report.Stack)
+	}
+	expectedState := map[string]interface{}{"sandboxes": []interface{}{"pod1", "pod2"}}
+	if !reflect.DeepEqual(report.State, expectedState) {
+		t.Errorf("bad state: %#v instead of %#v", report.State, expectedState)
+	}
+	if report.Errors["broken"] != "oops" ||
+		!strings.Contains(report.Errors["panicky"], "oh no") ||
+		!strings.Contains(report.Errors["stuck"], "timed out") {
+		t.Errorf("bad collector errors: %#v", report.Errors)
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package csi implements CSI node plugin that provisions Virtlet
+// volumes (qcow2, raw devices, ceph) the same way as Virtlet
+// flexvolume driver does, so they can be used via CSI persistent
+// volumes instead of the flexvolume mechanism.
+package csi
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Mirantis/virtlet/pkg/flexvolume"
+)
+
+const (
+	// DriverName is the name of Virtlet CSI driver
+	DriverName    = "virtlet.cloud"
+	driverVersion = "0.3.0"
+)
+
+// NodePlugin implements CSI Identity and Node services
+type NodePlugin struct {
+	driver *flexvolume.FlexVolumeDriver
+	nodeId string
+	server *grpc.Server
+}
+
+var _ csi.IdentityServer = &NodePlugin{}
+var _ csi.NodeServer = &NodePlugin{}
+
+// NewNodePlugin returns a new NodePlugin for the specified node
+// that uses the specified flexvolume driver to populate the
+// volume directories
+func NewNodePlugin(driver *flexvolume.FlexVolumeDriver, nodeId string) *NodePlugin {
+	p := &NodePlugin{
+		driver: driver,
+		nodeId: nodeId,
+		server: grpc.NewServer(),
+	}
+	csi.RegisterIdentityServer(p.server, p)
+	csi.RegisterNodeServer(p.server, p)
+	return p
+}
+
+// Serve serves CSI gRPC API on the specified unix socket
+func (p *NodePlugin) Serve(addr string) error {
+	if err := syscall.Unlink(addr); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ln, err := net.Listen("unix", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	return p.server.Serve(ln)
+}
+
+// Stop stops the gRPC server
+func (p *NodePlugin) Stop() {
+	p.server.Stop()
+}
+
+func (p *NodePlugin) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	return &csi.GetPluginInfoResponse{
+		Name:          DriverName,
+		VendorVersion: driverVersion,
+	}, nil
+}
+
+func (p *NodePlugin) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	// no controller service, so no capabilities to report
+	return &csi.GetPluginCapabilitiesResponse{}, nil
+}
+
+func (p *NodePlugin) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
+
+func (p *NodePlugin) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeStageVolume is not supported")
+}
+
+func (p *NodePlugin) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeUnstageVolume is not supported")
+}
+
+// NodePublishVolume populates the target path with the volume
+// attributes of the persistent volume. Virtlet then finds the
+// volume description there when the VM is being created, same
+// as with the flexvolumes.
+func (p *NodePlugin) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if err := validateVolumeRequest(req.GetVolumeId(), req.GetTargetPath()); err != nil {
+		return nil, err
+	}
+	attrs := req.GetVolumeAttributes()
+	if attrs["type"] == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume attributes must include volume type")
+	}
+	opts := make(map[string]interface{})
+	for k, v := range attrs {
+		opts[k] = v
+	}
+	glog.V(2).Infof("CSI: publishing volume %q at %q", req.GetVolumeId(), req.GetTargetPath())
+	if err := p.driver.MountVolume(req.GetTargetPath(), opts); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts and removes the target path
+func (p *NodePlugin) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	if err := validateVolumeRequest(req.GetVolumeId(), req.GetTargetPath()); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(req.GetTargetPath()); os.IsNotExist(err) {
+		// NodeUnpublishVolume must be idempotent
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+	glog.V(2).Infof("CSI: unpublishing volume %q at %q", req.GetVolumeId(), req.GetTargetPath())
+	if err := p.driver.UnmountVolume(req.GetTargetPath()); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+func (p *NodePlugin) NodeGetId(ctx context.Context, req *csi.NodeGetIdRequest) (*csi.NodeGetIdResponse, error) {
+	return &csi.NodeGetIdResponse{NodeId: p.nodeId}, nil
+}
+
+func (p *NodePlugin) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: p.nodeId}, nil
+}
+
+func (p *NodePlugin) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	// STAGE_UNSTAGE_VOLUME is not supported, so no capabilities
+	// to report
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+func validateVolumeRequest(volumeId, targetPath string) error {
+	var err error
+	switch {
+	case volumeId == "":
+		err = errors.New("volume id must be specified")
+	case targetPath == "":
+		err = errors.New("target path must be specified")
+	default:
+		return nil
+	}
+	return status.Error(codes.InvalidArgument, err.Error())
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package csi
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	csi "github.com/container-storage-interface/spec/lib/go/csi/v0"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Mirantis/virtlet/pkg/flexvolume"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	fakeUuid = "abb67e3c-71b3-4ddd-5505-8c4215d5c4eb"
+)
+
+func TestNodePublishUnpublish(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "csi-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	driver := flexvolume.NewFlexVolumeDriver(func() string { return fakeUuid }, flexvolume.NullMounter)
+	p := NewNodePlugin(driver, "kube-node-1")
+	targetPath := filepath.Join(tmpDir, "pv1", "mount")
+	if _, err := p.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+		VolumeId:         "pv1",
+		TargetPath:       targetPath,
+		VolumeAttributes: map[string]string{"type": "qcow2", "capacity": "2048MB"},
+	}); err != nil {
+		t.Fatalf("NodePublishVolume(): %v", err)
+	}
+
+	var opts map[string]interface{}
+	if err := utils.ReadJson(filepath.Join(targetPath, "virtlet-flexvolume.json"), &opts); err != nil {
+		t.Fatalf("error reading the volume data: %v", err)
+	}
+	expectedOpts := map[string]interface{}{
+		"type":     "qcow2",
+		"capacity": "2048MB",
+		"uuid":     fakeUuid,
+	}
+	if !reflect.DeepEqual(opts, expectedOpts) {
+		t.Errorf("bad volume data: %#v instead of %#v", opts, expectedOpts)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   "pv1",
+			TargetPath: targetPath,
+		}); err != nil {
+			t.Fatalf("NodeUnpublishVolume() #%d: %v", i+1, err)
+		}
+	}
+	if _, err := os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("the target path is not removed")
+	}
+}
+
+func TestNodePublishValidation(t *testing.T) {
+	p := NewNodePlugin(flexvolume.NewFlexVolumeDriver(utils.NewUuid, flexvolume.NullMounter), "kube-node-1")
+	for _, req := range []*csi.NodePublishVolumeRequest{
+		{TargetPath: "/tmp/foo"},
+		{VolumeId: "pv1"},
+		{VolumeId: "pv1", TargetPath: "/tmp/foo"},
+	} {
+		_, err := p.NodePublishVolume(context.Background(), req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("NodePublishVolume(%#v) didn't fail with InvalidArgument: %v", req, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"go.universe.tf/netboot/dhcp4"
+)
+
+const (
+	vendorClassOption    = 60
+	tftpServerNameOption = 66
+
+	pxeClientVendorClass  = "PXEClient"
+	httpClientVendorClass = "HTTPClient"
+)
+
+// SetBootFile makes the server offer the specified file to PXE
+// and UEFI HTTP boot clients. The file is expected to be served
+// over TFTP and HTTP on the address of the DHCP server. Empty
+// value disables network boot
+func (s *Server) SetBootFile(filename string) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.bootFile = filename
+}
+
+// setBootOptions adds the boot server address and the boot file
+// name to the response if the request comes from a network boot
+// client, as identified by its vendor class (RFC 4578, UEFI 2.5)
+func setBootOptions(resp, req *dhcp4.Packet, serverIP net.IP, bootFile string) {
+	vendorClass := string(req.Options[vendorClassOption])
+	switch {
+	case strings.HasPrefix(vendorClass, httpClientVendorClass):
+		// UEFI HTTP boot clients expect an URL and ignore
+		// the offers that don't echo their vendor class
+		resp.Options[vendorClassOption] = []byte(httpClientVendorClass)
+		resp.BootFilename = fmt.Sprintf("http://%s/%s", serverIP, strings.TrimPrefix(bootFile, "/"))
+	case strings.HasPrefix(vendorClass, pxeClientVendorClass):
+		resp.ServerAddr = serverIP
+		resp.BootFilename = bootFile
+		resp.Options[tftpServerNameOption] = []byte(serverIP.String())
+	}
+}
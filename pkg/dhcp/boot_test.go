@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"net"
+	"testing"
+
+	"go.universe.tf/netboot/dhcp4"
+)
+
+func TestSetBootOptions(t *testing.T) {
+	serverIP := net.IPv4(169, 254, 254, 2).To4()
+	for _, tc := range []struct {
+		name                string
+		vendorClass         string
+		bootFile            string
+		expectedFilename    string
+		expectedTFTPServer  string
+		expectedVendorClass string
+	}{
+		{
+			name:     "regular client",
+			bootFile: "pxelinux.0",
+		},
+		{
+			name:               "pxe client",
+			vendorClass:        "PXEClient:Arch:00000:UNDI:002001",
+			bootFile:           "pxelinux.0",
+			expectedFilename:   "pxelinux.0",
+			expectedTFTPServer: "169.254.254.2",
+		},
+		{
+			name:                "http client",
+			vendorClass:         "HTTPClient:Arch:00016:UNDI:003001",
+			bootFile:            "/efi/bootx64.efi",
+			expectedFilename:    "http://169.254.254.2/efi/bootx64.efi",
+			expectedVendorClass: "HTTPClient",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := &dhcp4.Packet{Options: make(dhcp4.Options)}
+			if tc.vendorClass != "" {
+				req.Options[vendorClassOption] = []byte(tc.vendorClass)
+			}
+			resp := &dhcp4.Packet{Options: make(dhcp4.Options)}
+			setBootOptions(resp, req, serverIP, tc.bootFile)
+			if resp.BootFilename != tc.expectedFilename {
+				t.Errorf("bad boot file name: expected %q, got %q", tc.expectedFilename, resp.BootFilename)
+			}
+			if tftpServer := string(resp.Options[tftpServerNameOption]); tftpServer != tc.expectedTFTPServer {
+				t.Errorf("bad TFTP server name: expected %q, got %q", tc.expectedTFTPServer, tftpServer)
+			}
+			if vendorClass := string(resp.Options[vendorClassOption]); vendorClass != tc.expectedVendorClass {
+				t.Errorf("bad vendor class: expected %q, got %q", tc.expectedVendorClass, vendorClass)
+			}
+			if tc.expectedTFTPServer != "" && !resp.ServerAddr.Equal(serverIP) {
+				t.Errorf("bad next server address %v", resp.ServerAddr)
+			}
+		})
+	}
+}
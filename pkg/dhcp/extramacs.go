@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ExtraHardwareAddr specifies an additional hardware address
+// which gets the same lease as the VM interface with the
+// specified index. It's used for guests that bring up bonded
+// or bridged interfaces with MAC addresses of their own
+type ExtraHardwareAddr struct {
+	// Interface is the index of the VM interface
+	Interface int
+	// HardwareAddr is the additional hardware address
+	HardwareAddr net.HardwareAddr
+}
+
+// ParseExtraHardwareAddrs parses a comma-separated list of
+// additional hardware addresses. Each item has the form of
+// [interface_index=]mac_address, with interface index
+// defaulting to 0
+func ParseExtraHardwareAddrs(value string) ([]ExtraHardwareAddr, error) {
+	var r []ExtraHardwareAddr
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		var extra ExtraHardwareAddr
+		macStr := item
+		if parts := strings.SplitN(item, "=", 2); len(parts) == 2 {
+			n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad interface index in %q", item)
+			}
+			extra.Interface = n
+			macStr = strings.TrimSpace(parts[1])
+		}
+		hwAddr, err := net.ParseMAC(macStr)
+		if err != nil {
+			return nil, fmt.Errorf("bad MAC address in %q: %v", item, err)
+		}
+		if len(hwAddr) != 6 || hwAddr[0]&1 != 0 {
+			return nil, fmt.Errorf("%q is not a unicast Ethernet address", macStr)
+		}
+		if seen[hwAddr.String()] {
+			return nil, fmt.Errorf("duplicate MAC address %s", hwAddr)
+		}
+		seen[hwAddr.String()] = true
+		extra.HardwareAddr = hwAddr
+		r = append(r, extra)
+	}
+	if len(r) == 0 {
+		return nil, fmt.Errorf("no MAC addresses specified")
+	}
+	return r, nil
+}
+
+// SetExtraHardwareAddrs makes the server answer the requests from
+// the additional hardware addresses, giving them the same leases
+// as the corresponding VM interfaces
+func (s *Server) SetExtraHardwareAddrs(extra []ExtraHardwareAddr) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.extraHardwareAddrs = extra
+}
+
+// SetRelaxed enables or disables relaxed mode in which the server
+// answers requests from any hardware address that come through
+// a container-side bridge, giving them the same lease as the
+// VM interface attached to that bridge
+func (s *Server) SetRelaxed(relaxed bool) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.relaxed = relaxed
+}
+
+// leaseHardwareAddr returns the hardware address of the VM
+// interface whose lease should be given to the client with
+// the specified hardware address that sent a request via
+// the specified interface. It returns nil if there's no
+// such VM interface. It must be called with configMutex held
+func (s *Server) leaseHardwareAddr(hwAddr net.HardwareAddr, ifName string) net.HardwareAddr {
+	for _, iface := range s.config.Interfaces {
+		if bytes.Equal(iface.HardwareAddr, hwAddr) {
+			return hwAddr
+		}
+	}
+	for _, extra := range s.extraHardwareAddrs {
+		if bytes.Equal(extra.HardwareAddr, hwAddr) && extra.Interface < len(s.config.Interfaces) {
+			return s.config.Interfaces[extra.Interface].HardwareAddr
+		}
+	}
+	if s.relaxed {
+		if i := s.config.InterfaceIndexForBridge(ifName); i >= 0 {
+			return s.config.Interfaces[i].HardwareAddr
+		}
+	}
+	return nil
+}
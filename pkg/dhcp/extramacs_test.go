@@ -0,0 +1,141 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+func mustParseMAC(t *testing.T, s string) net.HardwareAddr {
+	hwAddr, err := net.ParseMAC(s)
+	if err != nil {
+		t.Fatalf("bad MAC address %q: %v", s, err)
+	}
+	return hwAddr
+}
+
+func TestParseExtraHardwareAddrs(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected []ExtraHardwareAddr
+		err      bool
+	}{
+		{
+			value: "42:a4:a6:22:80:40",
+			expected: []ExtraHardwareAddr{
+				{0, mustParseMAC(t, "42:a4:a6:22:80:40")},
+			},
+		},
+		{
+			value: " 42:a4:a6:22:80:40, 1=42:a4:a6:22:80:41 ,0 = 42:A4:A6:22:80:42",
+			expected: []ExtraHardwareAddr{
+				{0, mustParseMAC(t, "42:a4:a6:22:80:40")},
+				{1, mustParseMAC(t, "42:a4:a6:22:80:41")},
+				{0, mustParseMAC(t, "42:a4:a6:22:80:42")},
+			},
+		},
+		{value: "", err: true},
+		{value: "42:a4:a6:22:80", err: true},
+		{value: "x=42:a4:a6:22:80:40", err: true},
+		{value: "-1=42:a4:a6:22:80:40", err: true},
+		{value: "01:00:5e:00:00:01", err: true},
+		{value: "42:a4:a6:22:80:40,1=42:a4:a6:22:80:40", err: true},
+	} {
+		extra, err := ParseExtraHardwareAddrs(tc.value)
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("didn't get an error for %q", tc.value)
+		case !tc.err && err != nil:
+			t.Errorf("ParseExtraHardwareAddrs(%q): %v", tc.value, err)
+		case !reflect.DeepEqual(extra, tc.expected):
+			t.Errorf("bad result for %q: expected %#v, got %#v", tc.value, tc.expected, extra)
+		}
+	}
+}
+
+func TestLeaseHardwareAddr(t *testing.T) {
+	vmAddrs := []net.HardwareAddr{
+		mustParseMAC(t, "42:a4:a6:22:80:2e"),
+		mustParseMAC(t, "42:a4:a6:22:80:2f"),
+	}
+	bondAddr := mustParseMAC(t, "42:a4:a6:22:80:40")
+	otherAddr := mustParseMAC(t, "42:a4:a6:22:80:50")
+	s := NewServer(&nettools.ContainerSideNetwork{
+		Interfaces: []nettools.InterfaceDescription{
+			{Type: nettools.InterfaceTypeTap, HardwareAddr: vmAddrs[0]},
+			{Type: nettools.InterfaceTypeTap, HardwareAddr: vmAddrs[1]},
+		},
+	})
+	for _, tc := range []struct {
+		name     string
+		extra    []ExtraHardwareAddr
+		relaxed  bool
+		hwAddr   net.HardwareAddr
+		ifName   string
+		expected net.HardwareAddr
+	}{
+		{
+			name:     "vm interface",
+			hwAddr:   vmAddrs[1],
+			ifName:   "br1",
+			expected: vmAddrs[1],
+		},
+		{
+			name:   "unknown address",
+			hwAddr: otherAddr,
+			ifName: "br0",
+		},
+		{
+			name:     "extra address",
+			extra:    []ExtraHardwareAddr{{1, bondAddr}},
+			hwAddr:   bondAddr,
+			ifName:   "br1",
+			expected: vmAddrs[1],
+		},
+		{
+			name:   "extra address for a missing interface",
+			extra:  []ExtraHardwareAddr{{2, bondAddr}},
+			hwAddr: bondAddr,
+			ifName: "br1",
+		},
+		{
+			name:     "relaxed mode",
+			relaxed:  true,
+			hwAddr:   otherAddr,
+			ifName:   "br1",
+			expected: vmAddrs[1],
+		},
+		{
+			name:    "relaxed mode with an unknown bridge",
+			relaxed: true,
+			hwAddr:  otherAddr,
+			ifName:  "br2",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s.SetExtraHardwareAddrs(tc.extra)
+			s.SetRelaxed(tc.relaxed)
+			if hwAddr := s.leaseHardwareAddr(tc.hwAddr, tc.ifName); !reflect.DeepEqual(hwAddr, tc.expected) {
+				t.Errorf("bad lease hardware address: expected %v, got %v", tc.expected, hwAddr)
+			}
+		})
+	}
+}
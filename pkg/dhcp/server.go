@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net"
 	"strings"
+	"sync"
 
 	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
 	"github.com/golang/glog"
@@ -44,12 +45,75 @@ var (
 )
 
 type Server struct {
-	config   *nettools.ContainerSideNetwork
-	listener *dhcp4.Conn
+	// configMutex guards config which may be replaced
+	// while the server is running
+	configMutex sync.Mutex
+	config      *nettools.ContainerSideNetwork
+	listener    *dhcp4.Conn
+	stats       *statsCollector
+	logRequests bool
+	debug       bool
+
+	// extraHardwareAddrs, relaxed and bootFile are
+	// also guarded by configMutex
+	extraHardwareAddrs []ExtraHardwareAddr
+	relaxed            bool
+	bootFile           string
 }
 
 func NewServer(config *nettools.ContainerSideNetwork) *Server {
-	return &Server{config: config}
+	return &Server{config: config, stats: newStatsCollector()}
+}
+
+// SetConfig replaces the network configuration used by the
+// server. It's used when VM interfaces are added or removed
+// while the server is running
+func (s *Server) SetConfig(config *nettools.ContainerSideNetwork) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.config = config
+}
+
+// SetRequestLogging enables or disables logging of every DHCP
+// request received by the server along with its outcome
+func (s *Server) SetRequestLogging(enable bool) {
+	s.logRequests = enable
+}
+
+// SetDebug enables or disables logging of the contents of every
+// DHCP packet received or sent by the server, which is normally
+// only done with glog verbosity level 3 or higher. It also
+// enables request logging
+func (s *Server) SetDebug(enable bool) {
+	s.debug = enable
+	if enable {
+		s.logRequests = true
+	}
+}
+
+// Stats returns DHCP request counters keyed by client
+// hardware address
+func (s *Server) Stats() map[string]InterfaceStats {
+	return s.stats.snapshot()
+}
+
+func (s *Server) logRequest(pkt *dhcp4.Packet, kind requestKind, resp *dhcp4.Packet, err error) {
+	if !s.logRequests {
+		return
+	}
+	result := "ignored"
+	yourAddr := ""
+	errStr := ""
+	switch {
+	case err != nil:
+		result = "refused"
+		errStr = err.Error()
+	case resp != nil:
+		result = strings.ToLower(resp.Type.String())
+		yourAddr = resp.YourAddr.String()
+	}
+	glog.Infof("dhcp request: mac=%s xid=%x kind=%s ciaddr=%s result=%s yiaddr=%s error=%q",
+		pkt.HardwareAddr, pkt.TransactionID, kind, pkt.ClientAddr, result, yourAddr, errStr)
 }
 
 func (s *Server) SetupListener(laddr string) error {
@@ -75,6 +139,9 @@ func (s *Server) Serve() error {
 			return fmt.Errorf("received DHCP packet with no interface information - please fill a bug to https://github.com/google/netboot")
 		}
 		glog.V(2).Infof("Received dhcp packet from: %s", pkt.HardwareAddr.String())
+		if s.debug {
+			glog.Infof("Received dhcp packet on %s:\n%s", intf.Name, pkt.DebugString())
+		}
 
 		serverIP, err := interfaceIP(intf)
 		if err != nil {
@@ -83,27 +150,32 @@ func (s *Server) Serve() error {
 		}
 
 		var resp *dhcp4.Packet
+		kind := getRequestKind(pkt)
 		switch pkt.Type {
 		case dhcp4.MsgDiscover:
-			resp, err = s.offerDHCP(pkt, serverIP)
+			resp, err = s.offerDHCP(pkt, serverIP, intf.Name)
 			if err != nil {
 				glog.Warningf("Failed to construct DHCP offer for %s: %s", pkt.HardwareAddr.String(), err)
-				continue
 			}
 		case dhcp4.MsgRequest:
-			resp, err = s.ackDHCP(pkt, serverIP)
+			resp, err = s.ackDHCP(pkt, serverIP, intf.Name)
 			if err != nil {
 				glog.Warningf("Failed to construct DHCP ACK for %s: %s", pkt.HardwareAddr.String(), err)
-				continue
 			}
 		default:
 			glog.Warningf("Ignoring packet from %s: packet is %s", pkt.HardwareAddr.String(), pkt.Type.String())
+		}
+		s.stats.record(pkt.HardwareAddr.String(), kind, err != nil)
+		s.logRequest(pkt, kind, resp, err)
+		if err != nil {
 			continue
 		}
 
 		if resp != nil {
 			glog.V(2).Infof("Sending %s packet to %s", resp.Type.String(), pkt.HardwareAddr.String())
-			glog.V(3).Info(resp.DebugString())
+			if s.debug || bool(glog.V(3)) {
+				glog.Info(resp.DebugString())
+			}
 			if err = s.listener.SendDHCP(resp, intf); err != nil {
 				glog.Warningf("Failed to send DHCP offer for %s: %s", pkt.HardwareAddr.String(), err)
 			}
@@ -154,11 +226,20 @@ func (s *Server) getInterfaceNo(hwAddr net.HardwareAddr) int {
 	return -1
 }
 
-func (s *Server) prepareResponse(pkt *dhcp4.Packet, serverIP net.IP, mt dhcp4.MessageType) (*dhcp4.Packet, error) {
-	interfaceNo := s.getInterfaceNo(pkt.HardwareAddr)
+func (s *Server) prepareResponse(pkt *dhcp4.Packet, serverIP net.IP, ifName string, mt dhcp4.MessageType) (*dhcp4.Packet, error) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	leaseHwAddr := s.leaseHardwareAddr(pkt.HardwareAddr, ifName)
+	if leaseHwAddr == nil {
+		return nil, fmt.Errorf("unexpected packet from %v", pkt.HardwareAddr)
+	}
+	interfaceNo := s.getInterfaceNo(leaseHwAddr)
 	if interfaceNo < 0 {
 		return nil, fmt.Errorf("unexpected packet from %v", pkt.HardwareAddr)
 	}
+	if !bytes.Equal(leaseHwAddr, pkt.HardwareAddr) {
+		glog.V(2).Infof("Giving the lease of %s to %s", leaseHwAddr, pkt.HardwareAddr)
+	}
 
 	var cfg *cnicurrent.IPConfig
 	for _, curCfg := range s.config.Result.IPs {
@@ -168,7 +249,7 @@ func (s *Server) prepareResponse(pkt *dhcp4.Packet, serverIP net.IP, mt dhcp4.Me
 	}
 	var mtu uint16
 	for _, iface := range s.config.Interfaces {
-		if bytes.Compare(pkt.HardwareAddr, iface.HardwareAddr) == 0 {
+		if bytes.Compare(leaseHwAddr, iface.HardwareAddr) == 0 {
 			mtu = iface.MTU
 		}
 	}
@@ -249,15 +330,19 @@ func (s *Server) prepareResponse(pkt *dhcp4.Packet, serverIP net.IP, mt dhcp4.Me
 		}
 	}
 
+	if s.bootFile != "" {
+		setBootOptions(p, pkt, serverIP, s.bootFile)
+	}
+
 	return p, nil
 }
 
-func (s *Server) offerDHCP(pkt *dhcp4.Packet, serverIP net.IP) (*dhcp4.Packet, error) {
-	return s.prepareResponse(pkt, serverIP, dhcp4.MsgOffer)
+func (s *Server) offerDHCP(pkt *dhcp4.Packet, serverIP net.IP, ifName string) (*dhcp4.Packet, error) {
+	return s.prepareResponse(pkt, serverIP, ifName, dhcp4.MsgOffer)
 }
 
-func (s *Server) ackDHCP(pkt *dhcp4.Packet, serverIP net.IP) (*dhcp4.Packet, error) {
-	return s.prepareResponse(pkt, serverIP, dhcp4.MsgAck)
+func (s *Server) ackDHCP(pkt *dhcp4.Packet, serverIP net.IP, ifName string) (*dhcp4.Packet, error) {
+	return s.prepareResponse(pkt, serverIP, ifName, dhcp4.MsgAck)
 }
 
 func (s *Server) getStaticRoutes() (router, routes []byte, err error) {
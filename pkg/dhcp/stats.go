@@ -0,0 +1,137 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"sync"
+	"time"
+
+	"go.universe.tf/netboot/dhcp4"
+)
+
+// maxStatsEntries is the maximum number of client hardware
+// addresses to keep the counters for. The guest may send the
+// requests with arbitrary hardware addresses, so the counters
+// for the least recently seen addresses are dropped once the
+// limit is reached
+const maxStatsEntries = 32
+
+// InterfaceStats contains DHCP request counters for a single VM
+// interface
+type InterfaceStats struct {
+	// Discover is the number of DHCPDISCOVER packets received
+	Discover uint64 `json:"discover"`
+	// Request is the number of DHCPREQUEST packets received
+	// from clients that don't have an address yet
+	Request uint64 `json:"request"`
+	// Renew is the number of DHCPREQUEST packets received
+	// from clients that are renewing or rebinding their lease
+	Renew uint64 `json:"renew"`
+	// Refused is the number of DHCPDISCOVER and DHCPREQUEST
+	// packets that were left unanswered because no address
+	// could be provided for the client
+	Refused uint64 `json:"refused"`
+}
+
+type requestKind string
+
+const (
+	requestKindDiscover requestKind = "discover"
+	requestKindRequest  requestKind = "request"
+	requestKindRenew    requestKind = "renew"
+	requestKindOther    requestKind = "other"
+)
+
+func getRequestKind(pkt *dhcp4.Packet) requestKind {
+	switch pkt.Type {
+	case dhcp4.MsgDiscover:
+		return requestKindDiscover
+	case dhcp4.MsgRequest:
+		// ciaddr is only filled in by the clients in BOUND,
+		// RENEWING and REBINDING states (RFC 2131, 4.3.2)
+		if pkt.ClientAddr != nil && !pkt.ClientAddr.IsUnspecified() {
+			return requestKindRenew
+		}
+		return requestKindRequest
+	default:
+		return requestKindOther
+	}
+}
+
+type statsEntry struct {
+	InterfaceStats
+	lastSeen time.Time
+}
+
+// statsCollector keeps DHCP request counters keyed by
+// client hardware address
+type statsCollector struct {
+	sync.Mutex
+	clock func() time.Time
+	stats map[string]*statsEntry
+}
+
+func newStatsCollector() *statsCollector {
+	return &statsCollector{clock: time.Now, stats: make(map[string]*statsEntry)}
+}
+
+// evictOldest removes the counters for the least recently
+// seen hardware address
+func (c *statsCollector) evictOldest() {
+	oldest := ""
+	for hwAddr, st := range c.stats {
+		if oldest == "" || st.lastSeen.Before(c.stats[oldest].lastSeen) {
+			oldest = hwAddr
+		}
+	}
+	delete(c.stats, oldest)
+}
+
+func (c *statsCollector) record(hwAddr string, kind requestKind, refused bool) {
+	c.Lock()
+	defer c.Unlock()
+	st, found := c.stats[hwAddr]
+	if !found {
+		if len(c.stats) >= maxStatsEntries {
+			c.evictOldest()
+		}
+		st = &statsEntry{}
+		c.stats[hwAddr] = st
+	}
+	st.lastSeen = c.clock()
+	switch kind {
+	case requestKindDiscover:
+		st.Discover++
+	case requestKindRequest:
+		st.Request++
+	case requestKindRenew:
+		st.Renew++
+	}
+	if refused && kind != requestKindOther {
+		st.Refused++
+	}
+}
+
+func (c *statsCollector) snapshot() map[string]InterfaceStats {
+	c.Lock()
+	defer c.Unlock()
+	r := make(map[string]InterfaceStats)
+	for hwAddr, st := range c.stats {
+		r[hwAddr] = st.InterfaceStats
+	}
+	return r
+}
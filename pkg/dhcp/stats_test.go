@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dhcp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsCollector(t *testing.T) {
+	c := newStatsCollector()
+	c.record("42:a4:a6:22:80:2e", requestKindDiscover, false)
+	c.record("42:a4:a6:22:80:2e", requestKindRequest, false)
+	c.record("42:a4:a6:22:80:2e", requestKindRenew, false)
+	c.record("42:a4:a6:22:80:2f", requestKindDiscover, true)
+	c.record("42:a4:a6:22:80:2f", requestKindRequest, true)
+	c.record("42:a4:a6:22:80:2f", requestKindOther, true)
+	expected := map[string]InterfaceStats{
+		"42:a4:a6:22:80:2e": {Discover: 1, Request: 1, Renew: 1},
+		"42:a4:a6:22:80:2f": {Discover: 1, Request: 1, Refused: 2},
+	}
+	if stats := c.snapshot(); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("bad stats: %#v instead of %#v", stats, expected)
+	}
+}
+
+func TestStatsCollectorEviction(t *testing.T) {
+	c := newStatsCollector()
+	now := time.Date(2018, 5, 16, 10, 0, 0, 0, time.UTC)
+	c.clock = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	hwAddr := func(n int) string {
+		return fmt.Sprintf("42:a4:a6:22:%02x:%02x", n/256, n%256)
+	}
+	for i := 0; i < maxStatsEntries; i++ {
+		c.record(hwAddr(i), requestKindDiscover, false)
+	}
+	// make the first address the most recently seen one
+	c.record(hwAddr(0), requestKindRequest, false)
+	for i := maxStatsEntries; i < maxStatsEntries+10; i++ {
+		c.record(hwAddr(i), requestKindDiscover, false)
+	}
+
+	stats := c.snapshot()
+	if len(stats) != maxStatsEntries {
+		t.Errorf("bad number of stats entries: %d instead of %d", len(stats), maxStatsEntries)
+	}
+	if st := stats[hwAddr(0)]; st.Request != 1 {
+		t.Errorf("the most recently seen entry was evicted")
+	}
+	for i := 1; i <= 10; i++ {
+		if _, found := stats[hwAddr(i)]; found {
+			t.Errorf("the entry for %s was not evicted", hwAddr(i))
+		}
+	}
+	if _, found := stats[hwAddr(maxStatsEntries+9)]; !found {
+		t.Errorf("the entry for the newest address is missing")
+	}
+}
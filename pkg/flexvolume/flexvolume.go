@@ -112,9 +112,19 @@ func (d *FlexVolumeDriver) mount(targetMountDir, jsonOptions string) (map[string
 	if err := json.Unmarshal([]byte(jsonOptions), &opts); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal json options: %v", err)
 	}
+	if err := d.MountVolume(targetMountDir, opts); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// MountVolume populates the volume directory with the volume
+// options that are then picked up by Virtlet. It's used both by
+// flexvolume 'mount' command and by the CSI node plugin.
+func (d *FlexVolumeDriver) MountVolume(targetMountDir string, opts map[string]interface{}) error {
 	opts[uuidOptionsKey] = d.uuidGen()
 	if err := os.MkdirAll(targetMountDir, 0700); err != nil {
-		return nil, fmt.Errorf("os.MkDirAll(): %v", err)
+		return fmt.Errorf("os.MkDirAll(): %v", err)
 	}
 
 	// Here we populate the volume directory twice.
@@ -129,11 +139,11 @@ func (d *FlexVolumeDriver) mount(targetMountDir, jsonOptions string) (map[string
 	// both directly and onto the freshly mounted tmpfs.
 
 	if err := d.populateVolumeDir(targetMountDir, opts); err != nil {
-		return nil, err
+		return err
 	}
 
 	if err := d.mounter.Mount("tmpfs", targetMountDir, "tmpfs"); err != nil {
-		return nil, fmt.Errorf("error mounting tmpfs at %q: %v", targetMountDir, err)
+		return fmt.Errorf("error mounting tmpfs at %q: %v", targetMountDir, err)
 	}
 
 	done := false
@@ -145,24 +155,33 @@ func (d *FlexVolumeDriver) mount(targetMountDir, jsonOptions string) (map[string
 	}()
 
 	if err := d.populateVolumeDir(targetMountDir, opts); err != nil {
-		return nil, err
+		return err
 	}
 
 	done = true
-	return nil, nil
+	return nil
 }
 
 // Invocation: <driver executable> unmount <mount dir>
 func (d *FlexVolumeDriver) unmount(targetMountDir string) (map[string]interface{}, error) {
+	if err := d.UnmountVolume(targetMountDir); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+// UnmountVolume unmounts the volume directory populated by
+// MountVolume() and removes it
+func (d *FlexVolumeDriver) UnmountVolume(targetMountDir string) error {
 	if err := d.mounter.Unmount(targetMountDir); err != nil {
-		return nil, fmt.Errorf("unmount %q: %v", err.Error())
+		return fmt.Errorf("unmount %q: %v", targetMountDir, err)
 	}
 
 	if err := os.RemoveAll(targetMountDir); err != nil {
-		return nil, fmt.Errorf("os.RemoveAll(): %v", err.Error())
+		return fmt.Errorf("os.RemoveAll(): %v", err)
 	}
 
-	return nil, nil
+	return nil
 }
 
 type driverOp func(*FlexVolumeDriver, []string) (map[string]interface{}, error)
@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health implements the health checks of Virtlet process
+// that are exposed via /healthz and /readyz HTTP endpoints and
+// reported to systemd via sd_notify protocol.
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultCheckTimeout is the default time limit for each check
+const DefaultCheckTimeout = 10 * time.Second
+
+// Check is a named health check
+type Check struct {
+	// Name is the name of the check
+	Name string
+	// Run performs the check, returning an error if it fails
+	Run func() error
+}
+
+// Result holds the outcome of a health check
+type Result struct {
+	// Name is the name of the check
+	Name string
+	// Err is the error returned by the check, or nil if it's passed
+	Err error
+	// Duration is the time taken by the check
+	Duration time.Duration
+}
+
+// Checker runs health checks
+type Checker struct {
+	sync.Mutex
+	checks  []Check
+	timeout time.Duration
+	ready   bool
+}
+
+// NewChecker returns a Checker for the specified checks. Each check
+// fails if it doesn't finish within the timeout
+func NewChecker(timeout time.Duration, checks ...Check) *Checker {
+	return &Checker{checks: checks, timeout: timeout}
+}
+
+// SetReady marks the process as ready to serve the requests
+// or not ready
+func (c *Checker) SetReady(ready bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.ready = ready
+}
+
+// Ready returns true if the process is marked as ready
+func (c *Checker) Ready() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.ready
+}
+
+// Run runs the checks in parallel and returns their results sorted
+// by the check name along with a flag that's true if all of the
+// checks have passed
+func (c *Checker) Run() ([]Result, bool) {
+	results := make([]Result, len(c.checks))
+	var wg sync.WaitGroup
+	for n, check := range c.checks {
+		wg.Add(1)
+		go func(n int, check Check) {
+			defer wg.Done()
+			results[n] = c.runCheck(check)
+		}(n, check)
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool { return results[i].Name < results[j].Name })
+	ok := true
+	for _, r := range results {
+		if r.Err != nil {
+			ok = false
+		}
+	}
+	return results, ok
+}
+
+func (c *Checker) runCheck(check Check) Result {
+	start := time.Now()
+	// the channel is buffered so the goroutine doesn't
+	// leak after the timeout
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- check.Run()
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-time.After(c.timeout):
+		err = fmt.Errorf("timed out after %v", c.timeout)
+	}
+	return Result{Name: check.Name, Err: err, Duration: time.Since(start)}
+}
+
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, needReady bool) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "only GET requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	results, ok := c.Run()
+	ready := c.Ready()
+	if needReady && !ready {
+		ok = false
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if needReady {
+		if ready {
+			fmt.Fprintf(w, "[+] startup ok\n")
+		} else {
+			fmt.Fprintf(w, "[-] startup: not finished yet\n")
+		}
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			fmt.Fprintf(w, "[+] %s ok\n", r.Name)
+		} else {
+			fmt.Fprintf(w, "[-] %s: %v\n", r.Name, r.Err)
+			glog.Warningf("Health check %s failed: %v", r.Name, r.Err)
+		}
+	}
+	if ok {
+		fmt.Fprintf(w, "ok\n")
+	} else {
+		fmt.Fprintf(w, "failed\n")
+	}
+}
+
+// HealthzHandler returns an http.Handler that runs the checks and
+// responds with status 200 if all of them pass, or 503 otherwise.
+// It's intended to be used as a liveness probe
+func (c *Checker) HealthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, false)
+	})
+}
+
+// ReadyzHandler returns an http.Handler that works like the one
+// returned by HealthzHandler(), but also requires the process to
+// be marked as ready. It's intended to be used as a readiness probe
+func (c *Checker) ReadyzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, true)
+	})
+}
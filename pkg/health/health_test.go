@@ -0,0 +1,234 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandlers(t *testing.T) {
+	var libvirtErr error
+	blockCh := make(chan struct{})
+	defer close(blockCh)
+	checks := []Check{
+		{Name: "metadata", Run: func() error { return nil }},
+		{Name: "libvirt", Run: func() error { return libvirtErr }},
+	}
+	hangingCheck := Check{Name: "tapmanager", Run: func() error {
+		<-blockCh
+		return nil
+	}}
+	for _, tc := range []struct {
+		name           string
+		hang           bool
+		libvirtErr     error
+		ready          bool
+		readyz         bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "healthz ok",
+			expectedStatus: http.StatusOK,
+			expectedBody:   "[+] libvirt ok\n[+] metadata ok\nok\n",
+		},
+		{
+			name:           "healthz failure",
+			libvirtErr:     errors.New("connection refused"),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "[-] libvirt: connection refused\n[+] metadata ok\nfailed\n",
+		},
+		{
+			name:           "healthz timeout",
+			hang:           true,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "[+] libvirt ok\n[+] metadata ok\n[-] tapmanager: timed out after 100ms\nfailed\n",
+		},
+		{
+			name:           "readyz before startup",
+			readyz:         true,
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "[-] startup: not finished yet\n[+] libvirt ok\n[+] metadata ok\nfailed\n",
+		},
+		{
+			name:           "readyz ok",
+			readyz:         true,
+			ready:          true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   "[+] startup ok\n[+] libvirt ok\n[+] metadata ok\nok\n",
+		},
+		{
+			name:           "readyz failure",
+			readyz:         true,
+			ready:          true,
+			libvirtErr:     errors.New("connection refused"),
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedBody:   "[+] startup ok\n[-] libvirt: connection refused\n[+] metadata ok\nfailed\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			libvirtErr = tc.libvirtErr
+			cs := checks
+			if tc.hang {
+				cs = append(cs, hangingCheck)
+			}
+			c := NewChecker(100*time.Millisecond, cs...)
+			c.SetReady(tc.ready)
+			handler, path := c.HealthzHandler(), "/healthz"
+			if tc.readyz {
+				handler, path = c.ReadyzHandler(), "/readyz"
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+			if rec.Code != tc.expectedStatus {
+				t.Errorf("bad status code: %d instead of %d", rec.Code, tc.expectedStatus)
+			}
+			if body := rec.Body.String(); body != tc.expectedBody {
+				t.Errorf("bad response body:\n%s\n-- instead of --\n%s", body, tc.expectedBody)
+			}
+		})
+	}
+}
+
+func TestHandlerMethod(t *testing.T) {
+	c := NewChecker(DefaultCheckTimeout)
+	rec := httptest.NewRecorder()
+	c.HealthzHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/healthz", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("bad status code: %d instead of %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func listenNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	tmpDir, err := ioutil.TempDir("", "sdnotify")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	socketPath := filepath.Join(tmpDir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		t.Fatalf("ListenUnixgram(): %v", err)
+	}
+	oldValue, wasSet := os.LookupEnv(notifySocketEnvVar)
+	os.Setenv(notifySocketEnvVar, socketPath)
+	return conn, func() {
+		if wasSet {
+			os.Setenv(notifySocketEnvVar, oldValue)
+		} else {
+			os.Unsetenv(notifySocketEnvVar)
+		}
+		conn.Close()
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func readNotification(t *testing.T, conn *net.UnixConn) string {
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("error reading the notification: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestNotify(t *testing.T) {
+	oldValue, wasSet := os.LookupEnv(notifySocketEnvVar)
+	os.Unsetenv(notifySocketEnvVar)
+	if err := Notify("READY=1"); err != nil {
+		t.Errorf("Notify() without NOTIFY_SOCKET: %v", err)
+	}
+	if wasSet {
+		os.Setenv(notifySocketEnvVar, oldValue)
+	}
+
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+	if err := Notify("READY=1"); err != nil {
+		t.Fatalf("Notify(): %v", err)
+	}
+	if msg := readNotification(t, conn); msg != "READY=1" {
+		t.Errorf("bad notification: %q", msg)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv(watchdogUsecEnvVar)
+	defer os.Unsetenv(watchdogPidEnvVar)
+	for _, tc := range []struct {
+		usec, pid string
+		expected  time.Duration
+	}{
+		{"", "", 0},
+		{"foo", "", 0},
+		{"30000000", "", 15 * time.Second},
+		{"30000000", "1", 0},
+		{"30000000", "self", 15 * time.Second},
+	} {
+		os.Setenv(watchdogUsecEnvVar, tc.usec)
+		pid := tc.pid
+		if pid == "self" {
+			pid = strconv.Itoa(os.Getpid())
+		}
+		os.Setenv(watchdogPidEnvVar, pid)
+		if interval := WatchdogInterval(); interval != tc.expected {
+			t.Errorf("WATCHDOG_USEC=%q WATCHDOG_PID=%q: bad interval %v instead of %v", tc.usec, pid, interval, tc.expected)
+		}
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+
+	var err error
+	c := NewChecker(DefaultCheckTimeout, Check{Name: "libvirt", Run: func() error { return err }})
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		c.RunWatchdog(time.Hour, stopCh)
+		close(doneCh)
+	}()
+	if msg := readNotification(t, conn); msg != "WATCHDOG=1\nSTATUS=all health checks passed" {
+		t.Errorf("bad notification: %q", msg)
+	}
+	close(stopCh)
+	<-doneCh
+
+	err = errors.New("connection\nrefused")
+	stopCh = make(chan struct{})
+	close(stopCh)
+	c.RunWatchdog(time.Hour, stopCh)
+	msg := readNotification(t, conn)
+	if strings.Contains(msg, "WATCHDOG=1") {
+		t.Errorf("watchdog notification sent despite the failed check: %q", msg)
+	}
+	if msg != "STATUS=health checks failed: libvirt: connection refused" {
+		t.Errorf("bad notification: %q", msg)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	notifySocketEnvVar = "NOTIFY_SOCKET"
+	watchdogUsecEnvVar = "WATCHDOG_USEC"
+	watchdogPidEnvVar  = "WATCHDOG_PID"
+)
+
+// Notify sends the state such as "READY=1" to systemd using sd_notify
+// protocol. It does nothing if the process isn't started by systemd
+// with Type=notify, i.e. NOTIFY_SOCKET environment variable isn't set
+func Notify(state string) error {
+	socketPath := os.Getenv(notifySocketEnvVar)
+	if socketPath == "" {
+		return nil
+	}
+	// the sockets with names starting with '@' are
+	// treated as abstract ones by Go
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("can't connect to systemd notification socket %q: %v", socketPath, err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("error sending notification to systemd: %v", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns the interval at which the watchdog
+// keep-alive notifications must be sent to systemd, which is half of
+// the watchdog timeout. It returns 0 if the watchdog isn't enabled
+// for the process
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(watchdogUsecEnvVar), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv(watchdogPidEnvVar); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// statusMessage returns the text for sd_notify STATUS= field
+// describing the results of the checks
+func statusMessage(results []Result) string {
+	var failed []string
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", r.Name, r.Err))
+		}
+	}
+	if len(failed) == 0 {
+		return "all health checks passed"
+	}
+	// STATUS= value must be a single line
+	return strings.Replace("health checks failed: "+strings.Join(failed, "; "), "\n", " ", -1)
+}
+
+// RunWatchdog runs the checks at the specified interval, sending
+// watchdog keep-alive notifications to systemd as long as all of them
+// pass, so systemd restarts the process if it's unable to manage the
+// VMs. The results of the checks are reported via STATUS= field.
+// It returns after stopCh is closed
+func (c *Checker) RunWatchdog(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		results, ok := c.Run()
+		state := "STATUS=" + statusMessage(results)
+		if ok {
+			state = "WATCHDOG=1\n" + state
+		}
+		if err := Notify(state); err != nil {
+			glog.Warningf("Watchdog notification failed: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
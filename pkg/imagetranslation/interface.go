@@ -35,6 +35,18 @@ type TranslationRule struct {
 
 	// Transport is the optional transport profile name to be used for the downloading
 	Transport string `yaml:"transport,omitempty" json:"transport,omitempty"`
+
+	// Arch is the optional image architecture in GOARCH notation (amd64, arm64, ppc64le).
+	// The node architecture is assumed if it's not specified
+	Arch string `yaml:"arch,omitempty" json:"arch,omitempty"`
+
+	// MachineType is the optional QEMU machine type (e.g. q35 or virt) for the VMs using the image.
+	// It overrides the default machine type for the architecture
+	MachineType string `yaml:"machineType,omitempty" json:"machineType,omitempty"`
+
+	// Emulator is the optional path to the emulator binary for the VMs using the image.
+	// It overrides the default emulator for the architecture
+	Emulator string `yaml:"emulator,omitempty" json:"emulator,omitempty"`
 }
 
 // ImageTranslation is a single translation config with optional prefix name
@@ -68,6 +68,9 @@ func convertEndpoint(rule TranslationRule, config *ImageTranslation) utils.Endpo
 		return utils.Endpoint{
 			Url:          rule.Url,
 			MaxRedirects: -1,
+			Arch:         rule.Arch,
+			MachineType:  rule.MachineType,
+			Emulator:     rule.Emulator,
 		}
 	}
 	if profile.TimeoutMilliseconds < 0 {
@@ -133,6 +136,9 @@ func convertEndpoint(rule TranslationRule, config *ImageTranslation) utils.Endpo
 		ProfileName:  rule.Transport,
 		MaxRedirects: maxRedirects,
 		TLS:          tlsConfig,
+		Arch:         rule.Arch,
+		MachineType:  rule.MachineType,
+		Emulator:     rule.Emulator,
 	}
 }
 
@@ -48,8 +48,10 @@ func TestTranslations(t *testing.T) {
 					Url:   "http://acme.org/linux_$1.qcow2",
 				},
 				{
-					Name: "linux/1",
-					Url:  "https://acme.org/linux.qcow2",
+					Name:        "linux/1",
+					Url:         "https://acme.org/linux.qcow2",
+					MachineType: "q35",
+					Emulator:    "/usr/bin/qemu-system-x86_64",
 				},
 			},
 		},
@@ -59,10 +61,12 @@ func TestTranslations(t *testing.T) {
 	translator.LoadConfigs(context.Background(), NewFakeConfigSource(configs))
 
 	for _, tc := range []struct {
-		name        string
-		allowRegexp bool
-		imageName   string
-		expectedUrl string
+		name             string
+		allowRegexp      bool
+		imageName        string
+		expectedUrl      string
+		expectedMachine  string
+		expectedEmulator string
 	}{
 		{
 			name:        "strict translation",
@@ -99,6 +103,9 @@ func TestTranslations(t *testing.T) {
 			allowRegexp: false,
 			imageName:   "prod/linux/1",
 			expectedUrl: "https://acme.org/linux.qcow2",
+			// machine settings are passed along with the URL
+			expectedMachine:  "q35",
+			expectedEmulator: "/usr/bin/qemu-system-x86_64",
 		},
 		{
 			name:        "regexp translation with prefix",
@@ -131,6 +138,9 @@ func TestTranslations(t *testing.T) {
 			if tc.expectedUrl != endpoint.Url {
 				t.Errorf("expected URL %q, but got %q", tc.expectedUrl, endpoint.Url)
 			}
+			if tc.expectedMachine != endpoint.MachineType || tc.expectedEmulator != endpoint.Emulator {
+				t.Errorf("expected machine type %q and emulator %q, but got %q and %q", tc.expectedMachine, tc.expectedEmulator, endpoint.MachineType, endpoint.Emulator)
+			}
 		})
 	}
 }
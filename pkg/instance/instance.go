@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package instance makes it possible to run several Virtlet
+// instances on the same node, e.g. the stable and the canary
+// DaemonSets during an upgrade. Each named instance gets its own
+// data directory, sockets, network namespace names and libvirt
+// object names, so the instances don't interfere with each other.
+package instance
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// EnvVar is the environment variable that passes the
+	// instance name to the helper processes such as vmwrapper
+	EnvVar = "VIRTLET_INSTANCE"
+	// DefaultDataDir is the data directory of the default instance
+	DefaultDataDir = "/var/lib/virtlet"
+	// defaultObjectPrefix is the prefix of libvirt domain and
+	// volume names of the default instance
+	defaultObjectPrefix = "virtlet-"
+	// namedObjectPrefix is the prefix of libvirt domain and volume
+	// names of the named instances that's followed by the
+	// instance name and a dash. It never matches the names of
+	// the default instance
+	namedObjectPrefix = "virtlet_"
+)
+
+var (
+	nameRx = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,18}[a-z0-9])?$`)
+	name   string
+)
+
+// Set sets the name of Virtlet instance for the current process.
+// Empty name denotes the default instance. Set must be called
+// before any of the paths or names are used
+func Set(instanceName string) error {
+	if instanceName != "" && !nameRx.MatchString(instanceName) {
+		return fmt.Errorf("bad instance name %q: must consist of at most 20 lowercase letters, digits and dashes, starting and ending with a letter or a digit", instanceName)
+	}
+	name = instanceName
+	return nil
+}
+
+// Name returns the name of the instance or an empty string
+// for the default instance
+func Name() string {
+	return name
+}
+
+// DataDir returns the directory that holds the data of
+// the instance
+func DataDir() string {
+	if name == "" {
+		return DefaultDataDir
+	}
+	return filepath.Join(DefaultDataDir, "instances", name)
+}
+
+// DataPath returns the path of the specified file or
+// directory inside the data directory of the instance
+func DataPath(elem ...string) string {
+	return filepath.Join(append([]string{DataDir()}, elem...)...)
+}
+
+// SocketPath returns the instance specific version of the
+// socket path by adding the instance name to the file name,
+// e.g. /var/lib/libvirt/streamer.sock becomes
+// /var/lib/libvirt/streamer-canary.sock
+func SocketPath(path string) string {
+	if name == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// ObjectPrefix returns the prefix of the names of libvirt
+// domains and volumes that belong to the instance
+func ObjectPrefix() string {
+	if name == "" {
+		return defaultObjectPrefix
+	}
+	return namedObjectPrefix + name + "-"
+}
+
+// IsVirtletObject returns true if the libvirt object with
+// the specified name belongs to any of Virtlet instances
+func IsVirtletObject(objName string) bool {
+	return strings.HasPrefix(objName, defaultObjectPrefix) || strings.HasPrefix(objName, namedObjectPrefix)
+}
+
+// NetNSName returns the name of the network namespace of
+// the pod with the specified id
+func NetNSName(podId string) string {
+	if name == "" {
+		return podId
+	}
+	return name + "_" + podId
+}
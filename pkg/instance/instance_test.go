@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package instance
+
+import (
+	"testing"
+)
+
+func TestInstance(t *testing.T) {
+	defer Set("")
+	for _, tc := range []struct {
+		name         string
+		dataPath     string
+		socketPath   string
+		objectPrefix string
+		netNSName    string
+	}{
+		{
+			name:         "",
+			dataPath:     "/var/lib/virtlet/nocloud",
+			socketPath:   "/var/lib/libvirt/streamer.sock",
+			objectPrefix: "virtlet-",
+			netNSName:    "69eec606-0493-11e7-8d8a-02420a000002",
+		},
+		{
+			name:         "canary",
+			dataPath:     "/var/lib/virtlet/instances/canary/nocloud",
+			socketPath:   "/var/lib/libvirt/streamer-canary.sock",
+			objectPrefix: "virtlet_canary-",
+			netNSName:    "canary_69eec606-0493-11e7-8d8a-02420a000002",
+		},
+	} {
+		t.Run("instance "+tc.name, func(t *testing.T) {
+			if err := Set(tc.name); err != nil {
+				t.Fatalf("Set(): %v", err)
+			}
+			if p := DataPath("nocloud"); p != tc.dataPath {
+				t.Errorf("bad data path: %q instead of %q", p, tc.dataPath)
+			}
+			if p := SocketPath("/var/lib/libvirt/streamer.sock"); p != tc.socketPath {
+				t.Errorf("bad socket path: %q instead of %q", p, tc.socketPath)
+			}
+			if p := ObjectPrefix(); p != tc.objectPrefix {
+				t.Errorf("bad object prefix: %q instead of %q", p, tc.objectPrefix)
+			}
+			if !IsVirtletObject(tc.objectPrefix + "foo") {
+				t.Errorf("%q is not recognized as a Virtlet object", tc.objectPrefix+"foo")
+			}
+			if n := NetNSName("69eec606-0493-11e7-8d8a-02420a000002"); n != tc.netNSName {
+				t.Errorf("bad netns name: %q instead of %q", n, tc.netNSName)
+			}
+		})
+	}
+	if IsVirtletObject("foreign-vm") {
+		t.Errorf("foreign-vm is recognized as a Virtlet object")
+	}
+	for _, name := range []string{"Canary", "-canary", "canary-", "canary_1", "instance-name-too-long"} {
+		if err := Set(name); err == nil {
+			t.Errorf("no error for bad instance name %q", name)
+		}
+	}
+}
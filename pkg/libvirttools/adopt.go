@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/instance"
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// ForeignDomain describes a libvirt domain on the node which
+// is not managed by Virtlet
+type ForeignDomain struct {
+	// Name is the name of the domain
+	Name string `json:"name"`
+	// UUID is the UUID of the domain
+	UUID string `json:"uuid"`
+	// Running is true if the domain is not shut off. Such
+	// domains must be shut down before they can be adopted
+	Running bool `json:"running"`
+}
+
+// ListForeignDomains returns the libvirt domains on the node
+// which are not managed by Virtlet and can be adopted by the
+// pods using VirtletAdoptDomain annotation
+func (v *VirtualizationTool) ListForeignDomains() ([]ForeignDomain, error) {
+	domains, err := v.domainConn.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+	var r []ForeignDomain
+	for _, domain := range domains {
+		name, err := domain.Name()
+		if err != nil {
+			return nil, err
+		}
+		if instance.IsVirtletObject(name) {
+			continue
+		}
+		uuid, err := domain.UUIDString()
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, ForeignDomain{Name: name, UUID: uuid, Running: domainActive(domain)})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Name < r[j].Name })
+	return r, nil
+}
+
+// mergeAdoptedDomain copies the parts of the adopted domain
+// definition that describe the guest's storage and firmware
+// into the domain definition generated by Virtlet. The network
+// interfaces, serial consoles and the emulator of the adopted
+// domain are replaced by the ones used by Virtlet
+func mergeAdoptedDomain(def, adopted *libvirtxml.Domain, keepMachineType bool) {
+	if adopted.Devices != nil {
+		def.Devices.Disks = adopted.Devices.Disks
+		def.Devices.Controllers = adopted.Devices.Controllers
+		def.Devices.Filesystems = adopted.Devices.Filesystems
+	}
+	if adopted.OS == nil {
+		return
+	}
+	if def.OS == nil {
+		def.OS = &libvirtxml.DomainOS{}
+	}
+	def.OS.Loader = adopted.OS.Loader
+	def.OS.NVRam = adopted.OS.NVRam
+	def.OS.BootDevices = adopted.OS.BootDevices
+	if keepMachineType && adopted.OS.Type != nil && def.OS.Type != nil && adopted.OS.Type.Machine != "" {
+		def.OS.Type.Machine = adopted.OS.Type.Machine
+	}
+	for _, disk := range def.Devices.Disks {
+		if disk.Boot != nil {
+			// per-device boot order can't be combined
+			// with <boot> elements in <os>
+			def.OS.BootDevices = nil
+			break
+		}
+	}
+}
+
+// adoptDomain takes over the libvirt domain specified by the pod
+// annotations, redefining it as the domain of the container. The
+// domain keeps its disks but gets the pod network. The original
+// definition of the domain is stored in the metadata so it can
+// be restored when the container is removed
+func (v *VirtualizationTool) adoptDomain(config *VMConfig, netFdKey string) (string, error) {
+	name := config.ParsedAnnotations.AdoptDomain
+	if instance.IsVirtletObject(name) {
+		return "", fmt.Errorf("domain %q is already managed by Virtlet", name)
+	}
+	domain, err := v.domainConn.LookupDomainByName(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up domain %q for adoption: %v", name, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return "", fmt.Errorf("failed to get state of domain %q: %v", name, err)
+	}
+	if state != virt.DOMAIN_SHUTOFF {
+		return "", fmt.Errorf("domain %q must be shut off before it can be adopted", name)
+	}
+
+	vols, err := v.volumeSource(config, v)
+	if err != nil {
+		return "", err
+	}
+	if len(vols) != 0 {
+		return "", errors.New("volumes can't be attached to adopted domains")
+	}
+
+	origDef, err := domain.Xml()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the definition of domain %q: %v", name, err)
+	}
+	origXML, err := origDef.Marshal()
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal the definition of domain %q: %v", name, err)
+	}
+	// make a copy of the definition as the original one
+	// is needed to restore the domain upon errors
+	var adopted libvirtxml.Domain
+	if err := adopted.Unmarshal(origXML); err != nil {
+		return "", fmt.Errorf("failed to unmarshal the definition of domain %q: %v", name, err)
+	}
+
+	settings, err := v.newDomainSettings(config, netFdKey)
+	if err != nil {
+		return "", err
+	}
+	domainDef, err := settings.createDomain(config)
+	if err != nil {
+		return "", err
+	}
+	mergeAdoptedDomain(domainDef, &adopted, config.ParsedAnnotations.MachineType == "")
+	if err := v.addSerialDevicesToDomain(config.PodSandboxId, config.Name, config.Attempt, domainDef, *settings); err != nil {
+		return "", err
+	}
+
+	if err := v.undefineDomain(name, domain); err != nil {
+		return "", fmt.Errorf("error undefining domain %q for adoption: %v", name, err)
+	}
+	ok := false
+	defer func() {
+		if ok {
+			return
+		}
+		if d, err := v.domainConn.LookupDomainByUUIDString(settings.domainUUID); err == nil {
+			if err := v.undefineDomain(settings.domainUUID, d); err != nil {
+				glog.Warningf("Failed to undefine domain %q: %v", settings.domainUUID, err)
+			}
+		}
+		if err := v.restoreAdoptedDomain(origXML); err != nil {
+			glog.Errorf("Failed to restore adopted domain %q: %v", name, err)
+		}
+	}()
+
+	glog.V(1).Infof("Pod %s (%s) adopts domain %q as %s", config.PodName, config.PodSandboxId, name, settings.domainName)
+	newDomain, err := v.domainConn.DefineDomain(domainDef)
+	if err != nil {
+		return "", fmt.Errorf("error defining the domain for adopted domain %q: %v", name, err)
+	}
+	if err := pinEmulator(newDomain); err != nil {
+		return "", err
+	}
+	if err := v.saveContainerInfo(config, "", false); err != nil {
+		return "", err
+	}
+	if err := v.metadataStore.Container(settings.domainUUID).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.AdoptedDomainXML = origXML
+			}
+			return c, nil
+		}); err != nil {
+		return "", err
+	}
+
+	ok = true
+	return settings.domainUUID, nil
+}
+
+// restoreAdoptedDomain defines the domain using its original
+// definition, returning it to the state it had before adoption
+func (v *VirtualizationTool) restoreAdoptedDomain(origXML string) error {
+	var def libvirtxml.Domain
+	if err := def.Unmarshal(origXML); err != nil {
+		return fmt.Errorf("failed to unmarshal the original domain definition: %v", err)
+	}
+	if _, err := v.domainConn.DefineDomain(&def); err != nil {
+		return fmt.Errorf("failed to define domain %q: %v", def.Name, err)
+	}
+	glog.V(1).Infof("Restored the original definition of adopted domain %q", def.Name)
+	return nil
+}
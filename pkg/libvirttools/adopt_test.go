@@ -0,0 +1,180 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const (
+	legacyDomainName = "legacy-vm"
+	legacyDomainUUID = "a9b8f1c2-1111-4d2a-9d3c-0123456789ab"
+	legacyDiskPath   = "/var/lib/libvirt/images/legacy-vm.qcow2"
+)
+
+func (ct *containerTester) defineLegacyDomain() virt.VirtDomain {
+	domain, err := ct.domainConn.DefineDomain(&libvirtxml.Domain{
+		Type: "kvm",
+		Name: legacyDomainName,
+		UUID: legacyDomainUUID,
+		OS: &libvirtxml.DomainOS{
+			Type: &libvirtxml.DomainOSType{Type: "hvm", Machine: "pc-q35-2.10"},
+			Loader: &libvirtxml.DomainLoader{
+				Path:     "/usr/share/OVMF/OVMF_CODE.fd",
+				Readonly: "yes",
+				Type:     "pflash",
+			},
+		},
+		Devices: &libvirtxml.DomainDeviceList{
+			Emulator: "/usr/bin/qemu-system-x86_64",
+			Disks: []libvirtxml.DomainDisk{
+				{
+					Type:   "file",
+					Device: "disk",
+					Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+					Source: &libvirtxml.DomainDiskSource{File: legacyDiskPath},
+					Target: &libvirtxml.DomainDiskTarget{Dev: "vda", Bus: "virtio"},
+				},
+			},
+			Interfaces: []libvirtxml.DomainInterface{
+				{
+					Type:   "bridge",
+					Source: &libvirtxml.DomainInterfaceSource{Bridge: "br0"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		ct.t.Fatalf("DefineDomain(): %v", err)
+	}
+	return domain
+}
+
+func TestAdoptDomain(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.defineLegacyDomain()
+
+	foreignDomains, err := ct.virtTool.ListForeignDomains()
+	if err != nil {
+		t.Fatalf("ListForeignDomains(): %v", err)
+	}
+	expectedForeignDomains := []ForeignDomain{{Name: legacyDomainName, UUID: legacyDomainUUID}}
+	if !reflect.DeepEqual(foreignDomains, expectedForeignDomains) {
+		t.Errorf("bad foreign domain list: %#v instead of %#v", foreignDomains, expectedForeignDomains)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations[AdoptDomainKeyName] = legacyDomainName
+	ct.setPodSandbox(sandbox)
+	containerID := ct.createContainer(sandbox, nil)
+
+	if _, err := ct.domainConn.LookupDomainByName(legacyDomainName); err != virt.ErrDomainNotFound {
+		t.Errorf("the original domain is still defined after adoption (err=%v)", err)
+	}
+	domain, err := ct.domainConn.LookupDomainByUUIDString(containerID)
+	if err != nil {
+		t.Fatalf("can't find the domain of the container: %v", err)
+	}
+	def, err := domain.Xml()
+	if err != nil {
+		t.Fatalf("Xml(): %v", err)
+	}
+	switch {
+	case !strings.HasPrefix(def.Name, "virtlet-"):
+		t.Errorf("bad name of the adopted domain: %q", def.Name)
+	case def.Devices.Emulator != vmWrapperPath:
+		t.Errorf("bad emulator of the adopted domain: %q", def.Devices.Emulator)
+	case len(def.Devices.Disks) != 1 || def.Devices.Disks[0].Source.File != legacyDiskPath:
+		t.Errorf("the disks of the adopted domain are not preserved: %#v", def.Devices.Disks)
+	case len(def.Devices.Interfaces) != 0:
+		t.Errorf("the network interfaces of the adopted domain must be removed: %#v", def.Devices.Interfaces)
+	case def.OS.Type.Machine != "pc-q35-2.10":
+		t.Errorf("the machine type of the adopted domain is not preserved: %q", def.OS.Type.Machine)
+	case def.OS.Loader == nil || def.OS.Loader.Path != "/usr/share/OVMF/OVMF_CODE.fd":
+		t.Errorf("the loader of the adopted domain is not preserved: %#v", def.OS.Loader)
+	}
+
+	if foreignDomains, err := ct.virtTool.ListForeignDomains(); err != nil {
+		t.Errorf("ListForeignDomains(): %v", err)
+	} else if len(foreignDomains) != 0 {
+		t.Errorf("the adopted domain is still listed as a foreign one: %#v", foreignDomains)
+	}
+	if containers := ct.listContainers(nil); len(containers) != 1 || containers[0].Id != containerID {
+		t.Errorf("the adopted domain is not listed as a container: %#v", containers)
+	}
+
+	ct.startContainer(containerID)
+	ct.stopContainer(containerID)
+	ct.removeContainer(containerID)
+
+	domain, err = ct.domainConn.LookupDomainByName(legacyDomainName)
+	if err != nil {
+		t.Fatalf("the original domain was not restored after removing the container: %v", err)
+	}
+	if uuid, err := domain.UUIDString(); err != nil {
+		t.Errorf("UUIDString(): %v", err)
+	} else if uuid != legacyDomainUUID {
+		t.Errorf("bad UUID of the restored domain: %q", uuid)
+	}
+	def, err = domain.Xml()
+	if err != nil {
+		t.Fatalf("Xml(): %v", err)
+	}
+	if len(def.Devices.Interfaces) != 1 || def.Devices.Emulator != "/usr/bin/qemu-system-x86_64" {
+		t.Errorf("the original definition of the domain was not restored: %#v", def.Devices)
+	}
+}
+
+func TestAdoptRunningDomain(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+	domain := ct.defineLegacyDomain()
+	if err := domain.Create(); err != nil {
+		t.Fatalf("Create(): %v", err)
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations[AdoptDomainKeyName] = legacyDomainName
+	ct.setPodSandbox(sandbox)
+	if _, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns"); err == nil {
+		t.Errorf("CreateContainer() didn't fail for a running domain")
+	}
+	if _, err := ct.domainConn.LookupDomainByName(legacyDomainName); err != nil {
+		t.Errorf("the running domain was removed: %v", err)
+	}
+}
+
+func TestAdoptMissingDomain(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations[AdoptDomainKeyName] = "no-such-domain"
+	ct.setPodSandbox(sandbox)
+	if _, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, nil), "/tmp/fakenetns"); err == nil {
+		t.Errorf("CreateContainer() didn't fail for a nonexistent domain")
+	}
+}
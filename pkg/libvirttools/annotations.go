@@ -18,8 +18,9 @@ package libvirttools
 
 import (
 	"fmt"
-	"strconv"
+	"regexp"
 	"strings"
+	"time"
 
 	// use this instead of "gopkg.in/yaml.v2" so we don't get
 	// map[interface{}]interface{} when unmarshalling cloud-init data
@@ -27,14 +28,38 @@ import (
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 
+	"github.com/Mirantis/virtlet/pkg/annotations"
+	"github.com/Mirantis/virtlet/pkg/bootserver"
 	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
+// guestInterfaceNameRx matches the interface names accepted by
+// Linux which don't need any quoting
+var guestInterfaceNameRx = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
 type DiskDriver string
 
+// CloudInitImageType specifies the format of the image
+// that passes cloud-init data to the VM
+type CloudInitImageType string
+
+// RootImageType specifies how the image of the VM pod is used
+type RootImageType string
+
 const (
+	// AnnotationSchemaVersion is the version of Virtlet pod
+	// annotation schema. The pods may specify the version they
+	// were written for using VirtletAnnotationSchemaVersion
+	// annotation, so they're rejected instead of being
+	// misinterpreted if the schema changes incompatibly
+	AnnotationSchemaVersion = "v1"
+	annotationKeyPrefix     = "Virtlet"
+
 	maxVCPUCount                                 = 255
+	AnnotationSchemaVersionKeyName               = "VirtletAnnotationSchemaVersion"
 	VCPUCountAnnotationKeyName                   = "VirtletVCPUCount"
+	MaxVCPUCountAnnotationKeyName                = "VirtletMaxVCPUCount"
 	CloudInitMetaDataKeyName                     = "VirtletCloudInitMetaData"
 	CloudInitUserDataKeyName                     = "VirtletCloudInitUserData"
 	CloudInitUserDataSourceKeyName               = "VirtletCloudInitUserDataSource"
@@ -43,8 +68,53 @@ const (
 	SSHKeysKeyName                               = "VirtletSSHKeys"
 	SSHKeySourceKeyName                          = "VirtletSSHKeySource"
 	DiskDriverKeyName                            = "VirtletDiskDriver"
+	MachineTypeKeyName                           = "VirtletMachineType"
+	MACAddressKeyName                            = "VirtletMACAddress"
+	IngressAllowKeyName                          = "VirtletIngressAllow"
+	CNINetworksKeyName                           = "VirtletCNINetworks"
+	CloudInitImageTypeKeyName                    = "VirtletCloudInitImageType"
+	VsockKeyName                                 = "VirtletVsock"
+	RootVolumePoolKeyName                        = "VirtletRootVolumePool"
+	QCOW2OptionsKeyName                          = "VirtletQCOW2Options"
+	VolumeEncryptionSecretKeyName                = "VirtletVolumeEncryptionSecret"
+	PowerOffOnCommandExitKeyName                 = "VirtletPowerOffOnCommandExit"
+	WaitForBootKeyName                           = "VirtletWaitForBoot"
+	BootTimeoutKeyName                           = "VirtletBootTimeout"
+	MinMemoryKeyName                             = "VirtletMinMemory"
+	NestedVirtualizationKeyName                  = "VirtletNestedVirtualization"
+	SharedRootImageKeyName                       = "VirtletSharedRootImage"
+	RootImageTypeKeyName                         = "VirtletRootImageType"
+	RootDiskSizeKeyName                          = "VirtletRootDiskSize"
+	KernelKeyName                                = "VirtletKernel"
+	InitrdKeyName                                = "VirtletInitrd"
+	KernelArgsKeyName                            = "VirtletKernelArgs"
+	VMPoolKeyName                                = "VirtletVMPool"
+	AdoptDomainKeyName                           = "VirtletAdoptDomain"
+	CrashDumpKeyName                             = "VirtletCrashDump"
+	DebugKeyName                                 = "VirtletDebug"
+	GuestInterfaceNamesKeyName                   = "VirtletGuestInterfaceNames"
+	L2NetworkKeyName                             = "VirtletL2Network"
+	BridgeMulticastKeyName                       = "VirtletBridgeMulticast"
+	DHCPExtraMACsKeyName                         = "VirtletDHCPExtraMACs"
+	DHCPRelaxedKeyName                           = "VirtletDHCPRelaxed"
+	NetBootKeyName                               = "VirtletNetBoot"
+	VirtioNetOptionsKeyName                      = "VirtletVirtioNetOptions"
 	DiskDriverVirtio                  DiskDriver = "virtio"
 	DiskDriverScsi                    DiskDriver = "scsi"
+
+	// CloudInitImageTypeNoCloud denotes NoCloud image (the default)
+	CloudInitImageTypeNoCloud CloudInitImageType = "nocloud"
+	// CloudInitImageTypeConfigDrive denotes OpenStack config drive
+	// image which includes network_data.json
+	CloudInitImageTypeConfigDrive CloudInitImageType = "configdrive"
+
+	// RootImageTypeDisk denotes a disk image that's copied to
+	// the root volume of the VM (the default)
+	RootImageTypeDisk RootImageType = "disk"
+	// RootImageTypeISO denotes an installer ISO image that's
+	// attached to the VM as a CD-ROM along with an empty root
+	// volume
+	RootImageTypeISO RootImageType = "iso"
 )
 
 type VirtletAnnotations struct {
@@ -55,6 +125,143 @@ type VirtletAnnotations struct {
 	UserDataScript    string
 	SSHKeys           []string
 	DiskDriver        DiskDriver
+	MachineType       string
+	CDImageType       CloudInitImageType
+	Vsock             bool
+	RootVolumePool    string
+	QCOW2Options      string
+	// VolumeEncryptionKey holds the passphrase for LUKS
+	// encryption of the root volume and qcow2 volumes of the VM.
+	// Empty value means that the volumes are not encrypted
+	VolumeEncryptionKey []byte
+	// PowerOffOnCommandExit specifies that the VM must be powered
+	// off after the container command finishes
+	PowerOffOnCommandExit bool
+	// WaitForBoot specifies that the container must not be
+	// reported as running until cloud-init finishes booting the VM
+	WaitForBoot bool
+	// BootTimeout specifies the time after which the VM is
+	// stopped and the container is marked as failed if the
+	// guest doesn't finish booting. 0 means no timeout
+	BootTimeout time.Duration
+	// MinMemory is the lower bound for the guest memory in bytes
+	// when the memory is reclaimed using the balloon driver.
+	// 0 means that no memory is reclaimed from the VM
+	MinMemory int64
+	// MaxVCPUCount is the maximum number of vCPUs that can be
+	// hot-plugged into the VM. 0 means no vCPU hotplug
+	MaxVCPUCount int
+	// NestedVirtualization specifies that the CPU features needed
+	// to run hypervisors inside the VM must be enabled
+	NestedVirtualization bool
+	// SharedRootImage specifies that the root volume must be a
+	// thin copy-on-write overlay over the image volume, which is
+	// shared between the VMs, instead of a full copy of the image
+	SharedRootImage bool
+	// RootImageType specifies whether the image is a disk image
+	// or an installer ISO. Empty value means a disk image
+	RootImageType RootImageType
+	// RootDiskSize is the size of the empty root volume in bytes
+	// that's created for the VMs installed from an ISO image
+	RootDiskSize int64
+	// Kernel specifies the kernel for direct kernel boot
+	// of the VM. The bootloader of the root volume is
+	// not used in this case
+	Kernel *BootFile
+	// Initrd specifies the initial ramdisk for direct kernel boot
+	Initrd *BootFile
+	// KernelArgs specifies the kernel command line for
+	// direct kernel boot. It can also be used without Kernel
+	// for the images made from container images that
+	// include a kernel
+	KernelArgs string
+	// VMPool specifies the name of the VirtualMachinePool
+	// which has standby VMs that can be claimed by the pod
+	VMPool string
+	// AdoptDomain specifies the name of a pre-existing libvirt
+	// domain on the node which is taken over by the pod
+	// instead of creating a new VM
+	AdoptDomain string
+	// CrashDump specifies that the memory of the VM must be
+	// dumped if the guest kernel panics, provided that crash
+	// dumps are enabled on the node
+	CrashDump bool
+	// Debug enables verbose logging of the VM's domain
+	// definition, CNI results and DHCP packets regardless
+	// of the glog verbosity level
+	Debug bool
+	// GuestInterfaceNames specifies the names of the network
+	// interfaces inside the guest in the order of the VM's NICs.
+	// Empty name means that the name of the interface in the
+	// pod network namespace is used
+	GuestInterfaceNames []string
+	// L2Network specifies the bridge on the node to attach the VM
+	// to instead of using CNI, optionally followed by a colon and
+	// the VLAN id. The guest gets its addresses from the provider
+	// network in this case
+	L2Network string
+	// NetBoot specifies the boot file for PXE boot as a path
+	// of the form dir/file relative to the netboot directory
+	// on the node. The VM tries to boot from its first NIC
+	// before its disks when it's set
+	NetBoot string
+	// VirtioNetOptions specifies the virtio-net device options
+	// that tune the virtio rings of the VM's NICs, such as
+	// rx_queue_size
+	VirtioNetOptions utils.VirtioNetOptions
+}
+
+// BootFile denotes a kernel or initrd file for direct kernel boot.
+// It's taken either from an image or from a ConfigMap or a Secret
+type BootFile struct {
+	// Source is the value of the annotation that specifies
+	// the file
+	Source string
+	// Image is the name of the image that holds the file,
+	// empty if the file comes from a ConfigMap or a Secret
+	Image string
+	// Data is the contents of the file taken from a ConfigMap
+	// or a Secret
+	Data []byte
+}
+
+// parseBootFile parses the annotation that specifies a kernel or
+// initrd file. The value is either kind/name/key, where kind is
+// configmap or secret, or the name of an image
+func parseBootFile(source string) *BootFile {
+	source = strings.TrimSpace(source)
+	if source == "" {
+		return nil
+	}
+	lcSource := strings.ToLower(source)
+	if strings.HasPrefix(lcSource, "configmap/") || strings.HasPrefix(lcSource, "secret/") {
+		return &BootFile{Source: source}
+	}
+	return &BootFile{Source: source, Image: source}
+}
+
+// parseGuestInterfaceNames parses a comma-separated list of
+// the guest interface names
+func parseGuestInterfaceNames(value string) ([]string, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+	names := strings.Split(value, ",")
+	seen := make(map[string]bool)
+	for n, name := range names {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			// keep the default name
+		case !guestInterfaceNameRx.MatchString(name):
+			return nil, fmt.Errorf("bad interface name %q", name)
+		case seen[name]:
+			return nil, fmt.Errorf("duplicate interface name %q", name)
+		}
+		seen[name] = true
+		names[n] = name
+	}
+	return names, nil
 }
 
 func LoadAnnotations(ns string, podAnnotations map[string]string) (*VirtletAnnotations, error) {
@@ -62,91 +269,170 @@ func LoadAnnotations(ns string, podAnnotations map[string]string) (*VirtletAnnot
 	if err := va.parsePodAnnotations(ns, podAnnotations); err != nil {
 		return nil, err
 	}
-	va.applyDefaults()
 	if err := va.validate(); err != nil {
 		return nil, err
 	}
 	return &va, nil
 }
 
-func (va *VirtletAnnotations) parsePodAnnotations(ns string, podAnnotations map[string]string) error {
-	if podAnnotations[CloudInitUserDataOverwriteKeyName] == "true" {
-		va.UserDataOverwrite = true
-	}
-	if err := va.loadExternalUserData(ns, podAnnotations); err != nil {
-		return err
-	}
+// inlineCloudInitData holds the cloud-init data specified directly
+// in the annotations which is combined with the data taken from
+// ConfigMaps and Secrets after the latter is loaded
+type inlineCloudInitData struct {
+	userData map[string]interface{}
+	sshKeys  []string
+}
 
-	if vcpuCountStr, found := podAnnotations[VCPUCountAnnotationKeyName]; found {
+// annotationSchema returns the schema of Virtlet pod annotations
+// that sets the fields of va. The fields must be already set to
+// their default values
+func (va *VirtletAnnotations) annotationSchema(inline *inlineCloudInitData) *annotations.Schema {
+	s := annotations.NewSchema(annotationKeyPrefix, AnnotationSchemaVersionKeyName, AnnotationSchemaVersion)
+	s.Int(VCPUCountAnnotationKeyName, &va.VCPUCount, 1, maxVCPUCount)
+	s.Int(MaxVCPUCountAnnotationKeyName, &va.MaxVCPUCount, 1, maxVCPUCount)
+	s.YAML(CloudInitMetaDataKeyName, &va.MetaData)
+	s.YAML(CloudInitUserDataKeyName, &inline.userData)
+	s.Bool(CloudInitUserDataOverwriteKeyName, &va.UserDataOverwrite)
+	s.Text(CloudInitUserDataScriptKeyName, &va.UserDataScript)
+	s.Lines(SSHKeysKeyName, &inline.sshKeys)
+	s.Enum(DiskDriverKeyName, (*string)(&va.DiskDriver), string(DiskDriverScsi), string(DiskDriverVirtio))
+	s.String(MachineTypeKeyName, &va.MachineType)
+	s.Enum(CloudInitImageTypeKeyName, (*string)(&va.CDImageType), string(CloudInitImageTypeNoCloud), string(CloudInitImageTypeConfigDrive))
+	s.Bool(VsockKeyName, &va.Vsock)
+	s.Custom(RootVolumePoolKeyName, func(value string) error {
+		value = strings.TrimSpace(value)
+		if value != "" && !storagePoolNameRx.MatchString(value) {
+			return fmt.Errorf("bad root volume pool name %q", value)
+		}
+		va.RootVolumePool = value
+		return nil
+	})
+	s.Custom(QCOW2OptionsKeyName, func(value string) error {
+		value = strings.TrimSpace(value)
+		if _, err := parseQCOW2Options(value, virt.QCOW2Options{}); err != nil {
+			return err
+		}
+		va.QCOW2Options = value
+		return nil
+	})
+	s.Bool(PowerOffOnCommandExitKeyName, &va.PowerOffOnCommandExit)
+	s.Bool(WaitForBootKeyName, &va.WaitForBoot)
+	s.Duration(BootTimeoutKeyName, &va.BootTimeout)
+	s.Quantity(MinMemoryKeyName, &va.MinMemory)
+	s.Bool(NestedVirtualizationKeyName, &va.NestedVirtualization)
+	s.Bool(SharedRootImageKeyName, &va.SharedRootImage)
+	s.Enum(RootImageTypeKeyName, (*string)(&va.RootImageType), string(RootImageTypeDisk), string(RootImageTypeISO))
+	s.Quantity(RootDiskSizeKeyName, &va.RootDiskSize)
+	s.Custom(KernelKeyName, func(value string) error {
+		va.Kernel = parseBootFile(value)
+		return nil
+	})
+	s.Custom(InitrdKeyName, func(value string) error {
+		va.Initrd = parseBootFile(value)
+		return nil
+	})
+	s.String(KernelArgsKeyName, &va.KernelArgs)
+	s.String(VMPoolKeyName, &va.VMPool)
+	s.String(AdoptDomainKeyName, &va.AdoptDomain)
+	s.Bool(CrashDumpKeyName, &va.CrashDump)
+	s.Bool(DebugKeyName, &va.Debug)
+	s.Custom(GuestInterfaceNamesKeyName, func(value string) error {
 		var err error
-		n, err := strconv.Atoi(vcpuCountStr)
-		if err != nil {
-			return fmt.Errorf("error parsing cpu count for VM pod (%q)", vcpuCountStr)
+		va.GuestInterfaceNames, err = parseGuestInterfaceNames(value)
+		return err
+	})
+	// these are loaded from ConfigMaps and Secrets by
+	// loadExternalUserData() after parsing the annotations
+	s.Known(CloudInitUserDataSourceKeyName, SSHKeySourceKeyName, VolumeEncryptionSecretKeyName)
+	// these are handled when the pod sandbox is created
+	s.Known(MACAddressKeyName, IngressAllowKeyName, CNINetworksKeyName, BridgeMulticastKeyName, DHCPExtraMACsKeyName, DHCPRelaxedKeyName)
+	// this one is validated when the pod sandbox is
+	// created, too, but it also affects cloud-init
+	// network configuration
+	s.String(L2NetworkKeyName, &va.L2Network)
+	// the boot server is set up when the pod sandbox is
+	// created, but the boot order of the VM changes, too
+	s.Custom(NetBootKeyName, func(value string) error {
+		if _, _, err := bootserver.ParseBootPath(value); err != nil {
+			return err
 		}
-		va.VCPUCount = n
+		va.NetBoot = value
+		return nil
+	})
+	s.Custom(VirtioNetOptionsKeyName, func(value string) error {
+		var err error
+		va.VirtioNetOptions, err = utils.ParseVirtioNetOptions(value)
+		return err
+	})
+	return s
+}
+
+func (va *VirtletAnnotations) parsePodAnnotations(ns string, podAnnotations map[string]string) error {
+	va.VCPUCount = 1
+	va.DiskDriver = DiskDriverScsi
+	var inline inlineCloudInitData
+	if err := va.annotationSchema(&inline).Parse(podAnnotations); err != nil {
+		return err
 	}
 
-	if metaDataStr, found := podAnnotations[CloudInitMetaDataKeyName]; found {
-		if err := yaml.Unmarshal([]byte(metaDataStr), &va.MetaData); err != nil {
-			return fmt.Errorf("failed to unmarshal cloud-init metadata")
-		}
+	if err := va.loadExternalUserData(ns, podAnnotations); err != nil {
+		return err
 	}
 
-	if userDataStr, found := podAnnotations[CloudInitUserDataKeyName]; found {
-		var userData map[string]interface{}
-		if err := yaml.Unmarshal([]byte(userDataStr), &userData); err != nil {
-			return fmt.Errorf("failed to unmarshal cloud-init userdata")
-		}
+	if inline.userData != nil {
 		if va.UserDataOverwrite {
-			va.UserData = userData
+			va.UserData = inline.userData
 		} else {
-			va.UserData = utils.Merge(va.UserData, userData).(map[string]interface{})
+			va.UserData = utils.Merge(va.UserData, inline.userData).(map[string]interface{})
 		}
 	}
 
-	va.UserDataScript = podAnnotations[CloudInitUserDataScriptKeyName]
-
-	if sshKeysStr, found := podAnnotations[SSHKeysKeyName]; found {
+	if _, found := podAnnotations[SSHKeysKeyName]; found {
 		if va.UserDataOverwrite {
 			va.SSHKeys = nil
 		}
-		keys := strings.Split(sshKeysStr, "\n")
-		for _, k := range keys {
-			k = strings.TrimSpace(k)
-			if k != "" {
-				va.SSHKeys = append(va.SSHKeys, k)
-			}
-		}
+		va.SSHKeys = append(va.SSHKeys, inline.sshKeys...)
 	}
-
-	va.DiskDriver = DiskDriver(podAnnotations[DiskDriverKeyName])
 	return nil
 }
 
-func (va *VirtletAnnotations) applyDefaults() {
-	if va.VCPUCount <= 0 {
-		va.VCPUCount = 1
-	}
-	if va.DiskDriver == "" {
-		va.DiskDriver = DiskDriverScsi
+// validate checks the combinations of the annotations
+func (va *VirtletAnnotations) validate() error {
+	var errs annotations.ErrorList
+	if va.MaxVCPUCount != 0 && va.MaxVCPUCount < va.VCPUCount {
+		errs.Add(MaxVCPUCountAnnotationKeyName, "max vcpu count %d is less than vcpu count %d", va.MaxVCPUCount, va.VCPUCount)
 	}
-}
 
-func (va *VirtletAnnotations) validate() error {
-	var errs []string
-	if va.VCPUCount > maxVCPUCount {
-		errs = append(errs, fmt.Sprintf("vcpu count %d too big, max is %d", va.VCPUCount, maxVCPUCount))
+	if va.RootImageType == RootImageTypeISO {
+		if va.RootDiskSize == 0 {
+			errs.Add(RootImageTypeKeyName, "%s annotation must be set for %q root image type", RootDiskSizeKeyName, RootImageTypeISO)
+		}
+		if va.SharedRootImage {
+			errs.Add(RootImageTypeKeyName, "%q root image type can't be used with shared root image", RootImageTypeISO)
+		}
 	}
 
-	if va.DiskDriver != DiskDriverVirtio && va.DiskDriver != DiskDriverScsi {
-		errs = append(errs, fmt.Sprintf("bad disk driver %q. Must be either %q or %q", DiskDriverVirtio, DiskDriverScsi))
+	if va.Kernel == nil && va.Initrd != nil {
+		errs.Add(InitrdKeyName, "%s annotation can only be used along with %s", InitrdKeyName, KernelKeyName)
 	}
 
-	if errs != nil {
-		return fmt.Errorf("bad virtlet annotations. Errors:\n%s", strings.Join(errs, "\n"))
+	if va.AdoptDomain != "" {
+		for _, conflict := range []struct {
+			set     bool
+			keyName string
+		}{
+			{va.VMPool != "", VMPoolKeyName},
+			{va.Kernel != nil, KernelKeyName},
+			{va.RootImageType == RootImageTypeISO, RootImageTypeKeyName},
+			{va.Vsock, VsockKeyName},
+		} {
+			if conflict.set {
+				errs.Add(AdoptDomainKeyName, "%s annotation can't be used along with %s", AdoptDomainKeyName, conflict.keyName)
+			}
+		}
 	}
 
-	return nil
+	return errs.Err()
 }
 
 func (va *VirtletAnnotations) loadExternalUserData(ns string, podAnnotations map[string]string) error {
@@ -182,6 +468,36 @@ func (va *VirtletAnnotations) loadExternalUserData(ns string, podAnnotations map
 			return err
 		}
 	}
+	for _, bootFile := range []*BootFile{va.Kernel, va.Initrd} {
+		if bootFile == nil || bootFile.Image != "" {
+			continue
+		}
+		var err error
+		if clientset == nil {
+			clientset, err = utils.GetK8sClientset(nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = bootFile.load(ns, clientset)
+		if err != nil {
+			return err
+		}
+	}
+	encryptionSecretKey := podAnnotations[VolumeEncryptionSecretKeyName]
+	if encryptionSecretKey != "" {
+		var err error
+		if clientset == nil {
+			clientset, err = utils.GetK8sClientset(nil)
+			if err != nil {
+				return err
+			}
+		}
+		err = va.loadVolumeEncryptionKey(ns, encryptionSecretKey, clientset)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -228,6 +544,42 @@ func (va *VirtletAnnotations) loadSSHKeysFromDataSource(ns, key string, clientse
 	return nil
 }
 
+func (va *VirtletAnnotations) loadVolumeEncryptionKey(ns, key string, clientset *kubernetes.Clientset) error {
+	parts := strings.Split(key, "/")
+	if len(parts) != 1 && len(parts) != 2 {
+		return fmt.Errorf("invalid %s annotation format. Expected name[/key], but instead got %s", VolumeEncryptionSecretKeyName, key)
+	}
+	dataKey := "key"
+	if len(parts) == 2 {
+		dataKey = parts[1]
+	}
+	data, err := readK8sKeySource("secret", parts[0], ns, dataKey, clientset)
+	if err != nil {
+		return err
+	}
+	if data[dataKey] == "" {
+		return fmt.Errorf("volume encryption key %q not found in secret %q", dataKey, parts[0])
+	}
+	va.VolumeEncryptionKey = []byte(data[dataKey])
+	return nil
+}
+
+func (f *BootFile) load(ns string, clientset *kubernetes.Clientset) error {
+	parts := strings.Split(f.Source, "/")
+	if len(parts) != 3 {
+		return fmt.Errorf("invalid boot file source format. Expected kind/name/key, but instead got %s", f.Source)
+	}
+	data, err := readK8sKeySource(parts[0], parts[1], ns, parts[2], clientset)
+	if err != nil {
+		return err
+	}
+	if data[parts[2]] == "" {
+		return fmt.Errorf("boot file %q not found in %s %q", parts[2], parts[0], parts[1])
+	}
+	f.Data = []byte(data[parts[2]])
+	return nil
+}
+
 func readK8sKeySource(sourceType, sourceName, ns, key string, clientset *kubernetes.Clientset) (map[string]string, error) {
 	sourceType = strings.ToLower(sourceType)
 	switch sourceType {
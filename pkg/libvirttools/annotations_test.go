@@ -19,6 +19,9 @@ package libvirttools
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
 )
 
 func TestVirtletAnnotations(t *testing.T) {
@@ -44,22 +47,6 @@ func TestVirtletAnnotations(t *testing.T) {
 				DiskDriver: "scsi",
 			},
 		},
-		{
-			name:        "negative vcpu count (default)",
-			annotations: map[string]string{"VirtletVCPUCount": "-1"},
-			va: &VirtletAnnotations{
-				VCPUCount:  1,
-				DiskDriver: "scsi",
-			},
-		},
-		{
-			name:        "zero vcpu count (default)",
-			annotations: map[string]string{"VirtletVCPUCount": "0"},
-			va: &VirtletAnnotations{
-				VCPUCount:  1,
-				DiskDriver: "scsi",
-			},
-		},
 		{
 			name:        "vcpu count specified",
 			annotations: map[string]string{"VirtletVCPUCount": "4"},
@@ -117,15 +104,326 @@ func TestVirtletAnnotations(t *testing.T) {
 				DiskDriver:     "scsi",
 			},
 		},
+		{
+			name:        "machine type",
+			annotations: map[string]string{"VirtletMachineType": "q35"},
+			va: &VirtletAnnotations{
+				VCPUCount:   1,
+				DiskDriver:  "scsi",
+				MachineType: "q35",
+			},
+		},
+		{
+			name:        "config drive",
+			annotations: map[string]string{"VirtletCloudInitImageType": "configdrive"},
+			va: &VirtletAnnotations{
+				VCPUCount:   1,
+				DiskDriver:  "scsi",
+				CDImageType: "configdrive",
+			},
+		},
+		{
+			name:        "vsock",
+			annotations: map[string]string{"VirtletVsock": "true"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				Vsock:      true,
+			},
+		},
+		{
+			name:        "root volume pool",
+			annotations: map[string]string{"VirtletRootVolumePool": "fast"},
+			va: &VirtletAnnotations{
+				VCPUCount:      1,
+				DiskDriver:     "scsi",
+				RootVolumePool: "fast",
+			},
+		},
+		{
+			name:        "qcow2 options",
+			annotations: map[string]string{"VirtletQCOW2Options": "preallocation=falloc,lazy_refcounts=on"},
+			va: &VirtletAnnotations{
+				VCPUCount:    1,
+				DiskDriver:   "scsi",
+				QCOW2Options: "preallocation=falloc,lazy_refcounts=on",
+			},
+		},
+		{
+			name:        "boot timeout",
+			annotations: map[string]string{"VirtletBootTimeout": "3m"},
+			va: &VirtletAnnotations{
+				VCPUCount:   1,
+				DiskDriver:  "scsi",
+				BootTimeout: 3 * time.Minute,
+			},
+		},
+		{
+			name:        "min memory",
+			annotations: map[string]string{"VirtletMinMemory": "256Mi"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				MinMemory:  256 * 1024 * 1024,
+			},
+		},
+		{
+			name: "max vcpu count",
+			annotations: map[string]string{
+				"VirtletVCPUCount":    "2",
+				"VirtletMaxVCPUCount": "8",
+			},
+			va: &VirtletAnnotations{
+				VCPUCount:    2,
+				MaxVCPUCount: 8,
+				DiskDriver:   "scsi",
+			},
+		},
+		{
+			name:        "nested virtualization",
+			annotations: map[string]string{"VirtletNestedVirtualization": "true"},
+			va: &VirtletAnnotations{
+				VCPUCount:            1,
+				DiskDriver:           "scsi",
+				NestedVirtualization: true,
+			},
+		},
+		{
+			name:        "shared root image",
+			annotations: map[string]string{"VirtletSharedRootImage": "true"},
+			va: &VirtletAnnotations{
+				VCPUCount:       1,
+				DiskDriver:      "scsi",
+				SharedRootImage: true,
+			},
+		},
+		{
+			name: "iso root image",
+			annotations: map[string]string{
+				"VirtletRootImageType": "iso",
+				"VirtletRootDiskSize":  "10Gi",
+			},
+			va: &VirtletAnnotations{
+				VCPUCount:     1,
+				DiskDriver:    "scsi",
+				RootImageType: RootImageTypeISO,
+				RootDiskSize:  10737418240,
+			},
+		},
+		{
+			name: "direct kernel boot",
+			annotations: map[string]string{
+				"VirtletKernel":     "virtlet.cloud/example.com/vmlinuz",
+				"VirtletInitrd":     "configmap/boot/initrd.img",
+				"VirtletKernelArgs": " console=ttyS0 root=/dev/vda ",
+			},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				Kernel: &BootFile{
+					Source: "virtlet.cloud/example.com/vmlinuz",
+					Image:  "virtlet.cloud/example.com/vmlinuz",
+				},
+				Initrd:     &BootFile{Source: "configmap/boot/initrd.img"},
+				KernelArgs: "console=ttyS0 root=/dev/vda",
+			},
+		},
+		{
+			name:        "kernel args without kernel",
+			annotations: map[string]string{"VirtletKernelArgs": "init=/bin/sh"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				KernelArgs: "init=/bin/sh",
+			},
+		},
+		{
+			name:        "vm pool",
+			annotations: map[string]string{"VirtletVMPool": "cirros"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				VMPool:     "cirros",
+			},
+		},
+		{
+			name:        "adopt domain",
+			annotations: map[string]string{"VirtletAdoptDomain": "legacy-vm"},
+			va: &VirtletAnnotations{
+				VCPUCount:   1,
+				DiskDriver:  "scsi",
+				AdoptDomain: "legacy-vm",
+			},
+		},
+		{
+			name:        "debug",
+			annotations: map[string]string{"VirtletDebug": "true"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				Debug:      true,
+			},
+		},
+		{
+			name:        "guest interface names",
+			annotations: map[string]string{"VirtletGuestInterfaceNames": "lan0, ,wan0"},
+			va: &VirtletAnnotations{
+				VCPUCount:           1,
+				DiskDriver:          "scsi",
+				GuestInterfaceNames: []string{"lan0", "", "wan0"},
+			},
+		},
+		{
+			name:        "l2 network",
+			annotations: map[string]string{"VirtletL2Network": "br-provider:100"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				L2Network:  "br-provider:100",
+			},
+		},
+		{
+			name:        "net boot",
+			annotations: map[string]string{"VirtletNetBoot": "ipxe/undionly.kpxe"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				NetBoot:    "ipxe/undionly.kpxe",
+			},
+		},
+		{
+			name:        "virtio-net options",
+			annotations: map[string]string{"VirtletVirtioNetOptions": "rx_queue_size=1024,event_idx=off"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+				VirtioNetOptions: utils.VirtioNetOptions{
+					"rx_queue_size": "1024",
+					"event_idx":     "off",
+				},
+			},
+		},
+		{
+			name:        "schema version",
+			annotations: map[string]string{"VirtletAnnotationSchemaVersion": "v1"},
+			va: &VirtletAnnotations{
+				VCPUCount:  1,
+				DiskDriver: "scsi",
+			},
+		},
 		// bad metadata items follow
 		{
 			name:        "bad vcpu count",
 			annotations: map[string]string{"VirtletVCPUCount": "256"},
 		},
+		{
+			name:        "negative vcpu count",
+			annotations: map[string]string{"VirtletVCPUCount": "-1"},
+		},
+		{
+			name:        "zero vcpu count",
+			annotations: map[string]string{"VirtletVCPUCount": "0"},
+		},
+		{
+			name:        "bad vsock flag",
+			annotations: map[string]string{"VirtletVsock": "yes please"},
+		},
+		{
+			name:        "bad guest interface name",
+			annotations: map[string]string{"VirtletGuestInterfaceNames": "eth0,bad/name"},
+		},
+		{
+			name:        "too long guest interface name",
+			annotations: map[string]string{"VirtletGuestInterfaceNames": "averyveryverylongname"},
+		},
+		{
+			name:        "duplicate guest interface names",
+			annotations: map[string]string{"VirtletGuestInterfaceNames": "eth0,eth1,eth0"},
+		},
+		{
+			name:        "net boot file outside of a directory",
+			annotations: map[string]string{"VirtletNetBoot": "undionly.kpxe"},
+		},
+		{
+			name:        "bad virtio-net queue size",
+			annotations: map[string]string{"VirtletVirtioNetOptions": "rx_queue_size=1000"},
+		},
+		{
+			name:        "virtio-net tx queue size",
+			annotations: map[string]string{"VirtletVirtioNetOptions": "tx_queue_size=1024"},
+		},
+		{
+			name:        "misspelled annotation",
+			annotations: map[string]string{"VirtletVCPUcount": "2"},
+		},
+		{
+			name:        "unsupported schema version",
+			annotations: map[string]string{"VirtletAnnotationSchemaVersion": "v2"},
+		},
 		{
 			name:        "bad disk driver",
 			annotations: map[string]string{"VirtletDiskDriver": "ducttape"},
 		},
+		{
+			name:        "bad cloud-init image type",
+			annotations: map[string]string{"VirtletCloudInitImageType": "floppy"},
+		},
+		{
+			name:        "bad root volume pool",
+			annotations: map[string]string{"VirtletRootVolumePool": "../fast"},
+		},
+		{
+			name:        "bad qcow2 options",
+			annotations: map[string]string{"VirtletQCOW2Options": "cluster_size=1000"},
+		},
+		{
+			name:        "bad boot timeout",
+			annotations: map[string]string{"VirtletBootTimeout": "forever"},
+		},
+		{
+			name: "max vcpu count less than vcpu count",
+			annotations: map[string]string{
+				"VirtletVCPUCount":    "4",
+				"VirtletMaxVCPUCount": "2",
+			},
+		},
+		{
+			name:        "bad root image type",
+			annotations: map[string]string{"VirtletRootImageType": "floppy"},
+		},
+		{
+			name:        "iso root image without root disk size",
+			annotations: map[string]string{"VirtletRootImageType": "iso"},
+		},
+		{
+			name: "bad root disk size",
+			annotations: map[string]string{
+				"VirtletRootImageType": "iso",
+				"VirtletRootDiskSize":  "huge",
+			},
+		},
+		{
+			name:        "initrd without kernel",
+			annotations: map[string]string{"VirtletInitrd": "secret/boot/initrd"},
+		},
+		{
+			name: "adopt domain with vm pool",
+			annotations: map[string]string{
+				"VirtletAdoptDomain": "legacy-vm",
+				"VirtletVMPool":      "cirros",
+			},
+		},
+		{
+			name: "adopt domain with vsock",
+			annotations: map[string]string{
+				"VirtletAdoptDomain": "legacy-vm",
+				"VirtletVsock":       "true",
+			},
+		},
+		{
+			name:        "bad min memory",
+			annotations: map[string]string{"VirtletMinMemory": "lots"},
+		},
 		{
 			name: "bad cloud-init meta-data",
 			annotations: map[string]string{
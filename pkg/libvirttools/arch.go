@@ -0,0 +1,171 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	emulatorEnvVar           = "VIRTLET_QEMU_BINARY"
+	machineTypeEnvVar        = "VIRTLET_MACHINE_TYPE"
+	crossArchEmulationEnvVar = "VIRTLET_ALLOW_CROSS_ARCH_EMULATION"
+)
+
+// archSettings describes the emulator and the machine type
+// to use for VMs on a particular architecture
+type archSettings struct {
+	// domainArch is the name of the architecture as used in
+	// libvirt domain definitions
+	domainArch string
+	// kvmEmulator is the path to the emulator binary used when
+	// KVM acceleration is enabled
+	kvmEmulator string
+	// tcgEmulator is the path to the emulator binary used for
+	// plain qemu (TCG) domains
+	tcgEmulator string
+	// machineType is the default machine type for the
+	// architecture. Empty string means libvirt default
+	machineType string
+}
+
+// archSettingsByGoArch maps GOARCH values to architecture settings
+var archSettingsByGoArch = map[string]archSettings{
+	"amd64": {
+		domainArch:  "x86_64",
+		kvmEmulator: "/usr/bin/kvm",
+		tcgEmulator: "/usr/bin/qemu-system-x86_64",
+	},
+	"arm64": {
+		domainArch:  "aarch64",
+		kvmEmulator: "/usr/bin/qemu-system-aarch64",
+		tcgEmulator: "/usr/bin/qemu-system-aarch64",
+		machineType: "virt",
+	},
+	"ppc64le": {
+		domainArch:  "ppc64le",
+		kvmEmulator: "/usr/bin/qemu-system-ppc64",
+		tcgEmulator: "/usr/bin/qemu-system-ppc64",
+		machineType: "pseries",
+	},
+}
+
+// ImagePlatform describes the platform settings of an image that
+// come from its translation rule
+type ImagePlatform struct {
+	// Arch is the architecture of the image in GOARCH notation
+	Arch string
+	// MachineType is the QEMU machine type to use for the image,
+	// empty for the default one
+	MachineType string
+	// Emulator is the path to the emulator binary to use for the
+	// image, empty for the default one
+	Emulator string
+}
+
+// getArchSettings returns emulator settings for the specified
+// architecture. For the node's architecture, the overrides from
+// VIRTLET_QEMU_BINARY and VIRTLET_MACHINE_TYPE environment variables
+// are applied. The emulator and the machine type specified for the
+// image take precedence over both the defaults and the overrides
+func getArchSettings(goarch string, platform ImagePlatform) (archSettings, error) {
+	settings, found := archSettingsByGoArch[goarch]
+	if !found {
+		return archSettings{}, fmt.Errorf("unsupported architecture %q", goarch)
+	}
+	// node-specific overrides aren't applied to foreign architectures
+	if goarch == runtime.GOARCH {
+		if emulator := os.Getenv(emulatorEnvVar); emulator != "" {
+			settings.kvmEmulator = emulator
+			settings.tcgEmulator = emulator
+		}
+		if machineType := os.Getenv(machineTypeEnvVar); machineType != "" {
+			settings.machineType = machineType
+		}
+	}
+	if platform.Emulator != "" {
+		settings.kvmEmulator = platform.Emulator
+		settings.tcgEmulator = platform.Emulator
+	}
+	if platform.MachineType != "" {
+		settings.machineType = platform.MachineType
+	}
+	return settings, nil
+}
+
+// emulator returns the emulator binary path for kvm or non-kvm domain
+func (s archSettings) emulator(useKvm bool) string {
+	if useKvm {
+		return s.kvmEmulator
+	}
+	return s.tcgEmulator
+}
+
+func crossArchEmulationAllowed() bool {
+	return utils.GetBoolFromString(os.Getenv(crossArchEmulationEnvVar))
+}
+
+// imageArch returns the architecture of an image. Images with
+// unspecified architecture are assumed to match the node
+func imageArch(arch string) string {
+	if arch == "" {
+		return runtime.GOARCH
+	}
+	return arch
+}
+
+// checkImageArch verifies that the image with the specified
+// architecture can be run on this node
+func checkImageArch(arch string) error {
+	arch = imageArch(arch)
+	if arch == runtime.GOARCH {
+		return nil
+	}
+	if _, found := archSettingsByGoArch[arch]; !found {
+		return fmt.Errorf("unsupported image architecture %q", arch)
+	}
+	if !crossArchEmulationAllowed() {
+		return fmt.Errorf("image architecture %q doesn't match node architecture %q and cross-architecture emulation is not enabled (set %s to enable it)", arch, runtime.GOARCH, crossArchEmulationEnvVar)
+	}
+	return nil
+}
+
+// guestArchSettings returns architecture settings for a VM that uses
+// an image with the specified platform settings. The second return
+// value is true if the guest needs to be emulated because its
+// architecture differs from that of the node
+func guestArchSettings(platform ImagePlatform) (archSettings, bool, error) {
+	arch := imageArch(platform.Arch)
+	foreign := arch != runtime.GOARCH
+	if foreign {
+		if err := checkImageArch(arch); err != nil {
+			return archSettings{}, false, err
+		}
+		glog.Warningf("Using TCG emulation for %q guest on %q node", arch, runtime.GOARCH)
+	}
+	settings, err := getArchSettings(arch, platform)
+	if err != nil {
+		return archSettings{}, false, err
+	}
+	return settings, foreign, nil
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func foreignArch() string {
+	if runtime.GOARCH == "arm64" {
+		return "amd64"
+	}
+	return "arm64"
+}
+
+func TestGuestArchSettings(t *testing.T) {
+	defer os.Unsetenv(crossArchEmulationEnvVar)
+	for _, tc := range []struct {
+		name          string
+		arch          string
+		allowEmulate  bool
+		expectForeign bool
+		expectError   bool
+	}{
+		{
+			name: "unspecified arch",
+			arch: "",
+		},
+		{
+			name: "node arch",
+			arch: runtime.GOARCH,
+		},
+		{
+			name:        "foreign arch without emulation",
+			arch:        foreignArch(),
+			expectError: true,
+		},
+		{
+			name:          "foreign arch with emulation",
+			arch:          foreignArch(),
+			allowEmulate:  true,
+			expectForeign: true,
+		},
+		{
+			name:         "unknown arch",
+			arch:         "vax",
+			allowEmulate: true,
+			expectError:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.allowEmulate {
+				os.Setenv(crossArchEmulationEnvVar, "1")
+			} else {
+				os.Unsetenv(crossArchEmulationEnvVar)
+			}
+			settings, foreign, err := guestArchSettings(ImagePlatform{Arch: tc.arch})
+			switch {
+			case tc.expectError:
+				if err == nil {
+					t.Errorf("guestArchSettings() didn't return an error")
+				}
+				return
+			case err != nil:
+				t.Fatalf("guestArchSettings(): %v", err)
+			}
+			if foreign != tc.expectForeign {
+				t.Errorf("bad 'foreign' flag: %v instead of %v", foreign, tc.expectForeign)
+			}
+			if expected := archSettingsByGoArch[imageArch(tc.arch)].domainArch; settings.domainArch != expected {
+				t.Errorf("bad domain arch: %q instead of %q", settings.domainArch, expected)
+			}
+		})
+	}
+}
+
+func TestGetArchSettings(t *testing.T) {
+	defer func() {
+		os.Unsetenv(emulatorEnvVar)
+		os.Unsetenv(machineTypeEnvVar)
+	}()
+	nodeDefaults := archSettingsByGoArch[runtime.GOARCH]
+	foreignDefaults := archSettingsByGoArch[foreignArch()]
+	for _, tc := range []struct {
+		name        string
+		goarch      string
+		env         map[string]string
+		platform    ImagePlatform
+		expected    archSettings
+		expectError bool
+	}{
+		{
+			name:     "defaults",
+			goarch:   runtime.GOARCH,
+			expected: nodeDefaults,
+		},
+		{
+			name:   "node overrides",
+			goarch: runtime.GOARCH,
+			env: map[string]string{
+				emulatorEnvVar:    "/opt/qemu/bin/qemu",
+				machineTypeEnvVar: "node-machine",
+			},
+			expected: archSettings{
+				domainArch:  nodeDefaults.domainArch,
+				kvmEmulator: "/opt/qemu/bin/qemu",
+				tcgEmulator: "/opt/qemu/bin/qemu",
+				machineType: "node-machine",
+			},
+		},
+		{
+			name:   "image settings",
+			goarch: runtime.GOARCH,
+			platform: ImagePlatform{
+				MachineType: "image-machine",
+				Emulator:    "/usr/local/bin/qemu",
+			},
+			expected: archSettings{
+				domainArch:  nodeDefaults.domainArch,
+				kvmEmulator: "/usr/local/bin/qemu",
+				tcgEmulator: "/usr/local/bin/qemu",
+				machineType: "image-machine",
+			},
+		},
+		{
+			name:   "image settings take precedence over node overrides",
+			goarch: runtime.GOARCH,
+			env: map[string]string{
+				emulatorEnvVar:    "/opt/qemu/bin/qemu",
+				machineTypeEnvVar: "node-machine",
+			},
+			platform: ImagePlatform{MachineType: "image-machine"},
+			expected: archSettings{
+				domainArch:  nodeDefaults.domainArch,
+				kvmEmulator: "/opt/qemu/bin/qemu",
+				tcgEmulator: "/opt/qemu/bin/qemu",
+				machineType: "image-machine",
+			},
+		},
+		{
+			name:   "node overrides are not applied to foreign architectures",
+			goarch: foreignArch(),
+			env: map[string]string{
+				emulatorEnvVar:    "/opt/qemu/bin/qemu",
+				machineTypeEnvVar: "node-machine",
+			},
+			expected: foreignDefaults,
+		},
+		{
+			name:     "image settings for foreign architecture",
+			goarch:   foreignArch(),
+			platform: ImagePlatform{MachineType: "image-machine"},
+			expected: archSettings{
+				domainArch:  foreignDefaults.domainArch,
+				kvmEmulator: foreignDefaults.kvmEmulator,
+				tcgEmulator: foreignDefaults.tcgEmulator,
+				machineType: "image-machine",
+			},
+		},
+		{
+			name:        "unsupported architecture",
+			goarch:      "vax",
+			expectError: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{emulatorEnvVar, machineTypeEnvVar} {
+				os.Setenv(name, tc.env[name])
+			}
+			settings, err := getArchSettings(tc.goarch, tc.platform)
+			switch {
+			case tc.expectError:
+				if err == nil {
+					t.Errorf("getArchSettings() didn't return an error")
+				}
+			case err != nil:
+				t.Errorf("getArchSettings(): %v", err)
+			case !reflect.DeepEqual(settings, tc.expected):
+				t.Errorf("bad arch settings: %#v instead of %#v", settings, tc.expected)
+			}
+		})
+	}
+}
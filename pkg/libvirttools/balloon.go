@@ -0,0 +1,179 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	// memoryStatsPeriod is the interval for collecting the
+	// guest memory statistics by the balloon driver
+	memoryStatsPeriod = 10 * time.Second
+	// balloonHeadroomPercent is the amount of the memory that's
+	// left to the guest on top of the memory it uses
+	balloonHeadroomPercent = 25
+	// balloonMaxShrinkPercent limits the amount of the memory
+	// that's reclaimed from the guest at once, so the guest
+	// has time to react to the memory pressure
+	balloonMaxShrinkPercent = 25
+	// balloonHysteresisPercent is the minimum change of the
+	// balloon target that's applied, so the balloon isn't
+	// adjusted due to small fluctuations of memory usage
+	balloonHysteresisPercent = 5
+)
+
+// balloonTarget calculates the new balloon target for the VM
+// based on its memory statistics, keeping the target within
+// [minMemory, maxMemory] range
+func balloonTarget(stats *virt.DomainMemoryStats, minMemory, maxMemory uint64) uint64 {
+	actual := stats.ActualBalloon
+	var used uint64
+	if stats.Unused < stats.Available {
+		used = stats.Available - stats.Unused
+	}
+	target := used + used*balloonHeadroomPercent/100
+	if minTarget := actual - actual*balloonMaxShrinkPercent/100; target < minTarget {
+		target = minTarget
+	}
+	if target < minMemory {
+		target = minMemory
+	}
+	if target > maxMemory {
+		target = maxMemory
+	}
+	var diff uint64
+	if target > actual {
+		diff = target - actual
+	} else {
+		diff = actual - target
+	}
+	// always apply the bounds, even if the change is small
+	if diff < actual*balloonHysteresisPercent/100 && actual >= minMemory && actual <= maxMemory {
+		return actual
+	}
+	// libvirt uses KiB for the balloon target
+	return target &^ 1023
+}
+
+// adjustBalloon changes the balloon target of the running VM
+// according to its memory usage
+func (v *VirtualizationTool) adjustBalloon(domain virt.VirtDomain, containerId string, minMemory uint64) error {
+	def, err := domain.Xml()
+	if err != nil {
+		return fmt.Errorf("cannot get the definition of domain %q: %v", containerId, err)
+	}
+	if def.Memory == nil {
+		return nil
+	}
+	maxMemory := uint64(def.Memory.Value) * uint64(memoryUnitMultipliers[def.Memory.Unit])
+
+	stats, err := domain.MemoryStats()
+	if err != nil {
+		return fmt.Errorf("cannot get memory stats of domain %q: %v", containerId, err)
+	}
+	if stats.Available == 0 {
+		// the guest statistics aren't collected by the balloon
+		// driver yet, so they're enabled here and the
+		// balloon is adjusted during the next pass
+		if err := domain.SetMemoryStatsPeriod(memoryStatsPeriod); err != nil {
+			return fmt.Errorf("cannot enable memory stats for domain %q: %v", containerId, err)
+		}
+		return nil
+	}
+
+	target := balloonTarget(stats, minMemory, maxMemory)
+	if target == stats.ActualBalloon {
+		return nil
+	}
+	glog.V(3).Infof("Changing the balloon target of %q from %d to %d bytes (available: %d, unused: %d)", containerId, stats.ActualBalloon, target, stats.Available, stats.Unused)
+	if err := domain.SetMemory(target); err != nil {
+		return fmt.Errorf("cannot set the balloon target of domain %q: %v", containerId, err)
+	}
+	return nil
+}
+
+// ReclaimMemory adjusts the balloon targets of the running VMs
+// that have VirtletMinMemory annotation according to their
+// memory usage, reclaiming the memory that's not used by
+// the guests and giving it back when the guests need it
+func (v *VirtualizationTool) ReclaimMemory() []error {
+	ids, _, allErrors := v.retrieveListOfContainerIDs()
+	for _, id := range ids {
+		config, _, err := v.getVMConfigFromMetadata(id)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("cannot get the config of container %q: %v", id, err))
+			continue
+		}
+		if config == nil {
+			continue
+		}
+		// the namespace is not passed to LoadAnnotations() so it
+		// doesn't try to fetch cloud-init data from k8s
+		ann, err := LoadAnnotations("", config.PodAnnotations)
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("bad annotations for container %q: %v", id, err))
+			continue
+		}
+		if ann.MinMemory == 0 {
+			continue
+		}
+
+		domain, err := v.domainConn.LookupDomainByUUIDString(id)
+		if err == virt.ErrDomainNotFound {
+			continue
+		}
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("cannot lookup domain %q: %v", id, err))
+			continue
+		}
+		state, err := domain.State()
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("cannot get the state of domain %q: %v", id, err))
+			continue
+		}
+		if state != virt.DOMAIN_RUNNING {
+			continue
+		}
+		if err := v.adjustBalloon(domain, id, uint64(ann.MinMemory)); err != nil {
+			allErrors = append(allErrors, err)
+		}
+	}
+	return allErrors
+}
+
+// RunMemoryReclaim invokes ReclaimMemory() periodically with the
+// specified interval until stopCh is closed
+func (v *VirtualizationTool) RunMemoryReclaim(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		for _, err := range v.ReclaimMemory() {
+			glog.Warningf("Memory reclaim: %v", err)
+		}
+	}
+}
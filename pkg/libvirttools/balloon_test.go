@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const mib = 1024 * 1024
+
+func TestBalloonTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name                  string
+		actual, used          uint64
+		minMemory, maxMemory  uint64
+		expectedBalloonTarget uint64
+	}{
+		{
+			name:                  "shrink",
+			actual:                1024 * mib,
+			used:                  700 * mib,
+			minMemory:             256 * mib,
+			maxMemory:             1024 * mib,
+			expectedBalloonTarget: 875 * mib,
+		},
+		{
+			name:                  "shrink limited by max shrink step",
+			actual:                1024 * mib,
+			used:                  100 * mib,
+			minMemory:             256 * mib,
+			maxMemory:             1024 * mib,
+			expectedBalloonTarget: 768 * mib,
+		},
+		{
+			name:                  "shrink limited by min memory",
+			actual:                300 * mib,
+			used:                  100 * mib,
+			minMemory:             256 * mib,
+			maxMemory:             1024 * mib,
+			expectedBalloonTarget: 256 * mib,
+		},
+		{
+			name:                  "grow",
+			actual:                512 * mib,
+			used:                  480 * mib,
+			minMemory:             256 * mib,
+			maxMemory:             1024 * mib,
+			expectedBalloonTarget: 600 * mib,
+		},
+		{
+			name:                  "grow limited by max memory",
+			actual:                900 * mib,
+			used:                  880 * mib,
+			minMemory:             256 * mib,
+			maxMemory:             1024 * mib,
+			expectedBalloonTarget: 1024 * mib,
+		},
+		{
+			name:                  "small change",
+			actual:                512 * mib,
+			used:                  400 * mib,
+			minMemory:             256 * mib,
+			maxMemory:             1024 * mib,
+			expectedBalloonTarget: 512 * mib,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stats := &virt.DomainMemoryStats{
+				ActualBalloon: tc.actual,
+				Available:     tc.actual,
+				Unused:        tc.actual - tc.used,
+			}
+			target := balloonTarget(stats, tc.minMemory, tc.maxMemory)
+			if target != tc.expectedBalloonTarget {
+				t.Errorf("bad balloon target: %d MiB instead of %d MiB", target/mib, tc.expectedBalloonTarget/mib)
+			}
+		})
+	}
+}
+
+func TestReclaimMemory(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandboxes := criapi.GetSandboxes(2)
+	sandboxes[0].Annotations[MinMemoryKeyName] = "256Mi"
+	var domains []*fake.FakeDomain
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+		containerId := ct.createContainer(sandbox, nil)
+		ct.startContainer(containerId)
+		d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+		if err != nil {
+			t.Fatalf("LookupDomainByUUIDString(): %v", err)
+		}
+		domain := d.(*fake.FakeDomain)
+		domain.SetGuestMemoryUsed(100 * mib)
+		domains = append(domains, domain)
+	}
+
+	reclaim := func() {
+		for _, err := range ct.virtTool.ReclaimMemory() {
+			t.Errorf("ReclaimMemory(): %v", err)
+		}
+	}
+
+	// the first pass enables the memory stats
+	reclaim()
+	if domains[0].Balloon() != 0 {
+		t.Errorf("the balloon target was set before the memory stats were collected")
+	}
+	for i, expected := range []uint64{768 * mib, 576 * mib, 432 * mib, 324 * mib, 256 * mib, 256 * mib} {
+		reclaim()
+		if domains[0].Balloon() != expected {
+			t.Errorf("bad balloon target after pass %d: %d MiB instead of %d MiB", i+1, domains[0].Balloon()/mib, expected/mib)
+		}
+	}
+
+	domains[0].SetGuestMemoryUsed(250 * mib)
+	reclaim()
+	if domains[0].Balloon() != 312*mib+512*1024 {
+		t.Errorf("bad balloon target after the memory usage growth: %d", domains[0].Balloon())
+	}
+
+	if domains[1].Balloon() != 0 {
+		t.Errorf("the balloon target was set for a VM without %s annotation", MinMemoryKeyName)
+	}
+}
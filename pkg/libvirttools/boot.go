@@ -0,0 +1,172 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	// bootFinishedPath is the file that's created by cloud-init
+	// after it finishes all of the boot stages
+	bootFinishedPath  = "/var/lib/cloud/instance/boot-finished"
+	bootCheckInterval = 2 * time.Second
+	// bootWaitTimeout must be less than kubelet's runtime
+	// request timeout (2 minutes by default)
+	bootWaitTimeout = 100 * time.Second
+	// bootTimeoutReason is the reason reported for
+	// the containers that failed to boot in time
+	bootTimeoutReason   = "BootTimeout"
+	bootTimeoutExitCode = 1
+	// bootFailureConsoleLines is the number of the last lines
+	// of the console output included in the boot failure message
+	bootFailureConsoleLines = 10
+	podLogsDirEnvVar        = "KUBERNETES_POD_LOGS"
+)
+
+// guestBootFinished returns true if cloud-init has finished
+// booting the VM. It returns false if the boot is still in
+// progress or the guest agent isn't available yet.
+func guestBootFinished(domain virt.VirtDomain) bool {
+	return CopyFromGuest(domain, bootFinishedPath, ioutil.Discard) == nil
+}
+
+// waitForBoot waits for cloud-init inside the VM to finish
+// booting it, as reported via QEMU guest agent
+func (v *VirtualizationTool) waitForBoot(domain virt.VirtDomain, containerId string) error {
+	glog.V(2).Infof("Waiting for VM %s to boot", containerId)
+	if err := utils.WaitLoop(func() (bool, error) {
+		state, err := domain.State()
+		if err != nil {
+			return false, fmt.Errorf("failed to get state of the domain %q: %v", containerId, err)
+		}
+		if state != virt.DOMAIN_RUNNING {
+			// the VM has stopped (e.g. it has run the
+			// command and powered off), nothing to wait for
+			glog.Warningf("VM %s stopped before finishing the boot", containerId)
+			return true, nil
+		}
+		return guestBootFinished(domain), nil
+	}, bootCheckInterval, bootWaitTimeout, v.clock); err != nil {
+		return fmt.Errorf("VM %s didn't finish booting in %v", containerId, bootWaitTimeout)
+	}
+	glog.V(2).Infof("VM %s has finished booting", containerId)
+	return nil
+}
+
+// lastConsoleLines returns up to n last lines of the console
+// output of the VM from its Kubernetes log file
+func lastConsoleLines(containerInfo *metadata.ContainerInfo, n int) ([]string, error) {
+	logsDir := os.Getenv(podLogsDirEnvVar)
+	if logsDir == "" || loggingDisabled() {
+		return nil, nil
+	}
+	// this must match the log file name used by the stream server
+	logPath := filepath.Join(logsDir, containerInfo.SandboxID, fmt.Sprintf("%s_%d.log", containerInfo.Name, containerInfo.Attempt))
+	f, err := os.Open(logPath)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry struct {
+			Log string `json:"log"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("bad log entry in %q: %v", logPath, err)
+		}
+		lines = append(lines, strings.TrimRight(entry.Log, "\r\n"))
+		if len(lines) > n {
+			lines = lines[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading %q: %v", logPath, err)
+	}
+	return lines, nil
+}
+
+// checkBoot checks whether the guest has finished booting.
+// If it didn't and the boot timeout has expired, the VM
+// is stopped and the boot failure is recorded in the
+// container metadata
+func (v *VirtualizationTool) checkBoot(domain virt.VirtDomain, containerId string, containerInfo *metadata.ContainerInfo) error {
+	if guestBootFinished(domain) {
+		containerInfo.BootFinished = true
+		return v.metadataStore.Container(containerId).Save(
+			func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+				if c != nil {
+					c.BootFinished = true
+				}
+				return c, nil
+			})
+	}
+
+	now := v.clock.Now().UnixNano()
+	if now-containerInfo.StartedAt < containerInfo.BootTimeout {
+		return nil
+	}
+
+	message := fmt.Sprintf("VM didn't finish booting in %v", time.Duration(containerInfo.BootTimeout))
+	lines, err := lastConsoleLines(containerInfo, bootFailureConsoleLines)
+	if err != nil {
+		glog.Warningf("Can't get console output of container %s: %v", containerId, err)
+	}
+	if len(lines) != 0 {
+		message += "; last console output:\n" + strings.Join(lines, "\n")
+	}
+	glog.Warningf("Stopping container %s: %s", containerId, message)
+	if err := domain.Destroy(); err != nil {
+		return fmt.Errorf("failed to destroy the domain %q: %v", containerId, err)
+	}
+
+	if err := v.metadataStore.Container(containerId).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.State = kubeapi.ContainerState_CONTAINER_EXITED
+				c.BootFailedAt = now
+				c.BootFailureMessage = message
+			}
+			return c, nil
+		}); err != nil {
+		return err
+	}
+	containerInfo.State = kubeapi.ContainerState_CONTAINER_EXITED
+	containerInfo.BootFailedAt = now
+	containerInfo.BootFailureMessage = message
+	return nil
+}
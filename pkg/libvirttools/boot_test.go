@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestWaitForBoot(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		bootsInTime bool
+	}{
+		{
+			name:        "boot finished",
+			bootsInTime: true,
+		},
+		{
+			name:        "boot timeout",
+			bootsInTime: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, fake.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations[WaitForBootKeyName] = "true"
+			ct.setPodSandbox(sandbox)
+			containerId := ct.createContainer(sandbox, nil)
+
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- ct.virtTool.StartContainer(containerId)
+			}()
+
+			// wait for the first boot check to fail
+			ct.clock.BlockUntil(1)
+			select {
+			case err := <-errCh:
+				t.Fatalf("StartContainer() returned before the VM has booted: %v", err)
+			default:
+			}
+
+			if !tc.bootsInTime {
+				ct.clock.Advance(bootWaitTimeout)
+				if err := <-errCh; err == nil {
+					t.Errorf("StartContainer() didn't fail after the boot timeout")
+				}
+				return
+			}
+
+			d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+			if err != nil {
+				t.Fatalf("LookupDomainByUUIDString(): %v", err)
+			}
+			d.(*fake.FakeDomain).SetGuestFile(bootFinishedPath, nil)
+			ct.clock.Advance(bootCheckInterval)
+			if err := <-errCh; err != nil {
+				t.Fatalf("StartContainer(): %v", err)
+			}
+
+			status := ct.containerStatus(containerId)
+			if status.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+				t.Errorf("bad container state: %v", status.State)
+			}
+		})
+	}
+}
+
+func TestBootTimeout(t *testing.T) {
+	logsDir, err := ioutil.TempDir("", "pod-logs-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(logsDir)
+	os.Setenv(podLogsDirEnvVar, logsDir)
+	defer os.Unsetenv(podLogsDirEnvVar)
+
+	for _, tc := range []struct {
+		name   string
+		booted bool
+	}{
+		{
+			name:   "boot finished",
+			booted: true,
+		},
+		{
+			name:   "boot timeout",
+			booted: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, fake.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations[BootTimeoutKeyName] = "5m"
+			ct.setPodSandbox(sandbox)
+			containerId := ct.createContainer(sandbox, nil)
+			ct.startContainer(containerId)
+
+			podLogsDir := filepath.Join(logsDir, sandbox.Metadata.Uid)
+			if err := os.MkdirAll(podLogsDir, 0755); err != nil {
+				t.Fatalf("MkdirAll(): %v", err)
+			}
+			var logLines []string
+			for i := 1; i <= 12; i++ {
+				logLines = append(logLines, fmt.Sprintf(`{"time":"2017-05-30T20:19:00Z","stream":"stdout","log":"line %d\r\n"}`, i))
+			}
+			logPath := filepath.Join(podLogsDir, fmt.Sprintf("%s_%d.log", fakeContainerName, fakeContainerAttempt))
+			if err := ioutil.WriteFile(logPath, []byte(strings.Join(logLines, "\n")+"\n"), 0644); err != nil {
+				t.Fatalf("WriteFile(): %v", err)
+			}
+
+			if tc.booted {
+				d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+				if err != nil {
+					t.Fatalf("LookupDomainByUUIDString(): %v", err)
+				}
+				d.(*fake.FakeDomain).SetGuestFile(bootFinishedPath, nil)
+			}
+
+			ct.clock.Advance(4 * time.Minute)
+			status := ct.containerStatus(containerId)
+			if status.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+				t.Errorf("bad container state before the timeout: %v", status.State)
+			}
+
+			ct.clock.Advance(2 * time.Minute)
+			status = ct.containerStatus(containerId)
+			if tc.booted {
+				if status.State != kubeapi.ContainerState_CONTAINER_RUNNING || status.Reason != "" {
+					t.Errorf("bad status of a booted container: %v %q", status.State, status.Reason)
+				}
+				return
+			}
+			if status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+				t.Errorf("bad container state after the timeout: %v", status.State)
+			}
+			if status.Reason != bootTimeoutReason || status.ExitCode != bootTimeoutExitCode || status.FinishedAt != ct.clock.Now().UnixNano() {
+				t.Errorf("bad boot failure status: reason %q, exit code %d, finished at %d", status.Reason, status.ExitCode, status.FinishedAt)
+			}
+			expectedMessage := "VM didn't finish booting in 5m0s; last console output:\nline 3\nline 4\nline 5\nline 6\nline 7\nline 8\nline 9\nline 10\nline 11\nline 12"
+			if status.Message != expectedMessage {
+				t.Errorf("bad boot failure message:\n%s\nExpected:\n%s", status.Message, expectedMessage)
+			}
+		})
+	}
+}
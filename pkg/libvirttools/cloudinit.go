@@ -26,9 +26,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 
+	cnitypes "github.com/containernetworking/cni/pkg/types"
 	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
 	"github.com/ghodss/yaml"
 	"github.com/golang/glog"
@@ -43,6 +45,19 @@ const (
 	EnvFileLocation   = "/etc/cloud/environment"
 	MountFileLocation = "/etc/cloud/mount-volumes.sh"
 	MountScriptSubst  = "@virtlet-mount-script@"
+	// ProfileEnvFileLocation is the location of the script that
+	// exports the environment variables of the container
+	// for login shells
+	ProfileEnvFileLocation = "/etc/profile.d/virtlet-env.sh"
+	// VolumeFilesIsoDir is the directory on the cloud-init
+	// image that holds the copies of Secret and ConfigMap
+	// files placed into the VM. The files are placed there
+	// under their paths inside the VM so they can be used
+	// even when write_files cloud-init module is not available
+	VolumeFilesIsoDir = "virtlet/files"
+	// PodInfoIsoPath is the path of the file on the cloud-init
+	// image that describes the pod similar to Downward API
+	PodInfoIsoPath = "virtlet/pod-info.json"
 )
 
 type CloudInitGenerator struct {
@@ -99,12 +114,18 @@ func (g *CloudInitGenerator) generateUserData(volumeMap diskPathMap) ([]byte, er
 	writeFilesUpdater := newWriteFilesUpdater(g.config.Mounts)
 	writeFilesUpdater.addSecrets()
 	writeFilesUpdater.addConfigMapEntries()
+	writeFilesUpdater.addDownwardAPIEntries()
 	writeFilesUpdater.addFileLikeMounts()
 	if mountScript != "" {
 		writeFilesUpdater.addMountScript(mountScript)
 	}
 	if envContent := g.generateEnvVarsContent(); envContent != "" {
 		writeFilesUpdater.addEnvironmentFile(envContent)
+		writeFilesUpdater.addProfileEnvScript(g.generateProfileEnvScript())
+	}
+	if len(g.config.Command) != 0 {
+		writeFilesUpdater.addCommandScript(g.generateCommandScript())
+		userData["runcmd"] = utils.Merge(userData["runcmd"], []interface{}{CommandScriptLocation})
 	}
 	writeFilesUpdater.updateUserData(userData)
 
@@ -134,6 +155,7 @@ func (g *CloudInitGenerator) generateNetworkConfiguration() ([]byte, error) {
 	var gateways []net.IP
 
 	// physical interfaces
+	nicNo := 0
 	for i, iface := range cniResult.Interfaces {
 		if iface.Sandbox == "" {
 			// skip host interfaces
@@ -141,9 +163,19 @@ func (g *CloudInitGenerator) generateNetworkConfiguration() ([]byte, error) {
 		}
 		subnets, curGateways := g.getSubnetsAndGatewaysForNthInterface(i, cniResult)
 		gateways = append(gateways, curGateways...)
+		if len(subnets) == 0 && g.config.ParsedAnnotations.L2Network != "" {
+			// in L2 mode, the addresses are assigned
+			// by the provider network
+			subnets = []map[string]interface{}{{"type": "dhcp"}}
+		}
+		name := iface.Name
+		if guestName := g.guestInterfaceName(nicNo); guestName != "" {
+			name = guestName
+		}
+		nicNo++
 		interfaceConf := map[string]interface{}{
 			"type":        "physical",
-			"name":        iface.Name,
+			"name":        name,
 			"mac_address": iface.Mac,
 			"subnets":     subnets,
 		}
@@ -151,8 +183,31 @@ func (g *CloudInitGenerator) generateNetworkConfiguration() ([]byte, error) {
 	}
 
 	// routes
+	for _, r := range routesWithGateways(cniResult.Routes, gateways) {
+		route := map[string]interface{}{
+			"type":        "route",
+			"destination": r.Dst.String(),
+			"gateway":     r.GW.String(),
+		}
+		config = append(config, route)
+	}
+
+	r, err := yaml.Marshal(map[string]interface{}{
+		"config": config,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte("version: 1\n" + string(r)), nil
+}
+
+// routesWithGateways returns the list of CNI routes with gateways
+// filled in. Routes with empty gateway use the first of the
+// gateways passed, and only the first default route is kept.
+func routesWithGateways(cniRoutes []*cnitypes.Route, gateways []net.IP) []cnitypes.Route {
+	var routes []cnitypes.Route
 	gotDefault := false
-	for _, cniRoute := range cniResult.Routes {
+	for _, cniRoute := range cniRoutes {
 		gw := cniRoute.GW
 		switch {
 		case gw != nil:
@@ -173,21 +228,131 @@ func (g *CloudInitGenerator) generateNetworkConfiguration() ([]byte, error) {
 			}
 			gotDefault = true
 		}
-		route := map[string]interface{}{
-			"type":        "route",
-			"destination": cniRoute.Dst.String(),
-			"gateway":     gw.String(),
+		routes = append(routes, cnitypes.Route{Dst: cniRoute.Dst, GW: gw})
+	}
+	return routes
+}
+
+// generateNetworkData generates the network configuration
+// in OpenStack network_data.json format for config drive
+func (g *CloudInitGenerator) generateNetworkData() ([]byte, error) {
+	cniResult, err := cni.BytesToResult([]byte(g.config.CNIConfig))
+	if err != nil {
+		return nil, err
+	}
+
+	links := []map[string]interface{}{}
+	networks := []map[string]interface{}{}
+	services := []map[string]interface{}{}
+	if cniResult == nil {
+		// This can only happen during integration tests
+		// where a dummy sandbox is used
+		return json.Marshal(map[string]interface{}{
+			"links":    links,
+			"networks": networks,
+			"services": services,
+		})
+	}
+
+	var gateways []net.IP
+	var networkAddrs []net.IPNet
+	nicNo := 0
+	for i, iface := range cniResult.Interfaces {
+		if iface.Sandbox == "" {
+			// skip host interfaces
+			continue
+		}
+		_, curGateways := g.getSubnetsAndGatewaysForNthInterface(i, cniResult)
+		gateways = append(gateways, curGateways...)
+		link := map[string]interface{}{
+			"id":                   iface.Name,
+			"type":                 "phy",
+			"ethernet_mac_address": iface.Mac,
+		}
+		// cloud-init renames the interface matching the
+		// MAC address if the link has a name
+		if guestName := g.guestInterfaceName(nicNo); guestName != "" {
+			link["name"] = guestName
+		}
+		nicNo++
+		links = append(links, link)
+		if g.config.ParsedAnnotations.L2Network != "" {
+			networks = append(networks, map[string]interface{}{
+				"id":     fmt.Sprintf("network%d", len(networks)),
+				"type":   "ipv4_dhcp",
+				"link":   iface.Name,
+				"routes": []map[string]interface{}{},
+			})
+		}
+		for _, ipConfig := range cniResult.IPs {
+			if ipConfig.Interface != i {
+				continue
+			}
+			networkType := "ipv6"
+			if ipConfig.Address.IP.To4() != nil {
+				networkType = "ipv4"
+			}
+			networks = append(networks, map[string]interface{}{
+				"id":         fmt.Sprintf("network%d", len(networks)),
+				"type":       networkType,
+				"link":       iface.Name,
+				"ip_address": ipConfig.Address.IP.String(),
+				"netmask":    net.IP(ipConfig.Address.Mask).String(),
+				"routes":     []map[string]interface{}{},
+			})
+			networkAddrs = append(networkAddrs, ipConfig.Address)
 		}
-		config = append(config, route)
 	}
 
-	r, err := yaml.Marshal(map[string]interface{}{
-		"config": config,
+	// Each route is attached to the network the gateway
+	// belongs to, or to the first network if there's no such one
+	for _, r := range routesWithGateways(cniResult.Routes, gateways) {
+		if len(networks) == 0 {
+			glog.Warning("cloud-init: got a route but no networks")
+			break
+		}
+		n := 0
+		for i, addr := range networkAddrs {
+			if addr.Contains(r.GW) {
+				n = i
+				break
+			}
+		}
+		networks[n]["routes"] = append(networks[n]["routes"].([]map[string]interface{}), map[string]interface{}{
+			"network": r.Dst.IP.String(),
+			"netmask": net.IP(r.Dst.Mask).String(),
+			"gateway": r.GW.String(),
+		})
+	}
+
+	for _, ns := range cniResult.DNS.Nameservers {
+		services = append(services, map[string]interface{}{
+			"type":    "dns",
+			"address": ns,
+		})
+	}
+
+	r, err := json.Marshal(map[string]interface{}{
+		"links":    links,
+		"networks": networks,
+		"services": services,
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error marshaling network_data.json: %v", err)
 	}
-	return []byte("version: 1\n" + string(r)), nil
+	return r, nil
+}
+
+// guestInterfaceName returns the guest interface name for
+// the VM's NIC with the specified index that's set using
+// VirtletGuestInterfaceNames annotation, or an empty string
+// if there's no such name
+func (g *CloudInitGenerator) guestInterfaceName(nicNo int) string {
+	names := g.config.ParsedAnnotations.GuestInterfaceNames
+	if nicNo >= len(names) {
+		return ""
+	}
+	return names[nicNo]
 }
 
 func (g *CloudInitGenerator) getSubnetsAndGatewaysForNthInterface(interfaceNo int, cniResult *cnicurrent.Result) ([]map[string]interface{}, []net.IP) {
@@ -251,23 +416,31 @@ func (g *CloudInitGenerator) GenerateImage(volumeMap diskPathMap) error {
 	}
 	defer os.RemoveAll(tmpDir)
 
-	var metaData, userData, networkConfiguration []byte
-	metaData, err = g.generateMetaData()
-	if err == nil {
-		userData, err = g.generateUserData(volumeMap)
+	userData, err := g.generateUserData(volumeMap)
+	if err != nil {
+		return err
 	}
-	if err == nil {
-		networkConfiguration, err = g.generateNetworkConfiguration()
+
+	var files map[string][]byte
+	var volumeId string
+	if g.config.ParsedAnnotations.CDImageType == CloudInitImageTypeConfigDrive {
+		files, err = g.configDriveFiles(userData)
+		volumeId = "config-2"
+	} else {
+		files, err = g.nocloudFiles(userData)
+		volumeId = "cidata"
 	}
 	if err != nil {
 		return err
 	}
+	for guestPath, content := range g.volumeFiles() {
+		files[path.Join(VolumeFilesIsoDir, guestPath)] = content
+	}
+	if files[PodInfoIsoPath], err = g.generatePodInfo(); err != nil {
+		return err
+	}
 
-	if err := utils.WriteFiles(tmpDir, map[string][]byte{
-		"user-data":      userData,
-		"meta-data":      metaData,
-		"network-config": networkConfiguration,
-	}); err != nil {
+	if err := utils.WriteFiles(tmpDir, files); err != nil {
 		return fmt.Errorf("can't write user-data: %v", err)
 	}
 
@@ -275,7 +448,7 @@ func (g *CloudInitGenerator) GenerateImage(volumeMap diskPathMap) error {
 		return fmt.Errorf("error making iso directory %q: %v", g.isoDir, err)
 	}
 
-	if err := utils.GenIsoImage(g.IsoPath(), "cidata", tmpDir); err != nil {
+	if err := utils.GenIsoImage(g.IsoPath(), volumeId, tmpDir); err != nil {
 		if rmErr := os.Remove(g.IsoPath()); rmErr != nil {
 			glog.Warningf("Error removing iso file %s: %v", g.IsoPath(), rmErr)
 		}
@@ -285,15 +458,176 @@ func (g *CloudInitGenerator) GenerateImage(volumeMap diskPathMap) error {
 	return nil
 }
 
+// nocloudFiles returns the contents of NoCloud image
+func (g *CloudInitGenerator) nocloudFiles(userData []byte) (map[string][]byte, error) {
+	metaData, err := g.generateMetaData()
+	if err != nil {
+		return nil, err
+	}
+	networkConfiguration, err := g.generateNetworkConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		"user-data":      userData,
+		"meta-data":      metaData,
+		"network-config": networkConfiguration,
+	}, nil
+}
+
+// generateConfigDriveMetaData generates meta_data.json
+// for OpenStack config drive. The guests such as cloudbase-init
+// expect the uuid to be an actual UUID, so the domain UUID is used
+func (g *CloudInitGenerator) generateConfigDriveMetaData() ([]byte, error) {
+	m := map[string]interface{}{
+		"uuid":     g.config.DomainUUID,
+		"hostname": g.config.PodName,
+		"name":     g.config.PodName,
+	}
+	if len(g.config.ParsedAnnotations.SSHKeys) != 0 {
+		keys := make(map[string]string)
+		for n, key := range g.config.ParsedAnnotations.SSHKeys {
+			keys[fmt.Sprintf("key%d", n)] = key
+		}
+		m["public_keys"] = keys
+	}
+	for k, v := range g.config.ParsedAnnotations.MetaData {
+		m[k] = v
+	}
+	r, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling meta_data.json: %v", err)
+	}
+	return r, nil
+}
+
+// configDriveFiles returns the contents of OpenStack config drive image
+func (g *CloudInitGenerator) configDriveFiles(userData []byte) (map[string][]byte, error) {
+	metaData, err := g.generateConfigDriveMetaData()
+	if err != nil {
+		return nil, err
+	}
+	networkData, err := g.generateNetworkData()
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		"openstack/latest/user_data":         userData,
+		"openstack/latest/meta_data.json":    metaData,
+		"openstack/latest/network_data.json": networkData,
+	}, nil
+}
+
+// volumeFiles returns the contents of Secret, ConfigMap and
+// Downward API volumes mounted into the VM keyed by their paths
+// inside the VM
+func (g *CloudInitGenerator) volumeFiles() map[string][]byte {
+	u := newWriteFilesUpdater(g.config.Mounts)
+	u.addSecrets()
+	u.addConfigMapEntries()
+	u.addDownwardAPIEntries()
+	return u.files
+}
+
+// podInfo describes the pod of the VM, providing the information
+// that's available to the containers via Downward API
+type podInfo struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Uid         string            `json:"uid"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	Limits      podInfoLimits     `json:"limits"`
+}
+
+type podInfoLimits struct {
+	// MemoryBytes is the memory limit in bytes, 0 if not set
+	MemoryBytes int64 `json:"memoryBytes"`
+	// MilliCPU is the CPU limit in millicores, 0 if not set
+	MilliCPU int64 `json:"milliCPU"`
+}
+
+func (g *CloudInitGenerator) generatePodInfo() ([]byte, error) {
+	info := podInfo{
+		Name:        g.config.PodName,
+		Namespace:   g.config.PodNamespace,
+		Uid:         g.config.PodSandboxId,
+		Labels:      make(map[string]string),
+		Annotations: make(map[string]string),
+		Limits: podInfoLimits{
+			MemoryBytes: g.config.MemoryLimitInBytes,
+		},
+	}
+	for k, v := range g.config.PodLabels {
+		// skip the labels added by kubelet
+		if !strings.HasPrefix(k, "io.kubernetes.") {
+			info.Labels[k] = v
+		}
+	}
+	for k, v := range g.config.PodAnnotations {
+		info.Annotations[k] = v
+	}
+	if g.config.CpuPeriod > 0 && g.config.CpuQuota > 0 {
+		info.Limits.MilliCPU = g.config.CpuQuota * 1000 / g.config.CpuPeriod
+	}
+	r, err := json.Marshal(info)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling pod info: %v", err)
+	}
+	return r, nil
+}
+
+var envVarNameRx = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// envVars returns the environment variables of the container
+// skipping the ones with names that can't be used in the shell
+func (g *CloudInitGenerator) envVars() []*VMKeyValue {
+	var r []*VMKeyValue
+	for _, entry := range g.config.Environment {
+		if !envVarNameRx.MatchString(entry.Key) {
+			glog.Warningf("Skipping environment variable with invalid name %q", entry.Key)
+			continue
+		}
+		r = append(r, entry)
+	}
+	return r
+}
+
+// generateEnvVarsContent generates the environment file in
+// the format used by /etc/environment and systemd EnvironmentFile=.
+// The values that contain the characters that have special meaning
+// in these files are double-quoted.
 func (g *CloudInitGenerator) generateEnvVarsContent() string {
 	var buffer bytes.Buffer
-	for _, entry := range g.config.Environment {
-		buffer.WriteString(fmt.Sprintf("%s=%s\n", entry.Key, entry.Value))
+	for _, entry := range g.envVars() {
+		value := entry.Value
+		if strings.ContainsAny(value, " \t\n\"'\\$`#") {
+			value = `"` + envFileEscaper.Replace(value) + `"`
+		}
+		buffer.WriteString(fmt.Sprintf("%s=%s\n", entry.Key, value))
 	}
 
 	return buffer.String()
 }
 
+var envFileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+// generateProfileEnvScript generates a shell script that exports
+// the environment variables of the container
+func (g *CloudInitGenerator) generateProfileEnvScript() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("# generated by Virtlet from the container environment\n")
+	for _, entry := range g.envVars() {
+		buffer.WriteString(fmt.Sprintf("export %s=%s\n", entry.Key, shellQuote(entry.Value)))
+	}
+	return buffer.String()
+}
+
+// shellQuote quotes the string for POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func (g *CloudInitGenerator) generateMounts(volumeMap diskPathMap) ([]interface{}, string) {
 	var r []interface{}
 	var mountScriptLines []string
@@ -334,11 +668,15 @@ func (g *CloudInitGenerator) generateMounts(volumeMap diskPathMap) ([]interface{
 type writeFilesUpdater struct {
 	entries []interface{}
 	mounts  []*VMMount
+	// files holds the contents of the files added from
+	// the volumes keyed by their paths inside the VM
+	files map[string][]byte
 }
 
 func newWriteFilesUpdater(mounts []*VMMount) *writeFilesUpdater {
 	return &writeFilesUpdater{
 		mounts: mounts,
+		files:  make(map[string][]byte),
 	}
 }
 
@@ -383,6 +721,10 @@ func (u *writeFilesUpdater) addConfigMapEntries() {
 	u.addFilesForVolumeType("configmap")
 }
 
+func (u *writeFilesUpdater) addDownwardAPIEntries() {
+	u.addFilesForVolumeType("downward-api")
+}
+
 func (u *writeFilesUpdater) addFileLikeMounts() {
 	for _, mount := range u.filterMounts(func(path string) bool {
 		fi, err := os.Stat(path)
@@ -422,6 +764,14 @@ func (u *writeFilesUpdater) addEnvironmentFile(content string) {
 	u.putPlainText(EnvFileLocation, content, 0644)
 }
 
+func (u *writeFilesUpdater) addProfileEnvScript(content string) {
+	u.putPlainText(ProfileEnvFileLocation, content, 0644)
+}
+
+func (u *writeFilesUpdater) addCommandScript(content string) {
+	u.putPlainText(CommandScriptLocation, content, 0755)
+}
+
 func (u *writeFilesUpdater) addFilesForMount(mount *VMMount) []interface{} {
 	var writeFiles []interface{}
 
@@ -435,7 +785,9 @@ func (u *writeFilesUpdater) addFilesForMount(mount *VMMount) []interface{} {
 			return err
 		}
 		relativePath := fullPath[len(mount.HostPath)+1:]
-		u.putBase64(path.Join(mount.ContainerPath, relativePath), content, stat.Mode())
+		guestPath := path.Join(mount.ContainerPath, relativePath)
+		u.putBase64(guestPath, content, stat.Mode())
+		u.files[guestPath] = content
 		return nil
 	}
 
@@ -467,6 +819,15 @@ func scanDirectory(dirPath string, callback func(string) error) error {
 	for _, entry := range entries {
 		fullPath := path.Join(dirPath, entry.Name())
 
+		// kubelet updates Secret and ConfigMap volumes atomically
+		// using '..data' symlink to a timestamped '..<timestamp>'
+		// directory, with the visible files being symlinks
+		// pointing into '..data', so the entries starting with
+		// '..' must be skipped to avoid duplicate files
+		if strings.HasPrefix(entry.Name(), "..") {
+			continue
+		}
+
 		switch {
 		case entry.Mode().IsDir():
 			glog.V(3).Infof("Scanning directory: %s", entry.Name())
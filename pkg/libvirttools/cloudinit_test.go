@@ -200,6 +200,11 @@ func TestCloudInitGenerator(t *testing.T) {
 						"content":     "foo=bar\nbaz=abc\n",
 						"permissions": "0644",
 					},
+					map[string]interface{}{
+						"path":        "/etc/profile.d/virtlet-env.sh",
+						"content":     "# generated by Virtlet from the container environment\nexport foo='bar'\nexport baz='abc'\n",
+						"permissions": "0644",
+					},
 				},
 			},
 		},
@@ -248,6 +253,11 @@ func TestCloudInitGenerator(t *testing.T) {
 						"content":     "foo=bar\nbaz=abc\n",
 						"permissions": "0644",
 					},
+					map[string]interface{}{
+						"path":        "/etc/profile.d/virtlet-env.sh",
+						"content":     "# generated by Virtlet from the container environment\nexport foo='bar'\nexport baz='abc'\n",
+						"permissions": "0644",
+					},
 				},
 			},
 		},
@@ -615,23 +625,337 @@ func TestCloudInitGenerateImage(t *testing.T) {
 		"meta-data":      "{\"instance-id\":\"foo.default\",\"local-hostname\":\"foo\"}",
 		"network-config": "version: 1\n",
 		"user-data":      "#cloud-config\n",
+		"virtlet": map[string]interface{}{
+			"pod-info.json": "{\"name\":\"foo\",\"namespace\":\"default\",\"uid\":\"\",\"labels\":{},\"annotations\":{},\"limits\":{\"memoryBytes\":0,\"milliCPU\":0}}",
+		},
+	}) {
+		t.Errorf("Bad iso content:\n%s", spew.Sdump(m))
+	}
+}
+
+func TestCloudInitGenerateConfigDriveImage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "nocloud-")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	g := NewCloudInitGenerator(&VMConfig{
+		DomainUUID:   "f30ed8d2-4a02-4a5f-9bfd-5c6a3b3c1c44",
+		PodName:      "foo",
+		PodNamespace: "default",
+		ParsedAnnotations: &VirtletAnnotations{
+			CDImageType: CloudInitImageTypeConfigDrive,
+			SSHKeys:     []string{"key1"},
+		},
+	}, tmpDir)
+
+	if err := g.GenerateImage(nil); err != nil {
+		t.Fatalf("GenerateImage(): %v", err)
+	}
+
+	m, err := testutils.IsoToMap(g.IsoPath())
+	if err != nil {
+		t.Fatalf("IsoToMap(): %v", err)
+	}
+
+	if !reflect.DeepEqual(m, map[string]interface{}{
+		"openstack": map[string]interface{}{
+			"latest": map[string]interface{}{
+				"meta_data.json":    "{\"hostname\":\"foo\",\"name\":\"foo\",\"public_keys\":{\"key0\":\"key1\"},\"uuid\":\"f30ed8d2-4a02-4a5f-9bfd-5c6a3b3c1c44\"}",
+				"network_data.json": "{\"links\":[],\"networks\":[],\"services\":[]}",
+				"user_data":         "#cloud-config\n",
+			},
+		},
+		"virtlet": map[string]interface{}{
+			"pod-info.json": "{\"name\":\"foo\",\"namespace\":\"default\",\"uid\":\"\",\"labels\":{},\"annotations\":{},\"limits\":{\"memoryBytes\":0,\"milliCPU\":0}}",
+		},
 	}) {
 		t.Errorf("Bad iso content:\n%s", spew.Sdump(m))
 	}
 }
 
+func TestNetworkDataGeneration(t *testing.T) {
+	g := NewCloudInitGenerator(buildNetworkedPodConfig(&cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{
+				Name:    "cni0",
+				Mac:     "00:11:22:33:44:55",
+				Sandbox: "/var/run/netns/bae464f1-6ee7-4ee2-826e-33293a9de95e",
+			},
+			{
+				Name:    "ignoreme0",
+				Mac:     "00:12:34:56:78:9a",
+				Sandbox: "", // host interface
+			},
+			{
+				Name:    "cni1",
+				Mac:     "00:11:22:33:ab:cd",
+				Sandbox: "/var/run/netns/bae464f1-6ee7-4ee2-826e-33293a9de95e",
+			},
+		},
+		IPs: []*cnicurrent.IPConfig{
+			{
+				Version: "4",
+				Address: net.IPNet{
+					IP:   net.IPv4(1, 1, 1, 1),
+					Mask: net.CIDRMask(8, 32),
+				},
+				Gateway:   net.IPv4(1, 2, 3, 4),
+				Interface: 0,
+			},
+			{
+				Version: "4",
+				Address: net.IPNet{
+					IP:   net.IPv4(192, 168, 100, 42),
+					Mask: net.CIDRMask(24, 32),
+				},
+				Gateway:   net.IPv4(192, 168, 100, 1),
+				Interface: 2,
+			},
+		},
+		Routes: []*cnitypes.Route{
+			{
+				Dst: net.IPNet{
+					IP:   net.IPv4zero,
+					Mask: net.CIDRMask(0, 32),
+				},
+				GW: nil,
+			},
+			{
+				Dst: net.IPNet{
+					IP:   net.IPv4(10, 10, 0, 0),
+					Mask: net.CIDRMask(16, 32),
+				},
+				GW: net.IPv4(192, 168, 100, 1),
+			},
+		},
+		DNS: cnitypes.DNS{
+			Nameservers: []string{"1.2.3.4", "5.6.7.8"},
+		},
+	}), "/foobar")
+
+	networkDataBytes, err := g.generateNetworkData()
+	if err != nil {
+		t.Fatalf("generateNetworkData(): %v", err)
+	}
+	var networkData map[string]interface{}
+	if err := json.Unmarshal(networkDataBytes, &networkData); err != nil {
+		t.Fatalf("Can't unmarshal network_data.json: %v", err)
+	}
+	expectedNetworkData := map[string]interface{}{
+		"links": []interface{}{
+			map[string]interface{}{
+				"id":                   "cni0",
+				"type":                 "phy",
+				"ethernet_mac_address": "00:11:22:33:44:55",
+			},
+			map[string]interface{}{
+				"id":                   "cni1",
+				"type":                 "phy",
+				"ethernet_mac_address": "00:11:22:33:ab:cd",
+			},
+		},
+		"networks": []interface{}{
+			map[string]interface{}{
+				"id":         "network0",
+				"type":       "ipv4",
+				"link":       "cni0",
+				"ip_address": "1.1.1.1",
+				"netmask":    "255.0.0.0",
+				"routes": []interface{}{
+					map[string]interface{}{
+						"network": "0.0.0.0",
+						"netmask": "0.0.0.0",
+						"gateway": "1.2.3.4",
+					},
+				},
+			},
+			map[string]interface{}{
+				"id":         "network1",
+				"type":       "ipv4",
+				"link":       "cni1",
+				"ip_address": "192.168.100.42",
+				"netmask":    "255.255.255.0",
+				"routes": []interface{}{
+					map[string]interface{}{
+						"network": "10.10.0.0",
+						"netmask": "255.255.0.0",
+						"gateway": "192.168.100.1",
+					},
+				},
+			},
+		},
+		"services": []interface{}{
+			map[string]interface{}{
+				"type":    "dns",
+				"address": "1.2.3.4",
+			},
+			map[string]interface{}{
+				"type":    "dns",
+				"address": "5.6.7.8",
+			},
+		},
+	}
+	if !reflect.DeepEqual(expectedNetworkData, networkData) {
+		t.Errorf("Bad network_data.json:\n%s\nUnmarshaled:\n%s", networkDataBytes, spew.Sdump(networkData))
+	}
+}
+
+func TestGuestInterfaceNames(t *testing.T) {
+	config := buildNetworkedPodConfig(&cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{
+				Name:    "cni0",
+				Mac:     "00:11:22:33:44:55",
+				Sandbox: "/var/run/netns/bae464f1-6ee7-4ee2-826e-33293a9de95e",
+			},
+			{
+				Name:    "ignoreme0",
+				Mac:     "00:12:34:56:78:9a",
+				Sandbox: "", // host interface
+			},
+			{
+				Name:    "cni1",
+				Mac:     "00:11:22:33:ab:cd",
+				Sandbox: "/var/run/netns/bae464f1-6ee7-4ee2-826e-33293a9de95e",
+			},
+		},
+	})
+	config.ParsedAnnotations.GuestInterfaceNames = []string{"", "wan0"}
+	g := NewCloudInitGenerator(config, "/foobar")
+
+	networkDataBytes, err := g.generateNetworkData()
+	if err != nil {
+		t.Fatalf("generateNetworkData(): %v", err)
+	}
+	var networkData struct {
+		Links []map[string]interface{} `json:"links"`
+	}
+	if err := json.Unmarshal(networkDataBytes, &networkData); err != nil {
+		t.Fatalf("Can't unmarshal network_data.json: %v", err)
+	}
+	expectedLinks := []map[string]interface{}{
+		{
+			"id":                   "cni0",
+			"type":                 "phy",
+			"ethernet_mac_address": "00:11:22:33:44:55",
+		},
+		{
+			"id":                   "cni1",
+			"name":                 "wan0",
+			"type":                 "phy",
+			"ethernet_mac_address": "00:11:22:33:ab:cd",
+		},
+	}
+	if !reflect.DeepEqual(expectedLinks, networkData.Links) {
+		t.Errorf("Bad links in network_data.json:\n%s", networkDataBytes)
+	}
+
+	networkConfigBytes, err := g.generateNetworkConfiguration()
+	if err != nil {
+		t.Fatalf("generateNetworkConfiguration(): %v", err)
+	}
+	var networkConfig struct {
+		Config []map[string]interface{} `json:"config"`
+	}
+	if err := yaml.Unmarshal(networkConfigBytes, &networkConfig); err != nil {
+		t.Fatalf("Can't unmarshal network-config: %v", err)
+	}
+	var names []string
+	for _, item := range networkConfig.Config {
+		names = append(names, item["name"].(string))
+	}
+	if expectedNames := []string{"cni0", "wan0"}; !reflect.DeepEqual(expectedNames, names) {
+		t.Errorf("Bad interface names in network-config: %v instead of %v:\n%s", names, expectedNames, networkConfigBytes)
+	}
+}
+
+func TestL2NetworkConfiguration(t *testing.T) {
+	config := buildNetworkedPodConfig(&cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{
+				Name:    "vl2c0ffee123456",
+				Mac:     "00:11:22:33:44:55",
+				Sandbox: "/var/run/netns/bae464f1-6ee7-4ee2-826e-33293a9de95e",
+			},
+		},
+	})
+	config.ParsedAnnotations.L2Network = "br-provider:100"
+	g := NewCloudInitGenerator(config, "/foobar")
+
+	networkConfigBytes, err := g.generateNetworkConfiguration()
+	if err != nil {
+		t.Fatalf("generateNetworkConfiguration(): %v", err)
+	}
+	var networkConfig map[string]interface{}
+	if err := yaml.Unmarshal(networkConfigBytes, &networkConfig); err != nil {
+		t.Fatalf("Can't unmarshal network-config: %v", err)
+	}
+	expectedNetworkConfig := map[string]interface{}{
+		"version": float64(1),
+		"config": []interface{}{
+			map[string]interface{}{
+				"type":        "physical",
+				"name":        "vl2c0ffee123456",
+				"mac_address": "00:11:22:33:44:55",
+				"subnets": []interface{}{
+					map[string]interface{}{"type": "dhcp"},
+				},
+			},
+		},
+	}
+	if !reflect.DeepEqual(expectedNetworkConfig, networkConfig) {
+		t.Errorf("Bad network-config:\n%s", networkConfigBytes)
+	}
+
+	networkDataBytes, err := g.generateNetworkData()
+	if err != nil {
+		t.Fatalf("generateNetworkData(): %v", err)
+	}
+	var networkData struct {
+		Networks []map[string]interface{} `json:"networks"`
+	}
+	if err := json.Unmarshal(networkDataBytes, &networkData); err != nil {
+		t.Fatalf("Can't unmarshal network_data.json: %v", err)
+	}
+	expectedNetworks := []map[string]interface{}{
+		{
+			"id":     "network0",
+			"type":   "ipv4_dhcp",
+			"link":   "vl2c0ffee123456",
+			"routes": []interface{}{},
+		},
+	}
+	if !reflect.DeepEqual(expectedNetworks, networkData.Networks) {
+		t.Errorf("Bad networks in network_data.json:\n%s", networkDataBytes)
+	}
+}
+
 func TestEnvDataGeneration(t *testing.T) {
-	expected := "key=value\n"
 	g := NewCloudInitGenerator(&VMConfig{
 		Environment: []*VMKeyValue{
 			{Key: "key", Value: "value"},
+			{Key: "MSG", Value: `it's "$HOME"`},
+			{Key: "bad-name", Value: "foo"},
+			{Key: "EMPTY", Value: ""},
 		},
 	}, "")
 
+	expected := "key=value\nMSG=\"it's \\\"\\$HOME\\\"\"\nEMPTY=\n"
 	output := g.generateEnvVarsContent()
 	if output != expected {
 		t.Errorf("Bad environment data generated:\n%s\nExpected:\n%s", output, expected)
 	}
+
+	expected = "# generated by Virtlet from the container environment\n" +
+		"export key='value'\n" +
+		"export MSG='it'\\''s \"$HOME\"'\n" +
+		"export EMPTY=''\n"
+	output = g.generateProfileEnvScript()
+	if output != expected {
+		t.Errorf("Bad profile script generated:\n%s\nExpected:\n%s", output, expected)
+	}
 }
 
 func verifyWriteFiles(t *testing.T, u *writeFilesUpdater, expectedWriteFiles ...interface{}) {
@@ -697,6 +1021,131 @@ func TestAddingSecrets(t *testing.T) {
 	})
 }
 
+func TestAddingAtomicWriterVolume(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// reproduce the layout of ConfigMap volumes made by kubelet
+	location := filepath.Join(tmpDir, "volumes/kubernetes.io~configmap/test-volume")
+	dataDir := filepath.Join(location, "..2018_01_01_00_00_00.000000000")
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		t.Fatalf("MkdirAll(): %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, "file"), []byte("test content"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := os.Symlink(filepath.Base(dataDir), filepath.Join(location, "..data")); err != nil {
+		t.Fatalf("Symlink(): %v", err)
+	}
+	if err := os.Symlink("..data/file", filepath.Join(location, "file")); err != nil {
+		t.Fatalf("Symlink(): %v", err)
+	}
+
+	u := newWriteFilesUpdater([]*VMMount{
+		{ContainerPath: "/container", HostPath: location},
+	})
+	u.addConfigMapEntries()
+	verifyWriteFiles(t, u, map[string]interface{}{
+		"path":        "/container/file",
+		"content":     "dGVzdCBjb250ZW50",
+		"encoding":    "b64",
+		"permissions": "0644",
+	})
+	expectedFiles := map[string][]byte{"/container/file": []byte("test content")}
+	if !reflect.DeepEqual(u.files, expectedFiles) {
+		t.Errorf("Bad volume files:\n%s\nExpected:\n%s", spew.Sdump(u.files), spew.Sdump(expectedFiles))
+	}
+}
+
+func TestCloudInitGenerateImageWithVolumeFiles(t *testing.T) {
+	withFakeVolumeDir(t, "volumes/kubernetes.io~secret/test-volume", 0600, func(location string) {
+		tmpDir, err := ioutil.TempDir("", "nocloud-")
+		if err != nil {
+			t.Fatalf("Can't create temp dir: %v", err)
+		}
+		defer os.RemoveAll(tmpDir)
+
+		g := NewCloudInitGenerator(&VMConfig{
+			PodName:      "foo",
+			PodNamespace: "default",
+			ParsedAnnotations: &VirtletAnnotations{
+				UserDataScript: "#!/bin/sh\necho hello\n",
+			},
+			Mounts: []*VMMount{
+				{ContainerPath: "/etc/app", HostPath: location},
+			},
+		}, tmpDir)
+
+		if err := g.GenerateImage(nil); err != nil {
+			t.Fatalf("GenerateImage(): %v", err)
+		}
+
+		m, err := testutils.IsoToMap(g.IsoPath())
+		if err != nil {
+			t.Fatalf("IsoToMap(): %v", err)
+		}
+
+		if !reflect.DeepEqual(m, map[string]interface{}{
+			"meta-data":      "{\"instance-id\":\"foo.default\",\"local-hostname\":\"foo\"}",
+			"network-config": "version: 1\n",
+			"user-data":      "#!/bin/sh\necho hello\n",
+			"virtlet": map[string]interface{}{
+				"pod-info.json": "{\"name\":\"foo\",\"namespace\":\"default\",\"uid\":\"\",\"labels\":{},\"annotations\":{},\"limits\":{\"memoryBytes\":0,\"milliCPU\":0}}",
+				"files": map[string]interface{}{
+					"etc": map[string]interface{}{
+						"app": map[string]interface{}{
+							"file": "test content",
+						},
+					},
+				},
+			},
+		}) {
+			t.Errorf("Bad iso content:\n%s", spew.Sdump(m))
+		}
+	})
+}
+
+func TestAddingDownwardAPIVolume(t *testing.T) {
+	withFakeVolumeDir(t, "volumes/kubernetes.io~downward-api/podinfo", 0, func(location string) {
+		u := newWriteFilesUpdater([]*VMMount{
+			{ContainerPath: "/etc/podinfo", HostPath: location},
+		})
+		u.addDownwardAPIEntries()
+		verifyWriteFiles(t, u, map[string]interface{}{
+			"path":        "/etc/podinfo/file",
+			"content":     "dGVzdCBjb250ZW50",
+			"encoding":    "b64",
+			"permissions": "0644",
+		})
+	})
+}
+
+func TestPodInfoGeneration(t *testing.T) {
+	g := NewCloudInitGenerator(&VMConfig{
+		PodSandboxId:       "69eec606-0493-5825-73a4-c5e0c0236155",
+		PodName:            "foo",
+		PodNamespace:       "default",
+		PodAnnotations:     map[string]string{"kubernetes.io/target-runtime": "virtlet.cloud"},
+		PodLabels:          map[string]string{"app": "foo", "io.kubernetes.pod.name": "foo"},
+		MemoryLimitInBytes: 1073741824,
+		CpuPeriod:          100000,
+		CpuQuota:           150000,
+	}, "")
+	data, err := g.generatePodInfo()
+	if err != nil {
+		t.Fatalf("generatePodInfo(): %v", err)
+	}
+	expected := `{"name":"foo","namespace":"default","uid":"69eec606-0493-5825-73a4-c5e0c0236155",` +
+		`"labels":{"app":"foo"},"annotations":{"kubernetes.io/target-runtime":"virtlet.cloud"},` +
+		`"limits":{"memoryBytes":1073741824,"milliCPU":1500}}`
+	if string(data) != expected {
+		t.Errorf("Bad pod info:\n%s\nExpected:\n%s", data, expected)
+	}
+}
+
 func TestAddingConfigMap(t *testing.T) {
 	withFakeVolumeDir(t, "volumes/kubernetes.io~configmap/test-volume", 0, func(location string) {
 		u := newWriteFilesUpdater([]*VMMount{
@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	// CommandScriptLocation is the location of the script that
+	// runs the container command inside the VM
+	CommandScriptLocation = "/etc/cloud/virtlet-command.sh"
+	// CommandExitCodeAnnotationKeyName is the container status
+	// annotation that holds the exit code of the container
+	// command after it finishes
+	CommandExitCodeAnnotationKeyName = "VirtletCommandExitCode"
+
+	commandExitCodePath    = "/var/lib/virtlet/command-exit-code"
+	commandExitCodeAckPath = commandExitCodePath + ".ack"
+	// commandAckTimeout is the number of seconds the VM waits
+	// for Virtlet to pick up the exit code before powering off
+	commandAckTimeout = 120
+)
+
+// generateCommandScript generates a shell script that runs the
+// container command and stores its exit code so it can be picked
+// up by Virtlet via QEMU guest agent
+func (g *CloudInitGenerator) generateCommandScript() string {
+	var quoted []string
+	for _, arg := range g.config.Command {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "#!/bin/sh\n# generated by Virtlet from the container command and args\n")
+	fmt.Fprintf(&buf, "[ -f %s ] && . %s\n", ProfileEnvFileLocation, ProfileEnvFileLocation)
+	fmt.Fprintf(&buf, "mkdir -p %s\n", path.Dir(commandExitCodePath))
+	fmt.Fprintf(&buf, "rm -f %s %s\n", commandExitCodePath, commandExitCodeAckPath)
+	fmt.Fprintf(&buf, "%s\n", strings.Join(quoted, " "))
+	fmt.Fprintf(&buf, "echo $? >%s.tmp && mv %s.tmp %s\n", commandExitCodePath, commandExitCodePath, commandExitCodePath)
+	if g.config.ParsedAnnotations != nil && g.config.ParsedAnnotations.PowerOffOnCommandExit {
+		fmt.Fprintf(&buf, "i=0\nwhile [ $i -lt %d ] && [ ! -e %s ]; do sleep 1; i=$((i+1)); done\n", commandAckTimeout, commandExitCodeAckPath)
+		fmt.Fprintf(&buf, "poweroff\n")
+	}
+	return buf.String()
+}
+
+// updateCommandStatus checks whether the container command has
+// finished inside the running VM, storing its exit code in the
+// container metadata if it did
+func (v *VirtualizationTool) updateCommandStatus(domain virt.VirtDomain, containerId string, containerInfo *metadata.ContainerInfo) error {
+	var buf bytes.Buffer
+	if err := CopyFromGuest(domain, commandExitCodePath, &buf); err != nil {
+		// the command didn't finish yet or the guest agent
+		// isn't available
+		glog.V(4).Infof("Can't get command exit code for container %s: %v", containerId, err)
+		return nil
+	}
+	exitCode, err := strconv.ParseInt(strings.TrimSpace(buf.String()), 10, 32)
+	if err != nil {
+		return fmt.Errorf("bad command exit code %q in container %s", buf.String(), containerId)
+	}
+	finishedAt := v.clock.Now().UnixNano()
+	if err := v.metadataStore.Container(containerId).Save(
+		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			if c != nil {
+				c.CommandFinishedAt = finishedAt
+				c.CommandExitCode = int32(exitCode)
+			}
+			return c, nil
+		},
+	); err != nil {
+		return err
+	}
+	containerInfo.CommandFinishedAt = finishedAt
+	containerInfo.CommandExitCode = int32(exitCode)
+	glog.V(2).Infof("Command of container %s exited with code %d", containerId, exitCode)
+
+	// let the VM know that the exit code is received
+	if err := CopyToGuest(domain, commandExitCodeAckPath, strings.NewReader("")); err != nil {
+		glog.Warningf("Can't acknowledge the command exit code for container %s: %v", containerId, err)
+	}
+	return nil
+}
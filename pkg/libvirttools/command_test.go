@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestCommandScriptGeneration(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		poweroff bool
+		expected string
+	}{
+		{
+			name: "plain command",
+			expected: "#!/bin/sh\n# generated by Virtlet from the container command and args\n" +
+				"[ -f /etc/profile.d/virtlet-env.sh ] && . /etc/profile.d/virtlet-env.sh\n" +
+				"mkdir -p /var/lib/virtlet\n" +
+				"rm -f /var/lib/virtlet/command-exit-code /var/lib/virtlet/command-exit-code.ack\n" +
+				"'/bin/sh' '-c' 'echo '\\''hello'\\'''\n" +
+				"echo $? >/var/lib/virtlet/command-exit-code.tmp && mv /var/lib/virtlet/command-exit-code.tmp /var/lib/virtlet/command-exit-code\n",
+		},
+		{
+			name:     "poweroff on exit",
+			poweroff: true,
+			expected: "#!/bin/sh\n# generated by Virtlet from the container command and args\n" +
+				"[ -f /etc/profile.d/virtlet-env.sh ] && . /etc/profile.d/virtlet-env.sh\n" +
+				"mkdir -p /var/lib/virtlet\n" +
+				"rm -f /var/lib/virtlet/command-exit-code /var/lib/virtlet/command-exit-code.ack\n" +
+				"'/bin/sh' '-c' 'echo '\\''hello'\\'''\n" +
+				"echo $? >/var/lib/virtlet/command-exit-code.tmp && mv /var/lib/virtlet/command-exit-code.tmp /var/lib/virtlet/command-exit-code\n" +
+				"i=0\nwhile [ $i -lt 120 ] && [ ! -e /var/lib/virtlet/command-exit-code.ack ]; do sleep 1; i=$((i+1)); done\n" +
+				"poweroff\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewCloudInitGenerator(&VMConfig{
+				Command:           []string{"/bin/sh", "-c", "echo 'hello'"},
+				ParsedAnnotations: &VirtletAnnotations{PowerOffOnCommandExit: tc.poweroff},
+			}, "")
+			if script := g.generateCommandScript(); script != tc.expected {
+				t.Errorf("Bad command script:\n%s\nExpected:\n%s", script, tc.expected)
+			}
+		})
+	}
+}
+
+func TestCommandExitCode(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	vmConfig, err := GetVMConfig(&kubeapi.CreateContainerRequest{
+		PodSandboxId: sandbox.Metadata.Uid,
+		Config: &kubeapi.ContainerConfig{
+			Metadata: &kubeapi.ContainerMetadata{Name: fakeContainerName},
+			Image:    &kubeapi.ImageSpec{Image: fakeImageName},
+			Command:  []string{"/bin/false"},
+		},
+		SandboxConfig: sandbox,
+	}, "")
+	if err != nil {
+		t.Fatalf("GetVMConfig(): %v", err)
+	}
+	containerId, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+	if err != nil {
+		t.Fatalf("CreateContainer(): %v", err)
+	}
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerId)
+
+	status := ct.containerStatus(containerId)
+	if _, found := status.Annotations[CommandExitCodeAnnotationKeyName]; found {
+		t.Errorf("unexpected exit code annotation before the command has finished")
+	}
+
+	d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	domain := d.(*fake.FakeDomain)
+	domain.SetGuestFile(commandExitCodePath, []byte("1\n"))
+	ct.clock.Advance(1 * time.Second)
+
+	status = ct.containerStatus(containerId)
+	if status.Annotations[CommandExitCodeAnnotationKeyName] != "1" {
+		t.Errorf("bad exit code annotation: %q", status.Annotations[CommandExitCodeAnnotationKeyName])
+	}
+	if status.ExitCode != 0 {
+		t.Errorf("exit code reported for a running container: %d", status.ExitCode)
+	}
+	if _, found := domain.GuestFile(commandExitCodeAckPath); !found {
+		t.Errorf("the exit code was not acknowledged")
+	}
+
+	ct.stopContainer(containerId)
+	status = ct.containerStatus(containerId)
+	if status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+		t.Errorf("bad container state: %v", status.State)
+	}
+	if status.ExitCode != 1 || status.FinishedAt != ct.clock.Now().UnixNano() {
+		t.Errorf("bad exit code / finish time: %d / %d", status.ExitCode, status.FinishedAt)
+	}
+}
@@ -17,21 +17,92 @@ limitations under the License.
 package libvirttools
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
 	libvirt "github.com/libvirt/libvirt-go"
 )
 
+const (
+	libvirtUsernameEnvVar     = "VIRTLET_LIBVIRT_USERNAME"
+	libvirtPasswordFileEnvVar = "VIRTLET_LIBVIRT_PASSWORD_FILE"
+)
+
 type Connection struct {
 	*LibvirtDomainConnection
 	*LibvirtStorageConnection
 }
 
+// libvirtCredentials returns the username and the password for
+// libvirt connection specified via VIRTLET_LIBVIRT_USERNAME and
+// VIRTLET_LIBVIRT_PASSWORD_FILE environment variables. Missing
+// password file is ignored so the file can come from an optional
+// secret
+func libvirtCredentials() (string, string, error) {
+	username := os.Getenv(libvirtUsernameEnvVar)
+	passwordFile := os.Getenv(libvirtPasswordFileEnvVar)
+	if passwordFile == "" {
+		return username, "", nil
+	}
+	password, err := ioutil.ReadFile(passwordFile)
+	switch {
+	case os.IsNotExist(err):
+		return username, "", nil
+	case err != nil:
+		return "", "", fmt.Errorf("can't read libvirt password file: %v", err)
+	}
+	return username, strings.TrimRight(string(password), "\r\n"), nil
+}
+
+// NewConnection connects to libvirt using the specified URI, which
+// may refer to a remote libvirtd. If the credentials are specified
+// via VIRTLET_LIBVIRT_USERNAME and VIRTLET_LIBVIRT_PASSWORD_FILE,
+// they're used for authentication when libvirt asks for them
 func NewConnection(uri string) (*Connection, error) {
-	conn, err := libvirt.NewConnect(uri)
+	username, password, err := libvirtCredentials()
 	if err != nil {
 		return nil, err
 	}
+	var conn *libvirt.Connect
+	if username == "" && password == "" {
+		conn, err = libvirt.NewConnect(uri)
+	} else {
+		auth := &libvirt.ConnectAuth{
+			CredType: []libvirt.ConnectCredentialType{
+				libvirt.CRED_AUTHNAME, libvirt.CRED_PASSPHRASE,
+			},
+			Callback: func(creds []*libvirt.ConnectCredential) {
+				for _, cred := range creds {
+					switch cred.Type {
+					case libvirt.CRED_AUTHNAME:
+						cred.Result = username
+					case libvirt.CRED_PASSPHRASE:
+						cred.Result = password
+					default:
+						continue
+					}
+					cred.ResultLen = len(cred.Result)
+				}
+			},
+		}
+		conn, err = libvirt.NewConnectWithAuth(uri, auth, 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to libvirt at %q: %v", uri, err)
+	}
+	glog.V(1).Infof("Connected to libvirt at %q", uri)
 	return &Connection{
 		LibvirtDomainConnection:  newLibvirtDomainConnection(conn),
 		LibvirtStorageConnection: newLibvirtStorageConnection(conn),
 	}, nil
 }
+
+// LibVersion returns the version of libvirt in major * 1000000 +
+// minor * 1000 + release notation
+func (c *Connection) LibVersion() (uint32, error) {
+	defer timeLibvirtCall("virConnectGetLibVersion", "")()
+	return c.LibvirtDomainConnection.conn.GetLibVersion()
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/ociimage"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+// imageBootFileDir returns the directory that holds the kernels
+// and initrds found in the images converted from container images
+func imageBootFileDir() string {
+	return filepath.Join(bootFileDir, "images")
+}
+
+// imageBootFilePath returns the path of the kernel or initrd
+// file that was found in the container image
+func imageBootFilePath(volumeName, kind string) string {
+	return filepath.Join(imageBootFileDir(), volumeName+"-"+kind)
+}
+
+// containerImageToFile fetches the container image referenced by
+// oci:// URL, flattens its layers and makes a bootable disk image
+// out of the resulting root filesystem. It returns the path to a
+// temporary file with the disk image that must be removed by the
+// caller. The kernel and initrd found in the container image are
+// saved for the direct kernel boot of the VMs
+func (i *ImageTool) containerImageToFile(endpoint utils.Endpoint, arch, volumeName string) (string, error) {
+	ref, err := ociimage.ParseReference(endpoint.Url)
+	if err != nil {
+		return "", err
+	}
+	httpClient, err := utils.NewHTTPClient(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	rootfsDir, err := ioutil.TempDir("", "virtlet-rootfs-")
+	if err != nil {
+		return "", fmt.Errorf("error creating rootfs dir: %v", err)
+	}
+	defer os.RemoveAll(rootfsDir)
+	glog.V(1).Infof("Unpacking container image %s", ref)
+	if err := ociimage.NewClient(httpClient).Unpack(ref, arch, rootfsDir); err != nil {
+		return "", err
+	}
+
+	if err := saveImageBootFiles(rootfsDir, volumeName); err != nil {
+		return "", err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "virtlet-disk-")
+	if err != nil {
+		return "", fmt.Errorf("error creating temporary dir for the disk image: %v", err)
+	}
+	path := filepath.Join(tmpDir, "disk.qcow2")
+	glog.V(1).Infof("Making disk image for container image %s", ref)
+	if err := ociimage.MakeDisk(rootfsDir, path); err != nil {
+		os.RemoveAll(tmpDir)
+		removeImageBootFiles(volumeName)
+		return "", err
+	}
+	return path, nil
+}
+
+// removeContainerImageFile removes the temporary disk image made
+// by containerImageToFile
+func removeContainerImageFile(path string) {
+	if err := os.RemoveAll(filepath.Dir(path)); err != nil {
+		glog.Warningf("Error removing temporary disk image %q: %v", path, err)
+	}
+}
+
+// saveImageBootFiles saves the kernel and initrd found in the
+// unpacked container image. If there's no kernel, an empty
+// "nokernel" marker file is written instead, so that the VMs that
+// can't boot from such image can be rejected with a clear error
+func saveImageBootFiles(rootfsDir, volumeName string) error {
+	// remove the files from the previous version of the image
+	removeImageBootFiles(volumeName)
+	if err := os.MkdirAll(imageBootFileDir(), 0755); err != nil {
+		return fmt.Errorf("error creating %q: %v", imageBootFileDir(), err)
+	}
+	kernel, initrd := ociimage.FindKernel(rootfsDir)
+	if kernel == "" {
+		glog.V(1).Infof("No kernel found in the container image for volume %q", volumeName)
+		path := imageBootFilePath(volumeName, "nokernel")
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			return fmt.Errorf("error writing %q: %v", path, err)
+		}
+		return nil
+	}
+	if err := copyFile(kernel, imageBootFilePath(volumeName, "kernel")); err != nil {
+		return err
+	}
+	if initrd == "" {
+		return nil
+	}
+	if err := copyFile(initrd, imageBootFilePath(volumeName, "initrd")); err != nil {
+		removeImageBootFiles(volumeName)
+		return err
+	}
+	return nil
+}
+
+// imageBootFiles returns the paths of the kernel and initrd
+// that were found in the container image, or empty strings
+// if there are no such files
+func imageBootFiles(volumeName string) (kernel, initrd string) {
+	kernel = imageBootFilePath(volumeName, "kernel")
+	if _, err := os.Stat(kernel); err != nil {
+		return "", ""
+	}
+	initrd = imageBootFilePath(volumeName, "initrd")
+	if _, err := os.Stat(initrd); err != nil {
+		initrd = ""
+	}
+	return kernel, initrd
+}
+
+// imageLacksKernel returns true if the image was converted
+// from a container image that has no kernel
+func imageLacksKernel(volumeName string) bool {
+	_, err := os.Stat(imageBootFilePath(volumeName, "nokernel"))
+	return err == nil
+}
+
+func removeImageBootFiles(volumeName string) {
+	for _, kind := range []string{"kernel", "initrd", "nokernel"} {
+		path := imageBootFilePath(volumeName, kind)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("Error removing %s file %q: %v", kind, path, err)
+		}
+	}
+}
+
+func copyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error copying %q to %q: %v", from, to, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestImageKernelBoot(t *testing.T) {
+	bootDir, err := ioutil.TempDir("", "boot-files-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(bootDir)
+	oldBootFileDir := bootFileDir
+	SetBootFileDir(bootDir)
+	defer SetBootFileDir(oldBootFileDir)
+
+	const imageName = "example.com/container-image"
+	volumeName, err := ImageNameToVolumeName(imageName)
+	if err != nil {
+		t.Fatalf("ImageNameToVolumeName(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		name           string
+		files          []string
+		kernel         *BootFile
+		expectedKernel string
+		expectedInitrd string
+		expectedArgs   string
+		expectError    bool
+	}{
+		{
+			name:           "kernel and initrd",
+			files:          []string{"boot/vmlinuz-4.15.0", "boot/initrd.img-4.15.0"},
+			expectedKernel: imageBootFilePath(volumeName, "kernel"),
+			expectedInitrd: imageBootFilePath(volumeName, "initrd"),
+			expectedArgs:   "root=/dev/sda rw console=ttyS0",
+		},
+		{
+			name:           "kernel only",
+			files:          []string{"vmlinuz"},
+			expectedKernel: imageBootFilePath(volumeName, "kernel"),
+			expectedArgs:   "root=/dev/sda rw console=ttyS0",
+		},
+		{
+			name:        "no kernel",
+			files:       []string{"bin/sh"},
+			expectError: true,
+		},
+		{
+			name:           "no kernel in the image but kernel annotation",
+			files:          []string{"bin/sh"},
+			kernel:         &BootFile{Data: []byte("kernel")},
+			expectedKernel: bootFilePath("container-id", "kernel"),
+			expectedArgs:   "root=/dev/sda init=/bin/sh",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rootfsDir, err := ioutil.TempDir("", "rootfs-")
+			if err != nil {
+				t.Fatalf("TempDir(): %v", err)
+			}
+			defer os.RemoveAll(rootfsDir)
+			for _, name := range tc.files {
+				path := filepath.Join(rootfsDir, name)
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatalf("MkdirAll(): %v", err)
+				}
+				if err := ioutil.WriteFile(path, []byte(name), 0644); err != nil {
+					t.Fatalf("WriteFile(): %v", err)
+				}
+			}
+			if err := saveImageBootFiles(rootfsDir, volumeName); err != nil {
+				t.Fatalf("saveImageBootFiles(): %v", err)
+			}
+			defer removeImageBootFiles(volumeName)
+
+			config := &VMConfig{
+				Image:             imageName,
+				ParsedAnnotations: &VirtletAnnotations{Kernel: tc.kernel},
+			}
+			if tc.kernel != nil {
+				config.ParsedAnnotations.KernelArgs = "root=/dev/sda init=/bin/sh"
+			}
+			domainDef := &libvirtxml.Domain{OS: &libvirtxml.DomainOS{}}
+			err = (&VirtualizationTool{}).setupDirectBoot(domainDef, config, "container-id")
+			if tc.expectError {
+				if err == nil {
+					t.Errorf("setupDirectBoot() didn't fail for an image without kernel")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setupDirectBoot(): %v", err)
+			}
+			if domainDef.OS.Kernel != tc.expectedKernel || domainDef.OS.Initrd != tc.expectedInitrd || domainDef.OS.KernelArgs != tc.expectedArgs {
+				t.Errorf("bad direct boot settings: kernel %q, initrd %q, args %q", domainDef.OS.Kernel, domainDef.OS.Initrd, domainDef.OS.KernelArgs)
+			}
+		})
+	}
+}
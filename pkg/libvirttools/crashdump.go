@@ -0,0 +1,243 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const crashDumpSuffix = ".dump"
+
+// CrashDump describes a memory dump of a crashed VM
+type CrashDump struct {
+	// ContainerID is the id of the VM container
+	ContainerID string
+	// PodNamespace is the namespace of the pod
+	PodNamespace string
+	// PodName is the name of the pod
+	PodName string
+	// Path is the path of the dump file on the node, empty
+	// if the dump couldn't be made
+	Path string
+	// Size is the size of the dump file in bytes
+	Size int64
+	// Error describes why the dump couldn't be made
+	Error string
+}
+
+// CrashDumpNotifier is invoked for each crash of a VM that
+// has VirtletCrashDump annotation
+type CrashDumpNotifier func(dump *CrashDump)
+
+type crashDumpSettings struct {
+	dir       string
+	spoolSize int64
+	notify    CrashDumpNotifier
+}
+
+// SetCrashDumps enables memory dumps of the crashed VMs that have
+// VirtletCrashDump annotation. The dumps are written into dir, and
+// the oldest ones are removed so that the total size of the dumps
+// doesn't exceed spoolSize bytes. notify, if not nil, is called
+// for each crash. spoolSize of 0 disables the dumps.
+func (v *VirtualizationTool) SetCrashDumps(dir string, spoolSize int64, notify CrashDumpNotifier) {
+	v.crashDumps = crashDumpSettings{dir: dir, spoolSize: spoolSize, notify: notify}
+}
+
+func (v *VirtualizationTool) crashDumpsEnabled() bool {
+	return v.crashDumps.spoolSize > 0 && v.crashDumps.dir != ""
+}
+
+type spoolFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// makeRoomInSpool removes the oldest dumps from the spool directory
+// so that a new dump of the specified size fits in the spool
+func makeRoomInSpool(dir string, spoolSize, size int64) error {
+	if size > spoolSize {
+		return fmt.Errorf("dump size %d exceeds the spool size %d", size, spoolSize)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []spoolFile
+	var total int64
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || !strings.HasSuffix(fi.Name(), crashDumpSuffix) {
+			continue
+		}
+		files = append(files, spoolFile{filepath.Join(dir, fi.Name()), fi.Size(), fi.ModTime()})
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, f := range files {
+		if total+size <= spoolSize {
+			break
+		}
+		glog.V(1).Infof("Removing old crash dump %q", f.path)
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+		total -= f.size
+	}
+	return nil
+}
+
+func domainMemorySize(domain virt.VirtDomain) (int64, error) {
+	def, err := domain.Xml()
+	if err != nil {
+		return 0, err
+	}
+	if def.Memory == nil {
+		return 0, nil
+	}
+	return int64(def.Memory.Value) * memoryUnitMultipliers[def.Memory.Unit], nil
+}
+
+// collectCrashDump dumps the memory of the VM if it's crashed and
+// has VirtletCrashDump annotation, and then powers it off. It
+// returns true if the VM was crashed
+func (v *VirtualizationTool) collectCrashDump(containerId string, domain virt.VirtDomain) (bool, error) {
+	if !v.crashDumpsEnabled() {
+		return false, nil
+	}
+	v.crashDumpMux.Lock()
+	defer v.crashDumpMux.Unlock()
+
+	// the state is checked under the lock so that the
+	// VM isn't dumped twice by concurrent calls
+	state, err := domain.State()
+	if err != nil {
+		return false, fmt.Errorf("cannot get the state of domain %q: %v", containerId, err)
+	}
+	if state != virt.DOMAIN_CRASHED {
+		return false, nil
+	}
+	containerInfo, err := v.metadataStore.Container(containerId).Retrieve()
+	if err != nil || containerInfo == nil {
+		return true, err
+	}
+	sandboxInfo, err := v.metadataStore.PodSandbox(containerInfo.SandboxID).Retrieve()
+	if err != nil || sandboxInfo == nil || sandboxInfo.Metadata == nil {
+		return true, err
+	}
+	// the namespace is not passed to LoadAnnotations() so it
+	// doesn't try to fetch cloud-init data from k8s
+	ann, err := LoadAnnotations("", sandboxInfo.Annotations)
+	if err != nil {
+		return true, fmt.Errorf("bad annotations for container %q: %v", containerId, err)
+	}
+	if !ann.CrashDump {
+		return true, nil
+	}
+
+	dump := &CrashDump{
+		ContainerID:  containerId,
+		PodNamespace: sandboxInfo.Metadata.Namespace,
+		PodName:      sandboxInfo.Metadata.Name,
+	}
+	if err := v.dumpCrashedDomain(dump, domain); err != nil {
+		dump.Error = err.Error()
+		glog.Errorf("Failed to dump the memory of crashed VM %s/%s (container %s): %v", dump.PodNamespace, dump.PodName, containerId, err)
+	} else {
+		glog.Warningf("VM %s/%s (container %s) crashed, memory dump written to %q", dump.PodNamespace, dump.PodName, containerId, dump.Path)
+	}
+	if v.crashDumps.notify != nil {
+		v.crashDumps.notify(dump)
+	}
+	if err := v.destroyDomain(containerId, domain); err != nil {
+		return true, fmt.Errorf("failed to destroy crashed domain %q: %v", containerId, err)
+	}
+	return true, nil
+}
+
+func (v *VirtualizationTool) dumpCrashedDomain(dump *CrashDump, domain virt.VirtDomain) error {
+	size, err := domainMemorySize(domain)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(v.crashDumps.dir, 0700); err != nil {
+		return err
+	}
+	if err := makeRoomInSpool(v.crashDumps.dir, v.crashDumps.spoolSize, size); err != nil {
+		return err
+	}
+	path := filepath.Join(v.crashDumps.dir, fmt.Sprintf("%s_%s_%s%s",
+		dump.PodNamespace, dump.PodName, v.clock.Now().UTC().Format("20060102T150405Z"), crashDumpSuffix))
+	if err := domain.CoreDump(path); err != nil {
+		os.Remove(path)
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dump.Path, dump.Size = path, fi.Size()
+	return nil
+}
+
+// CollectCrashDumps dumps the memory of the crashed VMs that have
+// VirtletCrashDump annotation and powers them off, so they're
+// restarted by kubelet. It returns the list of errors encountered
+func (v *VirtualizationTool) CollectCrashDumps() []error {
+	ids, _, allErrors := v.retrieveListOfContainerIDs()
+	for _, id := range ids {
+		domain, err := v.domainConn.LookupDomainByUUIDString(id)
+		if err == virt.ErrDomainNotFound {
+			continue
+		}
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("cannot lookup domain %q: %v", id, err))
+			continue
+		}
+		if _, err := v.collectCrashDump(id, domain); err != nil {
+			allErrors = append(allErrors, err)
+		}
+	}
+	return allErrors
+}
+
+// RunCrashDumpCollector invokes CollectCrashDumps() periodically
+// with the specified interval until stopCh is closed
+func (v *VirtualizationTool) RunCrashDumpCollector(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		for _, err := range v.CollectCrashDumps() {
+			glog.Warningf("Crash dump collection: %v", err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestMakeRoomInSpool(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "crash-dumps-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mtime := time.Date(2018, 5, 15, 10, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a.dump", "b.dump", "c.dump", "notadump.txt"} {
+		path := filepath.Join(tmpDir, name)
+		if err := ioutil.WriteFile(path, make([]byte, 100), 0600); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("Chtimes(): %v", err)
+		}
+		mtime = mtime.Add(time.Minute)
+	}
+
+	if err := makeRoomInSpool(tmpDir, 1000, 1001); err == nil {
+		t.Errorf("makeRoomInSpool() didn't fail for a dump that's larger than the spool")
+	}
+	if err := makeRoomInSpool(tmpDir, 400, 250); err != nil {
+		t.Fatalf("makeRoomInSpool(): %v", err)
+	}
+
+	fis, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("ReadDir(): %v", err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	expectedNames := []string{"c.dump", "notadump.txt"}
+	if !reflect.DeepEqual(names, expectedNames) {
+		t.Errorf("bad files left in the spool: %v instead of %v", names, expectedNames)
+	}
+}
+
+func TestCrashDump(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+	dumpDir := filepath.Join(ct.tmpDir, "crash-dumps")
+	var dumps []*CrashDump
+	ct.virtTool.SetCrashDumps(dumpDir, 10*1024*1024*1024, func(dump *CrashDump) {
+		dumps = append(dumps, dump)
+	})
+
+	sandboxes := criapi.GetSandboxes(2)
+	sandboxes[0].Annotations[CrashDumpKeyName] = "true"
+	var containerIds []string
+	var domains []*fake.FakeDomain
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+		containerId := ct.createContainer(sandbox, nil)
+		ct.startContainer(containerId)
+		d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+		if err != nil {
+			t.Fatalf("LookupDomainByUUIDString(): %v", err)
+		}
+		containerIds = append(containerIds, containerId)
+		domains = append(domains, d.(*fake.FakeDomain))
+	}
+
+	for n, expectedOnCrash := range []string{"preserve", "restart"} {
+		def, err := domains[n].Xml()
+		if err != nil {
+			t.Fatalf("Xml(): %v", err)
+		}
+		if def.OnCrash != expectedOnCrash {
+			t.Errorf("bad on_crash for VM %d: %q instead of %q", n, def.OnCrash, expectedOnCrash)
+		}
+	}
+
+	if errs := ct.virtTool.CollectCrashDumps(); len(errs) != 0 {
+		t.Fatalf("CollectCrashDumps(): %v", errs)
+	}
+	if len(dumps) != 0 {
+		t.Fatalf("unexpected crash dumps for the running VMs: %#v", dumps)
+	}
+
+	for _, d := range domains {
+		d.Crash()
+	}
+	if errs := ct.virtTool.CollectCrashDumps(); len(errs) != 0 {
+		t.Fatalf("CollectCrashDumps(): %v", errs)
+	}
+	if len(dumps) != 1 {
+		t.Fatalf("expected exactly one crash dump, got %#v", dumps)
+	}
+	dump := dumps[0]
+	expectedPath := filepath.Join(dumpDir, "default_testName_0_20170530T201900Z.dump")
+	if dump.ContainerID != containerIds[0] || dump.PodNamespace != "default" || dump.PodName != "testName_0" || dump.Path != expectedPath || dump.Error != "" {
+		t.Errorf("bad crash dump: %#v", dump)
+	}
+	if fi, err := os.Stat(expectedPath); err != nil {
+		t.Errorf("crash dump file not found: %v", err)
+	} else if fi.Size() != dump.Size || dump.Size == 0 {
+		t.Errorf("bad crash dump size %d (file size %d)", dump.Size, fi.Size())
+	}
+
+	for n, expectedState := range []virt.DomainState{virt.DOMAIN_SHUTOFF, virt.DOMAIN_CRASHED} {
+		if state, err := domains[n].State(); err != nil {
+			t.Errorf("State(): %v", err)
+		} else if state != expectedState {
+			t.Errorf("bad state of VM %d after crash dump collection: %v instead of %v", n, state, expectedState)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+var bootFileDir = "/var/lib/virtlet/boot"
+
+// bootFilePath returns the path of the file that holds the kernel
+// or initrd taken from a ConfigMap or a Secret for the domain
+func bootFilePath(domainUUID, kind string) string {
+	return filepath.Join(bootFileDir, domainUUID+"-"+kind)
+}
+
+// setupDirectBoot sets up direct kernel boot for the domain
+// if it's requested using the pod annotations or if the image
+// was converted from a container image that contains a kernel
+func (v *VirtualizationTool) setupDirectBoot(domainDef *libvirtxml.Domain, config *VMConfig, domainUUID string) error {
+	ann := config.ParsedAnnotations
+	if ann == nil {
+		return nil
+	}
+	if ann.Kernel == nil {
+		return v.setupImageKernelBoot(domainDef, config)
+	}
+	if domainDef.OS == nil {
+		return fmt.Errorf("the domain definition has no <os> element")
+	}
+	kernelPath, err := v.bootFile(ann.Kernel, domainUUID, "kernel")
+	if err != nil {
+		return err
+	}
+	domainDef.OS.Kernel = kernelPath
+	if ann.Initrd != nil {
+		if domainDef.OS.Initrd, err = v.bootFile(ann.Initrd, domainUUID, "initrd"); err != nil {
+			return err
+		}
+	}
+	domainDef.OS.KernelArgs = ann.KernelArgs
+	return nil
+}
+
+// setupImageKernelBoot sets up direct kernel boot using the
+// kernel found in the container image the VM image was made of
+func (v *VirtualizationTool) setupImageKernelBoot(domainDef *libvirtxml.Domain, config *VMConfig) error {
+	volumeName, err := ImageNameToVolumeName(config.Image)
+	if err != nil {
+		return err
+	}
+	kernel, initrd := imageBootFiles(volumeName)
+	if kernel == "" {
+		if imageLacksKernel(volumeName) {
+			// the root filesystem of such image is placed
+			// directly on the disk, so it has no bootloader
+			return fmt.Errorf("image %q was made from a container image that has no kernel, so it can't boot unless the kernel is specified using %s annotation", config.Image, KernelKeyName)
+		}
+		if config.ParsedAnnotations.KernelArgs != "" {
+			glog.Warningf("Ignoring %s annotation for image %q that has no kernel", KernelArgsKeyName, config.Image)
+		}
+		return nil
+	}
+	if domainDef.OS == nil {
+		return fmt.Errorf("the domain definition has no <os> element")
+	}
+	domainDef.OS.Kernel = kernel
+	domainDef.OS.Initrd = initrd
+	domainDef.OS.KernelArgs = config.ParsedAnnotations.KernelArgs
+	if domainDef.OS.KernelArgs == "" {
+		// the filesystem is placed directly on the root disk
+		rootDev := "/dev/sda"
+		if config.ParsedAnnotations.DiskDriver == DiskDriverVirtio {
+			rootDev = "/dev/vda"
+		}
+		domainDef.OS.KernelArgs = "root=" + rootDev + " rw console=ttyS0"
+	}
+	return nil
+}
+
+// bootFile returns the path to the kernel or initrd file,
+// writing it to the disk if it comes from a ConfigMap or
+// a Secret
+func (v *VirtualizationTool) bootFile(f *BootFile, domainUUID, kind string) (string, error) {
+	if f.Image != "" {
+		// the image is expected to be pulled beforehand,
+		// e.g. using 'virtletctl prefetch'
+		vol, err := v.imageManager.GetImageVolume(f.Image)
+		if err != nil {
+			return "", fmt.Errorf("error looking up %s image %q (it must be pulled beforehand): %v", kind, f.Image, err)
+		}
+		return vol.Path()
+	}
+	if err := os.MkdirAll(bootFileDir, 0755); err != nil {
+		return "", fmt.Errorf("error creating %q: %v", bootFileDir, err)
+	}
+	path := bootFilePath(domainUUID, kind)
+	if err := ioutil.WriteFile(path, f.Data, 0644); err != nil {
+		return "", fmt.Errorf("error writing %s file %q: %v", kind, path, err)
+	}
+	return path, nil
+}
+
+// removeBootFiles removes the kernel and initrd files
+// written for the domain, if any
+func removeBootFiles(domainUUID string) {
+	for _, kind := range []string{"kernel", "initrd"} {
+		path := bootFilePath(domainUUID, kind)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("Error removing %s file %q: %v", kind, path, err)
+		}
+	}
+}
+
+// SetBootFileDir sets the directory for kernel and initrd files
+// taken from ConfigMaps and Secrets. It can be useful in tests
+func SetBootFileDir(dir string) {
+	bootFileDir = dir
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// VolumeUsage describes host storage usage of a VM volume
+type VolumeUsage struct {
+	// Pool is the name of the storage pool of the volume
+	Pool string `json:"pool"`
+	// Name is the name of the volume
+	Name string `json:"name"`
+	// Capacity is the size of the volume as seen by the VM
+	Capacity uint64 `json:"capacity"`
+	// Allocation is the amount of host storage used by the volume
+	Allocation uint64 `json:"allocation"`
+}
+
+// VolumeUsageReport describes host storage usage of VM volumes
+// across all of the volume pools
+type VolumeUsageReport struct {
+	Volumes         []VolumeUsage `json:"volumes"`
+	TotalCapacity   uint64        `json:"totalCapacity"`
+	TotalAllocation uint64        `json:"totalAllocation"`
+	// Savings is the amount of host storage saved thanks to
+	// thin provisioning, i.e. the sum of unallocated parts of
+	// the volumes
+	Savings uint64 `json:"savings"`
+}
+
+// VolumeUsage returns a report on host storage usage of VM
+// volumes, which shows how much space is saved by thin
+// provisioning and discarding the data freed inside the VMs
+func (v *VirtualizationTool) VolumeUsage() (*VolumeUsageReport, error) {
+	pools := map[string]virt.VirtStoragePool{v.volumePoolName: v.volumePool}
+	poolNames := []string{v.volumePoolName}
+	for name, pool := range v.extraVolumePools {
+		pools[name] = pool
+		poolNames = append(poolNames, name)
+	}
+	sort.Strings(poolNames)
+
+	report := &VolumeUsageReport{Volumes: []VolumeUsage{}}
+	for _, poolName := range poolNames {
+		volumes, err := pools[poolName].ListAllVolumes()
+		if err != nil {
+			return nil, fmt.Errorf("cannot list volumes in pool %q: %v", poolName, err)
+		}
+		for _, vol := range volumes {
+			capacity, err := vol.Size()
+			if err != nil {
+				return nil, fmt.Errorf("cannot get the size of volume %q: %v", vol.Name(), err)
+			}
+			allocation, err := vol.Allocation()
+			if err != nil {
+				return nil, fmt.Errorf("cannot get the allocation of volume %q: %v", vol.Name(), err)
+			}
+			report.Volumes = append(report.Volumes, VolumeUsage{
+				Pool:       poolName,
+				Name:       vol.Name(),
+				Capacity:   capacity,
+				Allocation: allocation,
+			})
+			report.TotalCapacity += capacity
+			report.TotalAllocation += allocation
+			// qcow2 metadata may make the allocation
+			// exceed the capacity of a volume
+			if allocation < capacity {
+				report.Savings += capacity - allocation
+			}
+		}
+	}
+	return report, nil
+}
+
+type guestFSTrimPathResult struct {
+	Path    string `json:"path"`
+	Trimmed uint64 `json:"trimmed"`
+	Error   string `json:"error"`
+}
+
+type guestFSTrimResult struct {
+	// older guest agent versions return an empty result
+	Paths []guestFSTrimPathResult `json:"paths"`
+}
+
+// TrimFilesystems asks the guest agents of the running VMs to
+// discard unused blocks of the mounted filesystems so the
+// corresponding space is freed in the qcow2 volumes. The VMs
+// that don't run the guest agent are skipped
+func (v *VirtualizationTool) TrimFilesystems() []error {
+	ids, _, allErrors := v.retrieveListOfContainerIDs()
+	for _, id := range ids {
+		domain, err := v.domainConn.LookupDomainByUUIDString(id)
+		if err == virt.ErrDomainNotFound {
+			continue
+		}
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("cannot lookup domain %q: %v", id, err))
+			continue
+		}
+		state, err := domain.State()
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("cannot get the state of domain %q: %v", id, err))
+			continue
+		}
+		if state != virt.DOMAIN_RUNNING {
+			continue
+		}
+		var result guestFSTrimResult
+		if err := guestAgentExecute(domain, "guest-fstrim", nil, &result); err != nil {
+			// the guest agent may be missing in the VM
+			// or may not be started yet
+			glog.V(2).Infof("Can't trim the filesystems of %q: %v", id, err)
+			continue
+		}
+		for _, p := range result.Paths {
+			if p.Error != "" {
+				glog.V(2).Infof("Error trimming %q in %q: %s", p.Path, id, p.Error)
+			} else {
+				glog.V(3).Infof("Trimmed %d bytes on %q in %q", p.Trimmed, p.Path, id)
+			}
+		}
+	}
+	return allErrors
+}
+
+// RunFSTrim invokes TrimFilesystems() periodically with the
+// specified interval until stopCh is closed
+func (v *VirtualizationTool) RunFSTrim(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		for _, err := range v.TrimFilesystems() {
+			glog.Warningf("Filesystem trim: %v", err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestVolumeUsage(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerId := ct.createContainer(sandbox, nil)
+
+	pool, err := ct.storageConn.LookupStoragePoolByName("volumes")
+	if err != nil {
+		t.Fatalf("LookupStoragePoolByName(): %v", err)
+	}
+	vol, err := pool.LookupVolumeByName("virtlet_root_" + containerId)
+	if err != nil {
+		t.Fatalf("LookupVolumeByName(): %v", err)
+	}
+	size, err := vol.Size()
+	if err != nil {
+		t.Fatalf("Size(): %v", err)
+	}
+	allocation := size / 4
+	vol.(*fake.FakeStorageVolume).SetAllocation(allocation)
+
+	report, err := ct.virtTool.VolumeUsage()
+	if err != nil {
+		t.Fatalf("VolumeUsage(): %v", err)
+	}
+	if len(report.Volumes) != 1 {
+		t.Fatalf("expected 1 volume in the report, got: %#v", report.Volumes)
+	}
+	expected := VolumeUsage{
+		Pool:       "volumes",
+		Name:       "virtlet_root_" + containerId,
+		Capacity:   size,
+		Allocation: allocation,
+	}
+	if report.Volumes[0] != expected {
+		t.Errorf("bad volume usage: %#v instead of %#v", report.Volumes[0], expected)
+	}
+	if report.TotalCapacity != size || report.TotalAllocation != allocation || report.Savings != size-allocation {
+		t.Errorf("bad totals in volume usage report: %#v", report)
+	}
+}
+
+func TestTrimFilesystems(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandboxes := criapi.GetSandboxes(2)
+	var containerIds []string
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+		containerIds = append(containerIds, ct.createContainer(sandbox, nil))
+	}
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerIds[0])
+
+	if errs := ct.virtTool.TrimFilesystems(); errs != nil {
+		t.Fatalf("TrimFilesystems(): %v", errs)
+	}
+
+	for n, containerId := range containerIds {
+		d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+		if err != nil {
+			t.Fatalf("LookupDomainByUUIDString(): %v", err)
+		}
+		expectedCount := 0
+		if n == 0 {
+			expectedCount = 1
+		}
+		if count := d.(*fake.FakeDomain).FSTrimCount(); count != expectedCount {
+			t.Errorf("bad fstrim count for container %d: %d instead of %d", n, count, expectedCount)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// domainRetryPolicyEnvVar specifies how domain shutdown, destroy
+// and undefine operations are retried upon failures
+const domainRetryPolicyEnvVar = "VIRTLET_DOMAIN_RETRY_POLICY"
+
+// domainRetryPolicy describes the retries of domain operations
+// that can fail transiently, e.g. while QEMU flushes the disks.
+// The interval between the attempts is doubled after each failed
+// attempt until it reaches maxInterval.
+type domainRetryPolicy struct {
+	attempts    int
+	interval    time.Duration
+	maxInterval time.Duration
+}
+
+var defaultDomainRetryPolicy = domainRetryPolicy{
+	attempts:    5,
+	interval:    500 * time.Millisecond,
+	maxInterval: 8 * time.Second,
+}
+
+// parseDomainRetryPolicy parses the domain retry policy in
+// name=value[,name=value...] format. The names are attempts,
+// interval and max-interval. The settings that aren't specified
+// are taken from the default policy
+func parseDomainRetryPolicy(s string) (domainRetryPolicy, error) {
+	p := defaultDomainRetryPolicy
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return p, fmt.Errorf("bad retry policy setting %q, must be name=value", item)
+		}
+		var err error
+		switch parts[0] {
+		case "attempts":
+			p.attempts, err = strconv.Atoi(parts[1])
+			if err == nil && p.attempts < 1 {
+				err = fmt.Errorf("must be positive")
+			}
+		case "interval":
+			p.interval, err = time.ParseDuration(parts[1])
+		case "max-interval":
+			p.maxInterval, err = time.ParseDuration(parts[1])
+		default:
+			return p, fmt.Errorf("unsupported retry policy setting %q", parts[0])
+		}
+		if err != nil {
+			return p, fmt.Errorf("bad value for retry policy setting %q: %q", parts[0], parts[1])
+		}
+	}
+	if p.maxInterval < p.interval {
+		p.maxInterval = p.interval
+	}
+	return p, nil
+}
+
+func domainRetryPolicyFromEnv() (domainRetryPolicy, error) {
+	p, err := parseDomainRetryPolicy(os.Getenv(domainRetryPolicyEnvVar))
+	if err != nil {
+		return p, fmt.Errorf("error parsing %s: %v", domainRetryPolicyEnvVar, err)
+	}
+	return p, nil
+}
+
+// retryDomainOp invokes op until it succeeds or the number of
+// attempts allowed by the retry policy is exhausted. Each failure
+// is logged. The returned error lists the errors of all attempts
+func (v *VirtualizationTool) retryDomainOp(containerId, opName string, op func() error) error {
+	var errs []string
+	interval := v.domainRetryPolicy.interval
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			if attempt > 1 {
+				glog.V(1).Infof("Domain %s for container %q succeeded on attempt %d", opName, containerId, attempt)
+			}
+			return nil
+		}
+		glog.Warningf("Domain %s for container %q failed (attempt %d of %d): %v", opName, containerId, attempt, v.domainRetryPolicy.attempts, err)
+		errs = append(errs, fmt.Sprintf("attempt %d: %v", attempt, err))
+		if attempt >= v.domainRetryPolicy.attempts {
+			return fmt.Errorf("domain %s failed after %d attempts: %s", opName, attempt, strings.Join(errs, "; "))
+		}
+		v.clock.Sleep(interval)
+		if interval *= 2; interval > v.domainRetryPolicy.maxInterval {
+			interval = v.domainRetryPolicy.maxInterval
+		}
+	}
+}
+
+// destroyDomain powers off the domain, retrying transient failures.
+// The domain that turns out to be shut off after a failed attempt
+// is considered destroyed
+func (v *VirtualizationTool) destroyDomain(containerId string, domain virt.VirtDomain) error {
+	return v.retryDomainOp(containerId, "destroy", func() error {
+		err := domain.Destroy()
+		if err != nil {
+			if state, stateErr := domain.State(); stateErr == nil && state == virt.DOMAIN_SHUTOFF {
+				return nil
+			}
+		}
+		return err
+	})
+}
+
+// undefineDomain removes the domain definition, retrying
+// transient failures
+func (v *VirtualizationTool) undefineDomain(containerId string, domain virt.VirtDomain) error {
+	return v.retryDomainOp(containerId, "undefine", domain.Undefine)
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+	"github.com/Mirantis/virtlet/tests/gm"
+)
+
+func TestParseDomainRetryPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		expected domainRetryPolicy
+		err      bool
+	}{
+		{
+			spec:     "",
+			expected: defaultDomainRetryPolicy,
+		},
+		{
+			spec: "attempts=3, interval=1s,max-interval=30s",
+			expected: domainRetryPolicy{
+				attempts:    3,
+				interval:    time.Second,
+				maxInterval: 30 * time.Second,
+			},
+		},
+		{
+			spec: "interval=20s",
+			expected: domainRetryPolicy{
+				attempts:    defaultDomainRetryPolicy.attempts,
+				interval:    20 * time.Second,
+				maxInterval: 20 * time.Second,
+			},
+		},
+		{spec: "attempts=0", err: true},
+		{spec: "attempts", err: true},
+		{spec: "interval=forever", err: true},
+		{spec: "timeout=1s", err: true},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			p, err := parseDomainRetryPolicy(tc.spec)
+			switch {
+			case tc.err && err == nil:
+				t.Errorf("didn't get an error for a bad retry policy")
+			case !tc.err && err != nil:
+				t.Errorf("parseDomainRetryPolicy(): %v", err)
+			case !tc.err && !reflect.DeepEqual(p, tc.expected):
+				t.Errorf("bad retry policy: %#v instead of %#v", p, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDomainRemovalRetries(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+
+	containerId := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerId)
+
+	ct.domainConn.SetTransientErrors("Destroy", 2)
+	ct.domainConn.SetTransientErrors("Undefine", 1)
+	go func() {
+		ct.clock.BlockUntil(1)
+		ct.clock.Advance(500 * time.Millisecond)
+		ct.clock.BlockUntil(1)
+		ct.clock.Advance(time.Second)
+		ct.clock.BlockUntil(1)
+		ct.clock.Advance(500 * time.Millisecond)
+	}()
+
+	ct.rec.Rec("invoking RemoveContainer()", nil)
+	ct.removeContainer(containerId)
+	if len(ct.listContainers(nil)) != 0 {
+		t.Errorf("the container is not removed")
+	}
+	gm.Verify(t, ct.rec.Content())
+}
+
+func TestDomainRemovalRetriesExhausted(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.domainRetryPolicy = domainRetryPolicy{
+		attempts:    2,
+		interval:    time.Second,
+		maxInterval: time.Second,
+	}
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+
+	containerId := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerId)
+
+	ct.domainConn.SetTransientErrors("Destroy", 3)
+	go func() {
+		ct.clock.BlockUntil(1)
+		ct.clock.Advance(time.Second)
+	}()
+
+	if err := ct.virtTool.RemoveContainer(containerId); err == nil {
+		t.Errorf("RemoveContainer() didn't fail after the retries were exhausted")
+	}
+}
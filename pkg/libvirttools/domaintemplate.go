@@ -0,0 +1,262 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/template"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+const (
+	// domainTemplateEnvVar specifies the path to the file with
+	// the template used instead of the default one
+	domainTemplateEnvVar = "VIRTLET_DOMAIN_TEMPLATE"
+	vmWrapperPath        = "/vmwrapper"
+)
+
+// defaultDomainTemplate is used to generate the domains unless
+// VIRTLET_DOMAIN_TEMPLATE is set. The disks and the serial devices
+// are added to the domain after the template is rendered.
+//
+// Free page reporting is enabled for the balloon device by passing
+// -global virtio-balloon-pci.free-page-reporting=on to QEMU via
+// <qemu:commandline>, as <memballoon> attributes are not preserved
+// by libvirt-go-xml.
+//
+// pvpanic device is added the same way for the pods that have
+// VirtletCrashDump annotation as libvirt-go-xml doesn't support
+// <panic> element. QEMU reports guest panics to libvirt regardless
+// of that, and on_crash=preserve keeps the crashed VM around until
+// its memory is dumped.
+//
+// Nested virtualization is enabled for the pods that have
+// VirtletNestedVirtualization annotation by adding the following to
+// the domain, which requires kvm_intel or kvm_amd module to be
+// loaded like this: modprobe kvm_intel nested=1
+//
+//	<cpu mode="host-model">
+//	  <model fallback="forbid"/>
+//	  <feature policy="require" name="vmx"/>
+//	</cpu>
+//
+// Note that <memoryBacking><locked/></memoryBacking> causes
+// "qemu: qemu_thread_create: Resource temporarily unavailable"
+// QEMU errors when Virtlet is run as a non-privileged user.
+// Under strace, it looks like a bunch of mmap()s failing with EAGAIN
+// which happens due to mlockall() call somewhere above that.
+// This could be worked around using setrlimit() but really
+// swap handling is not needed here because it's incorrect
+// to have swap enabled on the nodes of a real Kubernetes cluster.
+const defaultDomainTemplate = `<domain type="{{.Type}}" xmlns:qemu="http://libvirt.org/schemas/domain/qemu/1.0">
+  <name>{{xml .Name}}</name>
+  <uuid>{{.UUID}}</uuid>
+  <memory unit="{{.MemoryUnit}}">{{.Memory}}</memory>
+  {{- if .MaxVCPUCount}}
+  <vcpu current="{{.VCPUCount}}">{{.MaxVCPUCount}}</vcpu>
+  {{- else}}
+  <vcpu>{{.VCPUCount}}</vcpu>
+  {{- end}}
+  <cputune>
+    <shares>{{.CPUShares}}</shares>
+    <period>{{.CPUPeriod}}</period>
+    <quota>{{.CPUQuota}}</quota>
+  </cputune>
+  <os>
+    <type{{if .Arch}} arch="{{.Arch}}"{{end}}{{if .MachineType}} machine="{{xml .MachineType}}"{{end}}>hvm</type>
+    <boot dev="hd"/>
+  </os>
+  <features>
+    <acpi/>
+  </features>
+  {{- if .NestedVirtFeature}}
+  <cpu mode="host-model">
+    <model fallback="forbid"/>
+    <feature policy="require" name="{{.NestedVirtFeature}}"/>
+  </cpu>
+  {{- end}}
+  <on_poweroff>destroy</on_poweroff>
+  <on_reboot>restart</on_reboot>
+  <on_crash>{{if .CrashDump}}preserve{{else}}restart{{end}}</on_crash>
+  <devices>
+    <emulator>{{.Emulator}}</emulator>
+    <controller type="scsi" index="0" model="virtio-scsi"/>
+    <input type="tablet" bus="usb"/>
+    <graphics type="vnc" port="-1"/>
+    <video>
+      <model type="cirrus"/>
+    </video>
+    <channel type="unix">
+      <source mode="bind" path="{{.GuestAgentSocketPath}}"/>
+      <target type="virtio" name="{{.GuestAgentChannelName}}"/>
+    </channel>
+  </devices>
+  <qemu:commandline>
+  {{- if .FreePageReporting}}
+    <qemu:arg value="-global"/>
+    <qemu:arg value="virtio-balloon-pci.free-page-reporting=on"/>
+  {{- end}}
+  {{- if .CrashDump}}
+    <qemu:arg value="-device"/>
+    <qemu:arg value="pvpanic"/>
+  {{- end}}
+  {{- range .Env}}
+    <qemu:env name="{{.Name}}" value="{{xml .Value}}"/>
+  {{- end}}
+  </qemu:commandline>
+</domain>
+`
+
+// DomainTemplateEnv denotes an environment variable for the
+// emulator process
+type DomainTemplateEnv struct {
+	Name  string
+	Value string
+}
+
+// DomainTemplateData is passed to the domain template. String
+// values that may contain characters that are special in XML
+// should be escaped using the 'xml' template function, e.g.
+// {{xml .PodName}}.
+type DomainTemplateData struct {
+	// Type is the domain type, either "kvm" or "qemu"
+	Type string
+	// Name is the name of the domain
+	Name string
+	// UUID is the UUID of the domain
+	UUID string
+	// Arch is the guest architecture, empty for the node's one
+	Arch string
+	// MachineType is the QEMU machine type, empty for the default one
+	MachineType string
+	// Memory is the amount of memory in MemoryUnit units
+	Memory int
+	// MemoryUnit is the unit of Memory
+	MemoryUnit string
+	// VCPUCount is the number of virtual CPUs
+	VCPUCount int
+	// MaxVCPUCount is the maximum number of virtual CPUs that
+	// can be hot-plugged, 0 if vCPU hotplug is not enabled
+	MaxVCPUCount int
+	// NestedVirtFeature is the CPU feature needed for nested
+	// virtualization ("vmx" or "svm"), empty if nested
+	// virtualization is not enabled for the VM
+	NestedVirtFeature string
+	// CrashDump specifies that the VM must have pvpanic device
+	// and be kept in the crashed state after a guest kernel
+	// panic so its memory can be dumped
+	CrashDump bool
+	// CPUShares is the value for <cputune><shares>
+	CPUShares uint
+	// CPUPeriod is the value for <cputune><period>
+	CPUPeriod uint64
+	// CPUQuota is the value for <cputune><quota>, which
+	// applies to each vCPU
+	CPUQuota int64
+	// Emulator is the path to vmwrapper which must be used
+	// as the emulator of the domain
+	Emulator string
+	// GuestAgentSocketPath is the path to the socket for
+	// QEMU guest agent channel
+	GuestAgentSocketPath string
+	// GuestAgentChannelName is the target name of QEMU guest
+	// agent channel
+	GuestAgentChannelName string
+	// FreePageReporting specifies that the balloon device must
+	// report the pages freed by the guest to the host
+	FreePageReporting bool
+	// Env lists the environment variables for vmwrapper which
+	// must be passed via <qemu:commandline>
+	Env []DomainTemplateEnv
+	// PodName is the name of the pod
+	PodName string
+	// PodNamespace is the namespace of the pod
+	PodNamespace string
+	// PodAnnotations contains the annotations of the pod
+	PodAnnotations map[string]string
+}
+
+func xmlEscape(s string) (string, error) {
+	var buf bytes.Buffer
+	if err := xml.EscapeText(&buf, []byte(s)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// parseDomainTemplate parses the text of the domain template
+func parseDomainTemplate(text string) (*template.Template, error) {
+	return template.New("domain").
+		Funcs(template.FuncMap{"xml": xmlEscape}).
+		Option("missingkey=zero").
+		Parse(text)
+}
+
+// loadDomainTemplate returns the domain template from the file
+// specified by VIRTLET_DOMAIN_TEMPLATE environment variable or the
+// default template if the variable is not set
+func loadDomainTemplate() (*template.Template, error) {
+	path := os.Getenv(domainTemplateEnvVar)
+	if path == "" {
+		return parseDomainTemplate(defaultDomainTemplate)
+	}
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading domain template: %v", err)
+	}
+	tmpl, err := parseDomainTemplate(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing domain template %q: %v", path, err)
+	}
+	return tmpl, nil
+}
+
+// renderDomainTemplate generates the domain definition using
+// the template
+func renderDomainTemplate(tmpl *template.Template, data *DomainTemplateData) (*libvirtxml.Domain, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("error executing domain template: %v", err)
+	}
+	var domain libvirtxml.Domain
+	if err := domain.Unmarshal(buf.String()); err != nil {
+		return nil, fmt.Errorf("error parsing the domain generated from the template: %v\n%s", err, buf.String())
+	}
+	if domain.Devices == nil {
+		domain.Devices = &libvirtxml.DomainDeviceList{}
+	}
+	if domain.Devices.Emulator != vmWrapperPath {
+		return nil, fmt.Errorf("the emulator of the domain generated from the template must be %q", vmWrapperPath)
+	}
+	envs := map[string]bool{}
+	if domain.QEMUCommandline != nil {
+		for _, env := range domain.QEMUCommandline.Envs {
+			envs[env.Name] = true
+		}
+	}
+	for _, env := range data.Env {
+		if !envs[env.Name] {
+			return nil, fmt.Errorf("the domain generated from the template lacks %s environment variable in <qemu:commandline>", env.Name)
+		}
+	}
+	return &domain, nil
+}
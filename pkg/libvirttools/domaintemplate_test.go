@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const customDomainTemplate = `<domain type="{{.Type}}" xmlns:qemu="http://libvirt.org/schemas/domain/qemu/1.0">
+  <name>{{xml .Name}}</name>
+  <uuid>{{.UUID}}</uuid>
+  <memory unit="{{.MemoryUnit}}">{{.Memory}}</memory>
+  <vcpu>{{.VCPUCount}}</vcpu>
+  <os>
+    <type>hvm</type>
+  </os>
+  <devices>
+    <emulator>{{.Emulator}}</emulator>
+    <video>
+      <model type="{{or (index .PodAnnotations "example.com/video") "vga"}}"/>
+    </video>
+  </devices>
+  <qemu:commandline>
+  {{- range .Env}}
+    <qemu:env name="{{.Name}}" value="{{xml .Value}}"/>
+  {{- end}}
+  </qemu:commandline>
+</domain>
+`
+
+func TestDomainTemplate(t *testing.T) {
+	data := &DomainTemplateData{
+		Type:       "kvm",
+		Name:       "virtlet-abb67e3c-71b3-container<1>",
+		UUID:       "abb67e3c-71b3-4ddd-5505-8c4215d5c4eb",
+		Memory:     1024,
+		MemoryUnit: "MiB",
+		VCPUCount:  2,
+		Emulator:   vmWrapperPath,
+		Env: []DomainTemplateEnv{
+			{Name: "VIRTLET_EMULATOR", Value: "/usr/bin/kvm"},
+			{Name: "VIRTLET_NET_KEY", Value: "a&b"},
+		},
+	}
+
+	tmpDir, err := ioutil.TempDir("", "domain-template-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	templatePath := filepath.Join(tmpDir, "domain.xml")
+	if err := ioutil.WriteFile(templatePath, []byte(customDomainTemplate), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	os.Setenv(domainTemplateEnvVar, templatePath)
+	defer os.Unsetenv(domainTemplateEnvVar)
+	tmpl, err := loadDomainTemplate()
+	if err != nil {
+		t.Fatalf("loadDomainTemplate(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		annotations map[string]string
+		video       string
+	}{
+		{
+			name:  "no annotations",
+			video: "vga",
+		},
+		{
+			name:        "annotation",
+			annotations: map[string]string{"example.com/video": "qxl"},
+			video:       "qxl",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data.PodAnnotations = tc.annotations
+			domain, err := renderDomainTemplate(tmpl, data)
+			if err != nil {
+				t.Fatalf("renderDomainTemplate(): %v", err)
+			}
+			if domain.Name != data.Name {
+				t.Errorf("bad domain name %q", domain.Name)
+			}
+			if domain.VCPU == nil || domain.VCPU.Value != 2 {
+				t.Errorf("bad vcpu: %#v", domain.VCPU)
+			}
+			if len(domain.Devices.Videos) != 1 || domain.Devices.Videos[0].Model.Type != tc.video {
+				t.Errorf("bad video devices: %#v", domain.Devices.Videos)
+			}
+			if len(domain.QEMUCommandline.Envs) != 2 || domain.QEMUCommandline.Envs[1].Value != "a&b" {
+				t.Errorf("bad emulator environment: %#v", domain.QEMUCommandline.Envs)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name, text string
+	}{
+		{
+			name: "bad emulator",
+			text: strings.Replace(customDomainTemplate, "{{.Emulator}}", "/usr/bin/kvm", 1),
+		},
+		{
+			name: "missing env",
+			text: strings.Replace(customDomainTemplate, `name="{{.Name}}"`, `name="FOO_{{.Name}}"`, 1),
+		},
+		{
+			name: "bad xml",
+			text: strings.Replace(customDomainTemplate, "</domain>", "", 1),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpl, err := parseDomainTemplate(tc.text)
+			if err != nil {
+				t.Fatalf("parseDomainTemplate(): %v", err)
+			}
+			if _, err := renderDomainTemplate(tmpl, data); err == nil {
+				t.Errorf("renderDomainTemplate() didn't fail")
+			}
+		})
+	}
+
+	if _, err := parseDomainTemplate("{{.Foo"); err == nil {
+		t.Errorf("parseDomainTemplate() didn't fail for bad template")
+	}
+}
+
+func TestDeployedDomainTemplate(t *testing.T) {
+	text, err := ioutil.ReadFile("../../deploy/domain-template.xml")
+	if err != nil {
+		t.Fatalf("ReadFile(): %v", err)
+	}
+	if string(text) != defaultDomainTemplate {
+		t.Errorf("deploy/domain-template.xml doesn't match the default domain template")
+	}
+}
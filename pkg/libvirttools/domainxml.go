@@ -0,0 +1,217 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"strconv"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	domainXMLDiffContext = 3
+	// vsockCIDPlaceholder is used in rendered domain definitions
+	// in place of vsock CIDs that are not allocated yet
+	vsockCIDPlaceholder = "(allocated upon VM creation)"
+)
+
+// DomainXMLReport contains domain definitions of a VM used for
+// debugging
+type DomainXMLReport struct {
+	// Defined is the definition of the domain as stored by libvirt
+	Defined string `json:"defined"`
+	// Rendered is the definition generated by Virtlet for the
+	// current pod annotations
+	Rendered string `json:"rendered"`
+	// Proposed is the definition generated by Virtlet for the
+	// pod annotations with the overrides applied
+	Proposed string `json:"proposed,omitempty"`
+	// Diff is the difference between Rendered and Proposed in
+	// unified diff format
+	Diff string `json:"diff,omitempty"`
+}
+
+var memoryUnitMultipliers = map[string]int64{
+	"":    1024, // libvirt default is KiB
+	"b":   1,
+	"k":   1024,
+	"KiB": 1024,
+	"M":   1024 * 1024,
+	"MiB": 1024 * 1024,
+	"G":   1024 * 1024 * 1024,
+	"GiB": 1024 * 1024 * 1024,
+}
+
+// restoreResourceLimits fills in the resource limits of the VM
+// config, which are not kept in the metadata store, based on the
+// domain definition and the memory overcommit ratio
+func restoreResourceLimits(config *VMConfig, def *libvirtxml.Domain, memoryOvercommitRatio float64) {
+	if def.Memory != nil {
+		memory := int64(def.Memory.Value) * memoryUnitMultipliers[def.Memory.Unit]
+		if memory != defaultMemory*memoryUnitMultipliers[defaultMemoryUnit] {
+			config.MemoryLimitInBytes = podMemoryLimit(memory, memoryOvercommitRatio)
+		}
+	}
+	if def.CPUTune != nil {
+		vcpuNum := int64(domainVCPUCount(def))
+		if def.CPUTune.Shares != nil {
+			config.CpuShares = int64(def.CPUTune.Shares.Value)
+		}
+		if def.CPUTune.Period != nil {
+			config.CpuPeriod = int64(def.CPUTune.Period.Value)
+		}
+		if def.CPUTune.Quota != nil {
+			config.CpuQuota = def.CPUTune.Quota.Value * vcpuNum
+		}
+	}
+}
+
+// domainVCPUCount returns the number of active vCPUs of the domain
+func domainVCPUCount(def *libvirtxml.Domain) int {
+	if def.VCPU == nil {
+		return 1
+	}
+	if def.VCPU.Current != "" {
+		if n, err := strconv.Atoi(def.VCPU.Current); err == nil && n > 0 {
+			return n
+		}
+	}
+	if def.VCPU.Value > 0 {
+		return def.VCPU.Value
+	}
+	return 1
+}
+
+func domainEnv(def *libvirtxml.Domain, name string) string {
+	if def.QEMUCommandline == nil {
+		return ""
+	}
+	for _, env := range def.QEMUCommandline.Envs {
+		if env.Name == name {
+			return env.Value
+		}
+	}
+	return ""
+}
+
+// renderDomain generates domain definition for the VM config
+// without defining the domain. The disks are taken from the
+// domain definition stored by libvirt as setting up the volumes
+// has side effects
+func (v *VirtualizationTool) renderDomain(config *VMConfig, defined *libvirtxml.Domain) (string, error) {
+	// the namespace is not passed to LoadAnnotations() so it doesn't
+	// try to fetch cloud-init data from k8s, as the domain definition
+	// doesn't depend on it
+	ann, err := LoadAnnotations("", config.PodAnnotations)
+	if err != nil {
+		return "", err
+	}
+	config.ParsedAnnotations = ann
+	settings, err := v.newDomainSettings(config, domainEnv(defined, netKeyEnvVar))
+	if err != nil {
+		return "", err
+	}
+	if settings.vsockCID, err = v.metadataStore.GetVsockCID(settings.domainUUID); err != nil {
+		return "", err
+	}
+	if !config.ParsedAnnotations.Vsock {
+		settings.vsockCID = 0
+	}
+	domainDef, err := settings.createDomain(config)
+	if err != nil {
+		return "", err
+	}
+	if config.ParsedAnnotations.Vsock && settings.vsockCID == 0 {
+		domainDef.QEMUCommandline.Envs = append(domainDef.QEMUCommandline.Envs,
+			libvirtxml.DomainQEMUCommandlineEnv{Name: vsockCIDEnvVar, Value: vsockCIDPlaceholder})
+	}
+	if defined.Devices != nil {
+		domainDef.Devices.Disks = defined.Devices.Disks
+	}
+	if err := v.addSerialDevicesToDomain(config.PodSandboxId, config.Name, config.Attempt, domainDef, *settings); err != nil {
+		return "", err
+	}
+	return domainDef.Marshal()
+}
+
+// DomainXML returns the definitions of the domain that corresponds
+// to the container. If annotationOverrides is not empty, the domain
+// definition is also rendered for the pod annotations updated
+// accordingly and compared to the one rendered for the current
+// annotations. Empty values in annotationOverrides mean removing
+// the corresponding annotations.
+func (v *VirtualizationTool) DomainXML(containerId string, annotationOverrides map[string]string) (*DomainXMLReport, error) {
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerId)
+	if err != nil {
+		return nil, fmt.Errorf("can't find the domain for container %q: %v", containerId, err)
+	}
+	defined, err := domain.Xml()
+	if err != nil {
+		return nil, err
+	}
+	definedXML, err := defined.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	containerInfo, err := v.metadataStore.Container(containerId).Retrieve()
+	if err != nil {
+		return nil, err
+	}
+	config, _, err := v.getVMConfigFromMetadata(containerId)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil || containerInfo == nil {
+		return nil, fmt.Errorf("container %q not found in the metadata store", containerId)
+	}
+	config.Attempt = containerInfo.Attempt
+	config.PodName = domainEnv(defined, "VIRTLET_POD_NAME")
+	config.PodNamespace = domainEnv(defined, "VIRTLET_POD_NAMESPACE")
+	restoreResourceLimits(config, defined, v.memoryOvercommitRatio)
+
+	renderConfig := *config
+	rendered, err := v.renderDomain(&renderConfig, defined)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering the domain for container %q: %v", containerId, err)
+	}
+	report := &DomainXMLReport{Defined: definedXML, Rendered: rendered}
+	if len(annotationOverrides) == 0 {
+		return report, nil
+	}
+
+	proposedConfig := renderConfig
+	proposedConfig.PodAnnotations = map[string]string{}
+	for k, value := range config.PodAnnotations {
+		proposedConfig.PodAnnotations[k] = value
+	}
+	for k, value := range annotationOverrides {
+		if value == "" {
+			delete(proposedConfig.PodAnnotations, k)
+		} else {
+			proposedConfig.PodAnnotations[k] = value
+		}
+	}
+	if report.Proposed, err = v.renderDomain(&proposedConfig, defined); err != nil {
+		return nil, fmt.Errorf("error rendering the domain for container %q with updated annotations: %v", containerId, err)
+	}
+	report.Diff = utils.DiffLines(report.Rendered, report.Proposed, domainXMLDiffContext)
+	return report, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"strings"
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestDomainXML(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+	sandbox := criapi.GetSandboxes(1)[0]
+	sandbox.Annotations = map[string]string{"VirtletVCPUCount": "2"}
+	ct.setPodSandbox(sandbox)
+	req := &kubeapi.CreateContainerRequest{
+		PodSandboxId: sandbox.Metadata.Uid,
+		Config: &kubeapi.ContainerConfig{
+			Metadata: &kubeapi.ContainerMetadata{
+				Name:    fakeContainerName,
+				Attempt: fakeContainerAttempt,
+			},
+			Image: &kubeapi.ImageSpec{
+				Image: fakeImageName,
+			},
+			Linux: &kubeapi.LinuxContainerConfig{
+				Resources: &kubeapi.LinuxContainerResources{
+					CpuQuota:           50000,
+					CpuPeriod:          100000,
+					CpuShares:          100,
+					MemoryLimitInBytes: 1234567,
+				},
+			},
+		},
+		SandboxConfig: sandbox,
+	}
+	vmConfig, err := GetVMConfig(req, "")
+	if err != nil {
+		t.Fatalf("GetVMConfig(): %v", err)
+	}
+	containerId, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+	if err != nil {
+		t.Fatalf("CreateContainer: %v", err)
+	}
+
+	report, err := ct.virtTool.DomainXML(containerId, nil)
+	if err != nil {
+		t.Fatalf("DomainXML(): %v", err)
+	}
+	if report.Defined == "" {
+		t.Errorf("defined domain XML is empty")
+	}
+	for _, s := range []string{
+		"<vcpu>2</vcpu>",
+		`<memory unit="b">1234567</memory>`,
+		"<quota>25000</quota>",
+		"<shares>100</shares>",
+		"/tmp/fakenetns",
+	} {
+		if !strings.Contains(report.Rendered, s) {
+			t.Errorf("rendered domain XML doesn't contain %q:\n%s", s, report.Rendered)
+		}
+	}
+	if report.Proposed != "" || report.Diff != "" {
+		t.Errorf("unexpected proposed domain XML / diff without annotation overrides")
+	}
+
+	report, err = ct.virtTool.DomainXML(containerId, map[string]string{
+		"VirtletVCPUCount": "",
+		"VirtletVsock":     "true",
+	})
+	if err != nil {
+		t.Fatalf("DomainXML(): %v", err)
+	}
+	for _, s := range []string{
+		"-  <vcpu>2</vcpu>",
+		"+  <vcpu>1</vcpu>",
+		"-    <quota>25000</quota>",
+		"+    <quota>50000</quota>",
+		vsockCIDEnvVar,
+		vsockCIDPlaceholder,
+	} {
+		if !strings.Contains(report.Diff, s) {
+			t.Errorf("domain XML diff doesn't contain %q:\n%s", s, report.Diff)
+		}
+	}
+
+	if _, err := ct.virtTool.DomainXML(containerId, map[string]string{"VirtletVCPUCount": "256"}); err == nil {
+		t.Errorf("DomainXML() didn't fail for invalid annotations")
+	}
+}
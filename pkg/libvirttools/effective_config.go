@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+)
+
+const (
+	// EffectiveConfigAnnotationKeyName is the name of container
+	// status annotation that reports the configuration the
+	// running VM actually got, in JSON format
+	EffectiveConfigAnnotationKeyName = "VirtletEffectiveConfig"
+
+	firmwareBIOS = "bios"
+	firmwareUEFI = "uefi"
+)
+
+// EffectiveConfig describes the configuration of a running VM
+// as it's seen by the guest. It may differ from the one requested
+// via pod annotations and resource limits, e.g. due to memory
+// overcommit or domain template customizations
+type EffectiveConfig struct {
+	// VCPUCount is the number of active vCPUs
+	VCPUCount int `json:"vcpuCount"`
+	// Memory is the amount of memory visible to the guest in bytes
+	Memory int64 `json:"memory,omitempty"`
+	// DiskBus is the bus used for the root disk,
+	// e.g. "scsi" or "virtio"
+	DiskBus string `json:"diskBus,omitempty"`
+	// Firmware is either "bios" or "uefi"
+	Firmware string `json:"firmware"`
+	// AccelerationMode is either "kvm" or "tcg"
+	AccelerationMode string `json:"accelerationMode"`
+	// MACAddresses lists the MAC addresses of the network
+	// interfaces of the VM
+	MACAddresses []string `json:"macAddresses,omitempty"`
+}
+
+// getEffectiveConfig returns the effective configuration of the VM
+// based on its domain definition and CNI result
+func getEffectiveConfig(def *libvirtxml.Domain, accelerationMode, cniConfig string) (*EffectiveConfig, error) {
+	ec := &EffectiveConfig{
+		VCPUCount:        domainVCPUCount(def),
+		Firmware:         firmwareBIOS,
+		AccelerationMode: accelerationMode,
+	}
+	if def.Memory != nil {
+		ec.Memory = int64(def.Memory.Value) * memoryUnitMultipliers[def.Memory.Unit]
+	}
+	if def.OS != nil && def.OS.Loader != nil && def.OS.Loader.Type == "pflash" {
+		ec.Firmware = firmwareUEFI
+	}
+	if def.Devices != nil {
+		for _, disk := range def.Devices.Disks {
+			if disk.Device == "disk" && disk.Target != nil {
+				ec.DiskBus = disk.Target.Bus
+				break
+			}
+		}
+	}
+
+	cniResult, err := cni.BytesToResult([]byte(cniConfig))
+	if err != nil {
+		return nil, err
+	}
+	if cniResult != nil {
+		for _, iface := range cniResult.Interfaces {
+			// host side interfaces don't belong to the VM
+			if iface.Sandbox != "" && iface.Mac != "" {
+				ec.MACAddresses = append(ec.MACAddresses, iface.Mac)
+			}
+		}
+	}
+	return ec, nil
+}
+
+// effectiveConfigAnnotation returns the value of the container
+// status annotation that describes the effective configuration
+// of the running VM
+func (v *VirtualizationTool) effectiveConfigAnnotation(def *libvirtxml.Domain, accelerationMode, sandboxID string) (string, error) {
+	cniConfig := ""
+	if sandboxID != "" {
+		sandbox, err := v.metadataStore.PodSandbox(sandboxID).Retrieve()
+		if err != nil {
+			return "", err
+		}
+		if sandbox != nil {
+			cniConfig = sandbox.CNIConfig
+		}
+	}
+	ec, err := getEffectiveConfig(def, accelerationMode, cniConfig)
+	if err != nil {
+		return "", err
+	}
+	bs, err := json.Marshal(ec)
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestGetEffectiveConfig(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		def       *libvirtxml.Domain
+		cniConfig string
+		expected  *EffectiveConfig
+	}{
+		{
+			name: "minimal domain",
+			def:  &libvirtxml.Domain{},
+			expected: &EffectiveConfig{
+				VCPUCount:        1,
+				Firmware:         "bios",
+				AccelerationMode: "kvm",
+			},
+		},
+		{
+			name: "full domain",
+			def: &libvirtxml.Domain{
+				Memory: &libvirtxml.DomainMemory{Value: 512, Unit: "MiB"},
+				VCPU:   &libvirtxml.DomainVCPU{Value: 4, Current: "2"},
+				OS: &libvirtxml.DomainOS{
+					Loader: &libvirtxml.DomainLoader{Path: "/usr/share/OVMF/OVMF_CODE.fd", Type: "pflash"},
+				},
+				Devices: &libvirtxml.DomainDeviceList{
+					Disks: []libvirtxml.DomainDisk{
+						{Device: "cdrom", Target: &libvirtxml.DomainDiskTarget{Dev: "hdc", Bus: "ide"}},
+						{Device: "disk", Target: &libvirtxml.DomainDiskTarget{Dev: "vda", Bus: "virtio"}},
+					},
+				},
+			},
+			cniConfig: `{
+				"cniVersion": "0.3.1",
+				"interfaces": [
+					{"name": "cni0", "mac": "0a:58:0a:f4:00:01"},
+					{"name": "eth0", "mac": "0a:58:0a:f4:00:02", "sandbox": "/var/run/netns/foo"},
+					{"name": "eth1", "mac": "0a:58:0a:f5:00:02", "sandbox": "/var/run/netns/foo"}
+				]
+			}`,
+			expected: &EffectiveConfig{
+				VCPUCount:        2,
+				Memory:           512 * 1024 * 1024,
+				DiskBus:          "virtio",
+				Firmware:         "uefi",
+				AccelerationMode: "kvm",
+				MACAddresses:     []string{"0a:58:0a:f4:00:02", "0a:58:0a:f5:00:02"},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ec, err := getEffectiveConfig(tc.def, "kvm", tc.cniConfig)
+			if err != nil {
+				t.Fatalf("getEffectiveConfig(): %v", err)
+			}
+			if !reflect.DeepEqual(ec, tc.expected) {
+				t.Errorf("bad effective config: got\n%#v\ninstead of\n%#v", ec, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// emulatorCPUSetEnvVar specifies the host CPUs the emulator threads
+// of the VMs are pinned to, e.g. "2-15". vhost threads are placed in
+// the emulator cgroup by the kernel, so they're pinned, too. This
+// makes it possible to keep the emulators away from the cores
+// reserved for kubelet and other node services
+const emulatorCPUSetEnvVar = "VIRTLET_EMULATOR_CPUSET"
+
+func emulatorCPUSet() (string, error) {
+	cpuSet := os.Getenv(emulatorCPUSetEnvVar)
+	if cpuSet == "" {
+		return "", nil
+	}
+	if _, err := parseCPUSet(cpuSet); err != nil {
+		return "", fmt.Errorf("bad %s value %q: %v", emulatorCPUSetEnvVar, cpuSet, err)
+	}
+	return cpuSet, nil
+}
+
+// parseCPUSet converts a cpuset in libvirt format, e.g. "0-15,^4",
+// to a CPU map with an item per each host CPU up to the last one
+// that's included in the set
+func parseCPUSet(cpuSet string) ([]bool, error) {
+	var cpuMap []bool
+	for _, item := range strings.Split(cpuSet, ",") {
+		exclude := strings.HasPrefix(item, "^")
+		if exclude {
+			item = item[1:]
+		}
+		parts := strings.SplitN(item, "-", 2)
+		var bounds [2]int
+		for n, part := range parts {
+			v, err := strconv.ParseUint(part, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("bad cpuset item %q", item)
+			}
+			bounds[n] = int(v)
+		}
+		if len(parts) == 1 {
+			bounds[1] = bounds[0]
+		}
+		if bounds[0] > bounds[1] {
+			return nil, fmt.Errorf("bad cpuset range %q", item)
+		}
+		for len(cpuMap) <= bounds[1] {
+			cpuMap = append(cpuMap, false)
+		}
+		for n := bounds[0]; n <= bounds[1]; n++ {
+			cpuMap[n] = !exclude
+		}
+	}
+	for len(cpuMap) > 0 && !cpuMap[len(cpuMap)-1] {
+		cpuMap = cpuMap[:len(cpuMap)-1]
+	}
+	if len(cpuMap) == 0 {
+		return nil, fmt.Errorf("cpuset %q is empty", cpuSet)
+	}
+	return cpuMap, nil
+}
+
+// pinEmulator pins the emulator threads of the domain to the host
+// CPUs specified by VIRTLET_EMULATOR_CPUSET, if any. This can't be
+// done using <emulatorpin> in the domain definition as libvirt-go-xml
+// doesn't support it yet
+func pinEmulator(domain virt.VirtDomain) error {
+	cpuSet, err := emulatorCPUSet()
+	if err != nil || cpuSet == "" {
+		return err
+	}
+	if err := domain.PinEmulator(cpuSet); err != nil {
+		return fmt.Errorf("error pinning the emulator to cpuset %q: %v", cpuSet, err)
+	}
+	return nil
+}
+
+// emulatorPriorityEnv returns the environment variables that make
+// vmwrapper apply the nice value, the I/O priority and the CPU
+// scheduling policy specified for the emulators to the emulator
+// process
+func emulatorPriorityEnv() ([]DomainTemplateEnv, error) {
+	var env []DomainTemplateEnv
+	values := make([]string, 3)
+	for n, name := range []string{utils.EmulatorNiceEnvVar, utils.EmulatorIOPrioEnvVar, utils.EmulatorSchedEnvVar} {
+		values[n] = os.Getenv(name)
+		if values[n] != "" {
+			env = append(env, DomainTemplateEnv{Name: name, Value: values[n]})
+		}
+	}
+	if _, err := utils.ParseEmulatorPriority(values[0], values[1], values[2]); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
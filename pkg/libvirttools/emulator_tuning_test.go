@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+func TestEmulatorCPUSet(t *testing.T) {
+	defer os.Unsetenv(emulatorCPUSetEnvVar)
+	for _, tc := range []struct {
+		cpuSet string
+		valid  bool
+	}{
+		{"", true},
+		{"2", true},
+		{"2-15", true},
+		{"0-3,8-11", true},
+		{"0-15,^4", true},
+		{"0-15,^4-5", true},
+		{"foo", false},
+		{"2-", false},
+		{"2,,3", false},
+		{"2-15 ", false},
+		{"-2", false},
+		{"2-15,", false},
+	} {
+		t.Run(tc.cpuSet, func(t *testing.T) {
+			os.Setenv(emulatorCPUSetEnvVar, tc.cpuSet)
+			cpuSet, err := emulatorCPUSet()
+			switch {
+			case !tc.valid && err == nil:
+				t.Errorf("emulatorCPUSet() didn't fail for %q", tc.cpuSet)
+			case tc.valid && err != nil:
+				t.Errorf("emulatorCPUSet(): %v", err)
+			case tc.valid && cpuSet != tc.cpuSet:
+				t.Errorf("bad cpuset %q instead of %q", cpuSet, tc.cpuSet)
+			}
+		})
+	}
+}
+
+func TestEmulatorPriorityEnv(t *testing.T) {
+	names := []string{utils.EmulatorNiceEnvVar, utils.EmulatorIOPrioEnvVar, utils.EmulatorSchedEnvVar}
+	defer func() {
+		for _, name := range names {
+			os.Unsetenv(name)
+		}
+	}()
+	for _, tc := range []struct {
+		name     string
+		values   []string
+		expected []DomainTemplateEnv
+		valid    bool
+	}{
+		{
+			name:   "no settings",
+			values: []string{"", "", ""},
+			valid:  true,
+		},
+		{
+			name:   "nice only",
+			values: []string{"5", "", ""},
+			expected: []DomainTemplateEnv{
+				{Name: utils.EmulatorNiceEnvVar, Value: "5"},
+			},
+			valid: true,
+		},
+		{
+			name:   "all settings",
+			values: []string{"-5", "best-effort:2", "fifo:10"},
+			expected: []DomainTemplateEnv{
+				{Name: utils.EmulatorNiceEnvVar, Value: "-5"},
+				{Name: utils.EmulatorIOPrioEnvVar, Value: "best-effort:2"},
+				{Name: utils.EmulatorSchedEnvVar, Value: "fifo:10"},
+			},
+			valid: true,
+		},
+		{
+			name:   "bad scheduling policy",
+			values: []string{"", "", "rr"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for n, name := range names {
+				os.Setenv(name, tc.values[n])
+			}
+			env, err := emulatorPriorityEnv()
+			switch {
+			case !tc.valid && err == nil:
+				t.Errorf("emulatorPriorityEnv() didn't fail")
+			case tc.valid && err != nil:
+				t.Errorf("emulatorPriorityEnv(): %v", err)
+			case !reflect.DeepEqual(env, tc.expected):
+				t.Errorf("bad env: %#v instead of %#v", env, tc.expected)
+			}
+		})
+	}
+}
+
+func TestParseCPUSet(t *testing.T) {
+	for _, tc := range []struct {
+		cpuSet string
+		cpuMap []bool
+	}{
+		{"0", []bool{true}},
+		{"2", []bool{false, false, true}},
+		{"1-3", []bool{false, true, true, true}},
+		{"0,2-3", []bool{true, false, true, true}},
+		{"0-4,^1-2", []bool{true, false, false, true, true}},
+		{"0-3,^3", []bool{true, true, true}},
+		{"^0", nil},
+		{"3-1", nil},
+		{"", nil},
+	} {
+		t.Run(tc.cpuSet, func(t *testing.T) {
+			cpuMap, err := parseCPUSet(tc.cpuSet)
+			switch {
+			case tc.cpuMap == nil && err == nil:
+				t.Errorf("parseCPUSet() didn't fail for %q", tc.cpuSet)
+			case tc.cpuMap != nil && err != nil:
+				t.Errorf("parseCPUSet(): %v", err)
+			case !reflect.DeepEqual(cpuMap, tc.cpuMap):
+				t.Errorf("bad cpu map %v instead of %v", cpuMap, tc.cpuMap)
+			}
+		})
+	}
+}
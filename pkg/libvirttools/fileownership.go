@@ -34,26 +34,36 @@ var emulatorUser struct {
 	uid, gid    int
 }
 
-// ChownForEmulator makes a file or directory owned by the emulator user.
-func ChownForEmulator(filePath string) error {
+// EmulatorUserIDs returns the uid and gid of the emulator user
+func EmulatorUserIDs() (int, int, error) {
 	emulatorUser.Lock()
 	defer emulatorUser.Unlock()
 	if !emulatorUser.initialized {
 		u, err := user.Lookup(emulatorUserName)
 		if err != nil {
-			return fmt.Errorf("can't find user %q: %v", emulatorUserName, err)
+			return 0, 0, fmt.Errorf("can't find user %q: %v", emulatorUserName, err)
 		}
 		emulatorUser.uid, err = strconv.Atoi(u.Uid)
 		if err != nil {
-			return fmt.Errorf("bad uid %q for user %q: %v", u.Uid, emulatorUserName, err)
+			return 0, 0, fmt.Errorf("bad uid %q for user %q: %v", u.Uid, emulatorUserName, err)
 		}
 		emulatorUser.gid, err = strconv.Atoi(u.Gid)
 		if err != nil {
-			return fmt.Errorf("bad gid %q for user %q: %v", u.Gid, emulatorUserName, err)
+			return 0, 0, fmt.Errorf("bad gid %q for user %q: %v", u.Gid, emulatorUserName, err)
 		}
+		emulatorUser.initialized = true
+	}
+	return emulatorUser.uid, emulatorUser.gid, nil
+}
+
+// ChownForEmulator makes a file or directory owned by the emulator user.
+func ChownForEmulator(filePath string) error {
+	uid, gid, err := EmulatorUserIDs()
+	if err != nil {
+		return err
 	}
-	if err := os.Chown(filePath, emulatorUser.uid, emulatorUser.gid); err != nil {
-		return fmt.Errorf("can't set the owner of tapmanager socket: %v", err)
+	if err := os.Chown(filePath, uid, gid); err != nil {
+		return fmt.Errorf("can't set the owner of %q: %v", filePath, err)
 	}
 	return nil
 }
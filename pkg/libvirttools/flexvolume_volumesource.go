@@ -29,6 +29,12 @@ import (
 const (
 	flexvolumeSubdir   = "volumes/virtlet~flexvolume_driver"
 	flexvolumeDataFile = "virtlet-flexvolume.json"
+	// csiSubdir is the directory where kubelet mounts CSI
+	// persistent volumes. It contains the volumes of all CSI
+	// drivers, and ones published by Virtlet CSI node plugin
+	// have flexvolume data files in their mount directories
+	csiSubdir      = "volumes/kubernetes.io~csi"
+	csiMountSubdir = "mount"
 )
 
 type FlexvolumeSource func(volumeName, configPath string, config *VMConfig, owner VolumeOwner) (VMVolume, error)
@@ -39,28 +45,76 @@ func AddFlexvolumeSource(fvType string, source FlexvolumeSource) {
 	flexvolumeTypeMap[fvType] = source
 }
 
-func ScanFlexvolumes(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
-	dir := filepath.Join(owner.KubeletRootDir(), config.PodSandboxId, flexvolumeSubdir)
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		glog.V(2).Infof("No flexvolumes to process for %q with uuid %q", config.Name, config.DomainUUID)
+type flexvolumeDataFileInfo struct {
+	volumeName   string
+	dataFilePath string
+}
+
+// listVolumeDirs returns the names of subdirectories of the specified
+// directory or nil if the directory doesn't exist
+func listVolumeDirs(dir string) ([]string, error) {
+	volDirItems, err := ioutil.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
 		return nil, nil
-	} else if err != nil {
+	case err != nil:
 		return nil, err
 	}
+	var names []string
+	for _, fi := range volDirItems {
+		if fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
 
-	glog.V(2).Info("Processing flexvolumes for flexvolume_driver")
-	volDirItems, err := ioutil.ReadDir(dir)
+// findFlexvolumeDataFiles returns the data files of Virtlet
+// flexvolumes and the volumes published by Virtlet CSI node plugin
+func findFlexvolumeDataFiles(podDir string) ([]flexvolumeDataFileInfo, error) {
+	dir := filepath.Join(podDir, flexvolumeSubdir)
+	names, err := listVolumeDirs(dir)
 	if err != nil {
 		return nil, err
 	}
+	var r []flexvolumeDataFileInfo
+	for _, name := range names {
+		r = append(r, flexvolumeDataFileInfo{name, filepath.Join(dir, name, flexvolumeDataFile)})
+	}
 
-	glog.V(2).Infof("Found flexvolumes definitions at %s:\n%#v", dir, volDirItems)
-	var vols []VMVolume
-	for _, fi := range volDirItems {
-		if !fi.IsDir() {
+	csiDir := filepath.Join(podDir, csiSubdir)
+	names, err = listVolumeDirs(csiDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		dataFilePath := filepath.Join(csiDir, name, csiMountSubdir, flexvolumeDataFile)
+		if _, err := os.Stat(dataFilePath); os.IsNotExist(err) {
+			// the volume doesn't belong to Virtlet
 			continue
+		} else if err != nil {
+			return nil, err
 		}
-		dataFilePath := filepath.Join(dir, fi.Name(), flexvolumeDataFile)
+		r = append(r, flexvolumeDataFileInfo{name, dataFilePath})
+	}
+	return r, nil
+}
+
+func ScanFlexvolumes(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
+	podDir := filepath.Join(owner.KubeletRootDir(), config.PodSandboxId)
+	dataFiles, err := findFlexvolumeDataFiles(podDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(dataFiles) == 0 {
+		glog.V(2).Infof("No flexvolumes to process for %q with uuid %q", config.Name, config.DomainUUID)
+		return nil, nil
+	}
+
+	glog.V(2).Infof("Found flexvolume definitions for %q:\n%#v", config.Name, dataFiles)
+	var vols []VMVolume
+	for _, df := range dataFiles {
+		dataFilePath := df.dataFilePath
 		content, err := ioutil.ReadFile(dataFilePath)
 		if err != nil {
 			return nil, fmt.Errorf("error reading flexvolume config %q: %v", dataFilePath, err)
@@ -77,7 +131,7 @@ func ScanFlexvolumes(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
 		if !found {
 			return nil, fmt.Errorf("bad flexvolume config %q: bad type %q", dataFilePath, fvType)
 		}
-		vol, err := fvSource(fi.Name(), dataFilePath, config, owner)
+		vol, err := fvSource(df.volumeName, dataFilePath, config, owner)
 		if err != nil {
 			return nil, err
 		}
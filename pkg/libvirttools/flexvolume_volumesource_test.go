@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFindFlexvolumeDataFiles(t *testing.T) {
+	podDir, err := ioutil.TempDir("", "pod-dir")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(podDir)
+
+	dataFiles, err := findFlexvolumeDataFiles(podDir)
+	if err != nil {
+		t.Fatalf("findFlexvolumeDataFiles(): %v", err)
+	}
+	if len(dataFiles) != 0 {
+		t.Errorf("unexpected data files in an empty pod dir: %#v", dataFiles)
+	}
+
+	for _, p := range []string{
+		filepath.Join(flexvolumeSubdir, "vol1", flexvolumeDataFile),
+		filepath.Join(csiSubdir, "pv1", csiMountSubdir, flexvolumeDataFile),
+		// a volume of another CSI driver
+		filepath.Join(csiSubdir, "pv2", csiMountSubdir, "foo.txt"),
+	} {
+		fullPath := filepath.Join(podDir, p)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0777); err != nil {
+			t.Fatalf("MkdirAll(): %v", err)
+		}
+		if err := ioutil.WriteFile(fullPath, []byte("{}"), 0666); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+	}
+
+	dataFiles, err = findFlexvolumeDataFiles(podDir)
+	if err != nil {
+		t.Fatalf("findFlexvolumeDataFiles(): %v", err)
+	}
+	expected := []flexvolumeDataFileInfo{
+		{"vol1", filepath.Join(podDir, flexvolumeSubdir, "vol1", flexvolumeDataFile)},
+		{"pv1", filepath.Join(podDir, csiSubdir, "pv1", csiMountSubdir, flexvolumeDataFile)},
+	}
+	if !reflect.DeepEqual(dataFiles, expected) {
+		t.Errorf("bad data file list: %#v instead of %#v", dataFiles, expected)
+	}
+}
@@ -21,6 +21,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/Mirantis/virtlet/pkg/instance"
+	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
 const (
@@ -38,11 +41,16 @@ func (v *VirtualizationTool) GarbageCollect() (allErrors []error) {
 	if fatal {
 		return
 	}
+	// standby VMs don't have metadata until they're claimed
+	ids = append(ids, v.standbyVMIDs()...)
+
+	allErrors = append(allErrors, v.removeOrphanInstallDisks()...)
 
 	allErrors = append(allErrors, v.removeOrphanDomains(ids)...)
 	allErrors = append(allErrors, v.removeOrphanRootVolumes(ids)...)
 	allErrors = append(allErrors, v.removeOrphanQcow2Volumes(ids)...)
 	allErrors = append(allErrors, v.removeOrphanNoCloudImages(ids, nocloudIsoDir)...)
+	allErrors = append(allErrors, v.removeOrphanBootFiles(ids)...)
 
 	return
 }
@@ -105,7 +113,12 @@ func (v *VirtualizationTool) removeOrphanDomains(ids []string) []error {
 		}
 
 		filter := func(id string) bool {
-			return strings.HasPrefix(name, "virtlet-"+id[:13])
+			return strings.HasPrefix(name, instance.ObjectPrefix()+id[:13])
+		}
+
+		// the domains of other Virtlet instances are left alone
+		if instance.IsVirtletObject(name) && !strings.HasPrefix(name, instance.ObjectPrefix()) {
+			continue
 		}
 
 		if !inList(ids, filter) {
@@ -140,13 +153,23 @@ func (v *VirtualizationTool) removeOrphanDomains(ids []string) []error {
 	return allErrors
 }
 
-func (v *VirtualizationTool) removeOrphanRootVolumes(ids []string) []error {
-	volumes, err := v.volumePool.ListAllVolumes()
-	if err != nil {
-		return []error{fmt.Errorf("cannot list libvirt volumes: %v", err)}
+// listVolumes returns the volumes from all of the volume pools
+func (v *VirtualizationTool) listVolumes() ([]virt.VirtStorageVolume, []error) {
+	var volumes []virt.VirtStorageVolume
+	var allErrors []error
+	for _, pool := range v.volumePools() {
+		poolVolumes, err := pool.ListAllVolumes()
+		if err != nil {
+			allErrors = append(allErrors, fmt.Errorf("cannot list libvirt volumes: %v", err))
+			continue
+		}
+		volumes = append(volumes, poolVolumes...)
 	}
+	return volumes, allErrors
+}
 
-	var allErrors []error
+func (v *VirtualizationTool) removeOrphanRootVolumes(ids []string) []error {
+	volumes, allErrors := v.listVolumes()
 	for _, volume := range volumes {
 		path, err := volume.Path()
 		if err != nil {
@@ -179,13 +202,48 @@ func (v *VirtualizationTool) removeOrphanRootVolumes(ids []string) []error {
 	return allErrors
 }
 
-func (v *VirtualizationTool) removeOrphanQcow2Volumes(ids []string) []error {
-	volumes, err := v.volumePool.ListAllVolumes()
+// removeOrphanInstallDisks removes the root volumes of the VMs
+// installed from ISO images that belong to the pod sandboxes
+// which don't exist anymore
+func (v *VirtualizationTool) removeOrphanInstallDisks() []error {
+	sandboxes, err := v.metadataStore.ListPodSandboxes(nil)
 	if err != nil {
-		return []error{fmt.Errorf("cannot list domains: %v", err)}
+		return []error{fmt.Errorf("cannot list pod sandboxes: %v", err)}
+	}
+	var ids []string
+	for _, sandbox := range sandboxes {
+		ids = append(ids, sandbox.GetID())
 	}
 
-	var allErrors []error
+	volumes, allErrors := v.listVolumes()
+	for _, volume := range volumes {
+		name := volume.Name()
+		if !strings.HasPrefix(name, installDiskPrefix) {
+			continue
+		}
+		filter := func(id string) bool {
+			return strings.HasPrefix(name, installDiskPrefix+id+"_")
+		}
+		if inList(ids, filter) {
+			continue
+		}
+		if err := volume.Remove(); err != nil {
+			allErrors = append(
+				allErrors,
+				fmt.Errorf("cannot remove volume %q: %v", name, err),
+			)
+			continue
+		}
+		if err := teardownVolumeEncryption(v, name); err != nil {
+			allErrors = append(allErrors, err)
+		}
+	}
+
+	return allErrors
+}
+
+func (v *VirtualizationTool) removeOrphanQcow2Volumes(ids []string) []error {
+	volumes, allErrors := v.listVolumes()
 	for _, volume := range volumes {
 		path, err := volume.Path()
 		if err != nil {
@@ -255,3 +313,31 @@ func (v *VirtualizationTool) removeOrphanNoCloudImages(ids []string, directory s
 
 	return allErrors
 }
+
+// removeOrphanBootFiles removes the kernel and initrd files
+// of the containers that don't exist anymore
+func (v *VirtualizationTool) removeOrphanBootFiles(ids []string) []error {
+	files, err := filepath.Glob(filepath.Join(bootFileDir, "*-*"))
+	if err != nil {
+		return []error{fmt.Errorf("error listing boot files in %q: %v", bootFileDir, err)}
+	}
+
+	var allErrors []error
+	for _, path := range files {
+		filename := filepath.Base(path)
+		filter := func(id string) bool {
+			return filename == id+"-kernel" || filename == id+"-initrd"
+		}
+		if inList(ids, filter) {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			allErrors = append(
+				allErrors,
+				fmt.Errorf("cannot remove boot file %q: %v", path, err),
+			)
+		}
+	}
+
+	return allErrors
+}
@@ -55,19 +55,27 @@ func TestDomainCleanup(t *testing.T) {
 		t.Fatalf("Cannot define new fake domain: %v", err)
 	}
 
-	if domains, _ := ct.domainConn.ListDomains(); len(domains) != 4 {
-		t.Errorf("Defined 4 domains in fake libvirt but ListDomains() returned %d of them", len(domains))
+	if _, err := ct.domainConn.DefineDomain(&libvirtxml.Domain{
+		Name: "virtlet_canary-" + "0d8a9ea2-7b1c-4d06-9f4e-6fa3c5e0b2a1"[:13] + "-container1",
+		UUID: "0d8a9ea2-7b1c-4d06-9f4e-6fa3c5e0b2a1",
+	}); err != nil {
+		t.Fatalf("Cannot define new fake domain: %v", err)
+	}
+
+	if domains, _ := ct.domainConn.ListDomains(); len(domains) != 5 {
+		t.Errorf("Defined 5 domains in fake libvirt but ListDomains() returned %d of them", len(domains))
 	}
 
 	// this should remove all domains (including other than virlet defined)
-	// with an exception of the last listed in randomUUIDs slice
+	// with an exception of the last listed in randomUUIDs slice and
+	// the domain that belongs to another Virtlet instance
 	errors := ct.virtTool.removeOrphanDomains(randomUUIDs[2:])
 	if errors != nil {
 		t.Errorf("removeOrphanDomains returned errors: %v", errors)
 	}
 
-	if domains, _ := ct.domainConn.ListDomains(); len(domains) != 1 {
-		t.Errorf("Expected a single remaining domain, ListDomains() returned %d of them", len(domains))
+	if domains, _ := ct.domainConn.ListDomains(); len(domains) != 2 {
+		t.Errorf("Expected two remaining domains, ListDomains() returned %d of them", len(domains))
 	}
 
 	gm.Verify(t, ct.rec.Content())
@@ -86,14 +94,14 @@ func TestRootVolumesCleanup(t *testing.T) {
 		if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
 			Name:   "root for " + uuid,
 			Target: &libvirtxml.StorageVolumeTarget{Path: "/some/path/virtlet_root_" + uuid},
-		}); err != nil {
+		}, nil); err != nil {
 			t.Fatalf("Cannot define new fake volume: %v", err)
 		}
 	}
 	if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
 		Name:   "some other volume",
 		Target: &libvirtxml.StorageVolumeTarget{Path: "/path/with/different/prefix"},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Cannot define new fake volume: %v", err)
 	}
 
@@ -128,14 +136,14 @@ func TestQcow2VolumesCleanup(t *testing.T) {
 		if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
 			Name:   "qcow flexvolume for " + uuid,
 			Target: &libvirtxml.StorageVolumeTarget{Path: "/some/path/virtlet-" + uuid},
-		}); err != nil {
+		}, nil); err != nil {
 			t.Fatalf("Cannot define new fake volume: %v", err)
 		}
 	}
 	if _, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
 		Name:   "some other volume",
 		Target: &libvirtxml.StorageVolumeTarget{Path: "/path/with/different/prefix"},
-	}); err != nil {
+	}, nil); err != nil {
 		t.Fatalf("Cannot define new fake volume: %v", err)
 	}
 
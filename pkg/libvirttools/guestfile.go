@@ -0,0 +1,172 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	// guestFileChunkSize limits the amount of data transferred
+	// by a single guest agent command so the messages
+	// stay well below libvirt RPC size limit
+	guestFileChunkSize = 256 * 1024
+	guestAgentTimeout  = 30 * time.Second
+)
+
+type guestAgentCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type guestFileReadResult struct {
+	Count  int    `json:"count"`
+	BufB64 string `json:"buf-b64"`
+	EOF    bool   `json:"eof"`
+}
+
+type guestFileWriteResult struct {
+	Count int  `json:"count"`
+	EOF   bool `json:"eof"`
+}
+
+func guestAgentExecute(domain virt.VirtDomain, cmd string, args interface{}, result interface{}) error {
+	bs, err := json.Marshal(guestAgentCommand{Execute: cmd, Arguments: args})
+	if err != nil {
+		return fmt.Errorf("error marshalling guest agent command: %v", err)
+	}
+	resp, err := domain.QemuAgentCommand(string(bs), guestAgentTimeout)
+	if err != nil {
+		return fmt.Errorf("guest agent command %q failed: %v", cmd, err)
+	}
+	if result == nil {
+		return nil
+	}
+	var msg struct {
+		Return json.RawMessage `json:"return"`
+	}
+	if err := json.Unmarshal([]byte(resp), &msg); err != nil {
+		return fmt.Errorf("error unmarshalling guest agent response to %q: %v", cmd, err)
+	}
+	if err := json.Unmarshal(msg.Return, result); err != nil {
+		return fmt.Errorf("error unmarshalling guest agent response to %q: %v", cmd, err)
+	}
+	return nil
+}
+
+func openGuestFile(domain virt.VirtDomain, path, mode string) (int, error) {
+	var handle int
+	if err := guestAgentExecute(domain, "guest-file-open", map[string]string{"path": path, "mode": mode}, &handle); err != nil {
+		return 0, err
+	}
+	return handle, nil
+}
+
+func closeGuestFile(domain virt.VirtDomain, handle int) error {
+	return guestAgentExecute(domain, "guest-file-close", map[string]int{"handle": handle}, nil)
+}
+
+// CopyToGuest writes the data read from r into the file inside the
+// VM using QEMU guest agent. The file is created if it doesn't
+// exist and truncated otherwise
+func CopyToGuest(domain virt.VirtDomain, path string, r io.Reader) error {
+	handle, err := openGuestFile(domain, path, "w")
+	if err != nil {
+		return err
+	}
+	closed := false
+	defer func() {
+		if closed {
+			return
+		}
+		if err := closeGuestFile(domain, handle); err != nil {
+			glog.Warningf("Error closing guest file %q: %v", path, err)
+		}
+	}()
+
+	buf := make([]byte, guestFileChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf)
+		for data := buf[:n]; len(data) > 0; {
+			var result guestFileWriteResult
+			if err := guestAgentExecute(domain, "guest-file-write", map[string]interface{}{
+				"handle":  handle,
+				"buf-b64": base64.StdEncoding.EncodeToString(data),
+			}, &result); err != nil {
+				return err
+			}
+			if result.Count <= 0 {
+				return fmt.Errorf("guest agent didn't write any data to %q", path)
+			}
+			data = data[result.Count:]
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	if err := guestAgentExecute(domain, "guest-file-flush", map[string]int{"handle": handle}, nil); err != nil {
+		return err
+	}
+	closed = true
+	return closeGuestFile(domain, handle)
+}
+
+// CopyFromGuest reads the file inside the VM using QEMU guest
+// agent and writes its contents to w
+func CopyFromGuest(domain virt.VirtDomain, path string, w io.Writer) error {
+	handle, err := openGuestFile(domain, path, "r")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := closeGuestFile(domain, handle); err != nil {
+			glog.Warningf("Error closing guest file %q: %v", path, err)
+		}
+	}()
+
+	for {
+		var result guestFileReadResult
+		if err := guestAgentExecute(domain, "guest-file-read", map[string]int{
+			"handle": handle,
+			"count":  guestFileChunkSize,
+		}, &result); err != nil {
+			return err
+		}
+		data, err := base64.StdEncoding.DecodeString(result.BufB64)
+		if err != nil {
+			return fmt.Errorf("bad data returned by guest agent for %q: %v", path, err)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		if result.EOF || result.Count == 0 {
+			return nil
+		}
+	}
+}
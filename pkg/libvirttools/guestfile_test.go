@@ -0,0 +1,79 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+)
+
+func TestGuestFileCopy(t *testing.T) {
+	dc := fake.NewFakeDomainConnection(nil)
+	d, err := dc.DefineDomain(&libvirtxml.Domain{
+		Name: "guestfile-test",
+		UUID: "c2d65c7a-6b1e-4c2c-8f5c-4c0c1ff0dd4e",
+	})
+	if err != nil {
+		t.Fatalf("DefineDomain(): %v", err)
+	}
+	domain := d.(*fake.FakeDomain)
+
+	if err := CopyToGuest(domain, "/etc/foo.conf", bytes.NewBufferString("foo")); err == nil {
+		t.Errorf("CopyToGuest() didn't fail for a domain that's not running")
+	}
+
+	if err := domain.Create(); err != nil {
+		t.Fatalf("Create(): %v", err)
+	}
+
+	for _, size := range []int{0, 10, guestFileChunkSize, guestFileChunkSize*2 + 42} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		if err := CopyToGuest(domain, "/etc/foo.conf", bytes.NewBuffer(data)); err != nil {
+			t.Fatalf("CopyToGuest() for size %d: %v", size, err)
+		}
+		written, found := domain.GuestFile("/etc/foo.conf")
+		switch {
+		case !found:
+			t.Errorf("guest file not created for size %d", size)
+		case !bytes.Equal(written, data):
+			t.Errorf("bad data written for size %d", size)
+		}
+
+		var buf bytes.Buffer
+		if err := CopyFromGuest(domain, "/etc/foo.conf", &buf); err != nil {
+			t.Fatalf("CopyFromGuest() for size %d: %v", size, err)
+		}
+		if !bytes.Equal(buf.Bytes(), data) {
+			t.Errorf("bad data read for size %d", size)
+		}
+	}
+
+	if err := CopyFromGuest(domain, "/no/such/file", &bytes.Buffer{}); err == nil {
+		t.Errorf("CopyFromGuest() didn't fail for a non-existent file")
+	}
+
+	if n := domain.OpenGuestFileCount(); n != 0 {
+		t.Errorf("%d guest files left open", n)
+	}
+}
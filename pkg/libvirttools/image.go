@@ -20,14 +20,17 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/url"
 	"os"
 	"strings"
 
 	"github.com/golang/glog"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/Mirantis/virtlet/pkg/imagetranslation"
+	"github.com/Mirantis/virtlet/pkg/ociimage"
 	"github.com/Mirantis/virtlet/pkg/utils"
 	"github.com/Mirantis/virtlet/pkg/virt"
 )
@@ -35,6 +38,15 @@ import (
 type ImageTool struct {
 	pool       virt.VirtStoragePool
 	downloader utils.Downloader
+	// blobsDir is the directory holding the image contents
+	// keyed by digest, empty if deduplication is disabled
+	blobsDir string
+	// pulls makes concurrent pulls of the same image
+	// share a single download
+	pulls singleflight.Group
+	// verifier checks image signatures, nil if
+	// signature verification is disabled
+	verifier *imageVerifier
 }
 
 type ImagePullError struct {
@@ -56,7 +68,16 @@ func NewImageTool(conn virt.VirtStorageConnection, downloader utils.Downloader,
 	if err != nil {
 		return nil, err
 	}
-	return &ImageTool{pool: pool, downloader: downloader}, nil
+	verifier, err := newImageVerifier(signaturePolicy(os.Getenv(imageSignaturePolicyEnvVar)), os.Getenv(imageKeysDirEnvVar))
+	if err != nil {
+		return nil, err
+	}
+	return &ImageTool{
+		pool:       pool,
+		downloader: downloader,
+		blobsDir:   os.Getenv(imageBlobsDirEnvVar),
+		verifier:   verifier,
+	}, nil
 }
 
 func (i *ImageTool) ListVolumes() ([]virt.VirtStorageVolume, error) {
@@ -73,15 +94,96 @@ func (i *ImageTool) fileToVolume(path, volumeName string) (virt.VirtStorageVolum
 		return nil, err
 	}
 	libvirtFilePath := fmt.Sprintf("/var/lib/libvirt/images/%s", volumeName)
-	return i.pool.ImageToVolume(&libvirtxml.StorageVolume{
+	def := &libvirtxml.StorageVolume{
 		Name:       volumeName,
 		Allocation: &libvirtxml.StorageVolumeSize{Value: 0},
 		Capacity:   &libvirtxml.StorageVolumeSize{Unit: "b", Value: imageSize},
 		Target:     &libvirtxml.StorageVolumeTarget{Path: libvirtFilePath},
-	}, path)
+	}
+	if i.blobsDir == "" {
+		return i.pool.ImageToVolume(def, path)
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := i.volumeFromBlob(def, digest)
+	if err != nil {
+		glog.Warningf("Can't reuse the contents of the existing image for volume %q: %v", volumeName, err)
+	}
+	if vol == nil {
+		if vol, err = i.pool.ImageToVolume(def, path); err != nil {
+			return nil, err
+		}
+		if volPath, err := vol.Path(); err != nil {
+			glog.Warningf("Can't get the path of image volume %q: %v", volumeName, err)
+		} else if err := addImageBlob(i.blobsDir, volPath, digest); err != nil {
+			glog.Warningf("Can't deduplicate image volume %q: %v", volumeName, err)
+		}
+	}
+	// the volume may have replaced an older version of the image
+	if err := gcImageBlobs(i.blobsDir); err != nil {
+		glog.Warningf("Error removing unused image blobs: %v", err)
+	}
+	return vol, nil
+}
+
+// volumeFromBlob creates the image volume as a hard link to the
+// existing blob with the same digest, so the image doesn't need to be
+// uploaded. It returns nil if there's no such blob
+func (i *ImageTool) volumeFromBlob(def *libvirtxml.StorageVolume, digest string) (virt.VirtStorageVolume, error) {
+	blobPath, err := findImageBlob(i.blobsDir, digest)
+	if err != nil || blobPath == "" {
+		return nil, err
+	}
+	if err := i.pool.RemoveVolumeByName(def.Name); err != nil {
+		return nil, err
+	}
+	vol, err := i.pool.CreateStorageVol(def, nil)
+	if err != nil {
+		return nil, err
+	}
+	volPath, err := vol.Path()
+	if err == nil {
+		err = replaceWithLink(blobPath, volPath)
+	}
+	if err != nil {
+		if err := vol.Remove(); err != nil {
+			glog.Warningf("Error removing image volume %q: %v", def.Name, err)
+		}
+		return nil, err
+	}
+	glog.V(2).Infof("Image volume %q shares its contents with blob %q", def.Name, blobPath)
+	return vol, nil
+}
+
+type pullResult struct {
+	vsv      virt.VirtStorageVolume
+	platform ImagePlatform
+}
+
+// PullRemoteImageToVolume downloads the image and stores it in the
+// specified volume. It returns the volume and the platform settings
+// of the image taken from its translation rule. If the same volume is already being
+// pulled, PullRemoteImageToVolume waits for that pull to finish and
+// returns its result instead of downloading the image again.
+func (i *ImageTool) PullRemoteImageToVolume(imageName, volumeName string, nameTranslator imagetranslation.ImageNameTranslator) (virt.VirtStorageVolume, ImagePlatform, error) {
+	r, err, shared := i.pulls.Do(volumeName, func() (interface{}, error) {
+		vsv, platform, err := i.pullRemoteImageToVolume(imageName, volumeName, nameTranslator)
+		return pullResult{vsv, platform}, err
+	})
+	if shared {
+		glog.V(2).Infof("Pull of image %q was shared with another request", imageName)
+	}
+	if err != nil {
+		return nil, ImagePlatform{}, err
+	}
+	res := r.(pullResult)
+	return res.vsv, res.platform, nil
 }
 
-func (i *ImageTool) PullRemoteImageToVolume(imageName, volumeName string, nameTranslator imagetranslation.ImageNameTranslator) (virt.VirtStorageVolume, error) {
+func (i *ImageTool) pullRemoteImageToVolume(imageName, volumeName string, nameTranslator imagetranslation.ImageNameTranslator) (virt.VirtStorageVolume, ImagePlatform, error) {
 	imageName = stripTagFromImageName(imageName)
 	endpoint := nameTranslator.Translate(imageName)
 	if endpoint.Url == "" {
@@ -91,24 +193,99 @@ func (i *ImageTool) PullRemoteImageToVolume(imageName, volumeName string, nameTr
 		glog.V(1).Infof("URL %q was translated to %q", imageName, endpoint.Url)
 	}
 
-	// TODO(nhlfr): Handle AuthConfig from PullImageRequest.
-	path, err := i.downloader.DownloadFile(endpoint)
+	arch := imageArch(endpoint.Arch)
+	if err := checkImageArch(arch); err != nil {
+		return nil, ImagePlatform{}, ImagePullError{
+			message:    fmt.Sprintf("can't pull image %q", imageName),
+			InnerError: err,
+		}
+	}
+
+	var path string
+	var err error
+	if strings.HasPrefix(endpoint.Url, ociimage.URLPrefix) {
+		err = i.checkContainerImageSignaturePolicy(endpoint)
+		if err == nil {
+			path, err = i.containerImageToFile(endpoint, arch, volumeName)
+		}
+		if err == nil {
+			defer removeContainerImageFile(path)
+		}
+	} else {
+		// TODO(nhlfr): Handle AuthConfig from PullImageRequest.
+		path, err = i.downloader.DownloadFile(endpoint)
+		if err == nil {
+			defer os.Remove(path)
+			err = i.verifyImage(endpoint, path)
+		}
+	}
 	if err == nil {
-		defer os.Remove(path)
 		var vsv virt.VirtStorageVolume
 		vsv, err = i.fileToVolume(path, volumeName)
 		if err == nil {
-			return vsv, nil
+			return vsv, ImagePlatform{
+				Arch:        arch,
+				MachineType: endpoint.MachineType,
+				Emulator:    endpoint.Emulator,
+			}, nil
 		}
 	}
-	return nil, ImagePullError{
+	return nil, ImagePlatform{}, ImagePullError{
 		message:    fmt.Sprintf("error pulling image %q from %q", imageName, endpoint.Url),
 		InnerError: err,
 	}
 }
 
+// verifyImage checks the signature of the downloaded image that's
+// fetched from the image URL with .sig suffix appended
+func (i *ImageTool) verifyImage(endpoint utils.Endpoint, path string) error {
+	if i.verifier == nil {
+		return nil
+	}
+	sigEndpoint := endpoint
+	sigEndpoint.Url += imageSignatureSuffix
+	sigPath, err := i.downloader.DownloadFile(sigEndpoint)
+	if err != nil {
+		if i.verifier.policy == signaturePolicyStrict {
+			return fmt.Errorf("can't get image signature: %v", err)
+		}
+		glog.Warningf("Using unsigned image from %q: can't get image signature: %v", endpoint.Url, err)
+		return nil
+	}
+	defer os.Remove(sigPath)
+	sig, err := ioutil.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	return i.verifier.verify(path, sig)
+}
+
+// checkContainerImageSignaturePolicy checks whether the images
+// converted from container images can be used with the current
+// signature policy, as their signatures can't be verified
+func (i *ImageTool) checkContainerImageSignaturePolicy(endpoint utils.Endpoint) error {
+	switch {
+	case i.verifier == nil:
+		return nil
+	case i.verifier.policy == signaturePolicyStrict:
+		return fmt.Errorf("can't verify the signature of container image %q", endpoint.Url)
+	default:
+		glog.Warningf("Using unsigned container image %q", endpoint.Url)
+		return nil
+	}
+}
+
 func (i *ImageTool) RemoveImage(volumeName string) error {
-	return i.pool.RemoveVolumeByName(volumeName)
+	if err := i.pool.RemoveVolumeByName(volumeName); err != nil {
+		return err
+	}
+	removeImageBootFiles(volumeName)
+	if i.blobsDir != "" {
+		if err := gcImageBlobs(i.blobsDir); err != nil {
+			glog.Warningf("Error removing unused image blobs: %v", err)
+		}
+	}
+	return nil
 }
 
 func (i *ImageTool) GetImageVolume(imageName string) (virt.VirtStorageVolume, error) {
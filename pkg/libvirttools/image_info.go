@@ -0,0 +1,57 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+var qcow2Magic = []byte{'Q', 'F', 'I', 0xfb}
+
+// qcow2HeaderSize is the size of the part of qcow2 header that's
+// needed to get the virtual size of the image, which is stored as
+// big endian uint64 at offset 24
+const qcow2HeaderSize = 32
+
+// ImageFileInfo returns the format of the image file ("qcow2" or
+// "raw") and its virtual size, i.e. the size of the disk as seen by
+// the VM
+func ImageFileInfo(path string) (string, uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, qcow2HeaderSize)
+	_, err = io.ReadFull(f, header)
+	switch {
+	case err == nil && bytes.Equal(header[:len(qcow2Magic)], qcow2Magic):
+		return "qcow2", binary.BigEndian.Uint64(header[24:32]), nil
+	case err != nil && err != io.EOF && err != io.ErrUnexpectedEOF:
+		return "", 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", 0, err
+	}
+	return "raw", uint64(fi.Size()), nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageFileInfo(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "image-info-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	qcow2Header := make([]byte, 512)
+	copy(qcow2Header, qcow2Magic)
+	// version
+	binary.BigEndian.PutUint32(qcow2Header[4:], 3)
+	binary.BigEndian.PutUint64(qcow2Header[24:], 10*1024*1024*1024)
+
+	for _, tc := range []struct {
+		name        string
+		content     []byte
+		format      string
+		virtualSize uint64
+	}{
+		{
+			name:        "qcow2",
+			content:     qcow2Header,
+			format:      "qcow2",
+			virtualSize: 10 * 1024 * 1024 * 1024,
+		},
+		{
+			name:        "raw",
+			content:     make([]byte, 4096),
+			format:      "raw",
+			virtualSize: 4096,
+		},
+		{
+			name:        "small raw",
+			content:     []byte("QFI"),
+			format:      "raw",
+			virtualSize: 3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(tmpDir, tc.name)
+			if err := ioutil.WriteFile(path, tc.content, 0644); err != nil {
+				t.Fatalf("WriteFile(): %v", err)
+			}
+			format, virtualSize, err := ImageFileInfo(path)
+			if err != nil {
+				t.Fatalf("ImageFileInfo(): %v", err)
+			}
+			if format != tc.format {
+				t.Errorf("bad format %q instead of %q", format, tc.format)
+			}
+			if virtualSize != tc.virtualSize {
+				t.Errorf("bad virtual size %d instead of %d", virtualSize, tc.virtualSize)
+			}
+		})
+	}
+}
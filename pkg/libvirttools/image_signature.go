@@ -0,0 +1,225 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	imageSignaturePolicyEnvVar = "VIRTLET_IMAGE_SIGNATURE_POLICY"
+	imageKeysDirEnvVar         = "VIRTLET_IMAGE_KEYS_DIR"
+	// imageSignatureSuffix is appended to the image URL to get
+	// the URL of its detached signature
+	imageSignatureSuffix = ".sig"
+	pgpArmorPrefix       = "-----BEGIN PGP SIGNATURE-----"
+)
+
+type signaturePolicy string
+
+const (
+	// signaturePolicyNone disables signature verification
+	signaturePolicyNone signaturePolicy = ""
+	// signaturePolicyPermissive makes Virtlet reject images with
+	// bad signatures but accept unsigned ones
+	signaturePolicyPermissive signaturePolicy = "permissive"
+	// signaturePolicyStrict makes Virtlet reject unsigned images
+	signaturePolicyStrict signaturePolicy = "strict"
+)
+
+var errBadSignature = errors.New("image signature doesn't match any of the configured keys")
+
+// imageVerifier checks detached image signatures, which can be either
+// OpenPGP signatures (armored or binary) or base64-encoded signatures
+// of the SHA256 digest of the image made using an ECDSA or RSA key,
+// like the ones produced by 'cosign sign-blob'
+type imageVerifier struct {
+	policy  signaturePolicy
+	keyring openpgp.EntityList
+	keys    []crypto.PublicKey
+}
+
+// newImageVerifier loads the public keys for image verification from
+// keysDir. The files with .asc and .gpg extensions are treated as
+// armored and binary OpenPGP keyrings, respectively, and the files with
+// .pem extension are treated as PEM-encoded public keys. It returns nil
+// if signature verification is disabled by the policy.
+func newImageVerifier(policy signaturePolicy, keysDir string) (*imageVerifier, error) {
+	switch policy {
+	case signaturePolicyNone:
+		return nil, nil
+	case signaturePolicyPermissive, signaturePolicyStrict:
+	default:
+		return nil, fmt.Errorf("bad image signature policy %q", policy)
+	}
+
+	v := &imageVerifier{policy: policy}
+	if keysDir != "" {
+		if err := v.loadKeys(keysDir); err != nil {
+			return nil, err
+		}
+	}
+	if len(v.keyring) == 0 && len(v.keys) == 0 {
+		return nil, fmt.Errorf("image signature verification is enabled but no keys were found in %q", keysDir)
+	}
+	return v, nil
+}
+
+func (v *imageVerifier) loadKeys(keysDir string) error {
+	files, err := ioutil.ReadDir(keysDir)
+	if err != nil {
+		return fmt.Errorf("can't read image keys dir %q: %v", keysDir, err)
+	}
+	for _, fi := range files {
+		// skip directories and also ..data and the like
+		// that appear in ConfigMap and Secret volumes
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		keyPath := filepath.Join(keysDir, fi.Name())
+		switch filepath.Ext(fi.Name()) {
+		case ".asc", ".gpg":
+			if err := v.loadKeyring(keyPath); err != nil {
+				return err
+			}
+		case ".pem":
+			if err := v.loadPEMKey(keyPath); err != nil {
+				return err
+			}
+		default:
+			glog.Warningf("Skipping unrecognized image key file %q", keyPath)
+		}
+	}
+	return nil
+}
+
+func (v *imageVerifier) loadKeyring(keyPath string) error {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var keyring openpgp.EntityList
+	if filepath.Ext(keyPath) == ".asc" {
+		keyring, err = openpgp.ReadArmoredKeyRing(f)
+	} else {
+		keyring, err = openpgp.ReadKeyRing(f)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading OpenPGP keyring %q: %v", keyPath, err)
+	}
+	v.keyring = append(v.keyring, keyring...)
+	return nil
+}
+
+func (v *imageVerifier) loadPEMKey(keyPath string) error {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return fmt.Errorf("%q doesn't contain a PEM-encoded public key", keyPath)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("error parsing public key %q: %v", keyPath, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+		v.keys = append(v.keys, key)
+	default:
+		return fmt.Errorf("unsupported public key type %T in %q", key, keyPath)
+	}
+	return nil
+}
+
+// verify checks the signature of the image file
+func (v *imageVerifier) verify(imagePath string, sig []byte) error {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if bytes.HasPrefix(bytes.TrimSpace(sig), []byte(pgpArmorPrefix)) {
+		return checkPGPSignature(openpgp.CheckArmoredDetachedSignature, v.keyring, f, sig)
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig))); err == nil {
+		return v.checkKeySignature(f, decoded)
+	}
+	return checkPGPSignature(openpgp.CheckDetachedSignature, v.keyring, f, sig)
+}
+
+func checkPGPSignature(check func(openpgp.KeyRing, io.Reader, io.Reader) (*openpgp.Entity, error), keyring openpgp.EntityList, signed io.Reader, sig []byte) error {
+	if len(keyring) == 0 {
+		return errBadSignature
+	}
+	signer, err := check(keyring, signed, bytes.NewReader(sig))
+	if err != nil {
+		return fmt.Errorf("%v: %v", errBadSignature, err)
+	}
+	for name := range signer.Identities {
+		glog.V(1).Infof("Image signed by %q", name)
+	}
+	return nil
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+func (v *imageVerifier) checkKeySignature(signed io.Reader, sig []byte) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, signed); err != nil {
+		return err
+	}
+	digest := h.Sum(nil)
+	for _, key := range v.keys {
+		switch k := key.(type) {
+		case *ecdsa.PublicKey:
+			var s ecdsaSignature
+			if _, err := asn1.Unmarshal(sig, &s); err == nil && ecdsa.Verify(k, digest, s.R, s.S) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, sig) == nil {
+				return nil
+			}
+		}
+	}
+	return errBadSignature
+}
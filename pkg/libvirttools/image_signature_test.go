@@ -0,0 +1,188 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+type imageSigner struct {
+	name string
+	sign func(data []byte) ([]byte, error)
+}
+
+func writePEMKey(t *testing.T, path string, pub crypto.PublicKey) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey(): %v", err)
+	}
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+}
+
+func setupImageSigners(t *testing.T, keysDir string) []imageSigner {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(): %v", err)
+	}
+	writePEMKey(t, filepath.Join(keysDir, "ecdsa.pem"), &ecdsaKey.PublicKey)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey(): %v", err)
+	}
+	writePEMKey(t, filepath.Join(keysDir, "rsa.pem"), &rsaKey.PublicKey)
+
+	entity, err := openpgp.NewEntity("Image Signer", "", "signer@example.com", nil)
+	if err != nil {
+		t.Fatalf("openpgp.NewEntity(): %v", err)
+	}
+	// Serialize() needs the self-signatures to be made
+	for _, id := range entity.Identities {
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, entity.PrimaryKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("SignUserId(): %v", err)
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if err := subkey.Sig.SignKey(subkey.PublicKey, entity.PrivateKey, nil); err != nil {
+			t.Fatalf("SignKey(): %v", err)
+		}
+	}
+	var keyring bytes.Buffer
+	w, err := armor.Encode(&keyring, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("armor.Encode(): %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("entity.Serialize(): %v", err)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(filepath.Join(keysDir, "signer.asc"), keyring.Bytes(), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	return []imageSigner{
+		{
+			name: "ecdsa",
+			sign: func(data []byte) ([]byte, error) {
+				digest := sha256.Sum256(data)
+				sig, err := ecdsaKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+				if err != nil {
+					return nil, err
+				}
+				return []byte(base64.StdEncoding.EncodeToString(sig) + "\n"), nil
+			},
+		},
+		{
+			name: "rsa",
+			sign: func(data []byte) ([]byte, error) {
+				digest := sha256.Sum256(data)
+				sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+				if err != nil {
+					return nil, err
+				}
+				return []byte(base64.StdEncoding.EncodeToString(sig)), nil
+			},
+		},
+		{
+			name: "armored pgp",
+			sign: func(data []byte) ([]byte, error) {
+				var sig bytes.Buffer
+				err := openpgp.ArmoredDetachSign(&sig, entity, bytes.NewReader(data), nil)
+				return sig.Bytes(), err
+			},
+		},
+		{
+			name: "binary pgp",
+			sign: func(data []byte) ([]byte, error) {
+				var sig bytes.Buffer
+				err := openpgp.DetachSign(&sig, entity, bytes.NewReader(data), nil)
+				return sig.Bytes(), err
+			},
+		},
+	}
+}
+
+func TestImageSignatures(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "image-signatures-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	keysDir := filepath.Join(tmpDir, "keys")
+	if err := os.Mkdir(keysDir, 0755); err != nil {
+		t.Fatalf("Mkdir(): %v", err)
+	}
+
+	if _, err := newImageVerifier(signaturePolicyStrict, keysDir); err == nil {
+		t.Errorf("newImageVerifier() didn't fail without keys")
+	}
+	if _, err := newImageVerifier("lax", keysDir); err == nil {
+		t.Errorf("newImageVerifier() didn't fail for a bad policy")
+	}
+	if v, err := newImageVerifier(signaturePolicyNone, keysDir); err != nil || v != nil {
+		t.Errorf("newImageVerifier() with signature verification disabled: %v, %v", v, err)
+	}
+
+	signers := setupImageSigners(t, keysDir)
+	v, err := newImageVerifier(signaturePolicyStrict, keysDir)
+	if err != nil {
+		t.Fatalf("newImageVerifier(): %v", err)
+	}
+
+	imageData := []byte("image contents")
+	imagePath := filepath.Join(tmpDir, "image")
+	if err := ioutil.WriteFile(imagePath, imageData, 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	for _, signer := range signers {
+		t.Run(signer.name, func(t *testing.T) {
+			sig, err := signer.sign(imageData)
+			if err != nil {
+				t.Fatalf("error signing the image: %v", err)
+			}
+			if err := v.verify(imagePath, sig); err != nil {
+				t.Errorf("verify(): %v", err)
+			}
+
+			otherSig, err := signer.sign([]byte("other contents"))
+			if err != nil {
+				t.Fatalf("error signing the data: %v", err)
+			}
+			if err := v.verify(imagePath, otherSig); err == nil {
+				t.Errorf("verify() didn't fail for a bad signature")
+			}
+		})
+	}
+}
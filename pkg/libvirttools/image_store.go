@@ -0,0 +1,135 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// imageBlobsDirEnvVar specifies the directory that holds the
+// contents of the images keyed by their sha256 digests. The image
+// volumes are hard links to these files, so the images that have
+// the same contents but different names share the disk space. The
+// directory must be on the same filesystem (and mount) as the
+// image storage pool. Empty value disables image deduplication
+const imageBlobsDirEnvVar = "VIRTLET_IMAGE_BLOBS_DIR"
+
+const imageBlobPrefix = "sha256_"
+
+// fileDigest returns hex-encoded sha256 digest of the file
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", fmt.Errorf("error reading %q: %v", path, err)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+func imageBlobPath(blobsDir, digest string) string {
+	return filepath.Join(blobsDir, imageBlobPrefix+digest)
+}
+
+// findImageBlob returns the path of the blob with the specified
+// digest or an empty string if there's no such blob
+func findImageBlob(blobsDir, digest string) (string, error) {
+	blobPath := imageBlobPath(blobsDir, digest)
+	_, err := os.Stat(blobPath)
+	switch {
+	case os.IsNotExist(err):
+		return "", nil
+	case err != nil:
+		return "", err
+	}
+	return blobPath, nil
+}
+
+// replaceWithLink atomically replaces the file at path with a hard
+// link to blobPath
+func replaceWithLink(blobPath, path string) error {
+	tmpPath := path + ".link"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(blobPath, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// addImageBlob makes the image file at path share its contents with
+// the blob that has the specified digest. If there's no such blob
+// yet, the image file becomes the blob
+func addImageBlob(blobsDir, path, digest string) error {
+	if err := os.MkdirAll(blobsDir, 0755); err != nil {
+		return fmt.Errorf("can't create image blobs dir: %v", err)
+	}
+	blobPath, err := findImageBlob(blobsDir, digest)
+	if err != nil {
+		return err
+	}
+	if blobPath != "" {
+		return replaceWithLink(blobPath, path)
+	}
+	if err := os.Link(path, imageBlobPath(blobsDir, digest)); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// gcImageBlobs removes the blobs that are not used by any images,
+// i.e. the ones that have no hard links besides the blob itself
+func gcImageBlobs(blobsDir string) error {
+	fis, err := ioutil.ReadDir(blobsDir)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), imageBlobPrefix) {
+			continue
+		}
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		if !ok || st.Nlink > 1 {
+			continue
+		}
+		glog.V(3).Infof("Removing unused image blob %q", fi.Name())
+		if err := os.Remove(filepath.Join(blobsDir, fi.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageBlobs(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "image-blobs-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	blobsDir := filepath.Join(tmpDir, "blobs")
+
+	images := map[string]string{
+		"image1": "foobar",
+		// same contents under a different name
+		"image2": "foobar",
+		"image3": "baz",
+	}
+	digests := map[string]string{}
+	for name, content := range images {
+		path := filepath.Join(tmpDir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("WriteFile(): %v", err)
+		}
+		digest, err := fileDigest(path)
+		if err != nil {
+			t.Fatalf("fileDigest(): %v", err)
+		}
+		digests[name] = digest
+		if err := addImageBlob(blobsDir, path, digest); err != nil {
+			t.Fatalf("addImageBlob(): %v", err)
+		}
+	}
+	if expected := "c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2"; digests["image1"] != expected {
+		t.Errorf("bad digest: %q instead of %q", digests["image1"], expected)
+	}
+
+	fi1, err := os.Stat(filepath.Join(tmpDir, "image1"))
+	if err != nil {
+		t.Fatalf("Stat(): %v", err)
+	}
+	fi2, err := os.Stat(filepath.Join(tmpDir, "image2"))
+	if err != nil {
+		t.Fatalf("Stat(): %v", err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Errorf("the images with the same contents don't share the file")
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(tmpDir, "image2")); err != nil {
+		t.Errorf("ReadFile(): %v", err)
+	} else if string(content) != "foobar" {
+		t.Errorf("bad image contents after deduplication: %q", content)
+	}
+
+	checkBlobs := func(expected ...string) {
+		for _, name := range []string{"image1", "image3"} {
+			blobPath, err := findImageBlob(blobsDir, digests[name])
+			if err != nil {
+				t.Fatalf("findImageBlob(): %v", err)
+			}
+			found := false
+			for _, n := range expected {
+				if n == name {
+					found = true
+				}
+			}
+			switch {
+			case found && blobPath == "":
+				t.Errorf("blob for %s not found", name)
+			case !found && blobPath != "":
+				t.Errorf("blob for %s was not removed", name)
+			}
+		}
+	}
+
+	if err := gcImageBlobs(blobsDir); err != nil {
+		t.Fatalf("gcImageBlobs(): %v", err)
+	}
+	checkBlobs("image1", "image3")
+
+	os.Remove(filepath.Join(tmpDir, "image1"))
+	os.Remove(filepath.Join(tmpDir, "image3"))
+	if err := gcImageBlobs(blobsDir); err != nil {
+		t.Fatalf("gcImageBlobs(): %v", err)
+	}
+	// image2 still uses the blob
+	checkBlobs("image1")
+
+	os.Remove(filepath.Join(tmpDir, "image2"))
+	if err := gcImageBlobs(blobsDir); err != nil {
+		t.Fatalf("gcImageBlobs(): %v", err)
+	}
+	checkBlobs()
+}
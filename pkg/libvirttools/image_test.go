@@ -0,0 +1,109 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/imagetranslation"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+)
+
+type blockingDownloader struct {
+	sync.Mutex
+	utils.Downloader
+	count   int
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDownloader) DownloadFile(endpoint utils.Endpoint) (string, error) {
+	d.Lock()
+	d.count++
+	d.Unlock()
+	d.once.Do(func() { close(d.started) })
+	<-d.release
+	return d.Downloader.DownloadFile(endpoint)
+}
+
+func TestConcurrentPulls(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "image-pull-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	downloader := &blockingDownloader{
+		Downloader: utils.NewFakeDownloader(tmpDir),
+		started:    make(chan struct{}),
+		release:    make(chan struct{}),
+	}
+	storageConn := fake.NewFakeStorageConnection(fake.NullRecorder)
+	imageTool, err := NewImageTool(storageConn, downloader, "default")
+	if err != nil {
+		t.Fatalf("NewImageTool(): %v", err)
+	}
+
+	imageName := "example.com/foobar"
+	volumeName, err := ImageNameToVolumeName(imageName)
+	if err != nil {
+		t.Fatalf("ImageNameToVolumeName(): %v", err)
+	}
+	translator := imagetranslation.NewImageNameTranslator()
+
+	const numPulls = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, numPulls)
+	pull := func() {
+		defer wg.Done()
+		_, _, err := imageTool.PullRemoteImageToVolume(imageName, volumeName, translator)
+		errs <- err
+	}
+	wg.Add(1)
+	go pull()
+	// make sure the first pull is in progress before starting the others
+	<-downloader.started
+	for n := 1; n < numPulls; n++ {
+		wg.Add(1)
+		go pull()
+	}
+	// give the other pulls some time to join the first one
+	time.Sleep(100 * time.Millisecond)
+	close(downloader.release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("PullRemoteImageToVolume(): %v", err)
+		}
+	}
+	downloader.Lock()
+	defer downloader.Unlock()
+	if downloader.count != 1 {
+		t.Errorf("the image was downloaded %d times instead of once", downloader.count)
+	}
+	if _, err := imageTool.ImageAsVolume(volumeName); err != nil {
+		t.Errorf("ImageAsVolume(): %v", err)
+	}
+}
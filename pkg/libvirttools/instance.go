@@ -0,0 +1,54 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"github.com/Mirantis/virtlet/pkg/instance"
+)
+
+const defaultVolumePoolName = "volumes"
+
+// VolumePoolName returns the name of the libvirt storage pool
+// that holds the volumes of the VMs of the current Virtlet instance
+func VolumePoolName() string {
+	if instance.Name() == "" {
+		return defaultVolumePoolName
+	}
+	return defaultVolumePoolName + "-" + instance.Name()
+}
+
+// useInstanceDataDirs makes the package keep nocloud images,
+// boot files and volume exports in the data directory of the
+// named Virtlet instance. The directories of the default
+// instance are left alone so they can be overridden by tests
+func useInstanceDataDirs() {
+	if instance.Name() == "" {
+		return
+	}
+	nocloudIsoDir = instance.DataPath("nocloud")
+	bootFileDir = instance.DataPath("boot")
+	volumeExportDir = instance.DataPath("exports")
+}
+
+// instanceQMPOutputDir returns the directory for the files
+// produced by QMP commands for the current Virtlet instance
+func instanceQMPOutputDir() string {
+	if instance.Name() == "" {
+		return DefaultQMPOutputDir
+	}
+	return instance.DataPath("dumps")
+}
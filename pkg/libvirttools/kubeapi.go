@@ -39,6 +39,7 @@ func GetVMConfig(in *kubeapi.CreateContainerRequest, cniConfig string) (*VMConfi
 		Image:                in.Config.Image.Image,
 		Attempt:              in.Config.Metadata.Attempt,
 		PodAnnotations:       in.SandboxConfig.Annotations,
+		PodLabels:            in.SandboxConfig.Labels,
 		ContainerAnnotations: in.Config.Annotations,
 		ContainerLabels:      in.Config.Labels,
 		CNIConfig:            cniConfig,
@@ -52,6 +53,10 @@ func GetVMConfig(in *kubeapi.CreateContainerRequest, cniConfig string) (*VMConfi
 		r.CpuQuota = res.CpuQuota
 	}
 
+	if len(in.Config.Command) != 0 || len(in.Config.Args) != 0 {
+		r.Command = append(append([]string{}, in.Config.Command...), in.Config.Args...)
+	}
+
 	for _, entry := range in.Config.Envs {
 		r.Environment = append(r.Environment, &VMKeyValue{Key: entry.Key, Value: entry.Value})
 	}
@@ -18,6 +18,7 @@ package libvirttools
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/golang/glog"
 	libvirt "github.com/libvirt/libvirt-go"
@@ -41,16 +42,54 @@ func (dc *LibvirtDomainConnection) DefineDomain(def *libvirtxml.Domain) (virt.Vi
 	if err != nil {
 		return nil, err
 	}
+	if xml, err = addDiskEncryption(xml, dc.volumeEncryption); err != nil {
+		return nil, err
+	}
 	glog.V(2).Infof("Defining domain:\n%s", xml)
+	done := timeLibvirtCall("virDomainDefineXML", def.Name)
 	d, err := dc.conn.DomainDefineXML(xml)
+	done()
 	if err != nil {
 		return nil, err
 	}
 	return &LibvirtDomain{d}, nil
 }
 
+// volumeEncryption returns the encryption settings of the storage
+// volume with the specified path. It returns nil if the volume is
+// not encrypted or the path doesn't correspond to a storage volume
+func (dc *LibvirtDomainConnection) volumeEncryption(path string) (*libvirtxml.StorageEncryption, error) {
+	done := timeLibvirtCall("virStorageVolLookupByPath", path)
+	vol, err := dc.conn.LookupStorageVolByPath(path)
+	done()
+	if err != nil {
+		libvirtErr, ok := err.(libvirt.Error)
+		if ok && libvirtErr.Code == libvirt.ERR_NO_STORAGE_VOL {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error looking up storage volume %q: %v", path, err)
+	}
+	defer vol.Free()
+	done = timeLibvirtCall("virStorageVolGetXMLDesc", path)
+	desc, err := vol.GetXMLDesc(0)
+	done()
+	if err != nil {
+		return nil, fmt.Errorf("error getting the definition of storage volume %q: %v", path, err)
+	}
+	var volDef libvirtxml.StorageVolume
+	if err := volDef.Unmarshal(desc); err != nil {
+		return nil, fmt.Errorf("error unmarshalling the definition of storage volume %q: %v", path, err)
+	}
+	if volDef.Target == nil {
+		return nil, nil
+	}
+	return volDef.Target.Encryption, nil
+}
+
 func (dc *LibvirtDomainConnection) ListDomains() ([]virt.VirtDomain, error) {
+	done := timeLibvirtCall("virConnectListAllDomains", "")
 	domains, err := dc.conn.ListAllDomains(0)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -64,7 +103,9 @@ func (dc *LibvirtDomainConnection) ListDomains() ([]virt.VirtDomain, error) {
 }
 
 func (dc *LibvirtDomainConnection) LookupDomainByName(name string) (virt.VirtDomain, error) {
+	done := timeLibvirtCall("virDomainLookupByName", name)
 	d, err := dc.conn.LookupDomainByName(name)
+	done()
 	if err != nil {
 		libvirtErr, ok := err.(libvirt.Error)
 		if ok && libvirtErr.Code == libvirt.ERR_NO_DOMAIN {
@@ -76,7 +117,9 @@ func (dc *LibvirtDomainConnection) LookupDomainByName(name string) (virt.VirtDom
 }
 
 func (dc *LibvirtDomainConnection) LookupDomainByUUIDString(uuid string) (virt.VirtDomain, error) {
+	done := timeLibvirtCall("virDomainLookupByUUIDString", uuid)
 	d, err := dc.conn.LookupDomainByUUIDString(uuid)
+	done()
 	if err != nil {
 		libvirtErr, ok := err.(libvirt.Error)
 		if ok && libvirtErr.Code == libvirt.ERR_NO_DOMAIN {
@@ -92,7 +135,9 @@ func (dc *LibvirtDomainConnection) DefineSecret(def *libvirtxml.Secret) (virt.Vi
 	if err != nil {
 		return nil, err
 	}
+	done := timeLibvirtCall("virSecretDefineXML", "")
 	secret, err := dc.conn.SecretDefineXML(xml, 0)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +145,9 @@ func (dc *LibvirtDomainConnection) DefineSecret(def *libvirtxml.Secret) (virt.Vi
 }
 
 func (dc *LibvirtDomainConnection) LookupSecretByUUIDString(uuid string) (virt.VirtSecret, error) {
+	done := timeLibvirtCall("virSecretLookupByUUIDString", uuid)
 	secret, err := dc.conn.LookupSecretByUUIDString(uuid)
+	done()
 	if err != nil {
 		libvirtErr, ok := err.(libvirt.Error)
 		if ok && libvirtErr.Code == libvirt.ERR_NO_SECRET {
@@ -113,11 +160,19 @@ func (dc *LibvirtDomainConnection) LookupSecretByUUIDString(uuid string) (virt.V
 
 func (dc *LibvirtDomainConnection) LookupSecretByUsageName(usageType string, usageName string) (virt.VirtSecret, error) {
 
-	if usageType != "ceph" {
+	var libvirtUsageType libvirt.SecretUsageType
+	switch usageType {
+	case "ceph":
+		libvirtUsageType = libvirt.SECRET_USAGE_TYPE_CEPH
+	case "volume":
+		libvirtUsageType = libvirt.SECRET_USAGE_TYPE_VOLUME
+	default:
 		return nil, fmt.Errorf("unsupported type %q for secret with usage name: %q", usageType, usageName)
 	}
 
-	secret, err := dc.conn.LookupSecretByUsage(libvirt.SECRET_USAGE_TYPE_CEPH, usageName)
+	done := timeLibvirtCall("virSecretLookupByUsage", usageName)
+	secret, err := dc.conn.LookupSecretByUsage(libvirtUsageType, usageName)
+	done()
 	if err != nil {
 		libvirtErr, ok := err.(libvirt.Error)
 		if ok && libvirtErr.Code == libvirt.ERR_NO_SECRET {
@@ -134,24 +189,55 @@ type LibvirtDomain struct {
 
 var _ virt.VirtDomain = &LibvirtDomain{}
 
+// domainName returns the name of the domain for use in libvirt call
+// metrics. virDomainGetName() doesn't involve a call to libvirtd
+func (domain *LibvirtDomain) domainName() string {
+	name, err := domain.d.GetName()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
 func (domain *LibvirtDomain) Create() error {
+	defer timeLibvirtCall("virDomainCreate", domain.domainName())()
 	return domain.d.Create()
 }
 
 func (domain *LibvirtDomain) Destroy() error {
+	defer timeLibvirtCall("virDomainDestroy", domain.domainName())()
 	return domain.d.Destroy()
 }
 
 func (domain *LibvirtDomain) Undefine() error {
+	defer timeLibvirtCall("virDomainUndefine", domain.domainName())()
 	return domain.d.Undefine()
 }
 
 func (domain *LibvirtDomain) Shutdown() error {
+	defer timeLibvirtCall("virDomainShutdown", domain.domainName())()
 	return domain.d.Shutdown()
 }
 
+func (domain *LibvirtDomain) Suspend() error {
+	defer timeLibvirtCall("virDomainSuspend", domain.domainName())()
+	return domain.d.Suspend()
+}
+
+func (domain *LibvirtDomain) Resume() error {
+	defer timeLibvirtCall("virDomainResume", domain.domainName())()
+	return domain.d.Resume()
+}
+
+func (domain *LibvirtDomain) Reset() error {
+	defer timeLibvirtCall("virDomainReset", domain.domainName())()
+	return domain.d.Reset(0)
+}
+
 func (domain *LibvirtDomain) State() (virt.DomainState, error) {
+	done := timeLibvirtCall("virDomainGetInfo", domain.domainName())
 	di, err := domain.d.GetInfo()
+	done()
 	if err != nil {
 		return virt.DOMAIN_NOSTATE, err
 	}
@@ -186,7 +272,9 @@ func (domain *LibvirtDomain) Name() (string, error) {
 }
 
 func (domain *LibvirtDomain) Xml() (*libvirtxml.Domain, error) {
+	done := timeLibvirtCall("virDomainGetXMLDesc", domain.domainName())
 	desc, err := domain.d.GetXMLDesc(libvirt.DOMAIN_XML_INACTIVE)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -197,14 +285,132 @@ func (domain *LibvirtDomain) Xml() (*libvirtxml.Domain, error) {
 	return &d, nil
 }
 
+func (domain *LibvirtDomain) QemuAgentCommand(cmd string, timeout time.Duration) (string, error) {
+	agentTimeout := libvirt.DOMAIN_QEMU_AGENT_COMMAND_DEFAULT
+	if timeout > 0 {
+		// libvirt uses seconds for agent command timeouts
+		agentTimeout = libvirt.DomainQemuAgentCommandTimeout((timeout + time.Second - 1) / time.Second)
+	}
+	defer timeLibvirtCall("virDomainQemuAgentCommand", domain.domainName())()
+	return domain.d.QemuAgentCommand(cmd, agentTimeout, 0)
+}
+
+func (domain *LibvirtDomain) QemuMonitorCommand(cmd string) (string, error) {
+	defer timeLibvirtCall("virDomainQemuMonitorCommand", domain.domainName())()
+	return domain.d.QemuMonitorCommand(cmd, libvirt.DOMAIN_QEMU_MONITOR_COMMAND_DEFAULT)
+}
+
+func (domain *LibvirtDomain) CoreDump(path string) error {
+	defer timeLibvirtCall("virDomainCoreDumpWithFormat", domain.domainName())()
+	return domain.d.CoreDumpWithFormat(path, libvirt.DOMAIN_CORE_DUMP_FORMAT_RAW, libvirt.DUMP_MEMORY_ONLY)
+}
+
+func (domain *LibvirtDomain) MemoryStats() (*virt.DomainMemoryStats, error) {
+	done := timeLibvirtCall("virDomainMemoryStats", domain.domainName())
+	stats, err := domain.d.MemoryStats(uint32(libvirt.DOMAIN_MEMORY_STAT_NR), 0)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	var r virt.DomainMemoryStats
+	for _, stat := range stats {
+		// libvirt reports the memory stats in KiB
+		switch libvirt.DomainMemoryStatTags(stat.Tag) {
+		case libvirt.DOMAIN_MEMORY_STAT_ACTUAL_BALLOON:
+			r.ActualBalloon = stat.Val * 1024
+		case libvirt.DOMAIN_MEMORY_STAT_AVAILABLE:
+			r.Available = stat.Val * 1024
+		case libvirt.DOMAIN_MEMORY_STAT_UNUSED:
+			r.Unused = stat.Val * 1024
+		case libvirt.DOMAIN_MEMORY_STAT_RSS:
+			r.RSS = stat.Val * 1024
+		}
+	}
+	return &r, nil
+}
+
+func (domain *LibvirtDomain) SetMemoryStatsPeriod(period time.Duration) error {
+	defer timeLibvirtCall("virDomainSetMemoryStatsPeriod", domain.domainName())()
+	return domain.d.SetMemoryStatsPeriod(int(period/time.Second), libvirt.DOMAIN_MEM_LIVE)
+}
+
+func (domain *LibvirtDomain) SetMemory(memory uint64) error {
+	defer timeLibvirtCall("virDomainSetMemoryFlags", domain.domainName())()
+	return domain.d.SetMemoryFlags(memory/1024, libvirt.DOMAIN_MEM_LIVE)
+}
+
+func (domain *LibvirtDomain) CPUTime() (time.Duration, error) {
+	done := timeLibvirtCall("virDomainGetInfo", domain.domainName())
+	info, err := domain.d.GetInfo()
+	done()
+	if err != nil {
+		return 0, err
+	}
+	// libvirt reports the CPU time in nanoseconds
+	return time.Duration(info.CpuTime), nil
+}
+
+func (domain *LibvirtDomain) isActive() (bool, error) {
+	state, err := domain.State()
+	if err != nil {
+		return false, err
+	}
+	return state != virt.DOMAIN_SHUTOFF, nil
+}
+
+func (domain *LibvirtDomain) SetVCPUCount(count int) error {
+	flags := libvirt.DOMAIN_VCPU_CONFIG
+	active, err := domain.isActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_VCPU_LIVE
+	}
+	defer timeLibvirtCall("virDomainSetVcpusFlags", domain.domainName())()
+	return domain.d.SetVcpusFlags(uint(count), flags)
+}
+
+func (domain *LibvirtDomain) SetCPUTune(shares uint64, period uint64, quota int64) error {
+	flags := libvirt.DOMAIN_AFFECT_CONFIG
+	active, err := domain.isActive()
+	if err != nil {
+		return err
+	}
+	if active {
+		flags |= libvirt.DOMAIN_AFFECT_LIVE
+	}
+	params := &libvirt.DomainSchedulerParameters{
+		CpuSharesSet:  shares != 0,
+		CpuShares:     shares,
+		VcpuPeriodSet: period != 0,
+		VcpuPeriod:    period,
+		VcpuQuotaSet:  quota > 0,
+		VcpuQuota:     uint64(quota),
+	}
+	defer timeLibvirtCall("virDomainSetSchedulerParametersFlags", domain.domainName())()
+	return domain.d.SetSchedulerParametersFlags(params, flags)
+}
+
+func (domain *LibvirtDomain) PinEmulator(cpuSet string) error {
+	cpuMap, err := parseCPUSet(cpuSet)
+	if err != nil {
+		return err
+	}
+	defer timeLibvirtCall("virDomainPinEmulator", domain.domainName())()
+	return domain.d.PinEmulator(cpuMap, libvirt.DOMAIN_AFFECT_CONFIG)
+}
+
 type LibvirtSecret struct {
 	s *libvirt.Secret
 }
 
 func (secret *LibvirtSecret) SetValue(value []byte) error {
+	defer timeLibvirtCall("virSecretSetValue", "")()
 	return secret.s.SetValue(value, 0)
 }
 
 func (secret *LibvirtSecret) Remove() error {
+	defer timeLibvirtCall("virSecretUndefine", "")()
 	return secret.s.Undefine()
 }
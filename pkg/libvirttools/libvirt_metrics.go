@@ -0,0 +1,136 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// libvirtCallBuckets are the upper bounds of libvirt call duration
+// histogram buckets in seconds
+var libvirtCallBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type libvirtCallHistogram struct {
+	// counts holds the number of calls per bucket, with the last
+	// item corresponding to the calls that took longer than the
+	// last bucket bound
+	counts []uint64
+	sum    time.Duration
+}
+
+// libvirtCallMetrics keeps the duration histograms of libvirt API
+// calls and logs the calls that take too long
+type libvirtCallMetrics struct {
+	sync.Mutex
+	slowThreshold time.Duration
+	calls         map[string]*libvirtCallHistogram
+}
+
+func newLibvirtCallMetrics() *libvirtCallMetrics {
+	return &libvirtCallMetrics{calls: make(map[string]*libvirtCallHistogram)}
+}
+
+var libvirtMetrics = newLibvirtCallMetrics()
+
+// SetSlowLibvirtCallThreshold sets the duration after which the
+// libvirt API calls are logged as slow ones. Zero value disables
+// slow call logging
+func SetSlowLibvirtCallThreshold(threshold time.Duration) {
+	libvirtMetrics.Lock()
+	defer libvirtMetrics.Unlock()
+	libvirtMetrics.slowThreshold = threshold
+}
+
+// WriteLibvirtMetrics writes libvirt API call duration histograms
+// in Prometheus text exposition format
+func WriteLibvirtMetrics(w io.Writer) error {
+	return libvirtMetrics.write(w)
+}
+
+// timeLibvirtCall starts timing a libvirt API call. object is the
+// name of the domain or another libvirt object the call is made
+// for, if any. The returned function must be invoked after the call
+// completes, e.g. defer timeLibvirtCall("virDomainCreate", name)()
+func timeLibvirtCall(call, object string) func() {
+	start := time.Now()
+	return func() {
+		libvirtMetrics.record(call, object, time.Since(start))
+	}
+}
+
+func (m *libvirtCallMetrics) record(call, object string, d time.Duration) {
+	m.Lock()
+	h, found := m.calls[call]
+	if !found {
+		h = &libvirtCallHistogram{counts: make([]uint64, len(libvirtCallBuckets)+1)}
+		m.calls[call] = h
+	}
+	n := sort.SearchFloat64s(libvirtCallBuckets, d.Seconds())
+	h.counts[n]++
+	h.sum += d
+	slowThreshold := m.slowThreshold
+	m.Unlock()
+
+	if slowThreshold <= 0 || d < slowThreshold {
+		return
+	}
+	if object == "" {
+		glog.Warningf("Slow libvirt call: %s took %v", call, d)
+	} else {
+		glog.Warningf("Slow libvirt call: %s for %q took %v", call, object, d)
+	}
+}
+
+func (m *libvirtCallMetrics) write(w io.Writer) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, err := io.WriteString(w, "# HELP virtlet_libvirt_call_duration_seconds Duration of libvirt API calls.\n# TYPE virtlet_libvirt_call_duration_seconds histogram\n"); err != nil {
+		return err
+	}
+	var calls []string
+	for call := range m.calls {
+		calls = append(calls, call)
+	}
+	sort.Strings(calls)
+	for _, call := range calls {
+		h := m.calls[call]
+		var count uint64
+		for n, bound := range libvirtCallBuckets {
+			count += h.counts[n]
+			if _, err := fmt.Fprintf(w, "virtlet_libvirt_call_duration_seconds_bucket{call=%q,le=%q} %d\n",
+				call, strconv.FormatFloat(bound, 'g', -1, 64), count); err != nil {
+				return err
+			}
+		}
+		count += h.counts[len(libvirtCallBuckets)]
+		if _, err := fmt.Fprintf(w, "virtlet_libvirt_call_duration_seconds_bucket{call=%q,le=\"+Inf\"} %d\n", call, count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "virtlet_libvirt_call_duration_seconds_sum{call=%q} %g\nvirtlet_libvirt_call_duration_seconds_count{call=%q} %d\n",
+			call, h.sum.Seconds(), call, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLibvirtCallMetrics(t *testing.T) {
+	m := newLibvirtCallMetrics()
+	m.slowThreshold = time.Second
+	m.record("virDomainCreate", "vm1", 3*time.Millisecond)
+	m.record("virDomainCreate", "vm2", 2*time.Second)
+	m.record("virDomainCreate", "vm3", 2*time.Minute)
+	m.record("virConnectListAllDomains", "", 50*time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := m.write(&buf); err != nil {
+		t.Fatalf("write(): %v", err)
+	}
+	expected := []string{
+		"# HELP virtlet_libvirt_call_duration_seconds Duration of libvirt API calls.",
+		"# TYPE virtlet_libvirt_call_duration_seconds histogram",
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="0.005"} 0`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="0.01"} 0`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="0.025"} 0`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="0.05"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="0.1"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="0.25"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="0.5"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="1"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="2.5"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="5"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="10"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="30"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="60"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virConnectListAllDomains",le="+Inf"} 1`,
+		`virtlet_libvirt_call_duration_seconds_sum{call="virConnectListAllDomains"} 0.05`,
+		`virtlet_libvirt_call_duration_seconds_count{call="virConnectListAllDomains"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="0.005"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="0.01"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="0.025"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="0.05"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="0.1"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="0.25"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="0.5"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="1"} 1`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="2.5"} 2`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="5"} 2`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="10"} 2`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="30"} 2`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="60"} 2`,
+		`virtlet_libvirt_call_duration_seconds_bucket{call="virDomainCreate",le="+Inf"} 3`,
+		`virtlet_libvirt_call_duration_seconds_sum{call="virDomainCreate"} 122.003`,
+		`virtlet_libvirt_call_duration_seconds_count{call="virDomainCreate"} 3`,
+		"",
+	}
+	if actual := buf.String(); actual != strings.Join(expected, "\n") {
+		t.Errorf("bad metrics output:\n%s", actual)
+	}
+}
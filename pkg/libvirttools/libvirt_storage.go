@@ -20,12 +20,15 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/golang/glog"
 	libvirt "github.com/libvirt/libvirt-go"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
 	"github.com/Mirantis/virtlet/pkg/diskimage"
+	"github.com/Mirantis/virtlet/pkg/utils"
 	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
@@ -45,7 +48,10 @@ func (sc *LibvirtStorageConnection) CreateStoragePool(def *libvirtxml.StoragePoo
 		return nil, err
 	}
 	glog.V(2).Infof("Creating storage pool:\n%s", xml)
-	p, err := sc.conn.StoragePoolCreateXML(xml, 0)
+	// build the pool so its directory is created if it doesn't exist
+	done := timeLibvirtCall("virStoragePoolCreateXML", def.Name)
+	p, err := sc.conn.StoragePoolCreateXML(xml, libvirt.STORAGE_POOL_CREATE_WITH_BUILD)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -53,7 +59,9 @@ func (sc *LibvirtStorageConnection) CreateStoragePool(def *libvirtxml.StoragePoo
 }
 
 func (sc *LibvirtStorageConnection) LookupStoragePoolByName(name string) (virt.VirtStoragePool, error) {
+	done := timeLibvirtCall("virStoragePoolLookupByName", name)
 	p, err := sc.conn.LookupStoragePoolByName(name)
+	done()
 	if err != nil {
 		libvirtErr, ok := err.(libvirt.Error)
 		if ok && libvirtErr.Code == libvirt.ERR_NO_STORAGE_POOL {
@@ -71,13 +79,113 @@ type LibvirtStoragePool struct {
 
 var _ virt.VirtStoragePool = &LibvirtStoragePool{}
 
-func (pool *LibvirtStoragePool) CreateStorageVol(def *libvirtxml.StorageVolume) (virt.VirtStorageVolume, error) {
+// poolName returns the name of the pool for use in libvirt call
+// metrics. virStoragePoolGetName() doesn't involve a call to libvirtd
+func (pool *LibvirtStoragePool) poolName() string {
+	name, err := pool.p.GetName()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+func (pool *LibvirtStoragePool) refresh() error {
+	defer timeLibvirtCall("virStoragePoolRefresh", pool.poolName())()
+	return pool.p.Refresh(0)
+}
+
+// applyQCOW2Options returns a copy of the volume definition updated
+// according to qcow2 options along with the flags for libvirt volume
+// creation calls. allocation is used for falloc preallocation mode.
+func applyQCOW2Options(def *libvirtxml.StorageVolume, opts *virt.QCOW2Options, allocation *libvirtxml.StorageVolumeSize) (*libvirtxml.StorageVolume, libvirt.StorageVolCreateFlags) {
+	if opts == nil {
+		return def, 0
+	}
+	d := *def
+	var target libvirtxml.StorageVolumeTarget
+	if d.Target != nil {
+		target = *d.Target
+	}
+	d.Target = &target
+	if opts.LazyRefcounts {
+		target.Compat = "1.1"
+		target.Features = []libvirtxml.StorageVolumeTargetFeature{{LazyRefcounts: &struct{}{}}}
+	}
+	var flags libvirt.StorageVolCreateFlags
+	switch opts.Preallocation {
+	case "metadata":
+		flags |= libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA
+		d.Allocation = &libvirtxml.StorageVolumeSize{Value: 0}
+	case "falloc":
+		// libvirt uses preallocation=falloc instead of
+		// preallocation=metadata when the allocation isn't
+		// less than the capacity
+		flags |= libvirt.STORAGE_VOL_CREATE_PREALLOC_METADATA
+		d.Allocation = allocation
+	}
+	return &d, flags
+}
+
+// qemuImgOptions returns qcow2 options in qemu-img -o format
+func qemuImgOptions(opts *virt.QCOW2Options) string {
+	var r []string
+	if opts.LazyRefcounts {
+		r = append(r, "compat=1.1", "lazy_refcounts=on")
+	}
+	if opts.Preallocation != "" {
+		r = append(r, "preallocation="+opts.Preallocation)
+	}
+	if opts.ClusterSize != 0 {
+		r = append(r, fmt.Sprintf("cluster_size=%d", opts.ClusterSize))
+	}
+	return strings.Join(r, ",")
+}
+
+// rewriteQCOW2Volume replaces the file of the volume with the one
+// made by qemu-img. This is needed to apply the options that libvirt
+// doesn't support, such as cluster_size. If srcPath is not empty,
+// the contents of the volume are copied from it.
+func (pool *LibvirtStoragePool) rewriteQCOW2Volume(vol *LibvirtStorageVolume, srcPath string, opts *virt.QCOW2Options) error {
+	volPath, err := vol.Path()
+	if err != nil {
+		return fmt.Errorf("can't get volume path: %v", err)
+	}
+	tmpPath := volPath + ".tmp"
+	var args []string
+	if srcPath == "" {
+		size, err := vol.Size()
+		if err != nil {
+			return fmt.Errorf("can't get volume size: %v", err)
+		}
+		args = []string{"create", "-f", "qcow2", "-o", qemuImgOptions(opts), tmpPath, strconv.FormatUint(size, 10)}
+	} else {
+		args = []string{"convert", "-O", "qcow2", "-o", qemuImgOptions(opts), srcPath, tmpPath}
+	}
+	glog.V(2).Infof("Recreating volume %q using qemu-img %s", vol.Name(), strings.Join(args, " "))
+	if out, err := utils.RunSandboxed(utils.QemuImgLimits, "qemu-img", args...); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	if err := os.Rename(tmpPath, volPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := pool.refresh(); err != nil {
+		return fmt.Errorf("failed to refresh the storage pool: %v", err)
+	}
+	return nil
+}
+
+func (pool *LibvirtStoragePool) CreateStorageVol(def *libvirtxml.StorageVolume, opts *virt.QCOW2Options) (virt.VirtStorageVolume, error) {
+	def, flags := applyQCOW2Options(def, opts, def.Capacity)
 	xml, err := def.Marshal()
 	if err != nil {
 		return nil, err
 	}
 	glog.V(2).Infof("Creating storage volume:\n%s", xml)
-	v, err := pool.p.StorageVolCreateXML(xml, 0)
+	done := timeLibvirtCall("virStorageVolCreateXML", def.Name)
+	v, err := pool.p.StorageVolCreateXML(xml, flags)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -85,27 +193,58 @@ func (pool *LibvirtStoragePool) CreateStorageVol(def *libvirtxml.StorageVolume)
 	// qcow2-based volumes for some time after creating them.
 	// Here we work around this problem by refreshing the pool
 	// which invokes acquiring volume info.
-	if err := pool.p.Refresh(0); err != nil {
+	if err := pool.refresh(); err != nil {
 		return nil, fmt.Errorf("failed to refresh the storage pool: %v", err)
 	}
-	return &LibvirtStorageVolume{name: def.Name, v: v}, nil
+	vol := &LibvirtStorageVolume{name: def.Name, v: v}
+	if opts != nil && opts.ClusterSize != 0 {
+		if err := pool.rewriteQCOW2Volume(vol, "", opts); err != nil {
+			vol.Remove()
+			return nil, err
+		}
+	}
+	return vol, nil
 }
 
-func (pool *LibvirtStoragePool) CreateStorageVolClone(def *libvirtxml.StorageVolume, from virt.VirtStorageVolume) (virt.VirtStorageVolume, error) {
+func (pool *LibvirtStoragePool) CreateStorageVolClone(def *libvirtxml.StorageVolume, from virt.VirtStorageVolume, opts *virt.QCOW2Options) (virt.VirtStorageVolume, error) {
+	var allocation *libvirtxml.StorageVolumeSize
+	if opts != nil && opts.Preallocation == "falloc" {
+		size, err := from.Size()
+		if err != nil {
+			return nil, fmt.Errorf("can't get the size of the source volume: %v", err)
+		}
+		allocation = &libvirtxml.StorageVolumeSize{Unit: "b", Value: size}
+	}
+	def, flags := applyQCOW2Options(def, opts, allocation)
 	xml, err := def.Marshal()
 	if err != nil {
 		return nil, err
 	}
 	glog.V(2).Infof("Creating storage volume clone:\n%s", xml)
-	v, err := pool.p.StorageVolCreateXMLFrom(xml, from.(*LibvirtStorageVolume).v, 0)
+	done := timeLibvirtCall("virStorageVolCreateXMLFrom", def.Name)
+	v, err := pool.p.StorageVolCreateXMLFrom(xml, from.(*LibvirtStorageVolume).v, flags)
+	done()
 	if err != nil {
 		return nil, err
 	}
-	return &LibvirtStorageVolume{name: def.Name, v: v}, nil
+	vol := &LibvirtStorageVolume{name: def.Name, v: v}
+	if opts != nil && opts.ClusterSize != 0 {
+		srcPath, err := from.Path()
+		if err == nil {
+			err = pool.rewriteQCOW2Volume(vol, srcPath, opts)
+		}
+		if err != nil {
+			vol.Remove()
+			return nil, err
+		}
+	}
+	return vol, nil
 }
 
 func (pool *LibvirtStoragePool) ListAllVolumes() ([]virt.VirtStorageVolume, error) {
+	done := timeLibvirtCall("virStoragePoolListAllVolumes", pool.poolName())
 	volumes, err := pool.p.ListAllStorageVolumes(0)
+	done()
 	if err != nil {
 		return nil, err
 	}
@@ -123,7 +262,9 @@ func (pool *LibvirtStoragePool) ListAllVolumes() ([]virt.VirtStorageVolume, erro
 }
 
 func (pool *LibvirtStoragePool) LookupVolumeByName(name string) (virt.VirtStorageVolume, error) {
+	done := timeLibvirtCall("virStorageVolLookupByName", name)
 	v, err := pool.p.LookupStorageVolByName(name)
+	done()
 	if err != nil {
 		libvirtErr, ok := err.(libvirt.Error)
 		if ok && libvirtErr.Code == libvirt.ERR_NO_STORAGE_VOL {
@@ -149,7 +290,7 @@ func (pool *LibvirtStoragePool) ImageToVolume(def *libvirtxml.StorageVolume, sou
 	}
 	defer f.Close()
 
-	vol, err := pool.CreateStorageVol(def)
+	vol, err := pool.CreateStorageVol(def, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -159,6 +300,8 @@ func (pool *LibvirtStoragePool) ImageToVolume(def *libvirtxml.StorageVolume, sou
 		return nil, err
 	}
 
+	// the whole upload is timed as a single call
+	defer timeLibvirtCall("virStorageVolUpload", def.Name)()
 	err = vol.(*LibvirtStorageVolume).v.Upload(stream, 0, 0, 0)
 	if err != nil {
 		return nil, err
@@ -213,18 +356,32 @@ func (volume *LibvirtStorageVolume) Name() string {
 }
 
 func (volume *LibvirtStorageVolume) Size() (uint64, error) {
+	done := timeLibvirtCall("virStorageVolGetInfo", volume.name)
 	info, err := volume.v.GetInfo()
+	done()
 	if err != nil {
 		return 0, err
 	}
 	return info.Capacity, nil
 }
 
+func (volume *LibvirtStorageVolume) Allocation() (uint64, error) {
+	done := timeLibvirtCall("virStorageVolGetInfo", volume.name)
+	info, err := volume.v.GetInfo()
+	done()
+	if err != nil {
+		return 0, err
+	}
+	return info.Allocation, nil
+}
+
 func (volume *LibvirtStorageVolume) Path() (string, error) {
+	defer timeLibvirtCall("virStorageVolGetPath", volume.name)()
 	return volume.v.GetPath()
 }
 
 func (volume *LibvirtStorageVolume) Remove() error {
+	defer timeLibvirtCall("virStorageVolDelete", volume.name)()
 	return volume.v.Delete(0)
 }
 
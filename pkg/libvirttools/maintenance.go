@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+const (
+	// DrainStopping means that the VM is being shut down
+	DrainStopping = "stopping"
+	// DrainStopped means that the VM was shut down
+	DrainStopped = "stopped"
+	// DrainFailed means that the VM could not be shut down
+	DrainFailed = "failed"
+)
+
+var errMaintenance = errors.New("the node is in maintenance mode, not creating new VMs")
+
+// DrainEvent describes the progress of draining the node
+type DrainEvent struct {
+	// ContainerId is the id of the container that
+	// corresponds to the VM
+	ContainerId string `json:"containerId"`
+	// PodNamespace is the namespace of the VM pod
+	PodNamespace string `json:"podNamespace"`
+	// PodName is the name of the VM pod
+	PodName string `json:"podName"`
+	// Status is one of DrainStopping, DrainStopped
+	// and DrainFailed
+	Status string `json:"status"`
+	// Error describes the shutdown failure
+	Error string `json:"error,omitempty"`
+}
+
+// SetMaintenance enables or disables the maintenance mode of the
+// node. No new VMs can be created while it's enabled
+func (v *VirtualizationTool) SetMaintenance(enable bool) {
+	var value int32
+	if enable {
+		value = 1
+	}
+	if atomic.SwapInt32(&v.maintenance, value) != value {
+		glog.V(1).Infof("Node maintenance mode enabled: %v", enable)
+	}
+}
+
+// InMaintenance returns true if the node is in maintenance mode
+func (v *VirtualizationTool) InMaintenance() bool {
+	return atomic.LoadInt32(&v.maintenance) != 0
+}
+
+type drainItem struct {
+	event     DrainEvent
+	createdAt int64
+}
+
+// drainItems returns the VMs that are to be shut down in the order
+// of shutdown, which is the reverse order of their creation
+func (v *VirtualizationTool) drainItems() ([]drainItem, error) {
+	sandboxes, err := v.metadataStore.ListPodSandboxes(nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list pod sandboxes: %v", err)
+	}
+	var items []drainItem
+	for _, sandbox := range sandboxes {
+		sandboxInfo, err := sandbox.Retrieve()
+		if err != nil {
+			return nil, fmt.Errorf("cannot retrieve pod sandbox %q: %v", sandbox.GetID(), err)
+		}
+		if sandboxInfo == nil {
+			continue
+		}
+		containers, err := v.metadataStore.ListPodContainers(sandbox.GetID())
+		if err != nil {
+			return nil, fmt.Errorf("cannot list containers for pod %s: %v", sandbox.GetID(), err)
+		}
+		for _, container := range containers {
+			containerInfo, err := container.Retrieve()
+			if err != nil {
+				return nil, fmt.Errorf("cannot retrieve container %q: %v", container.GetID(), err)
+			}
+			if containerInfo == nil || containerInfo.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+				continue
+			}
+			items = append(items, drainItem{
+				event: DrainEvent{
+					ContainerId:  container.GetID(),
+					PodNamespace: sandboxInfo.Metadata.Namespace,
+					PodName:      sandboxInfo.Metadata.Name,
+				},
+				createdAt: containerInfo.CreatedAt,
+			})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].createdAt > items[j].createdAt
+	})
+	return items, nil
+}
+
+// Drain puts the node into maintenance mode and shuts down the
+// running VMs one by one, most recently created first, giving each
+// of them the specified timeout to shut down gracefully before
+// powering it off. progress is invoked before and after shutting
+// down each VM. The node stays in maintenance mode after Drain
+// returns. An error is returned if any of the VMs couldn't be
+// shut down
+func (v *VirtualizationTool) Drain(timeout time.Duration, progress func(DrainEvent)) error {
+	v.SetMaintenance(true)
+	items, err := v.drainItems()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, item := range items {
+		event := item.event
+		event.Status = DrainStopping
+		progress(event)
+		if err := v.StopContainer(event.ContainerId, timeout); err != nil {
+			glog.Errorf("Error stopping container %q (pod %s/%s) during drain: %v", event.ContainerId, event.PodNamespace, event.PodName, err)
+			event.Status = DrainFailed
+			event.Error = err.Error()
+			failed++
+		} else {
+			event.Status = DrainStopped
+		}
+		progress(event)
+	}
+	if failed != 0 {
+		return fmt.Errorf("failed to stop %d of %d VMs", failed, len(items))
+	}
+	return nil
+}
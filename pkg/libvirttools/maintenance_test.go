@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestDrain(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandboxes := criapi.GetSandboxes(3)
+	var containerIds []string
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+		containerId := ct.createContainer(sandbox, nil)
+		containerIds = append(containerIds, containerId)
+		ct.clock.Advance(time.Second)
+	}
+	// the last VM is not running and must not be touched
+	ct.startContainer(containerIds[0])
+	ct.startContainer(containerIds[1])
+
+	var events []DrainEvent
+	if err := ct.virtTool.Drain(time.Minute, func(event DrainEvent) {
+		events = append(events, event)
+	}); err != nil {
+		t.Fatalf("Drain(): %v", err)
+	}
+	var expectedEvents []DrainEvent
+	for _, n := range []int{1, 0} {
+		for _, status := range []string{DrainStopping, DrainStopped} {
+			expectedEvents = append(expectedEvents, DrainEvent{
+				ContainerId:  containerIds[n],
+				PodNamespace: sandboxes[n].Metadata.Namespace,
+				PodName:      sandboxes[n].Metadata.Name,
+				Status:       status,
+			})
+		}
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("bad drain events: %#v instead of %#v", events, expectedEvents)
+	}
+	for _, containerId := range containerIds[:2] {
+		if status := ct.containerStatus(containerId); status.State != kubeapi.ContainerState_CONTAINER_EXITED {
+			t.Errorf("container %q wasn't stopped: %s", containerId, status.State)
+		}
+	}
+
+	if !ct.virtTool.InMaintenance() {
+		t.Errorf("the node is not in maintenance mode after drain")
+	}
+	vmConfig, err := GetVMConfig(&kubeapi.CreateContainerRequest{
+		PodSandboxId: sandboxes[0].Metadata.Uid,
+		Config: &kubeapi.ContainerConfig{
+			Metadata: &kubeapi.ContainerMetadata{Name: fakeContainerName},
+			Image:    &kubeapi.ImageSpec{Image: fakeImageName},
+		},
+		SandboxConfig: sandboxes[0],
+	}, "")
+	if err != nil {
+		t.Fatalf("GetVMConfig(): %v", err)
+	}
+	if _, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns"); err != errMaintenance {
+		t.Errorf("CreateContainer() in maintenance mode: expected errMaintenance, got %v", err)
+	}
+
+	ct.virtTool.SetMaintenance(false)
+	ct.removeContainer(containerIds[0])
+	ct.createContainer(sandboxes[0], nil)
+}
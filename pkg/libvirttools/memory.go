@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// memoryOvercommitRatioEnvVar specifies the ratio between
+	// the memory of the VMs and their pods' memory limits
+	memoryOvercommitRatioEnvVar = "VIRTLET_MEMORY_OVERCOMMIT_RATIO"
+	// ksmSettingsEnvVar specifies the kernel samepage merging
+	// settings to apply on the node when Virtlet starts
+	ksmSettingsEnvVar = "VIRTLET_KSM_SETTINGS"
+	// GuestMemoryAnnotationKeyName is the name of container
+	// status annotation that reports the amount of memory
+	// visible to the guest in bytes
+	GuestMemoryAnnotationKeyName = "VirtletGuestMemory"
+	maxMemoryOvercommitRatio     = 10
+)
+
+// ksmSysfsDir is a var so it can be overridden in tests
+var ksmSysfsDir = "/sys/kernel/mm/ksm"
+
+// ksmSettingNames lists the KSM settings that can
+// be changed via VIRTLET_KSM_SETTINGS
+var ksmSettingNames = map[string]bool{
+	"run":                true,
+	"pages_to_scan":      true,
+	"sleep_millisecs":    true,
+	"merge_across_nodes": true,
+	"use_zero_pages":     true,
+	"max_page_sharing":   true,
+}
+
+// memoryOvercommitRatio returns the memory overcommit ratio
+// set via VIRTLET_MEMORY_OVERCOMMIT_RATIO, 1 meaning no
+// overcommit
+func memoryOvercommitRatio() (float64, error) {
+	s := strings.TrimSpace(os.Getenv(memoryOvercommitRatioEnvVar))
+	if s == "" {
+		return 1, nil
+	}
+	ratio, err := strconv.ParseFloat(s, 64)
+	if err != nil || ratio < 1 || ratio > maxMemoryOvercommitRatio {
+		return 0, fmt.Errorf("bad %s value %q: must be a number between 1 and %d", memoryOvercommitRatioEnvVar, s, maxMemoryOvercommitRatio)
+	}
+	return ratio, nil
+}
+
+// guestMemory returns the amount of the guest memory for
+// the specified pod memory limit
+func guestMemory(memoryLimit int64, ratio float64) int64 {
+	return int64(float64(memoryLimit) * ratio)
+}
+
+// podMemoryLimit returns the pod memory limit for the
+// specified amount of the guest memory, reversing guestMemory()
+func podMemoryLimit(memory int64, ratio float64) int64 {
+	return int64(math.Ceil(float64(memory) / ratio))
+}
+
+// parseKSMSettings parses KSM settings in
+// name=value[,name=value...] format
+func parseKSMSettings(s string) (map[string]uint64, error) {
+	r := map[string]uint64{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad KSM setting %q, must be name=value", item)
+		}
+		if !ksmSettingNames[parts[0]] {
+			return nil, fmt.Errorf("unsupported KSM setting %q", parts[0])
+		}
+		value, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad value for KSM setting %q: %q", parts[0], parts[1])
+		}
+		r[parts[0]] = value
+	}
+	return r, nil
+}
+
+// configureKSM applies the KSM settings specified via
+// VIRTLET_KSM_SETTINGS. run=1 setting enables merging
+// of the identical memory pages of the VMs.
+func configureKSM() error {
+	settings, err := parseKSMSettings(os.Getenv(ksmSettingsEnvVar))
+	if err != nil {
+		return fmt.Errorf("error parsing %s: %v", ksmSettingsEnvVar, err)
+	}
+	// run must be set last so KSM starts with the new settings
+	var names []string
+	for name := range settings {
+		if name != "run" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, found := settings["run"]; found {
+		names = append(names, "run")
+	}
+	for _, name := range names {
+		value := strconv.FormatUint(settings[name], 10)
+		if err := ioutil.WriteFile(filepath.Join(ksmSysfsDir, name), []byte(value), 0644); err != nil {
+			return fmt.Errorf("error setting KSM %s to %s: %v", name, value, err)
+		}
+		glog.V(1).Infof("KSM: %s = %s", name, value)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestGuestMemory(t *testing.T) {
+	for _, ratio := range []float64{1, 1.3, 1.5, 2, 3.7} {
+		for _, limit := range []int64{1, 1000, 1234567, 512 * 1024 * 1024, 3*1024*1024*1024 + 7} {
+			memory := guestMemory(limit, ratio)
+			if memory < limit {
+				t.Errorf("guest memory %d is less than the limit %d (ratio %v)", memory, limit, ratio)
+			}
+			if restored := podMemoryLimit(memory, ratio); restored != limit {
+				t.Errorf("bad pod memory limit restored from %d (ratio %v): %d instead of %d", memory, ratio, restored, limit)
+			}
+		}
+	}
+}
+
+func TestParseKSMSettings(t *testing.T) {
+	for _, tc := range []struct {
+		str      string
+		settings map[string]uint64
+	}{
+		{
+			str:      "",
+			settings: map[string]uint64{},
+		},
+		{
+			str:      "run=1, pages_to_scan=1000,sleep_millisecs=50",
+			settings: map[string]uint64{"run": 1, "pages_to_scan": 1000, "sleep_millisecs": 50},
+		},
+		{str: "run"},
+		{str: "run=yes"},
+		{str: "full_scans=1"},
+	} {
+		t.Run(tc.str, func(t *testing.T) {
+			settings, err := parseKSMSettings(tc.str)
+			switch {
+			case tc.settings == nil && err == nil:
+				t.Errorf("didn't get an error for bad KSM settings")
+			case tc.settings != nil && err != nil:
+				t.Errorf("parseKSMSettings(): %v", err)
+			case !reflect.DeepEqual(settings, tc.settings):
+				t.Errorf("bad KSM settings: %#v instead of %#v", settings, tc.settings)
+			}
+		})
+	}
+}
+
+func TestConfigureKSM(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ksm-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	savedKSMSysfsDir := ksmSysfsDir
+	ksmSysfsDir = tmpDir
+	defer func() {
+		ksmSysfsDir = savedKSMSysfsDir
+	}()
+
+	os.Setenv(ksmSettingsEnvVar, "run=1,pages_to_scan=1000")
+	defer os.Unsetenv(ksmSettingsEnvVar)
+	if err := configureKSM(); err != nil {
+		t.Fatalf("configureKSM(): %v", err)
+	}
+	for name, expected := range map[string]string{"run": "1", "pages_to_scan": "1000"} {
+		value, err := ioutil.ReadFile(filepath.Join(tmpDir, name))
+		if err != nil {
+			t.Errorf("can't read KSM setting %q: %v", name, err)
+		} else if string(value) != expected {
+			t.Errorf("bad value for KSM setting %q: %q instead of %q", name, value, expected)
+		}
+	}
+}
+
+func TestMemoryOvercommit(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.SetMemoryOvercommitRatio(1.5)
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	memoryLimit := int64(512 * 1024 * 1024)
+	vmConfig, err := GetVMConfig(&kubeapi.CreateContainerRequest{
+		PodSandboxId: sandbox.Metadata.Uid,
+		Config: &kubeapi.ContainerConfig{
+			Metadata: &kubeapi.ContainerMetadata{Name: fakeContainerName},
+			Image:    &kubeapi.ImageSpec{Image: fakeImageName},
+			Linux: &kubeapi.LinuxContainerConfig{
+				Resources: &kubeapi.LinuxContainerResources{MemoryLimitInBytes: memoryLimit},
+			},
+		},
+		SandboxConfig: sandbox,
+	}, "")
+	if err != nil {
+		t.Fatalf("GetVMConfig(): %v", err)
+	}
+	containerId, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+	if err != nil {
+		t.Fatalf("CreateContainer(): %v", err)
+	}
+
+	d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	def, err := d.Xml()
+	if err != nil {
+		t.Fatalf("Xml(): %v", err)
+	}
+	expectedMemory := memoryLimit * 3 / 2
+	if def.Memory == nil || int64(def.Memory.Value)*memoryUnitMultipliers[def.Memory.Unit] != expectedMemory {
+		t.Errorf("bad domain memory: %#v", def.Memory)
+	}
+
+	status := ct.containerStatus(containerId)
+	if status.Annotations[GuestMemoryAnnotationKeyName] != strconv.FormatInt(expectedMemory, 10) {
+		t.Errorf("bad guest memory annotation: %q", status.Annotations[GuestMemoryAnnotationKeyName])
+	}
+}
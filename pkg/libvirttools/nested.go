@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// nestedVirtParams maps the CPU features needed for nested
+// virtualization to the KVM module parameters that enable it
+// on the host. It's a var so it can be overridden in tests
+var nestedVirtParams = []struct {
+	feature   string
+	paramPath string
+}{
+	{"vmx", "/sys/module/kvm_intel/parameters/nested"},
+	{"svm", "/sys/module/kvm_amd/parameters/nested"},
+}
+
+// nestedVirtFeature returns the CPU feature ("vmx" for Intel or
+// "svm" for AMD) that must be passed to the guests to run
+// hypervisors inside them, or an empty string if nested
+// virtualization is not enabled on the node
+func nestedVirtFeature() (string, error) {
+	for _, p := range nestedVirtParams {
+		value, err := ioutil.ReadFile(p.paramPath)
+		switch {
+		case os.IsNotExist(err):
+			// the module is not loaded
+			continue
+		case err != nil:
+			return "", fmt.Errorf("error checking nested virtualization support: %v", err)
+		}
+		switch strings.TrimSpace(string(value)) {
+		case "Y", "1":
+			return p.feature, nil
+		}
+	}
+	return "", nil
+}
+
+// nestedVirtSettings returns the CPU feature to enable for the VMs
+// that use nested virtualization, or an error if it's not possible
+// to run such VMs on the node
+func nestedVirtSettings(useKvm bool) (string, error) {
+	if !useKvm {
+		return "", fmt.Errorf("nested virtualization requires KVM")
+	}
+	feature, err := nestedVirtFeature()
+	if err != nil {
+		return "", err
+	}
+	if feature == "" {
+		return "", fmt.Errorf("nested virtualization is not enabled on the node (the nested parameter of kvm_intel or kvm_amd module must be set to 1)")
+	}
+	return feature, nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestNestedVirtualization(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		intelNested     string
+		amdNested       string
+		expectedFeature string
+	}{
+		{
+			name:            "intel",
+			intelNested:     "Y\n",
+			expectedFeature: "vmx",
+		},
+		{
+			name:            "amd",
+			amdNested:       "1\n",
+			expectedFeature: "svm",
+		},
+		{
+			name:        "disabled",
+			intelNested: "N\n",
+		},
+		{
+			name: "no kvm modules",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, fake.NewToplevelRecorder())
+			defer ct.teardown()
+
+			origNestedVirtParams := nestedVirtParams
+			defer func() { nestedVirtParams = origNestedVirtParams }()
+			intelParamPath := filepath.Join(ct.tmpDir, "kvm_intel_nested")
+			amdParamPath := filepath.Join(ct.tmpDir, "kvm_amd_nested")
+			nestedVirtParams = []struct {
+				feature   string
+				paramPath string
+			}{
+				{"vmx", intelParamPath},
+				{"svm", amdParamPath},
+			}
+			for path, value := range map[string]string{intelParamPath: tc.intelNested, amdParamPath: tc.amdNested} {
+				if value == "" {
+					continue
+				}
+				if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+					t.Fatalf("WriteFile(): %v", err)
+				}
+			}
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			sandbox.Annotations[NestedVirtualizationKeyName] = "true"
+			ct.setPodSandbox(sandbox)
+			vmConfig, err := GetVMConfig(&kubeapi.CreateContainerRequest{
+				PodSandboxId: sandbox.Metadata.Uid,
+				Config: &kubeapi.ContainerConfig{
+					Metadata: &kubeapi.ContainerMetadata{Name: fakeContainerName},
+					Image:    &kubeapi.ImageSpec{Image: fakeImageName},
+				},
+				SandboxConfig: sandbox,
+			}, "")
+			if err != nil {
+				t.Fatalf("GetVMConfig(): %v", err)
+			}
+			containerId, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+			if tc.expectedFeature == "" {
+				if err == nil {
+					t.Errorf("CreateContainer() didn't fail on a node without nested virtualization support")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CreateContainer(): %v", err)
+			}
+
+			d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+			if err != nil {
+				t.Fatalf("LookupDomainByUUIDString(): %v", err)
+			}
+			def, err := d.Xml()
+			if err != nil {
+				t.Fatalf("Xml(): %v", err)
+			}
+			if def.CPU == nil || def.CPU.Mode != "host-model" || len(def.CPU.Features) != 1 ||
+				def.CPU.Features[0].Name != tc.expectedFeature || def.CPU.Features[0].Policy != "require" {
+				t.Errorf("bad domain cpu definition: %#v", def.CPU)
+			}
+		})
+	}
+}
@@ -34,6 +34,10 @@ type nocloudVolume struct {
 var _ VMVolume = &nocloudVolume{}
 
 func GetNocloudVolume(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
+	// the guests of adopted domains are already set up
+	if config.ParsedAnnotations != nil && config.ParsedAnnotations.AdoptDomain != "" {
+		return nil, nil
+	}
 	return []VMVolume{
 		&nocloudVolume{
 			volumeBase{config, owner},
@@ -21,6 +21,7 @@ import (
 	"regexp"
 	"strconv"
 
+	"github.com/golang/glog"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
 	"github.com/Mirantis/virtlet/pkg/utils"
@@ -43,6 +44,7 @@ var capacityRx = regexp.MustCompile(`^\s*(\d+)\s*(\S*)\s*$`)
 type qcow2VolumeOptions struct {
 	Capacity string `json:"capacity,omitempty"`
 	Uuid     string `json:"uuid"`
+	Pool     string `json:"pool,omitempty"`
 }
 
 // qcow2Volume denotes a volume in QCOW2 format
@@ -52,6 +54,7 @@ type qcow2Volume struct {
 	capacityUnit string
 	name         string
 	uuid         string
+	poolName     string
 }
 
 var _ VMVolume = &qcow2Volume{}
@@ -66,6 +69,7 @@ func newQCOW2Volume(volumeName, configPath string, config *VMConfig, owner Volum
 		volumeBase: volumeBase{config, owner},
 		name:       volumeName,
 		uuid:       opts.Uuid,
+		poolName:   opts.Pool,
 	}
 
 	v.capacity, v.capacityUnit, err = parseCapacityStr(opts.Capacity)
@@ -80,12 +84,33 @@ func (v *qcow2Volume) volumeName() string {
 }
 
 func (v *qcow2Volume) createQCOW2Volume(capacity uint64, capacityUnit string) (virt.VirtStorageVolume, error) {
-	return v.owner.StoragePool().CreateStorageVol(&libvirtxml.StorageVolume{
+	pool, err := v.owner.StoragePoolByName(v.poolName)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := qcow2OptionsForConfig(v.config)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := setupVolumeEncryption(v.config, v.owner, v.volumeName())
+	if err != nil {
+		return nil, err
+	}
+	vol, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
 		Name:       v.volumeName(),
 		Allocation: &libvirtxml.StorageVolumeSize{Value: 0},
 		Capacity:   &libvirtxml.StorageVolumeSize{Unit: capacityUnit, Value: capacity},
-		Target:     &libvirtxml.StorageVolumeTarget{Format: &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"}},
-	})
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format:     &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+			Encryption: encryption,
+		},
+	}, opts)
+	if err != nil && encryption != nil {
+		if err := teardownVolumeEncryption(v.owner, v.volumeName()); err != nil {
+			glog.Warningf("Error cleaning up after failed qcow2 volume creation: %v", err)
+		}
+	}
+	return vol, err
 }
 
 func (v *qcow2Volume) Uuid() string {
@@ -103,21 +128,31 @@ func (v *qcow2Volume) Setup() (*libvirtxml.DomainDisk, error) {
 		return nil, err
 	}
 
-	err = vol.Format()
-	if err != nil {
-		return nil, err
+	// libguestfs can't open LUKS-encrypted images without the
+	// passphrase, so encrypted volumes are left unformatted
+	if volumeEncryptionKey(v.config) == nil {
+		if err := vol.Format(); err != nil {
+			return nil, err
+		}
 	}
 
 	return &libvirtxml.DomainDisk{
 		Type:   "file",
 		Device: "disk",
 		Source: &libvirtxml.DomainDiskSource{File: path},
-		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2", Discard: "unmap"},
 	}, nil
 }
 
 func (v *qcow2Volume) Teardown() error {
-	return v.owner.StoragePool().RemoveVolumeByName(v.volumeName())
+	pool, err := v.owner.StoragePoolByName(v.poolName)
+	if err != nil {
+		return err
+	}
+	if err := pool.RemoveVolumeByName(v.volumeName()); err != nil {
+		return err
+	}
+	return teardownVolumeEncryption(v.owner, v.volumeName())
 }
 
 func parseCapacityStr(capacityStr string) (int, string, error) {
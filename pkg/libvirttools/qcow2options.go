@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	// qcow2OptionsEnvVar specifies the node-wide defaults for
+	// qcow2 volume creation options
+	qcow2OptionsEnvVar  = "VIRTLET_QCOW2_OPTIONS"
+	minQCOW2ClusterSize = 512
+	maxQCOW2ClusterSize = 2 * 1024 * 1024
+)
+
+var qcow2SizeSuffixes = map[string]uint64{
+	"":  1,
+	"k": 1024,
+	"K": 1024,
+	"M": 1024 * 1024,
+}
+
+func parseQCOW2ClusterSize(s string) (uint64, error) {
+	numStr, suffix := s, ""
+	if n := len(s); n > 0 && (s[n-1] < '0' || s[n-1] > '9') {
+		numStr, suffix = s[:n-1], s[n-1:]
+	}
+	mul, found := qcow2SizeSuffixes[suffix]
+	if !found {
+		return 0, fmt.Errorf("bad cluster size %q", s)
+	}
+	n, err := strconv.ParseUint(numStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad cluster size %q", s)
+	}
+	size := n * mul
+	if size < minQCOW2ClusterSize || size > maxQCOW2ClusterSize || size&(size-1) != 0 {
+		return 0, fmt.Errorf("bad cluster size %q: must be a power of 2 between %d and %d", s, minQCOW2ClusterSize, maxQCOW2ClusterSize)
+	}
+	return size, nil
+}
+
+// parseQCOW2Options parses qcow2 options in qemu-img -o format,
+// e.g. preallocation=metadata,cluster_size=64k,lazy_refcounts=on,
+// applying them over base
+func parseQCOW2Options(s string, base virt.QCOW2Options) (virt.QCOW2Options, error) {
+	opts := base
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return virt.QCOW2Options{}, fmt.Errorf("bad qcow2 option %q, must be name=value", item)
+		}
+		name, value := parts[0], parts[1]
+		switch name {
+		case "preallocation":
+			switch value {
+			case "off":
+				opts.Preallocation = ""
+			case "metadata", "falloc":
+				opts.Preallocation = value
+			default:
+				return virt.QCOW2Options{}, fmt.Errorf("bad qcow2 preallocation mode %q, must be one of off, metadata, falloc", value)
+			}
+		case "cluster_size":
+			size, err := parseQCOW2ClusterSize(value)
+			if err != nil {
+				return virt.QCOW2Options{}, err
+			}
+			opts.ClusterSize = size
+		case "lazy_refcounts":
+			switch value {
+			case "on":
+				opts.LazyRefcounts = true
+			case "off":
+				opts.LazyRefcounts = false
+			default:
+				return virt.QCOW2Options{}, fmt.Errorf("bad qcow2 lazy_refcounts value %q, must be on or off", value)
+			}
+		default:
+			return virt.QCOW2Options{}, fmt.Errorf("unsupported qcow2 option %q", name)
+		}
+	}
+	return opts, nil
+}
+
+// qcow2OptionsForConfig returns qcow2 volume creation options for
+// the VM, which are taken from VIRTLET_QCOW2_OPTIONS environment
+// variable and VirtletQCOW2Options pod annotation. nil is returned
+// if the default options should be used.
+func qcow2OptionsForConfig(config *VMConfig) (*virt.QCOW2Options, error) {
+	opts, err := parseQCOW2Options(os.Getenv(qcow2OptionsEnvVar), virt.QCOW2Options{})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", qcow2OptionsEnvVar, err)
+	}
+	if config.ParsedAnnotations != nil {
+		if opts, err = parseQCOW2Options(config.ParsedAnnotations.QCOW2Options, opts); err != nil {
+			return nil, err
+		}
+	}
+	// the volumes are recreated using qemu-img to apply
+	// cluster_size, which doesn't handle the encryption
+	if opts.ClusterSize != 0 && volumeEncryptionKey(config) != nil {
+		return nil, fmt.Errorf("qcow2 cluster_size option can't be used with encrypted volumes")
+	}
+	if opts == (virt.QCOW2Options{}) {
+		return nil, nil
+	}
+	return &opts, nil
+}
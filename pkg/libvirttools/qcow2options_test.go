@@ -0,0 +1,104 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+func TestParseQCOW2Options(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		spec     string
+		base     virt.QCOW2Options
+		expected virt.QCOW2Options
+		bad      bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "all options",
+			spec: "preallocation=falloc, cluster_size=64k,lazy_refcounts=on",
+			expected: virt.QCOW2Options{
+				Preallocation: "falloc",
+				ClusterSize:   65536,
+				LazyRefcounts: true,
+			},
+		},
+		{
+			name: "override base",
+			spec: "preallocation=off,lazy_refcounts=off,cluster_size=2M",
+			base: virt.QCOW2Options{
+				Preallocation: "metadata",
+				ClusterSize:   4096,
+				LazyRefcounts: true,
+			},
+			expected: virt.QCOW2Options{ClusterSize: 2097152},
+		},
+		{
+			name:     "keep base",
+			spec:     "cluster_size=512",
+			base:     virt.QCOW2Options{Preallocation: "metadata"},
+			expected: virt.QCOW2Options{Preallocation: "metadata", ClusterSize: 512},
+		},
+		{
+			name: "bad preallocation mode",
+			spec: "preallocation=full",
+			bad:  true,
+		},
+		{
+			name: "cluster size not a power of 2",
+			spec: "cluster_size=96k",
+			bad:  true,
+		},
+		{
+			name: "cluster size too big",
+			spec: "cluster_size=4M",
+			bad:  true,
+		},
+		{
+			name: "bad cluster size suffix",
+			spec: "cluster_size=64G",
+			bad:  true,
+		},
+		{
+			name: "no value",
+			spec: "lazy_refcounts",
+			bad:  true,
+		},
+		{
+			name: "unknown option",
+			spec: "encryption=on",
+			bad:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := parseQCOW2Options(tc.spec, tc.base)
+			switch {
+			case tc.bad && err == nil:
+				t.Errorf("parseQCOW2Options didn't fail for %q", tc.spec)
+			case !tc.bad && err != nil:
+				t.Errorf("parseQCOW2Options(%q): %v", tc.spec, err)
+			case !tc.bad && opts != tc.expected:
+				t.Errorf("bad qcow2 options: %#v instead of %#v", opts, tc.expected)
+			}
+		})
+	}
+}
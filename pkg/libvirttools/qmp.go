@@ -0,0 +1,208 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// DefaultQMPOutputDir is the directory where the files
+	// produced by the QMP commands such as guest memory dumps
+	// and external snapshots are placed. Each pod gets its own
+	// subdirectory named NAMESPACE_NAME there
+	DefaultQMPOutputDir = "/var/lib/virtlet/dumps"
+)
+
+// QMPCommand denotes a QMP command passed through
+// to the QEMU monitor of a VM
+type QMPCommand struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments,omitempty"`
+}
+
+// qmpArgsChecker verifies the arguments of a QMP command
+// against the output directory
+type qmpArgsChecker func(args map[string]interface{}, outputDir string) error
+
+// allowedQMPCommands lists the QMP commands that can be passed
+// through to the QEMU monitor. Commands that write files are only
+// allowed to create new files inside the QMP output directory of
+// the pod.
+var allowedQMPCommands = map[string]qmpArgsChecker{
+	"query-block":            nil,
+	"query-blockstats":       nil,
+	"query-cpus":             nil,
+	"query-dump":             nil,
+	"query-status":           nil,
+	"query-version":          nil,
+	"blockdev-snapshot-sync": checkQMPSnapshotArgs,
+	"dump-guest-memory":      checkQMPDumpArgs,
+}
+
+// AllowedQMPCommands returns the sorted list of QMP commands that
+// can be executed using QMPCommand()
+func AllowedQMPCommands() []string {
+	var r []string
+	for cmd := range allowedQMPCommands {
+		r = append(r, cmd)
+	}
+	sort.Strings(r)
+	return r
+}
+
+func checkQMPOutputPath(path, outputDir string) error {
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("output path must be absolute: %q", path)
+	}
+	cleaned := filepath.Clean(path)
+	if filepath.Dir(cleaned) != filepath.Clean(outputDir) {
+		return fmt.Errorf("output path %q is outside %q", path, outputDir)
+	}
+	// QEMU truncates the existing files, so the users could
+	// destroy the earlier dumps and snapshots if it was allowed
+	if _, err := os.Lstat(cleaned); err == nil {
+		return fmt.Errorf("output file %q already exists", path)
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("can't check output file %q: %v", path, err)
+	}
+	return nil
+}
+
+func checkQMPSnapshotArgs(args map[string]interface{}, outputDir string) error {
+	file, ok := args["snapshot-file"].(string)
+	if !ok {
+		return errors.New("snapshot-file must be specified")
+	}
+	if err := checkQMPOutputPath(file, outputDir); err != nil {
+		return err
+	}
+	// only create new images, never reuse existing files that
+	// could point outside the output directory
+	if mode, found := args["mode"]; found && mode != "absolute-paths" {
+		return fmt.Errorf("unsupported snapshot mode %v", mode)
+	}
+	return nil
+}
+
+func checkQMPDumpArgs(args map[string]interface{}, outputDir string) error {
+	protocol, ok := args["protocol"].(string)
+	if !ok || !strings.HasPrefix(protocol, "file:") {
+		return errors.New("dump protocol must be file:PATH")
+	}
+	return checkQMPOutputPath(strings.TrimPrefix(protocol, "file:"), outputDir)
+}
+
+// checkQMPCommand verifies that the command is allowed
+// to be passed through to the QEMU monitor
+func checkQMPCommand(cmd *QMPCommand, outputDir string) error {
+	checker, found := allowedQMPCommands[cmd.Execute]
+	if !found {
+		return fmt.Errorf("QMP command %q is not allowed", cmd.Execute)
+	}
+	if checker == nil {
+		if len(cmd.Arguments) != 0 {
+			return fmt.Errorf("QMP command %q doesn't accept arguments", cmd.Execute)
+		}
+		return nil
+	}
+	return checker(cmd.Arguments, outputDir)
+}
+
+// SetQMPOutputDir sets the directory where the files produced
+// by the QMP commands are placed
+func (v *VirtualizationTool) SetQMPOutputDir(dir string) {
+	v.qmpOutputDir = dir
+}
+
+// podQMPOutputDir returns the directory where the files produced
+// by the QMP commands for the pod of the container are placed
+func (v *VirtualizationTool) podQMPOutputDir(containerId string) (string, error) {
+	containerInfo, err := v.metadataStore.Container(containerId).Retrieve()
+	if err != nil {
+		return "", err
+	}
+	if containerInfo == nil {
+		return "", fmt.Errorf("container %q not found", containerId)
+	}
+	sandboxInfo, err := v.metadataStore.PodSandbox(containerInfo.SandboxID).Retrieve()
+	if err != nil {
+		return "", err
+	}
+	if sandboxInfo == nil || sandboxInfo.Metadata == nil {
+		return "", fmt.Errorf("pod sandbox of container %q not found", containerId)
+	}
+	podDir := sandboxInfo.Metadata.Namespace + "_" + sandboxInfo.Metadata.Name
+	return filepath.Join(v.qmpOutputDir, podDir), nil
+}
+
+// QMPCommand passes the QMP command through to the QEMU monitor of
+// the container VM, returning the "return" part of the response
+func (v *VirtualizationTool) QMPCommand(containerId string, cmd *QMPCommand) (json.RawMessage, error) {
+	outputDir, err := v.podQMPOutputDir(containerId)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkQMPCommand(cmd, outputDir); err != nil {
+		return nil, err
+	}
+	domain, err := v.runningDomain(containerId)
+	if err != nil {
+		return nil, err
+	}
+	if allowedQMPCommands[cmd.Execute] != nil {
+		// the command writes a file. The output directories
+		// are only accessible by root as the dumps contain
+		// the memory of the VMs
+		for _, dir := range []string{v.qmpOutputDir, outputDir} {
+			if err := os.MkdirAll(dir, 0700); err != nil {
+				return nil, fmt.Errorf("can't create QMP output dir %q: %v", dir, err)
+			}
+			if err := os.Chmod(dir, 0700); err != nil {
+				return nil, fmt.Errorf("can't set permissions of QMP output dir %q: %v", dir, err)
+			}
+		}
+	}
+	bs, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling QMP command: %v", err)
+	}
+	resp, err := domain.QemuMonitorCommand(string(bs))
+	if err != nil {
+		return nil, fmt.Errorf("QMP command %q failed: %v", cmd.Execute, err)
+	}
+	var msg struct {
+		Return json.RawMessage `json:"return"`
+		Error  *struct {
+			Class string `json:"class"`
+			Desc  string `json:"desc"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(resp), &msg); err != nil {
+		return nil, fmt.Errorf("error unmarshalling QMP response to %q: %v", cmd.Execute, err)
+	}
+	if msg.Error != nil {
+		return nil, fmt.Errorf("QMP command %q failed: %s: %s", cmd.Execute, msg.Error.Class, msg.Error.Desc)
+	}
+	return msg.Return, nil
+}
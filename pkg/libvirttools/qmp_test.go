@@ -0,0 +1,197 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestCheckQMPCommand(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cmd   QMPCommand
+		valid bool
+	}{
+		{
+			name:  "query",
+			cmd:   QMPCommand{Execute: "query-block"},
+			valid: true,
+		},
+		{
+			name: "query with arguments",
+			cmd:  QMPCommand{Execute: "query-status", Arguments: map[string]interface{}{"foo": "bar"}},
+		},
+		{
+			name: "command not in the allowed list",
+			cmd:  QMPCommand{Execute: "human-monitor-command", Arguments: map[string]interface{}{"command-line": "info block"}},
+		},
+		{
+			name: "memory dump",
+			cmd: QMPCommand{Execute: "dump-guest-memory", Arguments: map[string]interface{}{
+				"paging":   false,
+				"protocol": "file:/var/lib/virtlet/dumps/default_cirros-vm/vm.dump",
+			}},
+			valid: true,
+		},
+		{
+			name: "memory dump to fd",
+			cmd: QMPCommand{Execute: "dump-guest-memory", Arguments: map[string]interface{}{
+				"paging":   false,
+				"protocol": "fd:dumpfd",
+			}},
+		},
+		{
+			name: "memory dump outside the output dir",
+			cmd: QMPCommand{Execute: "dump-guest-memory", Arguments: map[string]interface{}{
+				"paging":   false,
+				"protocol": "file:/var/lib/virtlet/dumps/default_cirros-vm/../virtlet.db",
+			}},
+		},
+		{
+			name: "snapshot",
+			cmd: QMPCommand{Execute: "blockdev-snapshot-sync", Arguments: map[string]interface{}{
+				"device":        "drive-virtio-disk0",
+				"snapshot-file": "/var/lib/virtlet/dumps/default_cirros-vm/snap.qcow2",
+				"format":        "qcow2",
+			}},
+			valid: true,
+		},
+		{
+			name: "snapshot reusing an existing file",
+			cmd: QMPCommand{Execute: "blockdev-snapshot-sync", Arguments: map[string]interface{}{
+				"device":        "drive-virtio-disk0",
+				"snapshot-file": "/var/lib/virtlet/dumps/default_cirros-vm/snap.qcow2",
+				"mode":          "existing",
+			}},
+		},
+		{
+			name: "snapshot in a subdirectory",
+			cmd: QMPCommand{Execute: "blockdev-snapshot-sync", Arguments: map[string]interface{}{
+				"device":        "drive-virtio-disk0",
+				"snapshot-file": "/var/lib/virtlet/dumps/default_cirros-vm/foo/snap.qcow2",
+			}},
+		},
+		{
+			name: "snapshot in the output dir of another pod",
+			cmd: QMPCommand{Execute: "blockdev-snapshot-sync", Arguments: map[string]interface{}{
+				"device":        "drive-virtio-disk0",
+				"snapshot-file": "/var/lib/virtlet/dumps/default_other-vm/snap.qcow2",
+			}},
+		},
+		{
+			name: "snapshot without a file",
+			cmd: QMPCommand{Execute: "blockdev-snapshot-sync", Arguments: map[string]interface{}{
+				"device": "drive-virtio-disk0",
+			}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkQMPCommand(&tc.cmd, "/var/lib/virtlet/dumps/default_cirros-vm")
+			switch {
+			case tc.valid && err != nil:
+				t.Errorf("checkQMPCommand(): unexpected error: %v", err)
+			case !tc.valid && err == nil:
+				t.Errorf("checkQMPCommand() didn't fail")
+			}
+		})
+	}
+}
+
+func TestQMPPassthrough(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerId := ct.createContainer(sandbox, nil)
+	if _, err := ct.virtTool.QMPCommand(containerId, &QMPCommand{Execute: "query-status"}); err == nil {
+		t.Errorf("QMPCommand() didn't fail for a VM that's not running")
+	}
+
+	ct.startContainer(containerId)
+	r, err := ct.virtTool.QMPCommand(containerId, &QMPCommand{Execute: "query-status"})
+	if err != nil {
+		t.Fatalf("QMPCommand(): %v", err)
+	}
+	var status struct {
+		Running bool   `json:"running"`
+		Status  string `json:"status"`
+	}
+	if err := json.Unmarshal(r, &status); err != nil {
+		t.Fatalf("error unmarshalling QMP response %q: %v", r, err)
+	}
+	if !status.Running || status.Status != "running" {
+		t.Errorf("bad VM status: %#v", status)
+	}
+
+	if _, err := ct.virtTool.QMPCommand(containerId, &QMPCommand{Execute: "quit"}); err == nil {
+		t.Errorf("QMPCommand() didn't fail for a command that's not allowed")
+	}
+}
+
+func TestQMPOutputDir(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	outputDir := filepath.Join(ct.tmpDir, "dumps")
+	ct.virtTool.SetQMPOutputDir(outputDir)
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerId := ct.createContainer(sandbox, nil)
+	ct.startContainer(containerId)
+
+	podDir := filepath.Join(outputDir, sandbox.Metadata.Namespace+"_"+sandbox.Metadata.Name)
+	dump := func(path string) error {
+		_, err := ct.virtTool.QMPCommand(containerId, &QMPCommand{
+			Execute: "dump-guest-memory",
+			Arguments: map[string]interface{}{
+				"paging":   false,
+				"protocol": "file:" + path,
+			},
+		})
+		return err
+	}
+	if err := dump(filepath.Join(outputDir, "vm.dump")); err == nil {
+		t.Errorf("QMPCommand() didn't fail for a dump outside the output dir of the pod")
+	}
+	if err := dump(filepath.Join(podDir, "vm.dump")); err != nil {
+		t.Fatalf("QMPCommand(): %v", err)
+	}
+	for _, dir := range []string{outputDir, podDir} {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			t.Fatalf("Stat(): %v", err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0700 {
+			t.Errorf("bad permissions of %q: %o instead of 700", dir, perm)
+		}
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(podDir, "vm.dump"), []byte("dump"), 0600); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := dump(filepath.Join(podDir, "vm.dump")); err == nil {
+		t.Errorf("QMPCommand() didn't fail for an existing output file")
+	}
+}
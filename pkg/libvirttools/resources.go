@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+// vcpuCountForQuota returns the number of vCPUs needed to make use
+// of the specified CFS quota, or 0 if there's no CPU limit
+func vcpuCountForQuota(period, quota int64) int {
+	if period <= 0 || quota <= 0 {
+		return 0
+	}
+	return int((quota + period - 1) / period)
+}
+
+// UpdateContainerResources applies the new CPU limits to the
+// VM. If the VM has VirtletMaxVCPUCount annotation and the new CPU
+// limit allows for more vCPUs than the VM currently has, the vCPUs
+// are hot-plugged into the VM, up to the maximum count. vCPUs are
+// never unplugged, as most guests don't handle it well. Memory
+// limit changes are not applied to the VMs.
+func (v *VirtualizationTool) UpdateContainerResources(containerId string, resources *kubeapi.LinuxContainerResources) error {
+	if resources == nil {
+		return nil
+	}
+	config, _, err := v.getVMConfigFromMetadata(containerId)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		return fmt.Errorf("container %q not found", containerId)
+	}
+	// the namespace is not passed to LoadAnnotations() so it
+	// doesn't try to fetch cloud-init data from k8s
+	ann, err := LoadAnnotations("", config.PodAnnotations)
+	if err != nil {
+		return fmt.Errorf("bad annotations for container %q: %v", containerId, err)
+	}
+
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerId)
+	if err != nil {
+		return fmt.Errorf("failed to look up domain %q: %v", containerId, err)
+	}
+	def, err := domain.Xml()
+	if err != nil {
+		return fmt.Errorf("failed to get the definition of domain %q: %v", containerId, err)
+	}
+
+	restoreResourceLimits(config, def, v.memoryOvercommitRatio)
+
+	vcpuNum := domainVCPUCount(def)
+	if ann.MaxVCPUCount != 0 {
+		needed := vcpuCountForQuota(resources.CpuPeriod, resources.CpuQuota)
+		if needed > ann.MaxVCPUCount {
+			needed = ann.MaxVCPUCount
+		}
+		if needed > vcpuNum {
+			glog.V(2).Infof("Hot-plugging vCPUs into %q: %d -> %d", containerId, vcpuNum, needed)
+			if err := domain.SetVCPUCount(needed); err != nil {
+				return fmt.Errorf("failed to set vcpu count for domain %q: %v", containerId, err)
+			}
+			vcpuNum = needed
+		}
+	}
+
+	if resources.MemoryLimitInBytes != 0 && resources.MemoryLimitInBytes != config.MemoryLimitInBytes {
+		glog.Warningf("Memory limit change for container %q is not applied to the running VM", containerId)
+	}
+
+	// the CPU quota is set per vCPU, see newDomainSettings()
+	if err := domain.SetCPUTune(uint64(resources.CpuShares), uint64(resources.CpuPeriod), resources.CpuQuota/int64(vcpuNum)); err != nil {
+		return fmt.Errorf("failed to update CPU tuning for domain %q: %v", containerId, err)
+	}
+	return nil
+}
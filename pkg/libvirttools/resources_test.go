@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestUpdateContainerResources(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		maxVCPUCount    string
+		initialVCPUs    string
+		updates         []int64
+		expectedVCPUs   string
+		expectedQuota   int64
+		expectedMaxVCPU int
+	}{
+		{
+			name:            "hotplug",
+			maxVCPUCount:    "4",
+			initialVCPUs:    "1",
+			updates:         []int64{250000},
+			expectedVCPUs:   "3",
+			expectedQuota:   83333,
+			expectedMaxVCPU: 4,
+		},
+		{
+			name:            "hotplug up to max vcpu count",
+			maxVCPUCount:    "2",
+			initialVCPUs:    "1",
+			updates:         []int64{250000},
+			expectedVCPUs:   "2",
+			expectedQuota:   125000,
+			expectedMaxVCPU: 2,
+		},
+		{
+			name:            "no unplug",
+			maxVCPUCount:    "4",
+			initialVCPUs:    "1",
+			updates:         []int64{250000, 100000},
+			expectedVCPUs:   "3",
+			expectedQuota:   33333,
+			expectedMaxVCPU: 4,
+		},
+		{
+			name:            "no hotplug",
+			updates:         []int64{250000},
+			expectedQuota:   250000,
+			expectedMaxVCPU: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ct := newContainerTester(t, fake.NewToplevelRecorder())
+			defer ct.teardown()
+
+			sandbox := criapi.GetSandboxes(1)[0]
+			if tc.maxVCPUCount != "" {
+				sandbox.Annotations[MaxVCPUCountAnnotationKeyName] = tc.maxVCPUCount
+			}
+			ct.setPodSandbox(sandbox)
+			containerId := ct.createContainer(sandbox, nil)
+			ct.startContainer(containerId)
+
+			d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+			if err != nil {
+				t.Fatalf("LookupDomainByUUIDString(): %v", err)
+			}
+			def, err := d.Xml()
+			if err != nil {
+				t.Fatalf("Xml(): %v", err)
+			}
+			if def.VCPU == nil || def.VCPU.Value != tc.expectedMaxVCPU || def.VCPU.Current != tc.initialVCPUs {
+				t.Fatalf("bad vcpu settings in the domain definition: %#v", def.VCPU)
+			}
+
+			for _, quota := range tc.updates {
+				if err := ct.virtTool.UpdateContainerResources(containerId, &kubeapi.LinuxContainerResources{
+					CpuPeriod: 100000,
+					CpuQuota:  quota,
+					CpuShares: 512,
+				}); err != nil {
+					t.Fatalf("UpdateContainerResources(): %v", err)
+				}
+			}
+
+			if def.VCPU.Current != tc.expectedVCPUs {
+				t.Errorf("bad current vcpu count: %q instead of %q", def.VCPU.Current, tc.expectedVCPUs)
+			}
+			if def.CPUTune == nil || def.CPUTune.Quota == nil || def.CPUTune.Quota.Value != tc.expectedQuota {
+				t.Errorf("bad cpu quota: %#v", def.CPUTune)
+			}
+			if def.CPUTune.Shares == nil || def.CPUTune.Shares.Value != 512 {
+				t.Errorf("bad cpu shares: %#v", def.CPUTune.Shares)
+			}
+		})
+	}
+}
@@ -18,7 +18,9 @@ package libvirttools
 
 import (
 	"fmt"
+	"strings"
 
+	"github.com/golang/glog"
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
 	"github.com/Mirantis/virtlet/pkg/virt"
@@ -31,37 +33,218 @@ type rootVolume struct {
 
 var _ VMVolume = &rootVolume{}
 
+// installDiskPrefix is the name prefix of the empty root volumes
+// that are created for installing the OS from an ISO image. Unlike
+// the other root volumes, they're named after the pod and the
+// container and are kept when the container is removed, so the
+// installed OS survives container restarts. They're removed
+// along with the pod sandbox
+const installDiskPrefix = "virtlet_disk_"
+
+func installDiskName(podSandboxID, containerName string) string {
+	return installDiskPrefix + podSandboxID + "_" + containerName
+}
+
 func GetRootVolume(config *VMConfig, owner VolumeOwner) ([]VMVolume, error) {
+	// adopted domains keep their own disks
+	if config.ParsedAnnotations != nil && config.ParsedAnnotations.AdoptDomain != "" {
+		return nil, nil
+	}
+	root := &rootVolume{
+		volumeBase{config, owner},
+	}
+	if !root.installFromISO() {
+		return []VMVolume{root}, nil
+	}
+
+	// the installer CD is only attached until the root
+	// volume is created, i.e. the first time the VM of
+	// the container is started
+	installed, err := root.exists()
+	if err != nil {
+		return nil, err
+	}
+	if installed {
+		glog.V(1).Infof("Using the installed root volume %q, not attaching the installer image", root.cloneName())
+		return []VMVolume{root}, nil
+	}
 	return []VMVolume{
-		&rootVolume{
+		root,
+		&installerVolume{
 			volumeBase{config, owner},
 		},
 	}, nil
 }
 
+// installFromISO returns true if the image is an installer ISO
+func (v *rootVolume) installFromISO() bool {
+	return v.config.ParsedAnnotations != nil && v.config.ParsedAnnotations.RootImageType == RootImageTypeISO
+}
+
 func (v *rootVolume) cloneName() string {
+	if v.installFromISO() {
+		return installDiskName(v.config.PodSandboxId, v.config.Name)
+	}
 	return "virtlet_root_" + v.config.DomainUUID
 }
 
+// exists returns true if the root volume already exists
+func (v *rootVolume) exists() (bool, error) {
+	pool, err := v.pool()
+	if err != nil {
+		return false, err
+	}
+	volumes, err := pool.ListAllVolumes()
+	if err != nil {
+		return false, err
+	}
+	for _, vol := range volumes {
+		if vol.Name() == v.cloneName() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// pool returns the storage pool for the root volume which is
+// specified by VirtletRootVolumePool annotation
+func (v *rootVolume) pool() (virt.VirtStoragePool, error) {
+	poolName := ""
+	if v.config.ParsedAnnotations != nil {
+		poolName = v.config.ParsedAnnotations.RootVolumePool
+	}
+	return v.owner.StoragePoolByName(poolName)
+}
+
 func (v *rootVolume) cloneVolume(name string, from virt.VirtStorageVolume) (virt.VirtStorageVolume, error) {
-	return v.owner.StoragePool().CreateStorageVolClone(&libvirtxml.StorageVolume{
+	pool, err := v.pool()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := qcow2OptionsForConfig(v.config)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := setupVolumeEncryption(v.config, v.owner, name)
+	if err != nil {
+		return nil, err
+	}
+	vol, err := pool.CreateStorageVolClone(&libvirtxml.StorageVolume{
 		Name: name,
 		Type: "file",
 		Target: &libvirtxml.StorageVolumeTarget{
-			Format: &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+			Format:     &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+			Encryption: encryption,
 		},
-	}, from)
+	}, from, opts)
+	if err != nil && encryption != nil {
+		if err := teardownVolumeEncryption(v.owner, name); err != nil {
+			glog.Warningf("Error cleaning up after failed root volume creation: %v", err)
+		}
+	}
+	return vol, err
 }
 
-func (v *rootVolume) Uuid() string { return "" }
+// overlayVolume creates a qcow2 volume that uses the image volume
+// as its backing file, so the image is shared between the VMs and
+// only the changes made by the guest are stored in the new volume
+func (v *rootVolume) overlayVolume(name string, from virt.VirtStorageVolume) (virt.VirtStorageVolume, error) {
+	pool, err := v.pool()
+	if err != nil {
+		return nil, err
+	}
+	imagePath, err := from.Path()
+	if err != nil {
+		return nil, fmt.Errorf("error getting image volume path: %v", err)
+	}
+	size, err := from.Size()
+	if err != nil {
+		return nil, fmt.Errorf("error getting image volume size: %v", err)
+	}
+	encryption, err := setupVolumeEncryption(v.config, v.owner, name)
+	if err != nil {
+		return nil, err
+	}
+	// the format of the backing file is not specified here
+	// as it's detected by libvirt
+	vol, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
+		Name:       name,
+		Type:       "file",
+		Allocation: &libvirtxml.StorageVolumeSize{Value: 0},
+		Capacity:   &libvirtxml.StorageVolumeSize{Unit: "b", Value: size},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format:     &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+			Encryption: encryption,
+		},
+		BackingStore: &libvirtxml.StorageVolumeBackingStore{Path: imagePath},
+	}, nil)
+	if err != nil && encryption != nil {
+		if err := teardownVolumeEncryption(v.owner, name); err != nil {
+			glog.Warningf("Error cleaning up after failed root volume creation: %v", err)
+		}
+	}
+	return vol, err
+}
 
-func (v *rootVolume) Setup() (*libvirtxml.DomainDisk, error) {
-	imageVolume, err := v.owner.ImageManager().GetImageVolume(v.config.Image)
+// installDisk returns the root volume for the VM installed from an
+// ISO image, creating an empty volume if it doesn't exist yet
+func (v *rootVolume) installDisk(name string) (virt.VirtStorageVolume, error) {
+	pool, err := v.pool()
+	if err != nil {
+		return nil, err
+	}
+	exists, err := v.exists()
+	switch {
+	case err != nil:
+		return nil, err
+	case exists:
+		return pool.LookupVolumeByName(name)
+	}
+	opts, err := qcow2OptionsForConfig(v.config)
+	if err != nil {
+		return nil, err
+	}
+	encryption, err := setupVolumeEncryption(v.config, v.owner, name)
 	if err != nil {
 		return nil, err
 	}
+	vol, err := pool.CreateStorageVol(&libvirtxml.StorageVolume{
+		Name:       name,
+		Type:       "file",
+		Allocation: &libvirtxml.StorageVolumeSize{Value: 0},
+		Capacity:   &libvirtxml.StorageVolumeSize{Unit: "b", Value: uint64(v.config.ParsedAnnotations.RootDiskSize)},
+		Target: &libvirtxml.StorageVolumeTarget{
+			Format:     &libvirtxml.StorageVolumeTargetFormat{Type: "qcow2"},
+			Encryption: encryption,
+		},
+	}, opts)
+	if err != nil && encryption != nil {
+		if err := teardownVolumeEncryption(v.owner, name); err != nil {
+			glog.Warningf("Error cleaning up after failed root volume creation: %v", err)
+		}
+	}
+	return vol, err
+}
+
+func (v *rootVolume) Uuid() string { return "" }
 
-	vol, err := v.cloneVolume(v.cloneName(), imageVolume)
+func (v *rootVolume) Setup() (*libvirtxml.DomainDisk, error) {
+	var vol virt.VirtStorageVolume
+	var err error
+	if v.installFromISO() {
+		vol, err = v.installDisk(v.cloneName())
+	} else {
+		var imageVolume virt.VirtStorageVolume
+		imageVolume, err = v.owner.ImageManager().GetImageVolume(v.config.Image)
+		if err != nil {
+			return nil, err
+		}
+		if v.config.ParsedAnnotations != nil && v.config.ParsedAnnotations.SharedRootImage {
+			vol, err = v.overlayVolume(v.cloneName(), imageVolume)
+		} else {
+			vol, err = v.cloneVolume(v.cloneName(), imageVolume)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -70,14 +253,84 @@ func (v *rootVolume) Setup() (*libvirtxml.DomainDisk, error) {
 		return nil, fmt.Errorf("error getting root volume path: %v", err)
 	}
 
-	return &libvirtxml.DomainDisk{
+	disk := &libvirtxml.DomainDisk{
 		Type:   "file",
 		Device: "disk",
-		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+		// pass discard requests from the guest to the qcow2
+		// image so the space freed in the guest is returned
+		// to the host
+		Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2", Discard: "unmap"},
 		Source: &libvirtxml.DomainDiskSource{File: volPath},
-	}, nil
+	}
+	if v.installFromISO() {
+		// boot from the installer CD while the disk is empty
+		disk.Boot = &libvirtxml.DomainDeviceBoot{Order: 1}
+	}
+	return disk, nil
 }
 
 func (v *rootVolume) Teardown() error {
-	return v.owner.StoragePool().RemoveVolumeByName(v.cloneName())
+	if v.installFromISO() {
+		// the installed OS must survive container restarts
+		return nil
+	}
+	pool, err := v.pool()
+	if err != nil {
+		return err
+	}
+	if err := pool.RemoveVolumeByName(v.cloneName()); err != nil {
+		return err
+	}
+	return teardownVolumeEncryption(v.owner, v.cloneName())
+}
+
+// installerVolume denotes the installer ISO image
+// attached to the VM as a CD-ROM
+type installerVolume struct {
+	volumeBase
+}
+
+var _ VMVolume = &installerVolume{}
+
+func (v *installerVolume) Uuid() string { return "" }
+
+func (v *installerVolume) Setup() (*libvirtxml.DomainDisk, error) {
+	imageVolume, err := v.owner.ImageManager().GetImageVolume(v.config.Image)
+	if err != nil {
+		return nil, err
+	}
+	imagePath, err := imageVolume.Path()
+	if err != nil {
+		return nil, fmt.Errorf("error getting installer image path: %v", err)
+	}
+	return &libvirtxml.DomainDisk{
+		Type:     "file",
+		Device:   "cdrom",
+		Driver:   &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+		Source:   &libvirtxml.DomainDiskSource{File: imagePath},
+		ReadOnly: &libvirtxml.DomainDiskReadOnly{},
+		Boot:     &libvirtxml.DomainDeviceBoot{Order: 2},
+	}, nil
+}
+
+// RemovePodVolumes removes the root volumes of the VMs installed
+// from ISO images that belong to the pod sandbox
+func (v *VirtualizationTool) RemovePodVolumes(podSandboxID string) error {
+	volumes, errs := v.listVolumes()
+	if len(errs) != 0 {
+		return errs[0]
+	}
+	for _, volume := range volumes {
+		if !strings.HasPrefix(volume.Name(), installDiskPrefix+podSandboxID+"_") {
+			continue
+		}
+		glog.V(1).Infof("Removing installed root volume %q", volume.Name())
+		if err := volume.Remove(); err != nil {
+			return fmt.Errorf("error removing volume %q: %v", volume.Name(), err)
+		}
+		if err := teardownVolumeEncryption(v, volume.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
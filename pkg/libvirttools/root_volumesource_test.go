@@ -17,8 +17,11 @@ limitations under the License.
 package libvirttools
 
 import (
+	"fmt"
 	"testing"
 
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
 	"github.com/Mirantis/virtlet/pkg/virt"
 	"github.com/Mirantis/virtlet/pkg/virt/fake"
 	"github.com/Mirantis/virtlet/tests/gm"
@@ -94,9 +97,134 @@ func TestRootVolumeLifeCycle(t *testing.T) {
 	gm.Verify(t, rec.Content())
 }
 
+func TestRootVolumePlacement(t *testing.T) {
+	rec := fake.NewToplevelRecorder()
+	spool := fake.NewFakeStoragePool(rec.Child("volumes"), "volumes", "/fake/volumes/pool")
+	fastPool := fake.NewFakeStoragePool(rec.Child("fast"), "fast", "/fake/fast/pool")
+	ipool := fake.NewFakeStoragePool(rec.Child("images"), "images", "/fake/images/pool")
+	owner := newFakeVolumeOwner(spool, fake.NewFakeImageManager(rec.Child("image"), ipool))
+	owner.extraPools = map[string]*fake.FakeStoragePool{"fast": fastPool}
+
+	config := &VMConfig{
+		DomainUUID:        testUuid,
+		Image:             "rootfs image name",
+		ParsedAnnotations: &VirtletAnnotations{RootVolumePool: "fast"},
+	}
+	volumes, err := GetRootVolume(config, owner)
+	if err != nil {
+		t.Fatalf("GetRootVolume returned an error: %v", err)
+	}
+	vol, err := volumes[0].Setup()
+	if err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+	if expectedPath := "/fake/fast/pool/virtlet_root_" + testUuid; vol.Source.File != expectedPath {
+		t.Errorf("Expected '%s' as root volume path, received: %s", expectedPath, vol.Source.File)
+	}
+	if _, err := spool.LookupVolumeByName("virtlet_root_" + testUuid); err == nil {
+		t.Errorf("root volume unexpectedly created in the default pool")
+	}
+	if err := volumes[0].Teardown(); err != nil {
+		t.Errorf("Teardown returned an error: %v", err)
+	}
+	if _, err := fastPool.LookupVolumeByName("virtlet_root_" + testUuid); err == nil {
+		t.Errorf("root volume not removed by Teardown")
+	}
+
+	config.ParsedAnnotations.RootVolumePool = "nosuchpool"
+	if _, err := volumes[0].Setup(); err == nil {
+		t.Errorf("Setup didn't fail for an unknown storage pool")
+	}
+}
+
+func TestRootVolumeEncryption(t *testing.T) {
+	rec := fake.NewToplevelRecorder()
+	spool := fake.NewFakeStoragePool(rec.Child("volumes"), "volumes", "/fake/volumes/pool")
+	ipool := fake.NewFakeStoragePool(rec.Child("images"), "images", "/fake/images/pool")
+	owner := newFakeVolumeOwner(spool, fake.NewFakeImageManager(rec.Child("image"), ipool))
+
+	config := &VMConfig{
+		DomainUUID:        testUuid,
+		Image:             "rootfs image name",
+		ParsedAnnotations: &VirtletAnnotations{VolumeEncryptionKey: []byte("foobar")},
+	}
+	volumes, err := GetRootVolume(config, owner)
+	if err != nil {
+		t.Fatalf("GetRootVolume returned an error: %v", err)
+	}
+	if _, err := volumes[0].Setup(); err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+	secretUsage := "virtlet-volume/virtlet_root_" + testUuid
+	if _, err := owner.domainConn.LookupSecretByUsageName("volume", secretUsage); err != nil {
+		t.Errorf("encryption secret not found: %v", err)
+	}
+	if err := volumes[0].Teardown(); err != nil {
+		t.Errorf("Teardown returned an error: %v", err)
+	}
+	if _, err := owner.domainConn.LookupSecretByUsageName("volume", secretUsage); err != virt.ErrSecretNotFound {
+		t.Errorf("encryption secret not removed by Teardown")
+	}
+
+	config.ParsedAnnotations.QCOW2Options = "cluster_size=1M"
+	if _, err := volumes[0].Setup(); err == nil {
+		t.Errorf("Setup didn't fail for an encrypted volume with cluster_size option")
+	}
+}
+
+func TestSharedRootImage(t *testing.T) {
+	rec := fake.NewToplevelRecorder()
+	spool := fake.NewFakeStoragePool(rec.Child("volumes"), "volumes", "/fake/volumes/pool")
+	ipool := fake.NewFakeStoragePool(rec.Child("images"), "images", "/fake/images/pool")
+	owner := newFakeVolumeOwner(spool, fake.NewFakeImageManager(rec.Child("image"), ipool))
+
+	volumes, err := GetRootVolume(&VMConfig{
+		DomainUUID:        testUuid,
+		Image:             "rootfs image name",
+		ParsedAnnotations: &VirtletAnnotations{SharedRootImage: true},
+	}, owner)
+	if err != nil {
+		t.Fatalf("GetRootVolume returned an error: %v", err)
+	}
+	vol, err := volumes[0].Setup()
+	if err != nil {
+		t.Fatalf("Setup returned an error: %v", err)
+	}
+	if expectedPath := "/fake/volumes/pool/virtlet_root_" + testUuid; vol.Source.File != expectedPath {
+		t.Errorf("Expected '%s' as root volume path, received: %s", expectedPath, vol.Source.File)
+	}
+
+	var def *libvirtxml.StorageVolume
+	for _, r := range rec.Content() {
+		switch r.Name {
+		case "volumes: CreateStorageVolClone":
+			t.Errorf("the image was copied instead of being used as a backing file")
+		case "volumes: CreateStorageVol":
+			def = r.Data.(*libvirtxml.StorageVolume)
+		}
+	}
+	switch {
+	case def == nil:
+		t.Errorf("root volume wasn't created")
+	case def.BackingStore == nil || def.BackingStore.Path != "/fake/volume/path":
+		t.Errorf("bad backing store of the root volume: %#v", def.BackingStore)
+	case def.Target == nil || def.Target.Format == nil || def.Target.Format.Type != "qcow2":
+		t.Errorf("root volume is not a qcow2 volume: %#v", def.Target)
+	}
+
+	if err := volumes[0].Teardown(); err != nil {
+		t.Errorf("Teardown returned an error: %v", err)
+	}
+	if _, err := spool.LookupVolumeByName("virtlet_root_" + testUuid); err == nil {
+		t.Errorf("root volume not removed by Teardown")
+	}
+}
+
 type fakeVolumeOwner struct {
 	storagePool  *fake.FakeStoragePool
+	extraPools   map[string]*fake.FakeStoragePool
 	imageManager *fake.FakeImageManager
+	domainConn   *fake.FakeDomainConnection
 }
 
 var _ VolumeOwner = fakeVolumeOwner{}
@@ -105,6 +233,7 @@ func newFakeVolumeOwner(storagePool *fake.FakeStoragePool, imageManager *fake.Fa
 	return &fakeVolumeOwner{
 		storagePool:  storagePool,
 		imageManager: imageManager,
+		domainConn:   fake.NewFakeDomainConnection(nil),
 	}
 }
 
@@ -112,8 +241,18 @@ func (vo fakeVolumeOwner) StoragePool() virt.VirtStoragePool {
 	return vo.storagePool
 }
 
+func (vo fakeVolumeOwner) StoragePoolByName(name string) (virt.VirtStoragePool, error) {
+	if name == "" {
+		return vo.storagePool, nil
+	}
+	if pool, found := vo.extraPools[name]; found {
+		return pool, nil
+	}
+	return nil, fmt.Errorf("unknown storage pool %q", name)
+}
+
 func (vo fakeVolumeOwner) DomainConnection() virt.VirtDomainConnection {
-	return nil
+	return vo.domainConn
 }
 
 func (vo fakeVolumeOwner) ImageManager() ImageManager {
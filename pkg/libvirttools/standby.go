@@ -0,0 +1,312 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const standbyNamePrefix = "standby-"
+
+// StandbyPool describes a pool of standby VMs which are kept
+// booted on the node so they can be quickly claimed by the pods
+type StandbyPool struct {
+	// Name is the name of the pool which is specified by the
+	// pods using VirtletVMPool annotation
+	Name string
+	// Image is the name of the image of the VMs
+	Image string
+	// Size is the number of standby VMs on the node
+	Size int
+	// VCPUCount is the number of vCPUs of the VMs.
+	// 0 means the default
+	VCPUCount int
+	// Memory is the memory limit of the VMs in bytes.
+	// 0 means the default
+	Memory int64
+}
+
+// sameVMs returns true if the VMs of the pools are
+// interchangeable
+func (p StandbyPool) sameVMs(other StandbyPool) bool {
+	return p.Name == other.Name && p.Image == other.Image &&
+		p.VCPUCount == other.VCPUCount && p.Memory == other.Memory
+}
+
+func (p StandbyPool) vmConfig() *VMConfig {
+	name := standbyNamePrefix + p.Name
+	config := &VMConfig{
+		// each standby VM gets a unique fake pod sandbox id
+		// as the domain UUID is derived from it
+		PodSandboxId:       utils.NewUuid(),
+		PodName:            name,
+		Name:               name,
+		Image:              p.Image,
+		MemoryLimitInBytes: p.Memory,
+		PodAnnotations:     map[string]string{},
+	}
+	if p.VCPUCount > 0 {
+		config.PodAnnotations[VCPUCountAnnotationKeyName] = strconv.Itoa(p.VCPUCount)
+	}
+	return config
+}
+
+type standbyVM struct {
+	id     string
+	pool   StandbyPool
+	config *VMConfig
+}
+
+// SetStandbyNetworkAttacher sets the function that's used to
+// hot-plug the network of the pod into a claimed standby VM.
+// The standby VMs can't be claimed unless it's set
+func (v *VirtualizationTool) SetStandbyNetworkAttacher(attach func(podSandboxID, qmpKey string) error) {
+	v.attachStandbyNetwork = attach
+}
+
+func (v *VirtualizationTool) isStandbyVM(id string) bool {
+	v.standbyMutex.Lock()
+	defer v.standbyMutex.Unlock()
+	_, found := v.standbyVMs[id]
+	return found
+}
+
+func (v *VirtualizationTool) standbyVMIDs() []string {
+	v.standbyMutex.Lock()
+	defer v.standbyMutex.Unlock()
+	var ids []string
+	for id := range v.standbyVMs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// SyncStandbyVMs makes sure that the node has the specified
+// number of standby VMs for each of the pools, creating and
+// removing the VMs as necessary. The images of the pools
+// must be already pulled. All of the standby VMs are removed
+// while the node is in maintenance mode
+func (v *VirtualizationTool) SyncStandbyVMs(pools []StandbyPool) (allErrors []error) {
+	if v.InMaintenance() {
+		pools = nil
+	}
+	poolsByName := make(map[string]StandbyPool)
+	for _, pool := range pools {
+		poolsByName[pool.Name] = pool
+	}
+
+	var toRemove []*standbyVM
+	counts := make(map[string]int)
+	v.standbyMutex.Lock()
+	if v.standbyVMs == nil {
+		v.standbyVMs = make(map[string]*standbyVM)
+	}
+	for id, vm := range v.standbyVMs {
+		pool, found := poolsByName[vm.pool.Name]
+		if !found || !pool.sameVMs(vm.pool) || counts[pool.Name] >= pool.Size {
+			toRemove = append(toRemove, vm)
+			delete(v.standbyVMs, id)
+			continue
+		}
+		counts[pool.Name]++
+	}
+	v.standbyMutex.Unlock()
+
+	for _, vm := range toRemove {
+		glog.V(1).Infof("Removing standby VM %s from pool %q", vm.id, vm.pool.Name)
+		if err := v.removeStandbyVM(vm); err != nil {
+			allErrors = append(allErrors, err)
+		}
+	}
+
+	for _, pool := range pools {
+		for n := counts[pool.Name]; n < pool.Size; n++ {
+			vm, err := v.createStandbyVM(pool)
+			if err != nil {
+				allErrors = append(allErrors, err)
+				break
+			}
+			glog.V(1).Infof("Created standby VM %s for pool %q", vm.id, pool.Name)
+			v.standbyMutex.Lock()
+			v.standbyVMs[vm.id] = vm
+			v.standbyMutex.Unlock()
+		}
+	}
+	return
+}
+
+func (v *VirtualizationTool) createStandbyVM(pool StandbyPool) (*standbyVM, error) {
+	config := pool.vmConfig()
+	if err := config.LoadAnnotations(); err != nil {
+		return nil, fmt.Errorf("bad settings for pool %q: %v", pool.Name, err)
+	}
+	id, err := v.createContainer(config, "", true)
+	if err != nil {
+		return nil, fmt.Errorf("error creating standby VM for pool %q: %v", pool.Name, err)
+	}
+	vm := &standbyVM{id: id, pool: pool, config: config}
+	domain, err := v.domainConn.LookupDomainByUUIDString(id)
+	if err == nil {
+		err = domain.Create()
+	}
+	if err != nil {
+		if err := v.removeStandbyVM(vm); err != nil {
+			glog.Warningf("Failed to remove standby VM %s: %v", id, err)
+		}
+		return nil, fmt.Errorf("error starting standby VM for pool %q: %v", pool.Name, err)
+	}
+	return vm, nil
+}
+
+func (v *VirtualizationTool) removeStandbyVM(vm *standbyVM) error {
+	if err := v.removeDomain(vm.id, vm.config, kubeapi.ContainerState_CONTAINER_UNKNOWN, false); err != nil {
+		return fmt.Errorf("error removing standby VM %s: %v", vm.id, err)
+	}
+	return nil
+}
+
+// checkStandbyVM returns an error if the standby VM can't
+// be used for the pod
+func (v *VirtualizationTool) checkStandbyVM(vm *standbyVM, config *VMConfig) error {
+	ann := config.ParsedAnnotations
+	vmAnn := vm.config.ParsedAnnotations
+	switch {
+	case config.Image != vm.config.Image:
+		return fmt.Errorf("the image %q doesn't match the image of the pool %q", config.Image, vm.config.Image)
+	case ann.VCPUCount != vmAnn.VCPUCount || ann.MaxVCPUCount != 0:
+		return errors.New("the vCPU count of the pod doesn't match the one of the pool")
+	case guestMemory(config.MemoryLimitInBytes, v.memoryOvercommitRatio) != guestMemory(vm.config.MemoryLimitInBytes, v.memoryOvercommitRatio):
+		return errors.New("the memory limit of the pod doesn't match the one of the pool")
+	case ann.DiskDriver != vmAnn.DiskDriver || ann.MachineType != "" || ann.NestedVirtualization ||
+		ann.Vsock || ann.Kernel != nil || ann.Initrd != nil || ann.KernelArgs != "" ||
+		ann.RootVolumePool != "" || ann.QCOW2Options != "" || ann.VolumeEncryptionKey != nil ||
+		ann.SharedRootImage || ann.RootImageType == RootImageTypeISO ||
+		ann.CDImageType == CloudInitImageTypeConfigDrive:
+		return errors.New("the pod uses annotations that can't be applied to a running VM")
+	}
+	vols, err := v.volumeSource(config, v)
+	if err != nil {
+		return err
+	}
+	for _, vol := range vols {
+		switch vol.(type) {
+		case *rootVolume, *nocloudVolume:
+		default:
+			return errors.New("volumes can't be added to standby VMs")
+		}
+	}
+	return nil
+}
+
+// claimStandbyVM tries to take a standby VM from the pool specified
+// by the pod annotations. It returns the id of the container or an
+// empty string if there's no suitable standby VM. The cloud-init
+// data of the VM is replaced with the one of the pod, and the VM
+// gets the pod network upon StartContainer()
+func (v *VirtualizationTool) claimStandbyVM(config *VMConfig) (string, error) {
+	if v.attachStandbyNetwork == nil {
+		return "", errors.New("standby VMs are not supported")
+	}
+	poolName := config.ParsedAnnotations.VMPool
+	var vm *standbyVM
+	var lastErr error
+	v.standbyMutex.Lock()
+	for id, c := range v.standbyVMs {
+		if c.pool.Name != poolName {
+			continue
+		}
+		if lastErr = v.checkStandbyVM(c, config); lastErr == nil {
+			vm = c
+			delete(v.standbyVMs, id)
+			break
+		}
+	}
+	v.standbyMutex.Unlock()
+	if vm == nil {
+		if lastErr == nil {
+			glog.V(1).Infof("No standby VMs available in pool %q for pod %s (%s)", poolName, config.PodName, config.PodSandboxId)
+		}
+		return "", lastErr
+	}
+
+	ok := false
+	defer func() {
+		if ok {
+			return
+		}
+		// the VM may be left in inconsistent state, so it's
+		// removed and then replaced by the next sync
+		if err := v.removeStandbyVM(vm); err != nil {
+			glog.Warningf("Failed to remove standby VM %s: %v", vm.id, err)
+		}
+	}()
+
+	config.DomainUUID = vm.id
+	domain, err := v.domainConn.LookupDomainByUUIDString(vm.id)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up standby VM %s: %v", vm.id, err)
+	}
+	diskList, err := newDiskList(config, v.volumeSource, v)
+	if err != nil {
+		return "", err
+	}
+	// nocloud ISO is rewritten in place, the guest
+	// sees the new data after reset
+	if err := diskList.writeImages(domain); err != nil {
+		return "", fmt.Errorf("error writing cloud-init data for standby VM %s: %v", vm.id, err)
+	}
+	if err := v.saveContainerInfo(config, "virtlet_root_"+vm.id, true); err != nil {
+		return "", err
+	}
+
+	ok = true
+	glog.V(1).Infof("Pod %s (%s) claimed standby VM %s from pool %q", config.PodName, config.PodSandboxId, vm.id, poolName)
+	return vm.id, nil
+}
+
+// activateStandbyVM hot-plugs the pod network into a claimed
+// standby VM and resets it, so the guest picks up the new
+// cloud-init data and configures the network
+func (v *VirtualizationTool) activateStandbyVM(domain virt.VirtDomain, state virt.DomainState, podSandboxID, containerID string) error {
+	if state != virt.DOMAIN_RUNNING {
+		return fmt.Errorf("standby VM %s is not running (state %v)", containerID, state)
+	}
+	if v.attachStandbyNetwork == nil {
+		return errors.New("standby VMs are not supported")
+	}
+	if err := v.attachStandbyNetwork(podSandboxID, containerID); err != nil {
+		return fmt.Errorf("error attaching the network of pod %s to standby VM %s: %v", podSandboxID, containerID, err)
+	}
+	if err := domain.Reset(); err != nil {
+		return fmt.Errorf("error resetting standby VM %s: %v", containerID, err)
+	}
+	return nil
+}
+
+// domainActive returns true if the domain is not shut off
+func domainActive(domain virt.VirtDomain) bool {
+	state, err := domain.State()
+	return err == nil && state != virt.DOMAIN_SHUTOFF && state != virt.DOMAIN_NOSTATE
+}
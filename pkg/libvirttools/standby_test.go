@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func (ct *containerTester) syncStandbyVMs(pools ...StandbyPool) {
+	if errs := ct.virtTool.SyncStandbyVMs(pools); len(errs) != 0 {
+		ct.t.Fatalf("SyncStandbyVMs(): %v", errs)
+	}
+}
+
+func (ct *containerTester) runningDomainIDs() []string {
+	domains, err := ct.domainConn.ListDomains()
+	if err != nil {
+		ct.t.Fatalf("ListDomains(): %v", err)
+	}
+	var ids []string
+	for _, d := range domains {
+		state, err := d.State()
+		if err != nil {
+			ct.t.Fatalf("State(): %v", err)
+		}
+		if state != virt.DOMAIN_RUNNING {
+			continue
+		}
+		id, err := d.UUIDString()
+		if err != nil {
+			ct.t.Fatalf("UUIDString(): %v", err)
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestStandbyVMs(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	var attached []string
+	ct.virtTool.SetStandbyNetworkAttacher(func(podSandboxID, qmpKey string) error {
+		attached = append(attached, podSandboxID+"/"+qmpKey)
+		return nil
+	})
+
+	pool := StandbyPool{Name: "pool1", Image: fakeImageName, Size: 2}
+	ct.syncStandbyVMs(pool)
+	standbyIDs := ct.runningDomainIDs()
+	if len(standbyIDs) != 2 {
+		t.Fatalf("expected 2 standby VMs, got %v", standbyIDs)
+	}
+	if containers := ct.listContainers(nil); len(containers) != 0 {
+		t.Errorf("standby VMs must not be listed as containers, got %v", containers)
+	}
+
+	// repeated sync doesn't change anything
+	ct.syncStandbyVMs(pool)
+	if ids := ct.runningDomainIDs(); !reflect.DeepEqual(ids, standbyIDs) {
+		t.Errorf("standby VMs changed after repeated sync: %v instead of %v", ids, standbyIDs)
+	}
+
+	sandboxes := criapi.GetSandboxes(2)
+	sandboxes[0].Annotations[VMPoolKeyName] = "pool1"
+	// the VM with a different vCPU count can't be taken from the pool
+	sandboxes[1].Annotations[VMPoolKeyName] = "pool1"
+	sandboxes[1].Annotations[VCPUCountAnnotationKeyName] = "2"
+	var containerIDs []string
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+		containerIDs = append(containerIDs, ct.createContainer(sandbox, nil))
+	}
+	claimedID := containerIDs[0]
+	if claimedID != standbyIDs[0] && claimedID != standbyIDs[1] {
+		t.Fatalf("the pod didn't claim a standby VM: %q not in %v", claimedID, standbyIDs)
+	}
+	if containerIDs[1] == standbyIDs[0] || containerIDs[1] == standbyIDs[1] {
+		t.Errorf("the pod with a different vCPU count claimed a standby VM")
+	}
+	if status := ct.containerStatus(claimedID); status.State != kubeapi.ContainerState_CONTAINER_CREATED {
+		t.Errorf("bad state of the claimed VM: %s", status.State)
+	}
+
+	ct.startContainer(claimedID)
+	if expected := []string{sandboxes[0].Metadata.Uid + "/" + claimedID}; !reflect.DeepEqual(attached, expected) {
+		t.Errorf("bad network attachments: %v instead of %v", attached, expected)
+	}
+	if status := ct.containerStatus(claimedID); status.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+		t.Errorf("bad state of the claimed VM after start: %s", status.State)
+	}
+
+	// the pool is replenished on the next sync
+	ct.syncStandbyVMs(pool)
+	if ids := ct.runningDomainIDs(); len(ids) != 3 {
+		t.Errorf("expected 2 standby VMs and a claimed VM, got %v", ids)
+	}
+
+	// the standby VMs are removed along with the pool
+	ct.syncStandbyVMs()
+	if ids := ct.runningDomainIDs(); !reflect.DeepEqual(ids, []string{claimedID}) {
+		t.Errorf("expected only the claimed VM to remain, got %v", ids)
+	}
+
+	ct.stopContainer(claimedID)
+	ct.removeContainer(claimedID)
+	if ids := ct.runningDomainIDs(); len(ids) != 0 {
+		t.Errorf("unexpected running domains after removing the claimed VM: %v", ids)
+	}
+}
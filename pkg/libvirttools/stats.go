@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// freePageReportingEnvVar enables free page reporting for the
+// balloon devices of the VMs, which requires QEMU 5.1+
+const freePageReportingEnvVar = "VIRTLET_BALLOON_FREE_PAGE_REPORTING"
+
+func freePageReporting() bool {
+	return utils.GetBoolFromString(os.Getenv(freePageReportingEnvVar))
+}
+
+// guestWorkingSet returns the amount of memory used by the guest.
+// If the guest reports its memory usage via the balloon driver,
+// the memory that's not used by the guest is excluded, otherwise
+// the RSS of the emulator process is used
+func guestWorkingSet(stats *virt.DomainMemoryStats) uint64 {
+	if stats.Available == 0 {
+		return stats.RSS
+	}
+	if stats.Unused >= stats.Available {
+		return 0
+	}
+	return stats.Available - stats.Unused
+}
+
+// containerStats returns the resource usage statistics of the
+// container. CPU and memory usage is only reported for the running
+// VMs
+func (v *VirtualizationTool) containerStats(container *kubeapi.Container) (*kubeapi.ContainerStats, error) {
+	stats := &kubeapi.ContainerStats{
+		Attributes: &kubeapi.ContainerAttributes{
+			Id:          container.Id,
+			Metadata:    container.Metadata,
+			Labels:      container.Labels,
+			Annotations: container.Annotations,
+		},
+	}
+	if container.State != kubeapi.ContainerState_CONTAINER_RUNNING {
+		return stats, nil
+	}
+	domain, err := v.domainConn.LookupDomainByUUIDString(container.Id)
+	switch {
+	case err == virt.ErrDomainNotFound:
+		return stats, nil
+	case err != nil:
+		return nil, fmt.Errorf("cannot lookup domain %q: %v", container.Id, err)
+	}
+
+	now := v.clock.Now().UnixNano()
+	cpuTime, err := domain.CPUTime()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get CPU time of domain %q: %v", container.Id, err)
+	}
+	stats.Cpu = &kubeapi.CpuUsage{
+		Timestamp:            now,
+		UsageCoreNanoSeconds: &kubeapi.UInt64Value{Value: uint64(cpuTime)},
+	}
+
+	memStats, err := domain.MemoryStats()
+	if err != nil {
+		// the domain may have stopped in the meantime
+		glog.Warningf("Cannot get memory stats of domain %q: %v", container.Id, err)
+		return stats, nil
+	}
+	if memStats.Available == 0 {
+		// the guest statistics aren't collected by the balloon
+		// driver yet, so they're enabled here and the RSS
+		// is reported until they become available
+		if err := domain.SetMemoryStatsPeriod(memoryStatsPeriod); err != nil {
+			glog.Warningf("Cannot enable memory stats for domain %q: %v", container.Id, err)
+		}
+	}
+	stats.Memory = &kubeapi.MemoryUsage{
+		Timestamp:       now,
+		WorkingSetBytes: &kubeapi.UInt64Value{Value: guestWorkingSet(memStats)},
+	}
+	return stats, nil
+}
+
+// ContainerStats returns the resource usage statistics of the
+// specified container
+func (v *VirtualizationTool) ContainerStats(containerId string) (*kubeapi.ContainerStats, error) {
+	containers, err := v.ListContainers(&kubeapi.ContainerFilter{Id: containerId})
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("container %q not found", containerId)
+	}
+	return v.containerStats(containers[0])
+}
+
+// ListContainerStats returns the resource usage statistics of the
+// containers that match the filter
+func (v *VirtualizationTool) ListContainerStats(filter *kubeapi.ContainerStatsFilter) ([]*kubeapi.ContainerStats, error) {
+	var containerFilter *kubeapi.ContainerFilter
+	if filter != nil {
+		containerFilter = &kubeapi.ContainerFilter{
+			Id:            filter.Id,
+			PodSandboxId:  filter.PodSandboxId,
+			LabelSelector: filter.LabelSelector,
+		}
+	}
+	containers, err := v.ListContainers(containerFilter)
+	if err != nil {
+		return nil, err
+	}
+	var r []*kubeapi.ContainerStats
+	for _, container := range containers {
+		stats, err := v.containerStats(container)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, stats)
+	}
+	return r, nil
+}
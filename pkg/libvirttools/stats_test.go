@@ -0,0 +1,128 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"testing"
+	"time"
+
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestGuestWorkingSet(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		stats    virt.DomainMemoryStats
+		expected uint64
+	}{
+		{
+			name:     "no guest stats",
+			stats:    virt.DomainMemoryStats{ActualBalloon: 1024, RSS: 700},
+			expected: 700,
+		},
+		{
+			name:     "guest stats",
+			stats:    virt.DomainMemoryStats{ActualBalloon: 1024, Available: 1000, Unused: 600, RSS: 700},
+			expected: 400,
+		},
+		{
+			name:     "bad guest stats",
+			stats:    virt.DomainMemoryStats{ActualBalloon: 1024, Available: 1000, Unused: 1200, RSS: 700},
+			expected: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if ws := guestWorkingSet(&tc.stats); ws != tc.expected {
+				t.Errorf("bad working set: %d instead of %d", ws, tc.expected)
+			}
+		})
+	}
+}
+
+func TestContainerStats(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandboxes := criapi.GetSandboxes(2)
+	var containerIds []string
+	for _, sandbox := range sandboxes {
+		ct.setPodSandbox(sandbox)
+		containerIds = append(containerIds, ct.createContainer(sandbox, nil))
+	}
+	ct.startContainer(containerIds[0])
+
+	d, err := ct.domainConn.LookupDomainByUUIDString(containerIds[0])
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	fd := d.(*fake.FakeDomain)
+	fd.SetCPUTime(3 * time.Second)
+	memStats, err := fd.MemoryStats()
+	if err != nil {
+		t.Fatalf("MemoryStats(): %v", err)
+	}
+
+	// the guest memory stats are not available at first,
+	// so the RSS is reported
+	stats, err := ct.virtTool.ContainerStats(containerIds[0])
+	if err != nil {
+		t.Fatalf("ContainerStats(): %v", err)
+	}
+	if stats.Attributes.Id != containerIds[0] || stats.Attributes.Metadata.Name != fakeContainerName {
+		t.Errorf("bad container attributes: %#v", stats.Attributes)
+	}
+	if stats.Cpu == nil || stats.Cpu.UsageCoreNanoSeconds.Value != uint64(3*time.Second) {
+		t.Errorf("bad cpu usage: %#v", stats.Cpu)
+	}
+	if stats.Memory == nil || stats.Memory.WorkingSetBytes.Value != memStats.RSS {
+		t.Errorf("bad memory usage: %#v (expected working set %d)", stats.Memory, memStats.RSS)
+	}
+
+	fd.SetGuestMemoryUsed(300 * 1024 * 1024)
+	stats, err = ct.virtTool.ContainerStats(containerIds[0])
+	if err != nil {
+		t.Fatalf("ContainerStats(): %v", err)
+	}
+	if stats.Memory == nil || stats.Memory.WorkingSetBytes.Value != 300*1024*1024 {
+		t.Errorf("bad memory usage: %#v (expected working set %d)", stats.Memory, 300*1024*1024)
+	}
+
+	allStats, err := ct.virtTool.ListContainerStats(nil)
+	if err != nil {
+		t.Fatalf("ListContainerStats(): %v", err)
+	}
+	if len(allStats) != 2 {
+		t.Fatalf("expected stats for 2 containers, got %d", len(allStats))
+	}
+	for _, s := range allStats {
+		if s.Attributes.Id == containerIds[1] && (s.Cpu != nil || s.Memory != nil) {
+			t.Errorf("usage reported for a container that's not running: %#v", s)
+		}
+	}
+
+	filtered, err := ct.virtTool.ListContainerStats(&kubeapi.ContainerStatsFilter{PodSandboxId: sandboxes[1].Metadata.Uid})
+	if err != nil {
+		t.Fatalf("ListContainerStats(): %v", err)
+	}
+	if len(filtered) != 1 || filtered[0].Attributes.Id != containerIds[1] {
+		t.Errorf("bad filtered container stats: %#v", filtered)
+	}
+}
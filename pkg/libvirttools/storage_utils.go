@@ -19,9 +19,14 @@ package libvirttools
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
+	"github.com/Mirantis/virtlet/pkg/instance"
 	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
@@ -52,12 +57,61 @@ var supportedStoragePools = map[string]string{
 	"volumes": "/var/lib/virtlet/volumes",
 }
 
+// storagePoolsEnvVar specifies additional volume pools in
+// name=path[,name=path...] format
+const storagePoolsEnvVar = "VIRTLET_STORAGE_POOLS"
+
+var storagePoolNameRx = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// storagePoolSpec describes an additional volume pool
+type storagePoolSpec struct {
+	name string
+	path string
+}
+
+// parseStoragePools parses the list of additional volume pools
+// in name=path[,name=path...] format. The result is sorted by
+// pool name.
+func parseStoragePools(s string) ([]storagePoolSpec, error) {
+	var r []storagePoolSpec
+	seen := map[string]bool{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad storage pool spec %q, must be name=path", item)
+		}
+		name, path := parts[0], filepath.Clean(parts[1])
+		switch {
+		case !storagePoolNameRx.MatchString(name):
+			return nil, fmt.Errorf("bad storage pool name %q", name)
+		case supportedStoragePools[name] != "" || seen[name]:
+			return nil, fmt.Errorf("duplicate storage pool name %q", name)
+		case !filepath.IsAbs(path):
+			return nil, fmt.Errorf("storage pool path must be absolute, got %q", parts[1])
+		}
+		seen[name] = true
+		r = append(r, storagePoolSpec{name: name, path: path})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].name < r[j].name })
+	return r, nil
+}
+
 func ensureStoragePool(conn virt.VirtStorageConnection, name string) (virt.VirtStoragePool, error) {
 	poolDir, found := supportedStoragePools[name]
+	if !found && name == VolumePoolName() {
+		poolDir, found = instance.DataPath("volumes"), true
+	}
 	if !found {
 		return nil, fmt.Errorf("pool with name '%s' is unknown", name)
 	}
+	return ensureDirStoragePool(conn, name, poolDir)
+}
 
+func ensureDirStoragePool(conn virt.VirtStorageConnection, name, poolDir string) (virt.VirtStoragePool, error) {
 	pool, err := conn.LookupStoragePoolByName(name)
 	if err == nil {
 		return pool, nil
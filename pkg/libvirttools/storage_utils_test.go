@@ -0,0 +1,81 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStoragePools(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		spec  string
+		pools []storagePoolSpec
+		bad   bool
+	}{
+		{
+			name: "empty",
+			spec: "",
+		},
+		{
+			name: "multiple pools",
+			spec: "slow=/mnt/hdd/virtlet, fast=/mnt/nvme/virtlet/,",
+			pools: []storagePoolSpec{
+				{name: "fast", path: "/mnt/nvme/virtlet"},
+				{name: "slow", path: "/mnt/hdd/virtlet"},
+			},
+		},
+		{
+			name: "no path",
+			spec: "fast",
+			bad:  true,
+		},
+		{
+			name: "relative path",
+			spec: "fast=nvme/virtlet",
+			bad:  true,
+		},
+		{
+			name: "bad name",
+			spec: "fast/1=/mnt/nvme",
+			bad:  true,
+		},
+		{
+			name: "duplicate name",
+			spec: "fast=/mnt/nvme,fast=/mnt/nvme2",
+			bad:  true,
+		},
+		{
+			name: "builtin pool name",
+			spec: "volumes=/mnt/nvme",
+			bad:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pools, err := parseStoragePools(tc.spec)
+			switch {
+			case tc.bad && err == nil:
+				t.Errorf("parseStoragePools didn't fail for %q", tc.spec)
+			case !tc.bad && err != nil:
+				t.Errorf("parseStoragePools(%q): %v", tc.spec, err)
+			case !tc.bad && !reflect.DeepEqual(pools, tc.pools):
+				t.Errorf("bad pool list: %#v instead of %#v", pools, tc.pools)
+			}
+		})
+	}
+}
@@ -18,8 +18,14 @@ package libvirttools
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/golang/glog"
@@ -29,8 +35,10 @@ import (
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 	kubetypes "k8s.io/kubernetes/pkg/kubelet/types"
 
+	"github.com/Mirantis/virtlet/pkg/instance"
 	"github.com/Mirantis/virtlet/pkg/metadata"
 	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/version"
 	"github.com/Mirantis/virtlet/pkg/virt"
 )
 
@@ -38,9 +46,7 @@ const (
 	defaultMemory     = 1024
 	defaultMemoryUnit = "MiB"
 	defaultDomainType = "kvm"
-	defaultEmulator   = "/usr/bin/kvm"
 	noKvmDomainType   = "qemu"
-	noKvmEmulator     = "/usr/bin/qemu-system-x86_64"
 
 	domainStartCheckInterval      = 250 * time.Millisecond
 	domainStartTimeout            = 10 * time.Second
@@ -51,118 +57,140 @@ const (
 
 	ContainerNsUuid       = "67b7fb47-7735-4b64-86d2-6d062d121966"
 	defaultKubeletRootDir = "/var/lib/kubelet/pods"
+
+	netKeyEnvVar          = "VIRTLET_NET_KEY"
+	qmpKeyEnvVar          = "VIRTLET_QMP_KEY"
+	vsockCIDEnvVar        = "VIRTLET_VSOCK_CID"
+	netBootEnvVar         = "VIRTLET_NET_BOOT"
+	guestAgentChannelName = "org.qemu.guest_agent.0"
+	guestAgentSocketDir   = "/var/lib/libvirt/qemu"
+	// StreamerSocketPath is the socket that receives the
+	// console output of the VMs of the default instance
+	StreamerSocketPath = "/var/lib/libvirt/streamer.sock"
+
+	// AccelerationModeAnnotationKeyName is the name of container status
+	// annotation that reports the acceleration mode used by the VM,
+	// which is either "kvm" or "tcg"
+	AccelerationModeAnnotationKeyName = "VirtletAccelerationMode"
+	accelerationModeKVM               = "kvm"
+	accelerationModeTCG               = "tcg"
+
+	// VsockCIDAnnotationKeyName is the name of container status
+	// annotation that reports the vsock CID assigned to the VM
+	VsockCIDAnnotationKeyName = "VirtletVsockCID"
 )
 
+// kvmDevicePath is a var so it can be overridden in tests
+var kvmDevicePath = "/dev/kvm"
+
+// emulatorVersion is a var so it can be overridden in tests
+var emulatorVersion = utils.EmulatorVersion
+
 type domainSettings struct {
 	useKvm           bool
+	emulator         string
+	arch             string
+	machineType      string
 	domainName       string
 	domainUUID       string
 	memory           int
 	memoryUnit       string
 	vcpuNum          int
+	maxVCPUNum       int
+	nestedFeature    string
+	crashDump        bool
 	cpuShares        uint
 	cpuPeriod        uint64
 	cpuQuota         int64
 	rootDiskFilepath string
 	netFdKey         string
+	qmpKey           string
+	vsockCID         uint32
+	netBoot          bool
+	virtioNetOptions utils.VirtioNetOptions
+	domainTemplate   *template.Template
 }
 
-func (ds *domainSettings) createDomain(config *VMConfig) *libvirtxml.Domain {
+func (ds *domainSettings) createDomain(config *VMConfig) (*libvirtxml.Domain, error) {
 	domainType := defaultDomainType
-	emulator := defaultEmulator
 	if !ds.useKvm {
 		domainType = noKvmDomainType
-		emulator = noKvmEmulator
 	}
 
-	scsiControllerIndex := uint(0)
-	domain := &libvirtxml.Domain{
-		Devices: &libvirtxml.DomainDeviceList{
-			Emulator: "/vmwrapper",
-			Inputs: []libvirtxml.DomainInput{
-				{Type: "tablet", Bus: "usb"},
-			},
-			Graphics: []libvirtxml.DomainGraphic{
-				{Type: "vnc", Port: -1},
-			},
-			Videos: []libvirtxml.DomainVideo{
-				{Model: libvirtxml.DomainVideoModel{Type: "cirrus"}},
-			},
-			Controllers: []libvirtxml.DomainController{
-				{Type: "scsi", Index: &scsiControllerIndex, Model: "virtio-scsi"},
-			},
-		},
-
-		OS: &libvirtxml.DomainOS{
-			Type: &libvirtxml.DomainOSType{Type: "hvm"},
-			BootDevices: []libvirtxml.DomainBootDevice{
-				{Dev: "hd"},
-			},
-		},
+	priorityEnv, err := emulatorPriorityEnv()
+	if err != nil {
+		return nil, err
+	}
 
-		// The following enables nested virtualization.
-		// The plan is to enable it via an annotation at some point.
-		// It commonly requires kvm_intel module to be loaded like this:
-		// modprobe kvm_intel nested=1
-		// CPU: &libvirtxml.DomainCPU{
-		// 	Mode: "host-model",
-		// 	Model: &libvirtxml.DomainCPUModel{
-		// 		Fallback: "forbid",
-		// 	},
-		// 	Features: []libvirtxml.DomainCPUFeature{
-		// 		{
-		// 			Policy: "require",
-		// 			Name:   "vmx",
-		// 		},
-		// 	},
-		// },
-
-		Features: &libvirtxml.DomainFeatureList{ACPI: &libvirtxml.DomainFeature{}},
-
-		OnPoweroff: "destroy",
-		OnReboot:   "restart",
-		OnCrash:    "restart",
-
-		Type: domainType,
-
-		Name:   ds.domainName,
-		UUID:   ds.domainUUID,
-		Memory: &libvirtxml.DomainMemory{Value: uint(ds.memory), Unit: ds.memoryUnit},
-		VCPU:   &libvirtxml.DomainVCPU{Value: ds.vcpuNum},
-		CPUTune: &libvirtxml.DomainCPUTune{
-			Shares: &libvirtxml.DomainCPUTuneShares{Value: ds.cpuShares},
-			Period: &libvirtxml.DomainCPUTunePeriod{Value: ds.cpuPeriod},
-			Quota:  &libvirtxml.DomainCPUTuneQuota{Value: ds.cpuQuota},
-		},
-		// This causes '"qemu: qemu_thread_create: Resource temporarily unavailable"' QEMU errors
-		// when Virtlet is run as a non-privileged user.
-		// Under strace, it looks like a bunch of mmap()s failing with EAGAIN
-		// which happens due to mlockall() call somewhere above that.
-		// This could be worked around using setrlimit() but really
-		// swap handling is not needed here because it's incorrect
-		// to have swap enabled on the nodes of a real Kubernetes cluster.
-
-		// MemoryBacking: &libvirtxml.DomainMemoryBacking{Locked: &libvirtxml.DomainMemoryBackingLocked{}},
-
-		QEMUCommandline: &libvirtxml.DomainQEMUCommandline{
-			Envs: []libvirtxml.DomainQEMUCommandlineEnv{
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_EMULATOR", Value: emulator},
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_NET_KEY", Value: ds.netFdKey},
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_POD_NAME", Value: config.PodName},
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_POD_NAMESPACE", Value: config.PodNamespace},
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_POD_UID", Value: config.PodSandboxId},
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_CONTAINER_ID", Value: config.DomainUUID},
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "VIRTLET_CONTAINER_NAME", Value: config.Name},
-				libvirtxml.DomainQEMUCommandlineEnv{Name: "CONTAINER_ATTEMPTS", Value: fmt.Sprint(config.Attempt)},
-			},
+	data := &DomainTemplateData{
+		Type:                  domainType,
+		Name:                  ds.domainName,
+		UUID:                  ds.domainUUID,
+		Arch:                  ds.arch,
+		MachineType:           ds.machineType,
+		Memory:                ds.memory,
+		MemoryUnit:            ds.memoryUnit,
+		VCPUCount:             ds.vcpuNum,
+		MaxVCPUCount:          ds.maxVCPUNum,
+		NestedVirtFeature:     ds.nestedFeature,
+		CrashDump:             ds.crashDump,
+		CPUShares:             ds.cpuShares,
+		CPUPeriod:             ds.cpuPeriod,
+		CPUQuota:              ds.cpuQuota,
+		Emulator:              vmWrapperPath,
+		GuestAgentSocketPath:  guestAgentSocketPath(ds.domainUUID),
+		GuestAgentChannelName: guestAgentChannelName,
+		FreePageReporting:     freePageReporting(),
+		Env: []DomainTemplateEnv{
+			{Name: "VIRTLET_EMULATOR", Value: ds.emulator},
+			{Name: netKeyEnvVar, Value: ds.netFdKey},
+			{Name: "VIRTLET_POD_NAME", Value: config.PodName},
+			{Name: "VIRTLET_POD_NAMESPACE", Value: config.PodNamespace},
+			{Name: "VIRTLET_POD_UID", Value: config.PodSandboxId},
+			{Name: "VIRTLET_CONTAINER_ID", Value: config.DomainUUID},
+			{Name: "VIRTLET_CONTAINER_NAME", Value: config.Name},
+			{Name: "CONTAINER_ATTEMPTS", Value: fmt.Sprint(config.Attempt)},
+			{Name: version.ProtocolVersionEnvVar, Value: strconv.Itoa(version.ProtocolVersion)},
 		},
+		PodName:        config.PodName,
+		PodNamespace:   config.PodNamespace,
+		PodAnnotations: config.PodAnnotations,
 	}
 
+	data.Env = append(data.Env, priorityEnv...)
+	if os.Getenv(utils.DisableVhostNetEnvVar) != "" {
+		data.Env = append(data.Env, DomainTemplateEnv{Name: utils.DisableVhostNetEnvVar, Value: "1"})
+	}
 	if os.Getenv("VIRTLET_SRIOV_SUPPORT") != "" {
-		domain.QEMUCommandline.Envs = append(domain.QEMUCommandline.Envs,
-			libvirtxml.DomainQEMUCommandlineEnv{Name: "VMWRAPPER_KEEP_PRIVS", Value: "1"})
+		data.Env = append(data.Env, DomainTemplateEnv{Name: "VMWRAPPER_KEEP_PRIVS", Value: "1"})
+	}
+	if instance.Name() != "" {
+		data.Env = append(data.Env, DomainTemplateEnv{Name: instance.EnvVar, Value: instance.Name()})
+	}
+
+	// libvirt-go-xml doesn't support <vsock> element yet,
+	// so the device is added by vmwrapper
+	if ds.vsockCID != 0 {
+		data.Env = append(data.Env, DomainTemplateEnv{Name: vsockCIDEnvVar, Value: fmt.Sprint(ds.vsockCID)})
+	}
+	if ds.qmpKey != "" {
+		data.Env = append(data.Env, DomainTemplateEnv{Name: qmpKeyEnvVar, Value: ds.qmpKey})
+	}
+	// NICs are added by vmwrapper, so it's vmwrapper
+	// that sets the boot index for the first one
+	if ds.netBoot {
+		data.Env = append(data.Env, DomainTemplateEnv{Name: netBootEnvVar, Value: "1"})
+	}
+	if len(ds.virtioNetOptions) != 0 {
+		data.Env = append(data.Env, DomainTemplateEnv{Name: utils.VirtioNetOptionsEnvVar, Value: ds.virtioNetOptions.String()})
 	}
-	return domain
+	return renderDomainTemplate(ds.domainTemplate, data)
+}
+
+// guestAgentSocketPath returns the path of the socket
+// which is used by libvirt to talk to QEMU guest agent
+func guestAgentSocketPath(domainUUID string) string {
+	return filepath.Join(guestAgentSocketDir, domainUUID+".agent")
 }
 
 func canUseKvm() bool {
@@ -173,16 +201,102 @@ func canUseKvm() bool {
 	return true
 }
 
+func tcgFallbackAllowed() bool {
+	return utils.GetBoolFromString(os.Getenv("VIRTLET_ALLOW_TCG_FALLBACK"))
+}
+
+// useKvm decides whether KVM acceleration should be used for new
+// domains. If KVM isn't disabled explicitly but /dev/kvm is missing,
+// domain creation fails unless TCG fallback is enabled via
+// VIRTLET_ALLOW_TCG_FALLBACK env var.
+func (v *VirtualizationTool) useKvm() (bool, error) {
+	if v.forceKVM {
+		return true, nil
+	}
+	if !canUseKvm() {
+		return false, nil
+	}
+	_, err := os.Stat(kvmDevicePath)
+	switch {
+	case err == nil:
+		return true, nil
+	case !os.IsNotExist(err):
+		return false, fmt.Errorf("error checking %q: %v", kvmDevicePath, err)
+	case !tcgFallbackAllowed():
+		return false, fmt.Errorf("%s is not available and TCG fallback is not enabled (set VIRTLET_ALLOW_TCG_FALLBACK to enable it)", kvmDevicePath)
+	}
+	glog.Warningf("*** %s is not available, falling back to TCG emulation. VMs will run much slower ***", kvmDevicePath)
+	return false, nil
+}
+
+// imageArchSettings returns architecture settings for VMs that use
+// the specified image
+func (v *VirtualizationTool) imageArchSettings(imageName string) (archSettings, bool, error) {
+	volumeName, err := ImageNameToVolumeName(imageName)
+	if err != nil {
+		return archSettings{}, false, err
+	}
+	var platform ImagePlatform
+	platform.Arch, err = v.metadataStore.GetImageArch(volumeName)
+	if err != nil {
+		return archSettings{}, false, fmt.Errorf("can't get architecture of image %q: %v", imageName, err)
+	}
+	platform.MachineType, platform.Emulator, err = v.metadataStore.GetImageMachineSettings(volumeName)
+	if err != nil {
+		return archSettings{}, false, fmt.Errorf("can't get machine settings of image %q: %v", imageName, err)
+	}
+	return guestArchSettings(platform)
+}
+
+func accelerationMode(domain virt.VirtDomain) (string, error) {
+	def, err := domain.Xml()
+	if err != nil {
+		return "", err
+	}
+	if def.Type == defaultDomainType {
+		return accelerationModeKVM, nil
+	}
+	return accelerationModeTCG, nil
+}
+
 type VirtualizationTool struct {
 	domainConn     virt.VirtDomainConnection
+	volumePoolName string
 	volumePool     virt.VirtStoragePool
-	imageManager   ImageManager
-	metadataStore  metadata.MetadataStore
-	clock          clockwork.Clock
-	forceKVM       bool
-	kubeletRootDir string
-	rawDevices     []string
-	volumeSource   VMVolumeSource
+	// extraVolumePools contains the additional volume pools
+	// specified via VIRTLET_STORAGE_POOLS keyed by name
+	extraVolumePools map[string]virt.VirtStoragePool
+	imageManager     ImageManager
+	metadataStore    metadata.MetadataStore
+	clock            clockwork.Clock
+	forceKVM         bool
+	kubeletRootDir   string
+	rawDevices       []string
+	volumeSource     VMVolumeSource
+	domainTemplate   *template.Template
+	// memoryOvercommitRatio is the ratio between the guest
+	// memory and the pod memory limit
+	memoryOvercommitRatio float64
+	// domainRetryPolicy specifies how domain shutdown, destroy
+	// and undefine operations are retried
+	domainRetryPolicy domainRetryPolicy
+	// maintenance is non-zero if the node is
+	// in maintenance mode
+	maintenance int32
+	// standbyVMs contains the standby VMs that are not
+	// claimed by the pods yet, keyed by domain UUID
+	standbyVMs   map[string]*standbyVM
+	standbyMutex sync.Mutex
+	// attachStandbyNetwork hot-plugs the network of the
+	// pod into a claimed standby VM
+	attachStandbyNetwork func(podSandboxID, qmpKey string) error
+	// qmpOutputDir is the directory where the files
+	// produced by QMP passthrough commands are placed
+	qmpOutputDir string
+	// crashDumps specifies how the memory dumps of
+	// the crashed VMs are collected
+	crashDumps   crashDumpSettings
+	crashDumpMux sync.Mutex
 }
 
 var _ VolumeOwner = &VirtualizationTool{}
@@ -190,16 +304,49 @@ var _ VolumeOwner = &VirtualizationTool{}
 func NewVirtualizationTool(domainConn virt.VirtDomainConnection, storageConn virt.VirtStorageConnection, imageManager ImageManager,
 	metadataStore metadata.MetadataStore, volumePoolName, rawDevices string, volumeSource VMVolumeSource) (*VirtualizationTool, error) {
 
+	useInstanceDataDirs()
 	volumePool, err := ensureStoragePool(storageConn, volumePoolName)
 	if err != nil {
 		return nil, err
 	}
+	poolSpecs, err := parseStoragePools(os.Getenv(storagePoolsEnvVar))
+	if err != nil {
+		return nil, err
+	}
+	extraVolumePools := map[string]virt.VirtStoragePool{}
+	for _, spec := range poolSpecs {
+		if extraVolumePools[spec.name], err = ensureDirStoragePool(storageConn, spec.name, spec.path); err != nil {
+			return nil, fmt.Errorf("error setting up storage pool %q: %v", spec.name, err)
+		}
+	}
+	domainTemplate, err := loadDomainTemplate()
+	if err != nil {
+		return nil, err
+	}
+	memoryOvercommitRatio, err := memoryOvercommitRatio()
+	if err != nil {
+		return nil, err
+	}
+	if err := configureKSM(); err != nil {
+		return nil, err
+	}
+	domainRetryPolicy, err := domainRetryPolicyFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if feature, err := nestedVirtFeature(); err != nil {
+		glog.Warningf("Can't detect nested virtualization support: %v", err)
+	} else if feature != "" {
+		glog.V(1).Infof("Nested virtualization is enabled on the node (%s)", feature)
+	}
 	return &VirtualizationTool{
-		domainConn:    domainConn,
-		volumePool:    volumePool,
-		imageManager:  imageManager,
-		metadataStore: metadataStore,
-		clock:         clockwork.NewRealClock(),
+		domainConn:       domainConn,
+		volumePoolName:   volumePoolName,
+		volumePool:       volumePool,
+		extraVolumePools: extraVolumePools,
+		imageManager:     imageManager,
+		metadataStore:    metadataStore,
+		clock:            clockwork.NewRealClock(),
 		// FIXME: kubelet's --root-dir may be something other than /var/lib/kubelet
 		// Need to remove it from daemonset mounts (both dev and non-dev)
 		// Use 'nsenter -t 1 -m -- tar ...' or something to grab the path
@@ -207,6 +354,11 @@ func NewVirtualizationTool(domainConn virt.VirtDomainConnection, storageConn vir
 		kubeletRootDir: defaultKubeletRootDir,
 		rawDevices:     strings.Split(rawDevices, ","),
 		volumeSource:   volumeSource,
+		domainTemplate: domainTemplate,
+
+		memoryOvercommitRatio: memoryOvercommitRatio,
+		domainRetryPolicy:     domainRetryPolicy,
+		qmpOutputDir:          instanceQMPOutputDir(),
 	}, nil
 }
 
@@ -218,10 +370,24 @@ func (v *VirtualizationTool) SetClock(clock clockwork.Clock) {
 	v.clock = clock
 }
 
+// SetMemoryOvercommitRatio sets the ratio between the guest memory
+// and the pod memory limit, overriding VIRTLET_MEMORY_OVERCOMMIT_RATIO
+func (v *VirtualizationTool) SetMemoryOvercommitRatio(ratio float64) {
+	v.memoryOvercommitRatio = ratio
+}
+
 func (v *VirtualizationTool) SetKubeletRootDir(kubeletRootDir string) {
 	v.kubeletRootDir = kubeletRootDir
 }
 
+// CheckLibvirt verifies that libvirt is able to handle the requests
+func (v *VirtualizationTool) CheckLibvirt() error {
+	if _, err := v.domainConn.ListDomains(); err != nil {
+		return fmt.Errorf("error listing libvirt domains: %v", err)
+	}
+	return nil
+}
+
 func loggingDisabled() bool {
 	disabled := os.Getenv("VIRTLET_DISABLE_LOGGING")
 	return utils.GetBoolFromString(disabled)
@@ -229,11 +395,13 @@ func loggingDisabled() bool {
 
 func (v *VirtualizationTool) addSerialDevicesToDomain(sandboxId, containerName string, containerAttempt uint32, domain *libvirtxml.Domain, settings domainSettings) error {
 	port := uint(0)
-	if !loggingDisabled() {
+	// the console output of standby VMs doesn't belong to any
+	// pod, so it's not logged
+	if !loggingDisabled() && settings.qmpKey == "" {
 		domain.Devices.Serials = []libvirtxml.DomainSerial{
 			{
 				Type:   "unix",
-				Source: &libvirtxml.DomainChardevSource{Mode: "connect", Path: "/var/lib/libvirt/streamer.sock"},
+				Source: &libvirtxml.DomainChardevSource{Mode: "connect", Path: instance.SocketPath(StreamerSocketPath)},
 				Target: &libvirtxml.DomainSerialTarget{Port: &port},
 			},
 		}
@@ -254,25 +422,26 @@ func (v *VirtualizationTool) addSerialDevicesToDomain(sandboxId, containerName s
 	return nil
 }
 
-func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string) (string, error) {
-	if err := config.LoadAnnotations(); err != nil {
-		return "", err
-	}
-
+// newDomainSettings returns domain settings for the specified VM
+// config. It doesn't have any side effects besides setting
+// config.DomainUUID, so it can also be used to render domain
+// definitions for debugging
+func (v *VirtualizationTool) newDomainSettings(config *VMConfig, netFdKey string) (*domainSettings, error) {
 	domainUUID := utils.NewUuid5(ContainerNsUuid, config.PodSandboxId)
 	// FIXME: this field should be moved to VMStatus struct (to be added)
 	config.DomainUUID = domainUUID
-	settings := domainSettings{
+	settings := &domainSettings{
 		domainUUID: domainUUID,
 		// Note: using only first 13 characters because libvirt has an issue with handling
 		// long path names for qemu monitor socket
-		domainName: "virtlet-" + domainUUID[:13] + "-" + config.Name,
-		netFdKey:   netFdKey,
+		domainName:     instance.ObjectPrefix() + domainUUID[:13] + "-" + config.Name,
+		netFdKey:       netFdKey,
+		domainTemplate: v.domainTemplate,
 	}
 
-	cloneName := "virtlet_root_" + settings.domainUUID
 	settings.vcpuNum = config.ParsedAnnotations.VCPUCount
-	settings.memory = int(config.MemoryLimitInBytes)
+	settings.maxVCPUNum = config.ParsedAnnotations.MaxVCPUCount
+	settings.memory = int(guestMemory(config.MemoryLimitInBytes, v.memoryOvercommitRatio))
 	settings.cpuShares = uint(config.CpuShares)
 	settings.cpuPeriod = uint64(config.CpuPeriod)
 	// Specified cpu bandwidth limits for domains actually are set equal per each vCPU by libvirt
@@ -284,8 +453,99 @@ func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string)
 		settings.memoryUnit = defaultMemoryUnit
 	}
 
-	settings.useKvm = v.forceKVM || canUseKvm()
-	domainDef := settings.createDomain(config)
+	arch, foreignArch, err := v.imageArchSettings(config.Image)
+	if err != nil {
+		return nil, err
+	}
+	useKvm := false
+	if foreignArch {
+		settings.arch = arch.domainArch
+	} else if useKvm, err = v.useKvm(); err != nil {
+		return nil, err
+	}
+	settings.useKvm = useKvm
+	settings.emulator = arch.emulator(useKvm)
+	if config.ParsedAnnotations.NestedVirtualization {
+		if settings.nestedFeature, err = nestedVirtSettings(useKvm); err != nil {
+			return nil, err
+		}
+	}
+	settings.crashDump = config.ParsedAnnotations.CrashDump && v.crashDumpsEnabled()
+	settings.netBoot = config.ParsedAnnotations.NetBoot != ""
+	settings.virtioNetOptions = config.ParsedAnnotations.VirtioNetOptions
+	if len(settings.virtioNetOptions) != 0 {
+		// vmwrapper checks the options, too, but it can only
+		// fail when the VM is started
+		qemuVersion, err := emulatorVersion(settings.emulator)
+		if err != nil {
+			return nil, err
+		}
+		if err := settings.virtioNetOptions.CheckQEMUVersion(qemuVersion); err != nil {
+			return nil, fmt.Errorf("bad %s annotation: %v", VirtioNetOptionsKeyName, err)
+		}
+	}
+	settings.machineType = arch.machineType
+	if config.ParsedAnnotations.MachineType != "" {
+		settings.machineType = config.ParsedAnnotations.MachineType
+	}
+	return settings, nil
+}
+
+func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string) (string, error) {
+	if v.InMaintenance() {
+		return "", errMaintenance
+	}
+	if err := config.LoadAnnotations(); err != nil {
+		return "", err
+	}
+	if config.ParsedAnnotations.AdoptDomain != "" {
+		return v.adoptDomain(config, netFdKey)
+	}
+	if config.ParsedAnnotations.VMPool != "" {
+		if containerID, err := v.claimStandbyVM(config); err != nil {
+			glog.Warningf("Can't claim a standby VM from pool %q for pod %s (%s), creating a new VM: %v",
+				config.ParsedAnnotations.VMPool, config.PodName, config.PodSandboxId, err)
+		} else if containerID != "" {
+			return containerID, nil
+		}
+	}
+	return v.createContainer(config, netFdKey, false)
+}
+
+// createContainer defines the domain for the VM. If standby is true,
+// the domain is defined for a standby VM, which doesn't have the
+// network and isn't recorded in the metadata store
+func (v *VirtualizationTool) createContainer(config *VMConfig, netFdKey string, standby bool) (string, error) {
+	settings, err := v.newDomainSettings(config, netFdKey)
+	if err != nil {
+		return "", err
+	}
+	if standby {
+		settings.qmpKey = settings.domainUUID
+	}
+	cloneName := "virtlet_root_" + settings.domainUUID
+	if config.ParsedAnnotations.RootImageType == RootImageTypeISO {
+		cloneName = installDiskName(config.PodSandboxId, config.Name)
+	}
+
+	ok := false
+	if config.ParsedAnnotations.Vsock {
+		if settings.vsockCID, err = v.metadataStore.AllocateVsockCID(settings.domainUUID); err != nil {
+			return "", fmt.Errorf("error allocating vsock CID: %v", err)
+		}
+		defer func() {
+			if ok {
+				return
+			}
+			if err := v.metadataStore.ReleaseVsockCID(settings.domainUUID); err != nil {
+				glog.Warningf("Failed to release vsock CID for %q: %v", settings.domainUUID, err)
+			}
+		}()
+	}
+	domainDef, err := settings.createDomain(config)
+	if err != nil {
+		return "", err
+	}
 
 	diskList, err := newDiskList(config, v.volumeSource, v)
 	if err != nil {
@@ -295,8 +555,15 @@ func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string)
 	if err != nil {
 		return "", err
 	}
+	for _, disk := range domainDef.Devices.Disks {
+		if disk.Boot != nil && domainDef.OS != nil {
+			// libvirt doesn't allow per-device boot order
+			// to be combined with <boot> elements in <os>
+			domainDef.OS.BootDevices = nil
+			break
+		}
+	}
 
-	ok := false
 	defer func() {
 		if ok {
 			return
@@ -309,40 +576,32 @@ func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string)
 		}
 	}()
 
+	if err := v.setupDirectBoot(domainDef, config, settings.domainUUID); err != nil {
+		return "", err
+	}
+
 	containerAttempt := config.Attempt
-	if err := v.addSerialDevicesToDomain(config.PodSandboxId, config.Name, containerAttempt, domainDef, settings); err != nil {
+	if err := v.addSerialDevicesToDomain(config.PodSandboxId, config.Name, containerAttempt, domainDef, *settings); err != nil {
 		return "", err
 	}
 
-	labels := map[string]string{}
-	for k, v := range config.ContainerLabels {
-		labels[k] = v
+	if config.ParsedAnnotations.Debug || bool(glog.V(4)) {
+		if domainXML, err := domainDef.Marshal(); err != nil {
+			glog.Warningf("Can't marshal the definition of domain %s: %v", settings.domainName, err)
+		} else {
+			glog.Infof("Defining domain %s:\n%s", settings.domainName, domainXML)
+		}
 	}
-	labels[kubetypes.KubernetesPodNameLabel] = config.PodName
-	labels[kubetypes.KubernetesPodNamespaceLabel] = config.PodNamespace
-	labels[kubetypes.KubernetesPodUIDLabel] = config.PodSandboxId
-	labels[kubetypes.KubernetesContainerNameLabel] = config.Name
 
 	domain, err := v.domainConn.DefineDomain(domainDef)
 	if err == nil {
-		err = diskList.writeImages(domain)
+		err = pinEmulator(domain)
 	}
 	if err == nil {
-		// FIXME: store VMConfig + VMStatus (to be added)
-		err = v.metadataStore.Container(settings.domainUUID).Save(
-			func(_ *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
-				return &metadata.ContainerInfo{
-					SandboxID:           config.PodSandboxId,
-					Name:                config.Name,
-					CreatedAt:           v.clock.Now().UnixNano(),
-					Image:               config.Image,
-					RootImageVolumeName: cloneName,
-					Labels:              labels,
-					Annotations:         config.ContainerAnnotations,
-					Attempt:             config.Attempt,
-					State:               kubeapi.ContainerState_CONTAINER_CREATED,
-				}, nil
-			})
+		err = diskList.writeImages(domain)
+	}
+	if err == nil && !standby {
+		err = v.saveContainerInfo(config, cloneName, false)
 	}
 	if err != nil {
 		return "", err
@@ -352,6 +611,40 @@ func (v *VirtualizationTool) CreateContainer(config *VMConfig, netFdKey string)
 	return settings.domainUUID, nil
 }
 
+// saveContainerInfo stores the metadata of a newly created container
+func (v *VirtualizationTool) saveContainerInfo(config *VMConfig, cloneName string, standbyVM bool) error {
+	labels := map[string]string{}
+	for k, v := range config.ContainerLabels {
+		labels[k] = v
+	}
+	labels[kubetypes.KubernetesPodNameLabel] = config.PodName
+	labels[kubetypes.KubernetesPodNamespaceLabel] = config.PodNamespace
+	labels[kubetypes.KubernetesPodUIDLabel] = config.PodSandboxId
+	labels[kubetypes.KubernetesContainerNameLabel] = config.Name
+
+	// FIXME: store VMConfig + VMStatus (to be added)
+	return v.metadataStore.Container(config.DomainUUID).Save(
+		func(_ *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+			return &metadata.ContainerInfo{
+				SandboxID:           config.PodSandboxId,
+				Name:                config.Name,
+				CreatedAt:           v.clock.Now().UnixNano(),
+				Image:               config.Image,
+				RootImageVolumeName: cloneName,
+				Labels:              labels,
+				Annotations:         config.ContainerAnnotations,
+				Attempt:             config.Attempt,
+				State:               kubeapi.ContainerState_CONTAINER_CREATED,
+				// the command is not run if user-data
+				// is replaced with a script
+				HasCommand:  len(config.Command) != 0 && config.ParsedAnnotations.UserDataScript == "",
+				WaitForBoot: config.ParsedAnnotations.WaitForBoot,
+				BootTimeout: int64(config.ParsedAnnotations.BootTimeout),
+				StandbyVM:   standbyVM,
+			}, nil
+		})
+}
+
 func (v *VirtualizationTool) startContainer(containerId string) error {
 	domain, err := v.domainConn.LookupDomainByUUIDString(containerId)
 	if err != nil {
@@ -362,12 +655,22 @@ func (v *VirtualizationTool) startContainer(containerId string) error {
 	if err != nil {
 		return fmt.Errorf("failed to get state of the domain %q: %v", containerId, err)
 	}
-	if state != virt.DOMAIN_SHUTOFF {
-		return fmt.Errorf("domain %q: bad state %v upon StartContainer()", containerId, state)
+	containerInfo, err := v.metadataStore.Container(containerId).Retrieve()
+	if err != nil {
+		return fmt.Errorf("failed to get metadata of container %q: %v", containerId, err)
 	}
-
-	if err = domain.Create(); err != nil {
-		return fmt.Errorf("failed to create domain %q: %v", containerId, err)
+	switch {
+	case containerInfo != nil && containerInfo.StandbyVM:
+		// the standby VM is already running
+		if err := v.activateStandbyVM(domain, state, containerInfo.SandboxID, containerId); err != nil {
+			return err
+		}
+	case state != virt.DOMAIN_SHUTOFF:
+		return fmt.Errorf("domain %q: bad state %v upon StartContainer()", containerId, state)
+	default:
+		if err = domain.Create(); err != nil {
+			return fmt.Errorf("failed to create domain %q: %v", containerId, err)
+		}
 	}
 
 	// XXX: maybe we don't really have to wait here but I couldn't
@@ -391,12 +694,19 @@ func (v *VirtualizationTool) startContainer(containerId string) error {
 		return err
 	}
 
+	if containerInfo != nil && containerInfo.WaitForBoot {
+		if err := v.waitForBoot(domain, containerId); err != nil {
+			return err
+		}
+	}
+
 	return v.metadataStore.Container(containerId).Save(
 		func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
 			// make sure the container is not removed during the call
 			if c != nil {
 				c.State = kubeapi.ContainerState_CONTAINER_RUNNING
 				c.StartedAt = v.clock.Now().UnixNano()
+				c.BootFinished = c.WaitForBoot
 			}
 			return c, nil
 		})
@@ -425,6 +735,12 @@ func (v *VirtualizationTool) StopContainer(containerId string, timeout time.Dura
 		return err
 	}
 
+	// kubelet stops the crashed VMs, so the memory dump
+	// must be taken before the domain is destroyed
+	if _, err := v.collectCrashDump(containerId, domain); err != nil {
+		glog.Warningf("Crash dump collection for container %q failed: %v", containerId, err)
+	}
+
 	// We try to shut down the VM gracefully first. This may take several attempts
 	// because shutdown requests may be ignored e.g. when the VM boots.
 	// If this fails, we just destroy the domain (i.e. power off the VM).
@@ -452,9 +768,10 @@ func (v *VirtualizationTool) StopContainer(containerId string, timeout time.Dura
 		}
 
 		if domainShutdownErr != nil {
-			// The domain is not in 'DOMAIN_SHUTOFF' state and domain.Shutdown() failed,
-			// so we need to return the error that happened during Shutdown()
-			return false, fmt.Errorf("failed to shut down domain %q: %v", containerId, err)
+			// The domain is not in 'DOMAIN_SHUTOFF' state and domain.Shutdown()
+			// failed. This may be a transient error, so we keep trying until
+			// the timeout expires
+			glog.Warningf("Failed to shut down domain %q: %v", containerId, domainShutdownErr)
 		}
 
 		return false, nil
@@ -463,7 +780,7 @@ func (v *VirtualizationTool) StopContainer(containerId string, timeout time.Dura
 	if err != nil {
 		glog.Warningf("Failed to shut down VM %q: %v -- trying to destroy the domain", containerId, err)
 		// if the domain is destroyed successfully we return no error
-		if err = domain.Destroy(); err != nil {
+		if err = v.destroyDomain(containerId, domain); err != nil {
 			return fmt.Errorf("failed to destroy the domain: %v", err)
 		}
 	}
@@ -567,13 +884,14 @@ func (v *VirtualizationTool) removeDomain(containerId string, config *VMConfig,
 	}
 
 	if domain != nil {
-		if state == kubeapi.ContainerState_CONTAINER_RUNNING {
-			if err := domain.Destroy(); err != nil {
+		// claimed standby VMs are running before StartContainer()
+		if state == kubeapi.ContainerState_CONTAINER_RUNNING || domainActive(domain) {
+			if err := v.destroyDomain(containerId, domain); err != nil {
 				return fmt.Errorf("failed to destroy the domain: %v", err)
 			}
 		}
 
-		if err := domain.Undefine(); err != nil {
+		if err := v.undefineDomain(containerId, domain); err != nil {
 			return fmt.Errorf("error undefining the domain %q: %v", containerId, err)
 		}
 
@@ -591,6 +909,16 @@ func (v *VirtualizationTool) removeDomain(containerId string, config *VMConfig,
 		}
 	}
 
+	if err := v.metadataStore.ReleaseVsockCID(containerId); err != nil {
+		glog.Warningf("Error releasing vsock CID for container %s: %v", containerId, err)
+	}
+
+	if err := os.Remove(guestAgentSocketPath(containerId)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Error removing guest agent socket for container %s: %v", containerId, err)
+	}
+
+	removeBootFiles(containerId)
+
 	diskList, err := newDiskList(config, v.volumeSource, v)
 	if err == nil {
 		err = diskList.teardown()
@@ -622,11 +950,22 @@ func (v *VirtualizationTool) RemoveContainer(containerId string) error {
 		return nil
 	}
 
+	containerInfo, err := v.metadataStore.Container(containerId).Retrieve()
+	if err != nil {
+		return err
+	}
+
 	if err := v.removeDomain(containerId, config, state, state == kubeapi.ContainerState_CONTAINER_CREATED ||
 		state == kubeapi.ContainerState_CONTAINER_RUNNING); err != nil {
 		return err
 	}
 
+	if containerInfo != nil && containerInfo.AdoptedDomainXML != "" {
+		if err := v.restoreAdoptedDomain(containerInfo.AdoptedDomainXML); err != nil {
+			return err
+		}
+	}
+
 	if v.metadataStore.Container(containerId).Save(
 		func(_ *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
 			return nil, nil // delete container
@@ -686,6 +1025,10 @@ func (v *VirtualizationTool) getContainerInfo(domain virt.VirtDomain, containerI
 	}
 
 	containerState := virtToKubeState(state, containerInfo.State)
+	if containerInfo.StandbyVM && containerInfo.State == kubeapi.ContainerState_CONTAINER_CREATED {
+		// claimed standby VMs are already running before StartContainer()
+		containerState = kubeapi.ContainerState_CONTAINER_CREATED
+	}
 	if containerInfo.State != containerState {
 		if err := v.metadataStore.Container(containerId).Save(
 			func(c *metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
@@ -700,6 +1043,16 @@ func (v *VirtualizationTool) getContainerInfo(domain virt.VirtDomain, containerI
 		}
 		containerInfo.State = containerState
 	}
+	if containerInfo.HasCommand && containerInfo.CommandFinishedAt == 0 && containerState == kubeapi.ContainerState_CONTAINER_RUNNING {
+		if err := v.updateCommandStatus(domain, containerId, containerInfo); err != nil {
+			glog.Warningf("Error checking the command status of container %s: %v", containerId, err)
+		}
+	}
+	if containerInfo.BootTimeout != 0 && !containerInfo.BootFinished && containerState == kubeapi.ContainerState_CONTAINER_RUNNING {
+		if err := v.checkBoot(domain, containerId, containerInfo); err != nil {
+			glog.Warningf("Error checking the boot status of container %s: %v", containerId, err)
+		}
+	}
 	return containerInfo, nil
 }
 
@@ -851,6 +1204,9 @@ func (v *VirtualizationTool) ListContainers(filter *kubeapi.ContainerFilter) ([]
 			if err != nil {
 				return nil, err
 			}
+			if v.isStandbyVM(containerId) {
+				continue
+			}
 			glog.V(0).Infof("Failed to find info in bolt for domain with id: %s, so just ignoring as not handled by virtlet.", containerId)
 			continue
 		}
@@ -878,6 +1234,60 @@ func (v *VirtualizationTool) ContainerStatus(containerId string) (*kubeapi.Conta
 		return nil, fmt.Errorf("missing containerInfo for containerId: %s", containerId)
 	}
 
+	mode, err := accelerationMode(domain)
+	if err != nil {
+		return nil, fmt.Errorf("can't determine acceleration mode for container %q: %v", containerId, err)
+	}
+	annotations := map[string]string{}
+	for k, v := range containerInfo.Annotations {
+		annotations[k] = v
+	}
+	annotations[AccelerationModeAnnotationKeyName] = mode
+	running := containerInfo.State == kubeapi.ContainerState_CONTAINER_RUNNING
+	if v.memoryOvercommitRatio != 1 || running {
+		def, err := domain.Xml()
+		if err != nil {
+			return nil, fmt.Errorf("can't get domain definition for container %q: %v", containerId, err)
+		}
+		if v.memoryOvercommitRatio != 1 && def.Memory != nil {
+			memory := int64(def.Memory.Value) * memoryUnitMultipliers[def.Memory.Unit]
+			annotations[GuestMemoryAnnotationKeyName] = strconv.FormatInt(memory, 10)
+		}
+		if running {
+			ec, err := v.effectiveConfigAnnotation(def, mode, containerInfo.SandboxID)
+			if err != nil {
+				return nil, fmt.Errorf("can't get effective config for container %q: %v", containerId, err)
+			}
+			annotations[EffectiveConfigAnnotationKeyName] = ec
+		}
+	}
+
+	vsockCID, err := v.metadataStore.GetVsockCID(containerId)
+	if err != nil {
+		return nil, fmt.Errorf("can't get vsock CID for container %q: %v", containerId, err)
+	}
+	if vsockCID != 0 {
+		annotations[VsockCIDAnnotationKeyName] = strconv.FormatUint(uint64(vsockCID), 10)
+	}
+
+	var exitCode int32
+	var finishedAt int64
+	if containerInfo.CommandFinishedAt != 0 {
+		annotations[CommandExitCodeAnnotationKeyName] = strconv.Itoa(int(containerInfo.CommandExitCode))
+		if containerInfo.State == kubeapi.ContainerState_CONTAINER_EXITED {
+			exitCode = containerInfo.CommandExitCode
+			finishedAt = containerInfo.CommandFinishedAt
+		}
+	}
+
+	var reason, message string
+	if containerInfo.BootFailedAt != 0 {
+		reason = bootTimeoutReason
+		message = containerInfo.BootFailureMessage
+		exitCode = bootTimeoutExitCode
+		finishedAt = containerInfo.BootFailedAt
+	}
+
 	image := &kubeapi.ImageSpec{Image: containerInfo.Image}
 
 	return &kubeapi.ContainerStatus{
@@ -891,11 +1301,52 @@ func (v *VirtualizationTool) ContainerStatus(containerId string) (*kubeapi.Conta
 		State:       containerInfo.State,
 		CreatedAt:   containerInfo.CreatedAt,
 		StartedAt:   containerInfo.StartedAt,
+		FinishedAt:  finishedAt,
+		ExitCode:    exitCode,
+		Reason:      reason,
+		Message:     message,
 		Labels:      containerInfo.Labels,
-		Annotations: containerInfo.Annotations,
+		Annotations: annotations,
 	}, nil
 }
 
+// runningDomain returns the domain of the container,
+// making sure that it's running
+func (v *VirtualizationTool) runningDomain(containerId string) (virt.VirtDomain, error) {
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerId)
+	if err != nil {
+		return nil, fmt.Errorf("can't find the domain for container %q: %v", containerId, err)
+	}
+	state, err := domain.State()
+	if err != nil {
+		return nil, fmt.Errorf("can't get the state of the domain for container %q: %v", containerId, err)
+	}
+	if state != virt.DOMAIN_RUNNING {
+		return nil, fmt.Errorf("the VM of container %q is not running", containerId)
+	}
+	return domain, nil
+}
+
+// CopyToContainer writes the data read from r to the file at the
+// specified path inside the container VM using QEMU guest agent
+func (v *VirtualizationTool) CopyToContainer(containerId, path string, r io.Reader) error {
+	domain, err := v.runningDomain(containerId)
+	if err != nil {
+		return err
+	}
+	return CopyToGuest(domain, path, r)
+}
+
+// CopyFromContainer writes the contents of the file at the
+// specified path inside the container VM to w using QEMU guest agent
+func (v *VirtualizationTool) CopyFromContainer(containerId, path string, w io.Writer) error {
+	domain, err := v.runningDomain(containerId)
+	if err != nil {
+		return err
+	}
+	return CopyFromGuest(domain, path, w)
+}
+
 // VolumeOwner implementation follows
 
 func (v *VirtualizationTool) StoragePool() virt.VirtStoragePool           { return v.volumePool }
@@ -903,3 +1354,30 @@ func (v *VirtualizationTool) DomainConnection() virt.VirtDomainConnection { retu
 func (v *VirtualizationTool) ImageManager() ImageManager                  { return v.imageManager }
 func (v *VirtualizationTool) RawDevices() []string                        { return v.rawDevices }
 func (v *VirtualizationTool) KubeletRootDir() string                      { return v.kubeletRootDir }
+
+// StoragePoolByName returns the volume pool with the specified name.
+// Empty name denotes the default volume pool.
+func (v *VirtualizationTool) StoragePoolByName(name string) (virt.VirtStoragePool, error) {
+	if name == "" || name == v.volumePoolName {
+		return v.volumePool, nil
+	}
+	if pool, found := v.extraVolumePools[name]; found {
+		return pool, nil
+	}
+	return nil, fmt.Errorf("unknown storage pool %q", name)
+}
+
+// volumePools returns all of the volume pools, starting with the
+// default one
+func (v *VirtualizationTool) volumePools() []virt.VirtStoragePool {
+	names := make([]string, 0, len(v.extraVolumePools))
+	for name := range v.extraVolumePools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pools := []virt.VirtStoragePool{v.volumePool}
+	for _, name := range names {
+		pools = append(pools, v.extraVolumePools[name])
+	}
+	return pools
+}
@@ -35,6 +35,7 @@ import (
 	"github.com/Mirantis/virtlet/pkg/metadata"
 	"github.com/Mirantis/virtlet/pkg/utils"
 	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/cnifixture"
 	"github.com/Mirantis/virtlet/tests/criapi"
 	"github.com/Mirantis/virtlet/tests/gm"
 )
@@ -113,7 +114,7 @@ func newContainerTester(t *testing.T, rec *fake.TopLevelRecorder) *containerTest
 		t.Fatalf("Error getting volume name for image %q: %v", fakeImageName, err)
 	}
 
-	if _, err := imageTool.PullRemoteImageToVolume(fakeImageName, imageVolumeName, imagetranslation.NewImageNameTranslator()); err != nil {
+	if _, _, err := imageTool.PullRemoteImageToVolume(fakeImageName, imageVolumeName, imagetranslation.NewImageNameTranslator()); err != nil {
 		t.Fatalf("Error pulling image %q to volume %q: %v", fakeImageName, imageVolumeName, err)
 	}
 
@@ -137,7 +138,7 @@ func (ct *containerTester) teardown() {
 	os.RemoveAll(ct.tmpDir)
 }
 
-func (ct *containerTester) createContainer(sandbox *kubeapi.PodSandboxConfig, mounts []*kubeapi.Mount) string {
+func (ct *containerTester) vmConfig(sandbox *kubeapi.PodSandboxConfig, mounts []*kubeapi.Mount) *VMConfig {
 	req := &kubeapi.CreateContainerRequest{
 		PodSandboxId: sandbox.Metadata.Uid,
 		Config: &kubeapi.ContainerConfig{
@@ -160,7 +161,11 @@ func (ct *containerTester) createContainer(sandbox *kubeapi.PodSandboxConfig, mo
 	if err != nil {
 		ct.t.Fatalf("GetVMConfig(): %v", err)
 	}
-	containerId, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+	return vmConfig
+}
+
+func (ct *containerTester) createContainer(sandbox *kubeapi.PodSandboxConfig, mounts []*kubeapi.Mount) string {
+	containerId, err := ct.virtTool.CreateContainer(ct.vmConfig(sandbox, mounts), "/tmp/fakenetns")
 	if err != nil {
 		ct.t.Fatalf("CreateContainer: %v", err)
 	}
@@ -345,6 +350,43 @@ func TestDoubleStartError(t *testing.T) {
 	}
 }
 
+func TestTCGFallback(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+	ct.virtTool.SetForceKVM(false)
+
+	origKvmDevicePath := kvmDevicePath
+	kvmDevicePath = filepath.Join(ct.tmpDir, "no-kvm")
+	defer func() { kvmDevicePath = origKvmDevicePath }()
+	os.Unsetenv("VIRTLET_DISABLE_KVM")
+	defer os.Unsetenv("VIRTLET_ALLOW_TCG_FALLBACK")
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+
+	vmConfig, err := GetVMConfig(&kubeapi.CreateContainerRequest{
+		PodSandboxId: sandbox.Metadata.Uid,
+		Config: &kubeapi.ContainerConfig{
+			Metadata: &kubeapi.ContainerMetadata{Name: fakeContainerName},
+			Image:    &kubeapi.ImageSpec{Image: fakeImageName},
+		},
+		SandboxConfig: sandbox,
+	}, "")
+	if err != nil {
+		t.Fatalf("GetVMConfig(): %v", err)
+	}
+	if _, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns"); err == nil {
+		t.Errorf("CreateContainer() didn't fail without /dev/kvm and TCG fallback enabled")
+	}
+
+	os.Setenv("VIRTLET_ALLOW_TCG_FALLBACK", "1")
+	containerId := ct.createContainer(sandbox, nil)
+	status := ct.containerStatus(containerId)
+	if mode := status.Annotations[AccelerationModeAnnotationKeyName]; mode != "tcg" {
+		t.Errorf("Bad acceleration mode: %q instead of %q", mode, "tcg")
+	}
+}
+
 type volMount struct {
 	name          string
 	containerPath string
@@ -355,11 +397,49 @@ func TestDomainDefinitions(t *testing.T) {
 		// note that this is only good for just one flexvolume
 		return fakeUuid
 	}, flexvolume.NullMounter)
+
+	tmpDir, err := ioutil.TempDir("", "domain-definitions-")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	nestedParamPath := filepath.Join(tmpDir, "nested")
+	if err := ioutil.WriteFile(nestedParamPath, []byte("Y\n"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	origNestedVirtParams := nestedVirtParams
+	defer func() { nestedVirtParams = origNestedVirtParams }()
+	nestedVirtParams = []struct {
+		feature   string
+		paramPath string
+	}{
+		{"vmx", nestedParamPath},
+	}
+	origEmulatorVersion := emulatorVersion
+	defer func() { emulatorVersion = origEmulatorVersion }()
+	emulatorVersion = func(string) (utils.QEMUVersion, error) {
+		return utils.QEMUVersion{2, 11}, nil
+	}
+	origKvmDevicePath := kvmDevicePath
+	defer func() { kvmDevicePath = origKvmDevicePath }()
+
+	cniResult, err := json.Marshal(cnifixture.NewResult().
+		Interface("eth0", cnifixture.MAC(1)).IP("10.1.90.5/24", "10.1.90.1").
+		Interface("eth1", cnifixture.MAC(2)).IP("10.2.90.5/24", "").
+		Result())
+	if err != nil {
+		t.Fatalf("error marshalling CNI result: %v", err)
+	}
+
 	for _, tc := range []struct {
-		name        string
-		annotations map[string]string
-		flexVolumes map[string]map[string]interface{}
-		mounts      []volMount
+		name          string
+		annotations   map[string]string
+		env           map[string]string
+		flexVolumes   map[string]map[string]interface{}
+		mounts        []volMount
+		cniConfig     string
+		noKvm         bool
+		imagePlatform ImagePlatform
 	}{
 		{
 			name: "plain domain",
@@ -436,12 +516,114 @@ func TestDomainDefinitions(t *testing.T) {
 				"VirtletDiskDriver": "virtio",
 			},
 		},
+		{
+			name: "vsock",
+			annotations: map[string]string{
+				"VirtletVsock": "true",
+			},
+		},
+		{
+			name: "emulator pinning",
+			env: map[string]string{
+				emulatorCPUSetEnvVar: "2-15",
+			},
+		},
+		{
+			name: "nested virtualization",
+			annotations: map[string]string{
+				"VirtletNestedVirtualization": "true",
+			},
+		},
+		{
+			name: "guest interface names",
+			annotations: map[string]string{
+				"VirtletGuestInterfaceNames": "mgmt0,data0",
+			},
+			cniConfig: string(cniResult),
+		},
+		{
+			name: "vhost-net disabled",
+			env: map[string]string{
+				utils.DisableVhostNetEnvVar: "1",
+			},
+		},
+		{
+			name: "virtio-net options",
+			annotations: map[string]string{
+				"VirtletVirtioNetOptions": "rx_queue_size=1024,event_idx=off",
+			},
+		},
+		{
+			name: "net boot",
+			annotations: map[string]string{
+				"VirtletNetBoot": "pxelinux/pxelinux.0",
+			},
+		},
+		{
+			name: "direct kernel boot",
+			annotations: map[string]string{
+				"VirtletKernel":     fakeImageName,
+				"VirtletKernelArgs": "console=ttyS0 root=/dev/sda",
+			},
+		},
+		{
+			name: "iso install",
+			annotations: map[string]string{
+				"VirtletRootImageType": "iso",
+				"VirtletRootDiskSize":  "2Gi",
+			},
+		},
+		{
+			name: "vcpu hotplug",
+			annotations: map[string]string{
+				"VirtletVCPUCount":    "2",
+				"VirtletMaxVCPUCount": "4",
+			},
+		},
+		{
+			name: "tcg fallback",
+			env: map[string]string{
+				"VIRTLET_ALLOW_TCG_FALLBACK": "1",
+			},
+			noKvm: true,
+		},
+		{
+			name: "machine type",
+			annotations: map[string]string{
+				"VirtletMachineType": "pc-q35-2.11",
+			},
+		},
+		{
+			name: "image machine settings",
+			imagePlatform: ImagePlatform{
+				MachineType: "pc-q35-2.11",
+				Emulator:    "/usr/local/bin/qemu-system-x86_64",
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
+			for k, v := range tc.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
 			rec := fake.NewToplevelRecorder()
 
 			ct := newContainerTester(t, rec)
 			defer ct.teardown()
+			if tc.noKvm {
+				ct.virtTool.SetForceKVM(false)
+				kvmDevicePath = filepath.Join(ct.tmpDir, "no-kvm")
+				defer func() { kvmDevicePath = origKvmDevicePath }()
+			}
+			if tc.imagePlatform.MachineType != "" || tc.imagePlatform.Emulator != "" {
+				imageVolumeName, err := ImageNameToVolumeName(fakeImageName)
+				if err != nil {
+					t.Fatalf("ImageNameToVolumeName(): %v", err)
+				}
+				if err := ct.metadataStore.SetImageMachineSettings(imageVolumeName, tc.imagePlatform.MachineType, tc.imagePlatform.Emulator); err != nil {
+					t.Fatalf("SetImageMachineSettings(): %v", err)
+				}
+			}
 
 			sandbox := criapi.GetSandboxes(1)[0]
 			sandbox.Annotations = tc.annotations
@@ -467,7 +649,12 @@ func TestDomainDefinitions(t *testing.T) {
 					ContainerPath: m.containerPath,
 				})
 			}
-			containerId := ct.createContainer(sandbox, mounts)
+			vmConfig := ct.vmConfig(sandbox, mounts)
+			vmConfig.CNIConfig = tc.cniConfig
+			containerId, err := ct.virtTool.CreateContainer(vmConfig, "/tmp/fakenetns")
+			if err != nil {
+				t.Fatalf("CreateContainer: %v", err)
+			}
 			// startContainer will cause fake VirtDomain
 			// to dump the cloudinit iso content
 			ct.startContainer(containerId)
@@ -54,6 +54,8 @@ type VMConfig struct {
 	CpuQuota int64
 	// Annotations for the containing pod
 	PodAnnotations map[string]string
+	// Labels for the containing pod
+	PodLabels map[string]string
 	// Annotations for the container
 	ContainerAnnotations map[string]string
 	// Labels for the container
@@ -65,6 +67,9 @@ type VMConfig struct {
 	DomainUUID string
 	// Environment variables to set in the VM
 	Environment []*VMKeyValue
+	// Command to run in the VM on boot along with its
+	// arguments. Empty if not specified
+	Command []string
 	// Host directories corresponding to the volumes which are to
 	// be mounted inside the VM
 	Mounts []*VMMount
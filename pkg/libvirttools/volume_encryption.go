@@ -0,0 +1,184 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+
+	"github.com/golang/glog"
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+const (
+	volumeSecretUsageType   = "volume"
+	volumeSecretUsagePrefix = "virtlet-volume/"
+)
+
+// volumeEncryptionKey returns the passphrase for LUKS encryption
+// of the VM volumes or nil if the volumes aren't encrypted
+func volumeEncryptionKey(config *VMConfig) []byte {
+	if config.ParsedAnnotations == nil {
+		return nil
+	}
+	return config.ParsedAnnotations.VolumeEncryptionKey
+}
+
+func volumeSecretUsage(volumeName string) string {
+	return volumeSecretUsagePrefix + volumeName
+}
+
+// setupVolumeEncryption defines libvirt secret that holds the
+// encryption passphrase for the volume and returns the encryption
+// settings for the volume definition. If the volumes of the VM
+// aren't encrypted, it returns nil
+func setupVolumeEncryption(config *VMConfig, owner VolumeOwner, volumeName string) (*libvirtxml.StorageEncryption, error) {
+	key := volumeEncryptionKey(config)
+	if key == nil {
+		return nil, nil
+	}
+	// the uuid must be known before defining the secret
+	// because it's used to refer to the secret in the
+	// volume definition
+	secretUUID := utils.NewUuid5(ContainerNsUuid, volumeSecretUsage(volumeName))
+	secret, err := owner.DomainConnection().DefineSecret(&libvirtxml.Secret{
+		Ephemeral: "no",
+		Private:   "yes",
+		UUID:      secretUUID,
+		Usage: &libvirtxml.SecretUsage{
+			Type:   volumeSecretUsageType,
+			Volume: volumeSecretUsage(volumeName),
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error defining encryption secret for volume %q: %v", volumeName, err)
+	}
+	if err := secret.SetValue(key); err != nil {
+		secret.Remove()
+		return nil, fmt.Errorf("error setting encryption secret for volume %q: %v", volumeName, err)
+	}
+	return &libvirtxml.StorageEncryption{
+		Format: "luks",
+		Secret: &libvirtxml.StorageEncryptionSecret{
+			Type: "passphrase",
+			UUID: secretUUID,
+		},
+	}, nil
+}
+
+// teardownVolumeEncryption removes the encryption secret of the
+// volume if it exists
+func teardownVolumeEncryption(owner VolumeOwner, volumeName string) error {
+	secret, err := owner.DomainConnection().LookupSecretByUsageName(volumeSecretUsageType, volumeSecretUsage(volumeName))
+	switch {
+	case err == virt.ErrSecretNotFound:
+		return nil
+	case err == nil:
+		glog.V(3).Infof("Removing encryption secret for volume %q", volumeName)
+		err = secret.Remove()
+	}
+	if err != nil {
+		return fmt.Errorf("error removing encryption secret for volume %q: %v", volumeName, err)
+	}
+	return nil
+}
+
+type domainDiskEncryption struct {
+	XMLName xml.Name `xml:"encryption"`
+	libvirtxml.StorageEncryption
+}
+
+// addDiskEncryption adds <encryption> elements to the disks in the
+// domain XML for which lookup returns non-nil encryption settings.
+// lookup is invoked with the source path of each file or block
+// disk. This is needed because libvirt-go-xml doesn't support
+// <encryption> element of the domain disks yet. The rest of the
+// document is left intact
+func addDiskEncryption(domainXML string, lookup func(path string) (*libvirtxml.StorageEncryption, error)) (string, error) {
+	type insertion struct {
+		offset int64
+		text   []byte
+	}
+	var insertions []insertion
+	decoder := xml.NewDecoder(bytes.NewBufferString(domainXML))
+	var path []string
+	sourcePath := ""
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("error parsing domain xml: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			path = append(path, t.Name.Local)
+			if len(path) == 4 && path[1] == "devices" && path[2] == "disk" && t.Name.Local == "source" {
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "file" || attr.Name.Local == "dev" {
+						sourcePath = attr.Value
+					}
+				}
+			}
+		case xml.EndElement:
+			path = path[:len(path)-1]
+			if len(path) != 2 || path[1] != "devices" || t.Name.Local != "disk" {
+				break
+			}
+			diskPath := sourcePath
+			sourcePath = ""
+			if diskPath == "" {
+				break
+			}
+			encryption, err := lookup(diskPath)
+			if err != nil {
+				return "", err
+			}
+			if encryption == nil {
+				break
+			}
+			text, err := xml.Marshal(domainDiskEncryption{StorageEncryption: *encryption})
+			if err != nil {
+				return "", fmt.Errorf("error marshalling disk encryption: %v", err)
+			}
+			// insert the element before </disk>
+			offset := decoder.InputOffset() - int64(len("</disk>"))
+			if offset < 0 || domainXML[offset:decoder.InputOffset()] != "</disk>" {
+				return "", fmt.Errorf("can't locate the end of disk %q in domain xml", diskPath)
+			}
+			insertions = append(insertions, insertion{offset: offset, text: text})
+		}
+	}
+	if len(insertions) == 0 {
+		return domainXML, nil
+	}
+	var buf bytes.Buffer
+	var pos int64
+	for _, ins := range insertions {
+		buf.WriteString(domainXML[pos:ins.offset])
+		buf.Write(ins.text)
+		pos = ins.offset
+	}
+	buf.WriteString(domainXML[pos:])
+	return buf.String(), nil
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"strings"
+	"testing"
+
+	libvirtxml "github.com/libvirt/libvirt-go-xml"
+)
+
+func TestAddDiskEncryption(t *testing.T) {
+	domain := &libvirtxml.Domain{
+		Type: "kvm",
+		Name: "encryption-test",
+		Devices: &libvirtxml.DomainDeviceList{
+			Disks: []libvirtxml.DomainDisk{
+				{
+					Type:   "file",
+					Device: "disk",
+					Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "qcow2"},
+					Source: &libvirtxml.DomainDiskSource{File: "/var/lib/virtlet/volumes/encrypted"},
+				},
+				{
+					Type:   "file",
+					Device: "cdrom",
+					Driver: &libvirtxml.DomainDiskDriver{Name: "qemu", Type: "raw"},
+					Source: &libvirtxml.DomainDiskSource{File: "/var/lib/virtlet/config/nocloud.iso"},
+				},
+			},
+		},
+	}
+	domainXML, err := domain.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal(): %v", err)
+	}
+
+	var lookedUp []string
+	out, err := addDiskEncryption(domainXML, func(path string) (*libvirtxml.StorageEncryption, error) {
+		lookedUp = append(lookedUp, path)
+		if path != "/var/lib/virtlet/volumes/encrypted" {
+			return nil, nil
+		}
+		return &libvirtxml.StorageEncryption{
+			Format: "luks",
+			Secret: &libvirtxml.StorageEncryptionSecret{
+				Type: "passphrase",
+				UUID: "4a8d4b7c-50a1-5ad1-8d49-9ac8b5a7d0f1",
+			},
+		}, nil
+	})
+	if err != nil {
+		t.Fatalf("addDiskEncryption(): %v", err)
+	}
+	if len(lookedUp) != 2 {
+		t.Errorf("unexpected lookups: %v", lookedUp)
+	}
+
+	encryptionXML := `<encryption format="luks"><secret type="passphrase" uuid="4a8d4b7c-50a1-5ad1-8d49-9ac8b5a7d0f1"></secret></encryption></disk>`
+	if n := strings.Count(out, encryptionXML); n != 1 {
+		t.Errorf("expected one encrypted disk, got %d:\n%s", n, out)
+	}
+	if strings.Replace(out, encryptionXML, "</disk>", 1) != domainXML {
+		t.Errorf("unexpected changes in the domain xml:\n%s", out)
+	}
+	var parsed libvirtxml.Domain
+	if err := parsed.Unmarshal(out); err != nil {
+		t.Errorf("failed to parse the updated domain xml: %v", err)
+	}
+
+	unchanged, err := addDiskEncryption(domainXML, func(string) (*libvirtxml.StorageEncryption, error) { return nil, nil })
+	switch {
+	case err != nil:
+		t.Errorf("addDiskEncryption(): %v", err)
+	case unchanged != domainXML:
+		t.Errorf("the domain xml was changed without encrypted disks:\n%s", unchanged)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// volumeExportDir is the directory used to hold the temporary
+// files with volume snapshots
+var volumeExportDir = "/var/lib/virtlet/exports"
+
+// convertVolume makes a compressed qcow2 copy of the volume image.
+// It's a variable so it can be replaced in the tests
+var convertVolume = func(srcPath, dstPath string) error {
+	args := []string{"convert", "-c", "-O", "qcow2", srcPath, dstPath}
+	if out, err := utils.RunSandboxed(utils.QemuImgLimits, "qemu-img", args...); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// exportFile is an io.ReadCloser that removes the underlying
+// file when closed
+type exportFile struct {
+	*os.File
+}
+
+func (f exportFile) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); rmErr != nil && err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+func (v *VirtualizationTool) findVolume(name string) (virt.VirtStorageVolume, error) {
+	for _, pool := range v.volumePools() {
+		vol, err := pool.LookupVolumeByName(name)
+		switch {
+		case err == nil:
+			return vol, nil
+		case err != virt.ErrStorageVolumeNotFound:
+			return nil, err
+		}
+	}
+	return nil, virt.ErrStorageVolumeNotFound
+}
+
+// freezeDomain makes the filesystems of a running VM consistent
+// and pauses it. It returns a function that undoes the changes
+func freezeDomain(domain virt.VirtDomain) (func(), error) {
+	// guest-fsfreeze-freeze flushes the data to the disk, so
+	// the qcow2 image is in a consistent state after the VM
+	// is paused
+	if err := guestAgentExecute(domain, "guest-fsfreeze-freeze", nil, nil); err != nil {
+		return nil, fmt.Errorf("can't freeze the filesystems (is qemu-guest-agent running in the VM?): %v", err)
+	}
+	thaw := func() {
+		if err := guestAgentExecute(domain, "guest-fsfreeze-thaw", nil, nil); err != nil {
+			glog.Warningf("Failed to thaw the filesystems after volume export: %v", err)
+		}
+	}
+	if err := domain.Suspend(); err != nil {
+		thaw()
+		return nil, fmt.Errorf("can't pause the VM: %v", err)
+	}
+	return func() {
+		if err := domain.Resume(); err != nil {
+			glog.Warningf("Failed to resume the VM after volume export: %v", err)
+		}
+		thaw()
+	}, nil
+}
+
+// ExportVolume makes a snapshot of the specified volume of the
+// container VM as a compressed qcow2 image. "root" denotes the root
+// volume, other names correspond to qcow2 flexvolumes. If the VM is
+// running, its filesystems are frozen using QEMU guest agent and
+// the VM is paused while the snapshot is being made. The snapshot
+// is removed when the returned ReadCloser is closed.
+func (v *VirtualizationTool) ExportVolume(containerId, volumeName string) (io.ReadCloser, int64, error) {
+	config, _, err := v.getVMConfigFromMetadata(containerId)
+	if err != nil {
+		return nil, 0, err
+	}
+	if config == nil {
+		return nil, 0, fmt.Errorf("container %q not found", containerId)
+	}
+	if config.PodAnnotations[VolumeEncryptionSecretKeyName] != "" {
+		return nil, 0, fmt.Errorf("can't export the volumes of container %q because they're encrypted", containerId)
+	}
+
+	libvirtVolName := "virtlet-" + containerId + "-" + volumeName
+	if volumeName == "root" {
+		libvirtVolName = "virtlet_root_" + containerId
+	}
+	vol, err := v.findVolume(libvirtVolName)
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't find volume %q of container %q: %v", volumeName, containerId, err)
+	}
+	volPath, err := vol.Path()
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't get the path of volume %q: %v", libvirtVolName, err)
+	}
+
+	domain, err := v.domainConn.LookupDomainByUUIDString(containerId)
+	if err != nil && err != virt.ErrDomainNotFound {
+		return nil, 0, fmt.Errorf("can't lookup the domain of container %q: %v", containerId, err)
+	}
+	if domain != nil {
+		state, err := domain.State()
+		if err != nil {
+			return nil, 0, fmt.Errorf("can't get the state of the domain of container %q: %v", containerId, err)
+		}
+		if state == virt.DOMAIN_RUNNING {
+			unfreeze, err := freezeDomain(domain)
+			if err != nil {
+				return nil, 0, err
+			}
+			defer unfreeze()
+		}
+	}
+
+	if err := os.MkdirAll(volumeExportDir, 0700); err != nil {
+		return nil, 0, fmt.Errorf("can't create the export directory %q: %v", volumeExportDir, err)
+	}
+	f, err := ioutil.TempFile(volumeExportDir, libvirtVolName+"-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("can't create a temporary file for the snapshot: %v", err)
+	}
+	f.Close()
+	if err := convertVolume(volPath, f.Name()); err != nil {
+		os.Remove(f.Name())
+		return nil, 0, err
+	}
+
+	snapshotPath := f.Name()
+	f, err = os.Open(snapshotPath)
+	if err != nil {
+		os.Remove(snapshotPath)
+		return nil, 0, fmt.Errorf("can't open the snapshot file: %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		exportFile{f}.Close()
+		return nil, 0, fmt.Errorf("can't stat the snapshot file: %v", err)
+	}
+	return exportFile{f}, fi.Size(), nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package libvirttools
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+	"github.com/Mirantis/virtlet/pkg/virt/fake"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+func TestExportVolume(t *testing.T) {
+	ct := newContainerTester(t, fake.NewToplevelRecorder())
+	defer ct.teardown()
+
+	sandbox := criapi.GetSandboxes(1)[0]
+	ct.setPodSandbox(sandbox)
+	containerId := ct.createContainer(sandbox, nil)
+	ct.clock.Advance(1 * time.Second)
+	ct.startContainer(containerId)
+
+	d, err := ct.domainConn.LookupDomainByUUIDString(containerId)
+	if err != nil {
+		t.Fatalf("LookupDomainByUUIDString(): %v", err)
+	}
+	domain := d.(*fake.FakeDomain)
+
+	savedExportDir, savedConvertVolume := volumeExportDir, convertVolume
+	defer func() {
+		volumeExportDir, convertVolume = savedExportDir, savedConvertVolume
+	}()
+	volumeExportDir = filepath.Join(ct.tmpDir, "exports")
+	var convertedPath string
+	convertVolume = func(srcPath, dstPath string) error {
+		if state, _ := domain.State(); state != virt.DOMAIN_PAUSED {
+			t.Errorf("the VM is not paused during the conversion")
+		}
+		if !domain.GuestFSFrozen() {
+			t.Errorf("the filesystems are not frozen during the conversion")
+		}
+		convertedPath = srcPath
+		return ioutil.WriteFile(dstPath, []byte("snapshot"), 0600)
+	}
+
+	r, size, err := ct.virtTool.ExportVolume(containerId, "root")
+	if err != nil {
+		t.Fatalf("ExportVolume(): %v", err)
+	}
+	vol, err := ct.virtTool.findVolume("virtlet_root_" + containerId)
+	if err != nil {
+		t.Fatalf("can't find the root volume: %v", err)
+	}
+	if expectedPath, _ := vol.Path(); convertedPath != expectedPath {
+		t.Errorf("bad volume path: %q instead of %q", convertedPath, expectedPath)
+	}
+	if state, _ := domain.State(); state != virt.DOMAIN_RUNNING {
+		t.Errorf("the VM is not resumed after the export")
+	}
+	if domain.GuestFSFrozen() {
+		t.Errorf("the filesystems are not thawed after the export")
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("error reading the snapshot: %v", err)
+	}
+	if string(data) != "snapshot" || size != int64(len(data)) {
+		t.Errorf("bad snapshot: %q (size %d)", data, size)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("error closing the snapshot: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(volumeExportDir); len(files) != 0 {
+		t.Errorf("the snapshot file is not removed")
+	}
+
+	if _, _, err := ct.virtTool.ExportVolume(containerId, "nosuchvolume"); err == nil {
+		t.Errorf("ExportVolume() didn't fail for a non-existing volume")
+	}
+}
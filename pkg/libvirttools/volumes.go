@@ -32,6 +32,7 @@ type ImageManager interface {
 
 type VolumeOwner interface {
 	StoragePool() virt.VirtStoragePool
+	StoragePoolByName(name string) (virt.VirtStoragePool, error)
 	DomainConnection() virt.VirtDomainConnection
 	ImageManager() ImageManager
 	RawDevices() []string
@@ -0,0 +1,45 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// NewForeignDomainsHandler returns an http.Handler that lists the
+// libvirt domains on the node which are not managed by Virtlet and
+// can be adopted by the pods, in JSON format
+func NewForeignDomainsHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		domains, err := v.libvirtVirtualizationTool.ListForeignDomains()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(domains); err != nil {
+			glog.Warningf("Error sending the list of foreign domains: %v", err)
+		}
+	})
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/audit"
+)
+
+// auditedCalls lists the CRI calls that change the state of the
+// node or give access to the VMs, which are recorded in the audit log
+var auditedCalls = map[string]bool{
+	"RunPodSandbox":            true,
+	"StopPodSandbox":           true,
+	"RemovePodSandbox":         true,
+	"CreateContainer":          true,
+	"StartContainer":           true,
+	"StopContainer":            true,
+	"RemoveContainer":          true,
+	"UpdateContainerResources": true,
+	"ReopenContainerLog":       true,
+	"ExecSync":                 true,
+	"Exec":                     true,
+	"Attach":                   true,
+	"PortForward":              true,
+	"UpdateRuntimeConfig":      true,
+	"PullImage":                true,
+	"RemoveImage":              true,
+}
+
+// SetAuditLog makes VirtletManager record the mutating CRI calls,
+// image pulls and QMP passthrough commands in the audit log
+func (v *VirtletManager) SetAuditLog(l *audit.Log) {
+	v.auditLog = l
+}
+
+// criRequester returns the identity of the CRI client, which is
+// available if the CRI socket listener is wrapped using
+// audit.NewPeerListener()
+func criRequester(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil && p.Addr.String() != "" {
+		return p.Addr.String()
+	}
+	return audit.UnknownRequester
+}
+
+// auditTarget returns the description of the object of a CRI call
+func auditTarget(req, resp interface{}) string {
+	var parts []string
+	add := func(name, value string) {
+		if value != "" {
+			parts = append(parts, name+"="+value)
+		}
+	}
+	if r, ok := req.(*kubeapi.RunPodSandboxRequest); ok {
+		if md := r.GetConfig().GetMetadata(); md != nil {
+			add("pod", md.Namespace+"/"+md.Name)
+		}
+	}
+	if r, ok := req.(*kubeapi.CreateContainerRequest); ok {
+		if md := r.GetSandboxConfig().GetMetadata(); md != nil {
+			add("pod", md.Namespace+"/"+md.Name)
+		}
+		if md := r.GetConfig().GetMetadata(); md != nil {
+			add("container", md.Name)
+		}
+	}
+	for _, o := range []interface{}{req, resp} {
+		if r, ok := o.(interface{ GetPodSandboxId() string }); ok {
+			add("podSandboxId", r.GetPodSandboxId())
+		}
+		if r, ok := o.(interface{ GetContainerId() string }); ok {
+			add("containerId", r.GetContainerId())
+		}
+	}
+	if r, ok := req.(interface{ GetImage() *kubeapi.ImageSpec }); ok {
+		add("image", r.GetImage().GetImage())
+	}
+	return strings.Join(parts, ",")
+}
+
+// auditCall records the CRI call in the audit log if it's
+// a mutating one
+func (v *VirtletManager) auditCall(ctx context.Context, method string, req, resp interface{}, err error) {
+	if v.auditLog == nil {
+		return
+	}
+	name := path.Base(method)
+	if !auditedCalls[name] {
+		return
+	}
+	v.auditLog.Record(name, criRequester(ctx), auditTarget(req, resp), err)
+}
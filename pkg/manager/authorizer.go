@@ -0,0 +1,122 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	authenticationv1 "k8s.io/client-go/pkg/apis/authentication/v1"
+	authorizationv1 "k8s.io/client-go/pkg/apis/authorization/v1"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+var errUnauthorized = errors.New("unauthorized")
+
+// PodAuthorizer checks whether the user identified by the bearer
+// token is allowed to access the VM of the specified pod using
+// one of the APIs that are exposed as pod subresources, such as
+// QMP passthrough or file copy
+type PodAuthorizer interface {
+	// Authorize returns the name of the user if the access is
+	// allowed and an error otherwise
+	Authorize(token, namespace, name, subresource string) (string, error)
+}
+
+type k8sPodAuthorizer struct{}
+
+// NewK8sPodAuthorizer returns a PodAuthorizer that authenticates the
+// users using TokenReview API and then checks whether they can
+// create the subresource of the pod using SubjectAccessReview API
+func NewK8sPodAuthorizer() PodAuthorizer {
+	return k8sPodAuthorizer{}
+}
+
+func (k8sPodAuthorizer) Authorize(token, namespace, name, subresource string) (string, error) {
+	clientset, err := utils.GetK8sClientset(nil)
+	if err != nil {
+		return "", err
+	}
+	tr, err := clientset.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	})
+	switch {
+	case err != nil:
+		return "", fmt.Errorf("TokenReview failed: %v", err)
+	case !tr.Status.Authenticated:
+		return "", errUnauthorized
+	}
+	user := tr.Status.User
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar, err := clientset.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace:   namespace,
+				Verb:        "create",
+				Resource:    "pods",
+				Subresource: subresource,
+				Name:        name,
+			},
+			User:   user.Username,
+			Groups: user.Groups,
+			Extra:  extra,
+		},
+	})
+	switch {
+	case err != nil:
+		return "", fmt.Errorf("SubjectAccessReview failed: %v", err)
+	case !sar.Status.Allowed:
+		return "", fmt.Errorf("user %q is not allowed to create pods/%s in namespace %q", user.Username, subresource, namespace)
+	}
+	return user.Username, nil
+}
+
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// authorizePodRequest checks the bearer token of the request using
+// the authorizer for the subresource of the pod and returns the name
+// of the user. If the access is denied, it records the denial in the
+// audit log under the specified operation name, writes the error
+// response and returns false
+func (v *VirtletManager) authorizePodRequest(w http.ResponseWriter, r *http.Request, authorizer PodAuthorizer, operation, podNs, podName, subresource string) (string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "bearer token must be specified", http.StatusUnauthorized)
+		return "", false
+	}
+	user, err := authorizer.Authorize(token, podNs, podName, subresource)
+	if err != nil {
+		glog.Warningf("Access to pods/%s of %s/%s denied: %v", subresource, podNs, podName, err)
+		v.auditLog.Record(operation, r.RemoteAddr, podNs+"/"+podName, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", false
+	}
+	return user, true
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+)
+
+// ReopenContainerLog makes Virtlet reopen the console log file of
+// the container. This corresponds to ReopenContainerLog CRI call
+// that's made by the kubelet after it rotates the container log.
+func (v *VirtletManager) ReopenContainerLog(containerId string) error {
+	glog.V(3).Infof("ReopenContainerLog called for container %q", containerId)
+	containerInfo, err := v.metadataStore.Container(containerId).Retrieve()
+	switch {
+	case err != nil:
+		return err
+	case containerInfo == nil:
+		return errContainerNotFound
+	}
+	return v.StreamServer.ReopenContainerLog(containerId)
+}
+
+// NewConsoleLogHandler returns an http.Handler that makes Virtlet
+// reopen VM console log files after they're rotated by an external
+// tool such as logrotate. The handler accepts POST requests with
+// optional containerId query parameter. If containerId is not
+// specified, the logs of all the containers are reopened.
+func NewConsoleLogHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		containerId := r.URL.Query().Get("containerId")
+		if containerId == "" {
+			v.StreamServer.ReopenAllContainerLogs()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		err := v.ReopenContainerLog(containerId)
+		switch {
+		case err == errContainerNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, fmt.Sprintf("error reopening the log: %v", err), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	crashDumpEventReason       = "VMCrashDumped"
+	crashDumpFailedEventReason = "VMCrashDumpFailed"
+)
+
+// postCrashDumpEvent posts a k8s event for the pod of the crashed
+// VM with the location of the memory dump
+func postCrashDumpEvent(dump *libvirttools.CrashDump) {
+	clientset, err := utils.GetK8sClientset(nil)
+	if err != nil {
+		glog.Warningf("Can't post crash dump event for pod %s/%s: %v", dump.PodNamespace, dump.PodName, err)
+		return
+	}
+	pod, err := clientset.Pods(dump.PodNamespace).Get(dump.PodName, meta_v1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Can't post crash dump event for pod %s/%s: %v", dump.PodNamespace, dump.PodName, err)
+		return
+	}
+	nodeName := os.Getenv("KUBE_NODE_NAME")
+	event := &v1.Event{
+		ObjectMeta: meta_v1.ObjectMeta{
+			GenerateName: pod.Name + ".",
+			Namespace:    pod.Namespace,
+		},
+		InvolvedObject: v1.ObjectReference{
+			Kind:            "Pod",
+			Namespace:       pod.Namespace,
+			Name:            pod.Name,
+			UID:             pod.UID,
+			APIVersion:      "v1",
+			ResourceVersion: pod.ResourceVersion,
+		},
+		Source:         v1.EventSource{Component: "virtlet", Host: nodeName},
+		FirstTimestamp: meta_v1.Now(),
+		LastTimestamp:  meta_v1.Now(),
+		Count:          1,
+		Type:           v1.EventTypeWarning,
+	}
+	if dump.Error != "" {
+		event.Reason = crashDumpFailedEventReason
+		event.Message = fmt.Sprintf("VM crashed, memory dump failed: %s", dump.Error)
+	} else {
+		event.Reason = crashDumpEventReason
+		event.Message = fmt.Sprintf("VM crashed, memory dump (%d bytes) written to %s on node %s", dump.Size, dump.Path, nodeName)
+	}
+	if _, err := clientset.Events(pod.Namespace).Create(event); err != nil {
+		glog.Warningf("Can't post crash dump event for pod %s/%s: %v", dump.PodNamespace, dump.PodName, err)
+	}
+}
+
+// EnableCrashDumps enables memory dumps of the crashed VMs that
+// have VirtletCrashDump annotation. The dumps are kept in dir with
+// their total size limited by spoolSize, and an event is posted
+// for the pod when its VM crashes
+func (v *VirtletManager) EnableCrashDumps(dir string, spoolSize int64) {
+	v.libvirtVirtualizationTool.SetCrashDumps(dir, spoolSize, postCrashDumpEvent)
+}
+
+// RunCrashDumpCollector periodically collects the memory dumps of
+// the crashed VMs until stopCh is closed
+func (v *VirtletManager) RunCrashDumpCollector(interval time.Duration, stopCh <-chan struct{}) {
+	defer v.RecoverPanic()
+	v.libvirtVirtualizationTool.RunCrashDumpCollector(interval, stopCh)
+}
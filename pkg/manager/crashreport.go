@@ -0,0 +1,154 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+
+	"github.com/Mirantis/virtlet/pkg/crashreport"
+)
+
+// maxCallRequestSize limits the length of the request
+// text of the in-flight CRI calls in the crash reports
+const maxCallRequestSize = 1024
+
+// InFlightCall describes a CRI call that's being handled
+type InFlightCall struct {
+	Method  string    `json:"method"`
+	Started time.Time `json:"started"`
+	Request string    `json:"request"`
+}
+
+type callTracker struct {
+	sync.Mutex
+	nextID int
+	calls  map[int]*InFlightCall
+}
+
+func newCallTracker() *callTracker {
+	return &callTracker{calls: make(map[int]*InFlightCall)}
+}
+
+func (t *callTracker) add(method string, req interface{}) int {
+	reqText := fmt.Sprint(req)
+	if len(reqText) > maxCallRequestSize {
+		reqText = reqText[:maxCallRequestSize] + "..."
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.nextID++
+	t.calls[t.nextID] = &InFlightCall{Method: method, Started: time.Now(), Request: reqText}
+	return t.nextID
+}
+
+func (t *callTracker) remove(id int) {
+	t.Lock()
+	defer t.Unlock()
+	delete(t.calls, id)
+}
+
+func (t *callTracker) list() []InFlightCall {
+	t.Lock()
+	defer t.Unlock()
+	r := make([]InFlightCall, 0, len(t.calls))
+	for _, c := range t.calls {
+		r = append(r, *c)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].Started.Before(r[j].Started) })
+	return r
+}
+
+// interceptCall keeps track of the CRI calls being handled
+// so they're included in the crash reports, and records the
+// mutating calls in the audit log
+func (v *VirtletManager) interceptCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	id := v.calls.add(info.FullMethod, req)
+	defer v.calls.remove(id)
+	defer v.RecoverPanic()
+	resp, err := handler(ctx, req)
+	v.auditCall(ctx, info.FullMethod, req, resp, err)
+	return resp, err
+}
+
+// crashReportSandbox describes a pod sandbox in the crash report
+type crashReportSandbox struct {
+	ID        string `json:"id"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name,omitempty"`
+	State     string `json:"state,omitempty"`
+}
+
+func (v *VirtletManager) crashReportSandboxes() (interface{}, error) {
+	sandboxes, err := v.metadataStore.ListPodSandboxes(nil)
+	if err != nil {
+		return nil, err
+	}
+	var r []crashReportSandbox
+	for _, sandbox := range sandboxes {
+		s := crashReportSandbox{ID: sandbox.GetID()}
+		if info, err := sandbox.Retrieve(); err == nil && info != nil {
+			s.State = info.State.String()
+			if info.Metadata != nil {
+				s.Namespace, s.Name = info.Metadata.Namespace, info.Metadata.Name
+			}
+		}
+		r = append(r, s)
+	}
+	return r, nil
+}
+
+func (v *VirtletManager) crashReportFDKeys() (interface{}, error) {
+	lister, ok := v.fdManager.(interface {
+		ListKeys() ([]string, error)
+	})
+	if !ok {
+		return nil, errors.New("fd manager can't list the keys")
+	}
+	return lister.ListKeys()
+}
+
+// EnableCrashReports makes Virtlet write a report with the stack
+// traces, the pod sandboxes, the keys of tapmanager's file
+// descriptors and the in-flight CRI calls into dir upon a panic
+func (v *VirtletManager) EnableCrashReports(dir string) {
+	r := crashreport.NewReporter(dir)
+	r.AddStateCollector("sandboxes", v.crashReportSandboxes)
+	r.AddStateCollector("fdKeys", v.crashReportFDKeys)
+	r.AddStateCollector("inFlightCalls", func() (interface{}, error) {
+		return v.calls.list(), nil
+	})
+	v.crashReporter = r
+}
+
+// RecoverPanic writes a crash report if crash reports are
+// enabled and the calling goroutine is panicking, and then
+// continues panicking. It must be invoked directly via defer
+func (v *VirtletManager) RecoverPanic() {
+	if p := recover(); p != nil {
+		if v.crashReporter != nil {
+			v.crashReporter.HandlePanic(p)
+		}
+		panic(p)
+	}
+}
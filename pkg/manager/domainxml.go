@@ -0,0 +1,89 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// annotationOverridesFromQuery parses the annotation query
+// parameters, each of which must have KEY=VALUE form
+func annotationOverridesFromQuery(values []string) (map[string]string, error) {
+	overrides := map[string]string{}
+	for _, s := range values {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("bad annotation %q, must be KEY=VALUE", s)
+		}
+		overrides[parts[0]] = parts[1]
+	}
+	return overrides, nil
+}
+
+// NewDomainXMLHandler returns an http.Handler that returns the
+// libvirt domain definitions of VM pods in JSON format. The pod is
+// specified using either podId or namespace and name query
+// parameters. The response includes the domain definition that's
+// currently stored by libvirt and the one that Virtlet renders for
+// the current pod annotations. If any annotation=KEY=VALUE query
+// parameters are specified, the response also includes the domain
+// definition for the annotations updated accordingly and the diff
+// between it and the one for the current annotations. Empty VALUE
+// means removing the annotation.
+func NewDomainXMLHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		podId, podNs, podName := q.Get("podId"), q.Get("namespace"), q.Get("name")
+		if podId == "" && (podNs == "" || podName == "") {
+			http.Error(w, "either pod id or pod namespace and name must be specified", http.StatusBadRequest)
+			return
+		}
+		overrides, err := annotationOverridesFromQuery(q["annotation"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		containerId, err := v.findPodContainer(podId, podNs, podName)
+		switch {
+		case err == errContainerNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		report, err := v.libvirtVirtualizationTool.DomainXML(containerId, overrides)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			glog.Warningf("Error sending domain XML for container %s: %v", containerId, err)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// FileCopySubresource is the pod subresource that the users must
+	// be allowed to "create" in order to copy files into and out of
+	// the VM
+	FileCopySubresource = "cp"
+	// maxFileCopySize limits the size of the files that are
+	// copied into the VMs
+	maxFileCopySize = 256 * 1024 * 1024
+)
+
+var (
+	errContainerNotFound = errors.New("VM pod not found")
+	errNoPodSpecified    = errors.New("either pod id or pod namespace and name must be specified")
+)
+
+// findPodContainer returns the id of the VM container of the pod
+// specified either by its id or by its namespace and name
+func (v *VirtletManager) findPodContainer(podId, podNs, podName string) (string, error) {
+	sandboxes, err := v.metadataStore.ListPodSandboxes(nil)
+	if err != nil {
+		return "", err
+	}
+	found := false
+	for _, sandbox := range sandboxes {
+		if podId != "" {
+			if sandbox.GetID() == podId {
+				found = true
+				break
+			}
+			continue
+		}
+		info, err := sandbox.Retrieve()
+		if err != nil {
+			return "", err
+		}
+		if info != nil && info.Metadata.Namespace == podNs && info.Metadata.Name == podName {
+			podId = sandbox.GetID()
+			found = true
+			break
+		}
+	}
+	if !found {
+		return "", errContainerNotFound
+	}
+
+	containers, err := v.metadataStore.ListPodContainers(podId)
+	if err != nil {
+		return "", err
+	}
+	if len(containers) == 0 {
+		return "", errContainerNotFound
+	}
+	return containers[0].GetID(), nil
+}
+
+// podSandboxRef returns the namespace and the name of the pod
+// with the specified id
+func (v *VirtletManager) podSandboxRef(podId string) (string, string, error) {
+	sandboxes, err := v.metadataStore.ListPodSandboxes(nil)
+	if err != nil {
+		return "", "", err
+	}
+	for _, sandbox := range sandboxes {
+		if sandbox.GetID() != podId {
+			continue
+		}
+		info, err := sandbox.Retrieve()
+		if err != nil {
+			return "", "", err
+		}
+		if info == nil || info.Metadata == nil {
+			break
+		}
+		return info.Metadata.Namespace, info.Metadata.Name, nil
+	}
+	return "", "", errContainerNotFound
+}
+
+// authorizePodTarget checks the access to the subresource of the pod
+// specified using either podId or namespace and name query parameters
+// of the request, and returns the container id, the namespace and
+// the name of the pod together with the name of the user. The pods
+// specified by namespace and name are only looked up after the
+// access is granted, so the users can't find out whether the pods
+// they have no access to exist. Upon failure, it writes the error
+// response and returns false
+func (v *VirtletManager) authorizePodTarget(w http.ResponseWriter, r *http.Request, authorizer PodAuthorizer, operation, subresource string) (string, string, string, string, bool) {
+	q := r.URL.Query()
+	podId, podNs, podName := q.Get("podId"), q.Get("namespace"), q.Get("name")
+	if podId == "" && (podNs == "" || podName == "") {
+		writePodTargetError(w, errNoPodSpecified)
+		return "", "", "", "", false
+	}
+	if bearerToken(r) == "" {
+		http.Error(w, "bearer token must be specified", http.StatusUnauthorized)
+		return "", "", "", "", false
+	}
+	if podId != "" {
+		// pod ids can't be guessed, so looking them up
+		// before checking the access reveals nothing
+		var err error
+		if podNs, podName, err = v.podSandboxRef(podId); err != nil {
+			writePodTargetError(w, err)
+			return "", "", "", "", false
+		}
+	}
+	user, ok := v.authorizePodRequest(w, r, authorizer, operation, podNs, podName, subresource)
+	if !ok {
+		return "", "", "", "", false
+	}
+	containerId, err := v.findPodContainer(podId, podNs, podName)
+	if err != nil {
+		writePodTargetError(w, err)
+		return "", "", "", "", false
+	}
+	return containerId, podNs, podName, user, true
+}
+
+// writePodTargetError writes the response for an error that
+// occurred while looking up the pod
+func writePodTargetError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case errContainerNotFound:
+		status = http.StatusNotFound
+	case errNoPodSpecified:
+		status = http.StatusBadRequest
+	}
+	http.Error(w, err.Error(), status)
+}
+
+// NewFileCopyHandler returns an http.Handler that copies files into
+// and out of running VMs using QEMU guest agent. The pod is
+// specified using either podId or namespace and name query
+// parameters, and path parameter specifies the absolute path of the
+// file inside the VM. GET requests return the contents of the
+// file, PUT requests replace it with the request body which must
+// not exceed 256 MiB. The caller must pass a bearer token in
+// Authorization header that's checked using the authorizer for the
+// cp subresource of the pod.
+func NewFileCopyHandler(v *VirtletManager, authorizer PodAuthorizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPut {
+			http.Error(w, "only GET and PUT requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		filePath := r.URL.Query().Get("path")
+		if !path.IsAbs(filePath) {
+			http.Error(w, fmt.Sprintf("absolute file path must be specified, got %q", filePath), http.StatusBadRequest)
+			return
+		}
+		operation := "CopyFromVM"
+		if r.Method == http.MethodPut {
+			operation = "CopyToVM"
+		}
+		if r.Method == http.MethodPut && r.ContentLength > maxFileCopySize {
+			http.Error(w, fmt.Sprintf("the file is too big (more than %d bytes)", maxFileCopySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		containerId, podNs, podName, user, ok := v.authorizePodTarget(w, r, authorizer, operation, FileCopySubresource)
+		if !ok {
+			return
+		}
+		target := fmt.Sprintf("%s/%s:%s", podNs, podName, filePath)
+
+		if r.Method == http.MethodPut {
+			glog.V(2).Infof("User %q copying file %q into container %s", user, filePath, containerId)
+			// the body may be chunked, so its size
+			// is also checked while it's being read
+			body := http.MaxBytesReader(w, r.Body, maxFileCopySize)
+			err := v.libvirtVirtualizationTool.CopyToContainer(containerId, filePath, body)
+			v.auditLog.Record(operation, user, target, err)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		glog.V(2).Infof("User %q copying file %q from container %s", user, filePath, containerId)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		cw := &countingWriter{w: w}
+		err := v.libvirtVirtualizationTool.CopyFromContainer(containerId, filePath, cw)
+		v.auditLog.Record(operation, user, target, err)
+		switch {
+		case err == nil:
+		case cw.n == 0:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			// the file is streamed to the client, so once
+			// its part is sent, the only way to report the
+			// error is aborting the response
+			glog.Warningf("Error sending file %q from container %s: %v", filePath, containerId, err)
+			panic(http.ErrAbortHandler)
+		}
+	})
+}
+
+// countingWriter counts the bytes written to the
+// underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jonboulle/clockwork"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/audit"
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+type fakePodAuthorizer struct {
+	calls []string
+}
+
+var _ PodAuthorizer = &fakePodAuthorizer{}
+
+func (a *fakePodAuthorizer) Authorize(token, namespace, name, subresource string) (string, error) {
+	a.calls = append(a.calls, token+" "+namespace+"/"+name+" "+subresource)
+	return "", errUnauthorized
+}
+
+func newManagerWithFakePod(t *testing.T) (*VirtletManager, *kubeapi.PodSandboxConfig) {
+	store, err := metadata.NewFakeMetadataStore()
+	if err != nil {
+		t.Fatalf("Error creating fake metadata store: %v", err)
+	}
+	sandboxes := criapi.GetSandboxes(1)
+	psi, err := metadata.NewPodSandboxInfo(sandboxes[0], nil, kubeapi.PodSandboxState_SANDBOX_READY, clockwork.NewRealClock())
+	if err != nil {
+		t.Fatalf("NewPodSandboxInfo(): %v", err)
+	}
+	if err := store.PodSandbox(sandboxes[0].Metadata.Uid).Save(func(*metadata.PodSandboxInfo) (*metadata.PodSandboxInfo, error) {
+		return psi, nil
+	}); err != nil {
+		t.Fatalf("Error saving pod sandbox: %v", err)
+	}
+	container := criapi.GetContainersConfig(sandboxes)[0]
+	if err := store.Container(container.ContainerId).Save(func(*metadata.ContainerInfo) (*metadata.ContainerInfo, error) {
+		return &metadata.ContainerInfo{Name: container.Name, SandboxID: container.SandboxId}, nil
+	}); err != nil {
+		t.Fatalf("Error saving container: %v", err)
+	}
+	return &VirtletManager{metadataStore: store}, sandboxes[0]
+}
+
+func TestFileCopyAuthorization(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "filecopy")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	auditLogPath := filepath.Join(tmpDir, "audit.log")
+	auditLog, err := audit.Open(auditLogPath, "virtlet")
+	if err != nil {
+		t.Fatalf("audit.Open(): %v", err)
+	}
+	defer auditLog.Close()
+
+	v, sandbox := newManagerWithFakePod(t)
+	v.SetAuditLog(auditLog)
+	authorizer := &fakePodAuthorizer{}
+	handler := NewFileCopyHandler(v, authorizer)
+	podId := sandbox.Metadata.Uid
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		length int64
+		status int
+		call   string
+	}{
+		{
+			name:   "no token",
+			method: "GET",
+			url:    "/cp?namespace=default&name=testName_0&path=/etc/hostname",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "no path",
+			method: "GET",
+			url:    "/cp?namespace=default&name=testName_0",
+			token:  "foobar",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "no pod",
+			method: "GET",
+			url:    "/cp?path=/etc/hostname",
+			token:  "foobar",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "denied access to nonexistent pod",
+			method: "GET",
+			url:    "/cp?namespace=default&name=nonexistent&path=/etc/hostname",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/nonexistent cp",
+		},
+		{
+			name:   "unknown pod id",
+			method: "GET",
+			url:    "/cp?podId=nonexistent&path=/etc/hostname",
+			token:  "foobar",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "too big file",
+			method: "PUT",
+			url:    "/cp?namespace=default&name=testName_0&path=/etc/hostname",
+			token:  "foobar",
+			length: maxFileCopySize + 1,
+			status: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:   "denied copy from VM",
+			method: "GET",
+			url:    "/cp?namespace=default&name=testName_0&path=/etc/hostname",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/testName_0 cp",
+		},
+		{
+			name:   "denied copy to VM by pod id",
+			method: "PUT",
+			url:    "/cp?podId=" + podId + "&path=/etc/hostname",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/testName_0 cp",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			authorizer.calls = nil
+			req := httptest.NewRequest(tc.method, tc.url, bytes.NewBufferString("foo"))
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			if tc.length != 0 {
+				req.ContentLength = tc.length
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("bad status code %d instead of %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			var expectedCalls []string
+			if tc.call != "" {
+				expectedCalls = []string{tc.call}
+			}
+			if !reflect.DeepEqual(authorizer.calls, expectedCalls) {
+				t.Errorf("bad authorizer calls: %#v instead of %#v", authorizer.calls, expectedCalls)
+			}
+		})
+	}
+
+	// the denials must be recorded in the audit log, the requests
+	// that don't reach the authorizer must not
+	f, err := os.Open(auditLogPath)
+	if err != nil {
+		t.Fatalf("Open(): %v", err)
+	}
+	defer f.Close()
+	var ops []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("bad audit record %q: %v", scanner.Text(), err)
+		}
+		if r.Outcome != audit.OutcomeFailure {
+			t.Errorf("bad audit record %q", scanner.Text())
+		}
+		ops = append(ops, r.Operation+" "+r.Target)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("error reading audit log: %v", err)
+	}
+	expectedOps := []string{
+		"CopyFromVM default/nonexistent",
+		"CopyFromVM default/testName_0",
+		"CopyToVM default/testName_0",
+	}
+	if !reflect.DeepEqual(ops, expectedOps) {
+		t.Errorf("bad audit log operations: %#v instead of %#v", ops, expectedOps)
+	}
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"github.com/Mirantis/virtlet/pkg/health"
+)
+
+// pinger is implemented by FDManagers that can check
+// the connection to tapmanager
+type pinger interface {
+	Ping() error
+}
+
+// HealthChecks returns the checks that verify that Virtlet is able
+// to manage the VMs: libvirt connectivity, tapmanager socket health
+// and metadata store health
+func (v *VirtletManager) HealthChecks() []health.Check {
+	checks := []health.Check{
+		{Name: "libvirt", Run: v.libvirtVirtualizationTool.CheckLibvirt},
+		{Name: "metadata", Run: v.metadataStore.Check},
+	}
+	if p, ok := v.fdManager.(pinger); ok {
+		checks = append(checks, health.Check{Name: "tapmanager", Run: p.Ping})
+	}
+	return checks
+}
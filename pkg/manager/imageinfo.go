@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+// ImageInfo contains the information about an image in the image
+// store that doesn't fit into CRI Image message
+type ImageInfo struct {
+	// Name is the image name
+	Name string `json:"name"`
+	// VolumeName is the name of the libvirt volume holding the image
+	VolumeName string `json:"volumeName"`
+	// Format is the format of the image, "qcow2" or "raw"
+	Format string `json:"format"`
+	// VirtualSize is the size of the disk as seen by the VM
+	VirtualSize uint64 `json:"virtualSize"`
+	// Size is the size of the image volume
+	Size uint64 `json:"size"`
+	// DiskUsage is the amount of host storage used by the image volume
+	DiskUsage uint64 `json:"diskUsage"`
+	// Arch is the architecture of the image in GOARCH notation.
+	// Empty value means the node architecture
+	Arch string `json:"arch,omitempty"`
+	// LastUsed is the time when the image was last pulled
+	// or used to create a container
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+}
+
+// imageMatchesFilter implements CRI image filter semantics. The
+// image reference in the filter matches the image if it refers to
+// the same image volume, so the tags are ignored as Virtlet doesn't
+// keep several tags of the same image. Empty filter matches any image
+func imageMatchesFilter(volumeName string, filter *kubeapi.ImageFilter) bool {
+	if filter == nil || filter.GetImage() == nil || filter.GetImage().Image == "" {
+		return true
+	}
+	filterVolumeName, err := libvirttools.ImageNameToVolumeName(filter.GetImage().Image)
+	if err != nil {
+		glog.Warningf("Bad image reference %q in the image filter: %v", filter.GetImage().Image, err)
+		return false
+	}
+	return filterVolumeName == volumeName
+}
+
+// touchImage updates the last used time of the image
+func (v *VirtletManager) touchImage(imageName string) {
+	volumeName, err := libvirttools.ImageNameToVolumeName(imageName)
+	if err == nil {
+		err = v.metadataStore.SetImageLastUsed(volumeName, time.Now())
+	}
+	if err != nil {
+		glog.Warningf("Error updating the last used time of image %q: %v", imageName, err)
+	}
+}
+
+// imageInfo returns the information about the image stored in the
+// volume or nil if the volume doesn't hold an image
+func (v *VirtletManager) imageInfo(volume virt.VirtStorageVolume) (*ImageInfo, error) {
+	volumeName := volume.Name()
+	imageName, err := v.metadataStore.GetImageName(volumeName)
+	if err != nil || imageName == "" {
+		return nil, err
+	}
+
+	info := &ImageInfo{
+		Name:       imageName,
+		VolumeName: volumeName,
+	}
+	if info.Size, err = volume.Size(); err != nil {
+		return nil, err
+	}
+	if info.DiskUsage, err = volume.Allocation(); err != nil {
+		return nil, err
+	}
+	if info.Arch, err = v.metadataStore.GetImageArch(volumeName); err != nil {
+		return nil, err
+	}
+	lastUsed, err := v.metadataStore.GetImageLastUsed(volumeName)
+	if err != nil {
+		return nil, err
+	}
+	if !lastUsed.IsZero() {
+		info.LastUsed = &lastUsed
+	}
+
+	path, err := volume.Path()
+	if err == nil {
+		info.Format, info.VirtualSize, err = libvirttools.ImageFileInfo(path)
+	}
+	if err != nil {
+		// the image info is still useful without the format
+		glog.Warningf("Error getting the format of image %q (volume %q): %v", imageName, volumeName, err)
+	}
+	return info, nil
+}
+
+// ImageInfo returns the information about the images that match
+// the filter
+func (v *VirtletManager) ImageInfo(filter *kubeapi.ImageFilter) ([]*ImageInfo, error) {
+	volumes, err := v.libvirtImageTool.ListVolumes()
+	if err != nil {
+		return nil, err
+	}
+	r := []*ImageInfo{}
+	for _, volume := range volumes {
+		if !imageMatchesFilter(volume.Name(), filter) {
+			continue
+		}
+		info, err := v.imageInfo(volume)
+		if err != nil {
+			return nil, err
+		}
+		if info != nil {
+			r = append(r, info)
+		}
+	}
+	return r, nil
+}
+
+// NewImageInfoHandler returns an http.Handler that returns the
+// information about the images in the image store in JSON format.
+// The images can be filtered using 'image' query parameter
+func NewImageInfoHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		var filter *kubeapi.ImageFilter
+		if image := r.URL.Query().Get("image"); image != "" {
+			filter = &kubeapi.ImageFilter{Image: &kubeapi.ImageSpec{Image: image}}
+		}
+		images, err := v.ImageInfo(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(images); err != nil {
+			glog.Warningf("Error sending image info: %v", err)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+)
+
+// NewLibvirtMetricsHandler returns an http.Handler that serves
+// libvirt API call duration metrics in Prometheus text exposition
+// format
+func NewLibvirtMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := libvirttools.WriteLibvirtMetrics(w); err != nil {
+			glog.Warningf("Error writing libvirt metrics: %v", err)
+		}
+	})
+}
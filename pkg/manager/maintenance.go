@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+)
+
+const defaultDrainTimeout = 2 * time.Minute
+
+type maintenanceStatus struct {
+	Maintenance bool `json:"maintenance"`
+}
+
+type drainResult struct {
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewMaintenanceHandler returns an http.Handler that manages the
+// maintenance mode of the node. GET requests return the current
+// mode. POST requests with action=drain query parameter put the
+// node into maintenance mode and shut down the VMs, streaming the
+// progress as JSON objects, one per line, and finishing with an
+// object that has "done" field set to true. The timeout query
+// parameter sets the graceful shutdown timeout for each VM. POST
+// requests with action=resume turn the maintenance mode off.
+func NewMaintenanceHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vt := v.libvirtVirtualizationTool
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(maintenanceStatus{Maintenance: vt.InMaintenance()}); err != nil {
+				glog.Warningf("Error sending maintenance status: %v", err)
+			}
+			return
+		case http.MethodPost:
+		default:
+			http.Error(w, "only GET and POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+
+		q := r.URL.Query()
+		switch q.Get("action") {
+		case "resume":
+			vt.SetMaintenance(false)
+			w.WriteHeader(http.StatusOK)
+			return
+		case "drain":
+		default:
+			http.Error(w, "action must be either drain or resume", http.StatusBadRequest)
+			return
+		}
+
+		timeout := defaultDrainTimeout
+		if s := q.Get("timeout"); s != "" {
+			var err error
+			if timeout, err = time.ParseDuration(s); err != nil || timeout <= 0 {
+				http.Error(w, "bad timeout", http.StatusBadRequest)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		send := func(o interface{}) {
+			if err := enc.Encode(o); err != nil {
+				glog.Warningf("Error sending drain progress: %v", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		glog.V(1).Infof("Draining the node")
+		err := vt.Drain(timeout, func(event libvirttools.DrainEvent) {
+			send(event)
+		})
+		result := drainResult{Done: true}
+		if err != nil {
+			glog.Errorf("Error draining the node: %v", err)
+			result.Error = err.Error()
+		}
+		send(result)
+	})
+}
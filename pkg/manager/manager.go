@@ -19,8 +19,10 @@ package manager
 import (
 	"errors"
 	"fmt"
-	"net"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -30,12 +32,18 @@ import (
 	"github.com/jonboulle/clockwork"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	grpcmetadata "google.golang.org/grpc/metadata"
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/Mirantis/virtlet/pkg/audit"
+	"github.com/Mirantis/virtlet/pkg/bootserver"
 	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/crashreport"
+	"github.com/Mirantis/virtlet/pkg/dhcp"
 	"github.com/Mirantis/virtlet/pkg/imagetranslation"
 	"github.com/Mirantis/virtlet/pkg/libvirttools"
 	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/nettools"
 	"github.com/Mirantis/virtlet/pkg/stream"
 	"github.com/Mirantis/virtlet/pkg/tapmanager"
 	"github.com/Mirantis/virtlet/pkg/utils"
@@ -47,6 +55,23 @@ const (
 	runtimeName             = "virtlet"
 	runtimeVersion          = "0.1.0"
 	defaultDownloadProtocol = "https"
+	downloadConfigEnvVar    = "VIRTLET_DOWNLOAD_CONFIG"
+	// useControllerEnvVar makes virtlet rely on virtlet-controller
+	// for publishing VirtletImageMapping objects in the image
+	// translations directory instead of listing them upon each pull,
+	// and makes it handle the snapshot requests that are assigned
+	// to the node by the controller
+	useControllerEnvVar = "VIRTLET_USE_CONTROLLER"
+	// ImageArchHeader is the name of gRPC response header that
+	// ImageStatus uses to report the architecture of the image
+	ImageArchHeader = "virtlet-image-arch"
+	// cniPluginVersionsConditionType is the type of the runtime
+	// condition that reports CNI spec version mismatches
+	cniPluginVersionsConditionType = "CNIPluginVersionsSupported"
+	// vhostNetConditionType is the type of the runtime condition
+	// that tells whether vhost-net acceleration is used for the
+	// tap interfaces of the new VMs
+	vhostNetConditionType = "VhostNetAvailable"
 )
 
 type VirtletManager struct {
@@ -58,7 +83,17 @@ type VirtletManager struct {
 	metadataStore              metadata.MetadataStore
 	fdManager                  tapmanager.FDManager
 	imageTranslationConfigsDir string
+	useController              bool
 	StreamServer               *stream.Server
+	// calls keeps track of the CRI calls being handled
+	calls         *callTracker
+	crashReporter *crashreport.Reporter
+	// cniPluginVersions is the result of probing
+	// the installed CNI plugins, if any
+	cniPluginVersions *cni.PluginVersionReport
+	// auditLog records the mutating operations,
+	// nil if auditing is disabled
+	auditLog *audit.Log
 }
 
 func NewVirtletManager(libvirtUri, poolName, downloadProtocol, storageBackend, rawDevices, imageTranslationConfigsDir string, metadataStore metadata.MetadataStore, fdManager tapmanager.FDManager) (*VirtletManager, error) {
@@ -70,7 +105,14 @@ func NewVirtletManager(libvirtUri, poolName, downloadProtocol, storageBackend, r
 	if downloadProtocol == "" {
 		downloadProtocol = defaultDownloadProtocol
 	}
-	downloader := utils.NewDownloader(downloadProtocol)
+	var downloadSettings []utils.DownloadSettings
+	if downloadConfigPath := os.Getenv(downloadConfigEnvVar); downloadConfigPath != "" {
+		downloadSettings, err = utils.LoadDownloadSettings(downloadConfigPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	downloader := utils.NewDownloaderWithSettings(downloadProtocol, downloadSettings)
 
 	conn, err := libvirttools.NewConnection(libvirtUri)
 	if err != nil {
@@ -90,7 +132,7 @@ func NewVirtletManager(libvirtUri, poolName, downloadProtocol, storageBackend, r
 		// doesn't produce correct name for cdrom devices
 		libvirttools.GetNocloudVolume)
 	// TODO: pool name should be passed like for imageTool
-	libvirtVirtualizationTool, err := libvirttools.NewVirtualizationTool(conn, conn, libvirtImageTool, metadataStore, "volumes", rawDevices, volSrc)
+	libvirtVirtualizationTool, err := libvirttools.NewVirtualizationTool(conn, conn, libvirtImageTool, metadataStore, libvirttools.VolumePoolName(), rawDevices, volSrc)
 	if err != nil {
 		return nil, err
 	}
@@ -110,13 +152,15 @@ func NewVirtletManager(libvirtUri, poolName, downloadProtocol, storageBackend, r
 	}
 
 	virtletManager := &VirtletManager{
-		server:                     grpc.NewServer(),
 		libvirtImageTool:           libvirtImageTool,
 		libvirtVirtualizationTool:  libvirtVirtualizationTool,
 		metadataStore:              metadataStore,
 		fdManager:                  fdManager,
 		imageTranslationConfigsDir: imageTranslationConfigsDir,
+		useController:              os.Getenv(useControllerEnvVar) != "",
+		calls:                      newCallTracker(),
 	}
+	virtletManager.server = grpc.NewServer(grpc.UnaryInterceptor(virtletManager.interceptCall))
 
 	kubeapi.RegisterRuntimeServiceServer(virtletManager.server, virtletManager)
 	kubeapi.RegisterImageServiceServer(virtletManager.server, virtletManager)
@@ -128,18 +172,52 @@ func (v *VirtletManager) Serve(addr string) error {
 	if err := syscall.Unlink(addr); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	ln, err := net.Listen("unix", addr)
+	ln, fi, err := utils.ListenUnix(addr)
 	if err != nil {
 		return err
 	}
-	defer ln.Close()
-	return v.server.Serve(ln)
+	defer func() {
+		ln.Close()
+		if err := utils.RemoveSocket(addr, fi); err != nil {
+			glog.Warningf("Can't remove CRI socket %q: %v", addr, err)
+		}
+	}()
+	// the requesters of the CRI calls are identified
+	// by the peer credentials for the audit log
+	return v.server.Serve(audit.NewPeerListener(ln))
 }
 
 func (v *VirtletManager) Stop() {
 	v.server.Stop()
 }
 
+// Shutdown makes Serve() return after the CRI requests being handled
+// are completed or the timeout expires, stops the streaming server and
+// closes the metadata store, flushing the pending writes. The VMs
+// are left running, so they can be picked up by the next Virtlet
+// process
+func (v *VirtletManager) Shutdown(timeout time.Duration) {
+	doneCh := make(chan struct{})
+	go func() {
+		v.server.GracefulStop()
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(timeout):
+		for _, c := range v.calls.list() {
+			glog.Warningf("Interrupting CRI call %s started at %v", c.Method, c.Started)
+		}
+		v.server.Stop()
+	}
+	if v.StreamServer != nil {
+		v.StreamServer.Stop()
+	}
+	if err := v.metadataStore.Close(); err != nil {
+		glog.Errorf("Error closing the metadata store: %v", err)
+	}
+}
+
 func (v *VirtletManager) Version(ctx context.Context, in *kubeapi.VersionRequest) (*kubeapi.VersionResponse, error) {
 	vRuntimeAPIVersion := runtimeAPIVersion
 	vRuntimeName := runtimeName
@@ -188,6 +266,82 @@ func (v *VirtletManager) RunPodSandbox(ctx context.Context, in *kubeapi.RunPodSa
 		PodNs:   podNs,
 		PodName: podName,
 	}
+	if macAddress, found := config.GetAnnotations()[libvirttools.MACAddressKeyName]; found {
+		if _, err := utils.ParseLocalMACAddress(macAddress); err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.MACAddressKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.MACAddressKeyName, err)
+		}
+		pnd.MACAddress = macAddress
+	}
+	if ingressRules, found := config.GetAnnotations()[libvirttools.IngressAllowKeyName]; found {
+		if _, err := nettools.ParseIngressRules(ingressRules); err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.IngressAllowKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.IngressAllowKeyName, err)
+		}
+		pnd.IngressRules = ingressRules
+	}
+	if networks, found := config.GetAnnotations()[libvirttools.CNINetworksKeyName]; found {
+		var err error
+		if pnd.Networks, err = cni.ParseNetworkList(networks); err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.CNINetworksKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.CNINetworksKeyName, err)
+		}
+	}
+	if debug, found := config.GetAnnotations()[libvirttools.DebugKeyName]; found {
+		var err error
+		if pnd.Debug, err = strconv.ParseBool(strings.TrimSpace(debug)); err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.DebugKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.DebugKeyName, err)
+		}
+	}
+	if pnd.Debug {
+		glog.Infof("Verbose logging is enabled for pod %s (%s)", podName, podId)
+	}
+	if l2Network, found := config.GetAnnotations()[libvirttools.L2NetworkKeyName]; found {
+		err := validateL2Network(l2Network, config.GetAnnotations())
+		if err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.L2NetworkKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.L2NetworkKeyName, err)
+		}
+		pnd.L2Network = l2Network
+	}
+	if multicast, found := config.GetAnnotations()[libvirttools.BridgeMulticastKeyName]; found {
+		mode, err := nettools.ParseBridgeMulticastMode(multicast)
+		if err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.BridgeMulticastKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.BridgeMulticastKeyName, err)
+		}
+		pnd.BridgeMulticast = string(mode)
+	}
+	if extraMACs, found := config.GetAnnotations()[libvirttools.DHCPExtraMACsKeyName]; found {
+		if _, err := dhcp.ParseExtraHardwareAddrs(extraMACs); err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.DHCPExtraMACsKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.DHCPExtraMACsKeyName, err)
+		}
+		pnd.DHCPExtraMACs = extraMACs
+	}
+	if relaxed, found := config.GetAnnotations()[libvirttools.DHCPRelaxedKeyName]; found {
+		var err error
+		if pnd.DHCPRelaxed, err = strconv.ParseBool(strings.TrimSpace(relaxed)); err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.DHCPRelaxedKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.DHCPRelaxedKeyName, err)
+		}
+	}
+	if netBoot, found := config.GetAnnotations()[libvirttools.NetBootKeyName]; found {
+		if _, _, err := bootserver.ParseBootPath(netBoot); err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.NetBootKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.NetBootKeyName, err)
+		}
+		pnd.NetBoot = netBoot
+	}
+	if virtioNetOptions, found := config.GetAnnotations()[libvirttools.VirtioNetOptionsKeyName]; found {
+		opts, err := utils.ParseVirtioNetOptions(virtioNetOptions)
+		if err != nil {
+			glog.Errorf("Invalid %s annotation for pod %s (%s): %v", libvirttools.VirtioNetOptionsKeyName, podName, podId, err)
+			return nil, fmt.Errorf("invalid %s annotation: %v", libvirttools.VirtioNetOptionsKeyName, err)
+		}
+		pnd.VirtioNetOptions = opts.String()
+	}
 	// Mimic kubelet's method of handling nameservers.
 	// As of k8s 1.5.2, kubelet doesn't use any nameserver information from CNI.
 	// (TODO: recheck this for 1.6)
@@ -233,6 +387,21 @@ func (v *VirtletManager) RunPodSandbox(ctx context.Context, in *kubeapi.RunPodSa
 	}, err
 }
 
+// validateL2Network validates the value of VirtletL2Network annotation
+// and checks that the pod doesn't use the annotations that don't make
+// sense for L2 mode
+func validateL2Network(l2Network string, annotations map[string]string) error {
+	if _, err := nettools.ParseL2Attachment(l2Network); err != nil {
+		return err
+	}
+	for _, key := range []string{libvirttools.CNINetworksKeyName, libvirttools.IngressAllowKeyName, libvirttools.DHCPExtraMACsKeyName, libvirttools.DHCPRelaxedKeyName, libvirttools.NetBootKeyName} {
+		if _, found := annotations[key]; found {
+			return fmt.Errorf("%s annotation can't be used along with %s", libvirttools.L2NetworkKeyName, key)
+		}
+	}
+	return nil
+}
+
 func validatePodSandboxConfig(config *kubeapi.PodSandboxConfig) error {
 	metadata := config.GetMetadata()
 	if metadata == nil {
@@ -286,6 +455,11 @@ func (v *VirtletManager) RemovePodSandbox(ctx context.Context, in *kubeapi.Remov
 	glog.V(2).Infof("RemovePodSandbox called for pod %s", podSandboxId)
 	glog.V(3).Infof("RemovePodSandbox: %s", spew.Sdump(in))
 
+	if err := v.libvirtVirtualizationTool.RemovePodVolumes(podSandboxId); err != nil {
+		glog.Errorf("Error when removing volumes of pod sandbox %q: %v", podSandboxId, err)
+		return nil, err
+	}
+
 	if err := v.metadataStore.PodSandbox(podSandboxId).Save(
 		func(c *metadata.PodSandboxInfo) (*metadata.PodSandboxInfo, error) {
 			return nil, nil
@@ -403,6 +577,8 @@ func (v *VirtletManager) CreateContainer(ctx context.Context, in *kubeapi.Create
 		return nil, err
 	}
 
+	v.touchImage(config.GetImage().Image)
+
 	response := &kubeapi.CreateContainerResponse{ContainerId: uuid}
 	glog.V(3).Infof("CreateContainer response: %s", spew.Sdump(response))
 	return response, nil
@@ -428,11 +604,26 @@ func (v *VirtletManager) StopContainer(ctx context.Context, in *kubeapi.StopCont
 		glog.Errorf("Error when stopping container %s: %v", in.ContainerId, err)
 		return nil, err
 	}
+	v.reportVMStopped(in.ContainerId)
 	response := &kubeapi.StopContainerResponse{}
 	glog.V(2).Infof("Sending stop response for containerID: %s", in.ContainerId)
 	return response, nil
 }
 
+// reportVMStopped tells tapmanager that the VM of the container
+// is no longer running, so the networks attached to the pod
+// afterwards are not hot-plugged into it
+func (v *VirtletManager) reportVMStopped(containerId string) {
+	containerInfo, err := v.metadataStore.Container(containerId).Retrieve()
+	if err != nil || containerInfo == nil {
+		glog.Warningf("Can't get the pod of container %s: %v", containerId, err)
+		return
+	}
+	if err := v.fdManager.Report(containerInfo.SandboxID, &tapmanager.NetdevReport{VMStopped: true}); err != nil {
+		glog.Warningf("Error reporting the VM of container %s as stopped: %v", containerId, err)
+	}
+}
+
 func (v *VirtletManager) RemoveContainer(ctx context.Context, in *kubeapi.RemoveContainerRequest) (*kubeapi.RemoveContainerResponse, error) {
 	glog.V(2).Infof("RemoveContainer called for containerID: %s", in.ContainerId)
 	glog.V(3).Infof("RemoveContainer: %s", spew.Sdump(in))
@@ -498,34 +689,101 @@ func (v *VirtletManager) UpdateRuntimeConfig(context.Context, *kubeapi.UpdateRun
 	return &kubeapi.UpdateRuntimeConfigResponse{}, nil
 }
 
+// SetCNIPluginVersionReport makes Status() include the results of
+// probing the installed CNI plugins in the runtime conditions
+func (v *VirtletManager) SetCNIPluginVersionReport(report *cni.PluginVersionReport) {
+	v.cniPluginVersions = report
+}
+
 func (v *VirtletManager) Status(context.Context, *kubeapi.StatusRequest) (*kubeapi.StatusResponse, error) {
 	ready := true
 	runtimeReadyStr := kubeapi.RuntimeReady
 	networkReadyStr := kubeapi.NetworkReady
+	conditions := []*kubeapi.RuntimeCondition{
+		{
+			Type:   runtimeReadyStr,
+			Status: ready,
+		},
+		{
+			Type:   networkReadyStr,
+			Status: ready,
+		},
+	}
+	if v.cniPluginVersions != nil {
+		conditions = append(conditions, cniPluginVersionCondition(v.cniPluginVersions))
+	}
+	conditions = append(conditions, vhostNetCondition())
 	return &kubeapi.StatusResponse{
 		Status: &kubeapi.RuntimeStatus{
-			Conditions: []*kubeapi.RuntimeCondition{
-				{
-					Type:   runtimeReadyStr,
-					Status: ready,
-				},
-				{
-					Type:   networkReadyStr,
-					Status: ready,
-				},
-			},
+			Conditions: conditions,
 		},
 	}, nil
 }
 
+// cniPluginVersionCondition returns the runtime condition that tells
+// whether the spec versions of the CNI configurations are supported
+// by both the plugins and Virtlet. It doesn't affect the readiness of
+// the network, as the mismatches may only concern the networks that
+// aren't used by any pods
+func cniPluginVersionCondition(report *cni.PluginVersionReport) *kubeapi.RuntimeCondition {
+	problems := report.Problems()
+	if len(problems) == 0 {
+		return &kubeapi.RuntimeCondition{
+			Type:   cniPluginVersionsConditionType,
+			Status: true,
+		}
+	}
+	return &kubeapi.RuntimeCondition{
+		Type:    cniPluginVersionsConditionType,
+		Status:  false,
+		Reason:  "CNIVersionMismatch",
+		Message: strings.Join(problems, "; "),
+	}
+}
+
+// vhostNetCondition returns the runtime condition that tells whether
+// vhost-net acceleration is available for the VMs. The VMs work
+// without it, just with lower network throughput, so it doesn't
+// affect the readiness of the network
+func vhostNetCondition() *kubeapi.RuntimeCondition {
+	if utils.VhostNetAvailable() {
+		return &kubeapi.RuntimeCondition{
+			Type:   vhostNetConditionType,
+			Status: true,
+		}
+	}
+	return &kubeapi.RuntimeCondition{
+		Type:    vhostNetConditionType,
+		Status:  false,
+		Reason:  "VhostNetUnavailable",
+		Message: "vhost-net is disabled or vhost_net kernel module is not loaded, using plain tap netdevs",
+	}
+}
+
 func (v *VirtletManager) ContainerStats(ctx context.Context, in *kubeapi.ContainerStatsRequest) (*kubeapi.ContainerStatsResponse, error) {
-	glog.V(2).Infof("ContainerStats: %s", spew.Sdump(in))
-	return nil, errors.New("ContainerStats() not implemented")
+	glog.V(4).Infof("ContainerStats: %s", spew.Sdump(in))
+	stats, err := v.libvirtVirtualizationTool.ContainerStats(in.ContainerId)
+	if err != nil {
+		glog.Errorf("Error when getting container '%s' stats: %v", in.ContainerId, err)
+		return nil, err
+	}
+
+	response := &kubeapi.ContainerStatsResponse{Stats: stats}
+	glog.V(4).Infof("ContainerStats response: %s", spew.Sdump(response))
+	return response, nil
 }
 
 func (v *VirtletManager) ListContainerStats(ctx context.Context, in *kubeapi.ListContainerStatsRequest) (*kubeapi.ListContainerStatsResponse, error) {
-	glog.V(2).Infof("ListContainerStats: %s", spew.Sdump(in))
-	return nil, errors.New("ListContainerStats() not implemented")
+	glog.V(4).Infof("ListContainerStats: %s", spew.Sdump(in))
+	stats, err := v.libvirtVirtualizationTool.ListContainerStats(in.GetFilter())
+	if err != nil {
+		glog.Errorf("Error when listing container stats with filter %s: %v", spew.Sdump(in.GetFilter()), err)
+		return nil, err
+	}
+
+	response := &kubeapi.ListContainerStatsResponse{Stats: stats}
+	glog.V(4).Infof("ListContainerStats response: %s", spew.Sdump(response))
+	return response, nil
 }
 
 //
@@ -565,6 +823,9 @@ func (v *VirtletManager) ListImages(ctx context.Context, in *kubeapi.ListImagesR
 
 	images := make([]*kubeapi.Image, 0, len(virtVolumes))
 	for _, virtVolume := range virtVolumes {
+		if !imageMatchesFilter(virtVolume.Name(), in.GetFilter()) {
+			continue
+		}
 		image, err := v.imageFromVolume(virtVolume)
 		if err != nil {
 			glog.Errorf("ListImages: error when getting image info for volume %q: %v", virtVolume.Name(), err)
@@ -574,11 +835,6 @@ func (v *VirtletManager) ListImages(ctx context.Context, in *kubeapi.ListImagesR
 		if image == nil {
 			continue
 		}
-		if filter := in.GetFilter(); filter != nil {
-			if filter.GetImage() != nil && filter.GetImage().Image != image.RepoTags[0] {
-				continue
-			}
-		}
 		images = append(images, image)
 	}
 
@@ -623,10 +879,29 @@ func (v *VirtletManager) ImageStatus(ctx context.Context, in *kubeapi.ImageStatu
 		return nil, err
 	}
 
+	info, err := v.imageInfo(volume)
+	if err != nil {
+		glog.Errorf("ImageStatus: error getting extended info for image %q (volume %q): %v", imageName, volumeName, err)
+		return nil, err
+	}
+
 	// Note that after the change described in FIXME comment above
 	// the image can be nil here if it's not in virtlet db, but that's ok
 	response := &kubeapi.ImageStatusResponse{Image: image}
-	glog.V(3).Infof("ImageStatus response: %s", spew.Sdump(response))
+	// CRI v1alpha1 has no field for extra image info, so it's
+	// reported in the log and via the debug API, and the
+	// architecture is also passed in the response header
+	if info != nil {
+		arch := info.Arch
+		if arch == "" {
+			arch = runtime.GOARCH
+		}
+		if err := grpc.SetHeader(ctx, grpcmetadata.Pairs(ImageArchHeader, arch)); err != nil {
+			// this happens when ImageStatus is not invoked via gRPC
+			glog.V(4).Infof("ImageStatus: can't set image arch header: %v", err)
+		}
+	}
+	glog.V(3).Infof("ImageStatus response: %s\nImage info: %s", spew.Sdump(response), spew.Sdump(info))
 	return response, err
 }
 
@@ -641,16 +916,28 @@ func (v *VirtletManager) PullImage(ctx context.Context, in *kubeapi.PullImageReq
 	}
 
 	imageNameTranslator := v.getImageNameTranslator(ctx)
-	if _, err = v.libvirtImageTool.PullRemoteImageToVolume(imageName, volumeName, imageNameTranslator); err != nil {
+	_, platform, err := v.libvirtImageTool.PullRemoteImageToVolume(imageName, volumeName, imageNameTranslator)
+	if err != nil {
 		glog.Errorf("Error when pulling image %q: %v", imageName, err)
 		return nil, err
 	}
 
+	if err = v.metadataStore.SetImageArch(volumeName, platform.Arch); err != nil {
+		glog.Errorf("Error when setting architecture %q for image %q: %v", platform.Arch, imageName, err)
+		return nil, err
+	}
+
+	if err = v.metadataStore.SetImageMachineSettings(volumeName, platform.MachineType, platform.Emulator); err != nil {
+		glog.Errorf("Error when setting machine settings for image %q: %v", imageName, err)
+		return nil, err
+	}
+
 	err = v.metadataStore.SetImageName(volumeName, imageName)
 	if err != nil {
 		glog.Errorf("Error when setting image name %q for volume %q: %v", imageName, volumeName, err)
 		return nil, err
 	}
+	v.touchImage(imageName)
 
 	response := &kubeapi.PullImageResponse{ImageRef: imageName}
 	return response, nil
@@ -658,7 +945,9 @@ func (v *VirtletManager) PullImage(ctx context.Context, in *kubeapi.PullImageReq
 
 func (v *VirtletManager) getImageNameTranslator(ctx context.Context) imagetranslation.ImageNameTranslator {
 	var sources []imagetranslation.ConfigSource
-	sources = append(sources, imagetranslation.NewCRDSource("kube-system"))
+	if !v.useController {
+		sources = append(sources, imagetranslation.NewCRDSource("kube-system"))
+	}
 	if v.imageTranslationConfigsDir != "" {
 		sources = append(sources, imagetranslation.NewFileConfigSource(v.imageTranslationConfigsDir))
 	}
@@ -17,10 +17,15 @@ limitations under the License.
 package manager
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/davecgh/go-spew/spew"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/pkg/api/v1"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
 
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
 	"github.com/Mirantis/virtlet/tests/criapi"
 )
 
@@ -34,3 +39,118 @@ func TestPodSanboxConfigValidation(t *testing.T) {
 		t.Errorf("Invalid pod sandbox passed validation:\n%s", spew.Sdump(invalidSandboxes[0]))
 	}
 }
+
+func TestImageFilter(t *testing.T) {
+	volumeName, err := libvirttools.ImageNameToVolumeName("example.com/cirros.img")
+	if err != nil {
+		t.Fatalf("ImageNameToVolumeName(): %v", err)
+	}
+	for _, tc := range []struct {
+		filter  *kubeapi.ImageFilter
+		matches bool
+	}{
+		{nil, true},
+		{&kubeapi.ImageFilter{}, true},
+		{&kubeapi.ImageFilter{Image: &kubeapi.ImageSpec{}}, true},
+		{&kubeapi.ImageFilter{Image: &kubeapi.ImageSpec{Image: "example.com/cirros.img"}}, true},
+		{&kubeapi.ImageFilter{Image: &kubeapi.ImageSpec{Image: "example.com/cirros.img:latest"}}, true},
+		{&kubeapi.ImageFilter{Image: &kubeapi.ImageSpec{Image: "example.com/ubuntu.img"}}, false},
+		{&kubeapi.ImageFilter{Image: &kubeapi.ImageSpec{Image: "other.example.com/cirros.img"}}, false},
+	} {
+		if matches := imageMatchesFilter(volumeName, tc.filter); matches != tc.matches {
+			t.Errorf("imageMatchesFilter() for filter %s: %v instead of %v", spew.Sdump(tc.filter), matches, tc.matches)
+		}
+	}
+}
+
+func TestVMSlotsPolicy(t *testing.T) {
+	allocatable := v1.ResourceList{
+		v1.ResourceMemory: resource.MustParse("16Gi"),
+		v1.ResourceCPU:    resource.MustParse("3500m"),
+	}
+	for _, tc := range []struct {
+		name         string
+		count        int
+		memory       string
+		cpu          string
+		enabled      bool
+		slots        int64
+		errorMessage string
+	}{
+		{name: "disabled"},
+		{name: "fixed count", count: 5, memory: "1Gi", enabled: true, slots: 5},
+		{name: "memory", memory: "3Gi", enabled: true, slots: 5},
+		{name: "cpu", cpu: "500m", enabled: true, slots: 7},
+		{name: "memory and cpu", memory: "1Gi", cpu: "1", enabled: true, slots: 3},
+		{name: "negative count", count: -1, errorMessage: "VM slot count can't be negative"},
+		{name: "bad memory", memory: "foo", errorMessage: "bad memory per VM slot"},
+		{name: "zero cpu", cpu: "0", errorMessage: "CPU per VM slot must be positive"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			policy, err := ParseVMSlotsPolicy(tc.count, tc.memory, tc.cpu)
+			switch {
+			case tc.errorMessage != "":
+				if err == nil {
+					t.Fatalf("ParseVMSlotsPolicy() didn't fail")
+				}
+				if !strings.Contains(err.Error(), tc.errorMessage) {
+					t.Errorf("bad error message %q (expected it to contain %q)", err, tc.errorMessage)
+				}
+				return
+			case err != nil:
+				t.Fatalf("ParseVMSlotsPolicy(): %v", err)
+			}
+			if policy.Enabled() != tc.enabled {
+				t.Errorf("Enabled() returned %v instead of %v", policy.Enabled(), tc.enabled)
+			}
+			if slots := policy.SlotCount(allocatable); slots != tc.slots {
+				t.Errorf("SlotCount() returned %d instead of %d", slots, tc.slots)
+			}
+		})
+	}
+}
+
+func TestAuditTarget(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		req      interface{}
+		resp     interface{}
+		expected string
+	}{
+		{
+			name: "RunPodSandbox",
+			req: &kubeapi.RunPodSandboxRequest{
+				Config: &kubeapi.PodSandboxConfig{
+					Metadata: &kubeapi.PodSandboxMetadata{Namespace: "default", Name: "cirros-vm"},
+				},
+			},
+			resp:     &kubeapi.RunPodSandboxResponse{PodSandboxId: "69eec606-0493-5825-73a4-c5e0c0236155"},
+			expected: "pod=default/cirros-vm,podSandboxId=69eec606-0493-5825-73a4-c5e0c0236155",
+		},
+		{
+			name:     "StopContainer",
+			req:      &kubeapi.StopContainerRequest{ContainerId: "231700d5-c9a6-5a49-738d-99a954c51550"},
+			resp:     &kubeapi.StopContainerResponse{},
+			expected: "containerId=231700d5-c9a6-5a49-738d-99a954c51550",
+		},
+		{
+			name:     "PullImage",
+			req:      &kubeapi.PullImageRequest{Image: &kubeapi.ImageSpec{Image: "example.com/cirros.img"}},
+			resp:     &kubeapi.PullImageResponse{ImageRef: "example.com/cirros.img"},
+			expected: "image=example.com/cirros.img",
+		},
+		{
+			name: "failed call",
+			req:  &kubeapi.RemovePodSandboxRequest{PodSandboxId: "69eec606-0493-5825-73a4-c5e0c0236155"},
+			// the response is a typed nil pointer if the call fails
+			resp:     (*kubeapi.RemovePodSandboxResponse)(nil),
+			expected: "podSandboxId=69eec606-0493-5825-73a4-c5e0c0236155",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if target := auditTarget(tc.req, tc.resp); target != tc.expected {
+				t.Errorf("bad audit target %q instead of %q", target, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/tapmanager"
+)
+
+// NewNetworkCheckHandler returns an http.Handler that makes the
+// tapmanager set up the network for a temporary pod, validate it and
+// tear it down upon POST requests, returning the network check report
+// in JSON format. It's used by 'virtletctl diagnose' to verify the
+// CNI configuration of a node without running any VMs.
+func NewNetworkCheckHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := tapmanager.CheckNetwork(v.fdManager)
+		v.auditLog.Record("CheckNetwork", r.RemoteAddr, "", err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			glog.Warningf("Error sending network check report: %v", err)
+		}
+	})
+}
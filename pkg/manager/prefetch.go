@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+)
+
+const (
+	imagePulling = "pulling"
+	imagePulled  = "pulled"
+	imageFailed  = "failed"
+)
+
+type imagePullEvent struct {
+	Image  string `json:"image"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type imagePullResult struct {
+	Done  bool   `json:"done"`
+	Error string `json:"error,omitempty"`
+}
+
+// NewImagePullHandler returns an http.Handler that pulls the images
+// specified using 'image' query parameters of POST requests, one
+// by one. The progress is streamed as JSON objects, one per line,
+// finishing with an object that has "done" field set to true.
+// It's used to warm up the image store before the VM pods that
+// use the images are deployed.
+func NewImagePullHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		images := r.URL.Query()["image"]
+		if len(images) == 0 {
+			http.Error(w, "no images specified", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+		send := func(o interface{}) {
+			if err := enc.Encode(o); err != nil {
+				glog.Warningf("Error sending image pull progress: %v", err)
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+
+		failed := 0
+		for _, image := range images {
+			send(imagePullEvent{Image: image, Status: imagePulling})
+			_, err := v.PullImage(r.Context(), &kubeapi.PullImageRequest{
+				Image: &kubeapi.ImageSpec{Image: image},
+			})
+			v.auditLog.Record("PullImage", r.RemoteAddr, "image="+image, err)
+			if err != nil {
+				failed++
+				send(imagePullEvent{Image: image, Status: imageFailed, Error: err.Error()})
+			} else {
+				send(imagePullEvent{Image: image, Status: imagePulled})
+			}
+		}
+
+		result := imagePullResult{Done: true}
+		if failed > 0 {
+			result.Error = fmt.Sprintf("%d of %d images failed to pull", failed, len(images))
+		}
+		send(result)
+	})
+}
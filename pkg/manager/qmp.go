@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+)
+
+const (
+	// QMPSubresource is the pod subresource that the users must
+	// be allowed to "create" in order to use QMP passthrough
+	QMPSubresource = "qmp"
+	// maxQMPRequestSize limits the size of QMP passthrough requests
+	maxQMPRequestSize = 64 * 1024
+)
+
+// NewQMPHandler returns an http.Handler that passes QMP commands
+// through to the QEMU monitor of a VM. The pod is specified using
+// namespace and name query parameters and the request body is the
+// QMP command in JSON format. The caller must pass a bearer token
+// in Authorization header that's checked using the authorizer for
+// the qmp subresource of the pod. Only the commands allowed by
+// libvirttools are accepted. The response is the "return" value
+// of the QMP command.
+func NewQMPHandler(v *VirtletManager, authorizer PodAuthorizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		podNs, podName := q.Get("namespace"), q.Get("name")
+		if podNs == "" || podName == "" {
+			http.Error(w, "pod namespace and name must be specified", http.StatusBadRequest)
+			return
+		}
+		user, ok := v.authorizePodRequest(w, r, authorizer, "QMPCommand", podNs, podName, QMPSubresource)
+		if !ok {
+			return
+		}
+		target := podNs + "/" + podName
+
+		var cmd libvirttools.QMPCommand
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxQMPRequestSize)).Decode(&cmd); err != nil {
+			http.Error(w, fmt.Sprintf("bad QMP command: %v", err), http.StatusBadRequest)
+			return
+		}
+		containerId, err := v.findPodContainer("", podNs, podName)
+		switch {
+		case err == errContainerNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		glog.V(1).Infof("User %q executing QMP command %q for pod %s/%s", user, cmd.Execute, podNs, podName)
+		result, err := v.libvirtVirtualizationTool.QMPCommand(containerId, &cmd)
+		v.auditLog.Record("QMPCommand:"+cmd.Execute, user, target, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(result); err != nil {
+			glog.Warningf("Error sending QMP response for pod %s/%s: %v", podNs, podName, err)
+		}
+	})
+}
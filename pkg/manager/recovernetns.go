@@ -18,8 +18,11 @@ package manager
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
 	"github.com/Mirantis/virtlet/pkg/metadata"
 	"github.com/Mirantis/virtlet/pkg/tapmanager"
 )
@@ -47,15 +50,34 @@ func recoverNetworkNamespaces(metadataStore metadata.MetadataStore, fdManager ta
 			continue
 		}
 
+		pnd := &tapmanager.PodNetworkDesc{
+			PodId:   s.GetID(),
+			PodNs:   psi.Metadata.GetNamespace(),
+			PodName: psi.Metadata.GetName(),
+		}
+		// the networks need to be known to remove
+		// the pod from them later
+		if networks, found := psi.Annotations[libvirttools.CNINetworksKeyName]; found {
+			if pnd.Networks, err = cni.ParseNetworkList(networks); err != nil {
+				allErrors = append(allErrors, fmt.Errorf("sandbox %q has bad %s annotation: %v", s.GetID(), libvirttools.CNINetworksKeyName, err))
+			}
+		}
+		// the annotation was validated when the sandbox was created
+		pnd.Debug, _ = strconv.ParseBool(strings.TrimSpace(psi.Annotations[libvirttools.DebugKeyName]))
+		// the network must be recovered in L2 mode, too
+		pnd.L2Network = psi.Annotations[libvirttools.L2NetworkKeyName]
+		// used for the networks attached later
+		pnd.BridgeMulticast = psi.Annotations[libvirttools.BridgeMulticastKeyName]
+		// the dhcp server is restarted upon recovery
+		pnd.DHCPExtraMACs = psi.Annotations[libvirttools.DHCPExtraMACsKeyName]
+		pnd.DHCPRelaxed, _ = strconv.ParseBool(strings.TrimSpace(psi.Annotations[libvirttools.DHCPRelaxedKeyName]))
+		pnd.NetBoot = psi.Annotations[libvirttools.NetBootKeyName]
+
 		if _, err := fdManager.AddFDs(
 			s.GetID(),
 			tapmanager.GetFDPayload{
-				CNIConfig: cniConfig,
-				Description: &tapmanager.PodNetworkDesc{
-					PodId:   s.GetID(),
-					PodNs:   psi.Metadata.GetNamespace(),
-					PodName: psi.Metadata.GetName(),
-				},
+				CNIConfig:   cniConfig,
+				Description: pnd,
 			},
 		); err != nil {
 			allErrors = append(allErrors, fmt.Errorf("error recovering netns for %q pod: %v", s.GetID(), err))
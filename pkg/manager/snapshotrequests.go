@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/s3"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/vmrequest"
+)
+
+// exportSnapshot uploads the snapshot of the VM volume
+// that's specified by the request to object storage
+func (v *VirtletManager) exportSnapshot(r *vmrequest.VirtletSnapshotRequest) (int64, error) {
+	user := fmt.Sprintf("%s/%s/%s", vmrequest.SnapshotRequestResource, r.Namespace, r.Name)
+	target := fmt.Sprintf("%s/%s:%s", r.Namespace, r.Spec.PodName, r.VolumeName())
+	size, err := func() (int64, error) {
+		containerId, err := v.findPodContainer("", r.Namespace, r.Spec.PodName)
+		if err != nil {
+			return 0, err
+		}
+		creds, err := s3Credentials(r.Namespace, r.Spec.Secret)
+		if err != nil {
+			return 0, fmt.Errorf("can't get object storage credentials: %v", err)
+		}
+		glog.V(2).Infof("Snapshot request %s/%s: exporting volume %q of container %s to %s", r.Namespace, r.Name, r.VolumeName(), containerId, r.Spec.URL)
+		snapshot, size, err := v.libvirtVirtualizationTool.ExportVolume(containerId, r.VolumeName())
+		if err != nil {
+			return 0, err
+		}
+		defer snapshot.Close()
+		if err := s3.Upload(http.DefaultClient, r.Spec.URL, creds, snapshot, size); err != nil {
+			return 0, err
+		}
+		return size, nil
+	}()
+	v.auditLog.Record("ExportVolume", user, target, err)
+	return size, err
+}
+
+// RunSnapshotRequests uploads the volume snapshots requested using
+// VirtletSnapshotRequest objects that are assigned to this node by
+// virtlet-controller until stopCh is closed. It returns immediately
+// unless Virtlet is configured to use the controller
+func (v *VirtletManager) RunSnapshotRequests(resync time.Duration, stopCh <-chan struct{}) {
+	defer v.RecoverPanic()
+	if !v.useController {
+		return
+	}
+	nodeName := os.Getenv("KUBE_NODE_NAME")
+	if nodeName == "" {
+		glog.Errorf("KUBE_NODE_NAME is not set, can't handle snapshot requests")
+		return
+	}
+	cfg, err := utils.GetK8sClientConfig("")
+	if err != nil {
+		glog.Errorf("Can't get k8s client config: %v", err)
+		return
+	}
+	client, err := vmrequest.GetCRDRestClient(cfg)
+	if err != nil {
+		glog.Errorf("Can't create CRD client: %v", err)
+		return
+	}
+	vmrequest.RunNodeSnapshotRequests(client, nodeName, resync, v.exportSnapshot, stopCh)
+}
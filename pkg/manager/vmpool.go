@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/libvirttools"
+	"github.com/Mirantis/virtlet/pkg/tapmanager"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/pkg/vmpool"
+)
+
+const vmPoolNamespace = "kube-system"
+
+// RunStandbyPools periodically makes sure that the node has the
+// standby VMs requested by VirtualMachinePool objects that match
+// the node, until stopCh is closed. The standby VMs that are
+// left from the previous run of Virtlet are removed upon startup
+// by the garbage collector and replaced by the new ones
+func (v *VirtletManager) RunStandbyPools(interval time.Duration, stopCh <-chan struct{}) {
+	defer v.RecoverPanic()
+	if err := vmpool.RegisterCustomResourceType(); err != nil {
+		glog.Errorf("Failed to register VirtualMachinePool resource type: %v", err)
+		return
+	}
+	v.libvirtVirtualizationTool.SetStandbyNetworkAttacher(func(podSandboxID, qmpKey string) error {
+		return v.fdManager.Report(podSandboxID, &tapmanager.NetdevReport{HotplugVia: qmpKey})
+	})
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		for _, err := range v.syncStandbyPools() {
+			glog.Warningf("VM pool sync: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (v *VirtletManager) syncStandbyPools() []error {
+	nodeLabels, err := getNodeLabels()
+	if err != nil {
+		return []error{err}
+	}
+	ctx := context.Background()
+	pools, err := vmpool.ListPools(ctx, vmPoolNamespace, nodeLabels)
+	if err != nil {
+		return []error{fmt.Errorf("error listing VM pools: %v", err)}
+	}
+
+	var allErrors []error
+	var standbyPools []libvirttools.StandbyPool
+	for _, p := range pools {
+		memory, err := p.MemoryBytes()
+		if err != nil {
+			allErrors = append(allErrors, err)
+			continue
+		}
+		if err := v.ensureImage(ctx, p.Spec.Image); err != nil {
+			allErrors = append(allErrors, fmt.Errorf("VM pool %q: %v", p.Name, err))
+			continue
+		}
+		standbyPools = append(standbyPools, libvirttools.StandbyPool{
+			Name:      p.Name,
+			Image:     p.Spec.Image,
+			Size:      p.Spec.Size,
+			VCPUCount: p.Spec.VCPUCount,
+			Memory:    memory,
+		})
+	}
+	return append(allErrors, v.libvirtVirtualizationTool.SyncStandbyVMs(standbyPools)...)
+}
+
+// ensureImage pulls the image unless it's already in the image store
+func (v *VirtletManager) ensureImage(ctx context.Context, image string) error {
+	status, err := v.ImageStatus(ctx, &kubeapi.ImageStatusRequest{
+		Image: &kubeapi.ImageSpec{Image: image},
+	})
+	if err != nil {
+		return err
+	}
+	if status.Image != nil {
+		return nil
+	}
+	_, err = v.PullImage(ctx, &kubeapi.PullImageRequest{
+		Image: &kubeapi.ImageSpec{Image: image},
+	})
+	v.auditLog.Record("PullImage", "standby-vm-pool", "image="+image, err)
+	return err
+}
+
+func getNodeLabels() (map[string]string, error) {
+	nodeName := os.Getenv("KUBE_NODE_NAME")
+	if nodeName == "" {
+		return nil, nil
+	}
+	clientset, err := utils.GetK8sClientset(nil)
+	if err != nil {
+		return nil, err
+	}
+	node, err := clientset.CoreV1().Nodes().Get(nodeName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting node %q: %v", nodeName, err)
+	}
+	return node.Labels, nil
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+// VMSlotsResourceName is the name of the extended resource that's
+// advertised for the node so VM pods can request it and the
+// scheduler can limit the number of VMs on the node independently
+// of the number of containers
+const VMSlotsResourceName = "virtlet.cloud/vm-slots"
+
+// VMSlotsPolicy determines the number of VM slots advertised for
+// the node
+type VMSlotsPolicy struct {
+	// Count is the fixed number of VM slots. If it's zero, the
+	// number of slots is calculated from the allocatable memory
+	// and CPU of the node
+	Count int64
+	// MemoryPerSlot is the amount of node's allocatable memory
+	// reserved for each VM slot. nil means that memory doesn't
+	// limit the number of slots
+	MemoryPerSlot *resource.Quantity
+	// CPUPerSlot is the amount of node's allocatable CPU reserved
+	// for each VM slot. nil means that CPU doesn't limit the number
+	// of slots
+	CPUPerSlot *resource.Quantity
+}
+
+func parseSlotQuantity(s, what string) (*resource.Quantity, error) {
+	if s == "" {
+		return nil, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s per VM slot %q: %v", what, s, err)
+	}
+	if q.Sign() <= 0 {
+		return nil, fmt.Errorf("%s per VM slot must be positive, got %q", what, s)
+	}
+	return &q, nil
+}
+
+// ParseVMSlotsPolicy makes a VMSlotsPolicy from the fixed slot count
+// and the amounts of memory and CPU per slot specified as k8s
+// resource quantities such as "1Gi" or "500m". Empty memory or cpu
+// means that the corresponding resource doesn't limit the number of
+// slots
+func ParseVMSlotsPolicy(count int, memory, cpu string) (VMSlotsPolicy, error) {
+	if count < 0 {
+		return VMSlotsPolicy{}, errors.New("VM slot count can't be negative")
+	}
+	memoryPerSlot, err := parseSlotQuantity(memory, "memory")
+	if err != nil {
+		return VMSlotsPolicy{}, err
+	}
+	cpuPerSlot, err := parseSlotQuantity(cpu, "CPU")
+	if err != nil {
+		return VMSlotsPolicy{}, err
+	}
+	return VMSlotsPolicy{
+		Count:         int64(count),
+		MemoryPerSlot: memoryPerSlot,
+		CPUPerSlot:    cpuPerSlot,
+	}, nil
+}
+
+// Enabled returns true if VM slots need to be advertised for the
+// node
+func (p VMSlotsPolicy) Enabled() bool {
+	return p.Count > 0 || p.MemoryPerSlot != nil || p.CPUPerSlot != nil
+}
+
+// SlotCount returns the number of VM slots for the node with the
+// specified allocatable resources
+func (p VMSlotsPolicy) SlotCount(allocatable v1.ResourceList) int64 {
+	if p.Count > 0 {
+		return p.Count
+	}
+	var n int64 = -1
+	limit := func(slots int64) {
+		if n < 0 || slots < n {
+			n = slots
+		}
+	}
+	if p.MemoryPerSlot != nil {
+		memory := allocatable[v1.ResourceMemory]
+		limit(memory.Value() / p.MemoryPerSlot.Value())
+	}
+	if p.CPUPerSlot != nil {
+		cpu := allocatable[v1.ResourceCPU]
+		limit(cpu.MilliValue() / p.CPUPerSlot.MilliValue())
+	}
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// advertiseVMSlots sets the capacity of VMSlotsResourceName in the
+// status of the node according to the policy. The kubelet makes
+// the extended resources from node capacity allocatable
+func advertiseVMSlots(nodeName string, policy VMSlotsPolicy) error {
+	clientset, err := utils.GetK8sClientset(nil)
+	if err != nil {
+		return err
+	}
+	node, err := clientset.CoreV1().Nodes().Get(nodeName, meta_v1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error getting node %q: %v", nodeName, err)
+	}
+	slots := policy.SlotCount(node.Status.Allocatable)
+	if q, found := node.Status.Capacity[VMSlotsResourceName]; found && q.Value() == slots {
+		return nil
+	}
+	// "/" in the resource name must be escaped in JSON pointer
+	path := "/status/capacity/" + strings.Replace(VMSlotsResourceName, "/", "~1", -1)
+	patch, err := json.Marshal([]map[string]string{
+		{"op": "add", "path": path, "value": strconv.FormatInt(slots, 10)},
+	})
+	if err != nil {
+		return fmt.Errorf("error marshalling node status patch: %v", err)
+	}
+	if _, err := clientset.CoreV1().Nodes().Patch(nodeName, types.JSONPatchType, patch, "status"); err != nil {
+		return fmt.Errorf("error updating the capacity of node %q: %v", nodeName, err)
+	}
+	glog.V(1).Infof("Advertising %d VM slots for node %q", slots, nodeName)
+	return nil
+}
+
+// RunVMSlotsAdvertiser periodically advertises the number of VM
+// slots determined by the policy as an extended resource of the
+// node until stopCh is closed. The advertisement is repeated so
+// the changes of node's allocatable resources are taken into account
+func (v *VirtletManager) RunVMSlotsAdvertiser(policy VMSlotsPolicy, interval time.Duration, stopCh <-chan struct{}) {
+	defer v.RecoverPanic()
+	nodeName := os.Getenv("KUBE_NODE_NAME")
+	if nodeName == "" {
+		glog.Errorf("KUBE_NODE_NAME is not set, can't advertise VM slots")
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := advertiseVMSlots(nodeName, policy); err != nil {
+			glog.Warningf("Failed to advertise VM slots: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
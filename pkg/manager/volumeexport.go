@@ -0,0 +1,143 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/golang/glog"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/Mirantis/virtlet/pkg/s3"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	// VolumeExportSubresource is the pod subresource that the
+	// users must be allowed to "create" in order to export
+	// the volumes of the VM
+	VolumeExportSubresource = "export"
+
+	s3AccessKeyIDKey     = "accessKeyID"
+	s3SecretAccessKeyKey = "secretAccessKey"
+	s3RegionKey          = "region"
+)
+
+// VolumeExportResult describes the result of a volume export
+type VolumeExportResult struct {
+	// URL is the URL of the uploaded object
+	URL string `json:"url"`
+	// Size is the size of the uploaded object
+	Size int64 `json:"size"`
+}
+
+// s3Credentials retrieves object storage credentials from
+// the specified k8s secret
+func s3Credentials(ns, secretName string) (s3.Credentials, error) {
+	clientset, err := utils.GetK8sClientset(nil)
+	if err != nil {
+		return s3.Credentials{}, err
+	}
+	secret, err := clientset.Secrets(ns).Get(secretName, meta_v1.GetOptions{})
+	if err != nil {
+		return s3.Credentials{}, err
+	}
+	creds := s3.Credentials{
+		AccessKeyID:     string(secret.Data[s3AccessKeyIDKey]),
+		SecretAccessKey: string(secret.Data[s3SecretAccessKeyKey]),
+		Region:          string(secret.Data[s3RegionKey]),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return s3.Credentials{}, fmt.Errorf("secret %q must contain %q and %q keys", secretName, s3AccessKeyIDKey, s3SecretAccessKeyKey)
+	}
+	return creds, nil
+}
+
+// NewVolumeExportHandler returns an http.Handler that uploads a
+// snapshot of a VM volume as a compressed qcow2 image to
+// S3-compatible object storage. The pod is specified using either
+// podId or namespace and name query parameters. volume parameter
+// specifies the volume to export ("root" by default), url parameter
+// specifies the object URL and secret parameter specifies the name
+// of the secret in the pod namespace that holds the object storage
+// credentials. Only POST requests are accepted. The caller must pass
+// a bearer token in Authorization header that's checked using the
+// authorizer for the export subresource of the pod. The response
+// is VolumeExportResult in JSON format.
+func NewVolumeExportHandler(v *VirtletManager, authorizer PodAuthorizer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		volumeName, objectURL, secretName := q.Get("volume"), q.Get("url"), q.Get("secret")
+		if volumeName == "" {
+			volumeName = "root"
+		}
+		var err error
+		if secretName == "" {
+			err = errors.New("secret name must be specified")
+		} else {
+			var u *url.URL
+			u, err = url.Parse(objectURL)
+			if err == nil && ((u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+				err = fmt.Errorf("bad object URL %q", objectURL)
+			}
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		containerId, podNs, podName, user, ok := v.authorizePodTarget(w, r, authorizer, "ExportVolume", VolumeExportSubresource)
+		if !ok {
+			return
+		}
+		target := fmt.Sprintf("%s/%s:%s", podNs, podName, volumeName)
+
+		creds, err := s3Credentials(podNs, secretName)
+		if err != nil {
+			v.auditLog.Record("ExportVolume", user, target, err)
+			http.Error(w, fmt.Sprintf("can't get object storage credentials: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		glog.V(2).Infof("User %q exporting volume %q of container %s to %s", user, volumeName, containerId, objectURL)
+		snapshot, size, err := v.libvirtVirtualizationTool.ExportVolume(containerId, volumeName)
+		if err != nil {
+			v.auditLog.Record("ExportVolume", user, target, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer snapshot.Close()
+		err = s3.Upload(http.DefaultClient, objectURL, creds, snapshot, size)
+		v.auditLog.Record("ExportVolume", user, target, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(VolumeExportResult{URL: objectURL, Size: size}); err != nil {
+			glog.Warningf("Error sending volume export result: %v", err)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestVolumeExportAuthorization(t *testing.T) {
+	v, sandbox := newManagerWithFakePod(t)
+	authorizer := &fakePodAuthorizer{}
+	handler := NewVolumeExportHandler(v, authorizer)
+	objectURL := "https%3A%2F%2Fs3.example.com%2Fvm-images%2Fvm.qcow2"
+	for _, tc := range []struct {
+		name   string
+		url    string
+		token  string
+		status int
+		call   string
+	}{
+		{
+			name:   "no token",
+			url:    "/export-volume?namespace=default&name=testName_0&secret=s3-creds&url=" + objectURL,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "no secret",
+			url:    "/export-volume?namespace=default&name=testName_0&url=" + objectURL,
+			token:  "foobar",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "denied access to nonexistent pod",
+			url:    "/export-volume?namespace=default&name=nonexistent&secret=s3-creds&url=" + objectURL,
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/nonexistent export",
+		},
+		{
+			name:   "unknown pod id",
+			url:    "/export-volume?podId=nonexistent&secret=s3-creds&url=" + objectURL,
+			token:  "foobar",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "denied",
+			url:    "/export-volume?namespace=default&name=testName_0&secret=s3-creds&url=" + objectURL,
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/testName_0 export",
+		},
+		{
+			name:   "denied by pod id",
+			url:    "/export-volume?podId=" + sandbox.Metadata.Uid + "&secret=s3-creds&url=" + objectURL,
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/testName_0 export",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			authorizer.calls = nil
+			req := httptest.NewRequest("POST", tc.url, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("bad status code %d instead of %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			var expectedCalls []string
+			if tc.call != "" {
+				expectedCalls = []string{tc.call}
+			}
+			if !reflect.DeepEqual(authorizer.calls, expectedCalls) {
+				t.Errorf("bad authorizer calls: %#v instead of %#v", authorizer.calls, expectedCalls)
+			}
+		})
+	}
+}
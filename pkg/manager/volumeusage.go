@@ -0,0 +1,52 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package manager
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// NewVolumeUsageHandler returns an http.Handler that returns the
+// report on host storage usage of VM volumes in JSON format
+func NewVolumeUsageHandler(v *VirtletManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "only GET requests are supported", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := v.libvirtVirtualizationTool.VolumeUsage()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			glog.Warningf("Error sending volume usage report: %v", err)
+		}
+	})
+}
+
+// RunFSTrim periodically asks the guest agents of the running VMs
+// to trim their filesystems until stopCh is closed
+func (v *VirtletManager) RunFSTrim(interval time.Duration, stopCh <-chan struct{}) {
+	defer v.RecoverPanic()
+	v.libvirtVirtualizationTool.RunFSTrim(interval, stopCh)
+}
@@ -17,25 +17,240 @@ limitations under the License.
 package metadata
 
 import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// Durability specifies how the writes to the metadata store
+// are persisted
+type Durability string
+
+const (
+	// DurabilitySync makes each write commit a separate transaction
+	// that's synced to the disk before the write returns. This is
+	// the default
+	DurabilitySync Durability = "sync"
+	// DurabilityBatch makes the concurrent writes coalesce into
+	// a single transaction. Each write still returns only after its
+	// data is synced to the disk, but it may be delayed for up to
+	// the flush interval waiting for other writes to join the batch
+	DurabilityBatch Durability = "batch"
+	// DurabilityRelaxed disables syncing the database on each
+	// commit. Instead, the database file is synced once per flush
+	// interval if it has changed. The data survives a crash of
+	// Virtlet process, but the writes made during the last flush
+	// interval may be lost (or the database may be damaged) if the
+	// node itself crashes
+	DurabilityRelaxed Durability = "relaxed"
+
+	// DefaultFlushInterval is the default flush interval
+	// for DurabilityBatch and DurabilityRelaxed modes
+	DefaultFlushInterval = 10 * time.Millisecond
 )
 
+// ParseDurability validates the durability level name
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case "":
+		return DurabilitySync, nil
+	case DurabilitySync, DurabilityBatch, DurabilityRelaxed:
+		return d, nil
+	default:
+		return "", fmt.Errorf("bad metadata store durability level %q (must be one of %q, %q or %q)", s, DurabilitySync, DurabilityBatch, DurabilityRelaxed)
+	}
+}
+
+// Options specify how the metadata store writes are handled
+type Options struct {
+	// Durability is the durability level of the writes.
+	// Empty value means DurabilitySync
+	Durability Durability
+	// FlushInterval is the maximum delay of a write waiting for
+	// a batch to be committed in DurabilityBatch mode, or the interval
+	// between database file syncs in DurabilityRelaxed mode.
+	// Zero value means DefaultFlushInterval
+	FlushInterval time.Duration
+	// MaxBatchSize is the maximum number of the writes coalesced
+	// into a single transaction in DurabilityBatch mode.
+	// Zero value means bolt's default
+	MaxBatchSize int
+	// Backend, if set, receives a copy of the store contents
+	// after each change, and the store is restored from it if the
+	// local database is empty
+	Backend StateBackend
+	// BackendSyncInterval is the delay between a change and saving
+	// the contents of the store to the backend. The changes made
+	// within this interval are saved together. Zero value means
+	// DefaultBackendSyncInterval
+	BackendSyncInterval time.Duration
+}
+
 type boltClient struct {
-	db *bolt.DB
+	db      *bolt.DB
+	batch   bool
+	flusher *flusher
+	mirror  *mirror
 }
 
 // NewMetadataStore is a factory function for MetadataStore interface
 func NewMetadataStore(path string) (MetadataStore, error) {
+	return NewMetadataStoreWithOptions(path, Options{})
+}
+
+// NewMetadataStoreWithOptions is a factory function for MetadataStore
+// interface that makes it possible to specify how the writes are handled
+func NewMetadataStoreWithOptions(path string, opts Options) (MetadataStore, error) {
+	durability, err := ParseDurability(string(opts.Durability))
+	if err != nil {
+		return nil, err
+	}
+	flushInterval := opts.FlushInterval
+	if flushInterval <= 0 {
+		flushInterval = DefaultFlushInterval
+	}
+
 	db, err := bolt.Open(path, 0600, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	client := &boltClient{db: db}
+	switch durability {
+	case DurabilityBatch:
+		client.batch = true
+		db.MaxBatchDelay = flushInterval
+		if opts.MaxBatchSize > 0 {
+			db.MaxBatchSize = opts.MaxBatchSize
+		}
+	case DurabilityRelaxed:
+		db.NoSync = true
+		client.flusher = newFlusher(db, flushInterval)
+	}
+
+	if opts.Backend != nil {
+		if err := restoreState(db, opts.Backend); err != nil {
+			client.Close()
+			return nil, err
+		}
+		syncInterval := opts.BackendSyncInterval
+		if syncInterval <= 0 {
+			syncInterval = DefaultBackendSyncInterval
+		}
+		client.mirror = newMirror(db, opts.Backend, syncInterval)
+	}
 	return client, nil
 }
 
+// update runs fn in a read-write transaction. In DurabilityBatch
+// mode, fn may be called more than once, so it must not have any
+// side effects besides the changes made to the database and the
+// values it returns via the closure variables
+func (b *boltClient) update(fn func(tx *bolt.Tx) error) error {
+	var err error
+	if b.batch {
+		err = b.db.Batch(fn)
+	} else {
+		err = b.db.Update(fn)
+	}
+	if err == nil {
+		if b.flusher != nil {
+			b.flusher.markDirty()
+		}
+		if b.mirror != nil {
+			b.mirror.markChanged()
+		}
+	}
+	return err
+}
+
+// Check verifies that the database can be read
+func (b boltClient) Check() error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func([]byte, *bolt.Bucket) error { return nil })
+	})
+}
+
+// DumpState returns a copy of the database contents
+func (b boltClient) DumpState() (*NodeState, error) {
+	var state *NodeState
+	if err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		state, err = exportState(tx)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
 // Close releases all database resources
 func (b boltClient) Close() error {
+	if b.mirror != nil {
+		b.mirror.stop()
+	}
+	if b.flusher != nil {
+		b.flusher.stop()
+	}
 	return b.db.Close()
 }
+
+// flusher syncs the database file periodically when
+// the database is opened with NoSync flag
+type flusher struct {
+	db       *bolt.DB
+	dirty    int32
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+}
+
+func newFlusher(db *bolt.DB, interval time.Duration) *flusher {
+	f := &flusher{
+		db:     db,
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go f.run(interval)
+	return f
+}
+
+func (f *flusher) markDirty() {
+	atomic.StoreInt32(&f.dirty, 1)
+}
+
+func (f *flusher) flush() {
+	if atomic.SwapInt32(&f.dirty, 0) == 0 {
+		return
+	}
+	if err := f.db.Sync(); err != nil {
+		// make sure the sync is retried later
+		f.markDirty()
+		glog.Errorf("Error syncing the metadata store: %v", err)
+	}
+}
+
+func (f *flusher) run(interval time.Duration) {
+	defer close(f.doneCh)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopCh:
+			f.flush()
+			return
+		case <-ticker.C:
+			f.flush()
+		}
+	}
+}
+
+// stop makes the flusher sync the pending writes and exit
+func (f *flusher) stop() {
+	f.stopOnce.Do(func() { close(f.stopCh) })
+	<-f.doneCh
+}
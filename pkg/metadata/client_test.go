@@ -0,0 +1,146 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseDurability(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected Durability
+		err      bool
+	}{
+		{"", DurabilitySync, false},
+		{"sync", DurabilitySync, false},
+		{"batch", DurabilityBatch, false},
+		{"relaxed", DurabilityRelaxed, false},
+		{"fast", "", true},
+	} {
+		d, err := ParseDurability(tc.value)
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("%q: didn't get the expected error", tc.value)
+		case !tc.err && err != nil:
+			t.Errorf("%q: unexpected error: %v", tc.value, err)
+		case d != tc.expected:
+			t.Errorf("%q: bad durability %q instead of %q", tc.value, d, tc.expected)
+		}
+	}
+}
+
+func openTestStore(t testing.TB, opts Options) (MetadataStore, string) {
+	filename, err := tempfile()
+	if err != nil {
+		t.Fatalf("tempfile(): %v", err)
+	}
+	store, err := NewMetadataStoreWithOptions(filename, opts)
+	if err != nil {
+		os.Remove(filename)
+		t.Fatalf("NewMetadataStoreWithOptions(): %v", err)
+	}
+	return store, filename
+}
+
+func TestDurabilityLevels(t *testing.T) {
+	const numWriters = 50
+	for _, durability := range []Durability{DurabilitySync, DurabilityBatch, DurabilityRelaxed} {
+		t.Run(string(durability), func(t *testing.T) {
+			store, filename := openTestStore(t, Options{
+				Durability:    durability,
+				FlushInterval: 5 * time.Millisecond,
+			})
+			defer os.Remove(filename)
+
+			var wg sync.WaitGroup
+			for i := 0; i < numWriters; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := store.SetImageName(fmt.Sprintf("volume-%d", i), fmt.Sprintf("image-%d", i)); err != nil {
+						t.Errorf("SetImageName(): %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+			if err := store.Close(); err != nil {
+				t.Fatalf("Close(): %v", err)
+			}
+
+			store, err := NewMetadataStore(filename)
+			if err != nil {
+				t.Fatalf("NewMetadataStore(): %v", err)
+			}
+			defer store.Close()
+			for i := 0; i < numWriters; i++ {
+				imageName, err := store.GetImageName(fmt.Sprintf("volume-%d", i))
+				switch {
+				case err != nil:
+					t.Errorf("GetImageName(): %v", err)
+				case imageName != fmt.Sprintf("image-%d", i):
+					t.Errorf("bad image name for volume-%d: %q", i, imageName)
+				}
+			}
+		})
+	}
+}
+
+func TestBadDurability(t *testing.T) {
+	filename, err := tempfile()
+	if err != nil {
+		t.Fatalf("tempfile(): %v", err)
+	}
+	defer os.Remove(filename)
+	if _, err := NewMetadataStoreWithOptions(filename, Options{Durability: "fast"}); err == nil {
+		t.Errorf("NewMetadataStoreWithOptions() didn't fail for a bad durability level")
+	}
+}
+
+// BenchmarkWrites measures the throughput of concurrent writes to
+// the metadata store with different durability levels. Batching only
+// pays off when fsync takes longer than the flush interval divided
+// by the number of concurrent writers, so the benchmark should be run
+// with the temporary directory located on the kind of disk that's
+// used on the nodes rather than tmpfs, e.g.
+// TMPDIR=/var/lib/virtlet go test -run XXX -bench Writes ./pkg/metadata
+func BenchmarkWrites(b *testing.B) {
+	for _, durability := range []Durability{DurabilitySync, DurabilityBatch, DurabilityRelaxed} {
+		b.Run(string(durability), func(b *testing.B) {
+			store, filename := openTestStore(b, Options{Durability: durability})
+			defer os.Remove(filename)
+			defer store.Close()
+			var n int64
+			// simulate many pods being created or removed at once
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					volumeName := fmt.Sprintf("volume-%d", atomic.AddInt64(&n, 1))
+					if err := store.SetImageName(volumeName, "image"); err != nil {
+						b.Fatalf("SetImageName(): %v", err)
+					}
+				}
+			})
+		})
+	}
+}
@@ -57,12 +57,13 @@ func (m containerMeta) Retrieve() (*ContainerInfo, error) {
 // Save allows to create/modify/delete container data bound to the object.
 // Supplied handler gets current ContainerInfo value (nil if doesn't exist) and returns new structure
 // value to be saved or nil to delete. If error value is returned from the handler, the transaction is
-// rolled back and returned error becomes the result of the function
+// rolled back and returned error becomes the result of the function.
+// When the store uses DurabilityBatch, the handler may be called more than once
 func (m containerMeta) Save(updater func(*ContainerInfo) (*ContainerInfo, error)) error {
 	if m.GetID() == "" {
 		return errors.New("Container ID cannot be empty")
 	}
-	return m.client.db.Update(func(tx *bolt.Tx) error {
+	return m.client.update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists([]byte("containers"))
 		if err != nil {
 			return err
@@ -101,6 +101,13 @@ func setUpTestStore(t *testing.T, sandboxConfigs []*kubeapi.PodSandboxConfig, co
 		t.Errorf("ListPodSandboxes() returned non-empty result for an empty db")
 	}
 
+	populateTestStore(t, store, sandboxConfigs, containerConfigs, clock)
+	dumpDB(t, store, "init")
+
+	return store
+}
+
+func populateTestStore(t *testing.T, store MetadataStore, sandboxConfigs []*kubeapi.PodSandboxConfig, containerConfigs []*criapi.ContainerTestConfig, clock clockwork.Clock) {
 	if clock == nil {
 		clock = clockwork.NewRealClock()
 	}
@@ -133,8 +140,4 @@ func setUpTestStore(t *testing.T, sandboxConfigs []*kubeapi.PodSandboxConfig, co
 			t.Fatal(err)
 		}
 	}
-
-	dumpDB(t, store, "init")
-
-	return store
 }
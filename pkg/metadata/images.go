@@ -17,14 +17,22 @@ limitations under the License.
 package metadata
 
 import (
+	"time"
+
 	"github.com/boltdb/bolt"
 )
 
-var imageBucket = []byte("images")
+var (
+	imageBucket            = []byte("images")
+	imageArchBucket        = []byte("image_archs")
+	imageMachineTypeBucket = []byte("image_machine_types")
+	imageEmulatorBucket    = []byte("image_emulators")
+	imageLastUsedBucket    = []byte("image_last_used")
+)
 
 // SetImageName associates image name with the volume
 func (b *boltClient) SetImageName(volumeName, imageName string) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
+	return b.update(func(tx *bolt.Tx) error {
 		bucket, err := tx.CreateBucketIfNotExists(imageBucket)
 		if err != nil {
 			return err
@@ -53,14 +61,133 @@ func (b *boltClient) GetImageName(volumeName string) (string, error) {
 	return imageName, err
 }
 
-// RemoveImage removes volume name association from the volume name
-func (b *boltClient) RemoveImage(volumeName string) error {
-	return b.db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket(imageBucket)
+// SetImageArch records the architecture of the image stored in the volume
+func (b *boltClient) SetImageArch(volumeName, arch string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(imageArchBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(volumeName), []byte(arch))
+	})
+}
+
+// GetImageArch returns the architecture of the image stored in the volume.
+// It returns an empty string if the architecture is not known
+func (b *boltClient) GetImageArch(volumeName string) (string, error) {
+	arch := ""
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(imageArchBucket)
 		if bucket == nil {
 			return nil
 		}
 
-		return bucket.Delete([]byte(volumeName))
+		if v := bucket.Get([]byte(volumeName)); v != nil {
+			arch = string(v)
+		}
+
+		return nil
+	})
+	return arch, err
+}
+
+// SetImageMachineSettings records the machine type and the emulator
+// binary that are specified for the image stored in the volume
+func (b *boltClient) SetImageMachineSettings(volumeName, machineType, emulator string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		for _, item := range []struct {
+			bucketName []byte
+			value      string
+		}{
+			{imageMachineTypeBucket, machineType},
+			{imageEmulatorBucket, emulator},
+		} {
+			bucket, err := tx.CreateBucketIfNotExists(item.bucketName)
+			if err != nil {
+				return err
+			}
+			if item.value == "" {
+				err = bucket.Delete([]byte(volumeName))
+			} else {
+				err = bucket.Put([]byte(volumeName), []byte(item.value))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetImageMachineSettings returns the machine type and the emulator
+// binary specified for the image stored in the volume. Empty strings
+// are returned for the settings that are not specified
+func (b *boltClient) GetImageMachineSettings(volumeName string) (string, string, error) {
+	var machineType, emulator string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(imageMachineTypeBucket); bucket != nil {
+			if v := bucket.Get([]byte(volumeName)); v != nil {
+				machineType = string(v)
+			}
+		}
+		if bucket := tx.Bucket(imageEmulatorBucket); bucket != nil {
+			if v := bucket.Get([]byte(volumeName)); v != nil {
+				emulator = string(v)
+			}
+		}
+		return nil
+	})
+	return machineType, emulator, err
+}
+
+// SetImageLastUsed records the time when the image stored in the volume
+// was last pulled or used to create a container
+func (b *boltClient) SetImageLastUsed(volumeName string, t time.Time) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(imageLastUsedBucket)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put([]byte(volumeName), []byte(t.UTC().Format(time.RFC3339Nano)))
+	})
+}
+
+// GetImageLastUsed returns the time when the image stored in the volume
+// was last used. It returns zero time if it's not known
+func (b *boltClient) GetImageLastUsed(volumeName string) (time.Time, error) {
+	var t time.Time
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(imageLastUsedBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		v := bucket.Get([]byte(volumeName))
+		if v == nil {
+			return nil
+		}
+
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, string(v))
+		return err
+	})
+	return t, err
+}
+
+// RemoveImage removes volume name association from the volume name
+func (b *boltClient) RemoveImage(volumeName string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		for _, bucketName := range [][]byte{imageBucket, imageArchBucket, imageMachineTypeBucket, imageEmulatorBucket, imageLastUsedBucket} {
+			bucket := tx.Bucket(bucketName)
+			if bucket == nil {
+				continue
+			}
+			if err := bucket.Delete([]byte(volumeName)); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
@@ -16,7 +16,10 @@ limitations under the License.
 
 package metadata
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestGetImageName(t *testing.T) {
 	tests := []struct {
@@ -80,6 +83,10 @@ func TestRemoveImage(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	if err = store.SetImageArch("another-distro", "arm64"); err != nil {
+		t.Fatal(err)
+	}
+
 	if err = store.RemoveImage("another-distro"); err != nil {
 		t.Fatal(err)
 	}
@@ -92,4 +99,132 @@ func TestRemoveImage(t *testing.T) {
 	if imageName != "" {
 		t.Errorf("Bad imageName for removed image: %q instead of an empty string", imageName)
 	}
+
+	arch, err := store.GetImageArch("another-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if arch != "" {
+		t.Errorf("Bad arch for removed image: %q instead of an empty string", arch)
+	}
+}
+
+func TestImageArch(t *testing.T) {
+	store, err := NewFakeMetadataStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	arch, err := store.GetImageArch("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arch != "" {
+		t.Errorf("Bad arch for unknown image: %q instead of an empty string", arch)
+	}
+
+	if err = store.SetImageArch("my-favorite-distro", "arm64"); err != nil {
+		t.Fatal(err)
+	}
+
+	arch, err = store.GetImageArch("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if arch != "arm64" {
+		t.Errorf("Bad arch: %q instead of %q", arch, "arm64")
+	}
+}
+
+func TestImageMachineSettings(t *testing.T) {
+	store, err := NewFakeMetadataStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	machineType, emulator, err := store.GetImageMachineSettings("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if machineType != "" || emulator != "" {
+		t.Errorf("Bad machine settings for unknown image: %q, %q instead of empty strings", machineType, emulator)
+	}
+
+	if err = store.SetImageMachineSettings("my-favorite-distro", "q35", "/usr/bin/qemu-system-x86_64"); err != nil {
+		t.Fatal(err)
+	}
+
+	machineType, emulator, err = store.GetImageMachineSettings("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if machineType != "q35" || emulator != "/usr/bin/qemu-system-x86_64" {
+		t.Errorf("Bad machine settings: %q, %q", machineType, emulator)
+	}
+
+	// the image may be pulled again after its translation rule is changed
+	if err = store.SetImageMachineSettings("my-favorite-distro", "pc", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	machineType, emulator, err = store.GetImageMachineSettings("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if machineType != "pc" || emulator != "" {
+		t.Errorf("Bad machine settings after an update: %q, %q", machineType, emulator)
+	}
+
+	if err = store.RemoveImage("my-favorite-distro"); err != nil {
+		t.Fatal(err)
+	}
+
+	machineType, emulator, err = store.GetImageMachineSettings("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if machineType != "" || emulator != "" {
+		t.Errorf("Bad machine settings for removed image: %q, %q instead of empty strings", machineType, emulator)
+	}
+}
+
+func TestImageLastUsed(t *testing.T) {
+	store, err := NewFakeMetadataStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastUsed, err := store.GetImageLastUsed("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastUsed.IsZero() {
+		t.Errorf("Bad last used time for unknown image: %v instead of zero time", lastUsed)
+	}
+
+	ts := time.Date(2018, 3, 14, 15, 9, 26, 535, time.UTC)
+	if err = store.SetImageLastUsed("my-favorite-distro", ts); err != nil {
+		t.Fatal(err)
+	}
+
+	lastUsed, err = store.GetImageLastUsed("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastUsed.Equal(ts) {
+		t.Errorf("Bad last used time: %v instead of %v", lastUsed, ts)
+	}
+
+	if err = store.RemoveImage("my-favorite-distro"); err != nil {
+		t.Fatal(err)
+	}
+
+	lastUsed, err = store.GetImageLastUsed("my-favorite-distro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lastUsed.IsZero() {
+		t.Errorf("Bad last used time for removed image: %v instead of zero time", lastUsed)
+	}
 }
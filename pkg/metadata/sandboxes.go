@@ -50,7 +50,7 @@ func (m podSandboxMeta) Retrieve() (*PodSandboxInfo, error) {
 		}
 		return retrieveSandboxFromDB(bucket, &psi)
 	})
-	if err == nil {
+	if err == nil && psi != nil {
 		psi.podID = m.GetID()
 	}
 	return psi, err
@@ -59,12 +59,13 @@ func (m podSandboxMeta) Retrieve() (*PodSandboxInfo, error) {
 // Save allows to create/modify/delete pod sandbox instance bound to the object.
 // Supplied handler gets current PodSandboxInfo value (nil if doesn't exist) and returns new structure
 // value to be saved or nil to delete. If error value is returned from the handler, the transaction is
-// rolled back and returned error becomes the result of the function
+// rolled back and returned error becomes the result of the function.
+// When the store uses DurabilityBatch, the handler may be called more than once
 func (m podSandboxMeta) Save(updater func(*PodSandboxInfo) (*PodSandboxInfo, error)) error {
 	if m.GetID() == "" {
 		return errors.New("Pod sandbox ID cannot be empty")
 	}
-	return m.client.db.Update(func(tx *bolt.Tx) error {
+	return m.client.update(func(tx *bolt.Tx) error {
 		key := "sandboxes/" + m.GetID()
 		var current *PodSandboxInfo
 		bucket, err := getSandboxBucket(tx, m.GetID(), true, false)
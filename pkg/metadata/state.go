@@ -0,0 +1,354 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// DefaultBackendSyncInterval is the default delay between a change
+// in the metadata store and saving its contents to the state backend
+const DefaultBackendSyncInterval = 5 * time.Second
+
+// ImageState describes an image stored in a volume
+type ImageState struct {
+	// Name is the name of the image
+	Name string `json:"name,omitempty"`
+	// Arch is the architecture of the image
+	Arch string `json:"arch,omitempty"`
+	// MachineType is the machine type specified for the image
+	MachineType string `json:"machineType,omitempty"`
+	// Emulator is the emulator binary specified for the image
+	Emulator string `json:"emulator,omitempty"`
+	// LastUsed is the time when the image was last used
+	// in RFC3339 format
+	LastUsed string `json:"lastUsed,omitempty"`
+}
+
+// NodeState is a copy of the metadata store contents
+type NodeState struct {
+	// Sandboxes maps pod sandbox ids to pod sandbox info
+	Sandboxes map[string]*PodSandboxInfo `json:"sandboxes,omitempty"`
+	// Containers maps container ids to container info
+	Containers map[string]*ContainerInfo `json:"containers,omitempty"`
+	// Images maps volume names to the images stored in them
+	Images map[string]*ImageState `json:"images,omitempty"`
+	// VsockCIDs maps container ids to vsock CIDs of the VMs
+	VsockCIDs map[string]uint32 `json:"vsockCIDs,omitempty"`
+}
+
+// StateBackend keeps a copy of the metadata store contents outside
+// of the node's local disk
+type StateBackend interface {
+	// LoadState returns the stored state, or nil if there's none
+	LoadState() (*NodeState, error)
+	// SaveState replaces the stored state
+	SaveState(state *NodeState) error
+}
+
+// exportState returns the contents of the database
+func exportState(tx *bolt.Tx) (*NodeState, error) {
+	state := &NodeState{
+		Sandboxes:  make(map[string]*PodSandboxInfo),
+		Containers: make(map[string]*ContainerInfo),
+		Images:     make(map[string]*ImageState),
+		VsockCIDs:  make(map[string]uint32),
+	}
+	image := func(volumeName []byte) *ImageState {
+		s := state.Images[string(volumeName)]
+		if s == nil {
+			s = &ImageState{}
+			state.Images[string(volumeName)] = s
+		}
+		return s
+	}
+	err := tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+		switch {
+		case strings.HasPrefix(string(name), "sandboxes/"):
+			podID := strings.TrimPrefix(string(name), "sandboxes/")
+			var psi *PodSandboxInfo
+			if err := retrieveSandboxFromDB(bucket, &psi); err != nil {
+				return fmt.Errorf("pod sandbox %q: %v", podID, err)
+			}
+			if psi != nil {
+				state.Sandboxes[podID] = psi
+			}
+			return nil
+		case string(name) == "containers":
+			return bucket.ForEach(func(k, v []byte) error {
+				var ci *ContainerInfo
+				if err := json.Unmarshal(v, &ci); err != nil {
+					return fmt.Errorf("container %q: %v", k, err)
+				}
+				state.Containers[string(k)] = ci
+				return nil
+			})
+		case string(name) == string(imageBucket):
+			return bucket.ForEach(func(k, v []byte) error {
+				image(k).Name = string(v)
+				return nil
+			})
+		case string(name) == string(imageArchBucket):
+			return bucket.ForEach(func(k, v []byte) error {
+				image(k).Arch = string(v)
+				return nil
+			})
+		case string(name) == string(imageMachineTypeBucket):
+			return bucket.ForEach(func(k, v []byte) error {
+				image(k).MachineType = string(v)
+				return nil
+			})
+		case string(name) == string(imageEmulatorBucket):
+			return bucket.ForEach(func(k, v []byte) error {
+				image(k).Emulator = string(v)
+				return nil
+			})
+		case string(name) == string(imageLastUsedBucket):
+			return bucket.ForEach(func(k, v []byte) error {
+				image(k).LastUsed = string(v)
+				return nil
+			})
+		case string(name) == string(vsockCIDBucket):
+			return bucket.ForEach(func(k, v []byte) error {
+				cid, err := decodeVsockCID(v)
+				if err != nil {
+					return fmt.Errorf("vsock CID record for container %q: %v", k, err)
+				}
+				state.VsockCIDs[string(k)] = cid
+				return nil
+			})
+		default:
+			glog.Warningf("Skipping unknown metadata bucket %q", name)
+			return nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// importState writes the state to an empty database
+func importState(tx *bolt.Tx, state *NodeState) error {
+	for podID, psi := range state.Sandboxes {
+		bucket, err := getSandboxBucket(tx, podID, true, false)
+		if err != nil {
+			return err
+		}
+		if err := saveSandboxToDB(bucket, psi); err != nil {
+			return err
+		}
+	}
+
+	if len(state.Containers) > 0 {
+		bucket, err := tx.CreateBucketIfNotExists([]byte("containers"))
+		if err != nil {
+			return err
+		}
+		for containerID, ci := range state.Containers {
+			data, err := json.Marshal(ci)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(containerID), data); err != nil {
+				return err
+			}
+			if ci.SandboxID == "" {
+				continue
+			}
+			if _, found := state.Sandboxes[ci.SandboxID]; !found {
+				glog.Warningf("Container %q refers to a missing pod sandbox %q", containerID, ci.SandboxID)
+				continue
+			}
+			if err := addContainerToSandbox(tx, containerID, ci.SandboxID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for volumeName, image := range state.Images {
+		for _, item := range []struct {
+			bucketName []byte
+			value      string
+		}{
+			{imageBucket, image.Name},
+			{imageArchBucket, image.Arch},
+			{imageMachineTypeBucket, image.MachineType},
+			{imageEmulatorBucket, image.Emulator},
+			{imageLastUsedBucket, image.LastUsed},
+		} {
+			if item.value == "" {
+				continue
+			}
+			bucket, err := tx.CreateBucketIfNotExists(item.bucketName)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(volumeName), []byte(item.value)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(state.VsockCIDs) > 0 {
+		bucket, err := tx.CreateBucketIfNotExists(vsockCIDBucket)
+		if err != nil {
+			return err
+		}
+		for containerID, cid := range state.VsockCIDs {
+			if err := bucket.Put([]byte(containerID), encodeVsockCID(cid)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func dbIsEmpty(tx *bolt.Tx) bool {
+	empty := true
+	tx.ForEach(func([]byte, *bolt.Bucket) error {
+		empty = false
+		return nil
+	})
+	return empty
+}
+
+// restoreState loads the state from the backend if the local
+// database is empty, e.g. after the node's disk was replaced
+func restoreState(db *bolt.DB, backend StateBackend) error {
+	var empty bool
+	db.View(func(tx *bolt.Tx) error {
+		empty = dbIsEmpty(tx)
+		return nil
+	})
+	if !empty {
+		return nil
+	}
+	state, err := backend.LoadState()
+	if err != nil {
+		return fmt.Errorf("error loading the metadata from the state backend: %v", err)
+	}
+	if state == nil {
+		return nil
+	}
+	glog.Infof("Restoring the metadata from the state backend: %d sandbox(es), %d container(s), %d image(s)",
+		len(state.Sandboxes), len(state.Containers), len(state.Images))
+	return db.Update(func(tx *bolt.Tx) error {
+		return importState(tx, state)
+	})
+}
+
+// mirror saves the metadata store contents to the state backend
+// after the changes, coalescing the changes made within the sync
+// interval
+type mirror struct {
+	db       *bolt.DB
+	backend  StateBackend
+	interval time.Duration
+	changeCh chan struct{}
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newMirror(db *bolt.DB, backend StateBackend, interval time.Duration) *mirror {
+	m := &mirror{
+		db:       db,
+		backend:  backend,
+		interval: interval,
+		changeCh: make(chan struct{}, 1),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *mirror) markChanged() {
+	select {
+	case m.changeCh <- struct{}{}:
+	default:
+	}
+}
+
+// save saves the current contents of the database to the backend
+func (m *mirror) save() error {
+	var state *NodeState
+	if err := m.db.View(func(tx *bolt.Tx) error {
+		var err error
+		state, err = exportState(tx)
+		return err
+	}); err != nil {
+		return fmt.Errorf("error exporting the metadata: %v", err)
+	}
+	if err := m.backend.SaveState(state); err != nil {
+		return fmt.Errorf("error saving the metadata to the state backend: %v", err)
+	}
+	return nil
+}
+
+func (m *mirror) run() {
+	defer close(m.doneCh)
+	pending := false
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-m.stopCh:
+			// the change notification may still be sitting
+			// in the channel if stop() is called right after
+			// the write
+			select {
+			case <-m.changeCh:
+				pending = true
+			default:
+			}
+			if pending {
+				if err := m.save(); err != nil {
+					glog.Error(err)
+				}
+			}
+			return
+		case <-m.changeCh:
+			if !pending {
+				pending = true
+				timer = time.After(m.interval)
+			}
+		case <-timer:
+			timer = nil
+			if err := m.save(); err != nil {
+				glog.Error(err)
+				// retry after the next interval
+				timer = time.After(m.interval)
+				continue
+			}
+			pending = false
+		}
+	}
+}
+
+// stop makes the mirror save the pending changes and exit
+func (m *mirror) stop() {
+	m.stopOnce.Do(func() { close(m.stopCh) })
+	<-m.doneCh
+}
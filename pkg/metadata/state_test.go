@@ -0,0 +1,171 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+type fakeStateBackend struct {
+	sync.Mutex
+	data  []byte
+	saves int
+}
+
+func (b *fakeStateBackend) LoadState() (*NodeState, error) {
+	b.Lock()
+	defer b.Unlock()
+	if b.data == nil {
+		return nil, nil
+	}
+	var state NodeState
+	if err := json.Unmarshal(b.data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (b *fakeStateBackend) SaveState(state *NodeState) error {
+	b.Lock()
+	defer b.Unlock()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	b.data = data
+	b.saves++
+	return nil
+}
+
+func (b *fakeStateBackend) saveCount() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.saves
+}
+
+func getState(t *testing.T, store MetadataStore) *NodeState {
+	state, err := store.DumpState()
+	if err != nil {
+		t.Fatalf("DumpState(): %v", err)
+	}
+	return state
+}
+
+func TestStateBackend(t *testing.T) {
+	backend := &fakeStateBackend{}
+	opts := Options{Backend: backend, BackendSyncInterval: 10 * time.Millisecond}
+	store, filename := openTestStore(t, opts)
+	defer os.Remove(filename)
+
+	sandboxes := criapi.GetSandboxes(2)
+	containers := criapi.GetContainersConfig(sandboxes)
+	populateTestStore(t, store, sandboxes, containers, clockwork.NewFakeClock())
+	if err := store.SetImageName("vol1", "example.com/image1"); err != nil {
+		t.Fatalf("SetImageName(): %v", err)
+	}
+	if err := store.SetImageArch("vol1", "x86_64"); err != nil {
+		t.Fatalf("SetImageArch(): %v", err)
+	}
+	if err := store.SetImageMachineSettings("vol1", "q35", "/usr/bin/qemu-system-x86_64"); err != nil {
+		t.Fatalf("SetImageMachineSettings(): %v", err)
+	}
+	if err := store.SetImageLastUsed("vol1", time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("SetImageLastUsed(): %v", err)
+	}
+	cid, err := store.AllocateVsockCID(containers[0].ContainerId)
+	if err != nil {
+		t.Fatalf("AllocateVsockCID(): %v", err)
+	}
+	expectedState := getState(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+	if backend.saveCount() == 0 {
+		t.Fatalf("the state wasn't saved to the backend")
+	}
+
+	// the state is restored in an empty database
+	store, filename = openTestStore(t, opts)
+	defer os.Remove(filename)
+	defer store.Close()
+	if state := getState(t, store); !reflect.DeepEqual(state, expectedState) {
+		t.Errorf("bad restored state:\n%#v\ninstead of\n%#v", state, expectedState)
+	}
+	podContainers, err := store.ListPodContainers(sandboxes[0].Metadata.Uid)
+	if err != nil {
+		t.Fatalf("ListPodContainers(): %v", err)
+	}
+	if len(podContainers) != 1 || podContainers[0].GetID() != containers[0].ContainerId {
+		t.Errorf("bad list of pod containers after restoring the state: %#v", podContainers)
+	}
+	if restoredCID, err := store.GetVsockCID(containers[0].ContainerId); err != nil {
+		t.Errorf("GetVsockCID(): %v", err)
+	} else if restoredCID != cid {
+		t.Errorf("bad vsock CID after restoring the state: %d instead of %d", restoredCID, cid)
+	}
+	if imageName, err := store.GetImageName("vol1"); err != nil {
+		t.Errorf("GetImageName(): %v", err)
+	} else if imageName != "example.com/image1" {
+		t.Errorf("bad image name after restoring the state: %q", imageName)
+	}
+}
+
+func TestStateBackendNotUsedForNonEmptyStore(t *testing.T) {
+	filename, err := tempfile()
+	if err != nil {
+		t.Fatalf("tempfile(): %v", err)
+	}
+	defer os.Remove(filename)
+	store, err := NewMetadataStore(filename)
+	if err != nil {
+		t.Fatalf("NewMetadataStore(): %v", err)
+	}
+	if err := store.SetImageName("vol1", "example.com/local-image"); err != nil {
+		t.Fatalf("SetImageName(): %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close(): %v", err)
+	}
+
+	backend := &fakeStateBackend{}
+	if err := backend.SaveState(&NodeState{
+		Images: map[string]*ImageState{
+			"vol2": {Name: "example.com/stale-image"},
+		},
+	}); err != nil {
+		t.Fatalf("SaveState(): %v", err)
+	}
+	store, err = NewMetadataStoreWithOptions(filename, Options{Backend: backend})
+	if err != nil {
+		t.Fatalf("NewMetadataStoreWithOptions(): %v", err)
+	}
+	defer store.Close()
+	if imageName, err := store.GetImageName("vol2"); err != nil {
+		t.Errorf("GetImageName(): %v", err)
+	} else if imageName != "" {
+		t.Errorf("the stale state was restored into a non-empty database")
+	}
+}
@@ -19,6 +19,7 @@ package metadata
 import (
 	"encoding/json"
 	"io"
+	"time"
 
 	"github.com/jonboulle/clockwork"
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
@@ -104,6 +105,38 @@ type ContainerInfo struct {
 	Annotations         map[string]string
 	Attempt             uint32
 	State               kubeapi.ContainerState
+	// HasCommand is true if the container command is run
+	// in the VM on boot
+	HasCommand bool
+	// CommandFinishedAt is the time when the exit code of the
+	// container command was received from the VM, 0 if the
+	// command didn't finish yet
+	CommandFinishedAt int64
+	// CommandExitCode is the exit code of the container command
+	CommandExitCode int32
+	// WaitForBoot is true if StartContainer must wait
+	// for the guest to finish booting
+	WaitForBoot bool
+	// BootTimeout is the time in nanoseconds after container
+	// start in which the guest must finish booting, 0 if
+	// there's no timeout
+	BootTimeout int64
+	// BootFinished is true if the guest is known
+	// to have finished booting
+	BootFinished bool
+	// BootFailedAt is the time when the VM was stopped because
+	// it didn't finish booting in time, 0 if it wasn't
+	BootFailedAt int64
+	// BootFailureMessage describes the boot failure, including
+	// the last lines of the VM console output if available
+	BootFailureMessage string
+	// StandbyVM is true if the container is a standby VM
+	// from a VirtualMachinePool that was claimed by the pod
+	StandbyVM bool
+	// AdoptedDomainXML is the original definition of the libvirt
+	// domain adopted by the container, empty if the VM was created
+	// by Virtlet
+	AdoptedDomainXML string
 }
 
 // ContainerMetadata contains methods of a single container (VM)
@@ -138,16 +171,64 @@ type ImageMetadataStore interface {
 	// GetImageName returns image name associated with the volume
 	GetImageName(volumeName string) (string, error)
 
+	// SetImageArch records the architecture of the image stored in the volume
+	SetImageArch(volumeName, arch string) error
+
+	// GetImageArch returns the architecture of the image stored in the volume
+	// or an empty string if it's unknown
+	GetImageArch(volumeName string) (string, error)
+
+	// SetImageMachineSettings records the machine type and the emulator
+	// binary that are specified for the image stored in the volume.
+	// Empty values mean the defaults for the image architecture
+	SetImageMachineSettings(volumeName, machineType, emulator string) error
+
+	// GetImageMachineSettings returns the machine type and the emulator
+	// binary specified for the image stored in the volume, or empty
+	// strings for the settings that are not specified
+	GetImageMachineSettings(volumeName string) (string, string, error)
+
+	// SetImageLastUsed records the time when the image stored in the volume
+	// was last pulled or used to create a container
+	SetImageLastUsed(volumeName string, t time.Time) error
+
+	// GetImageLastUsed returns the time when the image stored in the volume
+	// was last used or zero time if it's unknown
+	GetImageLastUsed(volumeName string) (time.Time, error)
+
 	// RemoveImage removes volume name association from the volume name
 	RemoveImage(volumeName string) error
 }
 
+// VsockCIDStore contains methods to manage vsock context ids (CIDs)
+// assigned to the VMs
+type VsockCIDStore interface {
+	// AllocateVsockCID assigns a vsock CID to the container with given
+	// ID, returning the existing one if it's already allocated
+	AllocateVsockCID(containerID string) (uint32, error)
+
+	// GetVsockCID returns the vsock CID assigned to the container
+	// with given ID or 0 if there's none
+	GetVsockCID(containerID string) (uint32, error)
+
+	// ReleaseVsockCID frees vsock CID assigned to the container with
+	// given ID. It's not an error if no CID is assigned
+	ReleaseVsockCID(containerID string) error
+}
+
 // MetadataStore provides single interface for metadata storage implementation
 type MetadataStore interface {
 	SandboxMetadataStore
 	ContainerMetadataStore
 	ImageMetadataStore
+	VsockCIDStore
 	io.Closer
+
+	// Check verifies that the store is usable
+	Check() error
+
+	// DumpState returns a copy of the store contents
+	DumpState() (*NodeState, error)
 }
 
 // NewPodSandboxInfo is a factory function for PodSandboxInfo instances
@@ -0,0 +1,156 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const (
+	writerPathEnvVar       = "VIRTLET_TEST_WRITER_PATH"
+	writerDurabilityEnvVar = "VIRTLET_TEST_WRITER_DURABILITY"
+	terminationIterations  = 5
+)
+
+// TestWriterProcess is not a real test. It's run in a child process
+// by TestTermination. It writes to the store until it's killed,
+// printing the number of each write after it's acknowledged,
+// and closes the store upon SIGTERM like Virtlet does
+func TestWriterProcess(t *testing.T) {
+	path := os.Getenv(writerPathEnvVar)
+	if path == "" {
+		t.Skip("only used as a child process of TestTermination")
+	}
+	store, err := NewMetadataStoreWithOptions(path, Options{
+		Durability:    Durability(os.Getenv(writerDurabilityEnvVar)),
+		FlushInterval: 50 * time.Millisecond,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't open the store: %v\n", err)
+		os.Exit(1)
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		if err := store.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "can't close the store: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
+	for i := 0; ; i++ {
+		if err := store.SetImageName(fmt.Sprintf("volume-%d", i), fmt.Sprintf("image-%d", i)); err != nil {
+			fmt.Fprintf(os.Stderr, "write failed: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(i)
+	}
+}
+
+// runWriter starts the writer process, kills it using the
+// specified signal at a random point and returns the number
+// of the writes acknowledged by the writer
+func runWriter(t *testing.T, path string, durability Durability, sig syscall.Signal) int {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWriterProcess$")
+	cmd.Env = append(os.Environ(), writerPathEnvVar+"="+path, writerDurabilityEnvVar+"="+string(durability))
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe(): %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("can't start the writer: %v", err)
+	}
+
+	// make sure the writer is running before killing it
+	scanner := bufio.NewScanner(stdout)
+	if !scanner.Scan() {
+		cmd.Wait()
+		t.Fatalf("the writer didn't make any writes")
+	}
+	time.Sleep(time.Duration(rand.Intn(100)) * time.Millisecond)
+	if err := cmd.Process.Signal(sig); err != nil {
+		t.Fatalf("can't kill the writer: %v", err)
+	}
+
+	acked := 0
+	for {
+		if n, err := strconv.Atoi(scanner.Text()); err == nil {
+			acked = n + 1
+		}
+		if !scanner.Scan() {
+			break
+		}
+	}
+	err = cmd.Wait()
+	if sig == syscall.SIGTERM && err != nil {
+		t.Errorf("the writer didn't exit cleanly upon SIGTERM: %v", err)
+	}
+	return acked
+}
+
+func TestTermination(t *testing.T) {
+	for _, durability := range []Durability{DurabilitySync, DurabilityBatch, DurabilityRelaxed} {
+		for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+			t.Run(fmt.Sprintf("%s/%s", durability, sig), func(t *testing.T) {
+				path, err := tempfile()
+				if err != nil {
+					t.Fatalf("tempfile(): %v", err)
+				}
+				defer os.Remove(path)
+
+				total := 0
+				for i := 0; i < terminationIterations; i++ {
+					// the writes start from the beginning
+					// each time, so the store only grows
+					// if the acknowledged writes survive
+					acked := runWriter(t, path, durability, sig)
+					if acked > total {
+						total = acked
+					}
+					store, err := NewMetadataStore(path)
+					if err != nil {
+						t.Fatalf("can't reopen the store after the writer is killed: %v", err)
+					}
+					if err := store.Check(); err != nil {
+						t.Errorf("store check failed: %v", err)
+					}
+					for n := 0; n < total; n++ {
+						imageName, err := store.GetImageName(fmt.Sprintf("volume-%d", n))
+						if err != nil {
+							t.Fatalf("GetImageName(): %v", err)
+						}
+						if expected := fmt.Sprintf("image-%d", n); imageName != expected {
+							t.Fatalf("acknowledged write #%d is lost: image name %q instead of %q", n, imageName, expected)
+						}
+					}
+					store.Close()
+				}
+			})
+		}
+	}
+}
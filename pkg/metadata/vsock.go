@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	// FirstVsockCID is the lowest CID that can be assigned to a VM.
+	// CIDs 0, 1 and 2 are reserved (2 being VMADDR_CID_HOST)
+	FirstVsockCID uint32 = 3
+	// maxVsockCID is the highest CID that can be assigned to a VM
+	// (0xffffffff is VMADDR_CID_ANY)
+	maxVsockCID uint32 = 0xfffffffe
+)
+
+var vsockCIDBucket = []byte("vsock_cids")
+
+func encodeVsockCID(cid uint32) []byte {
+	r := make([]byte, 4)
+	binary.BigEndian.PutUint32(r, cid)
+	return r
+}
+
+func decodeVsockCID(v []byte) (uint32, error) {
+	if len(v) != 4 {
+		return 0, fmt.Errorf("bad vsock CID record length %d", len(v))
+	}
+	return binary.BigEndian.Uint32(v), nil
+}
+
+// AllocateVsockCID assigns the lowest free vsock CID to the container
+func (b *boltClient) AllocateVsockCID(containerID string) (uint32, error) {
+	var cid uint32
+	err := b.update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(vsockCIDBucket)
+		if err != nil {
+			return err
+		}
+
+		if v := bucket.Get([]byte(containerID)); v != nil {
+			cid, err = decodeVsockCID(v)
+			return err
+		}
+
+		used := make(map[uint32]bool)
+		if err := bucket.ForEach(func(k, v []byte) error {
+			n, err := decodeVsockCID(v)
+			if err != nil {
+				return fmt.Errorf("vsock CID record for container %q: %v", k, err)
+			}
+			used[n] = true
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for n := FirstVsockCID; n <= maxVsockCID; n++ {
+			if !used[n] {
+				cid = n
+				return bucket.Put([]byte(containerID), encodeVsockCID(n))
+			}
+		}
+		return fmt.Errorf("no free vsock CIDs left")
+	})
+	if err != nil {
+		return 0, err
+	}
+	return cid, nil
+}
+
+// GetVsockCID returns the vsock CID assigned to the container
+func (b *boltClient) GetVsockCID(containerID string) (uint32, error) {
+	var cid uint32
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(vsockCIDBucket)
+		if bucket == nil {
+			return nil
+		}
+
+		v := bucket.Get([]byte(containerID))
+		if v == nil {
+			return nil
+		}
+
+		var err error
+		cid, err = decodeVsockCID(v)
+		return err
+	})
+	return cid, err
+}
+
+// ReleaseVsockCID frees the vsock CID assigned to the container
+func (b *boltClient) ReleaseVsockCID(containerID string) error {
+	return b.update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(vsockCIDBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(containerID))
+	})
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metadata
+
+import "testing"
+
+func TestVsockCIDs(t *testing.T) {
+	store, err := NewFakeMetadataStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cid, err := store.GetVsockCID("container-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != 0 {
+		t.Errorf("Bad CID for a container without one: %d instead of 0", cid)
+	}
+
+	for _, step := range []struct {
+		containerID string
+		release     bool
+		cid         uint32
+	}{
+		{containerID: "container-1", cid: 3},
+		{containerID: "container-2", cid: 4},
+		{containerID: "container-3", cid: 5},
+		// repeated allocation returns the same CID
+		{containerID: "container-2", cid: 4},
+		{containerID: "container-2", release: true},
+		// released CIDs are reused
+		{containerID: "container-4", cid: 4},
+		{containerID: "container-5", cid: 6},
+		// releasing unknown container is not an error
+		{containerID: "no-such-container", release: true},
+	} {
+		if step.release {
+			if err := store.ReleaseVsockCID(step.containerID); err != nil {
+				t.Fatalf("ReleaseVsockCID(%q): %v", step.containerID, err)
+			}
+			cid, err := store.GetVsockCID(step.containerID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cid != 0 {
+				t.Errorf("CID for %q wasn't released: %d", step.containerID, cid)
+			}
+			continue
+		}
+
+		cid, err := store.AllocateVsockCID(step.containerID)
+		if err != nil {
+			t.Fatalf("AllocateVsockCID(%q): %v", step.containerID, err)
+		}
+		if cid != step.cid {
+			t.Errorf("Bad CID allocated for %q: %d instead of %d", step.containerID, cid, step.cid)
+		}
+
+		cid, err = store.GetVsockCID(step.containerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cid != step.cid {
+			t.Errorf("Bad CID returned for %q: %d instead of %d", step.containerID, cid, step.cid)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	arpLen     = 28
+	arpOpReply = 2
+)
+
+// AddressConflictError is returned by DetectAddressConflicts()
+// when another host on the network uses the address that
+// was assigned to the VM
+type AddressConflictError struct {
+	// IP is the conflicting address
+	IP net.IP
+	// HardwareAddr is the hardware address of the host
+	// that uses the address
+	HardwareAddr net.HardwareAddr
+	// Interface is the name of the link on which
+	// the conflict was detected
+	Interface string
+}
+
+func (e *AddressConflictError) Error() string {
+	return fmt.Sprintf("address %v is already in use by %v (detected on %q)", e.IP, e.HardwareAddr, e.Interface)
+}
+
+// arpProbeFrame returns an Ethernet frame containing ARP probe
+// (RFC 5227, 2.1.1) for ip sent from hwAddr. The sender protocol
+// address of the probe is zero so it doesn't pollute ARP caches
+func arpProbeFrame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %v", ip)
+	}
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("bad hardware address: %v", hwAddr)
+	}
+	arp := make([]byte, arpLen)
+	binary.BigEndian.PutUint16(arp[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800)
+	arp[4] = 6
+	arp[5] = 4
+	binary.BigEndian.PutUint16(arp[6:8], arpOpRequest)
+	copy(arp[8:14], hwAddr)
+	// sender protocol address and target hardware
+	// address are left zeroed
+	copy(arp[24:28], ip4)
+	return padFrame(append(ethHeader(ethBroadcastAddr, hwAddr, ethTypeARP), arp...)), nil
+}
+
+// arpConflict checks whether the frame indicates that one of ips
+// is used by a host other than ownHwAddr. This is the case for
+// any ARP packet having one of ips as its sender address, as well
+// as for ARP probes for one of ips sent by another host. It returns
+// the conflicting address and the hardware address of the other
+// host, or nil if there's no conflict
+func arpConflict(frame []byte, ownHwAddr net.HardwareAddr, ips []net.IP) (net.IP, net.HardwareAddr) {
+	if len(frame) < ethHeaderLen+arpLen || binary.BigEndian.Uint16(frame[12:14]) != ethTypeARP {
+		return nil, nil
+	}
+	arp := frame[ethHeaderLen:]
+	if arp[4] != 6 || arp[5] != 4 {
+		return nil, nil
+	}
+	op := binary.BigEndian.Uint16(arp[6:8])
+	if op != arpOpRequest && op != arpOpReply {
+		return nil, nil
+	}
+	senderHwAddr := net.HardwareAddr(arp[8:14])
+	if bytes.Equal(senderHwAddr, ownHwAddr) {
+		return nil, nil
+	}
+	senderIP, targetIP := net.IP(arp[14:18]), net.IP(arp[24:28])
+	for _, ip := range ips {
+		if senderIP.Equal(ip) || (op == arpOpRequest && senderIP.Equal(net.IPv4zero) && targetIP.Equal(ip)) {
+			return ip, append(net.HardwareAddr(nil), senderHwAddr...)
+		}
+	}
+	return nil, nil
+}
+
+// DetectAddressConflicts sends ARP probes for each IPv4 address
+// of the VM tap interfaces and waits for the specified time
+// for other hosts that use any of these addresses to respond.
+// If such a host is found, *AddressConflictError is returned.
+// The function should be called from within container namespace
+// after SetupContainerSideNetwork() call, but before the VM is
+// started and before AnnounceAddresses() is called.
+func (csn *ContainerSideNetwork) DetectAddressConflicts(timeout time.Duration) error {
+	n := 0
+	for resultIndex, iface := range csn.Result.Interfaces {
+		if iface.Sandbox == "" {
+			continue
+		}
+		if n >= len(csn.Interfaces) {
+			break
+		}
+		desc := csn.Interfaces[n]
+		n++
+		// the guests check the addresses of SR-IOV VFs themselves
+		if desc.Type != InterfaceTypeTap {
+			continue
+		}
+		var ips []net.IP
+		var frames [][]byte
+		for _, ipConfig := range csn.Result.IPs {
+			if ipConfig.Interface != resultIndex || ipConfig.Address.IP.To4() == nil {
+				continue
+			}
+			frame, err := arpProbeFrame(desc.HardwareAddr, ipConfig.Address.IP)
+			if err != nil {
+				return err
+			}
+			ips = append(ips, ipConfig.Address.IP.To4())
+			frames = append(frames, frame)
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		// The probes are sent and the responses are received
+		// via CNI-provided link because the bridge doesn't
+		// pass the frames destined to the VM to the host
+		var conflict *AddressConflictError
+		if err := exchangeRawFrames(iface.Name, frames, timeout, func(frame []byte) bool {
+			ip, hwAddr := arpConflict(frame, desc.HardwareAddr, ips)
+			if ip == nil {
+				return false
+			}
+			conflict = &AddressConflictError{IP: ip, HardwareAddr: hwAddr, Interface: iface.Name}
+			return true
+		}); err != nil {
+			return fmt.Errorf("can't probe the addresses on %q: %v", iface.Name, err)
+		}
+		if conflict != nil {
+			return conflict
+		}
+		glog.V(3).Infof("No conflicts detected for %v on %q", ips, iface.Name)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestARPProbeFrame(t *testing.T) {
+	hwAddr, _ := net.ParseMAC(innerHwAddr)
+	frame, err := arpProbeFrame(hwAddr, net.ParseIP("10.1.90.5"))
+	if err != nil {
+		t.Fatalf("arpProbeFrame(): %v", err)
+	}
+	expected := []byte{
+		// ethernet header
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x42, 0xa4, 0xa6, 0x22, 0x80, 0x2e,
+		0x08, 0x06,
+		// ARP request
+		0, 1, 8, 0, 6, 4, 0, 1,
+		0x42, 0xa4, 0xa6, 0x22, 0x80, 0x2e,
+		0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0,
+		10, 1, 90, 5,
+	}
+	expected = append(expected, make([]byte, minEthFrameLen-len(expected))...)
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("bad ARP probe frame:\n%#v\ninstead of\n%#v", frame, expected)
+	}
+
+	if _, err := arpProbeFrame(hwAddr, net.ParseIP("fc00::5")); err == nil {
+		t.Errorf("arpProbeFrame() didn't fail for an IPv6 address")
+	}
+}
+
+func arpFrame(op byte, senderHwAddr string, senderIP, targetIP net.IP) []byte {
+	hwAddr, _ := net.ParseMAC(senderHwAddr)
+	frame := ethHeader(ethBroadcastAddr, hwAddr, ethTypeARP)
+	frame = append(frame, 0, 1, 8, 0, 6, 4, 0, op)
+	frame = append(frame, hwAddr...)
+	frame = append(frame, senderIP.To4()...)
+	frame = append(frame, make([]byte, 6)...)
+	frame = append(frame, targetIP.To4()...)
+	return padFrame(frame)
+}
+
+func TestARPConflict(t *testing.T) {
+	ownHwAddr, _ := net.ParseMAC(innerHwAddr)
+	otherHwAddr := "42:a4:a6:22:80:99"
+	ip := net.ParseIP("10.1.90.5")
+	otherIP := net.ParseIP("10.1.90.1")
+	ownProbe, _ := arpProbeFrame(ownHwAddr, ip)
+	ipv6Frame, _ := unsolicitedNAFrame(ownHwAddr, net.ParseIP("fc00::5"))
+	for _, tc := range []struct {
+		name     string
+		frame    []byte
+		conflict bool
+	}{
+		{
+			name:     "reply from another host",
+			frame:    arpFrame(arpOpReply, otherHwAddr, ip, ip),
+			conflict: true,
+		},
+		{
+			name:     "request from another host using the address",
+			frame:    arpFrame(arpOpRequest, otherHwAddr, ip, otherIP),
+			conflict: true,
+		},
+		{
+			name:     "probe for the address from another host",
+			frame:    arpFrame(arpOpRequest, otherHwAddr, net.IPv4zero, ip),
+			conflict: true,
+		},
+		{
+			name:  "own probe",
+			frame: ownProbe,
+		},
+		{
+			name:  "request for the address from another host",
+			frame: arpFrame(arpOpRequest, otherHwAddr, otherIP, ip),
+		},
+		{
+			name:  "unrelated reply",
+			frame: arpFrame(arpOpReply, otherHwAddr, otherIP, otherIP),
+		},
+		{
+			name:  "non-ARP frame",
+			frame: ipv6Frame,
+		},
+		{
+			name:  "truncated frame",
+			frame: arpFrame(arpOpReply, otherHwAddr, ip, ip)[:20],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conflictIP, hwAddr := arpConflict(tc.frame, ownHwAddr, []net.IP{ip.To4()})
+			switch {
+			case !tc.conflict && conflictIP != nil:
+				t.Errorf("unexpected conflict for %v with %v", conflictIP, hwAddr)
+			case tc.conflict && conflictIP == nil:
+				t.Errorf("conflict not detected")
+			case tc.conflict && (!conflictIP.Equal(ip) || hwAddr.String() != otherHwAddr):
+				t.Errorf("bad conflict info: %v, %v", conflictIP, hwAddr)
+			}
+		})
+	}
+}
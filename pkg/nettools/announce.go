@@ -0,0 +1,204 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ethHeaderLen   = 14
+	minEthFrameLen = 60
+
+	ethTypeARP  = 0x0806
+	ethTypeIPv6 = 0x86dd
+
+	arpOpRequest = 1
+
+	ipv6HeaderLen        = 40
+	icmpv6ProtocolNumber = 58
+	icmpv6NeighborAdvert = 136
+	// "Override" flag of Neighbor Advertisement (RFC 4861, 4.4)
+	naFlagOverride = 0x20
+	// "Target Link-Layer Address" option of Neighbor Advertisement
+	naOptTargetLinkLayerAddr = 2
+)
+
+var (
+	ethBroadcastAddr = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	// Ethernet address corresponding to ff02::1 (all nodes)
+	ethAllNodesAddr = net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}
+)
+
+func ethHeader(dst, src net.HardwareAddr, ethType uint16) []byte {
+	hdr := make([]byte, ethHeaderLen)
+	copy(hdr[0:6], dst)
+	copy(hdr[6:12], src)
+	binary.BigEndian.PutUint16(hdr[12:14], ethType)
+	return hdr
+}
+
+func padFrame(frame []byte) []byte {
+	if len(frame) < minEthFrameLen {
+		frame = append(frame, make([]byte, minEthFrameLen-len(frame))...)
+	}
+	return frame
+}
+
+// gratuitousARPFrame returns an Ethernet frame containing gratuitous
+// ARP request announcing that ip belongs to hwAddr
+func gratuitousARPFrame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("not an IPv4 address: %v", ip)
+	}
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("bad hardware address: %v", hwAddr)
+	}
+	arp := make([]byte, 28)
+	binary.BigEndian.PutUint16(arp[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(arp[2:4], 0x0800)
+	arp[4] = 6
+	arp[5] = 4
+	binary.BigEndian.PutUint16(arp[6:8], arpOpRequest)
+	copy(arp[8:14], hwAddr)
+	copy(arp[14:18], ip4)
+	// target hardware address is left zeroed
+	copy(arp[24:28], ip4)
+	return padFrame(append(ethHeader(ethBroadcastAddr, hwAddr, ethTypeARP), arp...)), nil
+}
+
+func icmpv6Checksum(src, dst net.IP, payload []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+		}
+		if len(b)%2 != 0 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.To16())
+	add(dst.To16())
+	pseudo := make([]byte, 8)
+	binary.BigEndian.PutUint32(pseudo[0:4], uint32(len(payload)))
+	pseudo[7] = icmpv6ProtocolNumber
+	add(pseudo)
+	add(payload)
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// unsolicitedNAFrame returns an Ethernet frame containing unsolicited
+// IPv6 Neighbor Advertisement announcing that ip belongs to hwAddr
+func unsolicitedNAFrame(hwAddr net.HardwareAddr, ip net.IP) ([]byte, error) {
+	if ip.To4() != nil || ip.To16() == nil {
+		return nil, fmt.Errorf("not an IPv6 address: %v", ip)
+	}
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("bad hardware address: %v", hwAddr)
+	}
+	ip = ip.To16()
+	allNodes := net.ParseIP("ff02::1")
+
+	icmp := make([]byte, 32)
+	icmp[0] = icmpv6NeighborAdvert
+	icmp[4] = naFlagOverride
+	copy(icmp[8:24], ip)
+	icmp[24] = naOptTargetLinkLayerAddr
+	icmp[25] = 1 // option length in units of 8 octets
+	copy(icmp[26:32], hwAddr)
+	binary.BigEndian.PutUint16(icmp[2:4], icmpv6Checksum(ip, allNodes, icmp))
+
+	ipHdr := make([]byte, ipv6HeaderLen)
+	ipHdr[0] = 6 << 4
+	binary.BigEndian.PutUint16(ipHdr[4:6], uint16(len(icmp)))
+	ipHdr[6] = icmpv6ProtocolNumber
+	// NDP messages must have hop limit of 255 (RFC 4861, 7.1.2)
+	ipHdr[7] = 255
+	copy(ipHdr[8:24], ip)
+	copy(ipHdr[24:40], allNodes)
+
+	frame := ethHeader(ethAllNodesAddr, hwAddr, ethTypeIPv6)
+	frame = append(frame, ipHdr...)
+	return padFrame(append(frame, icmp...)), nil
+}
+
+// AnnounceAddresses sends gratuitous ARP (or unsolicited Neighbor
+// Advertisement in case of IPv6) for each IP address of the VM tap
+// interfaces, so the upstream switches and CNI fabric learn the VM
+// location. The function should be called from within container
+// namespace after SetupContainerSideNetwork() or
+// RecreateContainerSideNetwork() call.
+func (csn *ContainerSideNetwork) AnnounceAddresses() error {
+	n := 0
+	for resultIndex, iface := range csn.Result.Interfaces {
+		if iface.Sandbox == "" {
+			continue
+		}
+		if n >= len(csn.Interfaces) {
+			break
+		}
+		desc := csn.Interfaces[n]
+		outIfName := fmt.Sprintf(containerBridgeNameTemplate, n)
+		n++
+		// SR-IOV VFs are not plugged into the bridge, and
+		// the guest announces itself through them
+		if desc.Type != InterfaceTypeTap {
+			continue
+		}
+		link, err := netlink.LinkByName(iface.Name)
+		if err != nil {
+			return err
+		}
+		if attachmentForLink(link) == attachViaRedirect {
+			// there's no bridge, the frames go out
+			// through the link directly
+			outIfName = iface.Name
+		}
+		for _, ipConfig := range csn.Result.IPs {
+			if ipConfig.Interface != resultIndex {
+				continue
+			}
+			var frame []byte
+			var err error
+			var ethType uint16
+			if ipConfig.Address.IP.To4() != nil {
+				frame, err = gratuitousARPFrame(desc.HardwareAddr, ipConfig.Address.IP)
+				ethType = ethTypeARP
+			} else {
+				frame, err = unsolicitedNAFrame(desc.HardwareAddr, ipConfig.Address.IP)
+				ethType = ethTypeIPv6
+			}
+			if err == nil {
+				err = sendRawFrame(outIfName, ethType, frame)
+			}
+			if err != nil {
+				return fmt.Errorf("can't announce %v on %q: %v", ipConfig.Address.IP, outIfName, err)
+			}
+			glog.V(3).Infof("Announced %v at %v on %q", ipConfig.Address.IP, desc.HardwareAddr, outIfName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+// +build linux
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+const ethPAll = 0x0003
+
+// htons converts a short from host to network byte order.
+// All the architectures supported by Virtlet are little-endian
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// sendRawFrame sends Ethernet frame via the specified interface
+func sendRawFrame(ifaceName string, ethType uint16, frame []byte) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethType)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethType),
+		Ifindex:  iface.Index,
+		Halen:    6,
+	}
+	copy(addr.Addr[:], frame[0:6])
+	return syscall.Sendto(fd, frame, 0, addr)
+}
+
+// exchangeRawFrames sends Ethernet frames via the specified interface
+// and passes the frames received on it to handle() until it returns
+// true or the timeout expires
+func exchangeRawFrames(ifaceName string, frames [][]byte, timeout time.Duration, handle func(frame []byte) bool) error {
+	iface, err := net.InterfaceByName(ifaceName)
+	if err != nil {
+		return err
+	}
+	// ETH_P_ALL is used because the frames passed to the
+	// protocol-specific handlers don't include the ones
+	// that are consumed by the bridge the link is attached to
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(htons(ethPAll)))
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	addr := &syscall.SockaddrLinklayer{
+		Protocol: htons(ethPAll),
+		Ifindex:  iface.Index,
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		sendAddr := &syscall.SockaddrLinklayer{
+			Ifindex: iface.Index,
+			Halen:   6,
+		}
+		copy(sendAddr.Addr[:], frame[0:6])
+		if err := syscall.Sendto(fd, frame, 0, sendAddr); err != nil {
+			return err
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 65536)
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return nil
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			continue
+		case err != nil:
+			return err
+		case handle(buf[:n]):
+			return nil
+		}
+	}
+}
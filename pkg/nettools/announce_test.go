@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestGratuitousARPFrame(t *testing.T) {
+	hwAddr, _ := net.ParseMAC(innerHwAddr)
+	frame, err := gratuitousARPFrame(hwAddr, net.ParseIP("10.1.90.5"))
+	if err != nil {
+		t.Fatalf("gratuitousARPFrame(): %v", err)
+	}
+	expected := []byte{
+		// ethernet header
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x42, 0xa4, 0xa6, 0x22, 0x80, 0x2e,
+		0x08, 0x06,
+		// ARP request
+		0, 1, 8, 0, 6, 4, 0, 1,
+		0x42, 0xa4, 0xa6, 0x22, 0x80, 0x2e,
+		10, 1, 90, 5,
+		0, 0, 0, 0, 0, 0,
+		10, 1, 90, 5,
+	}
+	expected = append(expected, make([]byte, minEthFrameLen-len(expected))...)
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("bad gratuitous ARP frame:\n%#v\ninstead of\n%#v", frame, expected)
+	}
+
+	if _, err := gratuitousARPFrame(hwAddr, net.ParseIP("fc00::5")); err == nil {
+		t.Errorf("gratuitousARPFrame() didn't fail for an IPv6 address")
+	}
+}
+
+func TestUnsolicitedNAFrame(t *testing.T) {
+	hwAddr, _ := net.ParseMAC(innerHwAddr)
+	ip := net.ParseIP("fc00::5")
+	frame, err := unsolicitedNAFrame(hwAddr, ip)
+	if err != nil {
+		t.Fatalf("unsolicitedNAFrame(): %v", err)
+	}
+	if len(frame) != ethHeaderLen+ipv6HeaderLen+32 {
+		t.Fatalf("bad frame length %d", len(frame))
+	}
+	if !bytes.Equal(frame[0:6], ethAllNodesAddr) || !bytes.Equal(frame[6:12], hwAddr) {
+		t.Errorf("bad ethernet addresses in the frame: %#v", frame[0:12])
+	}
+	if binary.BigEndian.Uint16(frame[12:14]) != ethTypeIPv6 {
+		t.Errorf("bad ethernet type in the frame: %#v", frame[12:14])
+	}
+	ipHdr := frame[ethHeaderLen : ethHeaderLen+ipv6HeaderLen]
+	if ipHdr[6] != icmpv6ProtocolNumber || ipHdr[7] != 255 {
+		t.Errorf("bad next header / hop limit in IPv6 header: %#v", ipHdr)
+	}
+	if !net.IP(ipHdr[8:24]).Equal(ip) || !net.IP(ipHdr[24:40]).Equal(net.ParseIP("ff02::1")) {
+		t.Errorf("bad addresses in IPv6 header: %#v", ipHdr)
+	}
+	icmp := frame[ethHeaderLen+ipv6HeaderLen:]
+	if icmp[0] != icmpv6NeighborAdvert || icmp[4] != naFlagOverride {
+		t.Errorf("bad ICMPv6 type / flags: %#v", icmp)
+	}
+	if !net.IP(icmp[8:24]).Equal(ip) {
+		t.Errorf("bad target address: %#v", icmp[8:24])
+	}
+	if !bytes.Equal(icmp[26:32], hwAddr) {
+		t.Errorf("bad target link-layer address: %#v", icmp[26:32])
+	}
+	// the checksum of a packet with correct checksum field is zero
+	if sum := icmpv6Checksum(ip, net.ParseIP("ff02::1"), icmp); sum != 0 {
+		t.Errorf("bad ICMPv6 checksum (verification sum %#04x)", sum)
+	}
+
+	if _, err := unsolicitedNAFrame(hwAddr, net.ParseIP("10.1.90.5")); err == nil {
+		t.Errorf("unsolicitedNAFrame() didn't fail for an IPv4 address")
+	}
+}
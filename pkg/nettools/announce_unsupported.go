@@ -0,0 +1,36 @@
+// +build !linux
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"errors"
+	"time"
+)
+
+// sendRawFrame sends Ethernet frame via the specified interface
+func sendRawFrame(ifaceName string, ethType uint16, frame []byte) error {
+	return errors.New("not implemented")
+}
+
+// exchangeRawFrames sends Ethernet frames via the specified interface
+// and passes the frames received on it to handle() until it returns
+// true or the timeout expires
+func exchangeRawFrames(ifaceName string, frames [][]byte, timeout time.Duration, handle func(frame []byte) bool) error {
+	return errors.New("not implemented")
+}
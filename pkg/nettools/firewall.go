@@ -0,0 +1,236 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	firewallChain            = "VIRTLET-INGRESS"
+	bridgeNFCallIptablesPath = "/proc/sys/net/bridge/bridge-nf-call-iptables"
+)
+
+// IngressRule describes the traffic that's allowed to reach the VM
+type IngressRule struct {
+	// Source denotes the network the traffic may come from.
+	// nil means any address
+	Source *net.IPNet
+	// Protocol is either "tcp" or "udp". It's only
+	// meaningful if Port is non-zero
+	Protocol string
+	// Port is the destination port. 0 means any port
+	Port int
+}
+
+// ParseIngressRules parses the list of ingress rules separated by
+// commas or whitespace. Each rule has the form [CIDR][:PORT[/PROTO]],
+// e.g. "10.0.0.0/8", "0.0.0.0/0:22", ":53/udp" or "10.1.0.0/16:8080/tcp".
+// PROTO may be either tcp (the default) or udp. Only IPv4 is supported
+func ParseIngressRules(s string) ([]IngressRule, error) {
+	var rules []IngressRule
+	for _, item := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		rule, err := parseIngressRule(item)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("empty ingress rule list")
+	}
+	return rules, nil
+}
+
+func parseIngressRule(s string) (IngressRule, error) {
+	var r IngressRule
+	if strings.Count(s, ":") > 1 {
+		return r, fmt.Errorf("bad ingress rule %q: only IPv4 is supported", s)
+	}
+	cidr, portSpec := s, ""
+	if i := strings.Index(s, ":"); i >= 0 {
+		cidr, portSpec = s[:i], s[i+1:]
+	}
+	if cidr != "" {
+		ip, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return r, fmt.Errorf("bad ingress rule %q: %v", s, err)
+		}
+		if ip.To4() == nil {
+			return r, fmt.Errorf("bad ingress rule %q: only IPv4 is supported", s)
+		}
+		r.Source = ipNet
+	}
+	if portSpec == "" {
+		if cidr == "" {
+			return r, fmt.Errorf("bad ingress rule %q: neither CIDR nor port specified", s)
+		}
+		return r, nil
+	}
+	r.Protocol = "tcp"
+	if i := strings.Index(portSpec, "/"); i >= 0 {
+		portSpec, r.Protocol = portSpec[:i], strings.ToLower(portSpec[i+1:])
+	}
+	if r.Protocol != "tcp" && r.Protocol != "udp" {
+		return r, fmt.Errorf("bad ingress rule %q: protocol must be either tcp or udp", s)
+	}
+	port, err := strconv.Atoi(portSpec)
+	if err != nil || port <= 0 || port > 65535 {
+		return r, fmt.Errorf("bad ingress rule %q: invalid port", s)
+	}
+	r.Port = port
+	return r, nil
+}
+
+func (r IngressRule) iptablesArgs() []string {
+	var args []string
+	if r.Source != nil {
+		args = append(args, "-s", r.Source.String())
+	}
+	if r.Port != 0 {
+		args = append(args, "-p", r.Protocol, "--dport", strconv.Itoa(r.Port))
+	}
+	return append(args, "-j", "ACCEPT")
+}
+
+// firewallCommands returns iptables command lines that make the
+// traffic that's going to the specified tap interfaces pass only
+// if it matches one of the rules or belongs to connections
+// initiated by the VM
+func firewallCommands(tapNames []string, rules []IngressRule) [][]string {
+	cmds := [][]string{
+		{"-N", firewallChain},
+		{"-A", firewallChain, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+	for _, r := range rules {
+		cmds = append(cmds, append([]string{"-A", firewallChain}, r.iptablesArgs()...))
+	}
+	cmds = append(cmds, []string{"-A", firewallChain, "-j", "DROP"})
+	for _, tapName := range tapNames {
+		cmds = append(cmds, []string{
+			"-A", "FORWARD", "-m", "physdev", "--physdev-is-bridged",
+			"--physdev-out", tapName, "-j", firewallChain,
+		})
+	}
+	return cmds
+}
+
+func runIptables(nsPath string, args ...string) error {
+	if out, err := exec.Command("nsenter", append([]string{"--net=" + nsPath, "iptables"}, args...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("[netns %q] iptables %s failed: %v\nOut:\n%s", nsPath, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// SetupFirewall restricts the traffic coming to the VM according
+// to the ingress rules. The traffic passing through the bridge is
+// only visible to iptables when br_netfilter is enabled for it, so
+// the function enables it for the bridges of the VM, leaving the
+// node-wide bridge-nf-call-iptables setting intact. It must be called
+// from within container namespace with container's sysfs mounted
+// after SetupContainerSideNetwork().
+func (csn *ContainerSideNetwork) SetupFirewall(rules []IngressRule) error {
+	contLinks, err := GetContainerLinks(csn.Result.Interfaces)
+	if err != nil {
+		return err
+	}
+	var tapNames, bridgeNames []string
+	for i, link := range contLinks {
+		if csn.Interfaces[i].Type != InterfaceTypeTap {
+			continue
+		}
+		if attachmentForLink(link) != attachViaBridge {
+			return fmt.Errorf("ingress rules are not supported for %s links", link.Type())
+		}
+		tapNames = append(tapNames, fmt.Sprintf(tapInterfaceNameTemplate, i))
+		bridgeNames = append(bridgeNames, fmt.Sprintf(containerBridgeNameTemplate, i))
+	}
+	if len(tapNames) == 0 {
+		return nil
+	}
+
+	if err := checkBridgeNetfilter(); err != nil {
+		return err
+	}
+	if err := enableBridgeNetfilter(bridgeNames); err != nil {
+		return err
+	}
+	for _, args := range firewallCommands(tapNames, rules) {
+		if err := runIptables(csn.NsPath, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkBridgeNetfilter() error {
+	if _, err := os.Stat(bridgeNFCallIptablesPath); err != nil {
+		return fmt.Errorf("br_netfilter is not available (is the module loaded?): %v", err)
+	}
+	return nil
+}
+
+// enableBridgeNetfilter makes the traffic passing through the
+// specified bridges visible to iptables using the per-bridge
+// nf_call_iptables option, which takes effect regardless of
+// the value of bridge-nf-call-iptables sysctl
+func enableBridgeNetfilter(bridgeNames []string) error {
+	for _, bridgeName := range bridgeNames {
+		if err := writeBridgeOption(bridgeName, "nf_call_iptables", "1"); err != nil {
+			return err
+		}
+		glog.V(3).Infof("Enabled bridged traffic filtering for bridge %q", bridgeName)
+	}
+	return nil
+}
+
+// TeardownFirewall removes the rules added by SetupFirewall()
+func (csn *ContainerSideNetwork) TeardownFirewall() error {
+	// -S output looks like "-A FORWARD -m physdev ... -j VIRTLET-INGRESS"
+	out, err := exec.Command("nsenter", "--net="+csn.NsPath, "iptables", "-S", "FORWARD").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("[netns %q] iptables -S failed: %v\nOut:\n%s", csn.NsPath, err, out)
+	}
+	found := false
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || fields[len(fields)-1] != firewallChain {
+			continue
+		}
+		found = true
+		fields[0] = "-D"
+		if err := runIptables(csn.NsPath, fields...); err != nil {
+			return err
+		}
+	}
+	if !found {
+		return nil
+	}
+	if err := runIptables(csn.NsPath, "-F", firewallChain); err != nil {
+		return err
+	}
+	return runIptables(csn.NsPath, "-X", firewallChain)
+}
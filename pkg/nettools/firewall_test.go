@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIngressRules(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		args     [][]string
+		errorStr string
+	}{
+		{
+			spec: "10.0.0.0/8",
+			args: [][]string{{"-s", "10.0.0.0/8", "-j", "ACCEPT"}},
+		},
+		{
+			spec: "0.0.0.0/0:22, 10.1.0.0/16:53/udp\n:8080",
+			args: [][]string{
+				{"-s", "0.0.0.0/0", "-p", "tcp", "--dport", "22", "-j", "ACCEPT"},
+				{"-s", "10.1.0.0/16", "-p", "udp", "--dport", "53", "-j", "ACCEPT"},
+				{"-p", "tcp", "--dport", "8080", "-j", "ACCEPT"},
+			},
+		},
+		{
+			spec: "192.168.10.5/24:443/TCP",
+			args: [][]string{{"-s", "192.168.10.0/24", "-p", "tcp", "--dport", "443", "-j", "ACCEPT"}},
+		},
+		{spec: "", errorStr: "empty ingress rule list"},
+		{spec: "10.0.0.0", errorStr: "bad ingress rule \"10.0.0.0\": invalid CIDR address: 10.0.0.0"},
+		{spec: "fc00::/64", errorStr: "bad ingress rule \"fc00::/64\": only IPv4 is supported"},
+		{spec: "10.0.0.0/8:99999", errorStr: "bad ingress rule \"10.0.0.0/8:99999\": invalid port"},
+		{spec: ":22/sctp", errorStr: "bad ingress rule \":22/sctp\": protocol must be either tcp or udp"},
+		{spec: ":", errorStr: "bad ingress rule \":\": neither CIDR nor port specified"},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			rules, err := ParseIngressRules(tc.spec)
+			if tc.errorStr != "" {
+				if err == nil {
+					t.Fatalf("didn't get the expected error")
+				}
+				if err.Error() != tc.errorStr {
+					t.Errorf("bad error message %q instead of %q", err.Error(), tc.errorStr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseIngressRules(): %v", err)
+			}
+			var args [][]string
+			for _, r := range rules {
+				args = append(args, r.iptablesArgs())
+			}
+			if !reflect.DeepEqual(args, tc.args) {
+				t.Errorf("bad iptables args: %#v instead of %#v", args, tc.args)
+			}
+		})
+	}
+}
+
+func TestFirewallCommands(t *testing.T) {
+	rules, err := ParseIngressRules("10.0.0.0/8:22")
+	if err != nil {
+		t.Fatalf("ParseIngressRules(): %v", err)
+	}
+	expected := [][]string{
+		{"-N", "VIRTLET-INGRESS"},
+		{"-A", "VIRTLET-INGRESS", "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"-A", "VIRTLET-INGRESS", "-s", "10.0.0.0/8", "-p", "tcp", "--dport", "22", "-j", "ACCEPT"},
+		{"-A", "VIRTLET-INGRESS", "-j", "DROP"},
+		{"-A", "FORWARD", "-m", "physdev", "--physdev-is-bridged", "--physdev-out", "tap0", "-j", "VIRTLET-INGRESS"},
+		{"-A", "FORWARD", "-m", "physdev", "--physdev-is-bridged", "--physdev-out", "tap1", "-j", "VIRTLET-INGRESS"},
+	}
+	if cmds := firewallCommands([]string{"tap0", "tap1"}, rules); !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("bad firewall commands: %#v instead of %#v", cmds, expected)
+	}
+}
+
+func TestEnableBridgeNetfilter(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sysfs-net")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	savedSysfsNetPath := sysfsNetPath
+	sysfsNetPath = tmpDir
+	defer func() { sysfsNetPath = savedSysfsNetPath }()
+
+	bridgeNames := []string{"br0", "br1"}
+	for _, bridgeName := range bridgeNames {
+		if err := os.MkdirAll(filepath.Join(tmpDir, bridgeName, "bridge"), 0755); err != nil {
+			t.Fatalf("MkdirAll(): %v", err)
+		}
+	}
+	if err := enableBridgeNetfilter(bridgeNames); err != nil {
+		t.Fatalf("enableBridgeNetfilter(): %v", err)
+	}
+	for _, bridgeName := range bridgeNames {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, bridgeName, "bridge", "nf_call_iptables"))
+		if err != nil {
+			t.Errorf("can't read nf_call_iptables of %q: %v", bridgeName, err)
+		} else if v := strings.TrimSpace(string(data)); v != "1" {
+			t.Errorf("bad nf_call_iptables value for %q: %q", bridgeName, v)
+		}
+	}
+
+	if err := enableBridgeNetfilter([]string{"br2"}); err == nil {
+		t.Errorf("didn't get an error for a missing bridge")
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"errors"
+	"fmt"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+)
+
+// AddInterface sets up an additional VM interface for the network
+// described by info. It's used to attach the VM to a network after
+// it's started. Unlike SetupContainerSideNetwork(), the function
+// doesn't try to fix CNI results lacking routes, and SR-IOV VFs are
+// not supported. It returns a new ContainerSideNetwork which has
+// info merged into its CNI result and the new interface appended to
+// its interface list, leaving csn itself intact. The function should
+// be called from within container namespace.
+func (csn *ContainerSideNetwork) AddInterface(info *cnicurrent.Result) (*ContainerSideNetwork, error) {
+	if len(info.IPs) == 0 {
+		return nil, errors.New("cni result does not have any IP addresses")
+	}
+	allLinks, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing the links: %v", err)
+	}
+	if err := fixCNIResultInterfaces(info, csn.NsPath, allLinks); err != nil {
+		return nil, err
+	}
+	contLinks, err := GetContainerLinks(info.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	if len(contLinks) != 1 {
+		return nil, fmt.Errorf("expected a single container interface in cni result, got %d", len(contLinks))
+	}
+	if isSriovVf(contLinks[0]) {
+		return nil, errors.New("SR-IOV VFs can't be attached to a running VM")
+	}
+
+	iface, err := setupInterface(len(csn.Interfaces), contLinks[0], csn.NsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the routes and DNS settings of the original network
+	// are kept, the additional network only provides
+	// the addresses
+	result := *csn.Result
+	offset := len(result.Interfaces)
+	result.Interfaces = append(append([]*cnicurrent.Interface(nil), result.Interfaces...), info.Interfaces...)
+	result.IPs = append([]*cnicurrent.IPConfig(nil), result.IPs...)
+	for _, ipConfig := range info.IPs {
+		c := *ipConfig
+		c.Interface += offset
+		result.IPs = append(result.IPs, &c)
+	}
+
+	return &ContainerSideNetwork{
+		Result:     &result,
+		NsPath:     csn.NsPath,
+		Interfaces: append(append([]InterfaceDescription(nil), csn.Interfaces...), iface),
+	}, nil
+}
+
+// TeardownLastInterface closes the file of the last interface in
+// csn.Interfaces and undoes the changes made for it in the container
+// network namespace. It's used to detach the VM from a network that
+// was attached using AddInterface(). The function should be called
+// from within container namespace.
+func (csn *ContainerSideNetwork) TeardownLastInterface() error {
+	if len(csn.Interfaces) == 0 {
+		return errors.New("no interfaces to tear down")
+	}
+	i := len(csn.Interfaces) - 1
+	csn.Interfaces[i].Fo.Close()
+
+	contLinks, err := GetContainerLinks(csn.Result.Interfaces)
+	if err != nil {
+		return err
+	}
+	if len(contLinks) != len(csn.Interfaces) {
+		return fmt.Errorf("container link count mismatch: %d instead of %d", len(contLinks), len(csn.Interfaces))
+	}
+	return csn.teardownInterface(i, contLinks[i])
+}
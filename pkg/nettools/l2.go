@@ -0,0 +1,234 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	l2TapNamePrefix = "vl2"
+	defaultVLAN     = 1
+	maxVLAN         = 4094
+)
+
+var linkNameRx = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// L2Attachment specifies the bridge in the node network namespace
+// which the tap device of the VM is attached to in L2 mode, bypassing
+// CNI, and optionally the VLAN to use on the bridge
+type L2Attachment struct {
+	// Bridge is the name of the bridge
+	Bridge string
+	// VLAN is the VLAN id, 0 means that the bridge's
+	// default VLAN is used
+	VLAN int
+}
+
+// ParseL2Attachment parses L2 attachment specification in
+// bridge[:vlan] format
+func ParseL2Attachment(spec string) (*L2Attachment, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ":")
+	if len(parts) > 2 {
+		return nil, fmt.Errorf("bad L2 attachment %q, must be bridge[:vlan]", spec)
+	}
+	att := &L2Attachment{Bridge: strings.TrimSpace(parts[0])}
+	if !linkNameRx.MatchString(att.Bridge) {
+		return nil, fmt.Errorf("bad bridge name %q", att.Bridge)
+	}
+	if len(parts) == 2 {
+		vlan, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || vlan < 1 || vlan > maxVLAN {
+			return nil, fmt.Errorf("bad VLAN id %q, must be between 1 and %d", parts[1], maxVLAN)
+		}
+		att.VLAN = vlan
+	}
+	return att, nil
+}
+
+// L2TapName returns the name of the tap device in the node network
+// namespace that's used by the pod with the specified id in L2 mode
+func L2TapName(podID string) string {
+	h := sha1.Sum([]byte(podID))
+	return l2TapNamePrefix + hex.EncodeToString(h[:])[:15-len(l2TapNamePrefix)]
+}
+
+func bridgeVLANFiltering(bridgeName string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", bridgeName, "bridge/vlan_filtering"))
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(data)) == "1", nil
+}
+
+// SetupL2Network creates the tap device for the pod with the specified
+// id in the current network namespace, which must be the node one,
+// and attaches it to the bridge. If hwAddr is nil, a random MAC address
+// is used. The returned ContainerSideNetwork has a single interface and
+// its Result contains no IP configuration, as the addresses are
+// assigned by the provider network. nsPath is the path to the pod
+// network namespace which is recorded in the Result
+func SetupL2Network(podID, nsPath string, att *L2Attachment, hwAddr net.HardwareAddr) (csn *ContainerSideNetwork, err error) {
+	br, err := netlink.LinkByName(att.Bridge)
+	if err != nil {
+		return nil, fmt.Errorf("can't find bridge %q: %v", att.Bridge, err)
+	}
+	if _, ok := br.(*netlink.Bridge); !ok {
+		return nil, fmt.Errorf("%q is not a bridge", att.Bridge)
+	}
+	if att.VLAN != 0 {
+		filtering, err := bridgeVLANFiltering(att.Bridge)
+		switch {
+		case err != nil:
+			return nil, fmt.Errorf("can't check VLAN filtering on bridge %q: %v", att.Bridge, err)
+		case !filtering:
+			return nil, fmt.Errorf("VLAN filtering is not enabled on bridge %q", att.Bridge)
+		}
+	}
+	if hwAddr == nil {
+		if hwAddr, err = GenerateMacAddress(); err != nil {
+			return nil, err
+		}
+	}
+
+	tapName := L2TapName(podID)
+	mtu := br.Attrs().MTU
+	tap, err := CreateTAP(tapName, mtu)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			if err := netlink.LinkDel(tap); err != nil {
+				glog.Warningf("Error removing tap %q during rollback: %v", tapName, err)
+			}
+		}
+	}()
+
+	if err = netlink.LinkSetMaster(tap, br.(*netlink.Bridge)); err != nil {
+		return nil, fmt.Errorf("can't attach %q to bridge %q: %v", tapName, att.Bridge, err)
+	}
+	if att.VLAN != 0 {
+		if err = netlink.BridgeVlanAdd(tap, uint16(att.VLAN), true, true, false, true); err != nil {
+			return nil, fmt.Errorf("can't add %q to VLAN %d: %v", tapName, att.VLAN, err)
+		}
+		if att.VLAN != defaultVLAN {
+			// the port is added to the default VLAN when
+			// it's attached to the bridge
+			if err := netlink.BridgeVlanDel(tap, defaultVLAN, true, true, false, true); err != nil {
+				glog.Warningf("Can't remove %q from the default VLAN: %v", tapName, err)
+			}
+		}
+	}
+
+	fo, err := OpenTAP(tapName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tap %q: %v", tapName, err)
+	}
+	glog.V(3).Infof("Attached tap %q to bridge %q (VLAN %d)", tapName, att.Bridge, att.VLAN)
+
+	return &ContainerSideNetwork{
+		Result: &cnicurrent.Result{
+			Interfaces: []*cnicurrent.Interface{
+				{
+					Name:    tapName,
+					Mac:     hwAddr.String(),
+					Sandbox: nsPath,
+				},
+			},
+		},
+		NsPath: nsPath,
+		Interfaces: []InterfaceDescription{
+			{
+				Type:         InterfaceTypeTap,
+				Fo:           fo,
+				Name:         tapName,
+				HardwareAddr: hwAddr,
+				MTU:          uint16(mtu),
+			},
+		},
+	}, nil
+}
+
+// RecreateL2Network populates ContainerSideNetwork for the pod in
+// L2 mode based on the Result returned by SetupL2Network(). If file
+// is not nil, it's used instead of reopening the tap device
+func RecreateL2Network(info *cnicurrent.Result, nsPath string, file *os.File) (*ContainerSideNetwork, error) {
+	if len(info.Interfaces) != 1 {
+		return nil, fmt.Errorf("bad L2 network configuration: expected 1 interface, got %d", len(info.Interfaces))
+	}
+	tapName := info.Interfaces[0].Name
+	hwAddr, err := net.ParseMAC(info.Interfaces[0].Mac)
+	if err != nil {
+		return nil, fmt.Errorf("bad MAC address in L2 network configuration: %v", err)
+	}
+	tap, err := netlink.LinkByName(tapName)
+	if err != nil {
+		return nil, fmt.Errorf("can't find tap %q: %v", tapName, err)
+	}
+	fo := file
+	if fo == nil {
+		if fo, err = OpenTAP(tapName); err != nil {
+			return nil, fmt.Errorf("failed to open tap %q: %v", tapName, err)
+		}
+	}
+	return &ContainerSideNetwork{
+		Result: info,
+		NsPath: nsPath,
+		Interfaces: []InterfaceDescription{
+			{
+				Type:         InterfaceTypeTap,
+				Fo:           fo,
+				Name:         tapName,
+				HardwareAddr: hwAddr,
+				MTU:          uint16(tap.Attrs().MTU),
+			},
+		},
+	}, nil
+}
+
+// TeardownL2Network closes the tap device created by SetupL2Network()
+// and removes it from the node network namespace
+func (csn *ContainerSideNetwork) TeardownL2Network() error {
+	for _, i := range csn.Interfaces {
+		i.Fo.Close()
+		tap, err := netlink.LinkByName(i.Name)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				continue
+			}
+			return err
+		}
+		if err := netlink.LinkDel(tap); err != nil {
+			return fmt.Errorf("can't remove tap %q: %v", i.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseL2Attachment(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		expected *L2Attachment
+	}{
+		{"br-provider", &L2Attachment{Bridge: "br-provider"}},
+		{" br0 : 100 ", &L2Attachment{Bridge: "br0", VLAN: 100}},
+		{"br0:4094", &L2Attachment{Bridge: "br0", VLAN: 4094}},
+		{"", nil},
+		{"br/0", nil},
+		{"averyveryverylongbridge", nil},
+		{"br0:0", nil},
+		{"br0:4095", nil},
+		{"br0:vlan", nil},
+		{"br0:100:200", nil},
+	} {
+		t.Run(tc.spec, func(t *testing.T) {
+			att, err := ParseL2Attachment(tc.spec)
+			switch {
+			case tc.expected == nil && err == nil:
+				t.Errorf("didn't get an error for %q", tc.spec)
+			case tc.expected != nil && err != nil:
+				t.Errorf("ParseL2Attachment(): %v", err)
+			case !reflect.DeepEqual(tc.expected, att) && tc.expected != nil:
+				t.Errorf("bad L2 attachment: expected %#v, got %#v", tc.expected, att)
+			}
+		})
+	}
+}
+
+func TestL2TapName(t *testing.T) {
+	name := L2TapName("69eec606-0493-5825-73a4-c5e0c0236155")
+	if len(name) != 15 {
+		t.Errorf("bad tap name length %d: %q", len(name), name)
+	}
+	if otherName := L2TapName("69eec606-0493-5825-73a4-c5e0c0236156"); otherName == name {
+		t.Errorf("got the same tap name %q for different pods", name)
+	}
+	if L2TapName("69eec606-0493-5825-73a4-c5e0c0236155") != name {
+		t.Errorf("tap name is not stable")
+	}
+}
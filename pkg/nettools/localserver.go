@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+// InternalServerIP returns the address of the servers that run
+// inside the pod network namespace, such as the DHCP server
+func InternalServerIP() net.IP {
+	return mustParseAddr(internalDhcpAddr).IP
+}
+
+// SetupInternalServerAccess makes it possible for the VM to reach
+// the servers listening on InternalServerIP() address other than
+// the DHCP server, which works with broadcasts. The VM sends the
+// packets for this address to its default gateway, so they're
+// diverted to the local network stack by ebtables before they're
+// forwarded by the bridge to the CNI-provided link, and the
+// routes to the VM addresses are added for the replies.
+// Only the tap interfaces attached via a bridge are handled.
+// The function must be called from within container namespace
+// after SetupContainerSideNetwork() call
+func (csn *ContainerSideNetwork) SetupInternalServerAccess() error {
+	serverIP := InternalServerIP()
+	n := 0
+	for resultIndex, iface := range csn.Result.Interfaces {
+		if iface.Sandbox == "" {
+			continue
+		}
+		if n >= len(csn.Interfaces) {
+			break
+		}
+		i := n
+		n++
+		if csn.Interfaces[i].Type != InterfaceTypeTap {
+			continue
+		}
+		br, err := netlink.LinkByName(fmt.Sprintf(containerBridgeNameTemplate, i))
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				// attached via tc redirection
+				continue
+			}
+			return err
+		}
+		for _, ipConfig := range csn.Result.IPs {
+			ip := ipConfig.Address.IP.To4()
+			if ipConfig.Interface != resultIndex || ip == nil {
+				continue
+			}
+			if err := netlink.RouteReplace(&netlink.Route{
+				LinkIndex: br.Attrs().Index,
+				Dst:       &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)},
+				Scope:     netlink.SCOPE_LINK,
+				Src:       serverIP,
+			}); err != nil {
+				return fmt.Errorf("error adding route to %s via %q: %v", ip, br.Attrs().Name, err)
+			}
+		}
+		tapName := fmt.Sprintf(tapInterfaceNameTemplate, i)
+		// the diverted packets are received on the tap
+		// interface while the replies go via the bridge
+		rpFilterPath := filepath.Join("/proc/sys/net/ipv4/conf", tapName, "rp_filter")
+		if err := ioutil.WriteFile(rpFilterPath, []byte("0"), 0644); err != nil {
+			glog.Warningf("Failed to disable reverse path filtering for %q: %v", tapName, err)
+		}
+		if err := divertToInternalServer(csn.NsPath, tapName, serverIP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func divertToInternalServer(nsPath, tapName string, serverIP net.IP) error {
+	args := []string{
+		"BROUTING", "--in-if", tapName, "-p", "IPV4", "--ip-destination", serverIP.String(),
+		// in the broute table, DROP means passing the frame to
+		// the network stack instead of bridging it
+		"-j", "redirect", "--redirect-target", "DROP",
+	}
+	// remove the rule first to avoid duplicates upon recovery
+	exec.Command("nsenter", append([]string{"--net=" + nsPath, "ebtables", "-t", "broute", "-D"}, args...)...).Run()
+	if out, err := exec.Command("nsenter", append([]string{"--net=" + nsPath, "ebtables", "-t", "broute", "-A"}, args...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("[netns %q] ebtables failed: %v\nOut:\n%s", nsPath, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+// BridgeMulticastMode specifies how the bridges created in the
+// container network namespace handle multicast traffic
+type BridgeMulticastMode string
+
+const (
+	// BridgeMulticastSnooping keeps the kernel defaults, i.e.
+	// IGMP/MLD snooping is enabled but the bridge doesn't send
+	// any queries itself. This is the default mode
+	BridgeMulticastSnooping BridgeMulticastMode = "snooping"
+	// BridgeMulticastQuerier makes the bridge act as IGMP/MLD
+	// querier, so the group memberships of the VM are refreshed
+	// even if there's no multicast router in the network
+	BridgeMulticastQuerier BridgeMulticastMode = "querier"
+	// BridgeMulticastFlood disables IGMP/MLD snooping, making
+	// the bridge flood the multicast traffic to all its ports
+	BridgeMulticastFlood BridgeMulticastMode = "flood"
+)
+
+// sysfsNetPath is the sysfs directory with network devices.
+// It's a variable so it can be changed in the tests
+var sysfsNetPath = "/sys/class/net"
+
+// ParseBridgeMulticastMode validates the bridge multicast mode.
+// Empty string means BridgeMulticastSnooping
+func ParseBridgeMulticastMode(s string) (BridgeMulticastMode, error) {
+	switch m := BridgeMulticastMode(strings.TrimSpace(s)); m {
+	case "":
+		return BridgeMulticastSnooping, nil
+	case BridgeMulticastSnooping, BridgeMulticastQuerier, BridgeMulticastFlood:
+		return m, nil
+	default:
+		return "", fmt.Errorf("bad bridge multicast mode %q (must be one of %q, %q or %q)", s, BridgeMulticastSnooping, BridgeMulticastQuerier, BridgeMulticastFlood)
+	}
+}
+
+func writeBridgeOption(bridgeName, option, value string) error {
+	path := filepath.Join(sysfsNetPath, bridgeName, "bridge", option)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("error setting %s of bridge %q: %v", option, bridgeName, err)
+	}
+	return nil
+}
+
+func setBridgeMulticastMode(bridgeName string, mode BridgeMulticastMode) error {
+	snooping, querier := "1", "0"
+	switch mode {
+	case BridgeMulticastSnooping:
+		// kernel defaults, nothing to do
+		return nil
+	case BridgeMulticastQuerier:
+		querier = "1"
+	case BridgeMulticastFlood:
+		snooping = "0"
+	default:
+		return fmt.Errorf("bad bridge multicast mode %q", mode)
+	}
+	if err := writeBridgeOption(bridgeName, "multicast_snooping", snooping); err != nil {
+		return err
+	}
+	return writeBridgeOption(bridgeName, "multicast_querier", querier)
+}
+
+// SetBridgeMulticastMode applies the multicast mode to the bridges
+// that connect the tap devices to the CNI interfaces. The interfaces
+// that don't use a bridge, such as SR-IOV VFs and the interfaces
+// using tc redirection, are skipped. The function should be called
+// from within container namespace with container's sysfs mounted.
+func (csn *ContainerSideNetwork) SetBridgeMulticastMode(mode BridgeMulticastMode) error {
+	if mode == BridgeMulticastSnooping {
+		return nil
+	}
+	for i, iface := range csn.Interfaces {
+		if iface.Type != InterfaceTypeTap {
+			continue
+		}
+		bridgeName := fmt.Sprintf(containerBridgeNameTemplate, i)
+		if _, err := netlink.LinkByName(bridgeName); err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				continue
+			}
+			return err
+		}
+		if err := setBridgeMulticastMode(bridgeName, mode); err != nil {
+			return err
+		}
+		glog.V(3).Infof("Set multicast mode of bridge %q to %q", bridgeName, mode)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseBridgeMulticastMode(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected BridgeMulticastMode
+	}{
+		{"", BridgeMulticastSnooping},
+		{"snooping", BridgeMulticastSnooping},
+		{" querier ", BridgeMulticastQuerier},
+		{"flood", BridgeMulticastFlood},
+		{"broadcast", ""},
+	} {
+		mode, err := ParseBridgeMulticastMode(tc.value)
+		switch {
+		case tc.expected == "" && err == nil:
+			t.Errorf("didn't get an error for %q", tc.value)
+		case tc.expected != "" && err != nil:
+			t.Errorf("ParseBridgeMulticastMode(%q): %v", tc.value, err)
+		case mode != tc.expected:
+			t.Errorf("bad mode for %q: expected %q, got %q", tc.value, tc.expected, mode)
+		}
+	}
+}
+
+func TestSetBridgeMulticastMode(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "sysfs-net")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	savedSysfsNetPath := sysfsNetPath
+	sysfsNetPath = tmpDir
+	defer func() { sysfsNetPath = savedSysfsNetPath }()
+
+	bridgeDir := filepath.Join(tmpDir, "br0", "bridge")
+	readOption := func(option string) string {
+		data, err := ioutil.ReadFile(filepath.Join(bridgeDir, option))
+		if err != nil {
+			t.Fatalf("can't read %s: %v", option, err)
+		}
+		return strings.TrimSpace(string(data))
+	}
+	for _, tc := range []struct {
+		mode              BridgeMulticastMode
+		snooping, querier string
+	}{
+		{BridgeMulticastQuerier, "1", "1"},
+		{BridgeMulticastFlood, "0", "0"},
+	} {
+		if err := os.MkdirAll(bridgeDir, 0755); err != nil {
+			t.Fatalf("MkdirAll(): %v", err)
+		}
+		if err := setBridgeMulticastMode("br0", tc.mode); err != nil {
+			t.Fatalf("setBridgeMulticastMode(): %v", err)
+		}
+		if snooping := readOption("multicast_snooping"); snooping != tc.snooping {
+			t.Errorf("bad multicast_snooping for %q: expected %q, got %q", tc.mode, tc.snooping, snooping)
+		}
+		if querier := readOption("multicast_querier"); querier != tc.querier {
+			t.Errorf("bad multicast_querier for %q: expected %q, got %q", tc.mode, tc.querier, querier)
+		}
+		os.RemoveAll(bridgeDir)
+	}
+
+	// the defaults are left intact
+	if err := setBridgeMulticastMode("br0", BridgeMulticastSnooping); err != nil {
+		t.Errorf("setBridgeMulticastMode(): %v", err)
+	}
+	if err := setBridgeMulticastMode("br0", BridgeMulticastQuerier); err == nil {
+		t.Errorf("didn't get an error for a missing bridge")
+	}
+}
@@ -354,13 +354,23 @@ func ValidateAndFixCNIResult(netConfig *cnicurrent.Result, nsPath string, allLin
 		return nil, fmt.Errorf("cni result does not have any IP addresses")
 	}
 
+	if err := fixCNIResultInterfaces(netConfig, nsPath, allLinks); err != nil {
+		return nil, err
+	}
+
+	return netConfig, nil
+}
+
+// fixCNIResultInterfaces makes the interface list of the CNI result
+// match the links in the container network namespace
+func fixCNIResultInterfaces(netConfig *cnicurrent.Result, nsPath string, allLinks []netlink.Link) error {
 	// Interfaces contain broken info more often than not, so we
 	// replace them here with what we can deduce from the network
 	// links in the container netns
 	for _, ipConfig := range netConfig.IPs {
 		link, err := findLinkByAddress(allLinks, ipConfig.Address)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
 		found := false
@@ -381,7 +391,7 @@ func ValidateAndFixCNIResult(netConfig *cnicurrent.Result, nsPath string, allLin
 		}
 	}
 
-	return netConfig, nil
+	return nil
 }
 
 // GetContainerLinks finds links that correspond to interfaces in the current
@@ -660,6 +670,9 @@ func rebindDriverToDevice(devName string) error {
 // with X denoting an link index in info.Interfaces list.
 // Each bridge gets assigned a link-local address to be used
 // for dhcp server.
+// macvlan and ipvlan links can't be bridged with VM's MAC address, so
+// instead of the bridge tc redirection is set up between tapX and the
+// link, with the link-local address for dhcp server assigned to tapX.
 // In case of SR-IOV VFs this function only sets up a device to be passed to VM.
 // The function should be called from within container namespace.
 // Returns container network struct and an error, if any.
@@ -672,107 +685,133 @@ func SetupContainerSideNetwork(info *cnicurrent.Result, nsPath string, allLinks
 	var interfaces []InterfaceDescription
 
 	for i, link := range contLinks {
-		hwAddr := link.Attrs().HardwareAddr
-		ifaceName := link.Attrs().Name
-		pciAddress := ""
-		var ifaceType InterfaceType
-		var fo *os.File
-
-		mtu := link.Attrs().MTU
-
-		if err := StripLink(link); err != nil {
+		iface, err := setupInterface(i, link, nsPath)
+		if err != nil {
 			return nil, err
 		}
+		interfaces = append(interfaces, iface)
+	}
 
-		if isSriovVf(link) {
-			if os.Getenv("VIRTLET_SRIOV_SUPPORT") == "" {
-				return nil, fmt.Errorf("SR-IOV device configured in container network namespace while Virtlet is configured with disabled SR-IOV support")
-			}
+	return &ContainerSideNetwork{info, nsPath, interfaces}, nil
+}
 
-			ifaceType = InterfaceTypeVF
+// setupInterface prepares the link with the specified index
+// to be passed to the VM. See SetupContainerSideNetwork()
+// for details. The function should be called from within
+// container namespace.
+func setupInterface(i int, link netlink.Link, nsPath string) (InterfaceDescription, error) {
+	hwAddr := link.Attrs().HardwareAddr
+	ifaceName := link.Attrs().Name
+	pciAddress := ""
+	var ifaceType InterfaceType
+	var fo *os.File
+	var err error
 
-			pciAddress, err = getPCIAddressOfVF(ifaceName)
-			if err != nil {
-				return nil, err
-			}
+	mtu := link.Attrs().MTU
 
-			fo, err = openVfConfigFile(pciAddress)
-			if err != nil {
-				return nil, err
-			}
+	if err := StripLink(link); err != nil {
+		return InterfaceDescription{}, err
+	}
 
-			if err := unbindDriverFromDevice(pciAddress); err != nil {
-				return nil, err
-			}
+	if isSriovVf(link) {
+		if os.Getenv("VIRTLET_SRIOV_SUPPORT") == "" {
+			return InterfaceDescription{}, fmt.Errorf("SR-IOV device configured in container network namespace while Virtlet is configured with disabled SR-IOV support")
+		}
 
-			glog.V(3).Infof("Adding interface %q as VF on %s address", ifaceName, pciAddress)
-		} else {
+		ifaceType = InterfaceTypeVF
+
+		pciAddress, err = getPCIAddressOfVF(ifaceName)
+		if err != nil {
+			return InterfaceDescription{}, err
+		}
+
+		fo, err = openVfConfigFile(pciAddress)
+		if err != nil {
+			return InterfaceDescription{}, err
+		}
+
+		if err := unbindDriverFromDevice(pciAddress); err != nil {
+			return InterfaceDescription{}, err
+		}
+
+		glog.V(3).Infof("Adding interface %q as VF on %s address", ifaceName, pciAddress)
+	} else {
+		attachment := attachmentForLink(link)
+		if attachment == attachViaBridge {
 			newHwAddr, err := GenerateMacAddress()
 			if err == nil {
 				err = SetHardwareAddr(link, newHwAddr)
 			}
 			if err != nil {
-				return nil, err
+				return InterfaceDescription{}, err
 			}
+		}
 
-			ifaceType = InterfaceTypeTap
+		ifaceType = InterfaceTypeTap
 
-			tapInterfaceName := fmt.Sprintf(tapInterfaceNameTemplate, i)
-			tap, err := CreateTAP(tapInterfaceName, mtu)
-			if err != nil {
-				return nil, err
-			}
+		tapInterfaceName := fmt.Sprintf(tapInterfaceNameTemplate, i)
+		tap, err := CreateTAP(tapInterfaceName, mtu)
+		if err != nil {
+			return InterfaceDescription{}, err
+		}
 
+		if attachment == attachViaRedirect {
+			glog.V(3).Infof("Using tc redirection between %q (%s) and %q", ifaceName, link.Type(), tapInterfaceName)
+			if err := setupRedirect(nsPath, link, tap); err != nil {
+				return InterfaceDescription{}, err
+			}
+		} else {
 			containerBridgeName := fmt.Sprintf(containerBridgeNameTemplate, i)
 			br, err := SetupBridge(containerBridgeName, []netlink.Link{link, tap})
 			if err != nil {
-				return nil, fmt.Errorf("failed to create bridge: %v", err)
+				return InterfaceDescription{}, fmt.Errorf("failed to create bridge: %v", err)
 			}
 
 			if err := netlink.AddrAdd(br, mustParseAddr(internalDhcpAddr)); err != nil {
-				return nil, fmt.Errorf("failed to set address for the bridge: %v", err)
+				return InterfaceDescription{}, fmt.Errorf("failed to set address for the bridge: %v", err)
 			}
 
 			// Add ebtables DHCP blocking rules
 			if err := updateEbTables(nsPath, ifaceName, "-A"); err != nil {
-				return nil, err
+				return InterfaceDescription{}, err
 			}
 
 			// Work around bridge MAC learning problem
 			// https://ubuntuforums.org/showthread.php?t=2329373&s=cf580a41179e0f186ad4e625834a1d61&p=13511965#post13511965
 			// (affects Flannel)
 			if err := disableMacLearning(nsPath, containerBridgeName); err != nil {
-				return nil, err
-			}
-
-			if err := bringUpLoopback(); err != nil {
-				return nil, err
+				return InterfaceDescription{}, err
 			}
+		}
 
-			glog.V(3).Infof("Opening tap interface %q for link %q", tapInterfaceName, ifaceName)
-			fo, err = OpenTAP(tapInterfaceName)
-			if err != nil {
-				return nil, fmt.Errorf("failed to open tap: %v", err)
-			}
-			glog.V(3).Infof("Adding interface %q as %q", ifaceName, tapInterfaceName)
+		if err := bringUpLoopback(); err != nil {
+			return InterfaceDescription{}, err
 		}
 
-		interfaces = append(interfaces, InterfaceDescription{
-			Type:         ifaceType,
-			Name:         ifaceName,
-			Fo:           fo,
-			HardwareAddr: hwAddr,
-			PCIAddress:   pciAddress,
-			MTU:          uint16(mtu),
-		})
+		glog.V(3).Infof("Opening tap interface %q for link %q", tapInterfaceName, ifaceName)
+		fo, err = OpenTAP(tapInterfaceName)
+		if err != nil {
+			return InterfaceDescription{}, fmt.Errorf("failed to open tap: %v", err)
+		}
+		glog.V(3).Infof("Adding interface %q as %q", ifaceName, tapInterfaceName)
 	}
 
-	return &ContainerSideNetwork{info, nsPath, interfaces}, nil
+	return InterfaceDescription{
+		Type:         ifaceType,
+		Name:         ifaceName,
+		Fo:           fo,
+		HardwareAddr: hwAddr,
+		PCIAddress:   pciAddress,
+		MTU:          uint16(mtu),
+	}, nil
 }
 
 // RecreateContainerSideNetwork tries to populate ContainerSideNetwork
-// structure based on a network namespace that was already adjusted for Virtlet
-func RecreateContainerSideNetwork(info *cnicurrent.Result, nsPath string, allLinks []netlink.Link) (*ContainerSideNetwork, error) {
+// structure based on a network namespace that was already adjusted for Virtlet.
+// If files is not nil, it must contain an open file for each interface
+// (a tap device or a VF config file) which is used instead of reopening
+// it, e.g. when the files are inherited from another process
+func RecreateContainerSideNetwork(info *cnicurrent.Result, nsPath string, allLinks []netlink.Link, files []*os.File) (*ContainerSideNetwork, error) {
 	if len(info.Interfaces) == 0 {
 		return nil, fmt.Errorf("wrong cni configuration - missing interfaces list: %v", spew.Sdump(info))
 	}
@@ -782,12 +821,16 @@ func RecreateContainerSideNetwork(info *cnicurrent.Result, nsPath string, allLin
 	if err != nil {
 		return nil, err
 	}
+	if files != nil && len(files) != len(contLinks) {
+		return nil, fmt.Errorf("got %d files for %d interfaces", len(files), len(contLinks))
+	}
 
 	var interfaces []InterfaceDescription
 
 	for i, link := range contLinks {
 		hwAddr := link.Attrs().HardwareAddr
 		ifaceName := link.Attrs().Name
+		mtu := link.Attrs().MTU
 		pciAddress := ""
 		var ifaceType InterfaceType
 		var fo *os.File
@@ -799,18 +842,29 @@ func RecreateContainerSideNetwork(info *cnicurrent.Result, nsPath string, allLin
 				return nil, err
 			}
 
-			fo, err = openVfConfigFile(pciAddress)
-			if err != nil {
+			if files != nil {
+				fo = files[i]
+			} else if fo, err = openVfConfigFile(pciAddress); err != nil {
 				return nil, err
 			}
 
 			// device should be already unbound, but after machine reboot that can be necessary
 			_ = unbindDriverFromDevice(pciAddress)
 		} else {
+			// The link got a random MAC address during the initial
+			// setup, while the original one was passed to the VM.
+			// The VM must keep its address after the restart, so
+			// it's taken from CNI result instead of the link.
+			hwAddr, err = originalHardwareAddr(info.Interfaces, ifaceName)
+			if err != nil {
+				return nil, err
+			}
+
 			ifaceType = InterfaceTypeTap
 			tapInterfaceName := fmt.Sprintf(tapInterfaceNameTemplate, i)
-			fo, err = OpenTAP(tapInterfaceName)
-			if err != nil {
+			if files != nil {
+				fo = files[i]
+			} else if fo, err = OpenTAP(tapInterfaceName); err != nil {
 				return nil, fmt.Errorf("failed to open tap: %v", err)
 			}
 		}
@@ -820,12 +874,52 @@ func RecreateContainerSideNetwork(info *cnicurrent.Result, nsPath string, allLin
 			Fo:           fo,
 			HardwareAddr: hwAddr,
 			PCIAddress:   pciAddress,
+			MTU:          uint16(mtu),
 		})
 	}
 
 	return &ContainerSideNetwork{info, nsPath, interfaces}, nil
 }
 
+// PinHardwareAddr sets the hardware address of the first interface
+// in the container network namespace, so that it's passed to the VM
+// instead of the address assigned by CNI. It also updates CNI result
+// accordingly. The function should be called from within container
+// namespace before SetupContainerSideNetwork()
+func PinHardwareAddr(info *cnicurrent.Result, hwAddr net.HardwareAddr) error {
+	for _, iface := range info.Interfaces {
+		if iface.Sandbox == "" {
+			continue
+		}
+		link, err := netlink.LinkByName(iface.Name)
+		if err != nil {
+			return err
+		}
+		if err := SetHardwareAddr(link, hwAddr); err != nil {
+			return err
+		}
+		iface.Mac = hwAddr.String()
+		return nil
+	}
+	return errors.New("no container interfaces found in CNI result")
+}
+
+// originalHardwareAddr returns the hardware address of the
+// interface with the specified name as it was reported by CNI
+func originalHardwareAddr(interfaces []*cnicurrent.Interface, ifaceName string) (net.HardwareAddr, error) {
+	for _, iface := range interfaces {
+		if iface.Sandbox == "" || iface.Name != ifaceName {
+			continue
+		}
+		hwAddr, err := net.ParseMAC(iface.Mac)
+		if err != nil {
+			return nil, fmt.Errorf("bad hardware address %q for interface %q in CNI result: %v", iface.Mac, ifaceName, err)
+		}
+		return hwAddr, nil
+	}
+	return nil, fmt.Errorf("interface %q not found in CNI result", ifaceName)
+}
+
 // TeardownBridge removes links from bridge and sets it down
 func TeardownBridge(bridge netlink.Link, links []netlink.Link) error {
 	for _, link := range links {
@@ -881,6 +975,20 @@ func ConfigureLink(link netlink.Link, info *cnicurrent.Result) error {
 	return nil
 }
 
+// InterfaceIndexForBridge returns the index of the tap interface
+// that's attached to the container-side bridge with the specified
+// name, or -1 if there's no such bridge
+func (csn *ContainerSideNetwork) InterfaceIndexForBridge(bridgeName string) int {
+	var i int
+	if _, err := fmt.Sscanf(bridgeName, containerBridgeNameTemplate, &i); err != nil || fmt.Sprintf(containerBridgeNameTemplate, i) != bridgeName {
+		return -1
+	}
+	if i < 0 || i >= len(csn.Interfaces) || csn.Interfaces[i].Type != InterfaceTypeTap {
+		return -1
+	}
+	return i
+}
+
 // Teardown cleans up container network configuration.
 // It does so by invoking teardown sequence which removes ebtables rules, links
 // and addresses in an order opposite to that of their creation in SetupContainerSideNetwork.
@@ -897,58 +1005,84 @@ func (csn *ContainerSideNetwork) Teardown() error {
 	}
 
 	for i, contLink := range contLinks {
+		if err := csn.teardownInterface(i, contLink); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// teardownInterface undoes the changes made by setupInterface()
+// for the interface with the specified index except for closing
+// its file. The function should be called from within container
+// namespace.
+func (csn *ContainerSideNetwork) teardownInterface(i int, contLink netlink.Link) error {
+	redirected := !isSriovVf(contLink) && attachmentForLink(contLink) == attachViaRedirect
+	if redirected {
+		if err := teardownRedirect(csn.NsPath, contLink); err != nil {
+			return err
+		}
+		tapInterfaceName := fmt.Sprintf(tapInterfaceNameTemplate, i)
+		tap, err := netlink.LinkByName(tapInterfaceName)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkDel(tap); err != nil {
+			return err
+		}
+	} else {
 		// Remove ebtables DHCP rules
 		if err := updateEbTables(csn.NsPath, contLink.Attrs().Name, "-D"); err != nil {
 			return nil
 		}
+	}
 
-		if !isSriovVf(contLink) {
-			tapInterfaceName := fmt.Sprintf(tapInterfaceNameTemplate, i)
-			tap, err := netlink.LinkByName(tapInterfaceName)
-			if err != nil {
-				return err
-			}
-
-			containerBridgeName := fmt.Sprintf(containerBridgeNameTemplate, i)
-			br, err := netlink.LinkByName(containerBridgeName)
-			if err != nil {
-				return err
-			}
-
-			if err := netlink.AddrDel(br, mustParseAddr(internalDhcpAddr)); err != nil {
-				return err
-			}
+	if !isSriovVf(contLink) && !redirected {
+		tapInterfaceName := fmt.Sprintf(tapInterfaceNameTemplate, i)
+		tap, err := netlink.LinkByName(tapInterfaceName)
+		if err != nil {
+			return err
+		}
 
-			if err := TeardownBridge(br, []netlink.Link{contLink, tap}); err != nil {
-				return err
-			}
+		containerBridgeName := fmt.Sprintf(containerBridgeNameTemplate, i)
+		br, err := netlink.LinkByName(containerBridgeName)
+		if err != nil {
+			return err
+		}
 
-			if err := netlink.LinkDel(br); err != nil {
-				return err
-			}
+		if err := netlink.AddrDel(br, mustParseAddr(internalDhcpAddr)); err != nil {
+			return err
+		}
 
-			if err := netlink.LinkSetDown(tap); err != nil {
-				return err
-			}
+		if err := TeardownBridge(br, []netlink.Link{contLink, tap}); err != nil {
+			return err
+		}
 
-			if err := netlink.LinkDel(tap); err != nil {
-				return err
-			}
+		if err := netlink.LinkDel(br); err != nil {
+			return err
+		}
 
-			if err := SetHardwareAddr(contLink, csn.Interfaces[i].HardwareAddr); err != nil {
-				return err
-			}
+		if err := netlink.LinkSetDown(tap); err != nil {
+			return err
 		}
 
-		rereadLink, err := netlink.LinkByName(contLink.Attrs().Name)
-		if err != nil {
+		if err := netlink.LinkDel(tap); err != nil {
 			return err
 		}
-		if err := ConfigureLink(rereadLink, csn.Result); err != nil {
+
+		if err := SetHardwareAddr(contLink, csn.Interfaces[i].HardwareAddr); err != nil {
 			return err
 		}
 	}
 
+	rereadLink, err := netlink.LinkByName(contLink.Attrs().Name)
+	if err != nil {
+		return err
+	}
+	if err := ConfigureLink(rereadLink, csn.Result); err != nil {
+		return err
+	}
 	return nil
 }
 
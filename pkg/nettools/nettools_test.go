@@ -22,6 +22,7 @@ import (
 	"net"
 	"os/exec"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/containernetworking/cni/pkg/ns"
@@ -449,6 +450,32 @@ func TestSetUpContainerSideNetworkWithInfo(t *testing.T) {
 	})
 }
 
+func TestInterfaceIndexForBridge(t *testing.T) {
+	csn := &ContainerSideNetwork{
+		Interfaces: []InterfaceDescription{
+			{Type: InterfaceTypeTap},
+			{Type: InterfaceTypeVF},
+			{Type: InterfaceTypeTap},
+		},
+	}
+	for _, tc := range []struct {
+		bridgeName string
+		index      int
+	}{
+		{"br0", 0},
+		{"br1", -1},
+		{"br2", 2},
+		{"br3", -1},
+		{"br02", -1},
+		{"br2x", -1},
+		{"eth0", -1},
+	} {
+		if i := csn.InterfaceIndexForBridge(tc.bridgeName); i != tc.index {
+			t.Errorf("InterfaceIndexForBridge(%q): expected %d, got %d", tc.bridgeName, tc.index, i)
+		}
+	}
+}
+
 func TestLoopbackInterface(t *testing.T) {
 	withFakeCNIVethAndGateway(t, func(hostNS, contNS ns.NetNS, origHostVeth, origContVeth netlink.Link) {
 		verifyContainerSideNetwork(t, origContVeth, contNS.Path())
@@ -558,6 +585,171 @@ func TestTeardownContainerSideNetwork(t *testing.T) {
 	})
 }
 
+func TestRecreateContainerSideNetwork(t *testing.T) {
+	withFakeCNIVethAndGateway(t, func(hostNS, contNS ns.NetNS, origHostVeth, origContVeth netlink.Link) {
+		if err := StripLink(origContVeth); err != nil {
+			log.Panicf("StripLink() failed: %v", err)
+		}
+		allLinks, err := netlink.LinkList()
+		if err != nil {
+			log.Panicf("error listing links: %v", err)
+		}
+
+		csn, err := SetupContainerSideNetwork(expectedExtractedLinkInfo(contNS.Path()), contNS.Path(), allLinks)
+		if err != nil {
+			log.Panicf("failed to set up container side network: %v", err)
+		}
+		defer csn.Interfaces[0].Fo.Close()
+
+		allLinks, err = netlink.LinkList()
+		if err != nil {
+			log.Panicf("error listing links: %v", err)
+		}
+		recreated, err := RecreateContainerSideNetwork(expectedExtractedLinkInfo(contNS.Path()), contNS.Path(), allLinks, nil)
+		if err != nil {
+			log.Panicf("failed to recreate container side network: %v", err)
+		}
+		defer recreated.Interfaces[0].Fo.Close()
+
+		if len(recreated.Interfaces) != 1 {
+			log.Panicf("bad interface count in the recreated container side network: %d", len(recreated.Interfaces))
+		}
+		if !reflect.DeepEqual(recreated.Interfaces[0].HardwareAddr, csn.Interfaces[0].HardwareAddr) {
+			t.Errorf("hardware address changed after recreating container side network: %v instead of %v", recreated.Interfaces[0].HardwareAddr, csn.Interfaces[0].HardwareAddr)
+		}
+		if recreated.Interfaces[0].MTU != csn.Interfaces[0].MTU {
+			t.Errorf("MTU changed after recreating container side network: %d instead of %d", recreated.Interfaces[0].MTU, csn.Interfaces[0].MTU)
+		}
+	})
+}
+
+// withFakeCNILinkOnDummy creates a link of the specified kind named
+// eth0 inside the container namespace, using a dummy link as its
+// master, and then invokes toRun() in the container namespace
+func withFakeCNILinkOnDummy(t *testing.T, kind string, toRun func(contNS ns.NetNS, link netlink.Link)) {
+	withTempNetNS(t, func(contNS ns.NetNS) {
+		inNS(contNS, "contNS", func() {
+			if err := netlink.LinkAdd(&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "dummy0"}}); err != nil {
+				log.Panicf("failed to create dummy link: %v", err)
+			}
+			master, err := netlink.LinkByName("dummy0")
+			if err != nil {
+				log.Panicf("can't locate dummy link: %v", err)
+			}
+			// ipvlan links share the MAC address of their master
+			master = setupLink(innerHwAddr, master)
+
+			attrs := netlink.LinkAttrs{Name: "eth0", ParentIndex: master.Attrs().Index}
+			var link netlink.Link
+			switch kind {
+			case "macvlan":
+				link = &netlink.Macvlan{LinkAttrs: attrs, Mode: netlink.MACVLAN_MODE_BRIDGE}
+			case "ipvlan":
+				link = &netlink.IPVlan{LinkAttrs: attrs, Mode: netlink.IPVLAN_MODE_L2}
+			default:
+				log.Panicf("bad link kind %q", kind)
+			}
+			if err := netlink.LinkAdd(link); err != nil {
+				log.Panicf("failed to create %s link: %v", kind, err)
+			}
+			link, err = netlink.LinkByName("eth0")
+			if err != nil {
+				log.Panicf("can't locate %s link: %v", kind, err)
+			}
+			if kind == "macvlan" {
+				link = setupLink(innerHwAddr, link)
+			} else if err := netlink.LinkSetUp(link); err != nil {
+				log.Panicf("failed to bring up %s link: %v", kind, err)
+			}
+			if err = netlink.AddrAdd(link, parseAddr("10.1.90.5/24")); err != nil {
+				log.Panicf("failed to add addr for %s link: %v", kind, err)
+			}
+			addTestRoute(t, &netlink.Route{
+				Gw:    parseAddr("10.1.90.1/24").IPNet.IP,
+				Scope: SCOPE_UNIVERSE,
+			})
+
+			toRun(contNS, link)
+		})
+	})
+}
+
+func tcOutput(t *testing.T, nsPath string, args ...string) string {
+	out, err := exec.Command("nsenter", append([]string{"--net=" + nsPath, "tc"}, args...)...).CombinedOutput()
+	if err != nil {
+		log.Panicf("tc %v failed: %v\nOut:\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+func verifyRedirectedContainerSideNetwork(t *testing.T, kind string) {
+	withFakeCNILinkOnDummy(t, kind, func(contNS ns.NetNS, link netlink.Link) {
+		allLinks, err := netlink.LinkList()
+		if err != nil {
+			log.Panicf("error listing links: %v", err)
+		}
+
+		csn, err := SetupContainerSideNetwork(expectedExtractedLinkInfo(contNS.Path()), contNS.Path(), allLinks)
+		if err != nil {
+			log.Panicf("failed to set up container side network: %v", err)
+		}
+		if csn.Interfaces[0].HardwareAddr.String() != innerHwAddr {
+			t.Errorf("bad hwaddr returned from SetupContainerSideNetwork: %v instead of %v", csn.Interfaces[0].HardwareAddr, innerHwAddr)
+		}
+
+		link, err = netlink.LinkByName("eth0")
+		if err != nil {
+			log.Panicf("the original %s link is gone", kind)
+		}
+		if link.Attrs().HardwareAddr.String() != innerHwAddr {
+			t.Errorf("%s link hardware address has changed", kind)
+		}
+		verifyNoAddressAndRoutes(t, link)
+		verifyNoLink(t, "br0", "in-container bridge")
+
+		tap := verifyLinkUp(t, "tap0", "tap0")
+		addrs, err := netlink.AddrList(tap, FAMILY_V4)
+		if err != nil {
+			log.Panicf("failed to get addresses for tap0: %v", err)
+		}
+		if len(addrs) != 1 || addrs[0].IPNet.String() != internalDhcpAddr {
+			t.Errorf("bad tap0 addresses: %s", spew.Sdump(addrs))
+		}
+		for _, ifName := range []string{"eth0", "tap0"} {
+			if out := tcOutput(t, contNS.Path(), "filter", "show", "dev", ifName, "parent", "ffff:"); !strings.Contains(out, "mirred") {
+				t.Errorf("no redirection set up for %s:\n%s", ifName, out)
+			}
+		}
+
+		if err := csn.Teardown(); err != nil {
+			log.Panicf("failed to tear down container side network: %v", err)
+		}
+		verifyNoLink(t, "tap0", "tap0")
+		if out := tcOutput(t, contNS.Path(), "qdisc", "show", "dev", "eth0"); strings.Contains(out, "ingress") {
+			t.Errorf("ingress qdisc wasn't removed from eth0:\n%s", out)
+		}
+		link, err = netlink.LinkByName("eth0")
+		if err != nil {
+			log.Panicf("the original %s link is gone", kind)
+		}
+		addrList, err := netlink.AddrList(link, FAMILY_V4)
+		if err != nil {
+			log.Panicf("AddrList() failed: %v", err)
+		}
+		if len(addrList) != 1 || addrList[0].IPNet.String() != "10.1.90.5/24" {
+			t.Errorf("%s link address wasn't restored: %s", kind, spew.Sdump(addrList))
+		}
+	})
+}
+
+func TestMacvlanContainerSideNetwork(t *testing.T) {
+	verifyRedirectedContainerSideNetwork(t, "macvlan")
+}
+
+func TestIpvlanContainerSideNetwork(t *testing.T) {
+	verifyRedirectedContainerSideNetwork(t, "ipvlan")
+}
+
 func TestFindingLinkByAddress(t *testing.T) {
 	withFakeCNIVeth(t, func(hostNS, contNS ns.NetNS, origHostVeth, origContVeth netlink.Link) {
 		expectedInfo := expectedExtractedLinkInfo(contNS.Path())
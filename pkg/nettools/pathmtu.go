@@ -0,0 +1,298 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	ipv4HeaderLen    = 20
+	icmpHeaderLen    = 8
+	icmpEchoReply    = 0
+	icmpUnreachable  = 3
+	icmpFragNeeded   = 4
+	icmpEchoRequest  = 8
+	ipv4ProtocolICMP = 1
+	minProbeMTU      = 576
+	maxPathMTUProbes = 16
+	pathMTUProbeID   = 0x7674
+)
+
+// PathMTUReport describes the result of probing the path MTU
+// between the pod network namespace and the gateway of an interface
+type PathMTUReport struct {
+	// Interface is the index of the interface in the CNI result
+	Interface int `json:"interface"`
+	// Gateway is the address of the gateway that was probed
+	Gateway string `json:"gateway"`
+	// MTU is the MTU of the interface
+	MTU int `json:"mtu"`
+	// PathMTU is the largest packet size that reached the gateway
+	// without fragmentation, 0 if no probes got through
+	PathMTU int `json:"pathMTU"`
+	// TooBigFrom is the address of the host that reported
+	// that a probe was too big, if any
+	TooBigFrom string `json:"tooBigFrom,omitempty"`
+}
+
+// Exceeded returns true if the interface MTU is known to exceed
+// the path MTU. It returns false if the gateway doesn't respond
+// to the probes, as the path MTU can't be determined in this case
+func (r *PathMTUReport) Exceeded() bool {
+	return r.PathMTU != 0 && r.PathMTU < r.MTU
+}
+
+func (r *PathMTUReport) String() string {
+	var s string
+	switch {
+	case r.PathMTU == 0:
+		s = fmt.Sprintf("interface %d: gateway %s doesn't respond to %d byte probes, path MTU is unknown", r.Interface, r.Gateway, minProbeMTU)
+	case r.Exceeded():
+		s = fmt.Sprintf("interface %d: MTU %d exceeds path MTU %d to gateway %s", r.Interface, r.MTU, r.PathMTU, r.Gateway)
+	default:
+		return fmt.Sprintf("interface %d: MTU %d works up to gateway %s", r.Interface, r.MTU, r.Gateway)
+	}
+	if r.TooBigFrom != "" {
+		s += fmt.Sprintf(" (packets are too big for %s)", r.TooBigFrom)
+	}
+	return s
+}
+
+// probeResult describes the outcome of a single probe
+type probeResult struct {
+	// ok is true if an echo reply was received
+	ok bool
+	// tooBig is true if the probe couldn't be sent as it
+	// exceeds the local MTU, or ICMP "fragmentation needed"
+	// error was received
+	tooBig bool
+	// nextHopMTU is the MTU reported in ICMP "fragmentation
+	// needed" error, 0 if unknown
+	nextHopMTU int
+	// from is the address of the host that sent ICMP
+	// "fragmentation needed" error, nil if the probe was
+	// rejected locally
+	from net.IP
+}
+
+// probeFunc sends a do-not-fragment probe of the specified size
+type probeFunc func(size int) (probeResult, error)
+
+func internetChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i : i+2]))
+	}
+	if len(b)%2 != 0 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// icmpEchoRequestPacket returns ICMP echo request which makes
+// an IPv4 packet of the specified size
+func icmpEchoRequestPacket(id, seq uint16, size int) []byte {
+	msg := make([]byte, size-ipv4HeaderLen)
+	msg[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	for i := icmpHeaderLen; i < len(msg); i++ {
+		msg[i] = byte(i)
+	}
+	binary.BigEndian.PutUint16(msg[2:4], internetChecksum(msg))
+	return msg
+}
+
+// parseProbeReply parses an IPv4 packet received on a raw ICMP socket.
+// It returns the probe result and true if the packet is a reply to
+// the probe identified by id and seq that was sent to dst
+func parseProbeReply(packet []byte, dst net.IP, id, seq uint16) (probeResult, bool) {
+	if len(packet) < ipv4HeaderLen || packet[0]>>4 != 4 {
+		return probeResult{}, false
+	}
+	ihl := int(packet[0]&0xf) * 4
+	if len(packet) < ihl+icmpHeaderLen {
+		return probeResult{}, false
+	}
+	from := net.IP(packet[12:16])
+	msg := packet[ihl:]
+	switch msg[0] {
+	case icmpEchoReply:
+		if !from.Equal(dst) || binary.BigEndian.Uint16(msg[4:6]) != id || binary.BigEndian.Uint16(msg[6:8]) != seq {
+			return probeResult{}, false
+		}
+		return probeResult{ok: true}, true
+	case icmpUnreachable:
+		if msg[1] != icmpFragNeeded {
+			return probeResult{}, false
+		}
+		// the error contains the IP header of the original
+		// packet followed by the first 8 bytes of its payload
+		orig := msg[icmpHeaderLen:]
+		if len(orig) < ipv4HeaderLen || orig[0]>>4 != 4 {
+			return probeResult{}, false
+		}
+		origIHL := int(orig[0]&0xf) * 4
+		if len(orig) < origIHL+icmpHeaderLen || orig[9] != ipv4ProtocolICMP || !net.IP(orig[16:20]).Equal(dst) {
+			return probeResult{}, false
+		}
+		origMsg := orig[origIHL:]
+		if origMsg[0] != icmpEchoRequest || binary.BigEndian.Uint16(origMsg[4:6]) != id || binary.BigEndian.Uint16(origMsg[6:8]) != seq {
+			return probeResult{}, false
+		}
+		return probeResult{
+			tooBig:     true,
+			nextHopMTU: int(binary.BigEndian.Uint16(msg[6:8])),
+			from:       append(net.IP(nil), from...),
+		}, true
+	default:
+		return probeResult{}, false
+	}
+}
+
+// findPathMTU finds the largest working probe size between
+// minProbeMTU and mtu. It returns the path MTU, which is 0 if
+// even the smallest probe doesn't get through, and the address
+// of the host which reported a probe as too big, if any
+func findPathMTU(mtu int, probe probeFunc) (int, net.IP, error) {
+	var tooBigFrom net.IP
+	try := func(size int) (probeResult, error) {
+		r, err := probe(size)
+		if err == nil && r.from != nil && tooBigFrom == nil {
+			tooBigFrom = r.from
+		}
+		return r, err
+	}
+
+	r, err := try(mtu)
+	switch {
+	case err != nil:
+		return 0, nil, err
+	case r.ok:
+		return mtu, nil, nil
+	}
+
+	// binary search between the largest size known to work
+	// and the smallest one known to fail
+	lo, hi := minProbeMTU-1, mtu
+	if nextHopMTU := r.nextHopMTU; r.tooBig && nextHopMTU >= minProbeMTU && nextHopMTU < mtu {
+		// try the reported next hop MTU first
+		r, err := try(nextHopMTU)
+		switch {
+		case err != nil:
+			return 0, nil, err
+		case r.ok:
+			// the packets that are larger than the next hop
+			// MTU are known to fail
+			return nextHopMTU, tooBigFrom, nil
+		default:
+			hi = nextHopMTU
+		}
+	}
+	if lo < minProbeMTU {
+		// don't waste time on the search if the gateway
+		// doesn't respond to the probes at all
+		r, err := try(minProbeMTU)
+		switch {
+		case err != nil:
+			return 0, nil, err
+		case !r.ok:
+			return 0, tooBigFrom, nil
+		}
+		lo = minProbeMTU
+	}
+	for n := 0; hi-lo > 1 && n < maxPathMTUProbes; n++ {
+		size := (lo + hi) / 2
+		r, err := try(size)
+		if err != nil {
+			return 0, nil, err
+		}
+		if r.ok {
+			lo = size
+		} else {
+			hi = size
+		}
+	}
+	return lo, tooBigFrom, nil
+}
+
+// CheckPathMTU probes the path MTU between the pod network namespace
+// and the gateway of each container interface in the CNI result that
+// has an IPv4 gateway, using the probes of the interface MTU size.
+// The interfaces without a gateway are skipped. The function should
+// be called from within container namespace before the addresses
+// are removed from the interfaces by SetupContainerSideNetwork()
+func CheckPathMTU(info *cnicurrent.Result, allLinks []netlink.Link, timeout time.Duration) ([]PathMTUReport, error) {
+	var reports []PathMTUReport
+	seq := uint16(0)
+	for i, iface := range info.Interfaces {
+		if iface.Sandbox == "" {
+			continue
+		}
+		var gw net.IP
+		for _, ipConfig := range info.IPs {
+			if ipConfig.Interface == i && ipConfig.Gateway != nil && ipConfig.Gateway.To4() != nil && !ipConfig.Gateway.IsUnspecified() {
+				gw = ipConfig.Gateway.To4()
+				break
+			}
+		}
+		if gw == nil {
+			continue
+		}
+		var link netlink.Link
+		for _, l := range allLinks {
+			if l.Attrs().Name == iface.Name {
+				link = l
+				break
+			}
+		}
+		if link == nil {
+			return nil, fmt.Errorf("interface %q not found", iface.Name)
+		}
+		mtu := link.Attrs().MTU
+		pathMTU, tooBigFrom, err := findPathMTU(mtu, func(size int) (probeResult, error) {
+			seq++
+			return sendPathMTUProbe(gw, pathMTUProbeID, seq, size, timeout)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error probing path MTU to %s: %v", gw, err)
+		}
+		r := PathMTUReport{
+			Interface: i,
+			Gateway:   gw.String(),
+			MTU:       mtu,
+			PathMTU:   pathMTU,
+		}
+		if tooBigFrom != nil {
+			r.TooBigFrom = tooBigFrom.String()
+		}
+		glog.V(3).Infof("Path MTU check: %s", r.String())
+		reports = append(reports, r)
+	}
+	return reports, nil
+}
@@ -0,0 +1,73 @@
+// +build linux
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// sendPathMTUProbe sends ICMP echo request of the specified size
+// with DF bit set to dst and waits for either echo reply or
+// ICMP "fragmentation needed" error until the timeout expires
+func sendPathMTUProbe(dst net.IP, id, seq uint16, size int, timeout time.Duration) (probeResult, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
+	if err != nil {
+		return probeResult{}, err
+	}
+	defer syscall.Close(fd)
+	// IP_PMTUDISC_PROBE sets DF bit but makes the kernel ignore
+	// the cached path MTU, so each probe actually hits the wire
+	if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE); err != nil {
+		return probeResult{}, err
+	}
+	addr := &syscall.SockaddrInet4{}
+	copy(addr.Addr[:], dst.To4())
+	if err := syscall.Sendto(fd, icmpEchoRequestPacket(id, seq, size), 0, addr); err != nil {
+		if err == syscall.EMSGSIZE {
+			// the probe exceeds the MTU of the outgoing interface
+			return probeResult{tooBig: true}, nil
+		}
+		return probeResult{}, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 65536)
+	for {
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return probeResult{}, nil
+		}
+		tv := syscall.NsecToTimeval(remaining.Nanoseconds())
+		if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+			return probeResult{}, err
+		}
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		switch {
+		case err == syscall.EAGAIN || err == syscall.EINTR:
+			continue
+		case err != nil:
+			return probeResult{}, err
+		}
+		if r, ok := parseProbeReply(buf[:n], dst, id, seq); ok {
+			return r, nil
+		}
+	}
+}
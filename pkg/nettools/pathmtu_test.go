@@ -0,0 +1,235 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func ipv4Packet(src, dst net.IP, payload []byte) []byte {
+	packet := make([]byte, ipv4HeaderLen+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	packet[8] = 64
+	packet[9] = ipv4ProtocolICMP
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:12], internetChecksum(packet[:ipv4HeaderLen]))
+	copy(packet[ipv4HeaderLen:], payload)
+	return packet
+}
+
+func TestICMPEchoRequestPacket(t *testing.T) {
+	msg := icmpEchoRequestPacket(0x1234, 42, 1500)
+	if len(msg) != 1500-ipv4HeaderLen {
+		t.Errorf("bad message length %d", len(msg))
+	}
+	if msg[0] != icmpEchoRequest {
+		t.Errorf("bad message type %d", msg[0])
+	}
+	if id := binary.BigEndian.Uint16(msg[4:6]); id != 0x1234 {
+		t.Errorf("bad id %04x", id)
+	}
+	if seq := binary.BigEndian.Uint16(msg[6:8]); seq != 42 {
+		t.Errorf("bad seq %d", seq)
+	}
+	if sum := internetChecksum(msg); sum != 0 {
+		t.Errorf("bad checksum: %04x", sum)
+	}
+}
+
+func TestParseProbeReply(t *testing.T) {
+	local := net.IPv4(10, 1, 90, 5)
+	gw := net.IPv4(10, 1, 90, 1)
+	router := net.IPv4(192, 168, 0, 1)
+	echoReply := func(id, seq uint16) []byte {
+		msg := icmpEchoRequestPacket(id, seq, 100)
+		msg[0] = icmpEchoReply
+		return msg
+	}
+	fragNeeded := func(code byte, dst net.IP, id, seq uint16, mtu uint16) []byte {
+		orig := ipv4Packet(local, dst, icmpEchoRequestPacket(id, seq, 1500))
+		msg := make([]byte, icmpHeaderLen, icmpHeaderLen+ipv4HeaderLen+icmpHeaderLen)
+		msg[0] = icmpUnreachable
+		msg[1] = code
+		binary.BigEndian.PutUint16(msg[6:8], mtu)
+		return append(msg, orig[:ipv4HeaderLen+icmpHeaderLen]...)
+	}
+	for _, tc := range []struct {
+		name     string
+		packet   []byte
+		expected *probeResult
+	}{
+		{
+			name:     "echo reply",
+			packet:   ipv4Packet(gw, local, echoReply(pathMTUProbeID, 3)),
+			expected: &probeResult{ok: true},
+		},
+		{
+			name:   "echo reply with another seq",
+			packet: ipv4Packet(gw, local, echoReply(pathMTUProbeID, 2)),
+		},
+		{
+			name:   "echo reply with another id",
+			packet: ipv4Packet(gw, local, echoReply(1, 3)),
+		},
+		{
+			name:   "echo reply from another host",
+			packet: ipv4Packet(router, local, echoReply(pathMTUProbeID, 3)),
+		},
+		{
+			name:   "fragmentation needed",
+			packet: ipv4Packet(router, local, fragNeeded(icmpFragNeeded, gw, pathMTUProbeID, 3, 1450)),
+			expected: &probeResult{
+				tooBig:     true,
+				nextHopMTU: 1450,
+				from:       router.To4(),
+			},
+		},
+		{
+			name:   "fragmentation needed for another probe",
+			packet: ipv4Packet(router, local, fragNeeded(icmpFragNeeded, gw, pathMTUProbeID, 4, 1450)),
+		},
+		{
+			name:   "fragmentation needed for another destination",
+			packet: ipv4Packet(router, local, fragNeeded(icmpFragNeeded, router, pathMTUProbeID, 3, 1450)),
+		},
+		{
+			name:   "host unreachable",
+			packet: ipv4Packet(router, local, fragNeeded(1, gw, pathMTUProbeID, 3, 0)),
+		},
+		{
+			name:   "truncated packet",
+			packet: ipv4Packet(gw, local, echoReply(pathMTUProbeID, 3))[:ipv4HeaderLen+4],
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, ok := parseProbeReply(tc.packet, gw, pathMTUProbeID, 3)
+			switch {
+			case tc.expected == nil && ok:
+				t.Errorf("unexpected probe reply: %#v", r)
+			case tc.expected == nil:
+			case !ok:
+				t.Errorf("probe reply not recognized")
+			case r.ok != tc.expected.ok || r.tooBig != tc.expected.tooBig || r.nextHopMTU != tc.expected.nextHopMTU || !r.from.Equal(tc.expected.from):
+				t.Errorf("bad probe result: expected %#v, got %#v", *tc.expected, r)
+			}
+		})
+	}
+}
+
+func TestFindPathMTU(t *testing.T) {
+	router := net.IPv4(192, 168, 0, 1)
+	for _, tc := range []struct {
+		name          string
+		mtu           int
+		pathMTU       int
+		reportMTU     bool
+		expectedMTU   int
+		expectedFrom  net.IP
+		maxProbeCount int
+		silentGateway bool
+		localMTU      int
+	}{
+		{
+			name:          "path MTU matches",
+			mtu:           9000,
+			pathMTU:       9000,
+			expectedMTU:   9000,
+			maxProbeCount: 1,
+		},
+		{
+			name:          "next hop MTU reported",
+			mtu:           9000,
+			pathMTU:       1500,
+			reportMTU:     true,
+			expectedMTU:   1500,
+			expectedFrom:  router,
+			maxProbeCount: 2,
+		},
+		{
+			name:          "silently dropped probes",
+			mtu:           9000,
+			pathMTU:       1450,
+			expectedMTU:   1450,
+			maxProbeCount: 2 + maxPathMTUProbes,
+		},
+		{
+			name:          "local MTU",
+			mtu:           9000,
+			pathMTU:       9000,
+			localMTU:      1500,
+			expectedMTU:   1500,
+			maxProbeCount: 2 + maxPathMTUProbes,
+		},
+		{
+			name:          "gateway doesn't respond",
+			mtu:           1500,
+			silentGateway: true,
+			expectedMTU:   0,
+			maxProbeCount: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			probeCount := 0
+			pathMTU, from, err := findPathMTU(tc.mtu, func(size int) (probeResult, error) {
+				probeCount++
+				switch {
+				case tc.silentGateway:
+					return probeResult{}, nil
+				case tc.localMTU != 0 && size > tc.localMTU:
+					return probeResult{tooBig: true}, nil
+				case size <= tc.pathMTU:
+					return probeResult{ok: true}, nil
+				case tc.reportMTU:
+					return probeResult{tooBig: true, nextHopMTU: tc.pathMTU, from: router}, nil
+				default:
+					return probeResult{}, nil
+				}
+			})
+			if err != nil {
+				t.Fatalf("findPathMTU(): %v", err)
+			}
+			if pathMTU != tc.expectedMTU {
+				t.Errorf("bad path MTU: expected %d, got %d", tc.expectedMTU, pathMTU)
+			}
+			if !from.Equal(tc.expectedFrom) {
+				t.Errorf("bad 'too big' source: expected %v, got %v", tc.expectedFrom, from)
+			}
+			if probeCount > tc.maxProbeCount {
+				t.Errorf("too many probes: %d > %d", probeCount, tc.maxProbeCount)
+			}
+		})
+	}
+}
+
+func TestPathMTUReport(t *testing.T) {
+	for _, tc := range []struct {
+		report   PathMTUReport
+		exceeded bool
+	}{
+		{PathMTUReport{Gateway: "10.1.90.1", MTU: 1500, PathMTU: 1500}, false},
+		{PathMTUReport{Gateway: "10.1.90.1", MTU: 9000, PathMTU: 1500, TooBigFrom: "192.168.0.1"}, true},
+		{PathMTUReport{Gateway: "10.1.90.1", MTU: 9000}, false},
+	} {
+		if tc.report.Exceeded() != tc.exceeded {
+			t.Errorf("%s: expected Exceeded() to return %v", tc.report.String(), tc.exceeded)
+		}
+	}
+}
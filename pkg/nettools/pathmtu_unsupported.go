@@ -0,0 +1,31 @@
+// +build !linux
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// sendPathMTUProbe sends ICMP echo request of the specified size
+// with DF bit set to dst and waits for the reply
+func sendPathMTUProbe(dst net.IP, id, seq uint16, size int, timeout time.Duration) (probeResult, error) {
+	return probeResult{}, errors.New("not implemented")
+}
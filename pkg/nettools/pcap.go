@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+const (
+	// CaptureTap denotes the tap device the VM interface uses
+	CaptureTap = "tap"
+	// CaptureLink denotes the CNI-provided link (e.g. veth)
+	// the VM interface is connected to
+	CaptureLink = "link"
+)
+
+// CaptureInterfaceName returns the name of the interface inside the
+// container network namespace which can be used to capture the
+// traffic of the VM network interface with the specified index.
+// side must be either CaptureTap or CaptureLink.
+func (csn *ContainerSideNetwork) CaptureInterfaceName(index int, side string) (string, error) {
+	if index < 0 || index >= len(csn.Interfaces) {
+		return "", fmt.Errorf("bad interface index %d (the VM has %d interface(s))", index, len(csn.Interfaces))
+	}
+	if csn.Interfaces[index].Type != InterfaceTypeTap {
+		return "", fmt.Errorf("interface %d is not a tap interface", index)
+	}
+	switch side {
+	case CaptureTap:
+		return fmt.Sprintf(tapInterfaceNameTemplate, index), nil
+	case CaptureLink:
+		n := 0
+		for _, iface := range csn.Result.Interfaces {
+			// skip host side interfaces, see GetContainerLinks()
+			if iface.Sandbox == "" {
+				continue
+			}
+			if n == index {
+				return iface.Name, nil
+			}
+			n++
+		}
+		return "", fmt.Errorf("CNI result has no container interface with index %d", index)
+	default:
+		return "", fmt.Errorf("bad capture side %q", side)
+	}
+}
+
+// RunCapture runs tcpdump on the specified interface inside the
+// network namespace, writing the packets in pcap format to w
+// until ctx is done. filter is an optional pcap filter expression.
+func RunCapture(ctx context.Context, nsPath, ifName, filter string, w io.Writer) error {
+	args := []string{"--net=" + nsPath, "tcpdump", "-i", ifName, "-n", "-s", "0", "-U", "-w", "-"}
+	if filter != "" {
+		args = append(args, filter)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "nsenter", args...)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("[netns %q] tcpdump on %q failed: %v\nOut:\n%s", nsPath, ifName, err, stderr.Bytes())
+	}
+	return nil
+}
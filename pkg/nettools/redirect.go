@@ -0,0 +1,106 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nettools
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// linkAttachment denotes the way the tap interface is connected
+// to the CNI-provided link
+type linkAttachment int
+
+const (
+	// attachViaBridge means that the tap and the CNI-provided link
+	// are joined using a bridge. This requires the link to be able
+	// to send and receive frames with VM's MAC address, which is
+	// the case for veths
+	attachViaBridge linkAttachment = iota
+	// attachViaRedirect means that the frames are passed between
+	// the tap and the CNI-provided link as is using tc mirred
+	// action. It's used for macvlan and ipvlan links which are
+	// tied to their own MAC address (macvlan only receives frames
+	// destined to its address, ipvlan shares the address of its
+	// master device), so the VM is given the link's MAC address
+	// which the link keeps.
+	attachViaRedirect
+)
+
+func attachmentForLink(link netlink.Link) linkAttachment {
+	switch link.Type() {
+	case "macvlan", "macvtap", "ipvlan":
+		return attachViaRedirect
+	default:
+		return attachViaBridge
+	}
+}
+
+func runTC(nsPath string, args ...string) error {
+	if out, err := exec.Command("nsenter", append([]string{"--net=" + nsPath, "tc"}, args...)...).CombinedOutput(); err != nil {
+		return fmt.Errorf("[netns %q] tc %s failed: %v\nOut:\n%s", nsPath, strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// setupRedirect makes the frames coming from the link go to the tap
+// and vice versa, except for DHCP requests and traffic destined to
+// internal DHCP server address which is handled by the tap itself.
+func setupRedirect(nsPath string, link, tap netlink.Link) error {
+	linkName := link.Attrs().Name
+	tapName := tap.Attrs().Name
+
+	if err := netlink.AddrAdd(tap, mustParseAddr(internalDhcpAddr)); err != nil {
+		return fmt.Errorf("failed to set address for the tap: %v", err)
+	}
+
+	internalIP := mustParseAddr(internalDhcpAddr).IP.To4()
+	internalIPHex := fmt.Sprintf("0x%02x%02x%02x%02x", internalIP[0], internalIP[1], internalIP[2], internalIP[3])
+
+	for _, args := range [][]string{
+		{"qdisc", "add", "dev", linkName, "ingress"},
+		{"filter", "add", "dev", linkName, "parent", "ffff:", "prio", "1", "protocol", "all",
+			"u32", "match", "u8", "0", "0", "action", "mirred", "egress", "redirect", "dev", tapName},
+		{"qdisc", "add", "dev", tapName, "ingress"},
+		// traffic for the internal DHCP server address (e.g. renewals)
+		{"filter", "add", "dev", tapName, "parent", "ffff:", "prio", "1", "protocol", "ip",
+			"u32", "match", "ip", "dst", internalIP.String() + "/32", "action", "ok"},
+		// broadcast DHCP requests
+		{"filter", "add", "dev", tapName, "parent", "ffff:", "prio", "2", "protocol", "ip",
+			"u32", "match", "ip", "protocol", "17", "0xff", "match", "ip", "dport", "67", "0xffff", "action", "ok"},
+		// ARP requests for the internal DHCP server address
+		// (target protocol address is at offset 24 in ARP packet)
+		{"filter", "add", "dev", tapName, "parent", "ffff:", "prio", "3", "protocol", "arp",
+			"u32", "match", "u32", internalIPHex, "0xffffffff", "at", "24", "action", "ok"},
+		{"filter", "add", "dev", tapName, "parent", "ffff:", "prio", "4", "protocol", "all",
+			"u32", "match", "u8", "0", "0", "action", "mirred", "egress", "redirect", "dev", linkName},
+	} {
+		if err := runTC(nsPath, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownRedirect removes the redirection set up by setupRedirect()
+// from the link. The tap is expected to be removed afterwards
+func teardownRedirect(nsPath string, link netlink.Link) error {
+	return runTC(nsPath, "qdisc", "del", "dev", link.Attrs().Name, "ingress")
+}
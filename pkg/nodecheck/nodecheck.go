@@ -0,0 +1,240 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodecheck
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+)
+
+const (
+	// MinLibvirtVersion is the oldest supported libvirt version
+	// in major * 1000000 + minor * 1000 + release notation
+	MinLibvirtVersion = 1003001
+	// DefaultMinFreeImageSpace is the default minimum amount of
+	// free space in the image store
+	DefaultMinFreeImageSpace = 1 << 30
+)
+
+// Config specifies the node check settings
+type Config struct {
+	// CNIPluginsDir is the directory with CNI plugin binaries
+	CNIPluginsDir string
+	// CNIConfigsDir is the directory with CNI configuration files
+	CNIConfigsDir string
+	// ImageDir is the directory of the image store
+	ImageDir string
+	// MinFreeImageSpace is the minimum amount of free space
+	// in bytes in the image store
+	MinFreeImageSpace uint64
+	// SkipKVM disables the check of KVM availability, which is
+	// needed when KVM is disabled explicitly
+	SkipKVM bool
+	// LibvirtVersion returns the libvirt version. nil value
+	// disables the libvirt version check
+	LibvirtVersion func() (uint32, error)
+	// DevDir is the location of /dev. Can be overridden in tests
+	DevDir string
+	// SysDir is the location of /sys. Can be overridden in tests
+	SysDir string
+}
+
+// Problem describes a failed check
+type Problem struct {
+	// Check is the name of the check
+	Check string
+	// Message describes the problem
+	Message string
+	// Hint suggests a way to fix the problem
+	Hint string
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%s: %s", p.Check, p.Message)
+	if p.Hint != "" {
+		s += " (" + p.Hint + ")"
+	}
+	return s
+}
+
+// Run checks that the node satisfies the Virtlet prerequisites and
+// returns the list of the problems found
+func Run(config Config) []Problem {
+	if config.DevDir == "" {
+		config.DevDir = "/dev"
+	}
+	if config.SysDir == "" {
+		config.SysDir = "/sys"
+	}
+	var problems []Problem
+	for _, check := range []func(Config) []Problem{
+		checkKVM,
+		checkLibvirt,
+		checkCNI,
+		checkKernelModules,
+		checkCgroups,
+		checkImageStore,
+	} {
+		problems = append(problems, check(config)...)
+	}
+	return problems
+}
+
+func checkKVM(config Config) []Problem {
+	if config.SkipKVM {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(config.DevDir, "kvm"), os.O_RDWR, 0)
+	if err != nil {
+		return []Problem{{
+			Check:   "kvm",
+			Message: fmt.Sprintf("KVM is not available: %v", err),
+			Hint:    "enable hardware virtualization in BIOS and load kvm_intel or kvm_amd module, or set disable_kvm in virtlet-config ConfigMap to use much slower software emulation",
+		}}
+	}
+	f.Close()
+	return nil
+}
+
+func checkLibvirt(config Config) []Problem {
+	if config.LibvirtVersion == nil {
+		return nil
+	}
+	version, err := config.LibvirtVersion()
+	switch {
+	case err != nil:
+		return []Problem{{
+			Check:   "libvirt",
+			Message: fmt.Sprintf("can't get libvirt version: %v", err),
+			Hint:    "make sure libvirtd is running and the libvirt URI and credentials are correct",
+		}}
+	case version < MinLibvirtVersion:
+		return []Problem{{
+			Check:   "libvirt",
+			Message: fmt.Sprintf("libvirt version %s is too old, need at least %s", formatVersion(version), formatVersion(MinLibvirtVersion)),
+			Hint:    "update libvirt",
+		}}
+	}
+	return nil
+}
+
+func formatVersion(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", v/1000000, v/1000%1000, v%1000)
+}
+
+func checkCNI(config Config) []Problem {
+	netConfigList, err := cni.ReadConfiguration(config.CNIConfigsDir)
+	if err != nil {
+		return []Problem{{
+			Check:   "cni",
+			Message: fmt.Sprintf("no usable CNI configuration in %s: %v", config.CNIConfigsDir, err),
+			Hint:    "install a CNI plugin for the cluster, e.g. flannel or calico",
+		}}
+	}
+	var problems []Problem
+	for _, plugin := range netConfigList.Plugins {
+		pluginType := plugin.Network.Type
+		path := filepath.Join(config.CNIPluginsDir, pluginType)
+		fi, err := os.Stat(path)
+		switch {
+		case err != nil:
+			problems = append(problems, Problem{
+				Check:   "cni",
+				Message: fmt.Sprintf("CNI plugin %q used by network %q is missing: %v", pluginType, netConfigList.Name, err),
+				Hint:    fmt.Sprintf("install the plugin binary into %s", config.CNIPluginsDir),
+			})
+		case fi.Mode()&0111 == 0:
+			problems = append(problems, Problem{
+				Check:   "cni",
+				Message: fmt.Sprintf("CNI plugin %q is not executable", path),
+				Hint:    "chmod +x " + path,
+			})
+		}
+	}
+	return problems
+}
+
+func checkKernelModules(config Config) []Problem {
+	var problems []Problem
+	for _, m := range []struct {
+		module, device string
+	}{
+		{"tun", "net/tun"},
+		{"vhost_net", "vhost-net"},
+	} {
+		if _, err := os.Stat(filepath.Join(config.DevDir, m.device)); err == nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(config.SysDir, "module", m.module)); err == nil {
+			continue
+		}
+		problems = append(problems, Problem{
+			Check:   "kernel-modules",
+			Message: fmt.Sprintf("kernel module %s is not loaded", m.module),
+			Hint:    "run 'modprobe " + m.module + "' on the node and add it to /etc/modules",
+		})
+	}
+	return problems
+}
+
+func checkCgroups(config Config) []Problem {
+	cgroupDir := filepath.Join(config.SysDir, "fs", "cgroup")
+	if _, err := os.Stat(filepath.Join(cgroupDir, "cgroup.controllers")); err == nil {
+		return []Problem{{
+			Check:   "cgroups",
+			Message: "unified cgroup hierarchy (cgroup v2) is not supported",
+			Hint:    "boot the node with systemd.unified_cgroup_hierarchy=0 kernel argument",
+		}}
+	}
+	var problems []Problem
+	for _, controller := range []string{"cpu", "cpuacct", "memory"} {
+		if _, err := os.Stat(filepath.Join(cgroupDir, controller)); err != nil {
+			problems = append(problems, Problem{
+				Check:   "cgroups",
+				Message: fmt.Sprintf("%s cgroup controller is not mounted under %s", controller, cgroupDir),
+				Hint:    "make sure the cgroup controllers are mounted as done by systemd and docker",
+			})
+		}
+	}
+	return problems
+}
+
+func checkImageStore(config Config) []Problem {
+	if config.ImageDir == "" {
+		return nil
+	}
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(config.ImageDir, &st); err != nil {
+		return []Problem{{
+			Check:   "image-store",
+			Message: fmt.Sprintf("can't check the free space in %s: %v", config.ImageDir, err),
+		}}
+	}
+	free := st.Bavail * uint64(st.Bsize)
+	if free < config.MinFreeImageSpace {
+		return []Problem{{
+			Check:   "image-store",
+			Message: fmt.Sprintf("only %d MiB free in %s, need at least %d MiB", free>>20, config.ImageDir, config.MinFreeImageSpace>>20),
+			Hint:    "free up disk space on the node or remove unused images using 'crictl rmi'",
+		}}
+	}
+	return nil
+}
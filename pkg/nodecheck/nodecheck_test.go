@@ -0,0 +1,198 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodecheck
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+type nodeSetup struct {
+	t       *testing.T
+	baseDir string
+}
+
+func newNodeSetup(t *testing.T) *nodeSetup {
+	baseDir, err := ioutil.TempDir("", "nodecheck")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	return &nodeSetup{t: t, baseDir: baseDir}
+}
+
+func (s *nodeSetup) writeFile(path, content string, mode os.FileMode) {
+	fullPath := filepath.Join(s.baseDir, path)
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		s.t.Fatalf("MkdirAll(): %v", err)
+	}
+	if err := ioutil.WriteFile(fullPath, []byte(content), mode); err != nil {
+		s.t.Fatalf("WriteFile(): %v", err)
+	}
+}
+
+func (s *nodeSetup) mkdir(path string) {
+	if err := os.MkdirAll(filepath.Join(s.baseDir, path), 0755); err != nil {
+		s.t.Fatalf("MkdirAll(): %v", err)
+	}
+}
+
+func (s *nodeSetup) config() Config {
+	return Config{
+		CNIPluginsDir:     filepath.Join(s.baseDir, "opt/cni/bin"),
+		CNIConfigsDir:     filepath.Join(s.baseDir, "etc/cni/net.d"),
+		ImageDir:          s.baseDir,
+		MinFreeImageSpace: 1,
+		LibvirtVersion:    func() (uint32, error) { return 1003001, nil },
+		DevDir:            filepath.Join(s.baseDir, "dev"),
+		SysDir:            filepath.Join(s.baseDir, "sys"),
+	}
+}
+
+func (s *nodeSetup) setupGoodNode() {
+	s.writeFile("dev/kvm", "", 0644)
+	s.writeFile("dev/net/tun", "", 0644)
+	s.mkdir("sys/module/vhost_net")
+	s.mkdir("sys/fs/cgroup/cpu")
+	s.mkdir("sys/fs/cgroup/cpuacct")
+	s.mkdir("sys/fs/cgroup/memory")
+	s.writeFile("etc/cni/net.d/10-test.conflist", `{
+  "cniVersion": "0.3.1",
+  "name": "test",
+  "plugins": [
+    {"type": "bridge"},
+    {"type": "portmap"}
+  ]
+}`, 0644)
+	s.writeFile("opt/cni/bin/bridge", "", 0755)
+	s.writeFile("opt/cni/bin/portmap", "", 0755)
+}
+
+func (s *nodeSetup) cleanup() {
+	os.RemoveAll(s.baseDir)
+}
+
+func problemChecks(problems []Problem) []string {
+	var r []string
+	for _, p := range problems {
+		r = append(r, p.Check)
+	}
+	sort.Strings(r)
+	return r
+}
+
+func TestNodeCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		setup    func(s *nodeSetup, config *Config)
+		problems []string
+	}{
+		{
+			name: "good node",
+		},
+		{
+			name: "no kvm",
+			setup: func(s *nodeSetup, config *Config) {
+				os.Remove(filepath.Join(s.baseDir, "dev/kvm"))
+			},
+			problems: []string{"kvm"},
+		},
+		{
+			name: "no kvm with kvm disabled",
+			setup: func(s *nodeSetup, config *Config) {
+				os.Remove(filepath.Join(s.baseDir, "dev/kvm"))
+				config.SkipKVM = true
+			},
+		},
+		{
+			name: "old libvirt",
+			setup: func(s *nodeSetup, config *Config) {
+				config.LibvirtVersion = func() (uint32, error) { return 1002002, nil }
+			},
+			problems: []string{"libvirt"},
+		},
+		{
+			name: "libvirt not available",
+			setup: func(s *nodeSetup, config *Config) {
+				config.LibvirtVersion = func() (uint32, error) { return 0, errors.New("no libvirt") }
+			},
+			problems: []string{"libvirt"},
+		},
+		{
+			name: "no cni config",
+			setup: func(s *nodeSetup, config *Config) {
+				os.RemoveAll(filepath.Join(s.baseDir, "etc/cni"))
+			},
+			problems: []string{"cni"},
+		},
+		{
+			name: "missing and non-executable cni plugins",
+			setup: func(s *nodeSetup, config *Config) {
+				os.Remove(filepath.Join(s.baseDir, "opt/cni/bin/bridge"))
+				os.Chmod(filepath.Join(s.baseDir, "opt/cni/bin/portmap"), 0644)
+			},
+			problems: []string{"cni", "cni"},
+		},
+		{
+			name: "missing kernel modules",
+			setup: func(s *nodeSetup, config *Config) {
+				os.RemoveAll(filepath.Join(s.baseDir, "dev/net"))
+				os.RemoveAll(filepath.Join(s.baseDir, "sys/module"))
+			},
+			problems: []string{"kernel-modules", "kernel-modules"},
+		},
+		{
+			name: "cgroup v2",
+			setup: func(s *nodeSetup, config *Config) {
+				s.writeFile("sys/fs/cgroup/cgroup.controllers", "cpu memory", 0644)
+			},
+			problems: []string{"cgroups"},
+		},
+		{
+			name: "missing memory cgroup",
+			setup: func(s *nodeSetup, config *Config) {
+				os.RemoveAll(filepath.Join(s.baseDir, "sys/fs/cgroup/memory"))
+			},
+			problems: []string{"cgroups"},
+		},
+		{
+			name: "not enough disk space",
+			setup: func(s *nodeSetup, config *Config) {
+				config.MinFreeImageSpace = 1 << 62
+			},
+			problems: []string{"image-store"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newNodeSetup(t)
+			defer s.cleanup()
+			s.setupGoodNode()
+			config := s.config()
+			if tc.setup != nil {
+				tc.setup(s, &config)
+			}
+			problems := Run(config)
+			if checks := problemChecks(problems); !reflect.DeepEqual(checks, tc.problems) {
+				t.Errorf("bad problem list: expected %v, got %v: %v", tc.problems, checks, problems)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package nodestate implements a metadata store backend that keeps
+// a copy of Virtlet's per-node state in VirtletNodeState objects.
+package nodestate
+
+import (
+	"errors"
+	"fmt"
+
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	groupName = "virtlet.k8s"
+	version   = "v1"
+	kind      = "VirtletNodeState"
+	resource  = "virtletnodestates"
+	// maxSaveAttempts is the number of attempts to save the state
+	// when it's concurrently modified by someone else, e.g. via kubectl
+	maxSaveAttempts = 3
+)
+
+var (
+	schemeBuilder      = runtime.NewSchemeBuilder(addKnownTypes)
+	scheme             = runtime.NewScheme()
+	schemeGroupVersion = schema.GroupVersion{Group: groupName, Version: version}
+)
+
+// VirtletNodeState holds a copy of Virtlet metadata for
+// the node which has the same name as the object
+type VirtletNodeState struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               metadata.NodeState `json:"spec"`
+}
+
+// VirtletNodeStateList is a k8s representation of list of node states
+type VirtletNodeStateList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata"`
+	Items            []VirtletNodeState `json:"items"`
+}
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(schemeGroupVersion,
+		&VirtletNodeState{},
+		&VirtletNodeStateList{},
+	)
+	meta_v1.AddToGroupVersion(scheme, schemeGroupVersion)
+	return nil
+}
+
+func init() {
+	if err := schemeBuilder.AddToScheme(scheme); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterCustomResourceType registers custom resource definition for VirtletNodeState kind in k8s
+func RegisterCustomResourceType() error {
+	crd := apiextensionsv1beta1.CustomResourceDefinition{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name: resource + "." + groupName,
+		},
+		Spec: apiextensionsv1beta1.CustomResourceDefinitionSpec{
+			Group:   groupName,
+			Version: version,
+			Scope:   apiextensionsv1beta1.ClusterScoped,
+			Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
+				Plural:     resource,
+				Singular:   "virtletnodestate",
+				Kind:       kind,
+				ShortNames: []string{"vns"},
+			},
+		},
+	}
+	cfg, err := utils.GetK8sClientConfig("")
+	if err != nil || cfg.Host == "" {
+		return err
+	}
+	extensionsClientSet, err := apiextensionsclient.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = extensionsClientSet.CustomResourceDefinitions().Create(&crd)
+	if err == nil || k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+type crdBackend struct {
+	client   *rest.RESTClient
+	nodeName string
+}
+
+var _ metadata.StateBackend = &crdBackend{}
+
+// NewStateBackend returns a metadata.StateBackend that keeps the state
+// of the specified node in VirtletNodeState object named after the node
+func NewStateBackend(nodeName string) (metadata.StateBackend, error) {
+	if nodeName == "" {
+		return nil, errors.New("node name is not specified")
+	}
+	cfg, err := utils.GetK8sClientConfig("")
+	if err != nil {
+		return nil, err
+	}
+	client, err := utils.GetK8sRestClient(cfg, scheme, &schemeGroupVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &crdBackend{client: client, nodeName: nodeName}, nil
+}
+
+func (b *crdBackend) get() (*VirtletNodeState, error) {
+	var obj VirtletNodeState
+	if err := b.client.Get().
+		Resource(resource).
+		Name(b.nodeName).
+		Do().Into(&obj); err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+// LoadState implements LoadState method of metadata.StateBackend
+func (b *crdBackend) LoadState() (*metadata.NodeState, error) {
+	obj, err := b.get()
+	switch {
+	case k8serrors.IsNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("error getting %s %q: %v", kind, b.nodeName, err)
+	}
+	return &obj.Spec, nil
+}
+
+// SaveState implements SaveState method of metadata.StateBackend
+func (b *crdBackend) SaveState(state *metadata.NodeState) error {
+	var err error
+	for i := 0; i < maxSaveAttempts; i++ {
+		if err = b.trySave(state); !k8serrors.IsConflict(err) && !k8serrors.IsAlreadyExists(err) {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error saving %s %q: %v", kind, b.nodeName, err)
+	}
+	return nil
+}
+
+func (b *crdBackend) trySave(state *metadata.NodeState) error {
+	obj := &VirtletNodeState{
+		TypeMeta: meta_v1.TypeMeta{
+			APIVersion: schemeGroupVersion.String(),
+			Kind:       kind,
+		},
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name: b.nodeName,
+		},
+		Spec: *state,
+	}
+	existing, err := b.get()
+	switch {
+	case k8serrors.IsNotFound(err):
+		return b.client.Post().
+			Resource(resource).
+			Body(obj).
+			Do().Error()
+	case err != nil:
+		return err
+	}
+	obj.ResourceVersion = existing.ResourceVersion
+	return b.client.Put().
+		Resource(resource).
+		Name(b.nodeName).
+		Body(obj).
+		Do().Error()
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package nodestate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/metadata"
+)
+
+const objPath = "/apis/virtlet.k8s/v1/virtletnodestates"
+
+// fakeAPIServer implements the subset of k8s API
+// used for VirtletNodeState objects
+type fakeAPIServer struct {
+	sync.Mutex
+	t               *testing.T
+	obj             *VirtletNodeState
+	resourceVersion int
+	conflicts       int
+}
+
+func (s *fakeAPIServer) writeStatus(w http.ResponseWriter, code int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Status",
+		"status":     "Failure",
+		"reason":     reason,
+		"code":       code,
+	})
+}
+
+func (s *fakeAPIServer) writeObj(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s.obj)
+}
+
+func (s *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Method == "GET" || r.Method == "PUT" {
+		if r.URL.Path != objPath+"/node1" {
+			s.t.Errorf("bad path %q", r.URL.Path)
+			s.writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+	} else if r.URL.Path != objPath {
+		s.t.Errorf("bad path %q", r.URL.Path)
+		s.writeStatus(w, http.StatusNotFound, "NotFound")
+		return
+	}
+
+	var obj VirtletNodeState
+	if r.Method == "POST" || r.Method == "PUT" {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			s.t.Fatalf("error reading request body: %v", err)
+		}
+		if err := json.Unmarshal(body, &obj); err != nil {
+			s.t.Fatalf("error unmarshalling request body: %v", err)
+		}
+		if obj.Kind != kind || obj.Name != "node1" {
+			s.t.Errorf("bad object: %#v", obj)
+		}
+	}
+
+	switch r.Method {
+	case "GET":
+		if s.obj == nil {
+			s.writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		s.writeObj(w, http.StatusOK)
+	case "POST":
+		if s.obj != nil {
+			s.writeStatus(w, http.StatusConflict, "AlreadyExists")
+			return
+		}
+		s.store(&obj)
+		s.writeObj(w, http.StatusCreated)
+	case "PUT":
+		if s.obj == nil {
+			s.writeStatus(w, http.StatusNotFound, "NotFound")
+			return
+		}
+		if s.conflicts > 0 || obj.ResourceVersion != s.obj.ResourceVersion {
+			if s.conflicts > 0 {
+				s.conflicts--
+			}
+			s.writeStatus(w, http.StatusConflict, "Conflict")
+			return
+		}
+		s.store(&obj)
+		s.writeObj(w, http.StatusOK)
+	default:
+		s.t.Errorf("unexpected method %q", r.Method)
+		s.writeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+func (s *fakeAPIServer) store(obj *VirtletNodeState) {
+	s.resourceVersion++
+	obj.ResourceVersion = strconv.Itoa(s.resourceVersion)
+	s.obj = obj
+}
+
+func TestStateBackend(t *testing.T) {
+	apiServer := &fakeAPIServer{t: t}
+	ts := httptest.NewServer(apiServer)
+	defer ts.Close()
+	os.Setenv("KUBERNETES_CLUSTER_URL", ts.URL)
+	defer os.Unsetenv("KUBERNETES_CLUSTER_URL")
+
+	backend, err := NewStateBackend("node1")
+	if err != nil {
+		t.Fatalf("NewStateBackend(): %v", err)
+	}
+	state, err := backend.LoadState()
+	if err != nil {
+		t.Fatalf("LoadState(): %v", err)
+	}
+	if state != nil {
+		t.Errorf("LoadState() returned non-nil state before the object was created: %#v", state)
+	}
+
+	for n, expectedState := range []*metadata.NodeState{
+		{
+			Containers: map[string]*metadata.ContainerInfo{
+				"container1": {Name: "vm1", SandboxID: "pod1"},
+			},
+			VsockCIDs: map[string]uint32{"container1": 3},
+		},
+		{
+			Images: map[string]*metadata.ImageState{
+				"vol1": {Name: "example.com/image1", Arch: "x86_64"},
+			},
+		},
+	} {
+		if n > 0 {
+			// make sure the update is retried
+			apiServer.conflicts = 1
+		}
+		if err := backend.SaveState(expectedState); err != nil {
+			t.Fatalf("SaveState(): %v", err)
+		}
+		state, err := backend.LoadState()
+		if err != nil {
+			t.Fatalf("LoadState(): %v", err)
+		}
+		if !reflect.DeepEqual(state, expectedState) {
+			t.Errorf("bad state:\n%#v\ninstead of\n%#v", state, expectedState)
+		}
+	}
+}
+
+func TestNoNodeName(t *testing.T) {
+	if _, err := NewStateBackend(""); err == nil {
+		t.Errorf("NewStateBackend() didn't fail for an empty node name")
+	}
+}
@@ -0,0 +1,147 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ociimage
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	// diskExtraSpace is the free space that's left on the
+	// filesystem of the disk image
+	diskExtraSpace = "+512M"
+	// maxSymlinks limits the number of symlinks followed
+	// when looking for the kernel
+	maxSymlinks = 16
+)
+
+// Unpack fetches the layers of the image for the specified
+// architecture and unpacks them into the directory
+func (c *Client) Unpack(ref *Reference, arch, dir string) error {
+	m, err := c.Manifest(ref, arch)
+	if err != nil {
+		return err
+	}
+	for n, layer := range m.Layers {
+		glog.V(2).Infof("Unpacking layer %d/%d of %s (%s)", n+1, len(m.Layers), ref, layer.Digest)
+		r, err := c.Blob(ref, layer.Digest)
+		if err != nil {
+			return err
+		}
+		err = ApplyLayer(dir, r)
+		if err == nil {
+			// read the rest of the blob to verify its digest
+			_, err = io.Copy(ioutil.Discard, r)
+		}
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("error applying layer %s of %s: %v", layer.Digest, ref, err)
+		}
+	}
+	return nil
+}
+
+// MakeDisk makes a qcow2 disk image at the specified path that
+// holds an ext4 filesystem with the contents of the directory. The
+// filesystem is placed directly on the disk without a partition
+// table, so the image can only be booted using direct kernel boot
+func MakeDisk(dir, path string) error {
+	out, err := utils.RunSandboxed(
+		utils.ImageBuilderLimits,
+		"virt-make-fs",
+		"--format=qcow2",
+		"--type=ext4",
+		"--label=rootfs",
+		"--size="+diskExtraSpace,
+		dir, path)
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// FindKernel looks for the kernel and initrd in the root directory,
+// checking the /vmlinuz and /initrd.img symlinks first and then
+// the latest versions under /boot. It returns empty kernel path
+// if there's no kernel in the root directory
+func FindKernel(dir string) (kernel, initrd string) {
+	kernel = findBootFile(dir, "vmlinuz")
+	if kernel == "" {
+		return "", ""
+	}
+	return kernel, findBootFile(dir, "initrd.img")
+}
+
+func findBootFile(dir, name string) string {
+	if path := resolveInRoot(dir, "/"+name); path != "" {
+		return path
+	}
+	if path := resolveInRoot(dir, "/boot/"+name); path != "" {
+		return path
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "boot", name+"-*"))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	sort.Strings(matches)
+	for n := len(matches) - 1; n >= 0; n-- {
+		if path := resolveInRoot(dir, strings.TrimPrefix(matches[n], dir)); path != "" {
+			return path
+		}
+	}
+	return ""
+}
+
+// resolveInRoot returns the path of the regular file inside the
+// root directory following the symlinks relative to the root
+// directory, or an empty string if there's no such file
+func resolveInRoot(dir, name string) string {
+	for i := 0; i < maxSymlinks; i++ {
+		path, err := rootfsPath(dir, name)
+		if err != nil {
+			return ""
+		}
+		fi, err := os.Lstat(path)
+		switch {
+		case err != nil:
+			return ""
+		case fi.Mode().IsRegular():
+			return path
+		case fi.Mode()&os.ModeSymlink == 0:
+			return ""
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return ""
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(filepath.Clean("/"+name)), target)
+		}
+		name = target
+	}
+	return ""
+}
@@ -0,0 +1,340 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ociimage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// URLPrefix is the prefix of the image URLs that refer
+	// to container images
+	URLPrefix = "oci://"
+
+	defaultRegistry   = "registry-1.docker.io"
+	defaultTag        = "latest"
+	maxManifestLevels = 2
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeOCIManifest        = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex           = "application/vnd.oci.image.index.v1+json"
+)
+
+// Reference denotes a container image in a registry
+type Reference struct {
+	// Registry is the host[:port] of the registry
+	Registry string
+	// Repository is the name of the repository, e.g. library/alpine
+	Repository string
+	// Reference is either a tag or a digest
+	Reference string
+}
+
+// ParseReference parses the container image reference
+// in [oci://][registry/]repository[:tag|@digest] format.
+// Docker Hub is used if the registry isn't specified
+func ParseReference(ref string) (*Reference, error) {
+	s := strings.TrimPrefix(ref, URLPrefix)
+	r := &Reference{Registry: defaultRegistry, Reference: defaultTag}
+	if p := strings.Index(s, "@"); p >= 0 {
+		r.Reference = s[p+1:]
+		s = s[:p]
+	} else if p := strings.LastIndex(s, ":"); p >= 0 && !strings.Contains(s[p:], "/") {
+		r.Reference = s[p+1:]
+		s = s[:p]
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		r.Registry = parts[0]
+		s = parts[1]
+	}
+	if s == "" {
+		return nil, fmt.Errorf("bad container image reference %q", ref)
+	}
+	if r.Registry == defaultRegistry && !strings.Contains(s, "/") {
+		s = "library/" + s
+	}
+	r.Repository = s
+	if r.Reference == "" {
+		return nil, fmt.Errorf("bad container image reference %q", ref)
+	}
+	return r, nil
+}
+
+func (r *Reference) String() string {
+	sep := ":"
+	if strings.Contains(r.Reference, ":") {
+		sep = "@"
+	}
+	return r.Registry + "/" + r.Repository + sep + r.Reference
+}
+
+// Descriptor describes a manifest or a blob
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Digest    string    `json:"digest"`
+	Size      int64     `json:"size"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Platform describes the platform of an image in a manifest list
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Manifest is an image manifest or a manifest list
+type Manifest struct {
+	MediaType string       `json:"mediaType"`
+	Config    *Descriptor  `json:"config,omitempty"`
+	Layers    []Descriptor `json:"layers,omitempty"`
+	Manifests []Descriptor `json:"manifests,omitempty"`
+}
+
+func (m *Manifest) isList() bool {
+	return m.MediaType == mediaTypeDockerManifestList || m.MediaType == mediaTypeOCIIndex || len(m.Manifests) != 0
+}
+
+// Client fetches the images from container registries
+// using Docker Registry HTTP API V2
+type Client struct {
+	httpClient *http.Client
+	scheme     string
+	tokens     map[string]string
+}
+
+// NewClient returns a new registry client that uses the specified
+// HTTP client
+func NewClient(httpClient *http.Client) *Client {
+	return &Client{
+		httpClient: httpClient,
+		scheme:     "https",
+		tokens:     make(map[string]string),
+	}
+}
+
+// Manifest returns the manifest of the image for the specified
+// architecture (using GOARCH notation), picking it from the
+// manifest list if the image is a multi-arch one
+func (c *Client) Manifest(ref *Reference, arch string) (*Manifest, error) {
+	reference := ref.Reference
+	for i := 0; i < maxManifestLevels; i++ {
+		var m Manifest
+		if err := c.getJSON(ref, "manifests/"+reference, &m); err != nil {
+			return nil, err
+		}
+		if !m.isList() {
+			if len(m.Layers) == 0 {
+				return nil, fmt.Errorf("%s: unsupported manifest type %q", ref, m.MediaType)
+			}
+			return &m, nil
+		}
+		reference = ""
+		for _, d := range m.Manifests {
+			if d.Platform != nil && d.Platform.OS == "linux" && d.Platform.Architecture == arch {
+				reference = d.Digest
+				break
+			}
+		}
+		if reference == "" {
+			return nil, fmt.Errorf("%s: no image for linux/%s", ref, arch)
+		}
+	}
+	return nil, fmt.Errorf("%s: too many nested manifest lists", ref)
+}
+
+// Blob returns a reader for the blob with the specified digest. The
+// reader returns an error upon EOF if the digest of the blob
+// doesn't match
+func (c *Client) Blob(ref *Reference, digest string) (io.ReadCloser, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" {
+		return nil, fmt.Errorf("unsupported blob digest %q", digest)
+	}
+	resp, err := c.get(ref, "blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	return &verifyingReader{
+		ReadCloser: resp.Body,
+		hash:       sha256.New(),
+		digest:     parts[1],
+	}, nil
+}
+
+func (c *Client) getJSON(ref *Reference, path string, v interface{}) error {
+	accept := strings.Join([]string{
+		mediaTypeDockerManifestList,
+		mediaTypeOCIIndex,
+		mediaTypeDockerManifest,
+		mediaTypeOCIManifest,
+	}, ", ")
+	resp, err := c.get(ref, path, accept)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading %s of %s: %v", path, ref, err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error parsing %s of %s: %v", path, ref, err)
+	}
+	return nil
+}
+
+func (c *Client) get(ref *Reference, path, accept string) (*http.Response, error) {
+	u := fmt.Sprintf("%s://%s/v2/%s/%s", c.scheme, ref.Registry, ref.Repository, path)
+	authorized := false
+	for {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if token := c.tokens[ref.Registry+"/"+ref.Repository]; token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized && !authorized:
+			challenge := resp.Header.Get("Www-Authenticate")
+			resp.Body.Close()
+			if err := c.authorize(ref, challenge); err != nil {
+				return nil, fmt.Errorf("error authorizing to %s: %v", ref.Registry, err)
+			}
+			authorized = true
+		case resp.StatusCode/100 != 2:
+			resp.Body.Close()
+			return nil, fmt.Errorf("error getting %s: HTTP status %d", u, resp.StatusCode)
+		default:
+			return resp, nil
+		}
+	}
+}
+
+// authorize obtains an anonymous bearer token for the repository
+func (c *Client) authorize(ref *Reference, challenge string) error {
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer ") {
+		return fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	params := parseChallenge(challenge[len("bearer "):])
+	if params["realm"] == "" {
+		return errors.New("no realm in the authentication challenge")
+	}
+	u, err := url.Parse(params["realm"])
+	if err != nil {
+		return fmt.Errorf("bad realm %q: %v", params["realm"], err)
+	}
+	q := u.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + ref.Repository + ":pull"
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	resp, err := c.httpClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error getting token from %s: HTTP status %d", params["realm"], resp.StatusCode)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("error parsing the token: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return errors.New("empty token")
+	}
+	c.tokens[ref.Registry+"/"+ref.Repository] = token.Token
+	return nil
+}
+
+// parseChallenge parses comma-separated key="value" pairs
+// of WWW-Authenticate header
+func parseChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		p := strings.Index(s, "=")
+		if p < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:p]))
+		s = s[p+1:]
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.Index(s[1:], "\"")
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if end := strings.Index(s, ","); end >= 0 {
+			value, s = s[:end], s[end:]
+		} else {
+			value, s = s, ""
+		}
+		params[key] = value
+	}
+	return params
+}
+
+type verifyingReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	digest string
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(r.hash.Sum(nil)) != r.digest {
+		return n, fmt.Errorf("blob digest mismatch: expected sha256:%s", r.digest)
+	}
+	return n, err
+}
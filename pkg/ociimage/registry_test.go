@@ -0,0 +1,311 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ociimage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	for _, tc := range []struct {
+		ref      string
+		expected *Reference
+	}{
+		{
+			ref:      "alpine",
+			expected: &Reference{Registry: "registry-1.docker.io", Repository: "library/alpine", Reference: "latest"},
+		},
+		{
+			ref:      "oci://alpine:3.7",
+			expected: &Reference{Registry: "registry-1.docker.io", Repository: "library/alpine", Reference: "3.7"},
+		},
+		{
+			ref:      "oci://quay.io/coreos/etcd:v3.3",
+			expected: &Reference{Registry: "quay.io", Repository: "coreos/etcd", Reference: "v3.3"},
+		},
+		{
+			ref:      "localhost:5000/foo/bar",
+			expected: &Reference{Registry: "localhost:5000", Repository: "foo/bar", Reference: "latest"},
+		},
+		{
+			ref:      "example.com/foo@sha256:0123",
+			expected: &Reference{Registry: "example.com", Repository: "foo", Reference: "sha256:0123"},
+		},
+		{
+			ref: "oci://",
+		},
+	} {
+		t.Run(tc.ref, func(t *testing.T) {
+			ref, err := ParseReference(tc.ref)
+			switch {
+			case tc.expected == nil && err == nil:
+				t.Errorf("ParseReference didn't fail for a bad reference")
+			case tc.expected != nil && err != nil:
+				t.Errorf("ParseReference: %v", err)
+			case !reflect.DeepEqual(ref, tc.expected):
+				t.Errorf("bad reference: expected %#v, got %#v", tc.expected, ref)
+			}
+		})
+	}
+}
+
+type tarEntry struct {
+	name     string
+	content  string
+	linkname string
+	typeflag byte
+}
+
+func makeLayer(t *testing.T, entries []tarEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		typeflag := e.typeflag
+		if typeflag == 0 {
+			typeflag = tar.TypeReg
+		}
+		hdr := &tar.Header{
+			Name:     e.name,
+			Linkname: e.linkname,
+			Typeflag: typeflag,
+			Mode:     0644,
+			Size:     int64(len(e.content)),
+		}
+		if typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if typeflag != tar.TypeReg {
+			hdr.Size = 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(): %v", err)
+		}
+		if typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				t.Fatalf("Write(): %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar Close(): %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("gzip Close(): %v", err)
+	}
+	return buf.Bytes()
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+type fakeRegistry struct {
+	t         *testing.T
+	blobs     map[string][]byte
+	manifests map[string]*Manifest
+	token     string
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		if req.URL.Query().Get("scope") != "repository:test/image:pull" {
+			r.t.Errorf("bad token scope %q", req.URL.Query().Get("scope"))
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+	if req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("Www-Authenticate", fmt.Sprintf("Bearer realm=\"https://%s/token\",service=\"test\",scope=\"repository:test/image:pull\"", req.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	switch {
+	case strings.HasPrefix(req.URL.Path, "/v2/test/image/manifests/"):
+		m, found := r.manifests[strings.TrimPrefix(req.URL.Path, "/v2/test/image/manifests/")]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.MediaType)
+		json.NewEncoder(w).Encode(m)
+	case strings.HasPrefix(req.URL.Path, "/v2/test/image/blobs/"):
+		blob, found := r.blobs[strings.TrimPrefix(req.URL.Path, "/v2/test/image/blobs/")]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(blob)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestUnpack(t *testing.T) {
+	layers := [][]byte{
+		makeLayer(t, []tarEntry{
+			{name: "etc/", typeflag: tar.TypeDir},
+			{name: "etc/hostname", content: "localhost"},
+			{name: "etc/removed", content: "foo"},
+			{name: "var/", typeflag: tar.TypeDir},
+			{name: "var/lib/", typeflag: tar.TypeDir},
+			{name: "var/lib/old", content: "old"},
+			{name: "boot/", typeflag: tar.TypeDir},
+			{name: "boot/vmlinuz-4.4.0-1", content: "old kernel"},
+			{name: "boot/vmlinuz-4.4.0-2", content: "kernel"},
+			{name: "boot/initrd.img-4.4.0-2", content: "initrd"},
+			{name: "vmlinuz", linkname: "boot/vmlinuz-4.4.0-2", typeflag: tar.TypeSymlink},
+		}),
+		makeLayer(t, []tarEntry{
+			{name: "etc/.wh.removed"},
+			{name: "var/lib/new", content: "new"},
+			{name: "var/lib/.wh..wh..opq"},
+			{name: "etc/hosts", linkname: "etc/hostname", typeflag: tar.TypeLink},
+		}),
+	}
+	amd64Manifest := &Manifest{
+		MediaType: mediaTypeDockerManifest,
+		Config:    &Descriptor{MediaType: "application/vnd.docker.container.image.v1+json", Digest: "sha256:00"},
+	}
+	registry := &fakeRegistry{
+		t:         t,
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string]*Manifest),
+		token:     "sometoken",
+	}
+	for _, layer := range layers {
+		digest := sha256Digest(layer)
+		registry.blobs[digest] = layer
+		amd64Manifest.Layers = append(amd64Manifest.Layers, Descriptor{
+			MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+			Digest:    digest,
+			Size:      int64(len(layer)),
+		})
+	}
+	registry.manifests["sha256:amd64"] = amd64Manifest
+	registry.manifests["latest"] = &Manifest{
+		MediaType: mediaTypeDockerManifestList,
+		Manifests: []Descriptor{
+			{
+				MediaType: mediaTypeDockerManifest,
+				Digest:    "sha256:arm64",
+				Platform:  &Platform{Architecture: "arm64", OS: "linux"},
+			},
+			{
+				MediaType: mediaTypeDockerManifest,
+				Digest:    "sha256:amd64",
+				Platform:  &Platform{Architecture: "amd64", OS: "linux"},
+			},
+		},
+	}
+	srv := httptest.NewTLSServer(registry)
+	defer srv.Close()
+
+	tmpDir, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ref, err := ParseReference("oci://" + strings.TrimPrefix(srv.URL, "https://") + "/test/image")
+	if err != nil {
+		t.Fatalf("ParseReference(): %v", err)
+	}
+	c := NewClient(srv.Client())
+	if err := c.Unpack(ref, "arm64", tmpDir); err == nil {
+		t.Errorf("Unpack() didn't fail for an image with missing manifest")
+	}
+	if err := c.Unpack(ref, "amd64", tmpDir); err != nil {
+		t.Fatalf("Unpack(): %v", err)
+	}
+
+	for _, tc := range []struct {
+		path, content string
+	}{
+		{"etc/hostname", "localhost"},
+		{"etc/hosts", "localhost"},
+		{"etc/removed", ""},
+		{"var/lib/old", ""},
+		{"var/lib/new", "new"},
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(tmpDir, tc.path))
+		switch {
+		case tc.content == "" && !os.IsNotExist(err):
+			t.Errorf("%s: the file was expected to be removed", tc.path)
+		case tc.content != "" && err != nil:
+			t.Errorf("%s: error reading the file: %v", tc.path, err)
+		case string(data) != tc.content:
+			t.Errorf("%s: bad content %q instead of %q", tc.path, data, tc.content)
+		}
+	}
+
+	kernel, initrd := FindKernel(tmpDir)
+	if kernel != filepath.Join(tmpDir, "boot/vmlinuz-4.4.0-2") {
+		t.Errorf("bad kernel path %q", kernel)
+	}
+	if initrd != filepath.Join(tmpDir, "boot/initrd.img-4.4.0-2") {
+		t.Errorf("bad initrd path %q", initrd)
+	}
+}
+
+func TestBadBlobDigest(t *testing.T) {
+	layer := makeLayer(t, []tarEntry{{name: "foo", content: "bar"}})
+	digest := sha256Digest([]byte("something else"))
+	registry := &fakeRegistry{
+		t:     t,
+		blobs: map[string][]byte{digest: layer},
+		manifests: map[string]*Manifest{
+			"latest": {
+				MediaType: mediaTypeOCIManifest,
+				Layers:    []Descriptor{{Digest: digest}},
+			},
+		},
+		token: "sometoken",
+	}
+	srv := httptest.NewTLSServer(registry)
+	defer srv.Close()
+
+	tmpDir, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ref, err := ParseReference(strings.TrimPrefix(srv.URL, "https://") + "/test/image")
+	if err != nil {
+		t.Fatalf("ParseReference(): %v", err)
+	}
+	err = NewClient(srv.Client()).Unpack(ref, "amd64", tmpDir)
+	if err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("expected digest mismatch error, got %v", err)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ociimage
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// ApplyLayer unpacks the layer tarball, which may be gzipped, into
+// the directory, handling the whiteout files that mark the files
+// removed from the lower layers
+func ApplyLayer(dir string, r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("error decompressing the layer: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	// the files added by this layer must be kept by opaque
+	// whiteouts that follow them in the tarball
+	added := make(map[string]bool)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			return nil
+		case err != nil:
+			return fmt.Errorf("error reading the layer: %v", err)
+		}
+		if err := applyEntry(dir, hdr, tr, added); err != nil {
+			return fmt.Errorf("error unpacking %q: %v", hdr.Name, err)
+		}
+	}
+}
+
+// rootfsPath returns the path of the file inside the root directory,
+// making sure that it can't be used to escape from the directory
+// by following symlinks
+func rootfsPath(dir, name string) (string, error) {
+	rel := filepath.Clean("/" + name)
+	if rel == "/" {
+		return dir, nil
+	}
+	parts := strings.Split(rel[1:], "/")
+	cur := dir
+	for _, part := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, part)
+		fi, err := os.Lstat(cur)
+		switch {
+		case os.IsNotExist(err):
+			return filepath.Join(dir, rel), nil
+		case err != nil:
+			return "", err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return "", fmt.Errorf("path %q contains a symlink", name)
+		}
+	}
+	return filepath.Join(dir, rel), nil
+}
+
+func applyEntry(dir string, hdr *tar.Header, r io.Reader, added map[string]bool) error {
+	path, err := rootfsPath(dir, hdr.Name)
+	if err != nil {
+		return err
+	}
+	if path == dir {
+		return nil
+	}
+	base := filepath.Base(path)
+	parent := filepath.Dir(path)
+	switch {
+	case base == opaqueWhiteout:
+		entries, err := ioutil.ReadDir(parent)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, fi := range entries {
+			if added[filepath.Join(parent, fi.Name())] {
+				continue
+			}
+			if err := os.RemoveAll(filepath.Join(parent, fi.Name())); err != nil {
+				return err
+			}
+		}
+		return nil
+	case strings.HasPrefix(base, whiteoutPrefix):
+		return os.RemoveAll(filepath.Join(parent, base[len(whiteoutPrefix):]))
+	}
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	added[path] = true
+	if fi, err := os.Lstat(path); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	mode := os.FileMode(hdr.Mode).Perm()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, mode); err != nil {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		return lchown(path, hdr, os.Symlink(hdr.Linkname, path))
+	case tar.TypeLink:
+		target, err := rootfsPath(dir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		devMode := uint32(mode)
+		switch hdr.Typeflag {
+		case tar.TypeChar:
+			devMode |= syscall.S_IFCHR
+		case tar.TypeBlock:
+			devMode |= syscall.S_IFBLK
+		default:
+			devMode |= syscall.S_IFIFO
+		}
+		dev := int((hdr.Devmajor&0xfff)<<8 | hdr.Devminor&0xff | (hdr.Devminor&0xfff00)<<12)
+		if err := syscall.Mknod(path, devMode, dev); err != nil {
+			return err
+		}
+	default:
+		// skip unsupported entries such as the ones holding
+		// extended headers
+		return nil
+	}
+
+	if err := lchown(path, hdr, nil); err != nil {
+		return err
+	}
+	// chmod is needed to set setuid/setgid/sticky bits
+	// and to override the umask
+	if err := os.Chmod(path, os.FileMode(hdr.Mode)&os.ModePerm|specialBits(hdr.Mode)); err != nil {
+		return err
+	}
+	return os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+}
+
+// lchown sets the owner of the file if running as root. It
+// returns err if it's not nil
+func lchown(path string, hdr *tar.Header, err error) error {
+	if err != nil || os.Geteuid() != 0 {
+		return err
+	}
+	return os.Lchown(path, hdr.Uid, hdr.Gid)
+}
+
+func specialBits(mode int64) os.FileMode {
+	var m os.FileMode
+	if mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
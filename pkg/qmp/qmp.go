@@ -0,0 +1,186 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package qmp implements a minimal client for QEMU Machine Protocol
+// which is used to talk to VM processes directly in cases when libvirt
+// can't help, e.g. when a file descriptor needs to be passed to QEMU.
+package qmp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Error denotes an error returned by QEMU in response to a command
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("QMP error: %s: %s", e.Class, e.Desc)
+}
+
+// Event denotes an asynchronous event received from QEMU
+type Event struct {
+	// Event is the name of the event, e.g. DEVICE_DELETED
+	Event string `json:"event"`
+	// Data contains event-specific data
+	Data json.RawMessage `json:"data"`
+}
+
+type command struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+type message struct {
+	QMP    json.RawMessage `json:"QMP"`
+	Return json.RawMessage `json:"return"`
+	Error  *Error          `json:"error"`
+	Event  string          `json:"event"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// Client talks to QEMU over a QMP socket. It's not safe for
+// concurrent use
+type Client struct {
+	conn   *net.UnixConn
+	dec    *json.Decoder
+	events []Event
+}
+
+// Dial connects to QMP socket at the specified path and negotiates
+// the capabilities. timeout limits the time spent connecting and
+// negotiating, it's also used as the initial deadline for the
+// connection which can be changed using SetDeadline()
+func Dial(socketPath string, timeout time.Duration) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to QMP socket %q: %v", socketPath, err)
+	}
+	c := &Client{
+		conn: conn.(*net.UnixConn),
+		dec:  json.NewDecoder(conn),
+	}
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		c.Close()
+		return nil, err
+	}
+	var greeting message
+	if err := c.dec.Decode(&greeting); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("error reading QMP greeting: %v", err)
+	}
+	if greeting.QMP == nil {
+		c.Close()
+		return nil, errors.New("bad QMP greeting")
+	}
+	if err := c.Execute("qmp_capabilities", nil, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// SetDeadline sets the deadline for the operations
+// on the connection
+func (c *Client) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Execute executes a QMP command with optional arguments. If result
+// is not nil, the value returned by the command is unmarshalled into
+// it. If QEMU returns an error, it's returned as *Error
+func (c *Client) Execute(cmd string, args interface{}, result interface{}) error {
+	return c.execute(cmd, args, result, nil)
+}
+
+// SendFD passes the file descriptor to QEMU using getfd command,
+// making it available to other commands under the specified name
+func (c *Client) SendFD(name string, fd int) error {
+	return c.execute("getfd", map[string]string{"fdname": name}, nil, syscall.UnixRights(fd))
+}
+
+func (c *Client) execute(cmd string, args interface{}, result interface{}, oob []byte) error {
+	bs, err := json.Marshal(command{Execute: cmd, Arguments: args})
+	if err != nil {
+		return fmt.Errorf("error marshalling QMP command: %v", err)
+	}
+	if _, _, err := c.conn.WriteMsgUnix(bs, oob, nil); err != nil {
+		return fmt.Errorf("error sending QMP command %q: %v", cmd, err)
+	}
+	for {
+		var msg message
+		if err := c.dec.Decode(&msg); err != nil {
+			return fmt.Errorf("error reading QMP response to %q: %v", cmd, err)
+		}
+		switch {
+		case msg.Event != "":
+			c.events = append(c.events, Event{Event: msg.Event, Data: msg.Data})
+		case msg.Error != nil:
+			return msg.Error
+		case msg.Return != nil:
+			if result == nil {
+				return nil
+			}
+			if err := json.Unmarshal(msg.Return, result); err != nil {
+				return fmt.Errorf("error unmarshalling QMP response to %q: %v", cmd, err)
+			}
+			return nil
+		}
+	}
+}
+
+// WaitEvent waits for an event with the specified name for which
+// match returns true. If match is nil, any event with this name
+// matches. The events received while waiting for command responses
+// are checked, too
+func (c *Client) WaitEvent(name string, match func(data json.RawMessage) bool) (*Event, error) {
+	matches := func(e *Event) bool {
+		return e.Event == name && (match == nil || match(e.Data))
+	}
+	for n := range c.events {
+		if matches(&c.events[n]) {
+			e := c.events[n]
+			c.events = append(c.events[:n], c.events[n+1:]...)
+			return &e, nil
+		}
+	}
+	for {
+		var msg message
+		if err := c.dec.Decode(&msg); err != nil {
+			return nil, fmt.Errorf("error waiting for QMP event %q: %v", name, err)
+		}
+		if msg.Event == "" {
+			continue
+		}
+		e := Event{Event: msg.Event, Data: msg.Data}
+		if matches(&e) {
+			return &e, nil
+		}
+		c.events = append(c.events, e)
+	}
+}
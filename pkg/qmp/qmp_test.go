@@ -0,0 +1,211 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package qmp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type fakeQEMU struct {
+	t        *testing.T
+	conn     *net.UnixConn
+	commands []map[string]interface{}
+	fds      []int
+}
+
+func (q *fakeQEMU) send(msg string) {
+	if _, err := q.conn.Write([]byte(msg + "\r\n")); err != nil {
+		q.t.Errorf("Write(): %v", err)
+	}
+}
+
+// serve reads the commands and sends the responses from the list,
+// one per command. Each response may be prepended by events
+func (q *fakeQEMU) serve(responses [][]string) {
+	q.send(`{"QMP": {"version": {"qemu": {"micro": 0, "minor": 11, "major": 2}}, "capabilities": []}}`)
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	for _, resp := range responses {
+		n, oobn, _, _, err := q.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			q.t.Errorf("ReadMsgUnix(): %v", err)
+			return
+		}
+		var cmd map[string]interface{}
+		if err := json.Unmarshal(buf[:n], &cmd); err != nil {
+			q.t.Errorf("bad command %q: %v", buf[:n], err)
+			return
+		}
+		q.commands = append(q.commands, cmd)
+		if oobn > 0 {
+			scms, err := syscall.ParseSocketControlMessage(oob[:oobn])
+			if err != nil || len(scms) != 1 {
+				q.t.Errorf("bad socket control message: %v", err)
+				return
+			}
+			fds, err := syscall.ParseUnixRights(&scms[0])
+			if err != nil {
+				q.t.Errorf("ParseUnixRights(): %v", err)
+				return
+			}
+			q.fds = append(q.fds, fds...)
+		}
+		for _, msg := range resp {
+			q.send(msg)
+		}
+	}
+}
+
+func withFakeQEMU(t *testing.T, responses [][]string, toCall func(c *Client)) *fakeQEMU {
+	tmpDir, err := ioutil.TempDir("", "qmp-test")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "qmp.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socketPath, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	defer l.Close()
+
+	q := &fakeQEMU{t: t}
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			t.Errorf("AcceptUnix(): %v", err)
+			return
+		}
+		defer conn.Close()
+		q.conn = conn
+		q.serve(responses)
+		// wait for the client to close the connection
+		bufio.NewReader(conn).ReadByte()
+	}()
+
+	c, err := Dial(socketPath, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	toCall(c)
+	c.Close()
+	<-doneCh
+	return q
+}
+
+func TestExecute(t *testing.T) {
+	var result struct {
+		Running bool   `json:"running"`
+		Status  string `json:"status"`
+	}
+	q := withFakeQEMU(t, [][]string{
+		{`{"return": {}}`},
+		{
+			`{"timestamp": {"seconds": 1, "microseconds": 2}, "event": "RTC_CHANGE", "data": {"offset": 0}}`,
+			`{"return": {"running": true, "singlestep": false, "status": "running"}}`,
+		},
+		{`{"error": {"class": "GenericError", "desc": "Duplicate ID 'net1' for device"}}`},
+	}, func(c *Client) {
+		if err := c.Execute("query-status", nil, &result); err != nil {
+			t.Errorf("Execute(): %v", err)
+		}
+		err := c.Execute("device_add", map[string]string{"driver": "virtio-net-pci", "id": "net1"}, nil)
+		if qerr, ok := err.(*Error); !ok {
+			t.Errorf("expected a QMP error, got %v", err)
+		} else if qerr.Class != "GenericError" {
+			t.Errorf("bad error class %q", qerr.Class)
+		}
+	})
+
+	if !result.Running || result.Status != "running" {
+		t.Errorf("bad query-status result: %#v", result)
+	}
+	expectedCommands := []map[string]interface{}{
+		{"execute": "qmp_capabilities"},
+		{"execute": "query-status"},
+		{
+			"execute":   "device_add",
+			"arguments": map[string]interface{}{"driver": "virtio-net-pci", "id": "net1"},
+		},
+	}
+	if !reflect.DeepEqual(q.commands, expectedCommands) {
+		t.Errorf("bad commands:\n%#v\ninstead of\n%#v", q.commands, expectedCommands)
+	}
+}
+
+func TestSendFDAndWaitEvent(t *testing.T) {
+	f, err := ioutil.TempFile("", "qmp-fd")
+	if err != nil {
+		t.Fatalf("TempFile(): %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	q := withFakeQEMU(t, [][]string{
+		{`{"return": {}}`},
+		{`{"return": {}}`},
+		{
+			`{"event": "DEVICE_DELETED", "data": {"device": "net0", "path": "/machine/peripheral/net0"}}`,
+			`{"return": {}}`,
+			`{"event": "DEVICE_DELETED", "data": {"device": "net1", "path": "/machine/peripheral/net1"}}`,
+		},
+	}, func(c *Client) {
+		if err := c.SendFD("tap1", int(f.Fd())); err != nil {
+			t.Errorf("SendFD(): %v", err)
+		}
+		if err := c.Execute("device_del", map[string]string{"id": "net1"}, nil); err != nil {
+			t.Errorf("Execute(): %v", err)
+		}
+		for _, id := range []string{"net1", "net0"} {
+			e, err := c.WaitEvent("DEVICE_DELETED", func(data json.RawMessage) bool {
+				var d struct {
+					Device string `json:"device"`
+				}
+				return json.Unmarshal(data, &d) == nil && d.Device == id
+			})
+			if err != nil {
+				t.Errorf("WaitEvent(): %v", err)
+			} else if e.Event != "DEVICE_DELETED" {
+				t.Errorf("bad event %q", e.Event)
+			}
+		}
+	})
+
+	if len(q.fds) != 1 {
+		t.Fatalf("expected 1 fd to be passed, got %d", len(q.fds))
+	}
+	syscall.Close(q.fds[0])
+	expectedCommand := map[string]interface{}{
+		"execute":   "getfd",
+		"arguments": map[string]interface{}{"fdname": "tap1"},
+	}
+	if !reflect.DeepEqual(q.commands[1], expectedCommand) {
+		t.Errorf("bad getfd command: %#v", q.commands[1])
+	}
+}
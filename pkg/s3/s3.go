@@ -0,0 +1,165 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package s3 implements uploading objects to S3-compatible object
+// storage using AWS Signature Version 4.
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRegion is used when the region is not specified
+	DefaultRegion = "us-east-1"
+	// unsignedPayload makes it possible to stream the object
+	// data without calculating its hash beforehand
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+)
+
+// Credentials specify the keys for accessing the object storage
+type Credentials struct {
+	// AccessKeyID is the access key id
+	AccessKeyID string
+	// SecretAccessKey is the secret key
+	SecretAccessKey string
+	// Region is the region of the storage. If it's empty,
+	// DefaultRegion is used
+	Region string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+func canonicalQuery(u *url.URL) string {
+	// url.Values.Encode() sorts the keys but uses '+'
+	// for spaces, which is not accepted by AWS
+	return strings.Replace(u.Query().Encode(), "+", "%20", -1)
+}
+
+// signRequest adds AWS Signature Version 4 authorization header to
+// the request. All of the request headers are signed along with
+// the Host header. payloadHash is the hex-encoded SHA256 of the
+// request body or UNSIGNED-PAYLOAD
+func signRequest(req *http.Request, creds Credentials, service, payloadHash string, now time.Time) {
+	region := creds.Region
+	if region == "" {
+		region = DefaultRegion
+	}
+	amzDate := now.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// Upload uploads size bytes read from r as an object with the
+// specified URL which must include the bucket and the object key,
+// e.g. https://s3.example.com/bucket/path/to/object
+func Upload(client *http.Client, objectURL string, creds Credentials, r io.Reader, size int64) error {
+	u, err := url.Parse(objectURL)
+	if err != nil {
+		return fmt.Errorf("bad object url %q: %v", objectURL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("bad object url %q: the scheme must be http or https", objectURL)
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), ioutil.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signRequest(req, creds, "s3", unsignedPayload, time.Now())
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error uploading %q: %v", objectURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("error uploading %q: %s: %s", objectURL, resp.Status, msg)
+	}
+	return nil
+}
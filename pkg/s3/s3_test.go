@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package s3
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	// this is the example from AWS Signature Version 4 documentation
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.Fatalf("NewRequest(): %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signRequest(req, Credentials{
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}, "iam", sha256Hex(""), time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if auth := req.Header.Get("Authorization"); auth != expected {
+		t.Errorf("bad Authorization header:\n%s\ninstead of\n%s", auth, expected)
+	}
+	if amzDate := req.Header.Get("X-Amz-Date"); amzDate != "20150830T123600Z" {
+		t.Errorf("bad X-Amz-Date header %q", amzDate)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	var uploaded []byte
+	var auth, path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("X-Amz-Content-Sha256") != unsignedPayload {
+			http.Error(w, "bad payload hash", http.StatusBadRequest)
+			return
+		}
+		auth = r.Header.Get("Authorization")
+		path = r.URL.Path
+		var err error
+		if uploaded, err = ioutil.ReadAll(r.Body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	data := []byte("qcow2 data")
+	creds := Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", Region: "eu-west-1"}
+	if err := Upload(nil, srv.URL+"/bucket/exports/vm.qcow2", creds, bytes.NewBuffer(data), int64(len(data))); err != nil {
+		t.Fatalf("Upload(): %v", err)
+	}
+	if !bytes.Equal(uploaded, data) {
+		t.Errorf("bad uploaded data: %q", uploaded)
+	}
+	if path != "/bucket/exports/vm.qcow2" {
+		t.Errorf("bad object path %q", path)
+	}
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request") {
+		t.Errorf("bad Authorization header %q", auth)
+	}
+
+	if err := Upload(nil, srv.URL+"/bucket/exports/vm.qcow2", creds, bytes.NewBuffer(data), int64(len(data))-1); err == nil {
+		t.Errorf("Upload() didn't fail for a short body")
+	}
+	if err := Upload(nil, "ftp://example.com/bucket/vm.qcow2", creds, bytes.NewBuffer(data), int64(len(data))); err == nil {
+		t.Errorf("Upload() didn't fail for a bad url scheme")
+	}
+}
@@ -29,6 +29,8 @@ import (
 	"golang.org/x/sync/syncmap"
 
 	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
 )
 
 // UnixServer listens for connections from qemu instances and sends its
@@ -42,8 +44,11 @@ type UnixServer struct {
 	UnixConnections *syncmap.Map
 
 	outputReaders    map[string][]chan []byte
+	logReopeners     map[string]chan struct{}
 	outputReadersMux sync.Mutex
 
+	logRateLimit LogRateLimit
+
 	workersWG sync.WaitGroup
 }
 
@@ -57,6 +62,7 @@ func NewUnixServer(socketPath, kubernetesDir string) *UnixServer {
 	}
 	u.UnixConnections = new(syncmap.Map)
 	u.outputReaders = map[string][]chan []byte{}
+	u.logReopeners = map[string]chan struct{}{}
 	u.closeCh = make(chan bool)
 	u.listenDone = make(chan bool)
 	return &u
@@ -69,14 +75,14 @@ func (u *UnixServer) Listen() {
 		u.listenDone <- true
 	}()
 
-	l, err := net.ListenUnix("unix", &net.UnixAddr{u.SocketPath, "unix"})
+	l, fi, err := utils.ListenUnix(u.SocketPath)
 	if err != nil {
 		glog.Error("listen error:", err)
 		return
 	}
 	defer func() {
 		l.Close()
-		u.cleanup()
+		u.cleanup(fi)
 	}()
 
 	for {
@@ -122,13 +128,18 @@ func (u *UnixServer) Listen() {
 
 		logChan := make(chan []byte)
 		u.AddOutputReader(containerID, logChan)
+		reopenCh := make(chan struct{}, 1)
+		u.outputReadersMux.Lock()
+		u.logReopeners[containerID] = reopenCh
+		rateLimit := u.logRateLimit
+		u.outputReadersMux.Unlock()
 		u.workersWG.Add(1)
 		go u.reader(containerID, &u.workersWG)
 
 		fileName := fmt.Sprintf("%s_%s.log", containerName, attempt)
 		outputFile := filepath.Join(u.kubernetesDir, podUID, fileName)
 		u.workersWG.Add(1)
-		go NewLogWriter(logChan, outputFile, &u.workersWG)
+		go NewLogWriter(logChan, outputFile, reopenCh, rateLimit, &u.workersWG)
 	}
 }
 
@@ -168,6 +179,7 @@ func (u *UnixServer) reader(containerID string, wg *sync.WaitGroup) {
 		close(reader)
 	}
 	delete(u.outputReaders, containerID)
+	delete(u.logReopeners, containerID)
 	u.outputReadersMux.Unlock()
 
 	glog.V(1).Infof("Stream reader for container '%s' stopped gracefully", containerID)
@@ -181,8 +193,10 @@ func (u *UnixServer) Stop() {
 	glog.V(1).Info("UnixSocket Listener stopped")
 }
 
-func (u *UnixServer) cleanup() {
-	os.Remove(u.SocketPath)
+func (u *UnixServer) cleanup(fi os.FileInfo) {
+	if err := utils.RemoveSocket(u.SocketPath, fi); err != nil {
+		glog.Warningf("Can't remove socket %q: %v", u.SocketPath, err)
+	}
 	u.UnixConnections.Range(func(key, conObj interface{}) bool {
 		conn := conObj.(*net.UnixConn)
 		conn.Close()
@@ -190,6 +204,43 @@ func (u *UnixServer) cleanup() {
 	})
 }
 
+// SetLogRateLimit sets the rate limit for the console logs
+// of the VMs that connect after this call
+func (u *UnixServer) SetLogRateLimit(limit LogRateLimit) {
+	u.outputReadersMux.Lock()
+	defer u.outputReadersMux.Unlock()
+	u.logRateLimit = limit
+}
+
+// ReopenLog makes the log writer of the specified container
+// reopen its log file
+func (u *UnixServer) ReopenLog(containerID string) error {
+	u.outputReadersMux.Lock()
+	defer u.outputReadersMux.Unlock()
+	reopenCh, ok := u.logReopeners[containerID]
+	if !ok {
+		return fmt.Errorf("no console log writer for container %q", containerID)
+	}
+	select {
+	case reopenCh <- struct{}{}:
+	default:
+		// there's already a pending reopen request
+	}
+	return nil
+}
+
+// ReopenAllLogs makes all of the log writers reopen their log files
+func (u *UnixServer) ReopenAllLogs() {
+	u.outputReadersMux.Lock()
+	defer u.outputReadersMux.Unlock()
+	for _, reopenCh := range u.logReopeners {
+		select {
+		case reopenCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
 // AddOutputReader adds a new channel for containerID to send stdout
 func (u *UnixServer) AddOutputReader(containerID string, newChan chan []byte) {
 	u.outputReadersMux.Lock()
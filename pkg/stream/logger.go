@@ -19,7 +19,7 @@ package stream
 import (
 	"bytes"
 	"encoding/json"
-	"io"
+	"fmt"
 	"os"
 	"sync"
 	"time"
@@ -27,48 +27,160 @@ import (
 	"github.com/golang/glog"
 )
 
-// NewLogWritter writes the lines from stdout channel in logFile in k8s format
-func NewLogWriter(stdout <-chan []byte, logFile string, wg *sync.WaitGroup) {
-	defer wg.Done()
-	glog.V(1).Info("Spawned new log writer. Log file:", logFile)
-	if _, err := os.Stat(logFile); os.IsNotExist(err) {
-		file, err := os.Create(logFile)
-		if err != nil {
-			glog.Warningln("Failed to create output file:", err)
-			return
+// partialLineTimeout is the time after which an unfinished line
+// such as a login prompt is written to the log as a separate line
+// so it can be seen while following the log
+var partialLineTimeout = 200 * time.Millisecond
+
+// LogRateLimit limits the rate at which console lines are written
+// to the container log so a guest flooding its serial console
+// can't fill up the node disk
+type LogRateLimit struct {
+	// LinesPerSecond is the sustained number of lines per
+	// second. Zero value disables the limit
+	LinesPerSecond int
+	// Burst is the number of lines that may be written at once
+	// after the log has been idle for some time
+	Burst int
+}
+
+type lineLimiter struct {
+	limit   LogRateLimit
+	tokens  float64
+	last    time.Time
+	dropped int
+	now     func() time.Time
+}
+
+func newLineLimiter(limit LogRateLimit) *lineLimiter {
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &lineLimiter{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		now:    time.Now,
+	}
+}
+
+// allow returns true if the next line may be written and
+// false if it must be dropped
+func (l *lineLimiter) allow() bool {
+	if l.limit.LinesPerSecond <= 0 {
+		return true
+	}
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.limit.LinesPerSecond)
+		if l.tokens > float64(l.limit.Burst) {
+			l.tokens = float64(l.limit.Burst)
 		}
-		file.Close()
 	}
+	l.last = now
+	if l.tokens < 1 {
+		l.dropped++
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// takeDropped returns the number of lines dropped since
+// the previous call
+func (l *lineLimiter) takeDropped() int {
+	n := l.dropped
+	l.dropped = 0
+	return n
+}
+
+func openLogFile(logFile string) (*os.File, error) {
+	return os.OpenFile(logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
 
-	f, err := os.OpenFile(logFile, os.O_WRONLY, 0777)
+// NewLogWriter writes the lines from stdout channel in logFile in k8s format.
+// The file is reopened each time a value is received from reopenCh, which
+// makes it possible to rotate the log. The lines exceeding rateLimit are
+// dropped and replaced with a line telling how many of them were lost
+func NewLogWriter(stdout <-chan []byte, logFile string, reopenCh <-chan struct{}, rateLimit LogRateLimit, wg *sync.WaitGroup) {
+	defer wg.Done()
+	glog.V(1).Info("Spawned new log writer. Log file:", logFile)
+	f, err := openLogFile(logFile)
 	if err != nil {
 		glog.Error("Failed to open output file:", err)
 		return
 	}
-	defer f.Close()
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+
+	limiter := newLineLimiter(rateLimit)
+	writeLine := func(line string) error {
+		if f == nil {
+			return nil
+		}
+		if !limiter.allow() {
+			return nil
+		}
+		if n := limiter.takeDropped(); n != 0 {
+			if err := writeLog(f, fmt.Sprintf("[virtlet: %d console line(s) dropped due to rate limiting]\n", n)); err != nil {
+				return err
+			}
+		}
+		return writeLog(f, line)
+	}
 
 	buffer := bytes.NewBufferString("")
-	for data := range stdout {
-		buffer.Write(data)
-		for {
-			line, err := buffer.ReadString('\n')
-			if err != nil {
-				// if EOF then write data back to buffer. It's unfinished line
-				if err == io.EOF {
+	partialTimer := time.NewTimer(partialLineTimeout)
+	partialTimer.Stop()
+	defer partialTimer.Stop()
+	for {
+		select {
+		case data, ok := <-stdout:
+			if !ok {
+				if buffer.Len() != 0 {
+					writeLine(buffer.String() + "\n")
+				}
+				glog.V(1).Info("Log writter stopped. Finished logging to file:", logFile)
+				return
+			}
+			buffer.Write(data)
+			for {
+				line, err := buffer.ReadString('\n')
+				if err != nil {
+					// EOF means unfinished line, write it back to buffer
 					buffer.WriteString(line)
 					break
-				} else {
-					glog.Error("Error when reading from buffer:", err)
 				}
-
+				if err := writeLine(line); err != nil {
+					f.Close()
+					f = nil
+				}
+			}
+			partialTimer.Stop()
+			if buffer.Len() != 0 {
+				partialTimer.Reset(partialLineTimeout)
+			}
+		case <-partialTimer.C:
+			if buffer.Len() != 0 {
+				if err := writeLine(buffer.String() + "\n"); err != nil {
+					f.Close()
+					f = nil
+				}
+				buffer.Reset()
+			}
+		case <-reopenCh:
+			glog.V(1).Info("Reopening log file:", logFile)
+			if f != nil {
+				f.Close()
 			}
-			err = writeLog(f, line)
-			if err != nil {
-				break
+			if f, err = openLogFile(logFile); err != nil {
+				glog.Error("Failed to reopen output file:", err)
+				f = nil
 			}
 		}
 	}
-	glog.V(1).Info("Log writter stopped. Finished logging to file:", logFile)
 }
 
 func writeLog(f *os.File, line string) error {
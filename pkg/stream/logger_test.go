@@ -18,10 +18,12 @@ package stream
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
@@ -46,7 +48,8 @@ func verifyJsonLines(t *testing.T, filePath string, lines []map[string]interface
 	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
-	for n := 0; scanner.Scan(); n++ {
+	n := 0
+	for ; scanner.Scan(); n++ {
 		l := scanner.Text()
 		if n >= len(lines) {
 			t.Errorf("excess line in the log: %q", l)
@@ -81,6 +84,9 @@ func verifyJsonLines(t *testing.T, filePath string, lines []map[string]interface
 	if err := scanner.Err(); err != nil {
 		t.Errorf("error reading the output file: %v", err)
 	}
+	if n < len(lines) {
+		t.Errorf("too few lines in the log: %d instead of %d", n, len(lines))
+	}
 }
 
 func TestLoggingInNewLogWritter(t *testing.T) {
@@ -150,7 +156,7 @@ func TestLoggingInNewLogWritter(t *testing.T) {
 		t.Logf("Running `%s` test", test.name)
 		defer os.RemoveAll(test.outputFile)
 		wg.Add(1)
-		go NewLogWriter(test.c, test.outputFile, &wg)
+		go NewLogWriter(test.c, test.outputFile, nil, LogRateLimit{}, &wg)
 		for _, line := range test.lines {
 			test.c <- line
 		}
@@ -160,3 +166,109 @@ func TestLoggingInNewLogWritter(t *testing.T) {
 		verifyJsonLines(t, test.outputFile, test.jsonLines)
 	}
 }
+
+func TestLineLimiter(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newLineLimiter(LogRateLimit{LinesPerSecond: 2, Burst: 3})
+	l.now = func() time.Time { return now }
+
+	var allowed []bool
+	for _, step := range []time.Duration{0, 0, 0, 0, 0, 500 * time.Millisecond, 0, time.Second, 0, 0} {
+		now = now.Add(step)
+		allowed = append(allowed, l.allow())
+	}
+	expected := []bool{true, true, true, false, false, true, false, true, true, false}
+	if !reflect.DeepEqual(allowed, expected) {
+		t.Errorf("bad limiter result: %v instead of %v", allowed, expected)
+	}
+	if n := l.takeDropped(); n != 4 {
+		t.Errorf("bad dropped count: %d instead of 4", n)
+	}
+	if n := l.takeDropped(); n != 0 {
+		t.Errorf("dropped count not reset: %d", n)
+	}
+}
+
+func TestLogRateLimit(t *testing.T) {
+	var wg sync.WaitGroup
+	outputFile := setupTmpLogFile("test1")
+	defer os.RemoveAll(filepath.Dir(outputFile))
+
+	c := make(chan []byte)
+	wg.Add(1)
+	// the sustained rate is too low to matter during the test
+	go NewLogWriter(c, outputFile, nil, LogRateLimit{LinesPerSecond: 1, Burst: 2}, &wg)
+	c <- []byte("l1\nl2\nl3\nl4\n")
+	close(c)
+	wg.Wait()
+
+	// the dropped lines are reported when the next
+	// line is allowed, that is, not within this test
+	verifyJsonLines(t, outputFile, []map[string]interface{}{
+		{"log": "l1\n"},
+		{"log": "l2\n"},
+	})
+}
+
+func TestPartialLine(t *testing.T) {
+	savedTimeout := partialLineTimeout
+	partialLineTimeout = 10 * time.Millisecond
+	defer func() { partialLineTimeout = savedTimeout }()
+
+	var wg sync.WaitGroup
+	outputFile := setupTmpLogFile("test1")
+	defer os.RemoveAll(filepath.Dir(outputFile))
+
+	c := make(chan []byte)
+	wg.Add(1)
+	go NewLogWriter(c, outputFile, nil, LogRateLimit{}, &wg)
+	c <- []byte("Welcome\nlogin: ")
+	waitForLogLines(t, outputFile, 2)
+	c <- []byte("root\n")
+	close(c)
+	wg.Wait()
+
+	verifyJsonLines(t, outputFile, []map[string]interface{}{
+		{"log": "Welcome\n"},
+		{"log": "login: \n"},
+		{"log": "root\n"},
+	})
+}
+
+func TestReopenLog(t *testing.T) {
+	var wg sync.WaitGroup
+	outputFile := setupTmpLogFile("test1")
+	defer os.RemoveAll(filepath.Dir(outputFile))
+
+	c := make(chan []byte)
+	reopenCh := make(chan struct{})
+	wg.Add(1)
+	go NewLogWriter(c, outputFile, reopenCh, LogRateLimit{}, &wg)
+	c <- []byte("before rotation\n")
+	waitForLogLines(t, outputFile, 1)
+	rotatedFile := outputFile + ".1"
+	if err := os.Rename(outputFile, rotatedFile); err != nil {
+		t.Fatalf("Rename(): %v", err)
+	}
+	reopenCh <- struct{}{}
+	c <- []byte("after rotation\n")
+	close(c)
+	wg.Wait()
+
+	verifyJsonLines(t, rotatedFile, []map[string]interface{}{
+		{"log": "before rotation\n"},
+	})
+	verifyJsonLines(t, outputFile, []map[string]interface{}{
+		{"log": "after rotation\n"},
+	})
+}
+
+func waitForLogLines(t *testing.T, filePath string, n int) {
+	for i := 0; i < 500; i++ {
+		if data, err := ioutil.ReadFile(filePath); err == nil && bytes.Count(data, []byte("\n")) >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d line(s) in %q", n, filePath)
+}
@@ -69,6 +69,23 @@ func NewServer(kubernetesDir, socketPath string, metadataStore metadata.Metadata
 	return s, nil
 }
 
+// SetLogRateLimit sets the rate limit for VM console logs
+func (s *Server) SetLogRateLimit(limit LogRateLimit) {
+	s.unixServer.SetLogRateLimit(limit)
+}
+
+// ReopenContainerLog makes Virtlet reopen the console log
+// file of the specified container, e.g. after it has been rotated
+func (s *Server) ReopenContainerLog(containerID string) error {
+	return s.unixServer.ReopenLog(containerID)
+}
+
+// ReopenAllContainerLogs reopens the console log files of
+// all of the running containers
+func (s *Server) ReopenAllContainerLogs() {
+	s.unixServer.ReopenAllLogs()
+}
+
 // Start starts streaming server gorutine and unixServer gorutine
 func (s *Server) Start() error {
 	if err := syscall.Unlink(s.unixServer.SocketPath); err != nil && !os.IsNotExist(err) {
@@ -0,0 +1,85 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/audit"
+)
+
+// PodAuthorizer checks whether the user identified by the bearer
+// token is allowed to access the network of the specified pod using
+// one of the tapmanager APIs that are exposed as pod subresources.
+// The authorizer returned by manager.NewK8sPodAuthorizer() implements
+// this interface
+type PodAuthorizer interface {
+	// Authorize returns the name of the user if the access is
+	// allowed and an error otherwise
+	Authorize(token, namespace, name, subresource string) (string, error)
+}
+
+func bearerToken(r *http.Request) string {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
+
+// authorizePodRequest checks the bearer token of the request using
+// the authorizer for the subresource of the pod that's specified
+// either by its id or by its namespace and name, and returns the
+// namespace and the name of the pod together with the name of the
+// user. The pods specified by namespace and name are only looked up
+// after the access is granted, so the users can't find out whether
+// the pods they have no access to exist. If the access is denied,
+// the denial is recorded in the audit log under the specified
+// operation name, the error response is written and false is
+// returned
+func (s *TapFDSource) authorizePodRequest(w http.ResponseWriter, r *http.Request, authorizer PodAuthorizer, auditLog *audit.Log, operation, subresource, podId, podNs, podName string) (string, string, string, bool) {
+	token := bearerToken(r)
+	if token == "" {
+		http.Error(w, "bearer token must be specified", http.StatusUnauthorized)
+		return "", "", "", false
+	}
+	if podId != "" {
+		// pod ids can't be guessed, so looking them up
+		// before checking the access reveals nothing
+		s.Lock()
+		_, pn := s.findPodNetwork(podId, "", "")
+		if pn != nil {
+			podNs, podName = pn.pnd.PodNs, pn.pnd.PodName
+		}
+		s.Unlock()
+		if pn == nil {
+			http.Error(w, errPodNotFound.Error(), http.StatusNotFound)
+			return "", "", "", false
+		}
+	}
+	user, err := authorizer.Authorize(token, podNs, podName, subresource)
+	if err != nil {
+		glog.Warningf("Access to pods/%s of %s/%s denied: %v", subresource, podNs, podName, err)
+		auditLog.Record(operation, r.RemoteAddr, podNs+"/"+podName, err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return "", "", "", false
+	}
+	return podNs, podName, user, true
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	defaultCNIDelAttempts       = 4
+	defaultCNIDelInitialBackoff = 500 * time.Millisecond
+	cniDelMaxBackoff            = 10 * time.Second
+	pendingCNIDelSuffix         = ".json"
+)
+
+// pendingCNIDel describes a CNI DEL operation that failed
+// and needs to be retried later so the resources held
+// by CNI plugins such as IP addresses are released
+type pendingCNIDel struct {
+	PodId   string `json:"podId"`
+	PodName string `json:"podName"`
+	PodNs   string `json:"podNs"`
+	// Network is the name of an additional network the
+	// pod was attached to. It's empty for the primary network
+	Network string `json:"network,omitempty"`
+	// IfName is the name of the pod interface for an
+	// additional network
+	IfName string `json:"ifName,omitempty"`
+	// ConfigFiles lists CNI configuration files of the networks
+	// selected for the pod instead of the default one
+	ConfigFiles []string `json:"configFiles,omitempty"`
+}
+
+func (d pendingCNIDel) String() string {
+	if d.Network == "" {
+		return fmt.Sprintf("pod %s (%s)", d.PodName, d.PodId)
+	}
+	return fmt.Sprintf("pod %s (%s) network %q", d.PodName, d.PodId, d.Network)
+}
+
+func (d pendingCNIDel) fileName() string {
+	if d.Network == "" {
+		return d.PodId + pendingCNIDelSuffix
+	}
+	return d.PodId + "_" + d.IfName + pendingCNIDelSuffix
+}
+
+// SetPendingCNIDelDir sets the directory for keeping the records
+// of CNI DEL operations that failed after all the retries. With
+// the directory set, pod network teardown proceeds with the local
+// cleanup upon such failures instead of returning an error, and
+// the operations are retried by RunCNIDelReconciler(). Empty value
+// (the default) disables this
+func (s *TapFDSource) SetPendingCNIDelDir(dir string) {
+	s.pendingCNIDelDir = dir
+}
+
+// SetCNIDelRetry sets the number of attempts made for CNI DEL
+// operations and the delay before the first retry. The delay
+// is doubled for each subsequent retry. Note that the retries
+// are done while the pod network is being released
+func (s *TapFDSource) SetCNIDelRetry(attempts int, initialBackoff time.Duration) {
+	s.cniDelAttempts = attempts
+	s.cniDelInitialBackoff = initialBackoff
+}
+
+func (s *TapFDSource) doCNIDel(d pendingCNIDel) error {
+	switch {
+	case d.Network != "":
+		return s.cniClient.RemoveSandboxFromNamedNetwork(context.Background(), d.Network, d.IfName, d.PodId, d.PodName, d.PodNs)
+	case len(d.ConfigFiles) != 0:
+		return s.cniClient.RemoveSandboxFromNetworks(context.Background(), d.ConfigFiles, d.PodId, d.PodName, d.PodNs)
+	}
+	return s.cniClient.RemoveSandboxFromNetwork(context.Background(), d.PodId, d.PodName, d.PodNs)
+}
+
+// cniDelWithRetry removes the pod from CNI network retrying
+// the operation with exponential backoff
+func (s *TapFDSource) cniDelWithRetry(d pendingCNIDel) error {
+	backoff := s.cniDelInitialBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = s.doCNIDel(d); err == nil || attempt >= s.cniDelAttempts {
+			return err
+		}
+		glog.Warningf("CNI DEL for %s failed (attempt %d of %d), retrying in %v: %v", d, attempt, s.cniDelAttempts, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > cniDelMaxBackoff {
+			backoff = cniDelMaxBackoff
+		}
+	}
+}
+
+// removeFromCNINetwork removes the pod from CNI network. If it
+// keeps failing and the pending CNI DEL directory is set, the
+// operation is recorded there for later retry and nil is returned
+func (s *TapFDSource) removeFromCNINetwork(d pendingCNIDel) error {
+	err := s.cniDelWithRetry(d)
+	if err == nil || s.pendingCNIDelDir == "" {
+		return err
+	}
+	glog.Errorf("CNI DEL for %s failed, will retry it later: %v", d, err)
+	if saveErr := s.savePendingCNIDel(d); saveErr != nil {
+		return fmt.Errorf("%v (also failed to record pending CNI DEL: %v)", err, saveErr)
+	}
+	return nil
+}
+
+func (s *TapFDSource) savePendingCNIDel(d pendingCNIDel) error {
+	if err := os.MkdirAll(s.pendingCNIDelDir, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	// write the record atomically so a partially written
+	// file isn't seen by the reconciler
+	path := filepath.Join(s.pendingCNIDelDir, d.fileName())
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// RetryPendingCNIDels retries the CNI DEL operations recorded
+// in the pending CNI DEL directory, removing the records
+// of the operations that succeed
+func (s *TapFDSource) RetryPendingCNIDels() {
+	if s.pendingCNIDelDir == "" {
+		return
+	}
+	files, err := ioutil.ReadDir(s.pendingCNIDelDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("Can't read pending CNI DEL dir: %v", err)
+		}
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() || !strings.HasSuffix(fi.Name(), pendingCNIDelSuffix) {
+			continue
+		}
+		path := filepath.Join(s.pendingCNIDelDir, fi.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			glog.Warningf("Can't read pending CNI DEL record %q: %v", path, err)
+			continue
+		}
+		var d pendingCNIDel
+		if err := json.Unmarshal(data, &d); err != nil || d.PodId == "" {
+			glog.Errorf("Removing bad pending CNI DEL record %q: %q", path, data)
+			os.Remove(path)
+			continue
+		}
+		if err := s.doCNIDel(d); err != nil {
+			glog.Warningf("Pending CNI DEL for %s failed: %v", d, err)
+			continue
+		}
+		glog.V(1).Infof("Pending CNI DEL for %s succeeded", d)
+		if err := os.Remove(path); err != nil {
+			glog.Warningf("Can't remove pending CNI DEL record %q: %v", path, err)
+		}
+	}
+}
+
+// RunCNIDelReconciler retries pending CNI DEL operations
+// right away and then periodically with the specified interval
+// until stopCh is closed
+func (s *TapFDSource) RunCNIDelReconciler(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.RetryPendingCNIDels()
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+)
+
+// failingCNIClient is a CNIClient which fails the specified
+// number of CNI DEL operations before starting to succeed
+type failingCNIClient struct {
+	cni.CNIClient
+	failures int
+	dels     []string
+}
+
+func (c *failingCNIClient) del(what string) error {
+	c.dels = append(c.dels, what)
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("etcd is unavailable")
+	}
+	return nil
+}
+
+func (c *failingCNIClient) RemoveSandboxFromNetwork(ctx context.Context, podId, podName, podNs string) error {
+	return c.del(podId)
+}
+
+func (c *failingCNIClient) RemoveSandboxFromNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNs string) error {
+	return c.del(podId + "/" + network)
+}
+
+func TestCNIDelRetry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pending-cni-del")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	primary := pendingCNIDel{PodId: "pod1", PodName: "vm1", PodNs: "default"}
+	extra := pendingCNIDel{PodId: "pod1", PodName: "vm1", PodNs: "default", Network: "extra", IfName: "virtlet-eth1"}
+	for _, tc := range []struct {
+		name             string
+		failures         int
+		pendingDir       string
+		del              pendingCNIDel
+		expectedDels     []string
+		expectError      bool
+		expectedPending  []string
+		expectedAllDels  []string
+		expectedLeftover []string
+	}{
+		{
+			name:            "success after retries",
+			failures:        2,
+			del:             primary,
+			expectedDels:    []string{"pod1", "pod1", "pod1"},
+			expectedAllDels: []string{"pod1", "pod1", "pod1"},
+		},
+		{
+			name:            "failure without pending dir",
+			failures:        10,
+			del:             primary,
+			expectedDels:    []string{"pod1", "pod1", "pod1"},
+			expectError:     true,
+			expectedAllDels: []string{"pod1", "pod1", "pod1"},
+		},
+		{
+			name:            "failure recorded and retried later",
+			failures:        3,
+			pendingDir:      tmpDir,
+			del:             extra,
+			expectedDels:    []string{"pod1/extra", "pod1/extra", "pod1/extra"},
+			expectedPending: []string{"pod1_virtlet-eth1.json"},
+			expectedAllDels: []string{"pod1/extra", "pod1/extra", "pod1/extra", "pod1/extra"},
+		},
+		{
+			name:             "pending record kept while CNI DEL keeps failing",
+			failures:         10,
+			pendingDir:       tmpDir,
+			del:              primary,
+			expectedDels:     []string{"pod1", "pod1", "pod1"},
+			expectedPending:  []string{"pod1.json"},
+			expectedAllDels:  []string{"pod1", "pod1", "pod1", "pod1"},
+			expectedLeftover: []string{"pod1.json"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &failingCNIClient{failures: tc.failures}
+			s := &TapFDSource{cniClient: c}
+			s.SetCNIDelRetry(3, 0)
+			s.SetPendingCNIDelDir(tc.pendingDir)
+			defer func() {
+				if tc.pendingDir != "" {
+					os.RemoveAll(tc.pendingDir)
+				}
+			}()
+
+			err := s.removeFromCNINetwork(tc.del)
+			switch {
+			case tc.expectError && err == nil:
+				t.Errorf("didn't get an expected error")
+			case !tc.expectError && err != nil:
+				t.Errorf("removeFromCNINetwork(): %v", err)
+			}
+			if !reflect.DeepEqual(c.dels, tc.expectedDels) {
+				t.Errorf("bad CNI DEL calls: %v instead of %v", c.dels, tc.expectedDels)
+			}
+			if pending := listDir(t, tc.pendingDir); !reflect.DeepEqual(pending, tc.expectedPending) {
+				t.Errorf("bad pending CNI DEL records: %v instead of %v", pending, tc.expectedPending)
+			}
+
+			s.RetryPendingCNIDels()
+			if !reflect.DeepEqual(c.dels, tc.expectedAllDels) {
+				t.Errorf("bad CNI DEL calls after the retry: %v instead of %v", c.dels, tc.expectedAllDels)
+			}
+			if pending := listDir(t, tc.pendingDir); !reflect.DeepEqual(pending, tc.expectedLeftover) {
+				t.Errorf("bad pending CNI DEL records after the retry: %v instead of %v", pending, tc.expectedLeftover)
+			}
+		})
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	if dir == "" {
+		return nil
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("Glob(): %v", err)
+	}
+	var r []string
+	for _, m := range matches {
+		r = append(r, filepath.Base(m))
+	}
+	return r
+}
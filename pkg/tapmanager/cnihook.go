@@ -0,0 +1,135 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+)
+
+const defaultCNIResultHookTimeout = 30 * time.Second
+
+// CNIResultHook adjusts CNI results before they're applied to the
+// pod network. It can be used to handle deployment-specific quirks,
+// such as rewriting DNS settings, adding routes or changing the
+// gateway
+type CNIResultHook interface {
+	// AdjustCNIResult returns the adjusted CNI result for the pod.
+	// network is the name of CNI network for the networks
+	// attached using AttachNetwork(), and an empty string
+	// otherwise. The hook must not change the list of interfaces
+	AdjustCNIResult(pnd *PodNetworkDesc, network string, result *cnicurrent.Result) (*cnicurrent.Result, error)
+}
+
+// ExecCNIResultHook is a CNIResultHook that runs an external
+// program. The program gets the CNI result as JSON on its stdin
+// and writes the adjusted result to its stdout. Empty output means
+// that the result is left as is. The pod is identified by
+// VIRTLET_POD_ID, VIRTLET_POD_NAME and VIRTLET_POD_NAMESPACE
+// environment variables, and VIRTLET_CNI_NETWORK contains the
+// name of the network being attached, if any
+type ExecCNIResultHook struct {
+	path    string
+	timeout time.Duration
+}
+
+var _ CNIResultHook = &ExecCNIResultHook{}
+
+// NewExecCNIResultHook returns an ExecCNIResultHook for the
+// specified program
+func NewExecCNIResultHook(path string) *ExecCNIResultHook {
+	return &ExecCNIResultHook{path: path, timeout: defaultCNIResultHookTimeout}
+}
+
+// AdjustCNIResult implements AdjustCNIResult method of
+// CNIResultHook interface
+func (h *ExecCNIResultHook) AdjustCNIResult(pnd *PodNetworkDesc, network string, result *cnicurrent.Result) (*cnicurrent.Result, error) {
+	in, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling CNI result: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.path)
+	cmd.Env = append(os.Environ(),
+		"VIRTLET_POD_ID="+pnd.PodId,
+		"VIRTLET_POD_NAME="+pnd.PodName,
+		"VIRTLET_POD_NAMESPACE="+pnd.PodNs,
+		"VIRTLET_CNI_NETWORK="+network)
+	cmd.Stdin = bytes.NewReader(in)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("CNI result hook %q timed out after %v", h.path, h.timeout)
+		}
+		return nil, fmt.Errorf("CNI result hook %q failed: %v: %s", h.path, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return result, nil
+	}
+	var adjusted cnicurrent.Result
+	if err := json.Unmarshal(stdout.Bytes(), &adjusted); err != nil {
+		return nil, fmt.Errorf("error parsing the output of CNI result hook %q: %v", h.path, err)
+	}
+	if err := validateAdjustedCNIResult(result, &adjusted); err != nil {
+		return nil, fmt.Errorf("bad output of CNI result hook %q: %v", h.path, err)
+	}
+	return &adjusted, nil
+}
+
+// validateAdjustedCNIResult makes sure that the hook didn't change
+// the interfaces, which must match the links created by CNI plugins
+func validateAdjustedCNIResult(orig, adjusted *cnicurrent.Result) error {
+	if len(orig.Interfaces) != len(adjusted.Interfaces) {
+		return fmt.Errorf("the number of interfaces changed from %d to %d", len(orig.Interfaces), len(adjusted.Interfaces))
+	}
+	for i, iface := range orig.Interfaces {
+		if adjusted.Interfaces[i] == nil || adjusted.Interfaces[i].Name != iface.Name || adjusted.Interfaces[i].Sandbox != iface.Sandbox {
+			return fmt.Errorf("interface %d (%q) changed", i, iface.Name)
+		}
+	}
+	for _, ipConfig := range adjusted.IPs {
+		if ipConfig.Interface >= len(adjusted.Interfaces) {
+			return fmt.Errorf("bad interface index %d for address %s", ipConfig.Interface, ipConfig.Address.String())
+		}
+	}
+	return nil
+}
+
+// adjustCNIResult passes the CNI result through the hook, if any
+func (s *TapFDSource) adjustCNIResult(pnd *PodNetworkDesc, network string, result *cnicurrent.Result) (*cnicurrent.Result, error) {
+	if s.cniResultHook == nil {
+		return result, nil
+	}
+	adjusted, err := s.cniResultHook.AdjustCNIResult(pnd, network, result)
+	if err != nil {
+		return nil, fmt.Errorf("error adjusting CNI result for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+	}
+	return adjusted, nil
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/Mirantis/virtlet/tests/cnifixture"
+)
+
+func TestExecCNIResultHook(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "cni-hook")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	pnd := &PodNetworkDesc{
+		PodId:   "69eec606-0493-11e7-bfb6-0242ac110002",
+		PodNs:   "default",
+		PodName: "foo",
+	}
+	gw := net.IPv4(10, 1, 90, 1)
+	result := cnifixture.NewResult().
+		Interface("eth0", cnifixture.MAC(0)).
+		InSandbox("/var/run/netns/bae464f1-6ee7-4ee2-826e-33293a9de95e").
+		IP("10.1.90.5/24", gw.String()).
+		DNS("10.96.0.10").
+		Result()
+
+	for _, tc := range []struct {
+		name        string
+		script      string
+		nameservers []string
+		routeCount  int
+		err         string
+	}{
+		{
+			name:        "unchanged",
+			script:      "cat >/dev/null",
+			nameservers: []string{"10.96.0.10"},
+		},
+		{
+			name:        "rewrite",
+			script:      `sed 's/"10\.96\.0\.10"/"'$VIRTLET_POD_NAMESPACE'-dns"/;s/"dns":/"routes":[{"dst":"10.10.0.0\/16","gw":"10.1.90.254"}],&/'`,
+			nameservers: []string{"default-dns"},
+			routeCount:  1,
+		},
+		{
+			name:   "failure",
+			script: "echo 'no way' >&2; exit 1",
+			err:    "no way",
+		},
+		{
+			name:   "bad json",
+			script: "echo '{'",
+			err:    "error parsing the output",
+		},
+		{
+			name:   "interfaces removed",
+			script: `echo '{"cniVersion":"0.3.1"}'`,
+			err:    "the number of interfaces changed",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hookPath := filepath.Join(tmpDir, strings.Replace(tc.name, " ", "-", -1))
+			if err := ioutil.WriteFile(hookPath, []byte("#!/bin/sh\n"+tc.script+"\n"), 0755); err != nil {
+				t.Fatalf("WriteFile(): %v", err)
+			}
+			orig := *result
+			s := &TapFDSource{}
+			s.SetCNIResultHook(NewExecCNIResultHook(hookPath))
+			adjusted, err := s.adjustCNIResult(pnd, "", &orig)
+			switch {
+			case tc.err != "" && err == nil:
+				t.Fatalf("didn't get an error")
+			case tc.err != "":
+				if !strings.Contains(err.Error(), tc.err) {
+					t.Errorf("bad error message %q (expected it to contain %q)", err, tc.err)
+				}
+				return
+			case err != nil:
+				t.Fatalf("adjustCNIResult(): %v", err)
+			}
+			if strings.Join(adjusted.DNS.Nameservers, ",") != strings.Join(tc.nameservers, ",") {
+				t.Errorf("bad nameservers: expected %v, got %v", tc.nameservers, adjusted.DNS.Nameservers)
+			}
+			if len(adjusted.Routes) != tc.routeCount {
+				t.Errorf("bad routes: %#v", adjusted.Routes)
+			}
+			if len(adjusted.IPs) != 1 || !adjusted.IPs[0].Gateway.Equal(gw) {
+				t.Errorf("bad IPs: %#v", adjusted.IPs)
+			}
+		})
+	}
+}
+
+func TestNoCNIResultHook(t *testing.T) {
+	result := &cnicurrent.Result{}
+	s := &TapFDSource{}
+	adjusted, err := s.adjustCNIResult(&PodNetworkDesc{}, "", result)
+	if err != nil {
+		t.Fatalf("adjustCNIResult(): %v", err)
+	}
+	if adjusted != result {
+		t.Errorf("the result was changed without a hook")
+	}
+}
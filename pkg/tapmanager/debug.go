@@ -0,0 +1,119 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/dhcp"
+)
+
+// PodNetworkState describes the state of a pod network
+// that's kept by tapmanager. It's only intended
+// for debugging purposes
+type PodNetworkState struct {
+	// Key is the key of the pod network in fd server
+	Key string `json:"key"`
+	// PodId specifies the id of the pod
+	PodId string `json:"podId"`
+	// PodNs specifies the namespace of the pod
+	PodNs string `json:"podNs"`
+	// PodName specifies the name of the pod
+	PodName string `json:"podName"`
+	// NsPath specifies the path to the network namespace of the pod
+	NsPath string `json:"nsPath"`
+	// CNIResult is the network configuration returned by CNI
+	// plugins, including the additional networks
+	CNIResult *cnicurrent.Result `json:"cniResult,omitempty"`
+	// Interfaces describes VM network interfaces
+	Interfaces []InterfaceDescription `json:"interfaces"`
+	// FDs lists the numbers of file descriptors of the interfaces
+	// in the tapmanager process as they're passed to the VM
+	FDs []int `json:"fds"`
+	// VMStartCount is the number of times the fds were handed
+	// to a VM process
+	VMStartCount int `json:"vmStartCount"`
+	// VMRunning is true if the VM that has obtained the fds
+	// is running
+	VMRunning bool `json:"vmRunning"`
+	// ExtraNetworks lists CNI networks attached to the running VM
+	ExtraNetworks []string `json:"extraNetworks,omitempty"`
+	// DHCP maps VM interface hardware addresses to DHCP
+	// request counters
+	DHCP map[string]dhcp.InterfaceStats `json:"dhcp,omitempty"`
+}
+
+// DebugState returns the state of all the pod networks,
+// sorted by pod id. FDs fields of the returned items are
+// not filled in
+func (s *TapFDSource) DebugState() []PodNetworkState {
+	s.Lock()
+	defer s.Unlock()
+	var r []PodNetworkState
+	for key, pn := range s.fdMap {
+		st := PodNetworkState{
+			Key:          key,
+			PodId:        pn.pnd.PodId,
+			PodNs:        pn.pnd.PodNs,
+			PodName:      pn.pnd.PodName,
+			VMStartCount: pn.vmStartCount,
+			VMRunning:    pn.vmRunning,
+		}
+		if pn.csn != nil {
+			st.NsPath = pn.csn.NsPath
+			st.CNIResult = pn.csn.Result
+			st.Interfaces = interfaceInfo(pn.csn, pn.netdevs).Interfaces
+		}
+		for _, en := range pn.extraNetworks {
+			st.ExtraNetworks = append(st.ExtraNetworks, en.network)
+		}
+		if pn.dhcpServer != nil {
+			st.DHCP = pn.dhcpServer.Stats()
+		}
+		r = append(r, st)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].PodId < r[j].PodId })
+	return r
+}
+
+// NewDebugHandler returns an http.Handler that serves a JSON
+// dump of pod network state of tapmanager. It's not
+// authenticated, so it should be only served on the loopback
+// interface or a unix socket
+func NewDebugHandler(s *TapFDSource, fdServer *FDServer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := s.DebugState()
+		for n := range state {
+			// the pod network may be in the middle of setup,
+			// in which case it has no fds yet
+			if fds, err := fdServer.getFDs(state[n].Key); err == nil {
+				state[n].FDs = fds
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(state); err != nil {
+			glog.Warningf("Error writing tapmanager state: %v", err)
+		}
+	})
+}
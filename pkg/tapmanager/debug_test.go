@@ -0,0 +1,115 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+func TestDebugHandler(t *testing.T) {
+	csn := &nettools.ContainerSideNetwork{
+		Result: &cnicurrent.Result{
+			Interfaces: []*cnicurrent.Interface{
+				{
+					Name:    "eth0",
+					Mac:     "42:a4:a6:22:80:2e",
+					Sandbox: "/var/run/netns/foo",
+				},
+			},
+		},
+		NsPath: "/var/run/netns/foo",
+		Interfaces: []nettools.InterfaceDescription{
+			{
+				Type:         nettools.InterfaceTypeTap,
+				Name:         "eth0",
+				HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+				MTU:          1500,
+			},
+		},
+	}
+	src := &TapFDSource{
+		fdMap: map[string]*podNetwork{
+			"pod2": {
+				pnd: PodNetworkDesc{PodId: "pod2", PodNs: "default", PodName: "vm2"},
+			},
+			"pod1": {
+				pnd:          PodNetworkDesc{PodId: "pod1", PodNs: "default", PodName: "vm1"},
+				csn:          csn,
+				vmStartCount: 1,
+				vmRunning:    true,
+				netdevs:      []NetdevDescription{{FdIndex: 0, Netdev: "tap0", Device: "net0"}},
+				extraNetworks: []extraNetwork{
+					{network: "extra", ifName: "virtlet-eth1"},
+				},
+			},
+		},
+	}
+	fdServer := NewFDServer("/nonexistent", src)
+	fdServer.fds["pod1"] = []int{42}
+
+	w := httptest.NewRecorder()
+	NewDebugHandler(src, fdServer).ServeHTTP(w, httptest.NewRequest("GET", "/debug/state", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("bad content type %q", ct)
+	}
+
+	var state []PodNetworkState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatalf("can't unmarshal the state: %v", err)
+	}
+	expected := []PodNetworkState{
+		{
+			Key:       "pod1",
+			PodId:     "pod1",
+			PodNs:     "default",
+			PodName:   "vm1",
+			NsPath:    "/var/run/netns/foo",
+			CNIResult: csn.Result,
+			Interfaces: []InterfaceDescription{
+				{
+					Type:         nettools.InterfaceTypeTap,
+					HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+					FdIndex:      0,
+					Name:         "eth0",
+					MTU:          1500,
+					Netdev:       "tap0",
+					Device:       "net0",
+				},
+			},
+			FDs:           []int{42},
+			VMStartCount:  1,
+			VMRunning:     true,
+			ExtraNetworks: []string{"extra"},
+		},
+		{
+			Key:     "pod2",
+			PodId:   "pod2",
+			PodNs:   "default",
+			PodName: "vm2",
+		},
+	}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("bad state:\n%s", w.Body.String())
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	minSaneMTU = 576
+	maxSaneMTU = 9000
+
+	networkCheckPodNs   = "virtlet-network-check"
+	networkCheckPodName = "network-check"
+)
+
+// NetworkCheckInterface describes a single interface that was
+// set up during the network dry run
+type NetworkCheckInterface struct {
+	// Name is the interface name inside the pod network namespace
+	// (only set for SR-IOV interfaces)
+	Name string `json:"name,omitempty"`
+	// HardwareAddr is the MAC address of the interface
+	HardwareAddr string `json:"hardwareAddr,omitempty"`
+	// MTU is the MTU of the interface
+	MTU uint16 `json:"mtu"`
+}
+
+// NetworkCheckReport contains the result of the network dry run
+type NetworkCheckReport struct {
+	// Interfaces lists the interfaces that were set up
+	Interfaces []NetworkCheckInterface `json:"interfaces,omitempty"`
+	// IPs lists the addresses obtained from CNI
+	IPs []string `json:"ips,omitempty"`
+	// Routes lists the routes obtained from CNI in
+	// "dst via gw" form
+	Routes []string `json:"routes,omitempty"`
+	// PathMTU contains the results of path MTU probes
+	// for the interfaces that have a gateway
+	PathMTU []nettools.PathMTUReport `json:"pathMTU,omitempty"`
+	// Problems lists the problems found in the network
+	// configuration. It's empty if the configuration is ok
+	Problems []string `json:"problems,omitempty"`
+}
+
+// OK returns true if no problems were found during the check
+func (r *NetworkCheckReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *NetworkCheckReport) addProblem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// addPathMTUReports adds the results of path MTU probes to the
+// report, treating the interfaces with the MTU exceeding the path
+// MTU as problems
+func (r *NetworkCheckReport) addPathMTUReports(reports []nettools.PathMTUReport) {
+	for _, pr := range reports {
+		r.PathMTU = append(r.PathMTU, pr)
+		if pr.Exceeded() {
+			r.addProblem("%s", pr.String())
+		}
+	}
+}
+
+// NewNetworkCheckReport validates the container side network
+// configuration and returns a report describing it
+func NewNetworkCheckReport(csn *nettools.ContainerSideNetwork) *NetworkCheckReport {
+	r := &NetworkCheckReport{}
+	for _, iface := range csn.Interfaces {
+		ci := NetworkCheckInterface{Name: iface.Name, MTU: iface.MTU}
+		if iface.HardwareAddr != nil {
+			ci.HardwareAddr = iface.HardwareAddr.String()
+		}
+		r.Interfaces = append(r.Interfaces, ci)
+		if iface.MTU != 0 && (iface.MTU < minSaneMTU || iface.MTU > maxSaneMTU) {
+			r.addProblem("interface %d has MTU %d outside of sane range %d..%d", len(r.Interfaces)-1, iface.MTU, minSaneMTU, maxSaneMTU)
+		}
+	}
+	if len(r.Interfaces) == 0 {
+		r.addProblem("no interfaces were set up")
+	}
+
+	if csn.Result == nil {
+		r.addProblem("no CNI result")
+		return r
+	}
+
+	hasGateway := false
+	for _, ipConfig := range csn.Result.IPs {
+		if ipConfig.Address.IP == nil || ipConfig.Address.IP.IsUnspecified() {
+			r.addProblem("CNI result contains an empty address")
+			continue
+		}
+		r.IPs = append(r.IPs, ipConfig.Address.String())
+		if ipConfig.Gateway != nil && !ipConfig.Gateway.IsUnspecified() {
+			hasGateway = true
+		}
+	}
+	if len(r.IPs) == 0 {
+		r.addProblem("no IP addresses were obtained from CNI")
+	}
+
+	for _, route := range csn.Result.Routes {
+		gw := route.GW
+		if gw == nil {
+			gw = net.IPv4zero
+		}
+		r.Routes = append(r.Routes, fmt.Sprintf("%s via %s", route.Dst.String(), gw))
+		if ones, _ := route.Dst.Mask.Size(); ones == 0 && route.GW != nil {
+			hasGateway = true
+		}
+	}
+	if !hasGateway {
+		r.addProblem("neither gateway nor default route is present")
+	}
+
+	return r
+}
+
+// CheckNetwork asks the tapmanager to set up the pod network for a
+// temporary fake pod, validate it and tear it down right away.
+// It can be used to verify CNI configuration before any VMs are run
+func CheckNetwork(fdManager FDManager) (*NetworkCheckReport, error) {
+	podId := utils.NewUuid()
+	respData, err := fdManager.AddFDs(podId, &GetFDPayload{
+		Description: &PodNetworkDesc{
+			PodId:   podId,
+			PodNs:   networkCheckPodNs,
+			PodName: networkCheckPodName,
+		},
+		DryRun: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("network dry run failed: %v", err)
+	}
+	var report NetworkCheckReport
+	if err := json.Unmarshal(respData, &report); err != nil {
+		return nil, fmt.Errorf("error unmarshalling network check report: %v", err)
+	}
+	return &report, nil
+}
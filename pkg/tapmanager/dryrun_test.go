@@ -0,0 +1,178 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+func parseAddr(t *testing.T, s string) net.IPNet {
+	ip, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("bad CIDR %q: %v", s, err)
+	}
+	ipnet.IP = ip
+	return *ipnet
+}
+
+func TestNetworkCheckReport(t *testing.T) {
+	hwAddr, _ := net.ParseMAC("42:a4:a6:22:80:2e")
+	for _, tc := range []struct {
+		name     string
+		mtu      uint16
+		gateway  net.IP
+		routes   []*cnitypes.Route
+		noIPs    bool
+		problems []string
+	}{
+		{
+			name:    "gateway",
+			mtu:     1500,
+			gateway: net.IPv4(10, 1, 90, 1),
+		},
+		{
+			name: "default route",
+			mtu:  1500,
+			routes: []*cnitypes.Route{
+				{
+					Dst: parseAddr(t, "0.0.0.0/0"),
+					GW:  net.IPv4(10, 1, 90, 1),
+				},
+			},
+		},
+		{
+			name: "no gateway",
+			mtu:  1500,
+			routes: []*cnitypes.Route{
+				{
+					Dst: parseAddr(t, "10.10.0.0/16"),
+				},
+			},
+			problems: []string{"neither gateway nor default route is present"},
+		},
+		{
+			name:     "bad mtu",
+			mtu:      65000,
+			gateway:  net.IPv4(10, 1, 90, 1),
+			problems: []string{"interface 0 has MTU 65000 outside of sane range 576..9000"},
+		},
+		{
+			name:  "no ips",
+			mtu:   1500,
+			noIPs: true,
+			problems: []string{
+				"no IP addresses were obtained from CNI",
+				"neither gateway nor default route is present",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := &cnicurrent.Result{Routes: tc.routes}
+			if !tc.noIPs {
+				result.IPs = []*cnicurrent.IPConfig{
+					{
+						Version: "4",
+						Address: parseAddr(t, "10.1.90.5/24"),
+						Gateway: tc.gateway,
+					},
+				}
+			}
+			report := NewNetworkCheckReport(&nettools.ContainerSideNetwork{
+				Result: result,
+				Interfaces: []nettools.InterfaceDescription{
+					{
+						Type:         nettools.InterfaceTypeTap,
+						HardwareAddr: hwAddr,
+						MTU:          tc.mtu,
+					},
+				},
+			})
+			if !reflect.DeepEqual(report.Problems, tc.problems) {
+				t.Errorf("bad problem list: expected %#v, got %#v", tc.problems, report.Problems)
+			}
+			if report.OK() != (len(tc.problems) == 0) {
+				t.Errorf("bad OK() value %v", report.OK())
+			}
+			if len(report.Interfaces) != 1 || report.Interfaces[0].HardwareAddr != "42:a4:a6:22:80:2e" {
+				t.Errorf("bad interface list: %#v", report.Interfaces)
+			}
+		})
+	}
+}
+
+func TestNetworkCheckReportPathMTU(t *testing.T) {
+	report := &NetworkCheckReport{}
+	report.addPathMTUReports([]nettools.PathMTUReport{
+		{
+			Interface: 0,
+			Gateway:   "10.1.90.1",
+			MTU:       1500,
+			PathMTU:   1500,
+		},
+		{
+			Interface:  1,
+			Gateway:    "10.2.90.1",
+			MTU:        9000,
+			PathMTU:    1500,
+			TooBigFrom: "192.168.0.1",
+		},
+		{
+			Interface: 2,
+			Gateway:   "10.3.90.1",
+			MTU:       9000,
+		},
+	})
+	if len(report.PathMTU) != 3 {
+		t.Errorf("bad path MTU report list: %#v", report.PathMTU)
+	}
+	expectedProblems := []string{
+		"interface 1: MTU 9000 exceeds path MTU 1500 to gateway 10.2.90.1 (packets are too big for 192.168.0.1)",
+	}
+	if !reflect.DeepEqual(report.Problems, expectedProblems) {
+		t.Errorf("bad problem list: expected %#v, got %#v", expectedProblems, report.Problems)
+	}
+}
+
+func TestParsePathMTUCheckMode(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected PathMTUCheckMode
+		err      bool
+	}{
+		{"", PathMTUCheckOff, false},
+		{"warn", PathMTUCheckWarn, false},
+		{" enforce ", PathMTUCheckEnforce, false},
+		{"refuse", "", true},
+	} {
+		mode, err := ParsePathMTUCheckMode(tc.value)
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("didn't get an error for %q", tc.value)
+		case !tc.err && err != nil:
+			t.Errorf("ParsePathMTUCheckMode(%q): %v", tc.value, err)
+		case mode != tc.expected:
+			t.Errorf("bad mode for %q: expected %q, got %q", tc.value, tc.expected, mode)
+		}
+	}
+}
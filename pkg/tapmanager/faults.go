@@ -0,0 +1,37 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+// FaultPoint denotes a place in tapmanager code where a fault can
+// be injected by the tests. The faults can only be injected if
+// Virtlet is built with faultinjection build tag, otherwise the
+// injection points do nothing
+type FaultPoint string
+
+const (
+	// FaultCreateNetNS makes the creation of the pod network
+	// namespace fail with the error of the fault
+	FaultCreateNetNS FaultPoint = "create-netns"
+	// FaultDHCPStart delays the start of the DHCP server of the
+	// pod or, if the fault has an error, makes the server exit
+	// with that error instead of serving the requests
+	FaultDHCPStart FaultPoint = "dhcp-start"
+	// FaultSendFDs makes FDServer drop the last file descriptor
+	// from the response to GetFDs() or, if the fault has an error,
+	// makes it return that error to the client
+	FaultSendFDs FaultPoint = "send-fds"
+)
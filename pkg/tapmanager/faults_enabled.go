@@ -0,0 +1,82 @@
+// +build faultinjection
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"sync"
+	"time"
+)
+
+// Fault describes what happens when the execution
+// reaches a fault injection point
+type Fault struct {
+	// Err is the error to be injected, if any
+	Err error
+	// Delay is the delay before the execution continues
+	Delay time.Duration
+	// Count is the number of times the fault fires
+	// before it's removed. 0 means no limit
+	Count int
+}
+
+var (
+	faultMutex sync.Mutex
+	faults     = make(map[FaultPoint]*Fault)
+)
+
+// InjectFault makes the fault fire when the execution reaches
+// the specified injection point, replacing the fault that was
+// previously injected there, if any
+func InjectFault(point FaultPoint, fault Fault) {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	faults[point] = &fault
+}
+
+// ClearFaults removes all of the injected faults
+func ClearFaults() {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	faults = make(map[FaultPoint]*Fault)
+}
+
+// checkFault returns true and the error of the fault, if any, if
+// a fault was injected at the point. It waits for the delay of
+// the fault before returning
+func checkFault(point FaultPoint) (bool, error) {
+	faultMutex.Lock()
+	fault, found := faults[point]
+	if !found {
+		faultMutex.Unlock()
+		return false, nil
+	}
+	if fault.Count > 0 {
+		fault.Count--
+		if fault.Count == 0 {
+			delete(faults, point)
+		}
+	}
+	err, delay := fault.Err, fault.Delay
+	faultMutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	return true, err
+}
@@ -0,0 +1,124 @@
+// +build faultinjection
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFaultCount(t *testing.T) {
+	defer ClearFaults()
+	InjectFault(FaultDHCPStart, Fault{Err: errors.New("boom"), Count: 2})
+	for i := 0; i < 2; i++ {
+		if hit, err := checkFault(FaultDHCPStart); !hit || err == nil || err.Error() != "boom" {
+			t.Errorf("bad fault check result #%d: %v, %v", i, hit, err)
+		}
+	}
+	if hit, err := checkFault(FaultDHCPStart); hit || err != nil {
+		t.Errorf("the fault fired after its count was exhausted: %v, %v", hit, err)
+	}
+
+	InjectFault(FaultDHCPStart, Fault{Delay: 100 * time.Millisecond})
+	start := time.Now()
+	if hit, err := checkFault(FaultDHCPStart); !hit || err != nil {
+		t.Errorf("bad fault check result: %v, %v", hit, err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("the fault wasn't delayed: %v", elapsed)
+	}
+	ClearFaults()
+	if hit, _ := checkFault(FaultDHCPStart); hit {
+		t.Errorf("the fault fired after ClearFaults()")
+	}
+}
+
+func TestFaultCreateNetNS(t *testing.T) {
+	defer ClearFaults()
+	InjectFault(FaultCreateNetNS, Fault{Err: errors.New("no space left on device")})
+	// failingCNIClient doesn't implement CNI ADD, so the
+	// test panics if the setup goes past the netns creation
+	s, err := NewTapFDSource(&failingCNIClient{})
+	if err != nil {
+		t.Fatalf("NewTapFDSource(): %v", err)
+	}
+	_, _, err = s.setupPodNetwork(context.Background(), &GetFDPayload{
+		Description: &PodNetworkDesc{
+			PodId:   "69eec606-0493-11e7-bfb6-0242ac110002",
+			PodNs:   "default",
+			PodName: "foo",
+		},
+	}, nil)
+	switch {
+	case err == nil:
+		t.Errorf("setupPodNetwork() didn't fail")
+	case !strings.Contains(err.Error(), "no space left on device"):
+		t.Errorf("bad error message: %v", err)
+	}
+}
+
+func TestFaultSendFDs(t *testing.T) {
+	defer ClearFaults()
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	s := NewFDServer(socketPath, newSampleFDSource(tmpDir))
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+	c := NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.AddFDs("foo", sampleFDData{Content: "foo"}); err != nil {
+		t.Fatalf("AddFDs(): %v", err)
+	}
+
+	InjectFault(FaultSendFDs, Fault{Err: errors.New("injected error"), Count: 1})
+	if _, _, err := c.GetFDs("foo"); err == nil || !strings.Contains(err.Error(), "injected error") {
+		t.Errorf("GetFDs() didn't return the injected error: %v", err)
+	}
+
+	// a dropped file descriptor breaks the connection
+	InjectFault(FaultSendFDs, Fault{Count: 1})
+	if _, _, err := c.GetFDs("foo"); err == nil {
+		t.Errorf("GetFDs() didn't fail after the file descriptor was dropped")
+	}
+
+	// the fault is gone after firing once
+	c1 := NewFDClient(socketPath)
+	if err := c1.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c1.Close()
+	verifyFD(t, c1, "foo", "foo")
+}
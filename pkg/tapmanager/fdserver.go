@@ -17,43 +17,132 @@ limitations under the License.
 package tapmanager
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/audit"
+	"github.com/Mirantis/virtlet/pkg/version"
 )
 
 const (
-	minAcceptErrorDelay = 5 * time.Millisecond
-	maxAcceptErrorDelay = 1 * time.Second
-	receiveFdTimeout    = 5 * time.Second
-	fdMagic             = 0x42424242
-	fdAdd               = 0
-	fdRelease           = 1
-	fdGet               = 2
-	fdResponse          = 0x80
-	fdAddResponse       = fdAdd | fdResponse
-	fdReleaseResponse   = fdRelease | fdResponse
-	fdGetResponse       = fdGet | fdResponse
-	fdError             = 0xff
+	minAcceptErrorDelay   = 5 * time.Millisecond
+	maxAcceptErrorDelay   = 1 * time.Second
+	receiveFdTimeout      = 5 * time.Second
+	fdMagic               = 0x42424243
+	fdLegacyMagic         = 0x42424242
+	fdAdd                 = 0
+	fdRelease             = 1
+	fdGet                 = 2
+	fdQuery               = 3
+	fdReport              = 4
+	fdPing                = 5
+	fdList                = 6
+	fdHello               = 7
+	fdHandoff             = 8
+	fdHandoffDone         = 9
+	fdResponse            = 0x80
+	fdAddResponse         = fdAdd | fdResponse
+	fdReleaseResponse     = fdRelease | fdResponse
+	fdGetResponse         = fdGet | fdResponse
+	fdQueryResponse       = fdQuery | fdResponse
+	fdReportResponse      = fdReport | fdResponse
+	fdPingResponse        = fdPing | fdResponse
+	fdListResponse        = fdList | fdResponse
+	fdHelloResponse       = fdHello | fdResponse
+	fdHandoffResponse     = fdHandoff | fdResponse
+	fdHandoffDoneResponse = fdHandoffDone | fdResponse
+	fdError               = 0xff
+	// fdFlagGzip means that the payload is compressed with gzip
+	fdFlagGzip = 1
+	// fdFlagAcceptGzip means that the sender can handle
+	// gzip-compressed payloads
+	fdFlagAcceptGzip = 2
+	// fdCompressThreshold is the minimum size of the payload
+	// that gets compressed
+	fdCompressThreshold = 4096
+	// fdChunkSize is the maximum size of the payload part
+	// that's passed to a single write call
+	fdChunkSize = 65536
+	// fdMaxDataSize limits the size of the payload
+	// (after decompression)
+	fdMaxDataSize = 64 * 1024 * 1024
+	// fdSourceSeparator separates the prefix that selects
+	// the FDSource from the rest of the key
+	fdSourceSeparator = "/"
 )
 
+// serverVersion returns the version info of FDServer.
+// It's a variable so it can be replaced in tests
+var serverVersion = func() version.Info {
+	return version.Local("tapmanager")
+}
+
+// errBadCommand is returned for unknown commands. The legacy servers
+// that don't support the version handshake return it for fdHello
+var errBadCommand = errors.New("bad command")
+
+// errBadMagic is returned for the headers with unknown magic
+var errBadMagic = errors.New("bad magic")
+
+// errHandshakeDropped is returned by the handshake if the server
+// closes the connection instead of responding, which is what the
+// legacy servers do upon getting a header in the current format
+var errHandshakeDropped = errors.New("the server closed the connection during the handshake")
+
+// staleSocketCheckTimeout limits the time spent trying to connect
+// to an existing socket to check whether it's in use
+const staleSocketCheckTimeout = 5 * time.Second
+
 // FDManager denotes an object that provides 'master'-side
 // functionality of FDClient
 type FDManager interface {
 	AddFDs(key string, data interface{}) ([]byte, error)
 	ReleaseFDs(key string) error
+	Report(key string, data interface{}) error
 }
 
+// fdHeader is the header of the requests and the responses.
+// Its Magic is fdMagic, or fdLegacyMagic for the headers that
+// are sent or received using the legacy format
 type fdHeader struct {
+	Magic   uint32
+	Command uint8
+	// Flags is a combination of fdFlag* values
+	Flags uint8
+	// RequestID is used to match responses with requests
+	// as there may be several requests in flight on the same
+	// connection
+	RequestID uint32
+	// TimeoutMs specifies the time limit for handling the request
+	// in milliseconds. Zero value means no limit
+	TimeoutMs uint32
+	DataSize  uint32
+	OobSize   uint32
+	Key       [64]byte
+}
+
+// fdLegacyHeader is the header format that was used before
+// the flags, request ids and timeouts were added. The servers that
+// use it handle the requests one by one, sending the responses in
+// the same order, and close the connection upon getting a header
+// with an unknown magic
+type fdLegacyHeader struct {
 	Magic    uint32
 	Command  uint8
 	DataSize uint32
@@ -61,6 +150,104 @@ type fdHeader struct {
 	Key      [64]byte
 }
 
+// readHeader reads the header in either of the formats. The legacy
+// header is converted to fdHeader keeping fdLegacyMagic so the
+// response can be sent back using the same format
+func readHeader(r io.Reader) (fdHeader, error) {
+	var hdr fdHeader
+	var magic [4]byte
+	if _, err := io.ReadFull(r, magic[:]); err != nil {
+		return hdr, err
+	}
+	r = io.MultiReader(bytes.NewReader(magic[:]), r)
+	switch binary.BigEndian.Uint32(magic[:]) {
+	case fdMagic:
+		if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+			return hdr, err
+		}
+	case fdLegacyMagic:
+		var legacyHdr fdLegacyHeader
+		if err := binary.Read(r, binary.BigEndian, &legacyHdr); err != nil {
+			return hdr, err
+		}
+		hdr = fdHeader{
+			Magic:    legacyHdr.Magic,
+			Command:  legacyHdr.Command,
+			DataSize: legacyHdr.DataSize,
+			OobSize:  legacyHdr.OobSize,
+			Key:      legacyHdr.Key,
+		}
+	default:
+		return hdr, errBadMagic
+	}
+	return hdr, nil
+}
+
+// writeHeader writes the header using the format that's denoted
+// by its magic. The fields that are missing from the legacy format
+// are dropped
+func writeHeader(w io.Writer, hdr *fdHeader) error {
+	if hdr.Magic != fdLegacyMagic {
+		return binary.Write(w, binary.BigEndian, hdr)
+	}
+	return binary.Write(w, binary.BigEndian, &fdLegacyHeader{
+		Magic:    hdr.Magic,
+		Command:  hdr.Command,
+		DataSize: hdr.DataSize,
+		OobSize:  hdr.OobSize,
+		Key:      hdr.Key,
+	})
+}
+
+// encodePayload compresses the payload if compress is true and the
+// payload is big enough, updating the header accordingly
+func encodePayload(hdr *fdHeader, data []byte, compress bool) ([]byte, error) {
+	if compress && len(data) >= fdCompressThreshold {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("error compressing payload: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("error compressing payload: %v", err)
+		}
+		if buf.Len() < len(data) {
+			data = buf.Bytes()
+			hdr.Flags |= fdFlagGzip
+		}
+	}
+	hdr.DataSize = uint32(len(data))
+	return data, nil
+}
+
+// decodePayload decompresses the payload if it's compressed
+func decodePayload(hdr *fdHeader, data []byte) ([]byte, error) {
+	if hdr.Flags&fdFlagGzip == 0 {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing payload: %v", err)
+	}
+	defer r.Close()
+	// read one byte more than allowed to detect oversized payloads
+	out, err := ioutil.ReadAll(io.LimitReader(r, fdMaxDataSize+1))
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("error decompressing payload: %v", err)
+	case len(out) > fdMaxDataSize:
+		return nil, fmt.Errorf("decompressed payload is too big (more than %d bytes)", fdMaxDataSize)
+	}
+	return out, nil
+}
+
+func checkDataSize(hdr *fdHeader) error {
+	if hdr.DataSize > fdMaxDataSize {
+		return fmt.Errorf("payload is too big: %d bytes", hdr.DataSize)
+	}
+	return nil
+}
+
 func (hdr *fdHeader) getKey() string {
 	return strings.TrimSpace(string(hdr.Key[:]))
 }
@@ -84,14 +271,35 @@ type FDSource interface {
 	// GetFDs sets up a file descriptors based on key
 	// and extra data. It should return the file descriptor list,
 	// any data that should be passed back to the client
-	// invoking AddFDs() and an error, if any.
-	GetFDs(key string, data []byte) ([]int, []byte, error)
+	// invoking AddFDs() and an error, if any. If the file
+	// descriptor list is empty, nothing is registered for the
+	// key and Release() is not called for it (this is used
+	// for checks that don't leave any resources behind).
+	// When the context is done, GetFDs() should roll back
+	// whatever it has set up and return an error as soon
+	// as possible.
+	GetFDs(ctx context.Context, key string, data []byte) ([]int, []byte, error)
 	// Release destroys (closes) the file descriptor and
 	// any associated resources
 	Release(key string) error
 	// GetInfo returns the information which needs to be
 	// propagated back the FDClient upon GetFDs() call
 	GetInfo(key string) ([]byte, error)
+	// QueryInfo returns the same information as GetInfo()
+	// for the FDClient's QueryInfo() call. Unlike GetInfo(),
+	// it must not have any side effects as the file
+	// descriptors are not handed out in this case
+	QueryInfo(key string) ([]byte, error)
+	// Report passes the data sent by the FDClient that
+	// has obtained the file descriptors, such as the
+	// identifiers of the devices it has created using them
+	Report(key string, data []byte) error
+}
+
+// FDSourceKey returns the key for the FDSource registered
+// with the specified prefix using FDServer's RegisterSource()
+func FDSourceKey(prefix, key string) string {
+	return prefix + fdSourceSeparator + key
 }
 
 // FDServer listens on a Unix domain socket, serving requests to
@@ -107,18 +315,136 @@ type FDServer struct {
 	sync.Mutex
 	lst        *net.UnixListener
 	socketPath string
+	socketMode os.FileMode
+	socketUID  int
+	socketGID  int
 	source     FDSource
+	sources    map[string]FDSource
 	fds        map[string][]int
 	stopCh     chan struct{}
+	// inherited contains the file descriptors received from
+	// the previous FDServer during the handoff that weren't
+	// adopted by the sources yet
+	inherited map[string][]int
+	// handoffConn is the connection of the FDServer that's
+	// taking over this one, nil if there's no handoff in progress
+	handoffConn *net.UnixConn
+	// handoffFiles are closed after the handoff is finished
+	// or aborted
+	handoffFiles []*os.File
+	handedOffCh  chan struct{}
+	// keyLocks serialize the add and release requests
+	// for each key
+	keyLocks map[string]*keyLock
+	// auditLog records the add and release requests,
+	// nil if auditing is disabled
+	auditLog *audit.Log
 }
 
 // NewFDServer returns an FDServer for the specified socket path and
-// an FDSource
+// an FDSource. The source handles the keys that don't have a prefix
+// of any source registered using RegisterSource(). It may be nil
+// if all of the keys are expected to have such prefixes
 func NewFDServer(socketPath string, source FDSource) *FDServer {
 	return &FDServer{
-		socketPath: socketPath,
-		source:     source,
-		fds:        make(map[string][]int),
+		socketPath:  socketPath,
+		socketUID:   -1,
+		socketGID:   -1,
+		source:      source,
+		sources:     make(map[string]FDSource),
+		fds:         make(map[string][]int),
+		inherited:   make(map[string][]int),
+		handedOffCh: make(chan struct{}),
+		keyLocks:    make(map[string]*keyLock),
+	}
+}
+
+// SetSocketPermissions sets the mode and the owner of the socket
+// file which are applied by Serve() before accepting any
+// connections. Zero mode means that the mode is determined by the
+// umask, and uid or gid being -1 means that the corresponding id is
+// left unchanged.
+func (s *FDServer) SetSocketPermissions(mode os.FileMode, uid, gid int) {
+	s.Lock()
+	defer s.Unlock()
+	s.socketMode = mode
+	s.socketUID = uid
+	s.socketGID = gid
+}
+
+// SetAuditLog makes FDServer record the requests that add and
+// release file descriptors, such as setting up and tearing down
+// pod networking, in the audit log
+func (s *FDServer) SetAuditLog(l *audit.Log) {
+	s.Lock()
+	defer s.Unlock()
+	s.auditLog = l
+}
+
+// RegisterSource registers an additional FDSource which handles
+// the keys that start with the prefix followed by '/', see
+// FDSourceKey(). The source receives the keys with the prefix
+// and the separator stripped. This makes it possible for
+// different kinds of file descriptors to be passed over the
+// same socket
+func (s *FDServer) RegisterSource(prefix string, source FDSource) error {
+	s.Lock()
+	defer s.Unlock()
+	switch {
+	case prefix == "" || strings.Contains(prefix, fdSourceSeparator):
+		return fmt.Errorf("bad fd source prefix %q", prefix)
+	case s.sources[prefix] != nil:
+		return fmt.Errorf("fd source with prefix %q is already registered", prefix)
+	}
+	s.sources[prefix] = source
+	return nil
+}
+
+// sourceForKey returns the FDSource that handles the key
+// and the key to pass to it
+func (s *FDServer) sourceForKey(key string) (FDSource, string, error) {
+	s.Lock()
+	defer s.Unlock()
+	if n := strings.Index(key, fdSourceSeparator); n > 0 {
+		if src := s.sources[key[:n]]; src != nil {
+			return src, key[n+1:], nil
+		}
+		return nil, "", fmt.Errorf("no fd source for key %q", key)
+	}
+	if s.source == nil {
+		return nil, "", fmt.Errorf("no fd source for key %q", key)
+	}
+	return s.source, key, nil
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lockKey makes sure that the requests that add and release the file
+// descriptors for the same key, such as a retry of a timed out
+// request, are handled one after another. It returns the function
+// that unlocks the key
+func (s *FDServer) lockKey(key string) func() {
+	s.Lock()
+	l := s.keyLocks[key]
+	if l == nil {
+		l = &keyLock{}
+		s.keyLocks[key] = l
+	}
+	l.refs++
+	s.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.Lock()
+		defer s.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.keyLocks, key)
+		}
 	}
 }
 
@@ -132,12 +458,39 @@ func (s *FDServer) addFDs(key string, fds []int) bool {
 	return true
 }
 
+// UpdateFDs replaces the list of file descriptors that's
+// passed to the clients for the key by GetFDs(). It's used
+// when the FDSource adds or removes file descriptors for
+// the key outside AddFDs() and ReleaseFDs() calls
+func (s *FDServer) UpdateFDs(key string, fds []int) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.fds[key]; !found {
+		return fmt.Errorf("bad fd key: %q", key)
+	}
+	s.fds[key] = fds
+	return nil
+}
+
 func (s *FDServer) removeFDs(key string) {
 	s.Lock()
 	defer s.Unlock()
 	delete(s.fds, key)
 }
 
+// Keys returns the sorted list of the keys that
+// currently have file descriptors
+func (s *FDServer) Keys() []string {
+	s.Lock()
+	defer s.Unlock()
+	keys := make([]string, 0, len(s.fds))
+	for key := range s.fds {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func (s *FDServer) getFDs(key string) ([]int, error) {
 	s.Lock()
 	defer s.Unlock()
@@ -156,17 +509,34 @@ func (s *FDServer) Serve() error {
 	if s.stopCh != nil {
 		return errors.New("already listening")
 	}
+	if err := removeStaleSocket(s.socketPath); err != nil {
+		return err
+	}
 	addr, err := net.ResolveUnixAddr("unix", s.socketPath)
 	if err != nil {
 		return fmt.Errorf("failed to resolve unix addr %q: %v", s.socketPath, err)
 	}
 	l, err := net.ListenUnix("unix", addr)
 	if err != nil {
-		l.Close()
 		return fmt.Errorf("failed to listen on socket %q: %v", s.socketPath, err)
 	}
+	if err := s.applySocketPermissions(); err != nil {
+		l.Close()
+		return err
+	}
+	s.serve(l)
+	return nil
+}
+
+// serve accepts the connections on the listener in a new
+// goroutine. The caller must hold the lock
+func (s *FDServer) serve(l *net.UnixListener) {
+	s.lst = l
 	// Accept error handling is inspired by server.go in grpc
-	s.stopCh = make(chan struct{})
+	// the goroutine below uses its own copy of the channel
+	// because Stop() resets s.stopCh
+	stopCh := make(chan struct{})
+	s.stopCh = stopCh
 	var delay time.Duration
 	go func() {
 		for {
@@ -187,12 +557,12 @@ func (s *FDServer) Serve() error {
 					select {
 					case <-time.After(delay):
 						continue
-					case <-s.stopCh:
+					case <-stopCh:
 						return
 					}
 				}
 				select {
-				case <-s.stopCh:
+				case <-stopCh:
 					// this error is expected
 					return
 				default:
@@ -208,22 +578,106 @@ func (s *FDServer) Serve() error {
 			}()
 		}
 	}()
+}
+
+func (s *FDServer) applySocketPermissions() error {
+	if s.socketMode != 0 {
+		if err := os.Chmod(s.socketPath, s.socketMode); err != nil {
+			return fmt.Errorf("can't set the mode of socket %q: %v", s.socketPath, err)
+		}
+	}
+	if s.socketUID != -1 || s.socketGID != -1 {
+		if err := os.Chown(s.socketPath, s.socketUID, s.socketGID); err != nil {
+			return fmt.Errorf("can't set the owner of socket %q: %v", s.socketPath, err)
+		}
+	}
 	return nil
 }
 
-func (s *FDServer) serveAdd(c *net.UnixConn, hdr *fdHeader) (*fdHeader, []byte, error) {
-	data := make([]byte, hdr.DataSize)
-	if len(data) > 0 {
-		if _, err := io.ReadFull(c, data); err != nil {
-			return nil, nil, fmt.Errorf("error reading payload: %v", err)
+// removeStaleSocket removes the socket file left behind by a server
+// that wasn't stopped properly, e.g. due to a crash. It returns an
+// error if the socket is in use by a live server or if the path
+// points to something other than a socket.
+func removeStaleSocket(socketPath string) error {
+	fi, err := os.Lstat(socketPath)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("can't stat %q: %v", socketPath, err)
+	case fi.Mode()&os.ModeSocket == 0:
+		return fmt.Errorf("%q exists and is not a socket", socketPath)
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, staleSocketCheckTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %q is in use by another server", socketPath)
+	}
+	if !isConnectionRefused(err) {
+		return fmt.Errorf("can't check whether socket %q is in use: %v", socketPath, err)
+	}
+
+	glog.Warningf("Removing stale socket %q", socketPath)
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("can't remove stale socket %q: %v", socketPath, err)
+	}
+	return nil
+}
+
+func isConnectionRefused(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return false
+	}
+	syscallErr, ok := opErr.Err.(*os.SyscallError)
+	return ok && syscallErr.Err == syscall.ECONNREFUSED
+}
+
+// getFDsFromSource invokes GetFDs() of the source cancelling its
+// context when the timeout expires if the timeout is non-zero, and
+// waits for GetFDs() to return. If the source still manages to set
+// up the file descriptors after the timeout, they're released and
+// an error is returned
+func (s *FDServer) getFDsFromSource(key string, data []byte, timeout time.Duration) ([]int, []byte, error) {
+	src, srcKey, err := s.sourceForKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if timeout == 0 {
+		return src.GetFDs(context.Background(), srcKey, data)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	fds, respData, err := src.GetFDs(ctx, srcKey, data)
+	switch {
+	case ctx.Err() == nil:
+		return fds, respData, err
+	case err == nil && len(fds) != 0:
+		glog.Warningf("Releasing fds for key %q after the request has timed out", key)
+		if err := src.Release(srcKey); err != nil {
+			glog.Errorf("Error releasing fds for key %q after timeout: %v", key, err)
 		}
 	}
+	return nil, nil, fmt.Errorf("timed out after %v", timeout)
+}
+
+func (s *FDServer) serveAdd(hdr *fdHeader, data []byte) (*fdHeader, []byte, error) {
 	key := hdr.getKey()
-	fds, respData, err := s.source.GetFDs(key, data)
+	defer s.lockKey(key)()
+	var fds []int
+	var respData []byte
+	var err error
+	if inherited := s.takeInheritedFDs(key); inherited != nil {
+		fds, respData, err = s.adoptFDs(key, data, inherited, time.Duration(hdr.TimeoutMs)*time.Millisecond)
+	} else {
+		fds, respData, err = s.getFDsFromSource(key, data, time.Duration(hdr.TimeoutMs)*time.Millisecond)
+	}
 	if err != nil {
 		return nil, nil, fmt.Errorf("error getting fd: %v", err)
 	}
-	if !s.addFDs(key, fds) {
+	if len(fds) != 0 && !s.addFDs(key, fds) {
 		return nil, nil, fmt.Errorf("fd key already exists: %q", err)
 	}
 	return &fdHeader{
@@ -236,7 +690,12 @@ func (s *FDServer) serveAdd(c *net.UnixConn, hdr *fdHeader) (*fdHeader, []byte,
 
 func (s *FDServer) serveRelease(hdr *fdHeader) (*fdHeader, error) {
 	key := hdr.getKey()
-	if err := s.source.Release(key); err != nil {
+	defer s.lockKey(key)()
+	src, srcKey, err := s.sourceForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := src.Release(srcKey); err != nil {
 		return nil, fmt.Errorf("error releasing fd: %v", err)
 	}
 	s.removeFDs(key)
@@ -247,16 +706,25 @@ func (s *FDServer) serveRelease(hdr *fdHeader) (*fdHeader, error) {
 	}, nil
 }
 
-func (s *FDServer) serveGet(c *net.UnixConn, hdr *fdHeader) (*fdHeader, []byte, []byte, error) {
+func (s *FDServer) serveGet(hdr *fdHeader) (*fdHeader, []byte, []byte, error) {
 	key := hdr.getKey()
 	fds, err := s.getFDs(key)
 	if err != nil {
 		return nil, nil, nil, err
 	}
-	info, err := s.source.GetInfo(key)
+	src, srcKey, err := s.sourceForKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	info, err := src.GetInfo(srcKey)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("can't get key info: %v", err)
 	}
+	if hit, err := checkFault(FaultSendFDs); err != nil {
+		return nil, nil, nil, err
+	} else if hit && len(fds) != 0 {
+		fds = fds[:len(fds)-1]
+	}
 
 	rights := syscall.UnixRights(fds...)
 	return &fdHeader{
@@ -268,61 +736,232 @@ func (s *FDServer) serveGet(c *net.UnixConn, hdr *fdHeader) (*fdHeader, []byte,
 	}, info, rights, nil
 }
 
+func (s *FDServer) serveQuery(hdr *fdHeader) (*fdHeader, []byte, error) {
+	key := hdr.getKey()
+	if _, err := s.getFDs(key); err != nil {
+		return nil, nil, err
+	}
+	src, srcKey, err := s.sourceForKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := src.QueryInfo(srcKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't get key info: %v", err)
+	}
+	return &fdHeader{
+		Magic:   fdMagic,
+		Command: fdQueryResponse,
+		Key:     hdr.Key,
+	}, info, nil
+}
+
+func (s *FDServer) serveReport(hdr *fdHeader, data []byte) (*fdHeader, error) {
+	key := hdr.getKey()
+	if _, err := s.getFDs(key); err != nil {
+		return nil, err
+	}
+	src, srcKey, err := s.sourceForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := src.Report(srcKey, data); err != nil {
+		return nil, fmt.Errorf("error handling the report: %v", err)
+	}
+	return &fdHeader{
+		Magic:   fdMagic,
+		Command: fdReportResponse,
+		Key:     hdr.Key,
+	}, nil
+}
+
+// serveHello checks the protocol version of the client
+// and responds with the version of the server
+func (s *FDServer) serveHello(data []byte) (*fdHeader, []byte, error) {
+	var peer version.Info
+	if err := json.Unmarshal(data, &peer); err != nil {
+		return nil, nil, fmt.Errorf("error unmarshalling version info: %v", err)
+	}
+	local := serverVersion()
+	if err := version.Check(local, peer); err != nil {
+		glog.Warningf("Rejecting the client: %v", err)
+		return nil, nil, err
+	}
+	glog.V(3).Infof("Client connected: %s", peer)
+	respData, err := json.Marshal(local)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling version info: %v", err)
+	}
+	return &fdHeader{Magic: fdMagic, Command: fdHelloResponse}, respData, nil
+}
+
+func (s *FDServer) handleRequest(c *net.UnixConn, hdr *fdHeader, data []byte) (*fdHeader, []byte, []byte) {
+	var respHdr *fdHeader
+	var respData, oobData []byte
+	data, err := decodePayload(hdr, data)
+	switch {
+	case err != nil:
+		// the error is sent back to the client below
+	case (hdr.Command == fdAdd || hdr.Command == fdRelease) && s.handingOff():
+		err = errHandingOff
+	case hdr.Command == fdAdd:
+		respHdr, respData, err = s.serveAdd(hdr, data)
+	case hdr.Command == fdRelease:
+		respHdr, err = s.serveRelease(hdr)
+	case hdr.Command == fdGet:
+		respHdr, respData, oobData, err = s.serveGet(hdr)
+	case hdr.Command == fdQuery:
+		respHdr, respData, err = s.serveQuery(hdr)
+	case hdr.Command == fdReport:
+		respHdr, err = s.serveReport(hdr, data)
+	case hdr.Command == fdPing:
+		respHdr = &fdHeader{Magic: fdMagic, Command: fdPingResponse}
+	case hdr.Command == fdList:
+		respHdr = &fdHeader{Magic: fdMagic, Command: fdListResponse}
+		respData, err = json.Marshal(s.Keys())
+	case hdr.Command == fdHello:
+		respHdr, respData, err = s.serveHello(data)
+	case hdr.Command == fdHandoff:
+		respHdr, respData, oobData, err = s.serveHandoff(c, hdr)
+	case hdr.Command == fdHandoffDone:
+		respHdr, err = s.serveHandoffDone(c)
+	default:
+		err = errBadCommand
+	}
+
+	switch hdr.Command {
+	case fdAdd:
+		s.audit("AddFDs", c, hdr.getKey(), err)
+	case fdRelease:
+		s.audit("ReleaseFDs", c, hdr.getKey(), err)
+	}
+
+	if err == nil {
+		respData, err = encodePayload(respHdr, respData, hdr.Flags&fdFlagAcceptGzip != 0)
+	}
+
+	if err != nil {
+		respData = []byte(err.Error())
+		oobData = nil
+		respHdr = &fdHeader{
+			Magic:    fdMagic,
+			Command:  fdError,
+			DataSize: uint32(len(respData)),
+			OobSize:  0,
+		}
+	}
+	// the response uses the same header format as the request
+	respHdr.Magic = hdr.Magic
+	respHdr.RequestID = hdr.RequestID
+	// let the client know it can send compressed payloads
+	respHdr.Flags |= fdFlagAcceptGzip
+	return respHdr, respData, oobData
+}
+
+func (s *FDServer) audit(operation string, c *net.UnixConn, key string, err error) {
+	s.Lock()
+	l := s.auditLog
+	s.Unlock()
+	l.Record(operation, audit.PeerCred(c), key, err)
+}
+
+// writeResponse writes the response header followed by the payload.
+// The out-of-band data is sent along with the first chunk of the
+// payload, and the rest of the payload is written in chunks
+func writeResponse(c *net.UnixConn, respHdr *fdHeader, data, oobData []byte) error {
+	if err := writeHeader(c, respHdr); err != nil {
+		return fmt.Errorf("error writing response header: %v", err)
+	}
+	if len(data) == 0 && len(oobData) == 0 {
+		return nil
+	}
+	first := data
+	if len(first) > fdChunkSize {
+		first = first[:fdChunkSize]
+	}
+	if first == nil {
+		first = []byte{}
+	}
+	if oobData == nil {
+		oobData = []byte{}
+	}
+	n, _, err := c.WriteMsgUnix(first, oobData, nil)
+	if err != nil {
+		return fmt.Errorf("error writing payload: %v", err)
+	}
+	for data = data[n:]; len(data) > 0; data = data[n:] {
+		chunk := data
+		if len(chunk) > fdChunkSize {
+			chunk = chunk[:fdChunkSize]
+		}
+		if n, err = c.Write(chunk); err != nil {
+			return fmt.Errorf("error writing payload: %v", err)
+		}
+	}
+	return nil
+}
+
+// serveConn reads requests from the connection and handles each of
+// them in a separate goroutine, so a slow request doesn't block the
+// requests that follow it. The responses are written as soon as
+// they're ready and may come in an order that differs from the order
+// of the requests. The requests that use the legacy header format
+// are handled one by one as the legacy clients expect the responses
+// to come in order.
 func (s *FDServer) serveConn(c *net.UnixConn) error {
+	var wg sync.WaitGroup
+	var writeLock sync.Mutex
 	defer c.Close()
+	// the handoff is aborted if the new server goes away
+	// before finishing it
+	defer s.abortHandoff(c)
+	// wait for the requests to be handled before closing the connection
+	defer wg.Wait()
 	for {
-		var hdr fdHeader
-		if err := binary.Read(c, binary.BigEndian, &hdr); err != nil {
-			if err == io.EOF {
-				break
-			}
+		hdr, err := readHeader(c)
+		switch {
+		case err == io.EOF:
+			return nil
+		case err == errBadMagic:
+			return err
+		case err != nil:
 			return fmt.Errorf("error reading the header: %v", err)
 		}
-		if hdr.Magic != fdMagic {
-			return errors.New("bad magic")
+		if err := checkDataSize(&hdr); err != nil {
+			return err
 		}
 
-		var err error
-		var respHdr *fdHeader
-		var data, oobData []byte
-		switch hdr.Command {
-		case fdAdd:
-			respHdr, data, err = s.serveAdd(c, &hdr)
-		case fdRelease:
-			respHdr, err = s.serveRelease(&hdr)
-		case fdGet:
-			respHdr, data, oobData, err = s.serveGet(c, &hdr)
-		default:
-			err = errors.New("bad command")
+		data := make([]byte, hdr.DataSize)
+		if len(data) > 0 {
+			if _, err := io.ReadFull(c, data); err != nil {
+				return fmt.Errorf("error reading payload: %v", err)
+			}
 		}
 
-		if err != nil {
-			data = []byte(err.Error())
-			oobData = nil
-			respHdr = &fdHeader{
-				Magic:    fdMagic,
-				Command:  fdError,
-				DataSize: uint32(len(data)),
-				OobSize:  0,
+		if hdr.Magic == fdLegacyMagic {
+			respHdr, respData, oobData := s.handleRequest(c, &hdr, data)
+			writeLock.Lock()
+			err := writeResponse(c, respHdr, respData, oobData)
+			writeLock.Unlock()
+			if err != nil {
+				return err
 			}
+			continue
 		}
 
-		if err := binary.Write(c, binary.BigEndian, respHdr); err != nil {
-			return fmt.Errorf("error writing response header: %v", err)
-		}
-		if len(data) > 0 || len(oobData) > 0 {
-			if data == nil {
-				data = []byte{}
+		wg.Add(1)
+		go func(hdr fdHeader) {
+			defer wg.Done()
+			respHdr, respData, oobData := s.handleRequest(c, &hdr, data)
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			if err := writeResponse(c, respHdr, respData, oobData); err != nil {
+				glog.Errorf("Request %d: %v", hdr.RequestID, err)
+				// the stream is broken at this point
+				c.Close()
 			}
-			if oobData == nil {
-				oobData = []byte{}
-			}
-			if _, _, err = c.WriteMsgUnix(data, oobData, nil); err != nil {
-				return fmt.Errorf("error writing payload: %v", err)
-			}
-		}
+		}(hdr)
 	}
-	return nil
 }
 
 // Stop makes FDServer stop listening and close its socket
@@ -336,117 +975,424 @@ func (s *FDServer) Stop() {
 	}
 }
 
+type fdReply struct {
+	hdr     fdHeader
+	data    []byte
+	oobData []byte
+	err     error
+}
+
 // FDClient can be used to connect to an FDServer listening on a Unix
-// domain socket
+// domain socket. Several requests can be made concurrently using
+// the same FDClient
 type FDClient struct {
-	socketPath string
-	conn       *net.UnixConn
+	sync.Mutex
+	socketPath    string
+	conn          *net.UnixConn
+	writeLock     sync.Mutex
+	lastRequestID uint32
+	pending       map[uint32]chan *fdReply
+	recvErr       error
+	timeout       time.Duration
+	compression   bool
+	// serverAcceptsGzip is set when the server indicates
+	// it can handle compressed requests
+	serverAcceptsGzip bool
+	// component is the name of the component that
+	// uses the client, e.g. "vmwrapper"
+	component string
+	// peer is the version info of the server
+	// obtained during the handshake
+	peer version.Info
+	// legacy is set when the server only understands
+	// the legacy header format
+	legacy bool
+	// legacyLock makes the requests wait for each other
+	// when talking to a legacy server, as the legacy
+	// responses carry no request ids
+	legacyLock sync.Mutex
 }
 
 var _ FDManager = &FDClient{}
 
 // NewFDClient returns an FDClient for specified socket path
 func NewFDClient(socketPath string) *FDClient {
-	return &FDClient{socketPath: socketPath}
+	return &FDClient{socketPath: socketPath, component: "fdclient"}
+}
+
+// SetComponent sets the name of the component that uses the
+// client which is reported to the server during the handshake
+func (c *FDClient) SetComponent(component string) {
+	c.Lock()
+	defer c.Unlock()
+	c.component = component
+}
+
+// SetAddTimeout sets the time limit for the server to handle AddFDs()
+// requests. If the limit is exceeded, the server rolls back the changes
+// made during the request and AddFDs() returns an error.
+// Zero timeout means no limit, which is the default
+func (c *FDClient) SetAddTimeout(timeout time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.timeout = timeout
+}
+
+// SetCompression enables or disables gzip compression of large
+// payloads. When it's enabled, the client asks the server to
+// compress the responses, and compresses the requests after the
+// server indicates it can handle them. It's disabled by default
+func (c *FDClient) SetCompression(enable bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.compression = enable
 }
 
 // Connect makes FDClient connect to its socket. You must call
-// Connect() method to be able to use the FDClient
+// Connect() method to be able to use the FDClient. After connecting,
+// the client exchanges the protocol versions with the server, and if
+// they're incompatible, the connection is closed and an error is
+// returned. If the server turns out to predate request ids, the
+// client reconnects and falls back to the legacy header format
 func (c *FDClient) Connect() error {
+	connected, err := c.connect(false)
+	if err != nil || !connected {
+		return err
+	}
+	err = c.handshake()
+	if err == errHandshakeDropped {
+		glog.V(3).Infof("Server at %q dropped the connection during the handshake, retrying using the legacy protocol", c.socketPath)
+		c.Close()
+		if _, err = c.connect(true); err == nil {
+			err = c.handshake()
+		}
+	}
+	if err != nil {
+		c.Close()
+		return err
+	}
+	return nil
+}
+
+// connect establishes the connection, returning false
+// if the client is already connected. If legacy is true,
+// the legacy header format is used for the requests
+func (c *FDClient) connect(legacy bool) (bool, error) {
+	c.Lock()
+	defer c.Unlock()
 	if c.conn != nil {
-		return nil
+		return false, nil
 	}
 
 	addr, err := net.ResolveUnixAddr("unix", c.socketPath)
 	if err != nil {
-		return fmt.Errorf("failed to resolve unix addr %q: %v", c.socketPath, err)
+		return false, fmt.Errorf("failed to resolve unix addr %q: %v", c.socketPath, err)
 	}
 
 	conn, err := net.DialUnix("unix", nil, addr)
 	if err != nil {
-		return fmt.Errorf("can't connect to %q: %v", c.socketPath, err)
+		return false, fmt.Errorf("can't connect to %q: %v", c.socketPath, err)
 	}
 	c.conn = conn
+	c.pending = make(map[uint32]chan *fdReply)
+	c.recvErr = nil
+	c.serverAcceptsGzip = false
+	c.legacy = legacy
+	go c.receive(conn)
+	return true, nil
+}
+
+// handshake exchanges the version info with the server
+func (c *FDClient) handshake() error {
+	c.Lock()
+	local := version.Local(c.component)
+	legacy := c.legacy
+	c.Unlock()
+	data, err := json.Marshal(local)
+	if err != nil {
+		return fmt.Errorf("error marshalling version info: %v", err)
+	}
+	peer := version.Legacy("tapmanager")
+	if legacy {
+		// the legacy header format can't carry the
+		// compression flags, and the servers that use
+		// it don't support the reports
+		peer.Features = 0
+	}
+	_, respData, _, err := c.request(&fdHeader{Command: fdHello}, data)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(respData, &peer); err != nil {
+			return fmt.Errorf("error unmarshalling version info: %v", err)
+		}
+	case isServerError(err, errBadCommand):
+		// the server predates the version handshake
+	case !legacy && c.connectionBroken():
+		return errHandshakeDropped
+	default:
+		return fmt.Errorf("version handshake failed: %v", err)
+	}
+	if err := version.Check(local, peer); err != nil {
+		return err
+	}
+	glog.V(3).Infof("Connected to %s", peer)
+	c.Lock()
+	c.peer = peer
+	c.Unlock()
 	return nil
 }
 
+// Peer returns the version info of the server
+func (c *FDClient) Peer() version.Info {
+	c.Lock()
+	defer c.Unlock()
+	return c.peer
+}
+
+// peerSupports returns true if both the client
+// and the server support the feature
+func (c *FDClient) peerSupports(feature version.Feature) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.peer.Features&version.SupportedFeatures&feature != 0
+}
+
+// connectionBroken returns true if the connection
+// was closed by the server
+func (c *FDClient) connectionBroken() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.recvErr != nil
+}
+
 // Close closes the connection to FDServer
 func (c *FDClient) Close() error {
+	c.Lock()
+	defer c.Unlock()
 	var err error
 	if c.conn != nil {
 		err = c.conn.Close()
 		c.conn = nil
+		c.failPendingLocked(errors.New("connection closed"))
 	}
 	return err
 }
 
-func (c *FDClient) request(hdr *fdHeader, data []byte) (*fdHeader, []byte, []byte, error) {
-	hdr.Magic = fdMagic
-	if c.conn == nil {
-		return nil, nil, nil, errors.New("not connected")
+func readResponse(conn *net.UnixConn) (*fdReply, error) {
+	var r fdReply
+	var err error
+	r.hdr, err = readHeader(conn)
+	switch {
+	case err == errBadMagic:
+		return nil, err
+	case err != nil:
+		return nil, fmt.Errorf("error reading response header: %v", err)
+	}
+	if err := checkDataSize(&r.hdr); err != nil {
+		return nil, err
 	}
 
-	if err := binary.Write(c.conn, binary.BigEndian, hdr); err != nil {
-		return nil, nil, nil, fmt.Errorf("error writing request header: %v", err)
+	r.data = make([]byte, r.hdr.DataSize)
+	r.oobData = make([]byte, r.hdr.OobSize)
+	if len(r.data) > 0 || len(r.oobData) > 0 {
+		// the out-of-band data comes with the first chunk
+		// of the payload, see writeResponse()
+		first := r.data
+		if len(first) > fdChunkSize {
+			first = first[:fdChunkSize]
+		}
+		n, oobn, _, _, err := conn.ReadMsgUnix(first, r.oobData)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the message: %v", err)
+		}
+		// ReadMsgUnix will read & discard a single byte if len(r.data) == 0
+		if len(r.data) == 0 && n != 1 {
+			return nil, fmt.Errorf("bad data size: %d instead of %d", n, len(r.data))
+		}
+		if oobn != len(r.oobData) {
+			return nil, fmt.Errorf("bad oob data size: %d instead of %d", oobn, len(r.oobData))
+		}
+		if len(r.data) > 0 && n < len(r.data) {
+			if _, err := io.ReadFull(conn, r.data[n:]); err != nil {
+				return nil, fmt.Errorf("error reading the payload: %v", err)
+			}
+		}
 	}
+	return &r, nil
+}
 
-	if len(data) > 0 {
-		if err := binary.Write(c.conn, binary.BigEndian, data); err != nil {
-			return nil, nil, nil, fmt.Errorf("error writing request payload: %v", err)
+// receive reads the responses from the connection and passes
+// them to the goroutines that made the corresponding requests
+func (c *FDClient) receive(conn *net.UnixConn) {
+	for {
+		resp, err := readResponse(conn)
+		if err != nil {
+			c.failPending(conn, err)
+			return
+		}
+		c.Lock()
+		id := resp.hdr.RequestID
+		if resp.hdr.Magic == fdLegacyMagic {
+			// only one request may be in flight
+			// when talking to a legacy server
+			id = c.lastRequestID
 		}
+		respCh, found := c.pending[id]
+		delete(c.pending, id)
+		c.Unlock()
+		if !found {
+			glog.Warningf("Got a response for an unknown request id %d", id)
+			continue
+		}
+		respCh <- resp
 	}
+}
 
-	var respHdr fdHeader
-	if err := binary.Read(c.conn, binary.BigEndian, &respHdr); err != nil {
-		return nil, nil, nil, fmt.Errorf("error reading response header: %v", err)
+func (c *FDClient) failPending(conn *net.UnixConn, err error) {
+	c.Lock()
+	defer c.Unlock()
+	if c.conn != conn {
+		// the connection was closed via Close()
+		return
 	}
-	if respHdr.Magic != fdMagic {
-		return nil, nil, nil, errors.New("bad magic")
+	c.recvErr = err
+	c.failPendingLocked(err)
+}
+
+func (c *FDClient) failPendingLocked(err error) {
+	for id, respCh := range c.pending {
+		respCh <- &fdReply{err: err}
+		delete(c.pending, id)
 	}
+}
 
-	respData := make([]byte, respHdr.DataSize)
-	oobData := make([]byte, respHdr.OobSize)
-	if len(respData) > 0 || len(oobData) > 0 {
-		n, oobn, _, _, err := c.conn.ReadMsgUnix(respData, oobData)
-		if err != nil {
-			return nil, nil, nil, fmt.Errorf("error reading the message: %v", err)
-		}
-		// ReadMsgUnix will read & discard a single byte if len(respData) == 0
-		if n != len(respData) && (len(respData) != 0 || n != 1) {
-			return nil, nil, nil, fmt.Errorf("bad data size: %d instead of %d", n, len(respData))
-		}
-		if oobn != len(oobData) {
-			return nil, nil, nil, fmt.Errorf("bad oob data size: %d instead of %d", oobn, len(oobData))
+func (c *FDClient) writeRequest(conn *net.UnixConn, hdr *fdHeader, data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := writeHeader(conn, hdr); err != nil {
+		return fmt.Errorf("error writing request header: %v", err)
+	}
+
+	if len(data) > 0 {
+		if err := binary.Write(conn, binary.BigEndian, data); err != nil {
+			return fmt.Errorf("error writing request payload: %v", err)
 		}
 	}
+	return nil
+}
+
+func (c *FDClient) request(hdr *fdHeader, data []byte) (*fdHeader, []byte, []byte, error) {
+	c.Lock()
+	legacy := c.legacy
+	c.Unlock()
+	if legacy {
+		c.legacyLock.Lock()
+		defer c.legacyLock.Unlock()
+	}
+
+	c.Lock()
+	if c.conn == nil {
+		c.Unlock()
+		return nil, nil, nil, errors.New("not connected")
+	}
+	if c.recvErr != nil {
+		err := c.recvErr
+		c.Unlock()
+		return nil, nil, nil, fmt.Errorf("connection is broken: %v", err)
+	}
+	conn := c.conn
+	hdr.Magic = fdMagic
+	if c.legacy {
+		hdr.Magic = fdLegacyMagic
+	}
+	if hdr.Command == fdAdd && c.timeout > 0 {
+		hdr.TimeoutMs = uint32(c.timeout / time.Millisecond)
+	}
+	if c.compression {
+		hdr.Flags |= fdFlagAcceptGzip
+	}
+	data, err := encodePayload(hdr, data, c.compression && c.serverAcceptsGzip)
+	if err != nil {
+		c.Unlock()
+		return nil, nil, nil, err
+	}
+	c.lastRequestID++
+	hdr.RequestID = c.lastRequestID
+	respCh := make(chan *fdReply, 1)
+	c.pending[hdr.RequestID] = respCh
+	c.Unlock()
 
-	if respHdr.Command == fdError {
-		return nil, nil, nil, fmt.Errorf("server returned error: %s", respData)
+	if err := c.writeRequest(conn, hdr, data); err != nil {
+		// the stream may be broken at this point, so we close
+		// the connection to make the pending requests fail
+		conn.Close()
+		return nil, nil, nil, err
 	}
 
-	if respHdr.Command != hdr.Command|fdResponse {
-		return nil, nil, nil, fmt.Errorf("unexpected command %02x", respHdr.Command)
+	resp := <-respCh
+	if resp.err != nil {
+		return nil, nil, nil, resp.err
 	}
 
-	return &respHdr, respData, oobData, nil
+	if resp.hdr.Flags&fdFlagAcceptGzip != 0 {
+		c.Lock()
+		c.serverAcceptsGzip = true
+		c.Unlock()
+	}
+	respData, err := decodePayload(&resp.hdr, resp.data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if resp.hdr.Command == fdError {
+		return nil, nil, nil, serverError(respData)
+	}
+
+	if resp.hdr.Command != hdr.Command|fdResponse {
+		return nil, nil, nil, fmt.Errorf("unexpected command %02x", resp.hdr.Command)
+	}
+
+	return &resp.hdr, respData, resp.oobData, nil
+}
+
+// serverError is an error returned by the server
+type serverError string
+
+func (e serverError) Error() string {
+	return "server returned error: " + string(e)
+}
+
+// isServerError returns true if err is the specified
+// error returned by the server
+func isServerError(err, serverErr error) bool {
+	se, ok := err.(serverError)
+	return ok && string(se) == serverErr.Error()
+}
+
+// marshalRequestData converts the request data to JSON unless it's
+// already a byte slice
+func marshalRequestData(data interface{}) ([]byte, error) {
+	if bs, ok := data.([]byte); ok {
+		return bs, nil
+	}
+	bs, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error marshalling json: %v", err)
+	}
+	return bs, nil
 }
 
 // AddFDs requests the FDServer to add a new file descriptor
 // using its FDSource. It returns the info which is returned
 // by FDSource's GetFDs() call
 func (c *FDClient) AddFDs(key string, data interface{}) ([]byte, error) {
-	bs, ok := data.([]byte)
-	if !ok {
-		var err error
-		bs, err = json.Marshal(data)
-		if err != nil {
-			return nil, fmt.Errorf("error marshalling json: %v", err)
-		}
+	bs, err := marshalRequestData(data)
+	if err != nil {
+		return nil, err
 	}
 	respHdr, respData, _, err := c.request(&fdHeader{
-		Command:  fdAdd,
-		DataSize: uint32(len(bs)),
-		Key:      fdKey(key),
+		Command: fdAdd,
+		Key:     fdKey(key),
 	}, bs)
 	if err != nil {
 		return nil, err
@@ -479,17 +1425,77 @@ func (c *FDClient) GetFDs(key string) ([]int, []byte, error) {
 		return nil, nil, err
 	}
 
+	fds, err := parseUnixRights(oobData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fds, respData, nil
+}
+
+// parseUnixRights returns the file descriptors passed
+// in the out-of-band data
+func parseUnixRights(oobData []byte) ([]int, error) {
 	scms, err := syscall.ParseSocketControlMessage(oobData)
 	if err != nil {
-		return nil, nil, fmt.Errorf("couldn't parse socket control message: %v", err)
+		return nil, fmt.Errorf("couldn't parse socket control message: %v", err)
 	}
 	if len(scms) != 1 {
-		return nil, nil, fmt.Errorf("unexpected number of socket control messages: %d instead of 1", len(scms))
+		return nil, fmt.Errorf("unexpected number of socket control messages: %d instead of 1", len(scms))
 	}
 
 	fds, err := syscall.ParseUnixRights(&scms[0])
 	if err != nil {
-		return nil, nil, fmt.Errorf("can't decode file descriptors: %v", err)
+		return nil, fmt.Errorf("can't decode file descriptors: %v", err)
 	}
-	return fds, respData, nil
+	return fds, nil
+}
+
+// QueryInfo returns the data that's returned from FDSource's
+// QueryInfo() call for the key. Unlike GetFDs(), it doesn't
+// transfer the file descriptors
+func (c *FDClient) QueryInfo(key string) ([]byte, error) {
+	_, respData, _, err := c.request(&fdHeader{
+		Command: fdQuery,
+		Key:     fdKey(key),
+	}, nil)
+	return respData, err
+}
+
+// Ping checks that FDServer is able to handle the requests
+func (c *FDClient) Ping() error {
+	_, _, _, err := c.request(&fdHeader{Command: fdPing}, nil)
+	return err
+}
+
+// ListKeys returns the sorted list of the keys
+// that have file descriptors on the server
+func (c *FDClient) ListKeys() ([]string, error) {
+	if !c.peerSupports(version.FeatureListKeys) {
+		return nil, fmt.Errorf("listing the keys is not supported by %s", c.Peer())
+	}
+	_, respData, _, err := c.request(&fdHeader{Command: fdList}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(respData, &keys); err != nil {
+		return nil, fmt.Errorf("error unmarshalling the list of keys: %v", err)
+	}
+	return keys, nil
+}
+
+// Report sends the data to FDSource's Report() method for the
+// key. It's intended to be used by the client that has obtained
+// the file descriptors using GetFDs() to tell the server how
+// they're being used
+func (c *FDClient) Report(key string, data interface{}) error {
+	bs, err := marshalRequestData(data)
+	if err != nil {
+		return err
+	}
+	_, _, _, err = c.request(&fdHeader{
+		Command: fdReport,
+		Key:     fdKey(key),
+	}, bs)
+	return err
 }
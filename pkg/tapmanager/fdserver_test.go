@@ -17,34 +17,72 @@ limitations under the License.
 package tapmanager
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/version"
 )
 
 type sampleFDData struct {
 	Content string
+	// Echo makes the source return the content from
+	// GetFDs() and GetInfo()
+	Echo bool
 }
 
 type sampleFDSource struct {
+	sync.Mutex
 	tmpDir string
 	files  map[string]*os.File
+	// blockCh, if set, makes GetFDs() for blockKey wait until the channel
+	// is closed or, unless ignoreCancel is set, the context is done
+	blockKey     string
+	blockCh      chan struct{}
+	ignoreCancel bool
+	// releaseCh, if set, receives the keys passed to Release()
+	releaseCh chan string
+	echo      map[string]string
+	reports   map[string]string
 }
 
 var _ FDSource = &sampleFDSource{}
 
 func newSampleFDSource(tmpDir string) *sampleFDSource {
 	return &sampleFDSource{
-		tmpDir: tmpDir,
-		files:  make(map[string]*os.File),
+		tmpDir:  tmpDir,
+		files:   make(map[string]*os.File),
+		echo:    make(map[string]string),
+		reports: make(map[string]string),
 	}
 }
 
-func (s *sampleFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
+func (s *sampleFDSource) GetFDs(ctx context.Context, key string, data []byte) ([]int, []byte, error) {
+	if s.blockCh != nil && key == s.blockKey {
+		if s.ignoreCancel {
+			<-s.blockCh
+		} else {
+			select {
+			case <-s.blockCh:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+	}
+	s.Lock()
+	defer s.Unlock()
 	var fdData sampleFDData
 	if err := json.Unmarshal(data, &fdData); err != nil {
 		return nil, nil, fmt.Errorf("error unmarshalling json: %v", err)
@@ -70,42 +108,79 @@ func (s *sampleFDSource) GetFDs(key string, data []byte) ([]int, []byte, error)
 		return nil, nil, fmt.Errorf("Seek(): %v", err)
 	}
 	s.files[key] = f
+	if fdData.Echo {
+		s.echo[key] = fdData.Content
+		return []int{int(f.Fd())}, []byte(fdData.Content), nil
+	}
 	return []int{int(f.Fd())}, []byte("abcdef"), nil
 }
 
 func (s *sampleFDSource) Release(key string) error {
+	s.Lock()
+	defer s.Unlock()
 	f, found := s.files[key]
 	if !found {
 		return fmt.Errorf("file not found: %q", key)
 	}
 	delete(s.files, key)
+	delete(s.echo, key)
+	delete(s.reports, key)
 	if err := f.Close(); err != nil {
 		return fmt.Errorf("can't close file %q: %v", f.Name(), err)
 	}
+	if s.releaseCh != nil {
+		s.releaseCh <- key
+	}
 	return nil
 }
 
 func (s *sampleFDSource) GetInfo(key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
 	_, found := s.files[key]
 	if !found {
 		return nil, fmt.Errorf("file not found: %q", key)
 	}
-	return []byte("info_" + key), nil
+	return []byte("info_" + key + s.echo[key]), nil
+}
+
+func (s *sampleFDSource) QueryInfo(key string) ([]byte, error) {
+	return s.GetInfo(key)
+}
+
+func (s *sampleFDSource) Report(key string, data []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, found := s.files[key]; !found {
+		return fmt.Errorf("file not found: %q", key)
+	}
+	s.reports[key] = string(data)
+	return nil
+}
+
+func (s *sampleFDSource) getReport(key string) string {
+	s.Lock()
+	defer s.Unlock()
+	return s.reports[key]
 }
 
 func (s *sampleFDSource) isEmpty() bool {
+	s.Lock()
+	defer s.Unlock()
 	return len(s.files) == 0
 }
 
-func verifyFD(t *testing.T, c *FDClient, key string, data string) {
+func verifyFD(t *testing.T, c *FDClient, key string, data string, expectedInfo ...string) {
 	fds, info, err := c.GetFDs(key)
 	if err != nil {
 		t.Fatalf("GetFDs(): %v", err)
 	}
 
-	expectedInfo := "info_" + key
-	if string(info) != expectedInfo {
-		t.Errorf("bad info: %q instead of %q", info, expectedInfo)
+	if len(expectedInfo) == 0 {
+		expectedInfo = []string{"info_" + key}
+	}
+	if string(info) != expectedInfo[0] {
+		t.Errorf("bad info (%d bytes): %.100q... instead of %.100q...", len(info), info, expectedInfo[0])
 	}
 
 	f1 := os.NewFile(uintptr(fds[0]), "acquired-fd")
@@ -117,7 +192,7 @@ func verifyFD(t *testing.T, c *FDClient, key string, data string) {
 	}
 
 	if string(content) != data {
-		t.Errorf("bad content: %q instead of %q", content, data)
+		t.Errorf("bad content (%d bytes): %.100q... instead of %.100q...", len(content), content, data)
 	}
 }
 
@@ -145,6 +220,13 @@ func TestFDServer(t *testing.T) {
 		}
 	}()
 
+	if err := c.Ping(); err != nil {
+		t.Errorf("Ping(): %v", err)
+	}
+	if peer := c.Peer(); peer.Component != "tapmanager" || peer.Version != version.ProtocolVersion {
+		t.Errorf("bad peer version info: %s", peer)
+	}
+
 	content := []string{"foo", "bar", "baz"}
 	for _, data := range content {
 		var err error
@@ -162,6 +244,27 @@ func TestFDServer(t *testing.T) {
 	for _, data := range content {
 		key := "k_" + data
 		verifyFD(t, c, key, data)
+		info, err := c.QueryInfo(key)
+		if err != nil {
+			t.Fatalf("QueryInfo(): %v", err)
+		}
+		if expectedInfo := "info_" + key; string(info) != expectedInfo {
+			t.Errorf("bad info from QueryInfo(): %q instead of %q", info, expectedInfo)
+		}
+		if err := c.Report(key, []byte("report_"+data)); err != nil {
+			t.Fatalf("Report(): %v", err)
+		}
+		if report, expectedReport := src.getReport(key), "report_"+data; report != expectedReport {
+			t.Errorf("bad report: %q instead of %q", report, expectedReport)
+		}
+	}
+
+	keys, err := c.ListKeys()
+	if err != nil {
+		t.Fatalf("ListKeys(): %v", err)
+	}
+	if expectedKeys := []string{"k_bar", "k_baz", "k_foo"}; !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("bad keys from ListKeys(): %v instead of %v", keys, expectedKeys)
 	}
 
 	for _, data := range content {
@@ -180,7 +283,631 @@ func TestFDServer(t *testing.T) {
 		t.Errorf("Bad error message from GetFD: %q instead of %q", err.Error(), expectedErrorMessage)
 	}
 
+	if err := c.Report("k_foo", []byte("report")); err == nil {
+		t.Errorf("Report didn't return an error for a released fd")
+	}
+
+	if !src.isEmpty() {
+		t.Errorf("fd source is not empty (but it should be)")
+	}
+}
+
+func TestFDServerSources(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	defaultSrc := newSampleFDSource(tmpDir)
+	s := NewFDServer(socketPath, defaultSrc)
+	vhostDir := filepath.Join(tmpDir, "vhost")
+	if err := os.Mkdir(vhostDir, 0755); err != nil {
+		t.Fatalf("Mkdir(): %v", err)
+	}
+	vhostSrc := newSampleFDSource(vhostDir)
+	if err := s.RegisterSource("vhost", vhostSrc); err != nil {
+		t.Fatalf("RegisterSource(): %v", err)
+	}
+	for _, prefix := range []string{"vhost", "", "tcp/foo"} {
+		if err := s.RegisterSource(prefix, newSampleFDSource(tmpDir)); err == nil {
+			t.Errorf("RegisterSource() didn't fail for prefix %q", prefix)
+		}
+	}
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+	c := NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+
+	vhostKey := FDSourceKey("vhost", "k_foo")
+	for _, key := range []string{"k_foo", vhostKey} {
+		if _, err := c.AddFDs(key, sampleFDData{Content: "content_" + key}); err != nil {
+			t.Fatalf("AddFDs(): %v", err)
+		}
+	}
+	verifyFD(t, c, "k_foo", "content_k_foo")
+	// the source receives the key without the prefix
+	verifyFD(t, c, vhostKey, "content_"+vhostKey, "info_k_foo")
+	if err := c.Report(vhostKey, []byte("report")); err != nil {
+		t.Fatalf("Report(): %v", err)
+	}
+	if report := vhostSrc.getReport("k_foo"); report != "report" {
+		t.Errorf("bad report for the vhost source: %q", report)
+	}
+	if report := defaultSrc.getReport("k_foo"); report != "" {
+		t.Errorf("the report was passed to the wrong source: %q", report)
+	}
+
+	if _, err := c.AddFDs(FDSourceKey("tcp", "k_foo"), sampleFDData{Content: "foo"}); err == nil {
+		t.Errorf("AddFDs() didn't fail for unregistered source")
+	}
+
+	if err := c.ReleaseFDs(vhostKey); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+	if !vhostSrc.isEmpty() {
+		t.Errorf("vhost fd source is not empty (but it should be)")
+	}
+	if defaultSrc.isEmpty() {
+		t.Errorf("the fd was released from the wrong source")
+	}
+	if err := c.ReleaseFDs("k_foo"); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+}
+
+func TestFDClientMultiplexing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	src := newSampleFDSource(tmpDir)
+	src.blockKey = "k_slow"
+	src.blockCh = make(chan struct{})
+	s := NewFDServer(socketPath, src)
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+	c := NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := c.AddFDs("k_slow", sampleFDData{Content: "slow"})
+		slowDone <- err
+	}()
+
+	// the requests below must not be blocked by the pending slow one
+	fastDone := make(chan error, 1)
+	go func() {
+		_, err := c.AddFDs("k_fast", sampleFDData{Content: "fast"})
+		fastDone <- err
+	}()
+
+	select {
+	case err := <-fastDone:
+		if err != nil {
+			t.Fatalf("AddFDs(): %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("AddFDs() was blocked by a pending request")
+	}
+	verifyFD(t, c, "k_fast", "fast")
+	if err := c.ReleaseFDs("k_fast"); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+
+	select {
+	case <-slowDone:
+		t.Fatalf("the slow request was not blocked")
+	default:
+	}
+
+	close(src.blockCh)
+	if err := <-slowDone; err != nil {
+		t.Fatalf("AddFDs(): %v", err)
+	}
+	verifyFD(t, c, "k_slow", "slow")
+	if err := c.ReleaseFDs("k_slow"); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+
+	if !src.isEmpty() {
+		t.Errorf("fd source is not empty (but it should be)")
+	}
+}
+
+func TestFDServerAddTimeout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	src := newSampleFDSource(tmpDir)
+	src.blockKey = "k_slow"
+	src.blockCh = make(chan struct{})
+	src.releaseCh = make(chan string, 10)
+	s := NewFDServer(socketPath, src)
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+	c := NewFDClient(socketPath)
+	c.SetAddTimeout(100 * time.Millisecond)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+
+	// the source gives up when the context is cancelled
+	if _, err := c.AddFDs("k_slow", sampleFDData{Content: "slow"}); err == nil {
+		t.Fatalf("AddFDs() didn't time out")
+	}
+	if _, _, err := c.GetFDs("k_slow"); err == nil {
+		t.Errorf("GetFDs() didn't fail for a timed out key")
+	}
+	if !src.isEmpty() {
+		t.Errorf("fd source is not empty (but it should be)")
+	}
+
+	// the source ignores the cancellation and completes
+	// GetFDs() after the timeout. The fds must be released
+	src.ignoreCancel = true
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := c.AddFDs("k_slow", sampleFDData{Content: "slow"})
+		slowDone <- err
+	}()
+	time.Sleep(200 * time.Millisecond)
+	close(src.blockCh)
+	if err := <-slowDone; err == nil {
+		t.Fatalf("AddFDs() didn't time out")
+	}
+	select {
+	case key := <-src.releaseCh:
+		if key != "k_slow" {
+			t.Errorf("bad key released: %q instead of %q", key, "k_slow")
+		}
+	default:
+		t.Fatalf("the fds were not released after the timeout")
+	}
+	if !src.isEmpty() {
+		t.Errorf("fd source is not empty (but it should be)")
+	}
+
+	if _, err := c.AddFDs("k_fast", sampleFDData{Content: "fast"}); err != nil {
+		t.Fatalf("AddFDs(): %v", err)
+	}
+	verifyFD(t, c, "k_fast", "fast")
+	if err := c.ReleaseFDs("k_fast"); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+}
+
+func TestFDServerKeySerialization(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	src := newSampleFDSource(tmpDir)
+	src.blockKey = "k_slow"
+	src.blockCh = make(chan struct{})
+	s := NewFDServer(socketPath, src)
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+	c := NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+
+	addDone := make(chan error, 1)
+	go func() {
+		_, err := c.AddFDs("k_slow", sampleFDData{Content: "slow"})
+		addDone <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// the release must wait for the pending add to complete
+	releaseDone := make(chan error, 1)
+	go func() {
+		releaseDone <- c.ReleaseFDs("k_slow")
+	}()
+	select {
+	case err := <-releaseDone:
+		t.Fatalf("ReleaseFDs() was not blocked by the pending AddFDs() for the same key (error: %v)", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(src.blockCh)
+	if err := <-addDone; err != nil {
+		t.Errorf("AddFDs(): %v", err)
+	}
+	if err := <-releaseDone; err != nil {
+		t.Errorf("ReleaseFDs(): %v", err)
+	}
 	if !src.isEmpty() {
 		t.Errorf("fd source is not empty (but it should be)")
 	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.keyLocks) != 0 {
+		t.Errorf("the key locks were not removed: %v", s.keyLocks)
+	}
+}
+
+func TestPayloadEncoding(t *testing.T) {
+	small := []byte("foobar")
+	large := bytes.Repeat([]byte("0123456789"), 1000)
+	for _, tc := range []struct {
+		name       string
+		data       []byte
+		compress   bool
+		compressed bool
+	}{
+		{"small payload", small, true, false},
+		{"large payload", large, true, true},
+		{"large payload without compression", large, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hdr fdHeader
+			encoded, err := encodePayload(&hdr, tc.data, tc.compress)
+			if err != nil {
+				t.Fatalf("encodePayload(): %v", err)
+			}
+			if int(hdr.DataSize) != len(encoded) {
+				t.Errorf("bad data size in the header: %d instead of %d", hdr.DataSize, len(encoded))
+			}
+			if compressed := hdr.Flags&fdFlagGzip != 0; compressed != tc.compressed {
+				t.Errorf("compressed flag is %v, expected %v", compressed, tc.compressed)
+			}
+			if tc.compressed && len(encoded) >= len(tc.data) {
+				t.Errorf("the payload wasn't compressed")
+			}
+			decoded, err := decodePayload(&hdr, encoded)
+			if err != nil {
+				t.Fatalf("decodePayload(): %v", err)
+			}
+			if !bytes.Equal(decoded, tc.data) {
+				t.Errorf("payload mismatch after decoding")
+			}
+		})
+	}
+}
+
+func TestFDServerLargePayloads(t *testing.T) {
+	for _, compression := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compression=%v", compression), func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+			if err != nil {
+				t.Fatalf("ioutil.TempDir(): %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			socketPath := filepath.Join(tmpDir, "passfd")
+			src := newSampleFDSource(tmpDir)
+			s := NewFDServer(socketPath, src)
+			if err := s.Serve(); err != nil {
+				t.Fatalf("Serve(): %v", err)
+			}
+			defer s.Stop()
+			c := NewFDClient(socketPath)
+			c.SetCompression(compression)
+			if err := c.Connect(); err != nil {
+				t.Fatalf("Connect(): %v", err)
+			}
+			defer c.Close()
+
+			// a few requests are made so the compressed requests
+			// are sent after the client learns the server supports them
+			for i := 0; i < 3; i++ {
+				key := fmt.Sprintf("k_%d", i)
+				content := strings.Repeat(fmt.Sprintf("{\"interface\": %d}", i), 100000)
+				respData, err := c.AddFDs(key, sampleFDData{Content: content, Echo: true})
+				if err != nil {
+					t.Fatalf("AddFDs(): %v", err)
+				}
+				if string(respData) != content {
+					t.Errorf("bad data returned from add (%d bytes instead of %d)", len(respData), len(content))
+				}
+				verifyFD(t, c, key, content, "info_"+key+content)
+				if err := c.ReleaseFDs(key); err != nil {
+					t.Fatalf("ReleaseFDs(): %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestFDServerStaleSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// simulate a crashed server which leaves its socket behind
+	socketPath := filepath.Join(tmpDir, "passfd")
+	addr, err := net.ResolveUnixAddr("unix", socketPath)
+	if err != nil {
+		t.Fatalf("ResolveUnixAddr(): %v", err)
+	}
+	l, err := net.ListenUnix("unix", addr)
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	l.SetUnlinkOnClose(false)
+	l.Close()
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Fatalf("the stale socket is not there: %v", err)
+	}
+
+	src := newSampleFDSource(tmpDir)
+	s := NewFDServer(socketPath, src)
+	s.SetSocketPermissions(0600, -1, -1)
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+
+	fi, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("Stat(): %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Errorf("bad socket permissions %04o instead of 0600", perm)
+	}
+
+	c := NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+	if _, err := c.AddFDs("k_foo", sampleFDData{Content: "foo"}); err != nil {
+		t.Fatalf("AddFDs(): %v", err)
+	}
+	verifyFD(t, c, "k_foo", "foo")
+	if err := c.ReleaseFDs("k_foo"); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+
+	// the socket of a live server must not be removed
+	if err := NewFDServer(socketPath, newSampleFDSource(tmpDir)).Serve(); err == nil {
+		t.Errorf("Serve() didn't fail for a socket that's in use")
+	}
+	if _, err := c.AddFDs("k_bar", sampleFDData{Content: "bar"}); err != nil {
+		t.Fatalf("AddFDs() after an attempt to start another server: %v", err)
+	}
+	if err := c.ReleaseFDs("k_bar"); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+
+	// files which are not sockets must not be removed either
+	filePath := filepath.Join(tmpDir, "notasocket")
+	if err := ioutil.WriteFile(filePath, []byte("foo"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := NewFDServer(filePath, newSampleFDSource(tmpDir)).Serve(); err == nil {
+		t.Errorf("Serve() didn't fail for a path that's not a socket")
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("the file was removed: %v", err)
+	}
+}
+
+func TestFDServerVersionMismatch(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	savedServerVersion := serverVersion
+	defer func() { serverVersion = savedServerVersion }()
+	serverVersion = func() version.Info {
+		return version.Info{
+			Component:  "tapmanager",
+			Version:    version.ProtocolVersion + 2,
+			MinVersion: version.ProtocolVersion + 1,
+		}
+	}
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	s := NewFDServer(socketPath, newSampleFDSource(tmpDir))
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+
+	c := NewFDClient(socketPath)
+	c.SetComponent("vmwrapper")
+	err = c.Connect()
+	switch {
+	case err == nil:
+		c.Close()
+		t.Fatalf("Connect() didn't fail for an incompatible server")
+	case !strings.Contains(err.Error(), "is too old for tapmanager"):
+		t.Errorf("bad error message: %v", err)
+	}
+	if err := c.Ping(); err == nil {
+		t.Errorf("the connection is not closed after a failed handshake")
+	}
+}
+
+func TestFDServerLegacyClient(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	src := newSampleFDSource(tmpDir)
+	s := NewFDServer(socketPath, src)
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+
+	// make a request the way the legacy clients do it
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Dial(): %v", err)
+	}
+	defer conn.Close()
+	data, err := json.Marshal(sampleFDData{Content: "foo"})
+	if err != nil {
+		t.Fatalf("json.Marshal(): %v", err)
+	}
+	if err := binary.Write(conn, binary.BigEndian, &fdLegacyHeader{
+		Magic:    fdLegacyMagic,
+		Command:  fdAdd,
+		DataSize: uint32(len(data)),
+		Key:      fdKey("k_foo"),
+	}); err != nil {
+		t.Fatalf("error writing legacy header: %v", err)
+	}
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("error writing the payload: %v", err)
+	}
+	var respHdr fdLegacyHeader
+	if err := binary.Read(conn, binary.BigEndian, &respHdr); err != nil {
+		t.Fatalf("error reading legacy header: %v", err)
+	}
+	if respHdr.Magic != fdLegacyMagic || respHdr.Command != fdAddResponse {
+		t.Fatalf("bad response header: %#v", respHdr)
+	}
+	respData := make([]byte, respHdr.DataSize)
+	if _, err := io.ReadFull(conn, respData); err != nil {
+		t.Fatalf("error reading the payload: %v", err)
+	}
+	if string(respData) != "abcdef" {
+		t.Errorf("bad data returned from add: %q instead of %q", respData, "abcdef")
+	}
+
+	c := NewFDClient(socketPath)
+	if _, err := c.connect(true); err != nil {
+		t.Fatalf("connect(): %v", err)
+	}
+	defer c.Close()
+	if err := c.handshake(); err != nil {
+		t.Fatalf("handshake(): %v", err)
+	}
+	verifyFD(t, c, "k_foo", "foo")
+	if err := c.ReleaseFDs("k_foo"); err != nil {
+		t.Fatalf("ReleaseFDs(): %v", err)
+	}
+	if !src.isEmpty() {
+		t.Errorf("fd source is not empty (but it should be)")
+	}
+}
+
+// serveLegacyConn handles the requests the way the servers that
+// predate request ids do it, echoing back the payload of fdAdd
+// requests
+func serveLegacyConn(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var hdr fdLegacyHeader
+		if err := binary.Read(conn, binary.BigEndian, &hdr); err != nil || hdr.Magic != fdLegacyMagic {
+			return
+		}
+		data := make([]byte, hdr.DataSize)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return
+		}
+		respHdr := fdLegacyHeader{Magic: fdLegacyMagic, Command: fdAddResponse, Key: hdr.Key}
+		if hdr.Command != fdAdd {
+			respHdr.Command = fdError
+			data = []byte("bad command")
+		}
+		respHdr.DataSize = uint32(len(data))
+		if err := binary.Write(conn, binary.BigEndian, &respHdr); err != nil {
+			return
+		}
+		if _, err := conn.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func TestFDClientLegacyServer(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Listen(): %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveLegacyConn(conn)
+		}
+	}()
+
+	c := NewFDClient(socketPath)
+	c.SetCompression(true)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+	if peer := c.Peer(); peer.Version != version.LegacyProtocolVersion || peer.Features != 0 {
+		t.Errorf("bad peer version info: %s", peer)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			// the payload is big enough to be compressed
+			// if the compression was used
+			content := key + strings.Repeat("x", fdCompressThreshold)
+			respData, err := c.AddFDs(key, sampleFDData{Content: content})
+			if err != nil {
+				t.Errorf("AddFDs(): %v", err)
+				return
+			}
+			var fdData sampleFDData
+			if err := json.Unmarshal(respData, &fdData); err != nil {
+				t.Errorf("error unmarshalling the response: %v", err)
+			} else if fdData.Content != content {
+				t.Errorf("got the response for a wrong request: %.10q... instead of %.10q...", fdData.Content, content)
+			}
+		}(fmt.Sprintf("k_%d", i))
+	}
+	wg.Wait()
+
+	if err := c.Ping(); err == nil || !isServerError(err, errBadCommand) {
+		t.Errorf("Ping() didn't return the bad command error: %v", err)
+	}
 }
@@ -0,0 +1,347 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/version"
+)
+
+// handoffAdoptTimeout is the time after which the inherited file
+// descriptors that weren't claimed during the recovery are closed
+var handoffAdoptTimeout = 10 * time.Minute
+
+var errHandingOff = errors.New("fd server is being handed off")
+
+// FDAdopter is implemented by the FDSources that can take over
+// the file descriptors of another tapmanager process, so the VMs
+// keep running with their network intact while tapmanager is
+// being replaced
+type FDAdopter interface {
+	// AdoptFDs is called instead of GetFDs() for a key that has
+	// file descriptors inherited from the previous FDServer.
+	// The source takes the ownership of the inherited
+	// descriptors, closing them if it can't use them
+	AdoptFDs(key string, data []byte, fds []int) ([]int, []byte, error)
+	// Detach makes the source stop using the resources that
+	// can't be shared with the new tapmanager process, such as
+	// DHCP listeners, without tearing down the networks. It's
+	// called right before the handoff is finished
+	Detach()
+}
+
+// handoffInfo describes the state of FDServer that's handed off
+type handoffInfo struct {
+	// FDCounts maps the fd keys to the numbers of the file
+	// descriptors that are handed off for them
+	FDCounts map[string]int `json:"fdCounts"`
+}
+
+// HandedOff returns a channel that's closed once the socket and
+// the file descriptors of FDServer are taken over by another
+// FDServer. After that, the process must exit without releasing
+// the file descriptors
+func (s *FDServer) HandedOff() <-chan struct{} {
+	return s.handedOffCh
+}
+
+// handingOff returns true if the handoff is in progress or
+// has already finished
+func (s *FDServer) handingOff() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.handingOffLocked()
+}
+
+func (s *FDServer) handingOffLocked() bool {
+	if s.handoffConn != nil {
+		return true
+	}
+	select {
+	case <-s.handedOffCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// serveHandoff handles the handoff requests. The request with
+// empty key starts the handoff and returns the listening socket
+// along with the list of the keys, and the requests that follow it
+// return the file descriptors for each key. The requests that can
+// change the set of the file descriptors are rejected until the
+// handoff is finished or aborted
+func (s *FDServer) serveHandoff(c *net.UnixConn, hdr *fdHeader) (*fdHeader, []byte, []byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	var respData []byte
+	var fds []int
+	if key := hdr.getKey(); key != "" {
+		if s.handoffConn != c {
+			return nil, nil, nil, errors.New("handoff is not started")
+		}
+		var found bool
+		if fds, found = s.fds[key]; !found {
+			return nil, nil, nil, fmt.Errorf("bad fd key: %q", key)
+		}
+	} else {
+		switch {
+		case s.handingOffLocked():
+			return nil, nil, nil, errHandingOff
+		case s.stopCh == nil:
+			return nil, nil, nil, errors.New("fd server is not listening")
+		}
+		f, err := s.lst.File()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("can't get the listening socket: %v", err)
+		}
+		// File() and Fd() may switch the socket to blocking mode
+		// which would keep Stop() from interrupting Accept()
+		// if the handoff is aborted
+		lstFD := int(f.Fd())
+		if err := syscall.SetNonblock(lstFD, true); err != nil {
+			f.Close()
+			return nil, nil, nil, fmt.Errorf("can't restore non-blocking mode of the listening socket: %v", err)
+		}
+		info := handoffInfo{FDCounts: make(map[string]int)}
+		for key, keyFDs := range s.fds {
+			info.FDCounts[key] = len(keyFDs)
+		}
+		if respData, err = json.Marshal(info); err != nil {
+			f.Close()
+			return nil, nil, nil, fmt.Errorf("error marshalling handoff info: %v", err)
+		}
+		glog.Infof("Handing off fd server socket %q with %d key(s)", s.socketPath, len(info.FDCounts))
+		s.handoffConn = c
+		// the file is closed after the response is sent,
+		// which happens before the handoff is finished
+		s.handoffFiles = append(s.handoffFiles, f)
+		fds = []int{lstFD}
+	}
+	rights := syscall.UnixRights(fds...)
+	return &fdHeader{
+		Magic:   fdMagic,
+		Command: fdHandoffResponse,
+		OobSize: uint32(len(rights)),
+		Key:     hdr.Key,
+	}, respData, rights, nil
+}
+
+// serveHandoffDone finishes the handoff, making FDServer stop
+// listening on the socket that's now served by the new FDServer
+func (s *FDServer) serveHandoffDone(c *net.UnixConn) (*fdHeader, error) {
+	s.Lock()
+	defer s.Unlock()
+	if s.handoffConn != c {
+		return nil, errors.New("handoff is not started")
+	}
+	sources := []FDSource{s.source}
+	for _, src := range s.sources {
+		sources = append(sources, src)
+	}
+	for _, src := range sources {
+		if adopter, ok := src.(FDAdopter); ok {
+			adopter.Detach()
+		}
+	}
+	if s.stopCh != nil {
+		// the socket file now belongs to the new server
+		s.lst.SetUnlinkOnClose(false)
+		close(s.stopCh)
+		s.lst.Close()
+		s.stopCh = nil
+	}
+	s.finishHandoffLocked()
+	close(s.handedOffCh)
+	glog.Infof("Fd server socket %q is handed off", s.socketPath)
+	return &fdHeader{Magic: fdMagic, Command: fdHandoffDoneResponse}, nil
+}
+
+// abortHandoff resumes normal operation of FDServer if the
+// connection that was used to start the handoff is closed
+// before the handoff is finished
+func (s *FDServer) abortHandoff(c *net.UnixConn) {
+	s.Lock()
+	defer s.Unlock()
+	if s.handoffConn == c {
+		glog.Warningf("Handoff of fd server socket %q aborted", s.socketPath)
+		s.finishHandoffLocked()
+	}
+}
+
+func (s *FDServer) finishHandoffLocked() {
+	for _, f := range s.handoffFiles {
+		f.Close()
+	}
+	s.handoffFiles = nil
+	s.handoffConn = nil
+}
+
+// TakeOver makes FDServer take over the listening socket and the
+// file descriptors of a running FDServer that belongs to an older
+// tapmanager process and listens on the same socket path. The
+// clients don't notice the change as the socket stays the same.
+// Instead of creating new file descriptors, the sources adopt the
+// inherited ones when AddFDs() is called for the corresponding keys
+// while the pod networks are being recovered. The inherited file
+// descriptors that aren't claimed within handoffAdoptTimeout are
+// closed. If there's no FDServer to take over or it doesn't support
+// the handoff, TakeOver() returns an error, and Serve() can be used
+// instead.
+func (s *FDServer) TakeOver() error {
+	s.Lock()
+	listening := s.stopCh != nil
+	s.Unlock()
+	if listening {
+		return errors.New("already listening")
+	}
+
+	c := NewFDClient(s.socketPath)
+	c.SetComponent("tapmanager")
+	if err := c.Connect(); err != nil {
+		return err
+	}
+	defer c.Close()
+	if !c.peerSupports(version.FeatureHandoff) {
+		return fmt.Errorf("handoff is not supported by %s", c.Peer())
+	}
+
+	_, respData, oobData, err := c.request(&fdHeader{Command: fdHandoff, Key: fdKey("")}, nil)
+	if err != nil {
+		return fmt.Errorf("error starting the handoff: %v", err)
+	}
+	lstFDs, err := parseUnixRights(oobData)
+	switch {
+	case err != nil:
+		return err
+	case len(lstFDs) != 1:
+		closeFDs(lstFDs)
+		return fmt.Errorf("got %d file descriptors instead of the listening socket", len(lstFDs))
+	}
+	lstFile := os.NewFile(uintptr(lstFDs[0]), s.socketPath)
+	defer lstFile.Close()
+	var info handoffInfo
+	if err := json.Unmarshal(respData, &info); err != nil {
+		return fmt.Errorf("error unmarshalling handoff info: %v", err)
+	}
+
+	inherited := make(map[string][]int)
+	abandon := func() {
+		for _, fds := range inherited {
+			closeFDs(fds)
+		}
+	}
+	for key, count := range info.FDCounts {
+		_, _, oobData, err := c.request(&fdHeader{Command: fdHandoff, Key: fdKey(key)}, nil)
+		if err != nil {
+			abandon()
+			return fmt.Errorf("error getting file descriptors for key %q: %v", key, err)
+		}
+		fds, err := parseUnixRights(oobData)
+		if err != nil {
+			abandon()
+			return err
+		}
+		inherited[key] = fds
+		if len(fds) != count {
+			abandon()
+			return fmt.Errorf("got %d file descriptors for key %q instead of %d", len(fds), key, count)
+		}
+	}
+
+	l, err := net.FileListener(lstFile)
+	if err != nil {
+		abandon()
+		return fmt.Errorf("can't use the inherited socket: %v", err)
+	}
+	ul, ok := l.(*net.UnixListener)
+	if !ok {
+		l.Close()
+		abandon()
+		return fmt.Errorf("the inherited socket is not a unix socket")
+	}
+	if _, _, _, err := c.request(&fdHeader{Command: fdHandoffDone}, nil); err != nil {
+		// the old server keeps serving the socket
+		ul.Close()
+		abandon()
+		return fmt.Errorf("error finishing the handoff: %v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	ul.SetUnlinkOnClose(true)
+	s.inherited = inherited
+	s.serve(ul)
+	time.AfterFunc(handoffAdoptTimeout, s.closeInheritedFDs)
+	glog.Infof("Took over fd server socket %q from %s with %d key(s)", s.socketPath, c.Peer(), len(inherited))
+	return nil
+}
+
+// takeInheritedFDs returns the inherited file descriptors
+// for the key, if any, removing them from the list
+func (s *FDServer) takeInheritedFDs(key string) []int {
+	s.Lock()
+	defer s.Unlock()
+	fds := s.inherited[key]
+	delete(s.inherited, key)
+	return fds
+}
+
+// adoptFDs makes the source for the key take over the inherited
+// file descriptors. If the source doesn't support that, the
+// inherited descriptors are closed and the source is asked
+// to create new ones
+func (s *FDServer) adoptFDs(key string, data []byte, inherited []int, timeout time.Duration) ([]int, []byte, error) {
+	src, srcKey, err := s.sourceForKey(key)
+	if err != nil {
+		closeFDs(inherited)
+		return nil, nil, err
+	}
+	if adopter, ok := src.(FDAdopter); ok {
+		glog.V(1).Infof("Adopting %d inherited file descriptor(s) for key %q", len(inherited), key)
+		return adopter.AdoptFDs(srcKey, data, inherited)
+	}
+	closeFDs(inherited)
+	return s.getFDsFromSource(key, data, timeout)
+}
+
+// closeInheritedFDs closes the inherited file descriptors
+// that weren't adopted by the sources
+func (s *FDServer) closeInheritedFDs() {
+	s.Lock()
+	defer s.Unlock()
+	for key, fds := range s.inherited {
+		glog.Warningf("Closing %d unclaimed inherited file descriptor(s) for key %q", len(fds), key)
+		closeFDs(fds)
+	}
+	s.inherited = make(map[string][]int)
+}
+
+func closeFDs(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
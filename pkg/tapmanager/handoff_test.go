@@ -0,0 +1,207 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adoptingFDSource is a sampleFDSource that can take over
+// the file descriptors inherited from another FDServer
+type adoptingFDSource struct {
+	*sampleFDSource
+	detached bool
+}
+
+var _ FDAdopter = &adoptingFDSource{}
+
+func (s *adoptingFDSource) AdoptFDs(key string, data []byte, fds []int) ([]int, []byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	if len(fds) != 1 {
+		closeFDs(fds)
+		return nil, nil, fmt.Errorf("bad number of inherited fds: %d", len(fds))
+	}
+	s.files[key] = os.NewFile(uintptr(fds[0]), key)
+	return fds, []byte("adopted"), nil
+}
+
+func (s *adoptingFDSource) Detach() {
+	s.Lock()
+	defer s.Unlock()
+	s.detached = true
+}
+
+func (s *adoptingFDSource) isDetached() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.detached
+}
+
+func TestFDServerHandoff(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	if err := NewFDServer(socketPath, newSampleFDSource(tmpDir)).TakeOver(); err == nil {
+		t.Errorf("TakeOver() didn't fail without a server to take over")
+	}
+
+	oldSrc := &adoptingFDSource{sampleFDSource: newSampleFDSource(tmpDir)}
+	oldServer := NewFDServer(socketPath, oldSrc)
+	if err := oldServer.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer oldServer.Stop()
+	oldClient := NewFDClient(socketPath)
+	if err := oldClient.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer oldClient.Close()
+	for _, data := range []string{"foo", "bar"} {
+		if _, err := oldClient.AddFDs("k_"+data, sampleFDData{Content: data}); err != nil {
+			t.Fatalf("AddFDs(): %v", err)
+		}
+	}
+
+	newSrc := &adoptingFDSource{sampleFDSource: newSampleFDSource(tmpDir)}
+	newServer := NewFDServer(socketPath, newSrc)
+	if err := newServer.TakeOver(); err != nil {
+		t.Fatalf("TakeOver(): %v", err)
+	}
+	defer newServer.Stop()
+
+	select {
+	case <-oldServer.HandedOff():
+	default:
+		t.Errorf("the old server is not handed off")
+	}
+	if !oldSrc.isDetached() {
+		t.Errorf("the source of the old server is not detached")
+	}
+	if _, err := oldClient.AddFDs("k_baz", sampleFDData{Content: "baz"}); err == nil {
+		t.Errorf("AddFDs() didn't fail for the old server after the handoff")
+	} else if !strings.Contains(err.Error(), errHandingOff.Error()) {
+		t.Errorf("bad error message: %v", err)
+	}
+
+	c := NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect() after the handoff: %v", err)
+	}
+	defer c.Close()
+	respData, err := c.AddFDs("k_foo", sampleFDData{Content: "foo"})
+	if err != nil {
+		t.Fatalf("AddFDs(): %v", err)
+	}
+	if string(respData) != "adopted" {
+		t.Errorf("the fd for k_foo was not adopted: %q", respData)
+	}
+	verifyFD(t, c, "k_foo", "foo")
+
+	// the unclaimed fds are eventually closed and the
+	// source is asked for the new ones
+	newServer.closeInheritedFDs()
+	if respData, err := c.AddFDs("k_bar", sampleFDData{Content: "newbar"}); err != nil {
+		t.Fatalf("AddFDs(): %v", err)
+	} else if string(respData) != "abcdef" {
+		t.Errorf("unexpected response for k_bar: %q", respData)
+	}
+	verifyFD(t, c, "k_bar", "newbar")
+
+	for _, key := range []string{"k_foo", "k_bar"} {
+		if err := c.ReleaseFDs(key); err != nil {
+			t.Fatalf("ReleaseFDs(): %v", err)
+		}
+	}
+	if !newSrc.isEmpty() {
+		t.Errorf("fd source is not empty (but it should be)")
+	}
+
+	newServer.Stop()
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("the socket is not removed after the new server is stopped")
+	}
+}
+
+func TestFDServerHandoffAbort(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "pass-fd-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "passfd")
+	s := NewFDServer(socketPath, newSampleFDSource(tmpDir))
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+
+	// simulate a new server that goes away in the middle of the handoff
+	hc := NewFDClient(socketPath)
+	if err := hc.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	_, _, oobData, err := hc.request(&fdHeader{Command: fdHandoff, Key: fdKey("")}, nil)
+	if err != nil {
+		t.Fatalf("error starting the handoff: %v", err)
+	}
+	fds, err := parseUnixRights(oobData)
+	if err != nil {
+		t.Fatalf("parseUnixRights(): %v", err)
+	}
+	closeFDs(fds)
+
+	c := NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+	if _, err := c.AddFDs("k_foo", sampleFDData{Content: "foo"}); err == nil {
+		t.Errorf("AddFDs() didn't fail during the handoff")
+	}
+
+	hc.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := c.AddFDs("k_foo", sampleFDData{Content: "foo"})
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("AddFDs() still fails after the handoff is aborted: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	verifyFD(t, c, "k_foo", "foo")
+
+	select {
+	case <-s.HandedOff():
+		t.Errorf("the server is marked as handed off after the handoff is aborted")
+	default:
+	}
+}
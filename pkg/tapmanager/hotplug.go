@@ -0,0 +1,595 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/audit"
+	"github.com/Mirantis/virtlet/pkg/nettools"
+	"github.com/Mirantis/virtlet/pkg/qmp"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+// QMPSocketDir is the directory that contains QMP sockets
+// of the VMs. vmwrapper only enables the QMP socket if the
+// directory exists. It's changed for named Virtlet instances
+var QMPSocketDir = "/var/lib/virtlet/qmp"
+
+const (
+	// NetworkAttachmentSubresource is the pod subresource that
+	// the users must be allowed to "create" in order to attach
+	// running VMs to additional networks and detach them
+	NetworkAttachmentSubresource = "network"
+	// extraIfNameTemplate is used to make the names of the
+	// interfaces that are added to the pod network namespace
+	// by CNI plugins for the additional networks
+	extraIfNameTemplate = "virtlet-eth%d"
+	qmpTimeout          = 30 * time.Second
+	deviceDeleteTimeout = 30 * time.Second
+)
+
+// extraNetwork describes a network that was attached to the VM
+// after its pod was created
+type extraNetwork struct {
+	network string
+	ifName  string
+	// prevCsn is the container side network as it was
+	// before the network was attached
+	prevCsn *nettools.ContainerSideNetwork
+}
+
+// QMPSocketPath returns the path to QMP socket of the VM
+// which uses the network with the specified key
+func QMPSocketPath(key string) string {
+	return filepath.Join(QMPSocketDir, key+".sock")
+}
+
+func netdevForInterface(index int) NetdevDescription {
+	return NetdevDescription{
+		FdIndex: index,
+		Netdev:  fmt.Sprintf("tap%d", index),
+		Device:  fmt.Sprintf("net%d", index),
+	}
+}
+
+// hotplugNIC passes the tap file descriptor to the VM and adds
+// virtio-net device with the specified options for it. Same as for
+// the NICs added by vmwrapper, vhost-net acceleration is used for the
+// NIC if it's available. netdev.Vhost is updated accordingly
+func hotplugNIC(key string, iface nettools.InterfaceDescription, netdev *NetdevDescription, nicOpts utils.VirtioNetOptions) error {
+	c, err := qmp.Dial(QMPSocketPath(key), qmpTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	fdName := "fd-" + netdev.Netdev
+	if err := c.SendFD(fdName, int(iface.Fo.Fd())); err != nil {
+		return fmt.Errorf("error passing tap fd to the VM: %v", err)
+	}
+	fdNames := []string{fdName}
+	netdevArgs := map[string]interface{}{
+		"type": "tap",
+		"id":   netdev.Netdev,
+		"fd":   fdName,
+	}
+	netdev.Vhost = false
+	if vhostFd, err := utils.OpenVhostNet(); err != nil {
+		glog.Warningf("Can't use vhost-net for netdev %q, falling back to plain tap netdev: %v", netdev.Netdev, err)
+	} else {
+		vhostFdName := "vhostfd-" + netdev.Netdev
+		err := c.SendFD(vhostFdName, vhostFd)
+		// the fd is duplicated by the kernel when it's passed
+		syscall.Close(vhostFd)
+		if err != nil {
+			glog.Warningf("Error passing vhost-net fd to the VM, falling back to plain tap netdev: %v", err)
+		} else {
+			fdNames = append(fdNames, vhostFdName)
+			netdevArgs["vhost"] = true
+			netdevArgs["vhostfd"] = vhostFdName
+			netdev.Vhost = true
+		}
+	}
+	if err := c.Execute("netdev_add", netdevArgs, nil); err != nil {
+		for _, name := range fdNames {
+			if err := c.Execute("closefd", map[string]string{"fdname": name}, nil); err != nil {
+				glog.Warningf("Error closing fd %q in the VM: %v", name, err)
+			}
+		}
+		netdev.Vhost = false
+		return fmt.Errorf("error adding netdev %q: %v", netdev.Netdev, err)
+	}
+	deviceArgs := map[string]string{
+		"driver": "virtio-net-pci",
+		"netdev": netdev.Netdev,
+		"id":     netdev.Device,
+		"mac":    iface.HardwareAddr.String(),
+	}
+	for name, value := range nicOpts {
+		deviceArgs[name] = value
+	}
+	if err := c.Execute("device_add", deviceArgs, nil); err != nil {
+		if err := c.Execute("netdev_del", map[string]string{"id": netdev.Netdev}, nil); err != nil {
+			glog.Warningf("Error removing netdev %q: %v", netdev.Netdev, err)
+		}
+		return fmt.Errorf("error adding device %q: %v", netdev.Device, err)
+	}
+	return nil
+}
+
+// unplugNIC removes the network device from the VM. The guest
+// must acknowledge the removal of the device for it to succeed
+func unplugNIC(key string, netdev NetdevDescription) error {
+	c, err := qmp.Dial(QMPSocketPath(key), qmpTimeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Execute("device_del", map[string]string{"id": netdev.Device}, nil); err != nil {
+		return fmt.Errorf("error removing device %q: %v", netdev.Device, err)
+	}
+	if err := c.SetDeadline(time.Now().Add(deviceDeleteTimeout)); err != nil {
+		return err
+	}
+	if _, err := c.WaitEvent("DEVICE_DELETED", func(data json.RawMessage) bool {
+		var d struct {
+			Device string `json:"device"`
+		}
+		return json.Unmarshal(data, &d) == nil && d.Device == netdev.Device
+	}); err != nil {
+		return fmt.Errorf("device %q was not removed by the guest: %v", netdev.Device, err)
+	}
+	if err := c.SetDeadline(time.Now().Add(qmpTimeout)); err != nil {
+		return err
+	}
+	if netdev.Netdev != "" {
+		if err := c.Execute("netdev_del", map[string]string{"id": netdev.Netdev}, nil); err != nil {
+			return fmt.Errorf("error removing netdev %q: %v", netdev.Netdev, err)
+		}
+	}
+	return nil
+}
+
+// adoptVM hot-plugs all of the interfaces of the pod network into
+// a running VM which has QMP socket for the key via but doesn't have
+// any NICs yet, which is the case for standby VMs claimed by pods.
+// The QMP socket of the VM is made available under the pod's key,
+// so the networks can be attached and detached later
+func (s *TapFDSource) adoptVM(key, via string) error {
+	pn, err := s.hotplugTarget(key)
+	if err != nil {
+		return err
+	}
+	pn.hotplugMutex.Lock()
+	defer pn.hotplugMutex.Unlock()
+
+	s.Lock()
+	csn := pn.csn
+	vmStarted := pn.vmRunning
+	s.Unlock()
+	if vmStarted {
+		return fmt.Errorf("the VM of pod %s (%s) is already running", pn.pnd.PodName, pn.pnd.PodId)
+	}
+	for _, iface := range csn.Interfaces {
+		if iface.Type != nettools.InterfaceTypeTap {
+			return errors.New("only tap interfaces can be hot-plugged")
+		}
+	}
+	nicOpts, err := utils.ParseVirtioNetOptions(pn.pnd.VirtioNetOptions)
+	if err != nil {
+		return err
+	}
+
+	qmpPath := QMPSocketPath(key)
+	if err := os.Remove(qmpPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing stale QMP socket %q: %v", qmpPath, err)
+	}
+	if err := os.Symlink(QMPSocketPath(via), qmpPath); err != nil {
+		return fmt.Errorf("error linking QMP socket: %v", err)
+	}
+
+	var netdevs []NetdevDescription
+	for index, iface := range csn.Interfaces {
+		netdev := netdevForInterface(index)
+		if err := hotplugNIC(key, iface, &netdev, nicOpts); err != nil {
+			for _, d := range netdevs {
+				if err := unplugNIC(key, d); err != nil {
+					glog.Errorf("Error removing device %q during rollback: %v", d.Device, err)
+				}
+			}
+			if err := os.Remove(qmpPath); err != nil {
+				glog.Warningf("Error removing QMP socket link %q: %v", qmpPath, err)
+			}
+			return err
+		}
+		netdevs = append(netdevs, netdev)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	pn.vmStartCount++
+	pn.vmRunning = true
+	pn.netdevs = netdevs
+	glog.V(1).Infof("Hot-plugged the network of pod %s (%s) into VM %q", pn.pnd.PodName, pn.pnd.PodId, via)
+	return nil
+}
+
+// vmStopped marks the VM of the pod as stopped, so that the
+// networks attached after that are not hot-plugged and the VM gets
+// them upon the next start instead. The QMP socket link made for a
+// standby VM is removed as the VM is gone
+func (s *TapFDSource) vmStopped(key string) error {
+	s.Lock()
+	pn, found := s.fdMap[key]
+	s.Unlock()
+	if !found {
+		return fmt.Errorf("bad fd key: %q", key)
+	}
+	// wait for the hot-plug operations in progress
+	pn.hotplugMutex.Lock()
+	defer pn.hotplugMutex.Unlock()
+
+	s.Lock()
+	defer s.Unlock()
+	pn.vmRunning = false
+	pn.netdevs = nil
+	qmpPath := QMPSocketPath(key)
+	if fi, err := os.Lstat(qmpPath); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := os.Remove(qmpPath); err != nil {
+			glog.Warningf("Error removing QMP socket link %q: %v", qmpPath, err)
+		}
+	}
+	glog.V(1).Infof("The VM of pod %s (%s) has stopped", pn.pnd.PodName, pn.pnd.PodId)
+	return nil
+}
+
+// hotplugTarget finds the pod network for AttachNetwork() and
+// DetachNetwork()
+func (s *TapFDSource) hotplugTarget(key string) (*podNetwork, error) {
+	s.Lock()
+	defer s.Unlock()
+	pn, found := s.fdMap[key]
+	if !found || pn.csn == nil {
+		return nil, errPodNotFound
+	}
+	if pn.dhcpServer == nil {
+		return nil, errors.New("the pod network doesn't support hot-plug")
+	}
+	return pn, nil
+}
+
+// AttachNetwork adds the VM pod to an additional CNI network with
+// the specified name. If the VM is running, the new interface is
+// hot-plugged into it, otherwise the VM gets it upon start.
+// updateFDs is used to update the list of file descriptors passed
+// to vmwrapper. It returns the description of the new interface.
+func (s *TapFDSource) AttachNetwork(key, network string, updateFDs func([]int) error) (*InterfaceDescription, error) {
+	pn, err := s.hotplugTarget(key)
+	if err != nil {
+		return nil, err
+	}
+	pn.hotplugMutex.Lock()
+	defer pn.hotplugMutex.Unlock()
+
+	s.Lock()
+	csn := pn.csn
+	vmStarted := pn.vmRunning
+	for _, en := range pn.extraNetworks {
+		if en.network == network {
+			s.Unlock()
+			return nil, fmt.Errorf("network %q is already attached", network)
+		}
+	}
+	s.Unlock()
+	pnd := pn.pnd
+	if pnd.IngressRules != "" {
+		return nil, errors.New("can't attach networks to the pods with ingress rules")
+	}
+
+	index := len(csn.Interfaces)
+	ifName := fmt.Sprintf(extraIfNameTemplate, index)
+	info, err := s.cniClient.AddSandboxToNamedNetwork(context.Background(), network, ifName, pnd.PodId, pnd.PodName, pnd.PodNs)
+	if err != nil {
+		return nil, fmt.Errorf("error adding pod %s (%s) to CNI network %q: %v", pnd.PodName, pnd.PodId, network, err)
+	}
+
+	vmNS, err := ns.GetNS(csn.NsPath)
+	if err == nil {
+		defer vmNS.Close()
+	}
+	var newCsn *nettools.ContainerSideNetwork
+	ok := false
+	defer func() {
+		if ok {
+			return
+		}
+		if newCsn != nil {
+			pn.dhcpServer.SetConfig(csn)
+			if err := doInNetNS(vmNS, newCsn.TeardownLastInterface); err != nil {
+				glog.Errorf("Error tearing down interface %q during rollback: %v", ifName, err)
+			}
+		}
+		if err := s.cniClient.RemoveSandboxFromNamedNetwork(context.Background(), network, ifName, pnd.PodId, pnd.PodName, pnd.PodNs); err != nil {
+			glog.Errorf("Error removing pod %s (%s) from CNI network %q during rollback: %v", pnd.PodName, pnd.PodId, network, err)
+		}
+	}()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open network namespace at %q: %v", csn.NsPath, err)
+	}
+	if info, err = s.adjustCNIResult(&pnd, network, info); err != nil {
+		return nil, err
+	}
+
+	if err := doInNetNS(vmNS, func() error {
+		var err error
+		if newCsn, err = csn.AddInterface(info); err != nil {
+			return err
+		}
+		// the interface is torn down by the deferred
+		// rollback if this fails
+		return newCsn.SetBridgeMulticastMode(bridgeMulticastMode(&pnd))
+	}); err != nil {
+		return nil, fmt.Errorf("error setting up interface for network %q: %v", network, err)
+	}
+	// make the dhcp server ready before the guest sees the new device
+	pn.dhcpServer.SetConfig(newCsn)
+
+	netdev := netdevForInterface(index)
+	if vmStarted {
+		nicOpts, err := utils.ParseVirtioNetOptions(pnd.VirtioNetOptions)
+		if err != nil {
+			return nil, err
+		}
+		if err := hotplugNIC(key, newCsn.Interfaces[index], &netdev, nicOpts); err != nil {
+			return nil, err
+		}
+	}
+	if err := updateFDs(interfaceFDs(newCsn)); err != nil {
+		if vmStarted {
+			if err := unplugNIC(key, netdev); err != nil {
+				glog.Errorf("Error removing device %q during rollback: %v", netdev.Device, err)
+			}
+		}
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.fdMap[key] != pn {
+		return nil, fmt.Errorf("the network of pod %s (%s) was removed", pnd.PodName, pnd.PodId)
+	}
+	pn.csn = newCsn
+	pn.extraNetworks = append(pn.extraNetworks, extraNetwork{
+		network: network,
+		ifName:  ifName,
+		prevCsn: csn,
+	})
+	if vmStarted {
+		pn.netdevs = append(pn.netdevs, netdev)
+	}
+	ok = true
+	glog.V(1).Infof("Attached pod %s (%s) to network %q", pnd.PodName, pnd.PodId, network)
+	return &interfaceInfo(newCsn, pn.netdevs).Interfaces[index], nil
+}
+
+// DetachNetwork removes the VM pod from an additional CNI network
+// that was attached using AttachNetwork(). The networks must be
+// detached in the reverse order of attachment. If the VM is running,
+// the interface is unplugged from it first. updateFDs is used to
+// update the list of file descriptors passed to vmwrapper.
+func (s *TapFDSource) DetachNetwork(key, network string, updateFDs func([]int) error) error {
+	pn, err := s.hotplugTarget(key)
+	if err != nil {
+		return err
+	}
+	pn.hotplugMutex.Lock()
+	defer pn.hotplugMutex.Unlock()
+
+	s.Lock()
+	csn := pn.csn
+	vmStarted := pn.vmRunning
+	n := len(pn.extraNetworks) - 1
+	for n >= 0 && pn.extraNetworks[n].network != network {
+		n--
+	}
+	if n < 0 {
+		s.Unlock()
+		return fmt.Errorf("network %q is not attached", network)
+	}
+	if n != len(pn.extraNetworks)-1 {
+		s.Unlock()
+		return fmt.Errorf("network %q must be detached after %q", network, pn.extraNetworks[len(pn.extraNetworks)-1].network)
+	}
+	en := pn.extraNetworks[n]
+	index := len(csn.Interfaces) - 1
+	var netdev *NetdevDescription
+	for n := range pn.netdevs {
+		if pn.netdevs[n].FdIndex == index {
+			netdev = &pn.netdevs[n]
+		}
+	}
+	if vmStarted && netdev == nil {
+		// vmwrapper didn't report the ids
+		d := netdevForInterface(index)
+		netdev = &d
+	}
+	s.Unlock()
+
+	if vmStarted {
+		if err := unplugNIC(key, *netdev); err != nil {
+			return err
+		}
+	}
+	if err := updateFDs(interfaceFDs(en.prevCsn)); err != nil {
+		glog.Warningf("Error updating fds for %q: %v", key, err)
+	}
+
+	s.Lock()
+	pn.csn = en.prevCsn
+	pn.extraNetworks = pn.extraNetworks[:n]
+	var netdevs []NetdevDescription
+	for _, d := range pn.netdevs {
+		if d.FdIndex != index {
+			netdevs = append(netdevs, d)
+		}
+	}
+	pn.netdevs = netdevs
+	s.Unlock()
+	pn.dhcpServer.SetConfig(en.prevCsn)
+
+	pnd := pn.pnd
+	vmNS, err := ns.GetNS(csn.NsPath)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace at %q: %v", csn.NsPath, err)
+	}
+	defer vmNS.Close()
+	if err := doInNetNS(vmNS, csn.TeardownLastInterface); err != nil {
+		return fmt.Errorf("error tearing down interface for network %q: %v", network, err)
+	}
+	if err := s.cniClient.RemoveSandboxFromNamedNetwork(context.Background(), en.network, en.ifName, pnd.PodId, pnd.PodName, pnd.PodNs); err != nil {
+		return fmt.Errorf("error removing pod %s (%s) from CNI network %q: %v", pnd.PodName, pnd.PodId, network, err)
+	}
+	glog.V(1).Infof("Detached pod %s (%s) from network %q", pnd.PodName, pnd.PodId, network)
+	return nil
+}
+
+// doInNetNS invokes toCall within the network namespace with
+// the network namespace's sysfs mounted at /sys
+func doInNetNS(vmNS ns.NetNS, toCall func() error) error {
+	return vmNS.Do(func(ns.NetNS) error {
+		if err := mountSysfs(); err != nil {
+			return err
+		}
+		defer func() {
+			if err := unmountSysfs(); err != nil {
+				glog.V(3).Infof("Warning, error during umount of /sys: %v", err)
+			}
+		}()
+		return toCall()
+	})
+}
+
+// networkAttachment specifies the pod and the CNI network
+// for an attach / detach request
+type networkAttachment struct {
+	podId, podNs, podName, network string
+}
+
+// networkAttachmentFromRequest returns the pod and the CNI
+// network specified by the attach / detach request
+func networkAttachmentFromRequest(r *http.Request) (networkAttachment, error) {
+	q := r.URL.Query()
+	na := networkAttachment{
+		podId:   q.Get("podId"),
+		podNs:   q.Get("namespace"),
+		podName: q.Get("name"),
+		network: q.Get("network"),
+	}
+	switch {
+	case na.podId == "" && (na.podNs == "" || na.podName == ""):
+		return na, errors.New("either pod id or pod namespace and name must be specified")
+	case na.network == "":
+		return na, errors.New("network name must be specified")
+	}
+	return na, nil
+}
+
+func handleNetworkAttachment(s *TapFDSource, fdServer *FDServer, authorizer PodAuthorizer, auditLog *audit.Log, w http.ResponseWriter, r *http.Request, attach bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	na, err := networkAttachmentFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	operation := "DetachNetwork"
+	if attach {
+		operation = "AttachNetwork"
+	}
+	podNs, podName, user, ok := s.authorizePodRequest(w, r, authorizer, auditLog, operation, NetworkAttachmentSubresource, na.podId, na.podNs, na.podName)
+	if !ok {
+		return
+	}
+	target := fmt.Sprintf("%s/%s:%s", podNs, podName, na.network)
+	s.Lock()
+	key, pn := s.findPodNetwork(na.podId, podNs, podName)
+	s.Unlock()
+	if pn == nil {
+		http.Error(w, errPodNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	updateFDs := func(fds []int) error {
+		return fdServer.UpdateFDs(key, fds)
+	}
+	glog.V(1).Infof("User %q requested %s for %s", user, operation, target)
+	if !attach {
+		err := s.DetachNetwork(key, na.network, updateFDs)
+		auditLog.Record(operation, user, target, err)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	desc, err := s.AttachNetwork(key, na.network, updateFDs)
+	auditLog.Record(operation, user, target, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(desc); err != nil {
+		glog.Warningf("Error sending interface description: %v", err)
+	}
+}
+
+// NewAttachNetworkHandler returns an http.Handler that attaches
+// VM pods to additional CNI networks upon POST requests. The pod
+// is specified using either podId or namespace and name query
+// parameters, and network parameter specifies the name of CNI
+// network. The description of the new interface is returned
+// as JSON. The caller must pass a bearer token in Authorization
+// header that's checked using the authorizer for the network
+// subresource of the pod.
+func NewAttachNetworkHandler(s *TapFDSource, fdServer *FDServer, authorizer PodAuthorizer, auditLog *audit.Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleNetworkAttachment(s, fdServer, authorizer, auditLog, w, r, true)
+	})
+}
+
+// NewDetachNetworkHandler returns an http.Handler that detaches
+// VM pods from the networks attached via the handler returned by
+// NewAttachNetworkHandler(). It accepts the same parameters.
+func NewDetachNetworkHandler(s *TapFDSource, fdServer *FDServer, authorizer PodAuthorizer, auditLog *audit.Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleNetworkAttachment(s, fdServer, authorizer, auditLog, w, r, false)
+	})
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNetworkAttachmentFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		url      string
+		expected networkAttachment
+		err      bool
+	}{
+		{
+			name:     "pod id",
+			url:      "/attach-network?podId=69eec606-0493-5825-73a4-c5e0c0236155&network=extra",
+			expected: networkAttachment{podId: "69eec606-0493-5825-73a4-c5e0c0236155", network: "extra"},
+		},
+		{
+			name:     "pod name",
+			url:      "/attach-network?namespace=default&name=cirros-vm&network=extra",
+			expected: networkAttachment{podNs: "default", podName: "cirros-vm", network: "extra"},
+		},
+		{
+			name: "no pod",
+			url:  "/attach-network?namespace=default&network=extra",
+			err:  true,
+		},
+		{
+			name: "no network",
+			url:  "/attach-network?podId=69eec606-0493-5825-73a4-c5e0c0236155",
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest("POST", tc.url, nil)
+			if err != nil {
+				t.Fatalf("NewRequest(): %v", err)
+			}
+			na, err := networkAttachmentFromRequest(r)
+			switch {
+			case tc.err && err == nil:
+				t.Errorf("didn't get an expected error")
+			case !tc.err && err != nil:
+				t.Errorf("networkAttachmentFromRequest(): %v", err)
+			case !tc.err && na != tc.expected:
+				t.Errorf("bad network attachment: %#v instead of %#v", na, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNetworkAttachmentAuthorization(t *testing.T) {
+	s := &TapFDSource{
+		fdMap: map[string]*podNetwork{
+			"69eec606-0493-5825-73a4-c5e0c0236155": {
+				pnd: PodNetworkDesc{
+					PodId:   "69eec606-0493-5825-73a4-c5e0c0236155",
+					PodNs:   "default",
+					PodName: "cirros-vm",
+				},
+			},
+		},
+	}
+	for _, tc := range []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		allow  bool
+		status int
+		call   string
+	}{
+		{
+			name:   "bad method",
+			method: "GET",
+			url:    "/attach-network?namespace=default&name=cirros-vm&network=extra",
+			token:  "foobar",
+			status: http.StatusMethodNotAllowed,
+		},
+		{
+			name:   "no token",
+			method: "POST",
+			url:    "/attach-network?namespace=default&name=cirros-vm&network=extra",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "denied",
+			method: "POST",
+			url:    "/attach-network?namespace=default&name=cirros-vm&network=extra",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/cirros-vm network",
+		},
+		{
+			name:   "denied by pod id",
+			method: "POST",
+			url:    "/attach-network?podId=69eec606-0493-5825-73a4-c5e0c0236155&network=extra",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/cirros-vm network",
+		},
+		{
+			name:   "denied for nonexistent pod",
+			method: "POST",
+			url:    "/attach-network?namespace=default&name=foobar&network=extra",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/foobar network",
+		},
+		{
+			name:   "allowed for nonexistent pod",
+			method: "POST",
+			url:    "/attach-network?namespace=default&name=foobar&network=extra",
+			token:  "foobar",
+			allow:  true,
+			status: http.StatusNotFound,
+			call:   "foobar default/foobar network",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			authorizer := &fakePodAuthorizer{allow: tc.allow}
+			req := httptest.NewRequest(tc.method, tc.url, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			NewAttachNetworkHandler(s, nil, authorizer, nil).ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("bad status code %d instead of %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			var expectedCalls []string
+			if tc.call != "" {
+				expectedCalls = []string{tc.call}
+			}
+			if !reflect.DeepEqual(authorizer.calls, expectedCalls) {
+				t.Errorf("bad authorizer calls: %#v instead of %#v", authorizer.calls, expectedCalls)
+			}
+		})
+	}
+}
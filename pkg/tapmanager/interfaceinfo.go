@@ -0,0 +1,202 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+// InterfaceInfoVersion denotes the version of InterfaceInfo
+// format produced by this version of Virtlet. It must be bumped
+// when changes are made that can't be handled by older clients
+// just ignoring unknown fields
+const InterfaceInfoVersion = 1
+
+// InterfaceInfo is the data returned by TapFDSource for GetFDs()
+// and QueryInfo() calls
+type InterfaceInfo struct {
+	// Version is the version of the info format
+	Version int `json:"version"`
+	// Interfaces contains the descriptions of VM network interfaces
+	Interfaces []InterfaceDescription `json:"interfaces"`
+}
+
+// NetdevDescription describes QEMU netdev and device that were
+// created by vmwrapper for a network interface
+type NetdevDescription struct {
+	// FdIndex is the index of the interface in the interface list
+	FdIndex int `json:"fdIndex"`
+	// Netdev is the id of QEMU netdev. It's empty for the
+	// interfaces that don't use a netdev, such as SR-IOV VFs
+	Netdev string `json:"netdev,omitempty"`
+	// Device is the id of QEMU device
+	Device string `json:"device"`
+	// Vhost is true if the netdev uses vhost-net acceleration
+	Vhost bool `json:"vhost,omitempty"`
+}
+
+// NetdevReport is sent by vmwrapper to tapmanager after it
+// obtains the file descriptors using GetFDs(). It's also sent
+// by virtlet with HotplugVia set when a pod claims a standby VM,
+// and with VMStopped set when the VM of the pod is stopped
+type NetdevReport struct {
+	Netdevs []NetdevDescription `json:"netdevs"`
+	// HotplugVia is the QMP key of an already running VM
+	// that has no network interfaces yet. If it's set, the
+	// interfaces of the pod are hot-plugged into that VM
+	// instead of being handed out to vmwrapper
+	HotplugVia string `json:"hotplugVia,omitempty"`
+	// VMStopped means that the VM process that has obtained
+	// the file descriptors has exited, so the networks that
+	// are attached from now on must not be hot-plugged
+	VMStopped bool `json:"vmStopped,omitempty"`
+}
+
+// MarshalJSON implements MarshalJSON method of json.Marshaler
+// interface. It makes the hardware address appear in the usual
+// colon-separated text form instead of base64-encoded bytes
+func (d InterfaceDescription) MarshalJSON() ([]byte, error) {
+	type plainDesc InterfaceDescription
+	return json.Marshal(struct {
+		plainDesc
+		HardwareAddr string `json:"mac"`
+	}{
+		plainDesc:    plainDesc(d),
+		HardwareAddr: d.HardwareAddr.String(),
+	})
+}
+
+// UnmarshalJSON implements UnmarshalJSON method of json.Unmarshaler
+// interface. Besides the text form, it accepts base64-encoded
+// hardware addresses used by the older Virtlet versions
+func (d *InterfaceDescription) UnmarshalJSON(data []byte) error {
+	type plainDesc InterfaceDescription
+	var v struct {
+		*plainDesc
+		HardwareAddr string `json:"mac"`
+	}
+	v.plainDesc = (*plainDesc)(d)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	d.HardwareAddr = nil
+	if v.HardwareAddr == "" {
+		return nil
+	}
+	hwAddr, err := net.ParseMAC(v.HardwareAddr)
+	if err != nil {
+		if hwAddr, err = base64.StdEncoding.DecodeString(v.HardwareAddr); err != nil {
+			return fmt.Errorf("bad hardware address %q", v.HardwareAddr)
+		}
+	}
+	d.HardwareAddr = hwAddr
+	return nil
+}
+
+// ParseInterfaceInfo parses the data returned by TapFDSource for
+// GetFDs() and QueryInfo() calls. Besides the versioned format,
+// it also accepts plain JSON array of interface descriptions
+// that was used by the older Virtlet versions
+func ParseInterfaceInfo(data []byte) ([]InterfaceDescription, error) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var descs []InterfaceDescription
+		if err := json.Unmarshal(data, &descs); err != nil {
+			return nil, fmt.Errorf("error unmarshalling interface descriptions: %v", err)
+		}
+		return descs, nil
+	}
+
+	var info InterfaceInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("error unmarshalling interface info: %v", err)
+	}
+	if info.Version < 1 || info.Version > InterfaceInfoVersion {
+		return nil, fmt.Errorf("unsupported interface info version %d", info.Version)
+	}
+	return info.Interfaces, nil
+}
+
+// FindInterface looks up an interface description by either the
+// hardware address or the name of the interface. It returns nil
+// if there's no matching interface
+func FindInterface(descs []InterfaceDescription, query string) *InterfaceDescription {
+	mac, err := net.ParseMAC(query)
+	for n := range descs {
+		if err == nil && bytes.Equal(descs[n].HardwareAddr, mac) {
+			return &descs[n]
+		}
+		if descs[n].Name == query {
+			return &descs[n]
+		}
+	}
+	return nil
+}
+
+func interfaceInfo(csn *nettools.ContainerSideNetwork, netdevs []NetdevDescription) *InterfaceInfo {
+	// CNI result lists both host and container side interfaces,
+	// while csn.Interfaces only contains container side ones,
+	// see nettools.GetContainerLinks()
+	var cniIndices []int
+	for n, iface := range csn.Result.Interfaces {
+		if iface.Sandbox != "" {
+			cniIndices = append(cniIndices, n)
+		}
+	}
+
+	info := &InterfaceInfo{Version: InterfaceInfoVersion}
+	for i, iface := range csn.Interfaces {
+		desc := InterfaceDescription{
+			FdIndex:      i,
+			HardwareAddr: iface.HardwareAddr,
+			Type:         iface.Type,
+			PCIAddress:   iface.PCIAddress,
+			Name:         iface.Name,
+			MTU:          iface.MTU,
+		}
+		if i < len(cniIndices) {
+			for _, ipConfig := range csn.Result.IPs {
+				if ipConfig.Interface == cniIndices[i] {
+					desc.IPs = append(desc.IPs, ipConfig.Address.String())
+				}
+			}
+		}
+		info.Interfaces = append(info.Interfaces, desc)
+	}
+	for _, netdev := range netdevs {
+		if netdev.FdIndex >= 0 && netdev.FdIndex < len(info.Interfaces) {
+			info.Interfaces[netdev.FdIndex].Netdev = netdev.Netdev
+			info.Interfaces[netdev.FdIndex].Device = netdev.Device
+			info.Interfaces[netdev.FdIndex].Vhost = netdev.Vhost
+		}
+	}
+	return info
+}
+
+func marshalInterfaceInfo(csn *nettools.ContainerSideNetwork, netdevs []NetdevDescription) ([]byte, error) {
+	data, err := json.Marshal(interfaceInfo(csn, netdevs))
+	if err != nil {
+		return nil, fmt.Errorf("interface info marshaling error: %v", err)
+	}
+	return data, nil
+}
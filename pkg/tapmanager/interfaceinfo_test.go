@@ -0,0 +1,214 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+	"github.com/Mirantis/virtlet/tests/cnifixture"
+)
+
+func mustParseMAC(mac string) net.HardwareAddr {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		panic(err)
+	}
+	return hwAddr
+}
+
+func sampleInterfaceDescs() []InterfaceDescription {
+	return []InterfaceDescription{
+		{
+			Type:         nettools.InterfaceTypeTap,
+			HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+			FdIndex:      0,
+			Name:         "eth0",
+			IPs:          []string{"10.1.90.5/24"},
+			MTU:          1500,
+		},
+		{
+			Type:         nettools.InterfaceTypeVF,
+			HardwareAddr: mustParseMAC("42:a4:a6:22:80:2f"),
+			FdIndex:      1,
+			PCIAddress:   "0000:00:05.1",
+			Name:         "eth1",
+		},
+	}
+}
+
+func TestInterfaceInfo(t *testing.T) {
+	csn := &nettools.ContainerSideNetwork{
+		Result: cnifixture.NewResult().
+			HostInterface("veth0", "ca:ce:8c:92:4d:4a").
+			Interface("eth0", cnifixture.MAC(0)).InSandbox("/var/run/netns/foo").
+			IP("10.1.90.5/24", "").
+			Interface("eth1", cnifixture.MAC(1)).InSandbox("/var/run/netns/foo").
+			Result(),
+		Interfaces: []nettools.InterfaceDescription{
+			{
+				Type:         nettools.InterfaceTypeTap,
+				Name:         "eth0",
+				HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+				MTU:          1500,
+			},
+			{
+				Type:         nettools.InterfaceTypeVF,
+				Name:         "eth1",
+				HardwareAddr: mustParseMAC("42:a4:a6:22:80:2f"),
+				PCIAddress:   "0000:00:05.1",
+			},
+		},
+	}
+
+	netdevs := []NetdevDescription{
+		{
+			FdIndex: 0,
+			Netdev:  "tap0",
+			Device:  "net0",
+		},
+		{
+			FdIndex: 1,
+			Device:  "hostdev0",
+		},
+	}
+	expectedWithNetdevs := sampleInterfaceDescs()
+	expectedWithNetdevs[0].Netdev = "tap0"
+	expectedWithNetdevs[0].Device = "net0"
+	expectedWithNetdevs[1].Device = "hostdev0"
+
+	for _, tc := range []struct {
+		name     string
+		netdevs  []NetdevDescription
+		expected []InterfaceDescription
+	}{
+		{
+			name:     "without netdevs",
+			expected: sampleInterfaceDescs(),
+		},
+		{
+			name:     "with netdevs",
+			netdevs:  netdevs,
+			expected: expectedWithNetdevs,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := marshalInterfaceInfo(csn, tc.netdevs)
+			if err != nil {
+				t.Fatalf("marshalInterfaceInfo(): %v", err)
+			}
+			descs, err := ParseInterfaceInfo(data)
+			if err != nil {
+				t.Fatalf("ParseInterfaceInfo(): %v", err)
+			}
+			if !reflect.DeepEqual(descs, tc.expected) {
+				t.Errorf("interface descriptions mismatch:\n%#v\ninstead of\n%#v", descs, tc.expected)
+			}
+		})
+	}
+}
+
+func TestParseInterfaceInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		data     string
+		expected []InterfaceDescription
+		err      bool
+	}{
+		{
+			name:     "versioned",
+			data:     `{"version":1,"interfaces":[{"type":0,"mac":"42:a4:a6:22:80:2e","fdIndex":0,"pciAddress":"","name":"eth0","ips":["10.1.90.5/24"],"mtu":1500},{"type":1,"mac":"42:a4:a6:22:80:2f","fdIndex":1,"pciAddress":"0000:00:05.1","name":"eth1"}]}`,
+			expected: sampleInterfaceDescs(),
+		},
+		{
+			name: "legacy",
+			data: ` [{"type":0,"mac":"QqSmIoAu","fdIndex":0,"pciAddress":""}]`,
+			expected: []InterfaceDescription{
+				{
+					Type:         nettools.InterfaceTypeTap,
+					HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+				},
+			},
+		},
+		{
+			name: "unknown fields",
+			data: `{"version":1,"interfaces":[{"type":0,"mac":"42:a4:a6:22:80:2e","fdIndex":0,"foo":"bar"}],"bar":42}`,
+			expected: []InterfaceDescription{
+				{
+					Type:         nettools.InterfaceTypeTap,
+					HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+				},
+			},
+		},
+		{
+			name: "bad mac",
+			data: `{"version":1,"interfaces":[{"type":0,"mac":"foo:bar","fdIndex":0}]}`,
+			err:  true,
+		},
+		{
+			name: "unsupported version",
+			data: `{"version":2,"interfaces":[]}`,
+			err:  true,
+		},
+		{
+			name: "no version",
+			data: `{"interfaces":[]}`,
+			err:  true,
+		},
+		{
+			name: "bad json",
+			data: `{"version":`,
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			descs, err := ParseInterfaceInfo([]byte(tc.data))
+			switch {
+			case tc.err && err == nil:
+				t.Errorf("didn't get an expected error")
+			case !tc.err && err != nil:
+				t.Errorf("ParseInterfaceInfo(): %v", err)
+			case !reflect.DeepEqual(descs, tc.expected):
+				t.Errorf("interface descriptions mismatch:\n%#v\ninstead of\n%#v", descs, tc.expected)
+			}
+		})
+	}
+}
+
+func TestFindInterface(t *testing.T) {
+	descs := sampleInterfaceDescs()
+	for _, tc := range []struct {
+		query         string
+		expectedIndex int
+	}{
+		{"42:a4:a6:22:80:2e", 0},
+		{"42-A4-A6-22-80-2F", 1},
+		{"eth1", 1},
+		{"eth2", -1},
+		{"42:a4:a6:22:80:30", -1},
+	} {
+		desc := FindInterface(descs, tc.query)
+		switch {
+		case tc.expectedIndex < 0 && desc != nil:
+			t.Errorf("%q: unexpected match: %#v", tc.query, desc)
+		case tc.expectedIndex >= 0 && desc != &descs[tc.expectedIndex]:
+			t.Errorf("%q: expected to match interface %d, got %#v", tc.query, tc.expectedIndex, desc)
+		}
+	}
+}
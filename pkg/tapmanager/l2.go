@@ -0,0 +1,92 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+// nodeNetNSPath is the path used by nsenter to run the commands in
+// the network namespace of tapmanager, which is the node one
+const nodeNetNSPath = "/proc/self/ns/net"
+
+// setupL2PodNetwork sets up the network of the pod in L2 mode, attaching
+// the tap device of the VM directly to a bridge in the node network
+// namespace instead of adding the pod to CNI networks. The pod still
+// gets its own network namespace, but there's nothing in it. There's
+// no DHCP server either, as the addresses are supposed to be assigned
+// by the provider network
+func (s *TapFDSource) setupL2PodNetwork(payload *GetFDPayload, hwAddr net.HardwareAddr, inheritedFiles []*os.File) (pn *podNetwork, netConfig *cnicurrent.Result, err error) {
+	pnd := payload.Description
+	netNSPath := cni.PodNetNSPath(pnd.PodId)
+	var csn *nettools.ContainerSideNetwork
+	if payload.CNIConfig != nil {
+		var file *os.File
+		switch len(inheritedFiles) {
+		case 0:
+		case 1:
+			file = inheritedFiles[0]
+		default:
+			return nil, nil, fmt.Errorf("got %d files for L2 network of pod %s (%s)", len(inheritedFiles), pnd.PodName, pnd.PodId)
+		}
+		if csn, err = nettools.RecreateL2Network(payload.CNIConfig, netNSPath, file); err != nil {
+			return nil, nil, fmt.Errorf("error recovering L2 network of pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+		}
+	} else {
+		att, err := nettools.ParseL2Attachment(pnd.L2Network)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := createNetNS(pnd.PodId); err != nil {
+			return nil, nil, fmt.Errorf("error creating new netns for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+		}
+		if csn, err = nettools.SetupL2Network(pnd.PodId, netNSPath, att, hwAddr); err != nil {
+			if err := cni.DestroyNetNS(pnd.PodId); err != nil {
+				glog.Errorf("Error removing network namespace of pod %s (%s) during rollback: %v", pnd.PodName, pnd.PodId, err)
+			}
+			return nil, nil, fmt.Errorf("error setting up L2 network for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+		}
+	}
+	if pnd.Debug {
+		glog.Infof("L2 network of pod %s (%s): bridge %q, tap %q, MAC %s", pnd.PodName, pnd.PodId,
+			pnd.L2Network, csn.Interfaces[0].Name, csn.Interfaces[0].HardwareAddr)
+	}
+	return &podNetwork{
+		pnd: *pnd,
+		csn: csn,
+	}, csn.Result, nil
+}
+
+// teardownL2PodNetwork removes the tap device of the pod in
+// L2 mode along with its network namespace
+func (s *TapFDSource) teardownL2PodNetwork(pn *podNetwork) error {
+	if err := pn.csn.TeardownL2Network(); err != nil {
+		return fmt.Errorf("error tearing down L2 network of pod %s (%s): %v", pn.pnd.PodName, pn.pnd.PodId, err)
+	}
+	if err := cni.DestroyNetNS(pn.pnd.PodId); err != nil {
+		return fmt.Errorf("error when removing network namespace for pod sandbox %q: %v", pn.pnd.PodId, err)
+	}
+	return nil
+}
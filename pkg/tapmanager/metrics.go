@@ -0,0 +1,137 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/dhcp"
+)
+
+// cniQueueStatsSource is implemented by CNI clients that
+// limit the number of concurrent CNI operations
+type cniQueueStatsSource interface {
+	QueueStats() cni.QueueStats
+}
+
+// PodDHCPStats contains DHCP request counters for VM
+// interfaces of a pod
+type PodDHCPStats struct {
+	// PodId specifies the id of the pod
+	PodId string
+	// PodNs specifies the namespace of the pod
+	PodNs string
+	// PodName specifies the name of the pod
+	PodName string
+	// Interfaces maps VM interface hardware addresses
+	// to request counters
+	Interfaces map[string]dhcp.InterfaceStats
+}
+
+// DHCPStats returns DHCP request counters for all pods
+// with active network, sorted by pod id
+func (s *TapFDSource) DHCPStats() []PodDHCPStats {
+	s.Lock()
+	defer s.Unlock()
+	var r []PodDHCPStats
+	for _, pn := range s.fdMap {
+		if pn.dhcpServer == nil {
+			continue
+		}
+		r = append(r, PodDHCPStats{
+			PodId:      pn.pnd.PodId,
+			PodNs:      pn.pnd.PodNs,
+			PodName:    pn.pnd.PodName,
+			Interfaces: pn.dhcpServer.Stats(),
+		})
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].PodId < r[j].PodId })
+	return r
+}
+
+// writeDHCPMetrics writes DHCP request counters in Prometheus
+// text exposition format
+func writeDHCPMetrics(w io.Writer, stats []PodDHCPStats) error {
+	if _, err := io.WriteString(w, "# HELP virtlet_dhcp_requests_total Number of DHCP requests received from VM interfaces.\n# TYPE virtlet_dhcp_requests_total counter\n"); err != nil {
+		return err
+	}
+	for _, ps := range stats {
+		var hwAddrs []string
+		for hwAddr := range ps.Interfaces {
+			hwAddrs = append(hwAddrs, hwAddr)
+		}
+		sort.Strings(hwAddrs)
+		for _, hwAddr := range hwAddrs {
+			st := ps.Interfaces[hwAddr]
+			for _, item := range []struct {
+				kind  string
+				value uint64
+			}{
+				{"discover", st.Discover},
+				{"request", st.Request},
+				{"renew", st.Renew},
+				{"refused", st.Refused},
+			} {
+				if _, err := fmt.Fprintf(w, "virtlet_dhcp_requests_total{pod_id=%q,pod_namespace=%q,pod_name=%q,mac=%q,kind=%q} %d\n",
+					ps.PodId, ps.PodNs, ps.PodName, hwAddr, item.kind, item.value); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// writeCNIQueueMetrics writes the numbers of running and waiting
+// CNI operations in Prometheus text exposition format
+func writeCNIQueueMetrics(w io.Writer, stats cni.QueueStats) error {
+	if _, err := fmt.Fprintf(w, "# HELP virtlet_cni_operations_running Number of CNI operations being executed.\n# TYPE virtlet_cni_operations_running gauge\nvirtlet_cni_operations_running %d\n", stats.Running); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, "# HELP virtlet_cni_operations_waiting Number of CNI operations waiting for their turn.\n# TYPE virtlet_cni_operations_waiting gauge\n"); err != nil {
+		return err
+	}
+	for _, kind := range []cni.OpKind{cni.OpAdd, cni.OpDel} {
+		if _, err := fmt.Fprintf(w, "virtlet_cni_operations_waiting{operation=%q} %d\n", kind, stats.Waiting[kind]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewMetricsHandler returns an http.Handler that serves tapmanager
+// metrics in Prometheus text exposition format
+func NewMetricsHandler(s *TapFDSource) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := writeDHCPMetrics(w, s.DHCPStats()); err != nil {
+			glog.Warningf("Error writing metrics: %v", err)
+			return
+		}
+		if qs, ok := s.cniClient.(cniQueueStatsSource); ok {
+			if err := writeCNIQueueMetrics(w, qs.QueueStats()); err != nil {
+				glog.Warningf("Error writing metrics: %v", err)
+			}
+		}
+	})
+}
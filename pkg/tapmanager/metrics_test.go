@@ -0,0 +1,72 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/dhcp"
+)
+
+func TestWriteDHCPMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeDHCPMetrics(&buf, []PodDHCPStats{
+		{
+			PodId:   "69eec606-0493-5825-73a4-c5e0c0236155",
+			PodNs:   "default",
+			PodName: "cirros-vm",
+			Interfaces: map[string]dhcp.InterfaceStats{
+				"42:a4:a6:22:80:2e": {Discover: 2, Request: 1, Renew: 3},
+			},
+		},
+	}); err != nil {
+		t.Fatalf("writeDHCPMetrics(): %v", err)
+	}
+	expected := `# HELP virtlet_dhcp_requests_total Number of DHCP requests received from VM interfaces.
+# TYPE virtlet_dhcp_requests_total counter
+virtlet_dhcp_requests_total{pod_id="69eec606-0493-5825-73a4-c5e0c0236155",pod_namespace="default",pod_name="cirros-vm",mac="42:a4:a6:22:80:2e",kind="discover"} 2
+virtlet_dhcp_requests_total{pod_id="69eec606-0493-5825-73a4-c5e0c0236155",pod_namespace="default",pod_name="cirros-vm",mac="42:a4:a6:22:80:2e",kind="request"} 1
+virtlet_dhcp_requests_total{pod_id="69eec606-0493-5825-73a4-c5e0c0236155",pod_namespace="default",pod_name="cirros-vm",mac="42:a4:a6:22:80:2e",kind="renew"} 3
+virtlet_dhcp_requests_total{pod_id="69eec606-0493-5825-73a4-c5e0c0236155",pod_namespace="default",pod_name="cirros-vm",mac="42:a4:a6:22:80:2e",kind="refused"} 0
+`
+	if buf.String() != expected {
+		t.Errorf("bad metrics output. Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
+
+func TestWriteCNIQueueMetrics(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeCNIQueueMetrics(&buf, cni.QueueStats{
+		Running: 4,
+		Waiting: map[cni.OpKind]int{cni.OpAdd: 3},
+	}); err != nil {
+		t.Fatalf("writeCNIQueueMetrics(): %v", err)
+	}
+	expected := `# HELP virtlet_cni_operations_running Number of CNI operations being executed.
+# TYPE virtlet_cni_operations_running gauge
+virtlet_cni_operations_running 4
+# HELP virtlet_cni_operations_waiting Number of CNI operations waiting for their turn.
+# TYPE virtlet_cni_operations_waiting gauge
+virtlet_cni_operations_waiting{operation="add"} 3
+virtlet_cni_operations_waiting{operation="del"} 0
+`
+	if buf.String() != expected {
+		t.Errorf("bad metrics output. Expected:\n%s\nGot:\n%s", expected, buf.String())
+	}
+}
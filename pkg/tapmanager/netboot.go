@@ -0,0 +1,90 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/bootserver"
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+const defaultNetBootDir = "/var/lib/virtlet/netboot"
+
+// SetNetBootDir sets the directory that contains the boot files
+// for the pods that boot over the network. Each pod gets the
+// files from a subdirectory specified in PodNetworkDesc
+func (s *TapFDSource) SetNetBootDir(dir string) {
+	s.netBootDir = dir
+}
+
+// setupBootServer starts TFTP and HTTP servers for the boot files
+// of the pod and makes them reachable for the VM. It must be
+// called from within the pod network namespace. It returns
+// the server and the name of the boot file to be passed to
+// the VM via DHCP
+func (s *TapFDSource) setupBootServer(pnd *PodNetworkDesc, csn *nettools.ContainerSideNetwork, vmNS ns.NetNS) (*bootserver.Server, string, error) {
+	// the value was validated by the caller
+	dir, bootFile, err := bootserver.ParseBootPath(pnd.NetBoot)
+	if err != nil {
+		return nil, "", err
+	}
+	root := filepath.Join(s.netBootDir, dir)
+	if fi, err := os.Stat(root); err != nil {
+		return nil, "", fmt.Errorf("can't use boot file directory: %v", err)
+	} else if !fi.IsDir() {
+		return nil, "", fmt.Errorf("%q is not a directory", root)
+	}
+
+	if err := csn.SetupInternalServerAccess(); err != nil {
+		return nil, "", fmt.Errorf("error setting up boot server access: %v", err)
+	}
+	// TFTP transfers use separate UDP ports, which must be
+	// opened in the pod network namespace, too
+	server := bootserver.NewServer(root, func(network, address string) (net.PacketConn, error) {
+		var conn net.PacketConn
+		err := vmNS.Do(func(ns.NetNS) error {
+			var err error
+			conn, err = net.ListenPacket(network, address)
+			return err
+		})
+		return conn, err
+	})
+	if err := server.Listen(nettools.InternalServerIP()); err != nil {
+		return nil, "", err
+	}
+	server.Serve()
+	glog.V(1).Infof("Serving boot files from %q for pod %s (%s), boot file %q", root, pnd.PodName, pnd.PodId, bootFile)
+	return server, bootFile, nil
+}
+
+// stopBootServer stops the boot file server of the pod, if any
+func stopBootServer(pn *podNetwork) {
+	if pn.bootServer == nil {
+		return
+	}
+	if err := pn.bootServer.Close(); err != nil {
+		glog.Warningf("Error stopping boot server for pod %s (%s): %v", pn.pnd.PodName, pn.pnd.PodId, err)
+	}
+	pn.bootServer = nil
+}
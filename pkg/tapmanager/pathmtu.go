@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"fmt"
+	"strings"
+
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/golang/glog"
+	"github.com/vishvananda/netlink"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+// PathMTUCheckMode specifies what to do with the pods whose
+// interface MTU exceeds the path MTU to the gateway
+type PathMTUCheckMode string
+
+const (
+	// PathMTUCheckOff disables the path MTU probes
+	PathMTUCheckOff PathMTUCheckMode = ""
+	// PathMTUCheckWarn makes Virtlet log a warning if the
+	// interface MTU exceeds the path MTU
+	PathMTUCheckWarn PathMTUCheckMode = "warn"
+	// PathMTUCheckEnforce makes the pod startup fail if the
+	// interface MTU exceeds the path MTU
+	PathMTUCheckEnforce PathMTUCheckMode = "enforce"
+)
+
+// ParsePathMTUCheckMode parses the path MTU check mode
+func ParsePathMTUCheckMode(value string) (PathMTUCheckMode, error) {
+	switch mode := PathMTUCheckMode(strings.TrimSpace(value)); mode {
+	case PathMTUCheckOff, PathMTUCheckWarn, PathMTUCheckEnforce:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("bad path MTU check mode %q (must be 'warn' or 'enforce')", value)
+	}
+}
+
+// checkPathMTU probes the path MTU for the interfaces in the CNI
+// result. It must be called from within pod network namespace.
+// Unless enforce is true, the problems are only logged
+func (s *TapFDSource) checkPathMTU(pnd *PodNetworkDesc, netConfig *cnicurrent.Result, allLinks []netlink.Link, enforce bool) ([]nettools.PathMTUReport, error) {
+	reports, err := nettools.CheckPathMTU(netConfig, allLinks, s.pathMTUProbeTimeout)
+	if err != nil {
+		if enforce {
+			return nil, fmt.Errorf("path MTU check failed for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+		}
+		glog.Warningf("Path MTU check failed for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+		return nil, nil
+	}
+	for _, r := range reports {
+		if !r.Exceeded() {
+			continue
+		}
+		if enforce {
+			return nil, fmt.Errorf("refusing to set up the network for pod %s (%s): %s", pnd.PodName, pnd.PodId, r.String())
+		}
+		glog.Warningf("Path MTU problem for pod %s (%s): %s", pnd.PodName, pnd.PodId, r.String())
+	}
+	return reports, nil
+}
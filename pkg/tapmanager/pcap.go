@@ -0,0 +1,238 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/Mirantis/virtlet/pkg/audit"
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+const (
+	// CaptureSubresource is the pod subresource that the users
+	// must be allowed to "create" in order to capture the traffic
+	// of the VM
+	CaptureSubresource = "pcap"
+
+	defaultCaptureDuration = 30 * time.Second
+	maxCaptureDuration     = 5 * time.Minute
+	defaultCaptureSize     = 16 * 1024 * 1024
+	maxCaptureSize         = 256 * 1024 * 1024
+)
+
+var (
+	errCaptureSizeExceeded = errors.New("capture size limit exceeded")
+	errPodNotFound         = errors.New("pod network not found")
+)
+
+// CaptureOptions specifies the parameters of a packet capture
+type CaptureOptions struct {
+	// PodId specifies the id of the pod. If it's empty,
+	// PodNs and PodName are used to find the pod
+	PodId string
+	// PodNs specifies the namespace of the pod
+	PodNs string
+	// PodName specifies the name of the pod
+	PodName string
+	// Interface specifies the index of VM network interface
+	Interface int
+	// Side specifies the interface to capture the traffic on,
+	// nettools.CaptureTap or nettools.CaptureLink
+	Side string
+	// Duration specifies the capture duration
+	Duration time.Duration
+	// MaxBytes specifies the maximum size of the capture
+	// output. The last packet is truncated when the
+	// limit is reached
+	MaxBytes int64
+	// Filter specifies an optional pcap filter expression
+	Filter string
+}
+
+// normalize applies the defaults and verifies the limits
+func (o *CaptureOptions) normalize() error {
+	if o.PodId == "" && (o.PodNs == "" || o.PodName == "") {
+		return errors.New("either pod id or pod namespace and name must be specified")
+	}
+	if o.Side == "" {
+		o.Side = nettools.CaptureTap
+	}
+	if o.Side != nettools.CaptureTap && o.Side != nettools.CaptureLink {
+		return fmt.Errorf("bad capture side %q", o.Side)
+	}
+	switch {
+	case o.Duration == 0:
+		o.Duration = defaultCaptureDuration
+	case o.Duration < 0 || o.Duration > maxCaptureDuration:
+		return fmt.Errorf("capture duration must be between 0 and %v", maxCaptureDuration)
+	}
+	switch {
+	case o.MaxBytes == 0:
+		o.MaxBytes = defaultCaptureSize
+	case o.MaxBytes < 0 || o.MaxBytes > maxCaptureSize:
+		return fmt.Errorf("capture size must be between 0 and %d bytes", maxCaptureSize)
+	}
+	return nil
+}
+
+// limitedWriter passes at most n bytes to w, cancelling the
+// capture when the limit is reached
+type limitedWriter struct {
+	w      io.Writer
+	n      int64
+	cancel context.CancelFunc
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	truncated := false
+	if int64(len(p)) > lw.n {
+		p = p[:lw.n]
+		truncated = true
+	}
+	n, err := lw.w.Write(p)
+	lw.n -= int64(n)
+	if f, ok := lw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	if err == nil && truncated {
+		err = errCaptureSizeExceeded
+	}
+	if err != nil {
+		lw.cancel()
+	}
+	return n, err
+}
+
+// captureTarget returns the network namespace path and the interface
+// name to use for the capture
+func (s *TapFDSource) captureTarget(opts CaptureOptions) (string, string, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, pn := s.findPodNetwork(opts.PodId, opts.PodNs, opts.PodName)
+	if pn == nil || pn.csn == nil {
+		return "", "", errPodNotFound
+	}
+	if pn.pnd.L2Network != "" {
+		// there's just the tap device in the node network
+		// namespace, so both sides are the same
+		if opts.Interface != 0 {
+			return "", "", fmt.Errorf("bad interface index %d (the VM has 1 interface)", opts.Interface)
+		}
+		return nodeNetNSPath, pn.csn.Interfaces[0].Name, nil
+	}
+	ifName, err := pn.csn.CaptureInterfaceName(opts.Interface, opts.Side)
+	if err != nil {
+		return "", "", err
+	}
+	return pn.csn.NsPath, ifName, nil
+}
+
+// Capture captures the traffic of a VM network interface, writing
+// the packets in pcap format to w. It returns when the capture
+// duration elapses or the size limit is reached.
+func (s *TapFDSource) Capture(opts CaptureOptions, w io.Writer) error {
+	if err := opts.normalize(); err != nil {
+		return err
+	}
+	nsPath, ifName, err := s.captureTarget(opts)
+	if err != nil {
+		return err
+	}
+	return s.runCapture(nsPath, ifName, opts, w)
+}
+
+func (s *TapFDSource) runCapture(nsPath, ifName string, opts CaptureOptions, w io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), opts.Duration)
+	defer cancel()
+	glog.V(1).Infof("Capturing traffic on %q in %q for %v (max %d bytes)", ifName, nsPath, opts.Duration, opts.MaxBytes)
+	return nettools.RunCapture(ctx, nsPath, ifName, opts.Filter, &limitedWriter{w: w, n: opts.MaxBytes, cancel: cancel})
+}
+
+func captureOptionsFromRequest(r *http.Request) (CaptureOptions, error) {
+	q := r.URL.Query()
+	opts := CaptureOptions{
+		PodId:   q.Get("podId"),
+		PodNs:   q.Get("namespace"),
+		PodName: q.Get("name"),
+		Side:    q.Get("side"),
+		Filter:  q.Get("filter"),
+	}
+	var err error
+	if s := q.Get("interface"); s != "" {
+		if opts.Interface, err = strconv.Atoi(s); err != nil {
+			return opts, fmt.Errorf("bad interface index %q", s)
+		}
+	}
+	if s := q.Get("duration"); s != "" {
+		if opts.Duration, err = time.ParseDuration(s); err != nil {
+			return opts, fmt.Errorf("bad duration %q", s)
+		}
+	}
+	if s := q.Get("maxBytes"); s != "" {
+		if opts.MaxBytes, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return opts, fmt.Errorf("bad maxBytes value %q", s)
+		}
+	}
+	return opts, opts.normalize()
+}
+
+// NewCaptureHandler returns an http.Handler that captures the
+// traffic of VM network interfaces and streams it back in pcap
+// format. The pod is specified using either podId or namespace and
+// name query parameters, the capture is controlled by optional
+// interface, side, duration, maxBytes and filter parameters. The
+// caller must pass a bearer token in Authorization header that's
+// checked using the authorizer for the pcap subresource of the pod.
+func NewCaptureHandler(s *TapFDSource, authorizer PodAuthorizer, auditLog *audit.Log) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		opts, err := captureOptionsFromRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		podNs, podName, user, ok := s.authorizePodRequest(w, r, authorizer, auditLog, "CapturePackets", CaptureSubresource, opts.PodId, opts.PodNs, opts.PodName)
+		if !ok {
+			return
+		}
+		target := podNs + "/" + podName
+		nsPath, ifName, err := s.captureTarget(opts)
+		switch {
+		case err == errPodNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		glog.V(1).Infof("User %q capturing the traffic of pod %s", user, target)
+		auditLog.Record("CapturePackets", user, target, nil)
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		if err := s.runCapture(nsPath, ifName, opts, w); err != nil {
+			// the headers are already sent at this point
+			glog.Warningf("Packet capture failed: %v", err)
+		}
+	})
+}
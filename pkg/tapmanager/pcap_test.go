@@ -0,0 +1,226 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCaptureOptionsFromRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		url      string
+		expected CaptureOptions
+		err      bool
+	}{
+		{
+			name: "defaults",
+			url:  "/pcap?podId=69eec606-0493-5825-73a4-c5e0c0236155",
+			expected: CaptureOptions{
+				PodId:    "69eec606-0493-5825-73a4-c5e0c0236155",
+				Side:     "tap",
+				Duration: defaultCaptureDuration,
+				MaxBytes: defaultCaptureSize,
+			},
+		},
+		{
+			name: "all options",
+			url:  "/pcap?namespace=default&name=cirros-vm&interface=1&side=link&duration=10s&maxBytes=1000&filter=port+22",
+			expected: CaptureOptions{
+				PodNs:     "default",
+				PodName:   "cirros-vm",
+				Interface: 1,
+				Side:      "link",
+				Duration:  10 * time.Second,
+				MaxBytes:  1000,
+				Filter:    "port 22",
+			},
+		},
+		{
+			name: "no pod",
+			url:  "/pcap?namespace=default",
+			err:  true,
+		},
+		{
+			name: "bad side",
+			url:  "/pcap?podId=abc&side=bridge",
+			err:  true,
+		},
+		{
+			name: "duration too long",
+			url:  "/pcap?podId=abc&duration=1h",
+			err:  true,
+		},
+		{
+			name: "size too big",
+			url:  "/pcap?podId=abc&maxBytes=1000000000000",
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatalf("NewRequest(): %v", err)
+			}
+			opts, err := captureOptionsFromRequest(r)
+			switch {
+			case tc.err && err == nil:
+				t.Errorf("didn't get an expected error")
+			case !tc.err && err != nil:
+				t.Errorf("captureOptionsFromRequest(): %v", err)
+			case !tc.err && !reflect.DeepEqual(opts, tc.expected):
+				t.Errorf("bad options: %#v instead of %#v", opts, tc.expected)
+			}
+		})
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	cancelled := false
+	lw := &limitedWriter{w: &buf, n: 5, cancel: func() { cancelled = true }}
+	if _, err := lw.Write([]byte("abc")); err != nil {
+		t.Fatalf("Write(): %v", err)
+	}
+	if cancelled {
+		t.Errorf("cancelled too early")
+	}
+	n, err := lw.Write([]byte("defg"))
+	if err != errCaptureSizeExceeded {
+		t.Errorf("expected errCaptureSizeExceeded, got %v", err)
+	}
+	if n != 2 {
+		t.Errorf("bad byte count %d instead of 2", n)
+	}
+	if !cancelled {
+		t.Errorf("the capture wasn't cancelled")
+	}
+	if buf.String() != "abcde" {
+		t.Errorf("bad output %q", buf.String())
+	}
+}
+
+type fakePodAuthorizer struct {
+	allow bool
+	calls []string
+}
+
+var _ PodAuthorizer = &fakePodAuthorizer{}
+
+func (a *fakePodAuthorizer) Authorize(token, namespace, name, subresource string) (string, error) {
+	a.calls = append(a.calls, token+" "+namespace+"/"+name+" "+subresource)
+	if !a.allow {
+		return "", errors.New("unauthorized")
+	}
+	return "alice", nil
+}
+
+func TestCaptureHandlerAuthorization(t *testing.T) {
+	s := &TapFDSource{
+		fdMap: map[string]*podNetwork{
+			"69eec606-0493-5825-73a4-c5e0c0236155": {
+				pnd: PodNetworkDesc{
+					PodId:   "69eec606-0493-5825-73a4-c5e0c0236155",
+					PodNs:   "default",
+					PodName: "cirros-vm",
+				},
+			},
+		},
+	}
+	for _, tc := range []struct {
+		name   string
+		url    string
+		token  string
+		allow  bool
+		status int
+		call   string
+	}{
+		{
+			name:   "no token",
+			url:    "/pcap?namespace=default&name=cirros-vm",
+			status: http.StatusUnauthorized,
+		},
+		{
+			name:   "bad request",
+			url:    "/pcap?namespace=default",
+			token:  "foobar",
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "denied",
+			url:    "/pcap?namespace=default&name=cirros-vm",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/cirros-vm pcap",
+		},
+		{
+			name:   "denied by pod id",
+			url:    "/pcap?podId=69eec606-0493-5825-73a4-c5e0c0236155",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/cirros-vm pcap",
+		},
+		{
+			name:   "denied for nonexistent pod",
+			url:    "/pcap?namespace=default&name=foobar",
+			token:  "foobar",
+			status: http.StatusForbidden,
+			call:   "foobar default/foobar pcap",
+		},
+		{
+			name:   "unknown pod id",
+			url:    "/pcap?podId=abc",
+			token:  "foobar",
+			status: http.StatusNotFound,
+		},
+		{
+			// the pod network isn't set up yet
+			name:   "allowed",
+			url:    "/pcap?namespace=default&name=cirros-vm",
+			token:  "foobar",
+			allow:  true,
+			status: http.StatusNotFound,
+			call:   "foobar default/cirros-vm pcap",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			authorizer := &fakePodAuthorizer{allow: tc.allow}
+			req := httptest.NewRequest("GET", tc.url, nil)
+			if tc.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.token)
+			}
+			rec := httptest.NewRecorder()
+			NewCaptureHandler(s, authorizer, nil).ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Errorf("bad status code %d instead of %d: %s", rec.Code, tc.status, rec.Body.String())
+			}
+			var expectedCalls []string
+			if tc.call != "" {
+				expectedCalls = []string{tc.call}
+			}
+			if !reflect.DeepEqual(authorizer.calls, expectedCalls) {
+				t.Errorf("bad authorizer calls: %#v instead of %#v", authorizer.calls, expectedCalls)
+			}
+		})
+	}
+}
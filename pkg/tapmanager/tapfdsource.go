@@ -17,9 +17,13 @@ limitations under the License.
 package tapmanager
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -30,15 +34,21 @@ import (
 	"github.com/golang/glog"
 	"github.com/vishvananda/netlink"
 
+	"github.com/Mirantis/virtlet/pkg/bootserver"
 	"github.com/Mirantis/virtlet/pkg/cni"
 	"github.com/Mirantis/virtlet/pkg/dhcp"
 	"github.com/Mirantis/virtlet/pkg/nettools"
+	"github.com/Mirantis/virtlet/pkg/utils"
 )
 
 const (
-	calicoNetType       = "calico"
-	calicoDefaultSubnet = 24
-	calicoSubnetVar     = "VIRTLET_CALICO_SUBNET"
+	calicoNetType         = "calico"
+	calicoDefaultSubnet   = 24
+	calicoSubnetVar       = "VIRTLET_CALICO_SUBNET"
+	dhcpLogRequestsEnvVar = "VIRTLET_DHCP_LOG_REQUESTS"
+	bridgeMulticastEnvVar = "VIRTLET_BRIDGE_MULTICAST"
+
+	defaultPathMTUProbeTimeout = time.Second
 )
 
 // InterfaceDescription contains interface type with additional data
@@ -48,6 +58,23 @@ type InterfaceDescription struct {
 	HardwareAddr net.HardwareAddr       `json:"mac"`
 	FdIndex      int                    `json:"fdIndex"`
 	PCIAddress   string                 `json:"pciAddress"`
+	// Name is the name of the CNI-provided interface
+	// in the pod network namespace
+	Name string `json:"name,omitempty"`
+	// IPs contains the addresses assigned to the interface
+	// in CIDR notation
+	IPs []string `json:"ips,omitempty"`
+	// MTU is the MTU of the interface
+	MTU uint16 `json:"mtu,omitempty"`
+	// Netdev is the id of QEMU netdev that uses the interface.
+	// It's only set after vmwrapper reports it
+	Netdev string `json:"netdev,omitempty"`
+	// Device is the id of QEMU device that corresponds to
+	// the interface. It's only set after vmwrapper reports it
+	Device string `json:"device,omitempty"`
+	// Vhost is true if the netdev uses vhost-net acceleration.
+	// It's only set after vmwrapper reports it
+	Vhost bool `json:"vhost,omitempty"`
 }
 
 // PodNetworkDesc contains the data that are required by TapFDSource
@@ -61,6 +88,48 @@ type PodNetworkDesc struct {
 	PodName string `json:"podName"`
 	// DNS specifies DNS settings for the pod
 	DNS *cnitypes.DNS
+	// MACAddress specifies the MAC address to use for the first
+	// VM interface instead of the one assigned by CNI
+	MACAddress string `json:"macAddress,omitempty"`
+	// IngressRules specifies the list of rules restricting the
+	// traffic that may reach the VM, in the format accepted by
+	// nettools.ParseIngressRules(). Empty string means that
+	// the traffic is not restricted
+	IngressRules string `json:"ingressRules,omitempty"`
+	// Networks specifies the names of CNI configuration files
+	// of the networks to attach the pod to, in order. Empty
+	// list means that the default network is used
+	Networks []string `json:"networks,omitempty"`
+	// Debug enables verbose logging of CNI results and DHCP
+	// packets for the pod regardless of the glog verbosity level
+	Debug bool `json:"debug,omitempty"`
+	// L2Network specifies the bridge in the node network namespace
+	// to attach the VM to, bypassing CNI, in the format accepted by
+	// nettools.ParseL2Attachment(). Empty string means that
+	// the pod is attached to CNI networks
+	L2Network string `json:"l2Network,omitempty"`
+	// BridgeMulticast specifies the multicast mode of the bridges
+	// in the pod network namespace, in the format accepted by
+	// nettools.ParseBridgeMulticastMode(). Empty string means
+	// that the node-wide setting is used
+	BridgeMulticast string `json:"bridgeMulticast,omitempty"`
+	// DHCPExtraMACs specifies additional MAC addresses that get
+	// the same DHCP leases as the VM interfaces, in the format
+	// accepted by dhcp.ParseExtraHardwareAddrs()
+	DHCPExtraMACs string `json:"dhcpExtraMACs,omitempty"`
+	// DHCPRelaxed makes the DHCP server answer the requests
+	// from any MAC address that come from a VM interface
+	DHCPRelaxed bool `json:"dhcpRelaxed,omitempty"`
+	// NetBoot specifies the boot files for the VMs that boot
+	// over the network, in the format accepted by
+	// bootserver.ParseBootPath(). The directory is relative
+	// to the netboot directory of TapFDSource
+	NetBoot string `json:"netBoot,omitempty"`
+	// VirtioNetOptions specifies the virtio-net device options
+	// for the NICs hot-plugged into the VM, in the format accepted
+	// by utils.ParseVirtioNetOptions(). vmwrapper gets the same
+	// options for the NICs it adds from the domain definition
+	VirtioNetOptions string `json:"virtioNetOptions,omitempty"`
 }
 
 // GetFDPayload contains the data that are required by TapFDSource
@@ -73,6 +142,15 @@ type GetFDPayload struct {
 	// CNIConfig specifies CNI configuration used to configure retaken
 	// environment
 	CNIConfig *cnicurrent.Result `json:"cniConfig"`
+	// DryRun specifies that the network must be torn down right
+	// after it's set up and validated. In this case, no file
+	// descriptors are returned and the response data contains
+	// marshalled NetworkCheckReport
+	DryRun bool `json:"dryRun,omitempty"`
+	// inheritedFDs are the file descriptors of the interfaces
+	// inherited from the previous tapmanager process which
+	// are used instead of reopening the devices upon recovery
+	inheritedFDs []int
 }
 
 type podNetwork struct {
@@ -80,6 +158,30 @@ type podNetwork struct {
 	csn        *nettools.ContainerSideNetwork
 	dhcpServer *dhcp.Server
 	doneCh     chan error
+	// bootServer serves the boot files for the VMs
+	// that boot over the network
+	bootServer *bootserver.Server
+	// vmStartCount is the number of times the fds were handed
+	// to a VM process. The container side network is kept intact
+	// between VM restarts within the same pod sandbox, so the
+	// restarted VM gets the same tap devices and MAC addresses
+	vmStartCount int
+	// vmRunning is true if the VM process that has obtained
+	// the fds is running, so the interfaces must be hot-plugged
+	// into it and unplugged from it
+	vmRunning bool
+	// netdevs contains QEMU netdev and device ids
+	// reported by vmwrapper for the current VM process
+	netdevs []NetdevDescription
+	// extraNetworks contains the networks attached
+	// using AttachNetwork() in the order of attachment
+	extraNetworks []extraNetwork
+	// hotplugMutex serializes AttachNetwork() and
+	// DetachNetwork() calls for the pod
+	hotplugMutex sync.Mutex
+	// pathMTU contains the results of path MTU probes
+	// made during the network setup, if any
+	pathMTU []nettools.PathMTUReport
 }
 
 // TapFDSource sets up and tears down Virtlet VM network.
@@ -91,21 +193,84 @@ type TapFDSource struct {
 	dummyNetwork       *cnicurrent.Result
 	dummyNetworkNsPath string
 	fdMap              map[string]*podNetwork
+	setupTimeout       time.Duration
+	// pendingMACs maps MAC addresses requested via PodNetworkDesc
+	// to the keys of the pod networks being set up
+	pendingMACs          map[string]string
+	cniDelAttempts       int
+	cniDelInitialBackoff time.Duration
+	pendingCNIDelDir     string
+	// addressConflictTimeout is the time to wait for the responses
+	// to ARP probes for VM addresses. Zero value disables the check
+	addressConflictTimeout time.Duration
+	pathMTUCheck           PathMTUCheckMode
+	pathMTUProbeTimeout    time.Duration
+	cniResultHook          CNIResultHook
+	netBootDir             string
 }
 
 var _ FDSource = &TapFDSource{}
+var _ FDAdopter = &TapFDSource{}
 
 // NewTapFDSource returns a TapFDSource for the specified CNI plugin &
 // config dir
 func NewTapFDSource(cniClient cni.CNIClient) (*TapFDSource, error) {
 	s := &TapFDSource{
-		cniClient: cniClient,
-		fdMap:     make(map[string]*podNetwork),
+		cniClient:            cniClient,
+		fdMap:                make(map[string]*podNetwork),
+		pendingMACs:          make(map[string]string),
+		cniDelAttempts:       defaultCNIDelAttempts,
+		cniDelInitialBackoff: defaultCNIDelInitialBackoff,
+		pathMTUProbeTimeout:  defaultPathMTUProbeTimeout,
+		netBootDir:           defaultNetBootDir,
 	}
 
 	return s, nil
 }
 
+// SetSetupTimeout sets the time limit for setting up the pod
+// network. If the setup takes longer, it's rolled back. Zero
+// value (the default) means no limit
+func (s *TapFDSource) SetSetupTimeout(timeout time.Duration) {
+	s.setupTimeout = timeout
+}
+
+// SetAddressConflictTimeout enables checking whether the addresses
+// assigned to the VM by CNI are already in use on the network before
+// the VM is started, specifying how long to wait for the responses
+// to ARP probes. Zero value (the default) disables the check
+func (s *TapFDSource) SetAddressConflictTimeout(timeout time.Duration) {
+	s.addressConflictTimeout = timeout
+}
+
+// SetPathMTUCheck enables probing the path MTU between the pod
+// network namespace and the gateway before the VM is started,
+// specifying what to do if the interface MTU exceeds it and how
+// long to wait for the reply to each probe. The path MTU is always
+// probed during the network dry run
+func (s *TapFDSource) SetPathMTUCheck(mode PathMTUCheckMode, probeTimeout time.Duration) {
+	s.pathMTUCheck = mode
+	if probeTimeout != 0 {
+		s.pathMTUProbeTimeout = probeTimeout
+	}
+}
+
+// SetCNIResultHook sets the hook that's used to adjust CNI results
+// before they're applied to the pod network. The results that are
+// passed in upon recovery are already adjusted, so the hook is
+// only invoked for the new pods and attached networks
+func (s *TapFDSource) SetCNIResultHook(hook CNIResultHook) {
+	s.cniResultHook = hook
+}
+
+// createNetNS creates the network namespace for the pod
+func createNetNS(podId string) error {
+	if _, err := checkFault(FaultCreateNetNS); err != nil {
+		return err
+	}
+	return cni.CreateNetNS(podId)
+}
+
 func (s *TapFDSource) getDummyNetwork() (*cnicurrent.Result, string, error) {
 	if s.dummyNetwork == nil {
 		var err error
@@ -120,35 +285,231 @@ func (s *TapFDSource) getDummyNetwork() (*cnicurrent.Result, string, error) {
 }
 
 // GetFDs implements GetFDs method of FDSource interface
-func (s *TapFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
+func (s *TapFDSource) GetFDs(ctx context.Context, key string, data []byte) ([]int, []byte, error) {
 	var payload GetFDPayload
 	if err := json.Unmarshal(data, &payload); err != nil {
 		return nil, nil, fmt.Errorf("error unmarshalling GetFD payload: %v", err)
 	}
+	return s.getFDs(ctx, key, &payload)
+}
+
+// AdoptFDs implements AdoptFDs method of FDAdopter interface. It
+// recovers the pod network in the same way as GetFDs() does when the
+// payload contains CNI config, but keeps the tap devices that are
+// inherited from the previous tapmanager process instead of reopening
+// them, as the tap devices can't be reopened while they're in use
+// by the VM
+func (s *TapFDSource) AdoptFDs(key string, data []byte, fds []int) ([]int, []byte, error) {
+	var payload GetFDPayload
+	if err := json.Unmarshal(data, &payload); err != nil {
+		closeFDs(fds)
+		return nil, nil, fmt.Errorf("error unmarshalling GetFD payload: %v", err)
+	}
+	if payload.CNIConfig == nil || payload.DryRun {
+		closeFDs(fds)
+		return nil, nil, errors.New("inherited file descriptors can only be adopted while recovering the network")
+	}
+	payload.inheritedFDs = fds
+	return s.getFDs(context.Background(), key, &payload)
+}
+
+// Detach implements Detach method of FDAdopter interface. It stops
+// the DHCP servers so that the new tapmanager process can start its
+// own ones for the pods, leaving the pod networks intact
+func (s *TapFDSource) Detach() {
+	s.Lock()
+	defer s.Unlock()
+	for _, pn := range s.fdMap {
+		stopBootServer(pn)
+		if pn.dhcpServer == nil {
+			continue
+		}
+		if err := pn.dhcpServer.Close(); err != nil {
+			glog.Warningf("Error stopping dhcp server for pod %s (%s): %v", pn.pnd.PodName, pn.pnd.PodId, err)
+			continue
+		}
+		<-pn.doneCh
+	}
+}
+
+func (s *TapFDSource) getFDs(ctx context.Context, key string, payload *GetFDPayload) ([]int, []byte, error) {
 	pnd := payload.Description
 
 	recover := payload.CNIConfig != nil
+	if recover && payload.DryRun {
+		return nil, nil, errors.New("can't do a dry run while recovering the network")
+	}
+
+	var hwAddr net.HardwareAddr
+	if pnd.MACAddress != "" {
+		var err error
+		if hwAddr, err = s.reserveMAC(key, pnd.MACAddress); err != nil {
+			return nil, nil, err
+		}
+		defer s.releaseMAC(hwAddr)
+	}
+
+	pn, netConfig, err := s.setupPodNetworkWithTimeout(ctx, payload, hwAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if payload.DryRun {
+		return s.finishDryRun(pn)
+	}
+
+	respData, err := json.Marshal(netConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling net config: %v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.fdMap[key] = pn
+	return interfaceFDs(pn.csn), respData, nil
+}
+
+// interfaceFDs returns the file descriptors of the interfaces
+func interfaceFDs(csn *nettools.ContainerSideNetwork) []int {
+	var fds []int
+	for _, i := range csn.Interfaces {
+		fds = append(fds, int(i.Fo.Fd()))
+	}
+	return fds
+}
+
+// setupPodNetworkWithTimeout invokes setupPodNetwork() making sure
+// that it doesn't take longer than the setup timeout. When the
+// timeout expires, the CNI plugins that are still running are
+// killed, and setupPodNetwork() removes the pod from CNI network
+// after they exit so that a late ADD can't leave its IPAM
+// allocations behind. Whatever setupPodNetwork() still manages
+// to set up after the timeout is torn down right away
+func (s *TapFDSource) setupPodNetworkWithTimeout(ctx context.Context, payload *GetFDPayload, hwAddr net.HardwareAddr) (*podNetwork, *cnicurrent.Result, error) {
+	if s.setupTimeout == 0 {
+		return s.setupPodNetwork(ctx, payload, hwAddr)
+	}
+
+	pnd := payload.Description
+	ctx, cancel := context.WithTimeout(ctx, s.setupTimeout)
+	defer cancel()
+	pn, netConfig, err := s.setupPodNetwork(ctx, payload, hwAddr)
+	if ctx.Err() == nil {
+		return pn, netConfig, err
+	}
+	if err == nil {
+		glog.Warningf("Tearing down the network of pod %s (%s) after setup timeout", pnd.PodName, pnd.PodId)
+		s.abandonPodNetwork(pn)
+	}
+	return nil, nil, fmt.Errorf("network setup for pod %s (%s) timed out after %v", pnd.PodName, pnd.PodId, s.setupTimeout)
+}
+
+// removePodFromNetwork removes the pod from CNI network and destroys
+// its network namespace, logging any errors. It's used to roll back
+// failed network setup
+func (s *TapFDSource) removePodFromNetwork(pnd *PodNetworkDesc) {
+	if pnd.L2Network != "" {
+		// setupL2PodNetwork() cleans up after itself if
+		// it fails, and if it succeeds after the timeout,
+		// the network is torn down as an abandoned one
+		return
+	}
+	if err := s.removeFromCNINetwork(pendingCNIDel{
+		PodId:       pnd.PodId,
+		PodName:     pnd.PodName,
+		PodNs:       pnd.PodNs,
+		ConfigFiles: pnd.Networks,
+	}); err != nil {
+		glog.Errorf("Error removing pod %s (%s) from CNI network during rollback: %v", pnd.PodName, pnd.PodId, err)
+	}
+	if err := cni.DestroyNetNS(pnd.PodId); err != nil {
+		glog.Errorf("Error removing network namespace of pod %s (%s) during rollback: %v", pnd.PodName, pnd.PodId, err)
+	}
+}
+
+// abandonPodNetwork tears down the pod network which was set up
+// after the request has timed out. If the network namespace is
+// already gone, it just releases the resources held by the
+// podNetwork
+func (s *TapFDSource) abandonPodNetwork(pn *podNetwork) {
+	err := s.teardownPodNetwork(pn)
+	if err == nil {
+		return
+	}
+	glog.Warningf("Error tearing down the network of pod %s (%s): %v", pn.pnd.PodName, pn.pnd.PodId, err)
+	stopBootServer(pn)
+	if pn.dhcpServer != nil {
+		if err := pn.dhcpServer.Close(); err != nil {
+			glog.Warningf("Error stopping dhcp server: %v", err)
+		}
+	}
+	for _, iface := range pn.csn.Interfaces {
+		iface.Fo.Close()
+	}
+}
+
+// setupPodNetwork sets up the network for the pod, or recovers it
+// if the payload contains CNI config. Unless the network is being
+// recovered, the pod is removed from CNI network and its network
+// namespace is destroyed if the setup fails
+func (s *TapFDSource) setupPodNetwork(ctx context.Context, payload *GetFDPayload, hwAddr net.HardwareAddr) (pn *podNetwork, netConfig *cnicurrent.Result, err error) {
+	pnd := payload.Description
+	recover := payload.CNIConfig != nil
+	netConfig = payload.CNIConfig
+
+	var inheritedFiles []*os.File
+	for _, fd := range payload.inheritedFDs {
+		inheritedFiles = append(inheritedFiles, os.NewFile(uintptr(fd), "inherited-fd"))
+	}
+	defer func() {
+		if err != nil {
+			for _, f := range inheritedFiles {
+				f.Close()
+			}
+		}
+	}()
+
+	if pnd.L2Network != "" {
+		return s.setupL2PodNetwork(payload, hwAddr, inheritedFiles)
+	}
 
 	if !recover {
-		if err := cni.CreateNetNS(pnd.PodId); err != nil {
+		if err := createNetNS(pnd.PodId); err != nil {
 			return nil, nil, fmt.Errorf("error creating new netns for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
 		}
+		defer func() {
+			if err != nil {
+				s.removePodFromNetwork(pnd)
+			}
+		}()
 
-		netConfig, err := s.cniClient.AddSandboxToNetwork(pnd.PodId, pnd.PodName, pnd.PodNs)
+		if len(pnd.Networks) != 0 {
+			netConfig, err = s.cniClient.AddSandboxToNetworks(ctx, pnd.Networks, pnd.PodId, pnd.PodName, pnd.PodNs)
+		} else {
+			netConfig, err = s.cniClient.AddSandboxToNetwork(ctx, pnd.PodId, pnd.PodName, pnd.PodNs)
+		}
 		if err != nil {
 			return nil, nil, fmt.Errorf("error adding pod %s (%s) to CNI network: %v", pnd.PodName, pnd.PodId, err)
 		}
-		glog.V(3).Infof("CNI configuration for pod %s (%s): %s", pnd.PodName, pnd.PodId, spew.Sdump(netConfig))
+		if err = ctx.Err(); err != nil {
+			// the plugins have completed after the timeout,
+			// so there's no point in going further
+			return nil, nil, fmt.Errorf("error adding pod %s (%s) to CNI network: %v", pnd.PodName, pnd.PodId, err)
+		}
+		if pnd.Debug || bool(glog.V(3)) {
+			glog.Infof("CNI configuration for pod %s (%s): %s", pnd.PodName, pnd.PodId, spew.Sdump(netConfig))
+		}
 
-		if payload.Description.DNS != nil {
+		if pnd.DNS != nil {
 			netConfig.DNS.Nameservers = pnd.DNS.Nameservers
 			netConfig.DNS.Search = pnd.DNS.Search
 			netConfig.DNS.Options = pnd.DNS.Options
 		}
-		payload.CNIConfig = netConfig
-	}
 
-	netConfig := payload.CNIConfig
+		if netConfig, err = s.adjustCNIResult(pnd, "", netConfig); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	netNSPath := cni.PodNetNSPath(pnd.PodId)
 	vmNS, err := ns.GetNS(netNSPath)
@@ -158,8 +519,10 @@ func (s *TapFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
 
 	var csn *nettools.ContainerSideNetwork
 	var dhcpServer *dhcp.Server
+	var bootServer *bootserver.Server
+	var pathMTU []nettools.PathMTUReport
 	doneCh := make(chan error)
-	if err := vmNS.Do(func(ns.NetNS) error {
+	if err = vmNS.Do(func(ns.NetNS) error {
 		// switch /sys to corresponding one in netns
 		if err := mountSysfs(); err != nil {
 			return err
@@ -177,17 +540,40 @@ func (s *TapFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
 		if err != nil {
 			return fmt.Errorf("error listing the links: %v", err)
 		}
-		if netConfig, err = nettools.ValidateAndFixCNIResult(netConfig, netNSPath, allLinks); err != nil {
-			return fmt.Errorf("error fixing cni configuration: %v", err)
+		// upon recovery, the CNI result is the one that was
+		// already fixed during the setup, and the addresses are
+		// no longer on the links, so it can't be fixed again
+		if !recover {
+			if netConfig, err = nettools.ValidateAndFixCNIResult(netConfig, netNSPath, allLinks); err != nil {
+				return fmt.Errorf("error fixing cni configuration: %v", err)
+			}
+			if err := nettools.FixCalicoNetworking(netConfig, s.getDummyNetwork); err != nil {
+				// don't fail in this case because there may be even no Calico
+				glog.Warningf("Calico detection/fix didn't work: %v", err)
+			}
+			if pnd.Debug || bool(glog.V(3)) {
+				glog.Infof("CNI Result after fix for pod %s (%s):\n%s", pnd.PodName, pnd.PodId, spew.Sdump(netConfig))
+			}
+		}
+
+		// upon recovery, the MAC address is already there in CNI result
+		if hwAddr != nil && !recover {
+			if err := nettools.PinHardwareAddr(netConfig, hwAddr); err != nil {
+				return fmt.Errorf("error setting MAC address: %v", err)
+			}
 		}
-		if err := nettools.FixCalicoNetworking(netConfig, s.getDummyNetwork); err != nil {
-			// don't fail in this case because there may be even no Calico
-			glog.Warningf("Calico detection/fix didn't work: %v", err)
+
+		// the probes must be sent before SetupContainerSideNetwork()
+		// takes the addresses away from the CNI-provided interfaces
+		if !recover && (payload.DryRun || s.pathMTUCheck != PathMTUCheckOff) {
+			enforce := !payload.DryRun && s.pathMTUCheck == PathMTUCheckEnforce
+			if pathMTU, err = s.checkPathMTU(pnd, netConfig, allLinks, enforce); err != nil {
+				return err
+			}
 		}
-		glog.V(3).Infof("CNI Result after fix:\n%s", spew.Sdump(netConfig))
 
 		if recover {
-			csn, err = nettools.RecreateContainerSideNetwork(netConfig, netNSPath, allLinks)
+			csn, err = nettools.RecreateContainerSideNetwork(netConfig, netNSPath, allLinks, inheritedFiles)
 		} else {
 			csn, err = nettools.SetupContainerSideNetwork(netConfig, netNSPath, allLinks)
 		}
@@ -195,12 +581,86 @@ func (s *TapFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
 			return err
 		}
 
+		if !recover {
+			if err := csn.SetBridgeMulticastMode(bridgeMulticastMode(pnd)); err != nil {
+				if err := csn.Teardown(); err != nil {
+					glog.Errorf("Error tearing down container side network during rollback: %v", err)
+				}
+				return err
+			}
+		}
+
+		if payload.DryRun {
+			return nil
+		}
+
+		// this must be done before AnnounceAddresses(), and the
+		// running VM would respond to the probes upon recovery
+		if s.addressConflictTimeout != 0 && !recover {
+			if err := csn.DetectAddressConflicts(s.addressConflictTimeout); err != nil {
+				if err := csn.Teardown(); err != nil {
+					glog.Errorf("Error tearing down container side network during rollback: %v", err)
+				}
+				return err
+			}
+		}
+
+		if pnd.IngressRules != "" && !recover {
+			// the rules were validated by the caller
+			rules, err := nettools.ParseIngressRules(pnd.IngressRules)
+			if err == nil {
+				err = csn.SetupFirewall(rules)
+			}
+			if err != nil {
+				if err := csn.Teardown(); err != nil {
+					glog.Errorf("Error tearing down container side network during rollback: %v", err)
+				}
+				return fmt.Errorf("error setting up ingress rules: %v", err)
+			}
+		}
+
 		dhcpServer = dhcp.NewServer(csn)
+		dhcpServer.SetRequestLogging(utils.GetBoolFromString(os.Getenv(dhcpLogRequestsEnvVar)))
+		dhcpServer.SetDebug(pnd.Debug)
+		dhcpServer.SetRelaxed(pnd.DHCPRelaxed)
+		if pnd.DHCPExtraMACs != "" {
+			// the value was validated by the caller
+			extra, err := dhcp.ParseExtraHardwareAddrs(pnd.DHCPExtraMACs)
+			if err != nil {
+				glog.Warningf("Ignoring bad extra MAC addresses for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+			} else {
+				dhcpServer.SetExtraHardwareAddrs(extra)
+			}
+		}
 		if err := dhcpServer.SetupListener("0.0.0.0"); err != nil {
+			if !recover {
+				if err := csn.Teardown(); err != nil {
+					glog.Errorf("Error tearing down container side network during rollback: %v", err)
+				}
+			}
 			return fmt.Errorf("Failed to set up dhcp listener: %v", err)
 		}
+		if pnd.NetBoot != "" {
+			var bootFile string
+			if bootServer, bootFile, err = s.setupBootServer(pnd, csn, vmNS); err != nil {
+				if err := dhcpServer.Close(); err != nil {
+					glog.Errorf("Error stopping dhcp server during rollback: %v", err)
+				}
+				if !recover {
+					if err := csn.Teardown(); err != nil {
+						glog.Errorf("Error tearing down container side network during rollback: %v", err)
+					}
+				}
+				return fmt.Errorf("failed to set up boot server: %v", err)
+			}
+			dhcpServer.SetBootFile(bootFile)
+		}
 		go func() {
 			doneCh <- vmNS.Do(func(ns.NetNS) error {
+				if _, err := checkFault(FaultDHCPStart); err != nil {
+					glog.Errorf("dhcp server error: %v", err)
+					return err
+				}
 				err := dhcpServer.Serve()
 				if err != nil {
 					glog.Errorf("dhcp server error: %v", err)
@@ -208,6 +668,9 @@ func (s *TapFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
 				return err
 			})
 		}()
+		if err := csn.AnnounceAddresses(); err != nil {
+			glog.Warningf("Failed to announce VM addresses for pod %s (%s): %v", pnd.PodName, pnd.PodId, err)
+		}
 		// FIXME: there's some very small possibility for a race here
 		// (happens if the VM makes DHCP request before DHCP server is ready)
 		// For now, let's make the probability of such problem even smaller
@@ -217,24 +680,82 @@ func (s *TapFDSource) GetFDs(key string, data []byte) ([]int, []byte, error) {
 		return nil, nil, err
 	}
 
-	respData, err := json.Marshal(netConfig)
+	return &podNetwork{
+		pnd:        *pnd,
+		csn:        csn,
+		dhcpServer: dhcpServer,
+		doneCh:     doneCh,
+		bootServer: bootServer,
+		pathMTU:    pathMTU,
+	}, netConfig, nil
+}
+
+// findPodNetwork returns the key and the network of the pod with
+// the specified id or, if podId is empty, namespace and name. It
+// returns nil podNetwork if there's no such pod. The caller must
+// hold the lock
+func (s *TapFDSource) findPodNetwork(podId, podNs, podName string) (string, *podNetwork) {
+	if podId != "" {
+		return podId, s.fdMap[podId]
+	}
+	for key, pn := range s.fdMap {
+		if pn.pnd.PodNs == podNs && pn.pnd.PodName == podName {
+			return key, pn
+		}
+	}
+	return "", nil
+}
+
+// bridgeMulticastMode returns the multicast mode for the bridges
+// in the pod network namespace, which is either set for the pod
+// or taken from the node-wide setting
+func bridgeMulticastMode(pnd *PodNetworkDesc) nettools.BridgeMulticastMode {
+	value := pnd.BridgeMulticast
+	if value == "" {
+		value = os.Getenv(bridgeMulticastEnvVar)
+	}
+	mode, err := nettools.ParseBridgeMulticastMode(value)
 	if err != nil {
-		return nil, nil, fmt.Errorf("error marshalling net config: %v", err)
+		glog.Warningf("%v, using %q", err, nettools.BridgeMulticastSnooping)
+		return nettools.BridgeMulticastSnooping
 	}
+	return mode
+}
 
+// reserveMAC verifies that the requested MAC address isn't used by
+// VMs on this node and makes sure that it will not be used by pod
+// networks being set up concurrently until releaseMAC() is called
+func (s *TapFDSource) reserveMAC(key, macAddress string) (net.HardwareAddr, error) {
+	hwAddr, err := utils.ParseLocalMACAddress(macAddress)
+	if err != nil {
+		return nil, fmt.Errorf("bad MAC address: %v", err)
+	}
 	s.Lock()
 	defer s.Unlock()
-	s.fdMap[key] = &podNetwork{
-		pnd:        *pnd,
-		csn:        csn,
-		dhcpServer: dhcpServer,
-		doneCh:     doneCh,
+	if otherKey, found := s.pendingMACs[hwAddr.String()]; found {
+		return nil, fmt.Errorf("MAC address %s is already being used by %q", hwAddr, otherKey)
 	}
-	var fds []int
-	for _, i := range csn.Interfaces {
-		fds = append(fds, int(i.Fo.Fd()))
+	for otherKey, pn := range s.fdMap {
+		if pn.csn == nil {
+			continue
+		}
+		for _, iface := range pn.csn.Interfaces {
+			if bytes.Equal(iface.HardwareAddr, hwAddr) {
+				return nil, fmt.Errorf("MAC address %s is already used by %q", hwAddr, otherKey)
+			}
+		}
 	}
-	return fds, respData, nil
+	s.pendingMACs[hwAddr.String()] = key
+	return hwAddr, nil
+}
+
+// releaseMAC removes MAC address reservation made by reserveMAC().
+// By the time it's called the address is either used by a pod
+// network registered in fdMap or the setup has failed
+func (s *TapFDSource) releaseMAC(hwAddr net.HardwareAddr) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pendingMACs, hwAddr.String())
 }
 
 // Release implements Release method of FDSource interface
@@ -246,6 +767,22 @@ func (s *TapFDSource) Release(key string) error {
 		return fmt.Errorf("bad fd key: %q", key)
 	}
 
+	if err := s.teardownPodNetwork(pn); err != nil {
+		return err
+	}
+
+	delete(s.fdMap, key)
+	if err := os.Remove(QMPSocketPath(key)); err != nil && !os.IsNotExist(err) {
+		glog.Warningf("Error removing QMP socket for %q: %v", key, err)
+	}
+	return nil
+}
+
+func (s *TapFDSource) teardownPodNetwork(pn *podNetwork) error {
+	if pn.pnd.L2Network != "" {
+		return s.teardownL2PodNetwork(pn)
+	}
+
 	netNSPath := cni.PodNetNSPath(pn.pnd.PodId)
 
 	vmNS, err := ns.GetNS(netNSPath)
@@ -258,10 +795,19 @@ func (s *TapFDSource) Release(key string) error {
 	}
 
 	if err := vmNS.Do(func(ns.NetNS) error {
-		if err := pn.dhcpServer.Close(); err != nil {
-			return fmt.Errorf("failed to stop dhcp server: %v", err)
+		stopBootServer(pn)
+		// there's no dhcp server in dry run mode
+		if pn.dhcpServer != nil {
+			if err := pn.dhcpServer.Close(); err != nil {
+				return fmt.Errorf("failed to stop dhcp server: %v", err)
+			}
+			<-pn.doneCh
+		}
+		if pn.pnd.IngressRules != "" {
+			if err := pn.csn.TeardownFirewall(); err != nil {
+				return err
+			}
 		}
-		<-pn.doneCh
 		if err := pn.csn.Teardown(); err != nil {
 			return err
 		}
@@ -270,7 +816,25 @@ func (s *TapFDSource) Release(key string) error {
 		return err
 	}
 
-	if err := s.cniClient.RemoveSandboxFromNetwork(pn.pnd.PodId, pn.pnd.PodName, pn.pnd.PodNs); err != nil {
+	for n := len(pn.extraNetworks) - 1; n >= 0; n-- {
+		en := pn.extraNetworks[n]
+		if err := s.removeFromCNINetwork(pendingCNIDel{
+			PodId:   pn.pnd.PodId,
+			PodName: pn.pnd.PodName,
+			PodNs:   pn.pnd.PodNs,
+			Network: en.network,
+			IfName:  en.ifName,
+		}); err != nil {
+			return fmt.Errorf("error removing pod sandbox %q from CNI network %q: %v", pn.pnd.PodId, en.network, err)
+		}
+	}
+
+	if err := s.removeFromCNINetwork(pendingCNIDel{
+		PodId:       pn.pnd.PodId,
+		PodName:     pn.pnd.PodName,
+		PodNs:       pn.pnd.PodNs,
+		ConfigFiles: pn.pnd.Networks,
+	}); err != nil {
 		return fmt.Errorf("error removing pod sandbox %q from CNI network: %v", pn.pnd.PodId, err)
 	}
 
@@ -278,10 +842,35 @@ func (s *TapFDSource) Release(key string) error {
 		return fmt.Errorf("error when removing network namespace for pod sandbox %q: %v", pn.pnd.PodId, err)
 	}
 
-	delete(s.fdMap, key)
 	return nil
 }
 
+// finishDryRun validates the network configuration, tears down the
+// network and returns the marshalled NetworkCheckReport
+func (s *TapFDSource) finishDryRun(pn *podNetwork) ([]int, []byte, error) {
+	report := NewNetworkCheckReport(pn.csn)
+	report.addPathMTUReports(pn.pathMTU)
+	if err := s.teardownPodNetwork(pn); err != nil {
+		return nil, nil, fmt.Errorf("error tearing down the network after the dry run: %v", err)
+	}
+	respData, err := json.Marshal(report)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error marshalling network check report: %v", err)
+	}
+	return nil, respData, nil
+}
+
+func announceAddresses(pn *podNetwork) error {
+	netNSPath := cni.PodNetNSPath(pn.pnd.PodId)
+	vmNS, err := ns.GetNS(netNSPath)
+	if err != nil {
+		return fmt.Errorf("failed to open network namespace at %q: %v", netNSPath, err)
+	}
+	return vmNS.Do(func(ns.NetNS) error {
+		return pn.csn.AnnounceAddresses()
+	})
+}
+
 // GetInfo implements GetInfo method of FDSource interface
 func (s *TapFDSource) GetInfo(key string) ([]byte, error) {
 	s.Lock()
@@ -290,18 +879,59 @@ func (s *TapFDSource) GetInfo(key string) ([]byte, error) {
 	if !found {
 		return nil, fmt.Errorf("bad fd key: %q", key)
 	}
-	var descriptions []InterfaceDescription
-	for i, iface := range pn.csn.Interfaces {
-		descriptions = append(descriptions, InterfaceDescription{
-			FdIndex:      i,
-			HardwareAddr: iface.HardwareAddr,
-			Type:         iface.Type,
-			PCIAddress:   iface.PCIAddress,
-		})
+	if pn.vmStartCount > 0 {
+		glog.V(1).Infof("Reusing the network of pod %s (%s) for VM restart #%d", pn.pnd.PodName, pn.pnd.PodId, pn.vmStartCount)
+		// the VM may have been down for a while, so remind
+		// the network where it is
+		if err := announceAddresses(pn); err != nil {
+			glog.Warningf("Failed to announce VM addresses for pod %s (%s): %v", pn.pnd.PodName, pn.pnd.PodId, err)
+		}
 	}
-	data, err := json.Marshal(descriptions)
-	if err != nil {
-		return nil, fmt.Errorf("interface descriptions marshaling error: %v", err)
+	pn.vmStartCount++
+	pn.vmRunning = true
+	// the ids will be reported again by the new VM process
+	pn.netdevs = nil
+	return marshalInterfaceInfo(pn.csn, nil)
+}
+
+// QueryInfo implements QueryInfo method of FDSource interface
+func (s *TapFDSource) QueryInfo(key string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	pn, found := s.fdMap[key]
+	if !found {
+		return nil, fmt.Errorf("bad fd key: %q", key)
+	}
+	return marshalInterfaceInfo(pn.csn, pn.netdevs)
+}
+
+// Report implements Report method of FDSource interface.
+// It expects a JSON-marshalled NetdevReport
+func (s *TapFDSource) Report(key string, data []byte) error {
+	var report NetdevReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return fmt.Errorf("error unmarshalling netdev report: %v", err)
+	}
+	if report.HotplugVia != "" {
+		return s.adoptVM(key, report.HotplugVia)
+	}
+	if report.VMStopped {
+		return s.vmStopped(key)
+	}
+	s.Lock()
+	defer s.Unlock()
+	pn, found := s.fdMap[key]
+	if !found {
+		return fmt.Errorf("bad fd key: %q", key)
 	}
-	return data, nil
+	for _, netdev := range report.Netdevs {
+		if netdev.FdIndex < 0 || netdev.FdIndex >= len(pn.csn.Interfaces) {
+			return fmt.Errorf("bad fd index in the netdev report: %d", netdev.FdIndex)
+		}
+	}
+	if pn.pnd.Debug || bool(glog.V(3)) {
+		glog.Infof("QEMU netdevs for pod %s (%s): %s", pn.pnd.PodName, pn.pnd.PodId, data)
+	}
+	pn.netdevs = report.Netdevs
+	return nil
 }
@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tapmanager
+
+import (
+	"testing"
+
+	"github.com/Mirantis/virtlet/pkg/nettools"
+)
+
+func TestReserveMAC(t *testing.T) {
+	src, err := NewTapFDSource(nil)
+	if err != nil {
+		t.Fatalf("NewTapFDSource(): %v", err)
+	}
+	src.fdMap["running-pod"] = &podNetwork{
+		pnd: PodNetworkDesc{PodId: "running-pod", PodNs: "default", PodName: "vm1"},
+		csn: &nettools.ContainerSideNetwork{
+			Interfaces: []nettools.InterfaceDescription{
+				{
+					Type:         nettools.InterfaceTypeTap,
+					Name:         "eth0",
+					HardwareAddr: mustParseMAC("42:a4:a6:22:80:2e"),
+				},
+			},
+		},
+	}
+	// the pod network that's not set up yet
+	src.fdMap["new-pod"] = &podNetwork{
+		pnd: PodNetworkDesc{PodId: "new-pod", PodNs: "default", PodName: "vm2"},
+	}
+
+	reserve := func(key, mac string, expectError bool) {
+		hwAddr, err := src.reserveMAC(key, mac)
+		switch {
+		case expectError && err == nil:
+			t.Errorf("reserveMAC() didn't fail for %q with MAC address %s", key, mac)
+		case !expectError && err != nil:
+			t.Errorf("reserveMAC() failed for %q with MAC address %s: %v", key, mac, err)
+		case !expectError && hwAddr.String() != mac:
+			t.Errorf("bad hardware address %s instead of %s", hwAddr, mac)
+		}
+	}
+
+	// vendor-assigned address
+	reserve("pod1", "00:16:3e:12:34:56", true)
+	// used by the VM of another pod
+	reserve("pod1", "42:a4:a6:22:80:2e", true)
+	// the case of the hex digits doesn't matter
+	reserve("pod1", "42:A4:A6:22:80:2E", true)
+
+	reserve("pod1", "02:65:02:12:34:56", false)
+	// the address is being used by a pod network
+	// that's being set up concurrently
+	reserve("pod2", "02:65:02:12:34:56", true)
+	reserve("pod2", "02:65:02:12:34:57", false)
+
+	src.releaseMAC(mustParseMAC("02:65:02:12:34:56"))
+	reserve("pod3", "02:65:02:12:34:56", false)
+	if len(src.pendingMACs) != 2 {
+		t.Errorf("bad pending MAC list: %v", src.pendingMACs)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+	// line numbers in a and b (1-based) before this op
+	aLine, bLine int
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffOps returns the edit script for turning a into b based
+// on the longest common subsequence of the lines
+func diffOps(a, b []string) []diffOp {
+	// lcs[i][j] is the length of LCS of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i], i + 1, j + 1})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i], i + 1, j + 1})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j], i + 1, j + 1})
+			j++
+		}
+	}
+	return ops
+}
+
+// DiffLines returns the difference between a and b in unified diff
+// format with the specified number of context lines, without file
+// headers. Empty string is returned if a and b are the same
+func DiffLines(a, b string, context int) string {
+	ops := diffOps(splitLines(a), splitLines(b))
+
+	var out []string
+	for start := 0; start < len(ops); {
+		if ops[start].kind == ' ' {
+			start++
+			continue
+		}
+		// extend the hunk while the changes are
+		// separated by at most 2*context lines
+		hunkStart := start - context
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		end := start
+		for n := start; n < len(ops) && n-end <= 2*context; n++ {
+			if ops[n].kind != ' ' {
+				end = n
+			}
+		}
+		hunkEnd := end + context + 1
+		if hunkEnd > len(ops) {
+			hunkEnd = len(ops)
+		}
+
+		aCount, bCount := 0, 0
+		var lines []string
+		for _, op := range ops[hunkStart:hunkEnd] {
+			if op.kind != '+' {
+				aCount++
+			}
+			if op.kind != '-' {
+				bCount++
+			}
+			lines = append(lines, string(op.kind)+op.line)
+		}
+		aStart, bStart := ops[hunkStart].aLine, ops[hunkStart].bLine
+		if aCount == 0 {
+			aStart--
+		}
+		if bCount == 0 {
+			bStart--
+		}
+		out = append(out, fmt.Sprintf("@@ -%d,%d +%d,%d @@", aStart, aCount, bStart, bCount))
+		out = append(out, lines...)
+		start = hunkEnd
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	return strings.Join(out, "\n") + "\n"
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import "testing"
+
+func TestDiffLines(t *testing.T) {
+	for _, tc := range []struct {
+		name, a, b, diff string
+	}{
+		{
+			name: "same",
+			a:    "a\nb\nc\n",
+			b:    "a\nb\nc\n",
+			diff: "",
+		},
+		{
+			name: "changed line",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			diff: "@@ -3,5 +3,5 @@\n 3\n 4\n-5\n+five\n 6\n 7\n",
+		},
+		{
+			name: "added lines",
+			a:    "1\n2\n3\n",
+			b:    "1\n2\nx\ny\n3\n",
+			diff: "@@ -1,3 +1,5 @@\n 1\n 2\n+x\n+y\n 3\n",
+		},
+		{
+			name: "removed line at the end",
+			a:    "1\n2\n3\n4\n5\n",
+			b:    "1\n2\n3\n4\n",
+			diff: "@@ -3,3 +3,2 @@\n 3\n 4\n-5\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			b:    "one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n",
+			diff: "@@ -1,3 +1,3 @@\n-1\n+one\n 2\n 3\n@@ -8,3 +8,3 @@\n 8\n 9\n-10\n+ten\n",
+		},
+		{
+			name: "from empty",
+			a:    "",
+			b:    "1\n2\n",
+			diff: "@@ -0,0 +1,2 @@\n+1\n+2\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			diff := DiffLines(tc.a, tc.b, 2)
+			if diff != tc.diff {
+				t.Errorf("bad diff:\n%s\ninstead of\n%s", diff, tc.diff)
+			}
+		})
+	}
+}
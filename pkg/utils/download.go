@@ -26,10 +26,12 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/juju/ratelimit"
 )
 
 // Endpoint contains all the endpoint parameters needed to download a file
@@ -51,6 +53,18 @@ type Endpoint struct {
 
 	// Transport profile name for this endpoint. Provided for logging/debugging
 	ProfileName string
+
+	// Arch is the architecture of the image using GOARCH notation
+	// (e.g. amd64 or arm64). Empty string means the node architecture
+	Arch string
+
+	// MachineType is the QEMU machine type to use for the VMs
+	// that are based on the image. Empty string means the default one
+	MachineType string
+
+	// Emulator is the path to the emulator binary to use for the VMs
+	// that are based on the image. Empty string means the default one
+	Emulator string
 }
 
 // TLSConfig has the TLS transport parameters
@@ -82,6 +96,7 @@ type Downloader interface {
 
 type defaultDownloader struct {
 	protocol string
+	settings []DownloadSettings
 }
 
 // NewDownloader returns the default downloader for 'protocol'.
@@ -89,7 +104,14 @@ type defaultDownloader struct {
 // 'protocol://location' and saves it in temporary file in default
 // system directory for temporary files
 func NewDownloader(protocol string) Downloader {
-	return &defaultDownloader{protocol}
+	return &defaultDownloader{protocol: protocol}
+}
+
+// NewDownloaderWithSettings returns the default downloader for
+// 'protocol' that applies the download settings with the longest
+// prefix matching the URL of each downloaded file
+func NewDownloaderWithSettings(protocol string, settings []DownloadSettings) Downloader {
+	return &defaultDownloader{protocol: protocol, settings: settings}
 }
 
 func buildTLSConfig(config *TLSConfig, profileName string) (*tls.Config, error) {
@@ -174,16 +196,70 @@ func createHttpClient(endpoint Endpoint) (*http.Client, error) {
 	}, nil
 }
 
+// NewHTTPClient returns an HTTP client that uses the proxy,
+// TLS and timeout settings of the endpoint
+func NewHTTPClient(endpoint Endpoint) (*http.Client, error) {
+	return createHttpClient(endpoint)
+}
+
+type httpStatusError struct {
+	url        string
+	statusCode int
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("error downloading %s: HTTP status %d", e.url, e.statusCode)
+}
+
+// isRetryableDownloadError returns false for the HTTP errors
+// that aren't likely to go away when the download is retried
+func isRetryableDownloadError(err error) bool {
+	if statusErr, ok := err.(httpStatusError); ok {
+		return statusErr.statusCode >= 500 || statusErr.statusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
 func (d *defaultDownloader) DownloadFile(endpoint Endpoint) (string, error) {
 	url := endpoint.Url
 	if !strings.Contains(url, "://") {
 		url = fmt.Sprintf("%s://%s", d.protocol, url)
 	}
 
+	settings := findDownloadSettings(d.settings, url)
+	if settings == nil {
+		settings = &DownloadSettings{}
+	} else {
+		glog.V(3).Infof("Using download settings for prefix %q for %s", settings.Prefix, url)
+	}
+	if endpoint.Proxy == "" {
+		endpoint.Proxy = settings.Proxy
+	}
+	if endpoint.Timeout <= 0 {
+		endpoint.Timeout = time.Duration(settings.TimeoutMilliseconds) * time.Millisecond
+	}
+
 	client, err := createHttpClient(endpoint)
 	if err != nil {
 		return "", err
 	}
+
+	retryDelay := settings.retryDelay()
+	for attempt := 0; ; attempt++ {
+		path, err := downloadToTempFile(client, url, settings.MaxBytesPerSecond)
+		if err == nil {
+			return path, nil
+		}
+		if attempt >= settings.Retries || !isRetryableDownloadError(err) {
+			return "", err
+		}
+		glog.Warningf("Download attempt %d of %d for %s failed, retrying in %v: %v", attempt+1, settings.Retries+1, url, retryDelay, err)
+		time.Sleep(retryDelay)
+		retryDelay *= 2
+	}
+}
+
+func downloadToTempFile(client *http.Client, url string, maxBytesPerSecond int64) (string, error) {
 	tempFile, err := ioutil.TempFile("", "virtlet_")
 	if err != nil {
 		return "", err
@@ -192,16 +268,29 @@ func (d *defaultDownloader) DownloadFile(endpoint Endpoint) (string, error) {
 
 	glog.V(2).Infof("Start downloading %s", url)
 
+	if err := downloadTo(tempFile, client, url, maxBytesPerSecond); err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	glog.V(2).Infof("Data from url %s saved in %s", url, tempFile.Name())
+	return tempFile.Name(), nil
+}
+
+func downloadTo(w io.Writer, client *http.Client, url string, maxBytesPerSecond int64) error {
 	resp, err := client.Get(url)
 	if err != nil {
-		return "", err
+		return err
 	}
 	defer resp.Body.Close()
 
-	_, err = io.Copy(tempFile, resp.Body)
-	if err != nil {
-		return "", err
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return httpStatusError{url: url, statusCode: resp.StatusCode}
 	}
-	glog.V(2).Infof("Data from url %s saved in %s", url, tempFile.Name())
-	return tempFile.Name(), nil
+
+	var r io.Reader = resp.Body
+	if maxBytesPerSecond > 0 {
+		r = ratelimit.Reader(r, ratelimit.NewBucketWithRate(float64(maxBytesPerSecond), maxBytesPerSecond))
+	}
+	_, err = io.Copy(w, r)
+	return err
 }
@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// DownloadSettings contains the download parameters for the URLs
+// that start with the specified prefix
+type DownloadSettings struct {
+	// Prefix is the URL prefix, e.g. https://images.example.com/.
+	// Empty prefix matches any URL
+	Prefix string `json:"prefix,omitempty"`
+
+	// Proxy is the HTTP(S) proxy server to use. It's only used
+	// if the image translation transport profile doesn't specify one
+	Proxy string `json:"proxy,omitempty"`
+
+	// MaxBytesPerSecond limits the download bandwidth. <= 0 means no limit (default)
+	MaxBytesPerSecond int64 `json:"maxBytesPerSecond,omitempty"`
+
+	// Retries is the number of times a failed download is retried
+	Retries int `json:"retries,omitempty"`
+
+	// RetryDelayMilliseconds is the delay before the first retry, it's doubled
+	// for each subsequent one. The default is 1000
+	RetryDelayMilliseconds int `json:"retryDelay,omitempty"`
+
+	// TimeoutMilliseconds specifies a time limit in milliseconds for a single download
+	// attempt. It's only used if the image translation transport profile doesn't
+	// specify one. <= 0 is no timeout (default)
+	TimeoutMilliseconds int `json:"timeout,omitempty"`
+}
+
+const defaultRetryDelay = time.Second
+
+func (s *DownloadSettings) retryDelay() time.Duration {
+	if s.RetryDelayMilliseconds <= 0 {
+		return defaultRetryDelay
+	}
+	return time.Duration(s.RetryDelayMilliseconds) * time.Millisecond
+}
+
+func (s *DownloadSettings) validate() error {
+	if s.Proxy != "" {
+		if _, err := url.Parse(s.Proxy); err != nil {
+			return fmt.Errorf("bad proxy url %q for prefix %q: %v", s.Proxy, s.Prefix, err)
+		}
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("negative retry count for prefix %q", s.Prefix)
+	}
+	return nil
+}
+
+// ParseDownloadSettings parses a yaml list of download settings
+func ParseDownloadSettings(data []byte) ([]DownloadSettings, error) {
+	var settings []DownloadSettings
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("error parsing download settings: %v", err)
+	}
+	for n := range settings {
+		if err := settings[n].validate(); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// LoadDownloadSettings loads download settings from the specified yaml file
+func LoadDownloadSettings(path string) ([]DownloadSettings, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading download settings: %v", err)
+	}
+	return ParseDownloadSettings(data)
+}
+
+// findDownloadSettings returns the settings with the longest prefix
+// matching the url or nil if there are no such settings
+func findDownloadSettings(settings []DownloadSettings, url string) *DownloadSettings {
+	var r *DownloadSettings
+	for n, s := range settings {
+		if strings.HasPrefix(url, s.Prefix) && (r == nil || len(s.Prefix) > len(r.Prefix)) {
+			r = &settings[n]
+		}
+	}
+	return r
+}
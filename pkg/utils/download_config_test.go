@@ -0,0 +1,114 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestDownloadSettings(t *testing.T) {
+	settings, err := ParseDownloadSettings([]byte(`
+- proxy: http://proxy.example.com:3128
+- prefix: https://images.example.com/
+  maxBytesPerSecond: 1048576
+  retries: 3
+- prefix: https://images.example.com/local/
+  retries: 1
+  retryDelay: 100
+  timeout: 60000
+`))
+	if err != nil {
+		t.Fatalf("ParseDownloadSettings(): %v", err)
+	}
+	for _, tc := range []struct {
+		url, prefix string
+	}{
+		{"https://example.com/foo.img", ""},
+		{"https://images.example.com/foo.img", "https://images.example.com/"},
+		{"https://images.example.com/local/foo.img", "https://images.example.com/local/"},
+	} {
+		s := findDownloadSettings(settings, tc.url)
+		if s == nil {
+			t.Errorf("no settings found for %q", tc.url)
+		} else if s.Prefix != tc.prefix {
+			t.Errorf("bad settings prefix for %q: %q instead of %q", tc.url, s.Prefix, tc.prefix)
+		}
+	}
+	if s := findDownloadSettings(settings[1:], "http://example.com/foo.img"); s != nil {
+		t.Errorf("unexpected settings for prefix %q", s.Prefix)
+	}
+
+	if _, err := ParseDownloadSettings([]byte("- prefix: http://example.com/\n  retries: -1\n")); err == nil {
+		t.Errorf("negative retry count not rejected")
+	}
+}
+
+func TestDownloadRetries(t *testing.T) {
+	var m sync.Mutex
+	count := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		defer m.Unlock()
+		count++
+		switch {
+		case r.URL.Path == "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		case count < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("foobar"))
+		}
+	}))
+	defer ts.Close()
+
+	downloader := NewDownloaderWithSettings("http", []DownloadSettings{
+		{
+			Prefix:                 ts.URL,
+			Retries:                2,
+			RetryDelayMilliseconds: 1,
+			MaxBytesPerSecond:      1048576,
+		},
+	})
+	path, err := downloader.DownloadFile(Endpoint{Url: ts.URL + "/image", MaxRedirects: -1})
+	if err != nil {
+		t.Fatalf("DownloadFile(): %v", err)
+	}
+	defer os.Remove(path)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile(): %v", err)
+	}
+	if string(content) != "foobar" {
+		t.Errorf("bad file content %q", content)
+	}
+	if count != 3 {
+		t.Errorf("bad request count %d instead of 3", count)
+	}
+
+	count = 0
+	if _, err := downloader.DownloadFile(Endpoint{Url: ts.URL + "/missing", MaxRedirects: -1}); err == nil {
+		t.Errorf("DownloadFile() didn't fail for a missing file")
+	}
+	if count != 1 {
+		t.Errorf("a download that failed with 404 was retried")
+	}
+}
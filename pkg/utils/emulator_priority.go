@@ -0,0 +1,155 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// EmulatorNiceEnvVar specifies the nice value of the emulator
+	// processes
+	EmulatorNiceEnvVar = "VIRTLET_EMULATOR_NICE"
+	// EmulatorIOPrioEnvVar specifies the I/O scheduling class and
+	// priority of the emulator processes, e.g. "best-effort:4",
+	// "realtime:0" or "idle"
+	EmulatorIOPrioEnvVar = "VIRTLET_EMULATOR_IOPRIO"
+	// EmulatorSchedEnvVar specifies the CPU scheduling policy and
+	// priority of the emulator processes, e.g. "fifo:10",
+	// "rr:10", "batch" or "other"
+	EmulatorSchedEnvVar = "VIRTLET_EMULATOR_SCHED"
+)
+
+const (
+	ioprioClassRT   = 1
+	ioprioClassBE   = 2
+	ioprioClassIdle = 3
+	ioprioMaxLevel  = 7
+
+	schedOther = 0
+	schedFIFO  = 1
+	schedRR    = 2
+	schedBatch = 3
+	schedIdle  = 5
+	// the range of the priorities of the realtime policies
+	schedMinRTPriority = 1
+	schedMaxRTPriority = 99
+)
+
+var ioprioClasses = map[string]int{
+	"realtime":    ioprioClassRT,
+	"best-effort": ioprioClassBE,
+	"idle":        ioprioClassIdle,
+}
+
+var schedPolicies = map[string]int{
+	"other": schedOther,
+	"fifo":  schedFIFO,
+	"rr":    schedRR,
+	"batch": schedBatch,
+	"idle":  schedIdle,
+}
+
+// EmulatorPriority holds the scheduling settings of the emulator
+// process. They're applied by vmwrapper before it execs the
+// emulator, so all of the emulator threads inherit them
+type EmulatorPriority struct {
+	// Nice is the nice value, nil if it must not be changed
+	Nice *int
+	// IOPrio is the I/O priority value for ioprio_set(2),
+	// 0 if it must not be changed
+	IOPrio int
+	// SchedPolicy is the CPU scheduling policy, -1 if it
+	// must not be changed
+	SchedPolicy int
+	// SchedPriority is the static scheduling priority for
+	// the realtime policies
+	SchedPriority int
+}
+
+// IsEmpty returns true if the settings don't change anything
+func (p *EmulatorPriority) IsEmpty() bool {
+	return p.Nice == nil && p.IOPrio == 0 && p.SchedPolicy < 0
+}
+
+// splitPriority splits the class/policy name and the optional
+// numeric level/priority separated by a colon
+func splitPriority(s string) (string, int, bool, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], 0, false, nil
+	}
+	n, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, false, fmt.Errorf("bad priority %q", parts[1])
+	}
+	return parts[0], n, true, nil
+}
+
+// ParseEmulatorPriority parses the nice value, the I/O priority and
+// the CPU scheduling policy of the emulator. Empty strings leave the
+// corresponding settings unchanged
+func ParseEmulatorPriority(nice, ioprio, sched string) (*EmulatorPriority, error) {
+	p := &EmulatorPriority{SchedPolicy: -1}
+	if nice != "" {
+		n, err := strconv.Atoi(nice)
+		if err != nil || n < -20 || n > 19 {
+			return nil, fmt.Errorf("bad emulator nice value %q (must be between -20 and 19)", nice)
+		}
+		p.Nice = &n
+	}
+
+	if ioprio != "" {
+		className, level, hasLevel, err := splitPriority(ioprio)
+		if err != nil {
+			return nil, fmt.Errorf("bad emulator I/O priority %q: %v", ioprio, err)
+		}
+		class, found := ioprioClasses[className]
+		switch {
+		case !found:
+			return nil, fmt.Errorf("bad emulator I/O scheduling class %q (must be 'realtime', 'best-effort' or 'idle')", className)
+		case class == ioprioClassIdle && hasLevel:
+			return nil, fmt.Errorf("emulator I/O priority can't be specified for 'idle' class")
+		case level < 0 || level > ioprioMaxLevel:
+			return nil, fmt.Errorf("bad emulator I/O priority %d (must be between 0 and %d)", level, ioprioMaxLevel)
+		}
+		p.IOPrio = class<<13 | level
+	}
+
+	if sched != "" {
+		policyName, priority, hasPriority, err := splitPriority(sched)
+		if err != nil {
+			return nil, fmt.Errorf("bad emulator scheduling policy %q: %v", sched, err)
+		}
+		policy, found := schedPolicies[policyName]
+		realtime := policy == schedFIFO || policy == schedRR
+		switch {
+		case !found:
+			return nil, fmt.Errorf("bad emulator scheduling policy %q (must be 'other', 'batch', 'idle', 'fifo' or 'rr')", policyName)
+		case realtime && (priority < schedMinRTPriority || priority > schedMaxRTPriority):
+			return nil, fmt.Errorf("emulator scheduling priority for %q policy must be between %d and %d", policyName, schedMinRTPriority, schedMaxRTPriority)
+		case !realtime && hasPriority:
+			return nil, fmt.Errorf("emulator scheduling priority can't be specified for %q policy", policyName)
+		}
+		p.SchedPolicy = policy
+		p.SchedPriority = priority
+	}
+
+	return p, nil
+}
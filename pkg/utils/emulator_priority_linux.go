@@ -0,0 +1,52 @@
+// +build linux
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const ioprioWhoProcess = 1
+
+// Apply applies the settings to the calling thread. As the settings
+// are per-thread on Linux, the caller must lock the goroutine to its
+// thread using runtime.LockOSThread() and exec the emulator from
+// the same goroutine, so the emulator inherits them
+func (p *EmulatorPriority) Apply() error {
+	if p.Nice != nil {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, *p.Nice); err != nil {
+			return fmt.Errorf("can't set nice value %d: %v", *p.Nice, err)
+		}
+	}
+	if p.IOPrio != 0 {
+		if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, uintptr(p.IOPrio)); errno != 0 {
+			return fmt.Errorf("can't set I/O priority: %v", errno)
+		}
+	}
+	if p.SchedPolicy >= 0 {
+		param := struct{ priority int32 }{int32(p.SchedPriority)}
+		if _, _, errno := unix.Syscall(unix.SYS_SCHED_SETSCHEDULER, 0, uintptr(p.SchedPolicy), uintptr(unsafe.Pointer(&param))); errno != 0 {
+			return fmt.Errorf("can't set scheduling policy: %v", errno)
+		}
+	}
+	return nil
+}
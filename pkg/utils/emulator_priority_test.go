@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEmulatorPriority(t *testing.T) {
+	nice := 5
+	for _, tc := range []struct {
+		name     string
+		nice     string
+		ioprio   string
+		sched    string
+		expected *EmulatorPriority
+	}{
+		{
+			name:     "empty",
+			expected: &EmulatorPriority{SchedPolicy: -1},
+		},
+		{
+			name:     "nice",
+			nice:     "5",
+			expected: &EmulatorPriority{Nice: &nice, SchedPolicy: -1},
+		},
+		{
+			name:     "best-effort ioprio",
+			ioprio:   "best-effort:2",
+			expected: &EmulatorPriority{IOPrio: 2<<13 | 2, SchedPolicy: -1},
+		},
+		{
+			name:     "idle ioprio",
+			ioprio:   "idle",
+			expected: &EmulatorPriority{IOPrio: 3 << 13, SchedPolicy: -1},
+		},
+		{
+			name:     "fifo",
+			sched:    "fifo:10",
+			expected: &EmulatorPriority{SchedPolicy: 1, SchedPriority: 10},
+		},
+		{
+			name:     "batch",
+			sched:    "batch",
+			expected: &EmulatorPriority{SchedPolicy: 3},
+		},
+		{name: "bad nice", nice: "-21"},
+		{name: "bad ioprio class", ioprio: "foo:1"},
+		{name: "bad ioprio level", ioprio: "best-effort:8"},
+		{name: "idle ioprio with level", ioprio: "idle:1"},
+		{name: "bad sched policy", sched: "foo"},
+		{name: "realtime policy without priority", sched: "rr"},
+		{name: "bad priority", sched: "fifo:x"},
+		{name: "non-realtime policy with priority", sched: "other:1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := ParseEmulatorPriority(tc.nice, tc.ioprio, tc.sched)
+			switch {
+			case tc.expected == nil && err == nil:
+				t.Errorf("ParseEmulatorPriority() didn't fail")
+			case tc.expected != nil && err != nil:
+				t.Errorf("ParseEmulatorPriority(): %v", err)
+			case !reflect.DeepEqual(p, tc.expected):
+				t.Errorf("bad result: %#v instead of %#v", p, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"net"
+)
+
+// ParseLocalMACAddress parses the specified string as 48-bit
+// MAC address and verifies that it's a locally administered
+// unicast address, so it can't clash with vendor-assigned ones
+func ParseLocalMACAddress(s string) (net.HardwareAddr, error) {
+	hwAddr, err := net.ParseMAC(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(hwAddr) != 6 {
+		return nil, fmt.Errorf("%q is not a 48-bit MAC address", s)
+	}
+	if hwAddr[0]&1 != 0 {
+		return nil, fmt.Errorf("%q is a multicast MAC address", s)
+	}
+	if hwAddr[0]&2 == 0 {
+		return nil, fmt.Errorf("%q is not a locally administered MAC address", s)
+	}
+	return hwAddr, nil
+}
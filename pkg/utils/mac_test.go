@@ -0,0 +1,49 @@
+/*
+Copyright 2017 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import "testing"
+
+func TestParseLocalMACAddress(t *testing.T) {
+	tests := []struct {
+		str   string
+		valid bool
+	}{
+		{"02:65:02:12:34:56", true},
+		{"42:a4:a6:22:80:2e", true},
+		{"0A-00-27-00-00-01", true},
+		// vendor-assigned
+		{"00:16:3e:12:34:56", false},
+		// multicast
+		{"03:00:00:00:00:01", false},
+		// too long
+		{"02:00:5e:10:00:00:00:01", false},
+		{"", false},
+		{"foobar", false},
+	}
+	for _, test := range tests {
+		hwAddr, err := ParseLocalMACAddress(test.str)
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("unexpected error parsing %q: %v", test.str, err)
+		case test.valid && hwAddr == nil:
+			t.Errorf("no address returned for %q", test.str)
+		case !test.valid && err == nil:
+			t.Errorf("%q didn't cause an error", test.str)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SandboxLimits specifies the restrictions for the helper
+// processes that handle untrusted data, such as qemu-img
+// working on the downloaded images. Zero values mean
+// no limit
+type SandboxLimits struct {
+	// Timeout is the wall clock time limit for the process
+	Timeout time.Duration
+	// CPUSeconds is the CPU time limit for the process
+	CPUSeconds uint64
+	// MemoryBytes limits the address space of the process
+	MemoryBytes uint64
+}
+
+var (
+	// QemuImgLimits are the limits for qemu-img commands
+	QemuImgLimits = SandboxLimits{
+		Timeout:     time.Hour,
+		CPUSeconds:  3600,
+		MemoryBytes: 2 << 30,
+	}
+	// ImageBuilderLimits are the limits for the tools that
+	// make disk images, such as virt-make-fs, which run VMs
+	// of their own and thus can't have their memory limited
+	ImageBuilderLimits = SandboxLimits{
+		Timeout:    time.Hour,
+		CPUSeconds: 3600,
+	}
+)
+
+// RunSandboxed runs the command in a separate process with the
+// specified resource limits and without network access and returns
+// its combined stdout and stderr. The process and its children are
+// killed if the command doesn't finish before the timeout
+func RunSandboxed(limits SandboxLimits, name string, args ...string) ([]byte, error) {
+	cmdArgs := []string{"--core=0"}
+	if limits.CPUSeconds != 0 {
+		cmdArgs = append(cmdArgs, "--cpu="+strconv.FormatUint(limits.CPUSeconds, 10))
+	}
+	if limits.MemoryBytes != 0 {
+		cmdArgs = append(cmdArgs, "--as="+strconv.FormatUint(limits.MemoryBytes, 10))
+	}
+	cmdArgs = append(cmdArgs, "--", name)
+	cmdArgs = append(cmdArgs, args...)
+	cmd := exec.Command("prlimit", cmdArgs...)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	isolateProcess(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting %s: %v", name, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timeout <-chan time.Time
+	if limits.Timeout != 0 {
+		timer := time.NewTimer(limits.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return out.Bytes(), fmt.Errorf("%s %s: %v", name, strings.Join(args, " "), err)
+		}
+		return out.Bytes(), nil
+	case <-timeout:
+		killProcessGroup(cmd)
+		<-done
+		return out.Bytes(), fmt.Errorf("%s %s: timed out after %v", name, strings.Join(args, " "), limits.Timeout)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunSandboxed(t *testing.T) {
+	out, err := RunSandboxed(SandboxLimits{Timeout: 10 * time.Second}, "sh", "-c", "echo foo; echo bar >&2")
+	if err != nil {
+		t.Fatalf("RunSandboxed(): %v", err)
+	}
+	if string(out) != "foo\nbar\n" {
+		t.Errorf("bad output %q", out)
+	}
+
+	if _, err := RunSandboxed(SandboxLimits{}, "sh", "-c", "exit 1"); err == nil {
+		t.Errorf("RunSandboxed() didn't fail for a failing command")
+	}
+}
+
+func TestRunSandboxedTimeout(t *testing.T) {
+	start := time.Now()
+	_, err := RunSandboxed(SandboxLimits{Timeout: 100 * time.Millisecond}, "sh", "-c", "sleep 30 & sleep 30")
+	switch {
+	case err == nil:
+		t.Errorf("RunSandboxed() didn't fail")
+	case !strings.Contains(err.Error(), "timed out"):
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("the command wasn't killed upon the timeout, took %v", d)
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"net"
+	"os"
+)
+
+// ListenUnix listens on the unix socket at path. Unlike the listener
+// returned by net.ListenUnix, the returned one doesn't remove the
+// socket file when it's closed, as by that time the file may belong
+// to another process, e.g. to the new Virtlet that has started while
+// the old one is shutting down. Use RemoveSocket() with the returned
+// FileInfo instead
+func ListenUnix(path string) (*net.UnixListener, os.FileInfo, error) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	l.SetUnlinkOnClose(false)
+	fi, err := os.Stat(path)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+	return l, fi, nil
+}
+
+// RemoveSocket removes the socket file at path if it's the same file
+// as the one described by fi, i.e. it wasn't replaced by another
+// process since it was created
+func RemoveSocket(path string, fi os.FileInfo) error {
+	cur, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case !os.SameFile(fi, cur):
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
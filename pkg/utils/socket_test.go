@@ -0,0 +1,70 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveSocket(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "socket-test")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	socketPath := filepath.Join(tmpDir, "test.sock")
+	l, fi, err := ListenUnix(socketPath)
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	l.Close()
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Fatalf("the socket is removed upon Close(): %v", err)
+	}
+
+	// another process takes over the socket path. The old socket
+	// file is moved aside instead of being removed so that its inode
+	// can't be reused for the new socket
+	if err := os.Rename(socketPath, socketPath+".old"); err != nil {
+		t.Fatalf("Rename(): %v", err)
+	}
+	newListener, newFi, err := ListenUnix(socketPath)
+	if err != nil {
+		t.Fatalf("ListenUnix(): %v", err)
+	}
+	defer newListener.Close()
+	if err := RemoveSocket(socketPath, fi); err != nil {
+		t.Fatalf("RemoveSocket(): %v", err)
+	}
+	if _, err := os.Stat(socketPath); err != nil {
+		t.Errorf("the socket of another listener was removed: %v", err)
+	}
+
+	if err := RemoveSocket(socketPath, newFi); err != nil {
+		t.Fatalf("RemoveSocket(): %v", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("the socket was not removed")
+	}
+	if err := RemoveSocket(socketPath, newFi); err != nil {
+		t.Errorf("RemoveSocket() failed for a missing socket: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// DisableVhostNetEnvVar makes Virtlet use plain tap netdevs
+// without vhost-net acceleration for the VMs
+const DisableVhostNetEnvVar = "VIRTLET_DISABLE_VHOST_NET"
+
+// VhostNetDevicePath is the path to vhost-net device.
+// It's a var so it can be overridden in tests
+var VhostNetDevicePath = "/dev/vhost-net"
+
+// OpenVhostNet opens vhost-net device for a tap netdev and returns
+// its file descriptor. The file descriptor is not closed on exec,
+// so it can be passed to the emulator. It returns an error if
+// vhost-net acceleration is disabled or the device can't be opened,
+// e.g. because vhost_net kernel module is not loaded on the node
+func OpenVhostNet() (int, error) {
+	if os.Getenv(DisableVhostNetEnvVar) != "" {
+		return -1, errors.New("vhost-net is disabled")
+	}
+	fd, err := syscall.Open(VhostNetDevicePath, syscall.O_RDWR, 0)
+	if err != nil {
+		return -1, &os.PathError{Op: "open", Path: VhostNetDevicePath, Err: err}
+	}
+	return fd, nil
+}
+
+// VhostNetAvailable returns true if vhost-net acceleration can be
+// used for the tap interfaces of the VMs, that is, it's not disabled
+// and vhost-net device can be opened. If it's not available, the
+// VMs use plain tap netdevs
+func VhostNetAvailable() bool {
+	fd, err := OpenVhostNet()
+	if err != nil {
+		return false
+	}
+	syscall.Close(fd)
+	return true
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestVhostNet(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "vhost-net")
+	if err != nil {
+		t.Fatalf("Can't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	fakeDevicePath := filepath.Join(tmpDir, "vhost-net")
+	if err := ioutil.WriteFile(fakeDevicePath, nil, 0600); err != nil {
+		t.Fatalf("Can't create fake vhost-net device: %v", err)
+	}
+	origDevicePath := VhostNetDevicePath
+	defer func() {
+		VhostNetDevicePath = origDevicePath
+		os.Unsetenv(DisableVhostNetEnvVar)
+	}()
+
+	for _, tc := range []struct {
+		name       string
+		devicePath string
+		disable    bool
+		available  bool
+	}{
+		{
+			name:       "vhost-net available",
+			devicePath: fakeDevicePath,
+			available:  true,
+		},
+		{
+			name:       "no vhost-net device",
+			devicePath: filepath.Join(tmpDir, "nonexistent"),
+		},
+		{
+			name:       "vhost-net device is a directory",
+			devicePath: tmpDir,
+		},
+		{
+			name:       "vhost-net disabled",
+			devicePath: fakeDevicePath,
+			disable:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			VhostNetDevicePath = tc.devicePath
+			if tc.disable {
+				os.Setenv(DisableVhostNetEnvVar, "1")
+			} else {
+				os.Unsetenv(DisableVhostNetEnvVar)
+			}
+			if available := VhostNetAvailable(); available != tc.available {
+				t.Errorf("VhostNetAvailable() returned %v instead of %v", available, tc.available)
+			}
+			fd, err := OpenVhostNet()
+			switch {
+			case tc.available && err != nil:
+				t.Errorf("OpenVhostNet(): %v", err)
+			case !tc.available && err == nil:
+				syscall.Close(fd)
+				t.Errorf("OpenVhostNet() didn't fail")
+			case err == nil:
+				flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+				if errno != 0 {
+					t.Errorf("fcntl(): %v", errno)
+				} else if flags&syscall.FD_CLOEXEC != 0 {
+					t.Errorf("vhost-net fd has close-on-exec flag set")
+				}
+				syscall.Close(fd)
+			}
+		})
+	}
+}
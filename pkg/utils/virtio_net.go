@@ -0,0 +1,175 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VirtioNetOptionsEnvVar passes the virtio-net device options of
+// the VM to vmwrapper, which adds the NICs to the emulator command line
+const VirtioNetOptionsEnvVar = "VIRTLET_VIRTIO_NET_OPTIONS"
+
+const (
+	minVirtioQueueSize = 256
+	maxVirtioQueueSize = 1024
+)
+
+// QEMUVersion denotes the version of QEMU as major, minor
+type QEMUVersion [2]int
+
+func (v QEMUVersion) String() string {
+	return fmt.Sprintf("%d.%d", v[0], v[1])
+}
+
+// Less returns true if v is older than other
+func (v QEMUVersion) Less(other QEMUVersion) bool {
+	return v[0] < other[0] || (v[0] == other[0] && v[1] < other[1])
+}
+
+var qemuVersionRx = regexp.MustCompile(`QEMU emulator version (\d+)\.(\d+)`)
+
+// ParseQEMUVersion extracts QEMU version from the output of
+// 'qemu-system-... -version'
+func ParseQEMUVersion(out string) (QEMUVersion, error) {
+	m := qemuVersionRx.FindStringSubmatch(out)
+	if m == nil {
+		return QEMUVersion{}, fmt.Errorf("can't find QEMU version in %q", out)
+	}
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+	return QEMUVersion{major, minor}, nil
+}
+
+// EmulatorVersion returns the version of the specified emulator
+// binary
+func EmulatorVersion(emulator string) (QEMUVersion, error) {
+	out, err := exec.Command(emulator, "-version").Output()
+	if err != nil {
+		return QEMUVersion{}, fmt.Errorf("can't get the version of %q: %v", emulator, err)
+	}
+	return ParseQEMUVersion(string(out))
+}
+
+type virtioNetOption struct {
+	// queueSize is true for the queue size options, which
+	// take a power of 2 value, and false for on/off options
+	queueSize bool
+	// minQEMUVersion is the first QEMU version that
+	// supports the option
+	minQEMUVersion QEMUVersion
+}
+
+var virtioNetOptions = map[string]virtioNetOption{
+	"rx_queue_size": {queueSize: true, minQEMUVersion: QEMUVersion{2, 7}},
+	"event_idx":     {},
+	"indirect_desc": {},
+	"mrg_rxbuf":     {},
+}
+
+// tapIncompatibleVirtioNetOptions lists the virtio-net device
+// options that are ignored by QEMU for the tap netdevs used by
+// Virtlet, along with the reason
+var tapIncompatibleVirtioNetOptions = map[string]string{
+	"tx_queue_size": "QEMU only honors it for vhost-user netdevs",
+}
+
+// VirtioNetOptions holds the virtio-net device properties that
+// tune the virtio rings of the NICs, such as rx_queue_size
+type VirtioNetOptions map[string]string
+
+// ParseVirtioNetOptions parses the virtio-net device options in
+// name=value[,name=value...] format. The supported options are
+// rx_queue_size, which must be a power of 2 between 256 and 1024,
+// and event_idx, indirect_desc and mrg_rxbuf, which are either
+// 'on' or 'off'
+func ParseVirtioNetOptions(s string) (VirtioNetOptions, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	opts := VirtioNetOptions{}
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bad virtio-net option %q (must be name=value)", item)
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		opt, found := virtioNetOptions[name]
+		switch {
+		case tapIncompatibleVirtioNetOptions[name] != "":
+			return nil, fmt.Errorf("virtio-net option %q can't be used with tap interfaces: %s", name, tapIncompatibleVirtioNetOptions[name])
+		case !found:
+			return nil, fmt.Errorf("unsupported virtio-net option %q", name)
+		case opts[name] != "":
+			return nil, fmt.Errorf("duplicate virtio-net option %q", name)
+		case opt.queueSize:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < minVirtioQueueSize || n > maxVirtioQueueSize || n&(n-1) != 0 {
+				return nil, fmt.Errorf("bad %s %q (must be a power of 2 between %d and %d)", name, value, minVirtioQueueSize, maxVirtioQueueSize)
+			}
+		case value != "on" && value != "off":
+			return nil, fmt.Errorf("bad %s %q (must be 'on' or 'off')", name, value)
+		}
+		opts[name] = value
+	}
+	return opts, nil
+}
+
+func (o VirtioNetOptions) names() []string {
+	var names []string
+	for name := range o {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns the options in the format that's accepted by
+// ParseVirtioNetOptions
+func (o VirtioNetOptions) String() string {
+	var items []string
+	for _, name := range o.names() {
+		items = append(items, name+"="+o[name])
+	}
+	return strings.Join(items, ",")
+}
+
+// DeviceOptions returns the options to be appended to the -device
+// argument of QEMU, including the leading comma
+func (o VirtioNetOptions) DeviceOptions() string {
+	s := ""
+	for _, name := range o.names() {
+		s += "," + name + "=" + o[name]
+	}
+	return s
+}
+
+// CheckQEMUVersion returns an error if some of the options are not
+// supported by the specified QEMU version
+func (o VirtioNetOptions) CheckQEMUVersion(v QEMUVersion) error {
+	for _, name := range o.names() {
+		if minVersion := virtioNetOptions[name].minQEMUVersion; v.Less(minVersion) {
+			return fmt.Errorf("virtio-net option %s requires QEMU %s or newer, but QEMU version is %s", name, minVersion, v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"testing"
+)
+
+func TestParseVirtioNetOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		options       string
+		deviceOptions string
+		error         bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:          "queue size",
+			options:       " rx_queue_size=1024 ",
+			deviceOptions: ",rx_queue_size=1024",
+		},
+		{
+			name:          "on/off options",
+			options:       "event_idx=off,indirect_desc=on,mrg_rxbuf=off",
+			deviceOptions: ",event_idx=off,indirect_desc=on,mrg_rxbuf=off",
+		},
+		{name: "queue size not a power of 2", options: "rx_queue_size=300", error: true},
+		{name: "queue size too large", options: "rx_queue_size=2048", error: true},
+		{name: "queue size too small", options: "rx_queue_size=128", error: true},
+		{name: "tx queue size", options: "tx_queue_size=1024", error: true},
+		{name: "bad on/off value", options: "event_idx=yes", error: true},
+		{name: "unsupported option", options: "mq=on", error: true},
+		{name: "no value", options: "event_idx", error: true},
+		{name: "duplicate option", options: "event_idx=on,event_idx=off", error: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := ParseVirtioNetOptions(tc.options)
+			switch {
+			case tc.error && err == nil:
+				t.Errorf("ParseVirtioNetOptions() didn't fail")
+			case !tc.error && err != nil:
+				t.Errorf("ParseVirtioNetOptions(): %v", err)
+			case opts.DeviceOptions() != tc.deviceOptions:
+				t.Errorf("bad device options: %q instead of %q", opts.DeviceOptions(), tc.deviceOptions)
+			}
+		})
+	}
+}
+
+func TestVirtioNetOptionsQEMUVersion(t *testing.T) {
+	v, err := ParseQEMUVersion("QEMU emulator version 2.9.0(Debian 1:2.9.0+dfsg-1)\nCopyright (c) 2003-2017 Fabrice Bellard and the QEMU Project developers\n")
+	if err != nil {
+		t.Fatalf("ParseQEMUVersion(): %v", err)
+	}
+	if v != (QEMUVersion{2, 9}) {
+		t.Fatalf("bad QEMU version %s", v)
+	}
+	opts, err := ParseVirtioNetOptions("rx_queue_size=1024")
+	if err != nil {
+		t.Fatalf("ParseVirtioNetOptions(): %v", err)
+	}
+	if err := opts.CheckQEMUVersion(v); err != nil {
+		t.Errorf("CheckQEMUVersion(): %v", err)
+	}
+	if err := opts.CheckQEMUVersion(QEMUVersion{2, 5}); err == nil {
+		t.Errorf("CheckQEMUVersion() didn't fail for rx_queue_size with QEMU 2.5")
+	}
+	if _, err := ParseQEMUVersion("foobar"); err == nil {
+		t.Errorf("ParseQEMUVersion() didn't fail for bad input")
+	}
+}
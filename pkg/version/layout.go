@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package version
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// DataLayoutVersion is the version of the layout of
+	// Virtlet data directory. It must be increased each time
+	// the data directory is changed in an incompatible way, with
+	// the corresponding migration added to layoutMigrations
+	DataLayoutVersion = 1
+	// LayoutVersionFile is the name of the file in the data
+	// directory that holds the version of its layout
+	LayoutVersionFile = "layout-version"
+)
+
+// layoutMigrations maps the layout versions to the functions
+// that upgrade the data directory from the previous version
+var layoutMigrations = map[int]func(dataDir string) error{}
+
+// ReadDataLayout returns the version of the layout of the data
+// directory. Zero is returned if the directory doesn't have the
+// version file yet
+func ReadDataLayout(dataDir string) (int, error) {
+	bs, err := ioutil.ReadFile(filepath.Join(dataDir, LayoutVersionFile))
+	switch {
+	case os.IsNotExist(err):
+		return 0, nil
+	case err != nil:
+		return 0, fmt.Errorf("error reading data layout version: %v", err)
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("bad data layout version %q in %q", strings.TrimSpace(string(bs)), dataDir)
+	}
+	return v, nil
+}
+
+// EnsureDataLayout verifies that the data directory can be used by
+// this version of Virtlet, upgrading its layout if necessary. The
+// data directories written by newer Virtlet versions are rejected
+// so a downgrade can't corrupt the state of the running VMs
+func EnsureDataLayout(dataDir string) error {
+	v, err := ReadDataLayout(dataDir)
+	switch {
+	case err != nil:
+		return err
+	case v > DataLayoutVersion:
+		return fmt.Errorf("data directory %q has layout version %d which is newer than %d supported by this Virtlet version", dataDir, v, DataLayoutVersion)
+	case v == DataLayoutVersion:
+		return nil
+	case v == 0:
+		// the directories created before the layout was
+		// versioned have the layout version 1
+		if err := writeDataLayout(dataDir, 1); err != nil {
+			return err
+		}
+		v = 1
+	}
+	for v < DataLayoutVersion {
+		v++
+		if migrate := layoutMigrations[v]; migrate != nil {
+			glog.V(0).Infof("Upgrading the layout of data directory %q to version %d", dataDir, v)
+			if err := migrate(dataDir); err != nil {
+				return fmt.Errorf("error upgrading the layout of data directory %q to version %d: %v", dataDir, v, err)
+			}
+		}
+		// the version is written after each step, so an
+		// interrupted upgrade is resumed where it stopped
+		if err := writeDataLayout(dataDir, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeDataLayout(dataDir string, v int) error {
+	path := filepath.Join(dataDir, LayoutVersionFile)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(fmt.Sprintf("%d\n", v)), 0644); err != nil {
+		return fmt.Errorf("error writing data layout version: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("error writing data layout version: %v", err)
+	}
+	return nil
+}
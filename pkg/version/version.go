@@ -0,0 +1,183 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version implements the compatibility checks between
+// Virtlet components that may temporarily run different versions
+// during a rolling upgrade. Virtlet manager and vmwrapper exchange
+// their protocol versions and feature sets with tapmanager when they
+// connect to it, and vmwrapper gets the protocol version of Virtlet
+// that has defined the domain via an environment variable.
+package version
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the version of the protocol used between
+	// Virtlet manager, tapmanager and vmwrapper. It must be
+	// increased each time an incompatible change is made
+	ProtocolVersion = 2
+	// MinProtocolVersion is the oldest protocol version of the
+	// peer that's still supported. Version 1 denotes the
+	// components that predate the version handshake
+	MinProtocolVersion = 1
+	// LegacyProtocolVersion is assumed for the peers that
+	// don't report their version
+	LegacyProtocolVersion = 1
+	// ProtocolVersionEnvVar passes the protocol version of Virtlet
+	// that has defined the domain to vmwrapper
+	ProtocolVersionEnvVar = "VIRTLET_PROTOCOL_VERSION"
+)
+
+// Feature denotes an optional protocol feature
+type Feature uint32
+
+const (
+	// FeatureCompression denotes gzip compression of
+	// large fd protocol payloads
+	FeatureCompression Feature = 1 << iota
+	// FeatureListKeys denotes the support for listing
+	// the fd keys held by tapmanager
+	FeatureListKeys
+	// FeatureReport denotes the support for the reports on
+	// the usage of the file descriptors by vmwrapper
+	FeatureReport
+	// FeatureHandoff denotes the support for handing off
+	// the fd server socket and the file descriptors to
+	// a new tapmanager process
+	FeatureHandoff
+)
+
+// SupportedFeatures is the set of features supported
+// by this version of Virtlet
+const SupportedFeatures = FeatureCompression | FeatureListKeys | FeatureReport | FeatureHandoff
+
+var featureNames = []struct {
+	feature Feature
+	name    string
+}{
+	{FeatureCompression, "compression"},
+	{FeatureListKeys, "list-keys"},
+	{FeatureReport, "report"},
+	{FeatureHandoff, "handoff"},
+}
+
+// String returns the comma-separated list of feature names
+func (f Feature) String() string {
+	var names []string
+	for _, fn := range featureNames {
+		if f&fn.feature != 0 {
+			names = append(names, fn.name)
+			f &^= fn.feature
+		}
+	}
+	if f != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(f)))
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Info describes the protocol version and the features
+// of a Virtlet component
+type Info struct {
+	// Component is the name of the component, e.g. "vmwrapper"
+	Component string `json:"component"`
+	// Version is the protocol version of the component
+	Version int `json:"version"`
+	// MinVersion is the oldest protocol version of the peer
+	// that the component can work with
+	MinVersion int `json:"minVersion"`
+	// Features is the set of the features supported
+	// by the component
+	Features Feature `json:"features"`
+}
+
+// Local returns the Info for the specified component
+// of this version of Virtlet
+func Local(component string) Info {
+	return Info{
+		Component:  component,
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Features:   SupportedFeatures,
+	}
+}
+
+// Legacy returns the Info for a component that
+// predates the version handshake
+func Legacy(component string) Info {
+	return Info{
+		Component:  component,
+		Version:    LegacyProtocolVersion,
+		MinVersion: LegacyProtocolVersion,
+		Features:   FeatureCompression | FeatureReport,
+	}
+}
+
+// String returns a human-readable representation of the Info
+func (i Info) String() string {
+	return fmt.Sprintf("%s (protocol version %d, features: %s)", i.Component, i.Version, i.Features)
+}
+
+// Check verifies that the local component can work with the peer.
+// The versions are compatible if each of them is not older than
+// the minimum version required by the other side
+func Check(local, peer Info) error {
+	switch {
+	case peer.Version < local.MinVersion:
+		return fmt.Errorf("%s is too old for %s: protocol version %d, at least %d is required", peer, local.Component, peer.Version, local.MinVersion)
+	case local.Version < peer.MinVersion:
+		return fmt.Errorf("%s is too new for %s: it requires protocol version %d or newer, but %d is supported", peer, local.Component, peer.MinVersion, local.Version)
+	}
+	return nil
+}
+
+// CommonFeatures returns the features supported by both of the peers
+func CommonFeatures(a, b Info) Feature {
+	return a.Features & b.Features
+}
+
+// FromEnv returns the protocol version passed using
+// ProtocolVersionEnvVar. Empty value denotes the legacy version
+func FromEnv(value string) (int, error) {
+	if value == "" {
+		return LegacyProtocolVersion, nil
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil || v < 1 {
+		return 0, fmt.Errorf("bad protocol version %q", value)
+	}
+	return v, nil
+}
+
+// CheckDomainVersion verifies that the domain defined by Virtlet
+// with the specified protocol version can be handled by this
+// version of vmwrapper
+func CheckDomainVersion(domainVersion int) error {
+	switch {
+	case domainVersion < MinProtocolVersion:
+		return fmt.Errorf("the domain was defined by Virtlet with protocol version %d, at least %d is required", domainVersion, MinProtocolVersion)
+	case domainVersion > ProtocolVersion:
+		return fmt.Errorf("the domain was defined by Virtlet with protocol version %d, which is newer than %d supported by this vmwrapper", domainVersion, ProtocolVersion)
+	}
+	return nil
+}
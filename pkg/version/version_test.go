@@ -0,0 +1,126 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package version
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	local := Info{Component: "virtlet", Version: 3, MinVersion: 2}
+	for _, tc := range []struct {
+		peer        Info
+		errContains string
+	}{
+		{peer: Info{Component: "tapmanager", Version: 3, MinVersion: 2}},
+		{peer: Info{Component: "tapmanager", Version: 2, MinVersion: 1}},
+		{peer: Info{Component: "tapmanager", Version: 4, MinVersion: 3}},
+		{
+			peer:        Legacy("tapmanager"),
+			errContains: "too old",
+		},
+		{
+			peer:        Info{Component: "tapmanager", Version: 5, MinVersion: 4},
+			errContains: "too new",
+		},
+	} {
+		err := Check(local, tc.peer)
+		switch {
+		case tc.errContains == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tc.peer, err)
+		case tc.errContains != "" && err == nil:
+			t.Errorf("%s: didn't get an error", tc.peer)
+		case tc.errContains != "" && !strings.Contains(err.Error(), tc.errContains):
+			t.Errorf("%s: bad error message %q", tc.peer, err)
+		}
+	}
+	if err := Check(Local("virtlet"), Legacy("tapmanager")); err != nil {
+		t.Errorf("the legacy version must be supported: %v", err)
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	common := CommonFeatures(Local("virtlet"), Legacy("tapmanager"))
+	if common&FeatureListKeys != 0 {
+		t.Errorf("list-keys feature must not be supported by legacy peers")
+	}
+	if s := common.String(); s != "compression,report" {
+		t.Errorf("bad feature list: %q", s)
+	}
+	if s := (FeatureListKeys | 0x100).String(); s != "list-keys,0x100" {
+		t.Errorf("bad feature list: %q", s)
+	}
+	if s := Feature(0).String(); s != "none" {
+		t.Errorf("bad feature list: %q", s)
+	}
+}
+
+func TestDomainVersion(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		ok    bool
+	}{
+		{"", true},
+		{"1", true},
+		{"2", true},
+		{"99", false},
+		{"0", false},
+		{"foo", false},
+	} {
+		v, err := FromEnv(tc.value)
+		if err == nil {
+			err = CheckDomainVersion(v)
+		}
+		if tc.ok && err != nil {
+			t.Errorf("%q: unexpected error: %v", tc.value, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("%q: didn't get an error", tc.value)
+		}
+	}
+}
+
+func TestDataLayout(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "data-layout")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	if v, err := ReadDataLayout(dataDir); err != nil || v != 0 {
+		t.Fatalf("ReadDataLayout() on an unversioned dir: %d, %v", v, err)
+	}
+	if err := EnsureDataLayout(dataDir); err != nil {
+		t.Fatalf("EnsureDataLayout(): %v", err)
+	}
+	if v, err := ReadDataLayout(dataDir); err != nil || v != DataLayoutVersion {
+		t.Errorf("ReadDataLayout(): %d, %v", v, err)
+	}
+	if err := EnsureDataLayout(dataDir); err != nil {
+		t.Errorf("EnsureDataLayout() on an up-to-date dir: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dataDir, LayoutVersionFile), []byte("42\n"), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := EnsureDataLayout(dataDir); err == nil {
+		t.Errorf("EnsureDataLayout() didn't fail for a newer layout")
+	}
+}
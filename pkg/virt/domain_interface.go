@@ -18,6 +18,7 @@ package virt
 
 import (
 	"errors"
+	"time"
 
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 )
@@ -86,6 +87,23 @@ type VirtSecret interface {
 	Remove() error
 }
 
+// DomainMemoryStats contains the memory statistics of a domain
+// that are reported by the balloon driver. All of the values
+// are in bytes
+type DomainMemoryStats struct {
+	// ActualBalloon is the current balloon size, i.e. the
+	// amount of memory available to the guest
+	ActualBalloon uint64
+	// Available is the total amount of memory as seen by
+	// the guest, 0 if the guest doesn't report it
+	Available uint64
+	// Unused is the amount of memory left completely unused
+	// by the guest, 0 if the guest doesn't report it
+	Unused uint64
+	// RSS is the resident set size of the emulator process
+	RSS uint64
+}
+
 // VirtDomain represents a domain which corresponds to a VM
 type VirtDomain interface {
 	// Create boots the domain
@@ -97,6 +115,13 @@ type VirtDomain interface {
 	Undefine() error
 	// Shutdown shuts down the domain
 	Shutdown() error
+	// Suspend pauses the domain
+	Suspend() error
+	// Resume resumes the domain paused using Suspend()
+	Resume() error
+	// Reset resets the running domain as if the reset
+	// button was pressed, without restarting the emulator
+	Reset() error
 	// State obtains the current state of the domain
 	State() (DomainState, error)
 	// UUIDString returns UUID string for this domain
@@ -105,4 +130,35 @@ type VirtDomain interface {
 	Name() (string, error)
 	// Xml retrieves xml definition of the domain
 	Xml() (*libvirtxml.Domain, error)
+	// QemuAgentCommand executes the command using QEMU guest agent
+	// running inside the VM, returning agent's JSON response.
+	// Non-positive timeout means using the libvirt default
+	QemuAgentCommand(cmd string, timeout time.Duration) (string, error)
+	// QemuMonitorCommand executes the QMP command using the QEMU
+	// monitor of the running domain, returning QEMU's JSON response
+	QemuMonitorCommand(cmd string) (string, error)
+	// CoreDump writes the memory of the domain to the specified
+	// file in ELF format, without the emulator state
+	CoreDump(path string) error
+	// MemoryStats returns the memory statistics of the running domain
+	MemoryStats() (*DomainMemoryStats, error)
+	// SetMemoryStatsPeriod sets the interval for collecting
+	// the guest memory statistics by the balloon driver
+	SetMemoryStatsPeriod(period time.Duration) error
+	// SetMemory changes the balloon target of the running
+	// domain to the specified number of bytes
+	SetMemory(memory uint64) error
+	// CPUTime returns the CPU time used by the domain
+	CPUTime() (time.Duration, error)
+	// SetVCPUCount changes the number of active vCPUs of the
+	// domain, hot-plugging them if the domain is running. The
+	// count can't exceed the maximum vCPU count of the domain
+	SetVCPUCount(count int) error
+	// SetCPUTune changes CPU shares and per-vCPU CFS bandwidth
+	// period and quota of the domain. Zero values are not applied
+	SetCPUTune(shares uint64, period uint64, quota int64) error
+	// PinEmulator pins the emulator threads of the domain to
+	// the host CPUs specified in libvirt cpuset format, e.g. "2-15".
+	// The pinning is stored in the domain config
+	PinEmulator(cpuSet string) error
 }
@@ -17,11 +17,15 @@ limitations under the License.
 package fake
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
+	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	libvirtxml "github.com/libvirt/libvirt-go-xml"
 
@@ -40,6 +44,7 @@ type FakeDomainConnection struct {
 	domainsByUuid      map[string]*FakeDomain
 	secretsByUsageName map[string]*FakeSecret
 	ignoreShutdown     bool
+	transientErrors    map[string]int
 }
 
 var _ virt.VirtDomainConnection = &FakeDomainConnection{}
@@ -60,6 +65,24 @@ func (dc *FakeDomainConnection) SetIgnoreShutdown(ignoreShutdown bool) {
 	dc.ignoreShutdown = ignoreShutdown
 }
 
+// SetTransientErrors makes the specified number of subsequent calls
+// of the domain method (Shutdown, Destroy or Undefine) fail
+func (dc *FakeDomainConnection) SetTransientErrors(method string, count int) {
+	if dc.transientErrors == nil {
+		dc.transientErrors = make(map[string]int)
+	}
+	dc.transientErrors[method] = count
+}
+
+func (dc *FakeDomainConnection) transientError(d *FakeDomain, method string) error {
+	if dc.transientErrors[method] <= 0 {
+		return nil
+	}
+	dc.transientErrors[method]--
+	d.rec.Rec(method, map[string]interface{}{"failed": true})
+	return fmt.Errorf("%s(): transient error for domain %q", method, d.def.Name)
+}
+
 func (dc *FakeDomainConnection) removeDomain(d *FakeDomain) {
 	if _, found := dc.domains[d.def.Name]; !found {
 		log.Panicf("domain %q not found", d.def.Name)
@@ -146,15 +169,20 @@ func (dc *FakeDomainConnection) DefineSecret(def *libvirtxml.Secret) (virt.VirtS
 	if def.UUID == "" {
 		return nil, fmt.Errorf("the secret has empty uuid")
 	}
-	if def.Usage.Name == "" {
+	// volume secrets are identified by Usage volume
+	usageName := def.Usage.Name
+	if def.Usage.Type == "volume" {
+		usageName = def.Usage.Volume
+	}
+	if usageName == "" {
 		return nil, fmt.Errorf("the secret has empty Usage name")
 	}
 	// clear secret uuid as it's generated randomly
 	def.UUID = ""
 	dc.rec.Rec("DefineSecret", def)
 
-	s := newFakeSecret(dc, def.Usage.Name)
-	dc.secretsByUsageName[def.Usage.Name] = s
+	s := newFakeSecret(dc, usageName)
+	dc.secretsByUsageName[usageName] = s
 	return s, nil
 }
 
@@ -176,6 +204,13 @@ type FakeDomain struct {
 	created bool
 	state   virt.DomainState
 	def     *libvirtxml.Domain
+	agent   *fakeGuestAgent
+	// balloon is the current balloon size in bytes,
+	// 0 meaning the whole guest memory
+	balloon         uint64
+	guestMemoryUsed uint64
+	statsPeriod     time.Duration
+	cpuTime         time.Duration
 }
 
 func newFakeDomain(dc *FakeDomainConnection, def *libvirtxml.Domain) *FakeDomain {
@@ -184,6 +219,7 @@ func newFakeDomain(dc *FakeDomainConnection, def *libvirtxml.Domain) *FakeDomain
 		dc:    dc,
 		state: virt.DOMAIN_SHUTOFF,
 		def:   def,
+		agent: newFakeGuestAgent(),
 	}
 }
 
@@ -219,6 +255,9 @@ func (d *FakeDomain) Create() error {
 }
 
 func (d *FakeDomain) Destroy() error {
+	if err := d.dc.transientError(d, "Destroy"); err != nil {
+		return err
+	}
 	d.rec.Rec("Destroy", nil)
 	if d.removed {
 		return fmt.Errorf("Destroy() called on a removed (undefined) domain %q", d.def.Name)
@@ -228,6 +267,9 @@ func (d *FakeDomain) Destroy() error {
 }
 
 func (d *FakeDomain) Undefine() error {
+	if err := d.dc.transientError(d, "Undefine"); err != nil {
+		return err
+	}
 	d.rec.Rec("Undefine", nil)
 	if d.removed {
 		return fmt.Errorf("Undefine(): domain %q already removed", d.def.Name)
@@ -238,6 +280,9 @@ func (d *FakeDomain) Undefine() error {
 }
 
 func (d *FakeDomain) Shutdown() error {
+	if err := d.dc.transientError(d, "Shutdown"); err != nil {
+		return err
+	}
 	if d.dc.ignoreShutdown {
 		d.rec.Rec("Shutdown", map[string]interface{}{"ignored": true})
 	} else {
@@ -253,6 +298,65 @@ func (d *FakeDomain) Shutdown() error {
 	return nil
 }
 
+func (d *FakeDomain) Suspend() error {
+	d.rec.Rec("Suspend", nil)
+	if d.removed {
+		return fmt.Errorf("Suspend() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DOMAIN_RUNNING {
+		return fmt.Errorf("Suspend() called on a domain %q that's not running", d.def.Name)
+	}
+	d.state = virt.DOMAIN_PAUSED
+	return nil
+}
+
+func (d *FakeDomain) Resume() error {
+	d.rec.Rec("Resume", nil)
+	if d.removed {
+		return fmt.Errorf("Resume() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DOMAIN_PAUSED {
+		return fmt.Errorf("Resume() called on a domain %q that's not paused", d.def.Name)
+	}
+	d.state = virt.DOMAIN_RUNNING
+	return nil
+}
+
+func (d *FakeDomain) Reset() error {
+	d.rec.Rec("Reset", nil)
+	if d.removed {
+		return fmt.Errorf("Reset() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DOMAIN_RUNNING {
+		return fmt.Errorf("Reset() called on a domain %q that's not running", d.def.Name)
+	}
+	return nil
+}
+
+// Crash simulates a guest kernel panic that
+// leaves the domain in the crashed state
+func (d *FakeDomain) Crash() {
+	d.rec.Rec("Crash", nil)
+	d.state = virt.DOMAIN_CRASHED
+}
+
+func (d *FakeDomain) CoreDump(path string) error {
+	d.rec.Rec("CoreDump", filepath.Base(path))
+	if d.removed {
+		return fmt.Errorf("CoreDump() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DOMAIN_RUNNING && d.state != virt.DOMAIN_PAUSED && d.state != virt.DOMAIN_CRASHED {
+		return fmt.Errorf("CoreDump() called on a domain %q that's not active", d.def.Name)
+	}
+	// the dump is a sparse file of the guest memory size
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Truncate(int64(d.guestMemory()))
+}
+
 func (d *FakeDomain) State() (virt.DomainState, error) {
 	if d.removed {
 		return virt.DOMAIN_NOSTATE, fmt.Errorf("State() called on a removed (undefined) domain %q", d.def.Name)
@@ -275,6 +379,151 @@ func (d *FakeDomain) Xml() (*libvirtxml.Domain, error) {
 	return d.def, nil
 }
 
+func (d *FakeDomain) guestMemory() uint64 {
+	if d.def.Memory == nil {
+		return 0
+	}
+	// the fake only handles the units used by Virtlet
+	switch d.def.Memory.Unit {
+	case "b", "bytes":
+		return uint64(d.def.Memory.Value)
+	case "MiB", "M":
+		return uint64(d.def.Memory.Value) * 1024 * 1024
+	default:
+		return uint64(d.def.Memory.Value) * 1024
+	}
+}
+
+func (d *FakeDomain) MemoryStats() (*virt.DomainMemoryStats, error) {
+	if d.state != virt.DOMAIN_RUNNING {
+		return nil, fmt.Errorf("domain %q is not running", d.def.Name)
+	}
+	stats := &virt.DomainMemoryStats{ActualBalloon: d.balloon, RSS: d.guestMemory()}
+	if stats.ActualBalloon == 0 {
+		stats.ActualBalloon = d.guestMemory()
+	}
+	if d.statsPeriod != 0 {
+		stats.Available = stats.ActualBalloon
+		if d.guestMemoryUsed < stats.Available {
+			stats.Unused = stats.Available - d.guestMemoryUsed
+		}
+	}
+	return stats, nil
+}
+
+func (d *FakeDomain) SetMemoryStatsPeriod(period time.Duration) error {
+	d.rec.Rec("SetMemoryStatsPeriod", period.String())
+	if d.state != virt.DOMAIN_RUNNING {
+		return fmt.Errorf("domain %q is not running", d.def.Name)
+	}
+	d.statsPeriod = period
+	return nil
+}
+
+func (d *FakeDomain) SetMemory(memory uint64) error {
+	d.rec.Rec("SetMemory", memory)
+	if d.state != virt.DOMAIN_RUNNING {
+		return fmt.Errorf("domain %q is not running", d.def.Name)
+	}
+	if memory > d.guestMemory() {
+		return fmt.Errorf("balloon target %d exceeds the memory of domain %q", memory, d.def.Name)
+	}
+	d.balloon = memory
+	return nil
+}
+
+func (d *FakeDomain) CPUTime() (time.Duration, error) {
+	if d.removed {
+		return 0, fmt.Errorf("CPUTime() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	return d.cpuTime, nil
+}
+
+func (d *FakeDomain) QemuMonitorCommand(cmd string) (string, error) {
+	if d.removed {
+		return "", fmt.Errorf("QemuMonitorCommand() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DOMAIN_RUNNING {
+		return "", fmt.Errorf("domain %q is not running", d.def.Name)
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(cmd), &parsed); err != nil {
+		return "", fmt.Errorf("bad QMP command %q: %v", cmd, err)
+	}
+	d.rec.Rec("QemuMonitorCommand", parsed)
+	r := map[string]interface{}{}
+	if parsed["execute"] == "query-status" {
+		r["running"] = true
+		r["status"] = "running"
+	}
+	bs, err := json.Marshal(map[string]interface{}{"return": r})
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+func (d *FakeDomain) SetVCPUCount(count int) error {
+	d.rec.Rec("SetVCPUCount", count)
+	if d.removed {
+		return fmt.Errorf("SetVCPUCount() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.def.VCPU == nil || count > d.def.VCPU.Value {
+		return fmt.Errorf("requested vcpus is greater than max allowable vcpus for domain %q", d.def.Name)
+	}
+	d.def.VCPU.Current = strconv.Itoa(count)
+	return nil
+}
+
+func (d *FakeDomain) SetCPUTune(shares uint64, period uint64, quota int64) error {
+	d.rec.Rec("SetCPUTune", map[string]interface{}{
+		"shares": shares,
+		"period": period,
+		"quota":  quota,
+	})
+	if d.removed {
+		return fmt.Errorf("SetCPUTune() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.def.CPUTune == nil {
+		d.def.CPUTune = &libvirtxml.DomainCPUTune{}
+	}
+	if shares != 0 {
+		d.def.CPUTune.Shares = &libvirtxml.DomainCPUTuneShares{Value: uint(shares)}
+	}
+	if period != 0 {
+		d.def.CPUTune.Period = &libvirtxml.DomainCPUTunePeriod{Value: period}
+	}
+	if quota > 0 {
+		d.def.CPUTune.Quota = &libvirtxml.DomainCPUTuneQuota{Value: quota}
+	}
+	return nil
+}
+
+// SetGuestMemoryUsed sets the amount of memory used by
+// the guest as reported by the fake balloon driver
+func (d *FakeDomain) PinEmulator(cpuSet string) error {
+	d.rec.Rec("PinEmulator", cpuSet)
+	if d.removed {
+		return fmt.Errorf("PinEmulator() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	return nil
+}
+
+func (d *FakeDomain) SetGuestMemoryUsed(used uint64) {
+	d.guestMemoryUsed = used
+}
+
+// SetCPUTime sets the CPU time used by the domain
+func (d *FakeDomain) SetCPUTime(cpuTime time.Duration) {
+	d.cpuTime = cpuTime
+}
+
+// Balloon returns the current balloon size
+// of the domain, 0 if it wasn't set
+func (d *FakeDomain) Balloon() uint64 {
+	return d.balloon
+}
+
 type FakeSecret struct {
 	rec       Recorder
 	dc        *FakeDomainConnection
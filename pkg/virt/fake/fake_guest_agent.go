@@ -0,0 +1,193 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fake
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/virt"
+)
+
+type fakeGuestFile struct {
+	path   string
+	offset int
+	write  bool
+}
+
+// fakeGuestAgent emulates the file operations,
+// fstrim and fsfreeze of QEMU guest agent
+type fakeGuestAgent struct {
+	files       map[string][]byte
+	handles     map[int]*fakeGuestFile
+	nextHandle  int
+	fstrimCount int
+	frozen      bool
+}
+
+func newFakeGuestAgent() *fakeGuestAgent {
+	return &fakeGuestAgent{
+		files:      make(map[string][]byte),
+		handles:    make(map[int]*fakeGuestFile),
+		nextHandle: 1000,
+	}
+}
+
+type fakeAgentCommand struct {
+	Execute   string `json:"execute"`
+	Arguments struct {
+		Path   string `json:"path"`
+		Mode   string `json:"mode"`
+		Handle int    `json:"handle"`
+		Count  int    `json:"count"`
+		BufB64 string `json:"buf-b64"`
+	} `json:"arguments"`
+}
+
+func (a *fakeGuestAgent) handle(cmd *fakeAgentCommand) (interface{}, error) {
+	switch cmd.Execute {
+	case "guest-file-open":
+		f := &fakeGuestFile{path: cmd.Arguments.Path}
+		switch cmd.Arguments.Mode {
+		case "", "r":
+			if _, found := a.files[f.path]; !found {
+				return nil, fmt.Errorf("failed to open file '%s' (mode: 'r'): No such file or directory", f.path)
+			}
+		case "w":
+			f.write = true
+			a.files[f.path] = nil
+		default:
+			return nil, fmt.Errorf("unsupported file mode %q", cmd.Arguments.Mode)
+		}
+		h := a.nextHandle
+		a.nextHandle++
+		a.handles[h] = f
+		return h, nil
+	case "guest-fstrim":
+		a.fstrimCount++
+		return map[string]interface{}{
+			"paths": []map[string]interface{}{
+				{"path": "/", "trimmed": 0, "minimum": 0},
+			},
+		}, nil
+	case "guest-fsfreeze-freeze":
+		if a.frozen {
+			return nil, fmt.Errorf("The command guest-fsfreeze-freeze has been disabled for this instance")
+		}
+		a.frozen = true
+		return 1, nil
+	case "guest-fsfreeze-thaw":
+		if !a.frozen {
+			return 0, nil
+		}
+		a.frozen = false
+		return 1, nil
+	case "guest-file-read", "guest-file-write", "guest-file-flush", "guest-file-close":
+		// handled below
+	default:
+		return nil, fmt.Errorf("the command %s has not been found", cmd.Execute)
+	}
+
+	f, found := a.handles[cmd.Arguments.Handle]
+	if !found {
+		return nil, fmt.Errorf("handle '%d' has not been found", cmd.Arguments.Handle)
+	}
+	switch cmd.Execute {
+	case "guest-file-read":
+		if f.write {
+			return nil, fmt.Errorf("handle '%d' is not open for reading", cmd.Arguments.Handle)
+		}
+		data := a.files[f.path][f.offset:]
+		if len(data) > cmd.Arguments.Count {
+			data = data[:cmd.Arguments.Count]
+		}
+		f.offset += len(data)
+		return map[string]interface{}{
+			"count":   len(data),
+			"buf-b64": base64.StdEncoding.EncodeToString(data),
+			"eof":     f.offset == len(a.files[f.path]),
+		}, nil
+	case "guest-file-write":
+		if !f.write {
+			return nil, fmt.Errorf("handle '%d' is not open for writing", cmd.Arguments.Handle)
+		}
+		data, err := base64.StdEncoding.DecodeString(cmd.Arguments.BufB64)
+		if err != nil {
+			return nil, fmt.Errorf("bad base64 data: %v", err)
+		}
+		a.files[f.path] = append(a.files[f.path], data...)
+		return map[string]interface{}{"count": len(data), "eof": false}, nil
+	case "guest-file-close":
+		delete(a.handles, cmd.Arguments.Handle)
+	}
+	return map[string]interface{}{}, nil
+}
+
+func (d *FakeDomain) QemuAgentCommand(cmd string, timeout time.Duration) (string, error) {
+	if d.removed {
+		return "", fmt.Errorf("QemuAgentCommand() called on a removed (undefined) domain %q", d.def.Name)
+	}
+	if d.state != virt.DOMAIN_RUNNING {
+		return "", fmt.Errorf("domain %q is not running", d.def.Name)
+	}
+	var parsed fakeAgentCommand
+	if err := json.Unmarshal([]byte(cmd), &parsed); err != nil {
+		return "", fmt.Errorf("bad guest agent command %q: %v", cmd, err)
+	}
+	r, err := d.agent.handle(&parsed)
+	if err != nil {
+		return "", err
+	}
+	bs, err := json.Marshal(map[string]interface{}{"return": r})
+	if err != nil {
+		return "", err
+	}
+	return string(bs), nil
+}
+
+// GuestFile returns the contents of the file in the
+// guest filesystem as seen by the fake guest agent
+func (d *FakeDomain) GuestFile(path string) ([]byte, bool) {
+	data, found := d.agent.files[path]
+	return data, found
+}
+
+// SetGuestFile sets the contents of the file in the
+// guest filesystem as seen by the fake guest agent
+func (d *FakeDomain) SetGuestFile(path string, data []byte) {
+	d.agent.files[path] = data
+}
+
+// OpenGuestFileCount returns the number of guest files
+// that are currently open via the fake guest agent
+func (d *FakeDomain) OpenGuestFileCount() int {
+	return len(d.agent.handles)
+}
+
+// FSTrimCount returns the number of guest-fstrim
+// commands handled by the fake guest agent
+func (d *FakeDomain) FSTrimCount() int {
+	return d.agent.fstrimCount
+}
+
+// GuestFSFrozen returns true if the filesystems of the
+// VM are frozen via the fake guest agent
+func (d *FakeDomain) GuestFSFrozen() bool {
+	return d.agent.frozen
+}
@@ -107,16 +107,27 @@ func (p *FakeStoragePool) createStorageVol(def *libvirtxml.StorageVolume) (virt.
 	return v, nil
 }
 
-func (p *FakeStoragePool) CreateStorageVol(def *libvirtxml.StorageVolume) (virt.VirtStorageVolume, error) {
-	p.rec.Rec("CreateStorageVol", def)
+func (p *FakeStoragePool) CreateStorageVol(def *libvirtxml.StorageVolume, opts *virt.QCOW2Options) (virt.VirtStorageVolume, error) {
+	if opts == nil {
+		p.rec.Rec("CreateStorageVol", def)
+	} else {
+		p.rec.Rec("CreateStorageVol", map[string]interface{}{
+			"def":     def,
+			"options": opts,
+		})
+	}
 	return p.createStorageVol(def)
 }
 
-func (p *FakeStoragePool) CreateStorageVolClone(def *libvirtxml.StorageVolume, from virt.VirtStorageVolume) (virt.VirtStorageVolume, error) {
-	p.rec.Rec("CreateStorageVolClone", map[string]interface{}{
+func (p *FakeStoragePool) CreateStorageVolClone(def *libvirtxml.StorageVolume, from virt.VirtStorageVolume, opts *virt.QCOW2Options) (virt.VirtStorageVolume, error) {
+	data := map[string]interface{}{
 		"def":  def,
 		"from": from.(*FakeStorageVolume).descriptiveName(),
-	})
+	}
+	if opts != nil {
+		data["options"] = opts
+	}
+	p.rec.Rec("CreateStorageVolClone", data)
 	d := *def
 	d.Capacity = &libvirtxml.StorageVolumeSize{Unit: "b", Value: from.(*FakeStorageVolume).size}
 	return p.createStorageVol(&d)
@@ -150,7 +161,7 @@ func (p *FakeStoragePool) ImageToVolume(def *libvirtxml.StorageVolume, sourcePat
 	if fi.IsDir() {
 		return nil, fmt.Errorf("ImageToVolume(): %q is a directory", sourcePath)
 	}
-	return p.CreateStorageVol(def)
+	return p.CreateStorageVol(def, nil)
 }
 
 func (p *FakeStoragePool) removeVolumeByName(name string) error {
@@ -172,6 +183,8 @@ type FakeStorageVolume struct {
 	name string
 	path string
 	size uint64
+
+	allocation uint64
 }
 
 func newFakeStorageVolume(rec Recorder, pool *FakeStoragePool, def *libvirtxml.StorageVolume) (*FakeStorageVolume, error) {
@@ -212,6 +225,17 @@ func (v *FakeStorageVolume) Size() (uint64, error) {
 	return v.size, nil
 }
 
+// Allocation returns the allocation of the volume set via
+// SetAllocation(), which is 0 by default
+func (v *FakeStorageVolume) Allocation() (uint64, error) {
+	return v.allocation, nil
+}
+
+// SetAllocation sets the value to be returned by Allocation()
+func (v *FakeStorageVolume) SetAllocation(allocation uint64) {
+	v.allocation = allocation
+}
+
 func (v *FakeStorageVolume) Path() (string, error) {
 	return v.path, nil
 }
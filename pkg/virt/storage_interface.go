@@ -32,6 +32,18 @@ var ErrStoragePoolNotFound = errors.New("storage pool not found")
 // be found
 var ErrStorageVolumeNotFound = errors.New("storage volume not found")
 
+// QCOW2Options specifies qemu-img creation options for qcow2
+// volumes. Zero values denote qemu-img defaults.
+type QCOW2Options struct {
+	// Preallocation is the preallocation mode, either
+	// "metadata" or "falloc"
+	Preallocation string
+	// ClusterSize is the cluster size in bytes
+	ClusterSize uint64
+	// LazyRefcounts enables lazy_refcounts feature
+	LazyRefcounts bool
+}
+
 // VirtStorageConnection provides operations on the storage pools and storage volumes
 type VirtStorageConnection interface {
 	// CreateStoragePool creates a storage pool based on the specified definition
@@ -44,12 +56,15 @@ type VirtStorageConnection interface {
 
 // VirtStoragePool represents a pool of volumes
 type VirtStoragePool interface {
-	// CreateStorageVol creates a new storage volume based on the specified definition
-	CreateStorageVol(def *libvirtxml.StorageVolume) (VirtStorageVolume, error)
+	// CreateStorageVol creates a new storage volume based on the
+	// specified definition. opts specifies the options for qcow2
+	// volumes and may be nil
+	CreateStorageVol(def *libvirtxml.StorageVolume, opts *QCOW2Options) (VirtStorageVolume, error)
 	// CreateStorageVolClone creates a new storage volume clone
 	// based on the specified definition and an existing volume
-	// passed as 'from'
-	CreateStorageVolClone(def *libvirtxml.StorageVolume, from VirtStorageVolume) (VirtStorageVolume, error)
+	// passed as 'from'. opts specifies the options for qcow2
+	// volumes and may be nil
+	CreateStorageVolClone(def *libvirtxml.StorageVolume, from VirtStorageVolume, opts *QCOW2Options) (VirtStorageVolume, error)
 	// ListAllVolumes lists all storage volumes available in the pool
 	ListAllVolumes() ([]VirtStorageVolume, error)
 	// LookupVolumeByName tries to locate the storage volume by its
@@ -69,6 +84,10 @@ type VirtStorageVolume interface {
 	Name() string
 	// Size returns the size of this storage volume
 	Size() (uint64, error)
+	// Allocation returns the amount of host storage that is
+	// actually used by this storage volume, which may be less
+	// than its size for thin provisioned volumes
+	Allocation() (uint64, error)
 	// Size returns the path to the file representing this storage volume
 	Path() (string, error)
 	// Remove removes this storage volume
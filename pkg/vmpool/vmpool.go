@@ -0,0 +1,190 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmpool
+
+import (
+	"context"
+	"fmt"
+
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/rest"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const groupName = "virtlet.k8s"
+const version = "v1"
+
+var (
+	schemeBuilder      = runtime.NewSchemeBuilder(addKnownTypes)
+	scheme             = runtime.NewScheme()
+	schemeGroupVersion = schema.GroupVersion{Group: groupName, Version: version}
+)
+
+// VirtualMachinePoolSpec describes the standby VMs that are kept
+// booted on the nodes so they can be claimed by the pods
+type VirtualMachinePoolSpec struct {
+	// Image is the image of the VMs. It must match the
+	// image of the pods that claim the VMs
+	Image string `json:"image"`
+	// Size is the number of standby VMs on each node
+	Size int `json:"size"`
+	// NodeSelector limits the pool to the nodes that have
+	// the specified labels. Empty selector matches all nodes
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// VCPUCount is the number of vCPUs of the VMs.
+	// It must match VirtletVCPUCount annotation of the pods
+	VCPUCount int `json:"vcpuCount,omitempty"`
+	// Memory is the memory limit of the VMs, e.g. "1Gi".
+	// It must match the memory limit of the pods
+	Memory string `json:"memory,omitempty"`
+}
+
+// VirtualMachinePool represents a pool of standby VMs
+type VirtualMachinePool struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               VirtualMachinePoolSpec `json:"spec"`
+}
+
+// VirtualMachinePoolList is a k8s representation of list of VM pools
+type VirtualMachinePoolList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata"`
+	Items            []VirtualMachinePool `json:"items"`
+}
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(schemeGroupVersion,
+		&VirtualMachinePool{},
+		&VirtualMachinePoolList{},
+	)
+	meta_v1.AddToGroupVersion(scheme, schemeGroupVersion)
+	return nil
+}
+
+func init() {
+	if err := schemeBuilder.AddToScheme(scheme); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterCustomResourceType registers custom resource definition for VirtualMachinePool kind in k8s
+func RegisterCustomResourceType() error {
+	crd := apiextensionsv1beta1.CustomResourceDefinition{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Name: "virtualmachinepools." + groupName,
+		},
+		Spec: apiextensionsv1beta1.CustomResourceDefinitionSpec{
+			Group:   groupName,
+			Version: version,
+			Scope:   apiextensionsv1beta1.NamespaceScoped,
+			Names: apiextensionsv1beta1.CustomResourceDefinitionNames{
+				Plural:     "virtualmachinepools",
+				Singular:   "virtualmachinepool",
+				Kind:       "VirtualMachinePool",
+				ShortNames: []string{"vmpool"},
+			},
+		},
+	}
+	cfg, err := utils.GetK8sClientConfig("")
+	if err != nil || cfg.Host == "" {
+		return err
+	}
+	extensionsClientSet, err := apiextensionsclient.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+
+	_, err = extensionsClientSet.CustomResourceDefinitions().Create(&crd)
+	if err == nil || errors.IsAlreadyExists(err) {
+		return nil
+	}
+	return err
+}
+
+// MatchesNode returns true if the pool is applicable to
+// the node with the specified labels
+func (p VirtualMachinePool) MatchesNode(nodeLabels map[string]string) bool {
+	for k, v := range p.Spec.NodeSelector {
+		if nodeLabels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// MemoryBytes returns the memory limit of the VMs in bytes,
+// or 0 if it's not specified
+func (p VirtualMachinePool) MemoryBytes() (int64, error) {
+	if p.Spec.Memory == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(p.Spec.Memory)
+	if err != nil {
+		return 0, fmt.Errorf("bad memory size %q for VM pool %q: %v", p.Spec.Memory, p.Name, err)
+	}
+	return q.Value(), nil
+}
+
+// ListPools returns the VM pools from the specified namespace
+// that match the node with the specified labels
+func ListPools(ctx context.Context, namespace string, nodeLabels map[string]string) ([]VirtualMachinePool, error) {
+	cfg, err := utils.GetK8sClientConfig("")
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Host == "" {
+		return nil, nil
+	}
+
+	client, err := getCRDRestClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var list VirtualMachinePoolList
+	err = client.Get().
+		Context(ctx).
+		Resource("virtualmachinepools").
+		Namespace(namespace).
+		Do().Into(&list)
+	if err != nil {
+		return nil, err
+	}
+	return filterPools(list.Items, nodeLabels), nil
+}
+
+func filterPools(pools []VirtualMachinePool, nodeLabels map[string]string) []VirtualMachinePool {
+	var r []VirtualMachinePool
+	for _, p := range pools {
+		if p.MatchesNode(nodeLabels) {
+			r = append(r, p)
+		}
+	}
+	return r
+}
+
+func getCRDRestClient(cfg *rest.Config) (*rest.RESTClient, error) {
+	return utils.GetK8sRestClient(cfg, scheme, &schemeGroupVersion)
+}
@@ -0,0 +1,98 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmpool
+
+import (
+	"reflect"
+	"testing"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func pool(name string, nodeSelector map[string]string) VirtualMachinePool {
+	return VirtualMachinePool{
+		ObjectMeta: meta_v1.ObjectMeta{Name: name},
+		Spec: VirtualMachinePoolSpec{
+			Image:        "cirros",
+			Size:         2,
+			NodeSelector: nodeSelector,
+		},
+	}
+}
+
+func TestFilterPools(t *testing.T) {
+	pools := []VirtualMachinePool{
+		pool("all", nil),
+		pool("ssd", map[string]string{"disk": "ssd"}),
+		pool("ssd-big", map[string]string{"disk": "ssd", "size": "big"}),
+	}
+	for _, tc := range []struct {
+		name       string
+		nodeLabels map[string]string
+		expected   []string
+	}{
+		{
+			name:     "no labels",
+			expected: []string{"all"},
+		},
+		{
+			name:       "partial match",
+			nodeLabels: map[string]string{"disk": "ssd", "size": "small"},
+			expected:   []string{"all", "ssd"},
+		},
+		{
+			name:       "full match",
+			nodeLabels: map[string]string{"disk": "ssd", "size": "big", "foo": "bar"},
+			expected:   []string{"all", "ssd", "ssd-big"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var names []string
+			for _, p := range filterPools(pools, tc.nodeLabels) {
+				names = append(names, p.Name)
+			}
+			if !reflect.DeepEqual(names, tc.expected) {
+				t.Errorf("bad pool list: %v instead of %v", names, tc.expected)
+			}
+		})
+	}
+}
+
+func TestMemoryBytes(t *testing.T) {
+	for _, tc := range []struct {
+		memory   string
+		expected int64
+		err      bool
+	}{
+		{memory: "", expected: 0},
+		{memory: "1Gi", expected: 1073741824},
+		{memory: "512M", expected: 512000000},
+		{memory: "lots", err: true},
+	} {
+		p := pool("foo", nil)
+		p.Spec.Memory = tc.memory
+		n, err := p.MemoryBytes()
+		switch {
+		case tc.err && err == nil:
+			t.Errorf("%q: didn't get an expected error", tc.memory)
+		case !tc.err && err != nil:
+			t.Errorf("%q: unexpected error: %v", tc.memory, err)
+		case n != tc.expected:
+			t.Errorf("%q: bad memory size %d instead of %d", tc.memory, n, tc.expected)
+		}
+	}
+}
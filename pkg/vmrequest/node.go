@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmrequest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/kubernetes/pkg/client/retry"
+)
+
+// SnapshotExporter uploads the snapshot described by the request
+// and returns its size
+type SnapshotExporter func(r *VirtletSnapshotRequest) (int64, error)
+
+type statusSetter func(r *VirtletSnapshotRequest, status SnapshotRequestStatus) error
+
+// snapshotRequestRunner handles the snapshot requests that are
+// assigned to the node
+type snapshotRequestRunner struct {
+	sync.Mutex
+	nodeName  string
+	export    SnapshotExporter
+	setStatus statusSetter
+	// handled contains the requests that were taken by the
+	// runner. The requests are kept there until they're deleted,
+	// so the snapshot isn't uploaded again if a stale copy of
+	// the request is seen after the status is updated
+	handled map[types.UID]bool
+}
+
+func newSnapshotRequestRunner(nodeName string, export SnapshotExporter, setStatus statusSetter) *snapshotRequestRunner {
+	return &snapshotRequestRunner{
+		nodeName:  nodeName,
+		export:    export,
+		setStatus: setStatus,
+		handled:   make(map[types.UID]bool),
+	}
+}
+
+// take returns true if the runner must handle the request
+func (sr *snapshotRequestRunner) take(r *VirtletSnapshotRequest) bool {
+	if r.Status.Phase != PhasePending || r.Status.NodeName != sr.nodeName {
+		return false
+	}
+	sr.Lock()
+	defer sr.Unlock()
+	if sr.handled[r.UID] {
+		return false
+	}
+	sr.handled[r.UID] = true
+	return true
+}
+
+func (sr *snapshotRequestRunner) forget(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if r, ok := obj.(*VirtletSnapshotRequest); ok {
+		sr.Lock()
+		defer sr.Unlock()
+		delete(sr.handled, r.UID)
+	}
+}
+
+func (sr *snapshotRequestRunner) run(r *VirtletSnapshotRequest) {
+	status := SnapshotRequestStatus{Phase: PhaseDone, NodeName: sr.nodeName}
+	size, err := sr.export(r)
+	if err != nil {
+		glog.Errorf("Snapshot request %s/%s failed: %v", r.Namespace, r.Name, err)
+		status.Phase = PhaseFailed
+		status.Message = err.Error()
+	} else {
+		glog.V(1).Infof("Snapshot request %s/%s done, %d bytes uploaded", r.Namespace, r.Name, size)
+		status.Size = size
+	}
+	if err := sr.setStatus(r, status); err != nil {
+		glog.Errorf("Error updating the status of snapshot request %s/%s: %v", r.Namespace, r.Name, err)
+	}
+}
+
+func (sr *snapshotRequestRunner) handle(obj interface{}) {
+	if r, ok := obj.(*VirtletSnapshotRequest); ok && sr.take(r) {
+		go sr.run(r)
+	}
+}
+
+// setSnapshotRequestStatus updates the status of the snapshot
+// request, retrying if the request was changed by someone else
+func setSnapshotRequestStatus(client rest.Interface, r *VirtletSnapshotRequest, status SnapshotRequestStatus) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var cur VirtletSnapshotRequest
+		if err := client.Get().
+			Namespace(r.Namespace).
+			Resource(SnapshotRequestResource).
+			Name(r.Name).
+			Do().
+			Into(&cur); err != nil {
+			return err
+		}
+		cur.Status = status
+		return UpdateSnapshotRequest(client, &cur)
+	})
+}
+
+// RunNodeSnapshotRequests handles the snapshot requests that are
+// assigned to the specified node by virtlet-controller until stopCh
+// is closed. The snapshots are uploaded using export and the status
+// of the requests is updated after the upload finishes
+func RunNodeSnapshotRequests(client rest.Interface, nodeName string, resync time.Duration, export SnapshotExporter, stopCh <-chan struct{}) {
+	sr := newSnapshotRequestRunner(nodeName, export, func(r *VirtletSnapshotRequest, status SnapshotRequestStatus) error {
+		return setSnapshotRequestStatus(client, r, status)
+	})
+	lw := NewNodeSnapshotRequestListWatch(client, nodeName)
+	_, informer := cache.NewInformer(lw, &VirtletSnapshotRequest{}, resync, cache.ResourceEventHandlerFuncs{
+		AddFunc:    sr.handle,
+		UpdateFunc: func(_, obj interface{}) { sr.handle(obj) },
+		DeleteFunc: sr.forget,
+	})
+	informer.Run(stopCh)
+}
@@ -0,0 +1,296 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vmrequest defines VirtletSnapshotRequest and
+// VirtletMigrationRequest resources, which are handled by
+// virtlet-controller together with Virtlet on the nodes.
+package vmrequest
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	apiextensionsv1beta1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1beta1"
+	apiextensionsclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	groupName = "virtlet.k8s"
+	version   = "v1"
+
+	// SnapshotRequestResource is the resource name of
+	// VirtletSnapshotRequest objects
+	SnapshotRequestResource = "virtletsnapshotrequests"
+	// MigrationRequestResource is the resource name of
+	// VirtletMigrationRequest objects
+	MigrationRequestResource = "virtletmigrationrequests"
+	// NodeLabel is the label that's set by virtlet-controller
+	// on the requests that are assigned to a node
+	NodeLabel = "virtlet.k8s/node"
+
+	defaultVolume = "root"
+)
+
+// Phase denotes the processing phase of a request
+type Phase string
+
+const (
+	// PhasePending means that the request is assigned to
+	// the node that runs the pod and is not handled yet
+	PhasePending Phase = "Pending"
+	// PhaseDone means that the request is completed
+	PhaseDone Phase = "Done"
+	// PhaseFailed means that the request has failed
+	PhaseFailed Phase = "Failed"
+)
+
+var (
+	schemeBuilder      = runtime.NewSchemeBuilder(addKnownTypes)
+	scheme             = runtime.NewScheme()
+	schemeGroupVersion = schema.GroupVersion{Group: groupName, Version: version}
+)
+
+// SnapshotRequestSpec describes a snapshot of a VM volume that
+// must be uploaded to S3-compatible object storage
+type SnapshotRequestSpec struct {
+	// PodName is the name of the VM pod in the
+	// namespace of the request
+	PodName string `json:"podName"`
+	// Volume is the name of the volume, "root" by default
+	Volume string `json:"volume,omitempty"`
+	// URL is the URL of the object to upload
+	URL string `json:"url"`
+	// Secret is the name of the secret in the namespace of
+	// the request that holds object storage credentials
+	Secret string `json:"secret"`
+}
+
+// SnapshotRequestStatus describes the outcome of a snapshot request
+type SnapshotRequestStatus struct {
+	// Phase is the processing phase of the request
+	Phase Phase `json:"phase,omitempty"`
+	// NodeName is the node the request is assigned to
+	NodeName string `json:"nodeName,omitempty"`
+	// Message describes the error if the request has failed
+	Message string `json:"message,omitempty"`
+	// Size is the size of the uploaded snapshot
+	Size int64 `json:"size,omitempty"`
+}
+
+// VirtletSnapshotRequest represents a request to upload a snapshot
+// of a VM volume to object storage
+type VirtletSnapshotRequest struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               SnapshotRequestSpec   `json:"spec"`
+	Status             SnapshotRequestStatus `json:"status,omitempty"`
+}
+
+// VirtletSnapshotRequestList is a k8s representation of list of
+// snapshot requests
+type VirtletSnapshotRequestList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata"`
+	Items            []VirtletSnapshotRequest `json:"items"`
+}
+
+// MigrationRequestSpec describes a migration of a VM
+// to another node
+type MigrationRequestSpec struct {
+	// PodName is the name of the VM pod in the
+	// namespace of the request
+	PodName string `json:"podName"`
+	// TargetNode is the node to migrate the VM to
+	TargetNode string `json:"targetNode,omitempty"`
+}
+
+// MigrationRequestStatus describes the outcome of a migration request
+type MigrationRequestStatus struct {
+	// Phase is the processing phase of the request
+	Phase Phase `json:"phase,omitempty"`
+	// Message describes the error if the request has failed
+	Message string `json:"message,omitempty"`
+}
+
+// VirtletMigrationRequest represents a request to migrate a VM
+// to another node
+type VirtletMigrationRequest struct {
+	meta_v1.TypeMeta   `json:",inline"`
+	meta_v1.ObjectMeta `json:"metadata"`
+	Spec               MigrationRequestSpec   `json:"spec"`
+	Status             MigrationRequestStatus `json:"status,omitempty"`
+}
+
+// VirtletMigrationRequestList is a k8s representation of list of
+// migration requests
+type VirtletMigrationRequestList struct {
+	meta_v1.TypeMeta `json:",inline"`
+	meta_v1.ListMeta `json:"metadata"`
+	Items            []VirtletMigrationRequest `json:"items"`
+}
+
+func addKnownTypes(scheme *runtime.Scheme) error {
+	scheme.AddKnownTypes(schemeGroupVersion,
+		&VirtletSnapshotRequest{},
+		&VirtletSnapshotRequestList{},
+		&VirtletMigrationRequest{},
+		&VirtletMigrationRequestList{},
+	)
+	meta_v1.AddToGroupVersion(scheme, schemeGroupVersion)
+	return nil
+}
+
+func init() {
+	if err := schemeBuilder.AddToScheme(scheme); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterCustomResourceTypes registers custom resource definitions
+// for VirtletSnapshotRequest and VirtletMigrationRequest kinds in k8s
+func RegisterCustomResourceTypes() error {
+	cfg, err := utils.GetK8sClientConfig("")
+	if err != nil || cfg.Host == "" {
+		return err
+	}
+	extensionsClientSet, err := apiextensionsclient.NewForConfig(cfg)
+	if err != nil {
+		return err
+	}
+	for _, names := range []apiextensionsv1beta1.CustomResourceDefinitionNames{
+		{
+			Plural:     SnapshotRequestResource,
+			Singular:   "virtletsnapshotrequest",
+			Kind:       "VirtletSnapshotRequest",
+			ShortNames: []string{"vsr"},
+		},
+		{
+			Plural:     MigrationRequestResource,
+			Singular:   "virtletmigrationrequest",
+			Kind:       "VirtletMigrationRequest",
+			ShortNames: []string{"vmr"},
+		},
+	} {
+		crd := apiextensionsv1beta1.CustomResourceDefinition{
+			ObjectMeta: meta_v1.ObjectMeta{
+				Name: names.Plural + "." + groupName,
+			},
+			Spec: apiextensionsv1beta1.CustomResourceDefinitionSpec{
+				Group:   groupName,
+				Version: version,
+				Scope:   apiextensionsv1beta1.NamespaceScoped,
+				Names:   names,
+			},
+		}
+		_, err = extensionsClientSet.CustomResourceDefinitions().Create(&crd)
+		if err != nil && !k8serrors.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// VolumeName returns the name of the volume to take
+// the snapshot of
+func (r *VirtletSnapshotRequest) VolumeName() string {
+	if r.Spec.Volume == "" {
+		return defaultVolume
+	}
+	return r.Spec.Volume
+}
+
+// Validate verifies the spec of the snapshot request
+func (r *VirtletSnapshotRequest) Validate() error {
+	switch {
+	case r.Spec.PodName == "":
+		return errors.New("pod name must be specified")
+	case r.Spec.Secret == "":
+		return errors.New("secret name must be specified")
+	}
+	u, err := url.Parse(r.Spec.URL)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("bad object URL %q", r.Spec.URL)
+	}
+	return nil
+}
+
+// GetCRDRestClient returns ReST client that can be used to work
+// with VM requests
+func GetCRDRestClient(cfg *rest.Config) (*rest.RESTClient, error) {
+	return utils.GetK8sRestClient(cfg, scheme, &schemeGroupVersion)
+}
+
+// UpdateSnapshotRequest updates the snapshot request. It fails
+// if the request was changed by someone else after it was retrieved
+func UpdateSnapshotRequest(client rest.Interface, r *VirtletSnapshotRequest) error {
+	return client.Put().
+		Namespace(r.Namespace).
+		Resource(SnapshotRequestResource).
+		Name(r.Name).
+		Body(r).
+		Do().
+		Error()
+}
+
+// UpdateMigrationRequest updates the migration request. It fails
+// if the request was changed by someone else after it was retrieved
+func UpdateMigrationRequest(client rest.Interface, r *VirtletMigrationRequest) error {
+	return client.Put().
+		Namespace(r.Namespace).
+		Resource(MigrationRequestResource).
+		Name(r.Name).
+		Body(r).
+		Do().
+		Error()
+}
+
+// NewNodeSnapshotRequestListWatch returns a ListWatch for the
+// snapshot requests from all namespaces that are assigned to
+// the specified node
+func NewNodeSnapshotRequestListWatch(client cache.Getter, nodeName string) *cache.ListWatch {
+	selector := NodeLabel + "=" + nodeName
+	return &cache.ListWatch{
+		ListFunc: func(options meta_v1.ListOptions) (runtime.Object, error) {
+			options.LabelSelector = selector
+			return client.Get().
+				Resource(SnapshotRequestResource).
+				VersionedParams(&options, meta_v1.ParameterCodec).
+				Do().
+				Get()
+		},
+		WatchFunc: func(options meta_v1.ListOptions) (watch.Interface, error) {
+			options.Watch = true
+			options.LabelSelector = selector
+			return client.Get().
+				Resource(SnapshotRequestResource).
+				VersionedParams(&options, meta_v1.ParameterCodec).
+				Watch()
+		},
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vmrequest
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+func snapshotRequest(name string, spec SnapshotRequestSpec, status SnapshotRequestStatus) *VirtletSnapshotRequest {
+	return &VirtletSnapshotRequest{
+		ObjectMeta: meta_v1.ObjectMeta{
+			Namespace: "default",
+			Name:      name,
+			UID:       types.UID("uid-" + name),
+		},
+		Spec:   spec,
+		Status: status,
+	}
+}
+
+func TestValidateSnapshotRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		spec  SnapshotRequestSpec
+		valid bool
+	}{
+		{
+			name:  "valid",
+			spec:  SnapshotRequestSpec{PodName: "vm", URL: "https://s3.example.com/bucket/vm.qcow2", Secret: "creds"},
+			valid: true,
+		},
+		{
+			name: "no pod name",
+			spec: SnapshotRequestSpec{URL: "https://s3.example.com/bucket/vm.qcow2", Secret: "creds"},
+		},
+		{
+			name: "no secret",
+			spec: SnapshotRequestSpec{PodName: "vm", URL: "https://s3.example.com/bucket/vm.qcow2"},
+		},
+		{
+			name: "bad url scheme",
+			spec: SnapshotRequestSpec{PodName: "vm", URL: "ftp://s3.example.com/bucket/vm.qcow2", Secret: "creds"},
+		},
+		{
+			name: "no host",
+			spec: SnapshotRequestSpec{PodName: "vm", URL: "/bucket/vm.qcow2", Secret: "creds"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := snapshotRequest("req", tc.spec, SnapshotRequestStatus{}).Validate()
+			switch {
+			case tc.valid && err != nil:
+				t.Errorf("Validate(): %v", err)
+			case !tc.valid && err == nil:
+				t.Errorf("Validate() didn't fail for an invalid request")
+			}
+		})
+	}
+}
+
+func TestVolumeName(t *testing.T) {
+	if name := snapshotRequest("req", SnapshotRequestSpec{}, SnapshotRequestStatus{}).VolumeName(); name != "root" {
+		t.Errorf("bad default volume name %q", name)
+	}
+	if name := snapshotRequest("req", SnapshotRequestSpec{Volume: "data"}, SnapshotRequestStatus{}).VolumeName(); name != "data" {
+		t.Errorf("bad volume name %q", name)
+	}
+}
+
+func TestSnapshotRequestRunner(t *testing.T) {
+	statusCh := make(chan SnapshotRequestStatus, 10)
+	var exported []string
+	sr := newSnapshotRequestRunner("node1", func(r *VirtletSnapshotRequest) (int64, error) {
+		exported = append(exported, r.Name)
+		if r.Name == "fail" {
+			return 0, errors.New("export failed")
+		}
+		return 4242, nil
+	}, func(r *VirtletSnapshotRequest, status SnapshotRequestStatus) error {
+		statusCh <- status
+		return nil
+	})
+	handle := func(r *VirtletSnapshotRequest) *SnapshotRequestStatus {
+		if !sr.take(r) {
+			return nil
+		}
+		sr.run(r)
+		select {
+		case status := <-statusCh:
+			return &status
+		case <-time.After(time.Second):
+			t.Fatalf("the status of %q wasn't updated", r.Name)
+			return nil
+		}
+	}
+
+	spec := SnapshotRequestSpec{PodName: "vm", URL: "https://s3.example.com/bucket/vm.qcow2", Secret: "creds"}
+	pending := SnapshotRequestStatus{Phase: PhasePending, NodeName: "node1"}
+	ok := snapshotRequest("ok", spec, pending)
+	for _, tc := range []struct {
+		name     string
+		r        *VirtletSnapshotRequest
+		expected *SnapshotRequestStatus
+	}{
+		{
+			name:     "successful export",
+			r:        ok,
+			expected: &SnapshotRequestStatus{Phase: PhaseDone, NodeName: "node1", Size: 4242},
+		},
+		{
+			name: "stale copy of a handled request",
+			r:    ok,
+		},
+		{
+			name:     "failed export",
+			r:        snapshotRequest("fail", spec, pending),
+			expected: &SnapshotRequestStatus{Phase: PhaseFailed, NodeName: "node1", Message: "export failed"},
+		},
+		{
+			name: "request assigned to another node",
+			r:    snapshotRequest("other-node", spec, SnapshotRequestStatus{Phase: PhasePending, NodeName: "node2"}),
+		},
+		{
+			name: "request that's not assigned yet",
+			r:    snapshotRequest("new", spec, SnapshotRequestStatus{}),
+		},
+		{
+			name: "completed request",
+			r:    snapshotRequest("done", spec, SnapshotRequestStatus{Phase: PhaseDone, NodeName: "node1"}),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status := handle(tc.r)
+			if !reflect.DeepEqual(status, tc.expected) {
+				t.Errorf("bad status: %#v instead of %#v", status, tc.expected)
+			}
+		})
+	}
+	if expected := []string{"ok", "fail"}; !reflect.DeepEqual(exported, expected) {
+		t.Errorf("bad list of exported snapshots: %v instead of %v", exported, expected)
+	}
+
+	// deleting the request removes it from the list of
+	// the handled ones
+	sr.forget(cache.DeletedFinalStateUnknown{Key: "default/ok", Obj: ok})
+	if status := handle(ok); status == nil || status.Phase != PhaseDone {
+		t.Errorf("the request wasn't handled after it was forgotten")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package vsock provides a way to connect to the services running
+// inside VMs via virtio-vsock from the host side.
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// HostCID is the CID used to address the host from the guest
+const HostCID uint32 = 2
+
+// Addr denotes vsock endpoint
+type Addr struct {
+	CID  uint32
+	Port uint32
+}
+
+var _ net.Addr = &Addr{}
+
+// Network implements Network method of net.Addr
+func (a *Addr) Network() string { return "vsock" }
+
+// String implements String method of net.Addr
+func (a *Addr) String() string { return fmt.Sprintf("%d:%d", a.CID, a.Port) }
+
+// conn wraps vsock file descriptor to provide net.Conn interface
+type conn struct {
+	*os.File
+	local, remote *Addr
+}
+
+var _ net.Conn = &conn{}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
@@ -0,0 +1,91 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// SO_VM_SOCKETS_CONNECT_TIMEOUT from linux/vm_sockets.h
+const soVMSocketsConnectTimeout = 6
+
+// Dial connects to the specified port of the VM with the specified CID
+func Dial(cid, port uint32) (net.Conn, error) {
+	return DialTimeout(cid, port, 0)
+}
+
+// DialTimeout connects to the specified port of the VM with the
+// specified CID, failing if the connection can't be established
+// within the specified timeout. Zero timeout means using the kernel
+// default (2 seconds)
+func DialTimeout(cid, port uint32, timeout time.Duration) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("can't create vsock socket: %v", err)
+	}
+
+	ok := false
+	defer func() {
+		if !ok {
+			unix.Close(fd)
+		}
+	}()
+
+	if timeout > 0 {
+		tv := unix.NsecToTimeval(timeout.Nanoseconds())
+		if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.AF_VSOCK, soVMSocketsConnectTimeout, uintptr(unsafe.Pointer(&tv)), unsafe.Sizeof(tv), 0); errno != 0 {
+			return nil, fmt.Errorf("can't set vsock connect timeout: %v", errno)
+		}
+	}
+
+	remote := &Addr{CID: cid, Port: port}
+	for {
+		err = unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port})
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can't connect to vsock %s: %v", remote, err)
+	}
+
+	local := &Addr{}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vmAddr, isVM := sa.(*unix.SockaddrVM); isVM {
+			local.CID, local.Port = vmAddr.CID, vmAddr.Port
+		}
+	}
+
+	// non-blocking mode makes os.File use the runtime poller
+	// so the deadlines can be used
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return nil, fmt.Errorf("can't set vsock socket to non-blocking mode: %v", err)
+	}
+
+	ok = true
+	return &conn{
+		File:   os.NewFile(uintptr(fd), "vsock:"+remote.String()),
+		local:  local,
+		remote: remote,
+	}, nil
+}
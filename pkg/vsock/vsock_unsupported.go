@@ -0,0 +1,37 @@
+// +build !linux
+
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsock
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// Dial connects to the specified port of the VM with the specified CID
+func Dial(cid, port uint32) (net.Conn, error) {
+	return nil, errors.New("not implemented")
+}
+
+// DialTimeout connects to the specified port of the VM with the
+// specified CID, failing if the connection can't be established
+// within the specified timeout
+func DialTimeout(cid, port uint32, timeout time.Duration) (net.Conn, error) {
+	return nil, errors.New("not implemented")
+}
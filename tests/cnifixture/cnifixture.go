@@ -0,0 +1,211 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package cnifixture provides a builder for the CNI results that
+// are used as test fixtures, so the tests don't need to spell out
+// the whole result structure for each case.
+package cnifixture
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+)
+
+// SandboxPlaceholder is the sandbox path that's used for the
+// interfaces in the pod network namespace by default. The tests
+// replace it with the actual path of the namespace
+const SandboxPlaceholder = "placeholder"
+
+// MAC returns the MAC address for the interface with the specified
+// index. The addresses are stable across the test runs
+func MAC(n int) string {
+	return fmt.Sprintf("42:a4:a6:22:80:%02x", 0x2e+n)
+}
+
+// Builder constructs a CNI result. The builder methods panic
+// upon invalid arguments, as they're only used with constant
+// test data
+type Builder struct {
+	result *cnicurrent.Result
+}
+
+// NewResult returns a new Builder for an empty CNI result
+func NewResult() *Builder {
+	return &Builder{result: &cnicurrent.Result{}}
+}
+
+// MultiInterfaceResult returns a Builder for a result with the
+// specified number of interfaces in the pod network namespace
+// named eth0, eth1 and so on, with the MAC addresses returned by
+// MAC(). Interface N gets 10.<N+1>.90.5/24 address. The default
+// route goes via 10.1.90.1, which is also set as the gateway of
+// the first interface
+func MultiInterfaceResult(n int) *Builder {
+	b := NewResult()
+	for i := 0; i < n; i++ {
+		gateway := ""
+		if i == 0 {
+			gateway = "10.1.90.1"
+		}
+		b.Interface(fmt.Sprintf("eth%d", i), MAC(i)).IP(fmt.Sprintf("10.%d.90.5/24", i+1), gateway)
+	}
+	if n > 0 {
+		b.DefaultRoute("10.1.90.1")
+	}
+	return b
+}
+
+// Interface adds an interface in the pod network namespace
+// with the sandbox set to SandboxPlaceholder
+func (b *Builder) Interface(name, mac string) *Builder {
+	b.result.Interfaces = append(b.result.Interfaces, &cnicurrent.Interface{
+		Name:    name,
+		Mac:     mac,
+		Sandbox: SandboxPlaceholder,
+	})
+	return b
+}
+
+// HostInterface adds an interface that resides outside of the
+// pod network namespace, such as a bridge on the host
+func (b *Builder) HostInterface(name, mac string) *Builder {
+	b.result.Interfaces = append(b.result.Interfaces, &cnicurrent.Interface{
+		Name: name,
+		Mac:  mac,
+	})
+	return b
+}
+
+// InSandbox sets the sandbox of the last added interface
+func (b *Builder) InSandbox(sandbox string) *Builder {
+	b.lastInterface().Sandbox = sandbox
+	return b
+}
+
+// IP adds an address in CIDR notation to the last added interface.
+// Empty gateway means that the address has no gateway. The IP
+// version is determined by the address
+func (b *Builder) IP(cidr, gateway string) *Builder {
+	b.lastInterface()
+	b.addIP(len(b.result.Interfaces)-1, cidr, gateway)
+	return b
+}
+
+// IPForInterface adds an address in CIDR notation for the
+// interface with the specified index, which doesn't have to
+// be valid, so broken results can be constructed, too
+func (b *Builder) IPForInterface(n int, cidr, gateway string) *Builder {
+	b.addIP(n, cidr, gateway)
+	return b
+}
+
+func (b *Builder) addIP(n int, cidr, gateway string) {
+	ipConfig := &cnicurrent.IPConfig{
+		Version:   "4",
+		Interface: n,
+		Address:   mustParseCIDR(cidr),
+	}
+	if ipConfig.Address.IP.To4() == nil {
+		ipConfig.Version = "6"
+	}
+	if gateway != "" {
+		ipConfig.Gateway = mustParseIP(gateway)
+	}
+	b.result.IPs = append(b.result.IPs, ipConfig)
+}
+
+// Route adds a route to the destination in CIDR notation. Empty
+// gateway means that the route has no gateway
+func (b *Builder) Route(dst, gateway string) *Builder {
+	route := &cnitypes.Route{Dst: mustParseCIDR(dst)}
+	if gateway != "" {
+		route.GW = mustParseIP(gateway)
+	}
+	b.result.Routes = append(b.result.Routes, route)
+	return b
+}
+
+// DefaultRoute adds the default route via the specified
+// gateway, which may be either an IPv4 or an IPv6 address
+func (b *Builder) DefaultRoute(gateway string) *Builder {
+	if mustParseIP(gateway).To4() == nil {
+		return b.Route("::/0", gateway)
+	}
+	return b.Route("0.0.0.0/0", gateway)
+}
+
+// DNS sets the nameservers of the result
+func (b *Builder) DNS(nameservers ...string) *Builder {
+	b.result.DNS.Nameservers = nameservers
+	return b
+}
+
+// Result returns a copy of the CNI result, so the builder
+// may be used to construct several similar results
+func (b *Builder) Result() *cnicurrent.Result {
+	r := &cnicurrent.Result{DNS: b.result.DNS}
+	r.DNS.Nameservers = append([]string(nil), b.result.DNS.Nameservers...)
+	for _, iface := range b.result.Interfaces {
+		c := *iface
+		r.Interfaces = append(r.Interfaces, &c)
+	}
+	for _, ipConfig := range b.result.IPs {
+		c := *ipConfig
+		r.IPs = append(r.IPs, &c)
+	}
+	for _, route := range b.result.Routes {
+		c := *route
+		r.Routes = append(r.Routes, &c)
+	}
+	return r
+}
+
+func (b *Builder) lastInterface() *cnicurrent.Interface {
+	if len(b.result.Interfaces) == 0 {
+		log.Panicf("no interfaces added to the CNI result")
+	}
+	return b.result.Interfaces[len(b.result.Interfaces)-1]
+}
+
+// mustParseIP parses an IP address, using 4-byte
+// representation for IPv4 addresses
+func mustParseIP(s string) net.IP {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		log.Panicf("bad IP address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// mustParseCIDR parses an address in CIDR notation, keeping
+// the host part of the address
+func mustParseCIDR(s string) net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		log.Panicf("bad CIDR %q: %v", s, err)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return net.IPNet{IP: ip, Mask: ipNet.Mask}
+}
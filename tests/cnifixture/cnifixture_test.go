@@ -0,0 +1,95 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cnifixture
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+)
+
+func TestBuilder(t *testing.T) {
+	b := MultiInterfaceResult(2).
+		HostInterface("cni0", "ca:ce:8c:92:4d:4a").
+		Route("10.10.42.0/24", "10.1.90.90").
+		IPForInterface(5, "fd00:1::5/64", "").
+		DNS("10.96.0.10")
+	expected := &cnicurrent.Result{
+		Interfaces: []*cnicurrent.Interface{
+			{Name: "eth0", Mac: "42:a4:a6:22:80:2e", Sandbox: SandboxPlaceholder},
+			{Name: "eth1", Mac: "42:a4:a6:22:80:2f", Sandbox: SandboxPlaceholder},
+			{Name: "cni0", Mac: "ca:ce:8c:92:4d:4a"},
+		},
+		IPs: []*cnicurrent.IPConfig{
+			{
+				Version:   "4",
+				Interface: 0,
+				Address: net.IPNet{
+					IP:   net.IP{10, 1, 90, 5},
+					Mask: net.IPMask{255, 255, 255, 0},
+				},
+				Gateway: net.IP{10, 1, 90, 1},
+			},
+			{
+				Version:   "4",
+				Interface: 1,
+				Address: net.IPNet{
+					IP:   net.IP{10, 2, 90, 5},
+					Mask: net.IPMask{255, 255, 255, 0},
+				},
+			},
+			{
+				Version:   "6",
+				Interface: 5,
+				Address: net.IPNet{
+					IP:   net.ParseIP("fd00:1::5"),
+					Mask: net.CIDRMask(64, 128),
+				},
+			},
+		},
+		Routes: []*cnitypes.Route{
+			{
+				Dst: net.IPNet{
+					IP:   net.IP{0, 0, 0, 0},
+					Mask: net.IPMask{0, 0, 0, 0},
+				},
+				GW: net.IP{10, 1, 90, 1},
+			},
+			{
+				Dst: net.IPNet{
+					IP:   net.IP{10, 10, 42, 0},
+					Mask: net.IPMask{255, 255, 255, 0},
+				},
+				GW: net.IP{10, 1, 90, 90},
+			},
+		},
+		DNS: cnitypes.DNS{Nameservers: []string{"10.96.0.10"}},
+	}
+	r := b.Result()
+	if !reflect.DeepEqual(r, expected) {
+		t.Errorf("bad result:\n%s\ninstead of\n%s", r, expected)
+	}
+
+	r.Interfaces[0].Name = "foo"
+	r.IPs = nil
+	if again := b.Result(); !reflect.DeepEqual(again, expected) {
+		t.Errorf("the result was modified via a copy:\n%s", again)
+	}
+}
@@ -141,7 +141,9 @@ func (o VMOptions) applyDefaults() framework.VMOptions {
 }
 
 func requireCloudInit() {
-	if !*includeCloudInitTests {
+	if activeProfile != nil {
+		requireGuestFeature(guestFeatureCloudInit)
+	} else if !*includeCloudInitTests {
 		Skip("Cloud-Init tests are not enabled")
 	}
 }
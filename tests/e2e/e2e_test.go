@@ -34,6 +34,11 @@ func TestE2E(t *testing.T) {
 	RegisterFailHandler(Fail)
 
 	BeforeAll(func() {
+		Expect(applyGuestProfile()).To(Succeed())
+		if activeProfile != nil {
+			By(fmt.Sprintf("Using guest image profile %s", activeProfile.Name))
+		}
+
 		var err error
 		controller, err = framework.NewController("")
 		Expect(err).ToNot(HaveOccurred())
@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/Mirantis/virtlet/tests/e2e/framework"
+	. "github.com/Mirantis/virtlet/tests/e2e/ginkgo-ext"
+)
+
+var _ = Describe("QEMU guest agent", func() {
+	var vm *framework.VMInterface
+
+	BeforeAll(func() {
+		requireGuestFeature(guestFeatureGuestAgent)
+		vm = controller.VM("guest-agent-vm")
+		Expect(vm.Create(VMOptions{}.applyDefaults(), time.Minute*5, nil)).To(Succeed())
+	})
+
+	AfterAll(func() {
+		if vm != nil {
+			deleteVM(vm)
+		}
+	})
+
+	It("Should respond to guest-ping", func() {
+		Eventually(func() error {
+			_, err := vm.VirshCommand("qemu-agent-command", "<domain>", `{"execute":"guest-ping"}`)
+			return err
+		}, "3m", "5s").Should(Succeed())
+	})
+})
@@ -0,0 +1,187 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+
+	. "github.com/Mirantis/virtlet/tests/e2e/ginkgo-ext"
+)
+
+const (
+	// guestFeatureCloudInit denotes full-featured cloud-init in the
+	// guest image (as opposed to cirros' limited implementation)
+	guestFeatureCloudInit = "cloud-init"
+	// guestFeatureGuestAgent denotes QEMU guest agent that's
+	// started in the guest image by default
+	guestFeatureGuestAgent = "guest-agent"
+)
+
+var (
+	profileName     = flag.String("profile", "", "name of the guest image profile from the profile manifest to run the tests against (overrides -image and -sshuser)")
+	profileManifest = flag.String("profile-manifest", "tests/e2e/profiles.yaml", "path to the manifest that lists the guest image profiles")
+	profileNoVerify = flag.Bool("profile-no-verify", false, "don't verify the checksum of the profile image")
+)
+
+// guestProfile describes a guest image that the tests can be run
+// against
+type guestProfile struct {
+	// Name is the name of the profile
+	Name string `yaml:"name"`
+	// Image is the image URL without http(s)://
+	Image string `yaml:"image"`
+	// SHA256 is the hex-encoded sha256 digest of the image
+	SHA256 string `yaml:"sha256,omitempty"`
+	// SHA256SumsURL is the URL of the sha256sum-style checksum file
+	// provided by the image vendor. It's used to verify the image
+	// if SHA256 is not specified
+	SHA256SumsURL string `yaml:"sha256sums,omitempty"`
+	// SSHUser is the default SSH user of the image
+	SSHUser string `yaml:"sshUser"`
+	// Features lists the guest-dependent features supported by
+	// the image
+	Features []string `yaml:"features,omitempty"`
+}
+
+func (p *guestProfile) hasFeature(feature string) bool {
+	for _, f := range p.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// expectedDigest returns the digest of the image either from the
+// manifest or from the checksum file of the image vendor
+func (p *guestProfile) expectedDigest() (string, error) {
+	if p.SHA256 != "" {
+		return p.SHA256, nil
+	}
+	if p.SHA256SumsURL == "" {
+		return "", fmt.Errorf("profile %q has neither sha256 nor sha256sums specified", p.Name)
+	}
+	resp, err := http.Get(p.SHA256SumsURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error fetching %q: %s", p.SHA256SumsURL, resp.Status)
+	}
+	fileName := path.Base(p.Image)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == fileName {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading %q: %v", p.SHA256SumsURL, err)
+	}
+	return "", fmt.Errorf("%q doesn't contain the checksum of %q", p.SHA256SumsURL, fileName)
+}
+
+// verify downloads the image and checks its digest
+func (p *guestProfile) verify() error {
+	expected, err := p.expectedDigest()
+	if err != nil {
+		return err
+	}
+	resp, err := http.Get("https://" + p.Image)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error downloading %q: %s", p.Image, resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return fmt.Errorf("error downloading %q: %v", p.Image, err)
+	}
+	if actual := fmt.Sprintf("%x", h.Sum(nil)); actual != strings.ToLower(expected) {
+		return fmt.Errorf("checksum mismatch for %q: expected %s, got %s", p.Image, expected, actual)
+	}
+	return nil
+}
+
+func loadGuestProfile(manifestPath, name string) (*guestProfile, error) {
+	data, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't read profile manifest: %v", err)
+	}
+	var profiles []*guestProfile
+	if err := yaml.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("error parsing profile manifest %q: %v", manifestPath, err)
+	}
+	for _, p := range profiles {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("profile %q not found in %q", name, manifestPath)
+}
+
+// activeProfile is the guest image profile the tests are being run
+// against, or nil if no profile is selected
+var activeProfile *guestProfile
+
+// applyGuestProfile loads the profile specified using -profile flag,
+// verifies its image and makes it the default for the VMs created by
+// the tests
+func applyGuestProfile() error {
+	if *profileName == "" {
+		return nil
+	}
+	p, err := loadGuestProfile(*profileManifest, *profileName)
+	if err != nil {
+		return err
+	}
+	if !*profileNoVerify {
+		if err := p.verify(); err != nil {
+			return err
+		}
+	}
+	*vmImageLocation = p.Image
+	if p.SSHUser != "" {
+		*sshUser = p.SSHUser
+	}
+	activeProfile = p
+	return nil
+}
+
+// requireGuestFeature skips the current test if the guest image
+// of the active profile doesn't support the specified feature. If
+// no profile is selected, the tests that depend on the guest
+// features are skipped
+func requireGuestFeature(feature string) {
+	if activeProfile == nil || !activeProfile.hasFeature(feature) {
+		Skip(fmt.Sprintf("guest image doesn't support %q", feature))
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package e2e
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/Mirantis/virtlet/tests/e2e/framework"
+	. "github.com/Mirantis/virtlet/tests/e2e/ginkgo-ext"
+)
+
+var (
+	soakDuration     = flag.Duration("soak-duration", 0, "run the soak test that creates and destroys VM pods in a loop for the specified time (0 disables the soak test)")
+	soakLeakSamples  = flag.Int("soak-leak-samples", 5, "number of consecutive growing resource counts after which the soak test reports a leak")
+	soakDebugAddress = flag.String("soak-debug-address", "/run/virtlet-debug.sock", "debug API address of Virtlet used by the soak test to check metadata store entries (empty value disables the check)")
+)
+
+// soakSample holds the counts of the node resources that must not
+// grow while the VM pods are being created and destroyed
+type soakSample map[string]int
+
+// soakMetric describes a shell command that's run in virtlet
+// container and prints a number
+type soakMetric struct {
+	name    string
+	command string
+}
+
+func soakMetrics() []soakMetric {
+	metrics := []soakMetric{
+		{"netns files", "ls /var/run/netns | wc -l"},
+		{"veth devices", "ip -o link show type veth | wc -l"},
+		{"libvirt domains", "virsh list --all --name | grep -c . || true"},
+		{"libvirt volumes", "virsh vol-list --pool volumes | grep -c '^ virtlet_' || true"},
+		{"virtlet fds", "ls /proc/$(pgrep -o -x virtlet)/fd | wc -l"},
+	}
+	if *soakDebugAddress != "" {
+		metrics = append(metrics, soakMetric{
+			"metadata entries",
+			fmt.Sprintf("virtletctl metadata -server %q | awk 'NR > 1 { n += $2 } END { print n }'", *soakDebugAddress),
+		})
+	}
+	return metrics
+}
+
+func takeSoakSample(virtletContainer framework.Executor, metrics []soakMetric) soakSample {
+	sample := soakSample{}
+	for _, m := range metrics {
+		out := do(framework.ExecSimple(virtletContainer, "/bin/sh", "-c", m.command)).(string)
+		n, err := strconv.Atoi(strings.TrimSpace(out))
+		Expect(err).NotTo(HaveOccurred(), "bad output for %s: %q", m.name, out)
+		sample[m.name] = n
+	}
+	return sample
+}
+
+// findLeaks returns the names of the metrics which kept growing
+// over the last numSamples samples
+func findLeaks(samples []soakSample, numSamples int) []string {
+	if numSamples < 2 || len(samples) < numSamples {
+		return nil
+	}
+	var leaks []string
+	last := samples[len(samples)-numSamples:]
+	for name := range last[0] {
+		growing := true
+		for i := 1; i < len(last); i++ {
+			if last[i][name] <= last[i-1][name] {
+				growing = false
+				break
+			}
+		}
+		if growing {
+			leaks = append(leaks, name)
+		}
+	}
+	return leaks
+}
+
+var _ = Describe("Soak test", func() {
+	It("Should not leak node resources while VMs are created and destroyed", func() {
+		if *soakDuration == 0 {
+			Skip("Soak test is not enabled")
+		}
+
+		virtletPod, err := controller.VirtletPod()
+		Expect(err).NotTo(HaveOccurred())
+		virtletContainer, err := virtletPod.Container("virtlet")
+		Expect(err).NotTo(HaveOccurred())
+
+		metrics := soakMetrics()
+		samples := []soakSample{takeSoakSample(virtletContainer, metrics)}
+		By(fmt.Sprintf("Initial resource counts: %v", samples[0]))
+
+		deadline := time.Now().Add(*soakDuration)
+		for cycle := 1; time.Now().Before(deadline); cycle++ {
+			vm := controller.VM(fmt.Sprintf("soak-vm-%d", cycle))
+			Expect(vm.Create(VMOptions{}.applyDefaults(), time.Minute*5, nil)).To(Succeed())
+			waitSSH(vm).Close()
+			deleteVM(vm)
+
+			sample := takeSoakSample(virtletContainer, metrics)
+			By(fmt.Sprintf("Resource counts after cycle %d: %v", cycle, sample))
+			samples = append(samples, sample)
+			if leaks := findLeaks(samples, *soakLeakSamples); len(leaks) != 0 {
+				Fail(fmt.Sprintf("possible leak detected after cycle %d, growing: %s; samples: %v", cycle, strings.Join(leaks, ", "), samples))
+			}
+		}
+	})
+})
@@ -19,12 +19,17 @@ package integration
 import (
 	"os"
 	"path"
+	"runtime"
 	"testing"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/manager"
 )
 
 type imageTester struct {
@@ -63,16 +68,26 @@ func (it *imageTester) pullSampleImage() {
 	it.pullImage(imageCirrosUrl)
 }
 
-func (it *imageTester) queryImage() *kubeapi.Image {
+func (it *imageTester) queryImageWithArch() (*kubeapi.Image, string) {
 	imageSpec := &kubeapi.ImageSpec{Image: imageCirrosUrl}
 	in := &kubeapi.ImageStatusRequest{
 		Image: imageSpec,
 	}
-	resp, err := it.imageServiceClient.ImageStatus(context.Background(), in)
+	var header metadata.MD
+	resp, err := it.imageServiceClient.ImageStatus(context.Background(), in, grpc.Header(&header))
 	if err != nil {
 		it.t.Fatalf("ImageStatus() failed: %v", err)
 	}
-	return resp.Image
+	var arch string
+	if values := header[manager.ImageArchHeader]; len(values) != 0 {
+		arch = values[0]
+	}
+	return resp.Image, arch
+}
+
+func (it *imageTester) queryImage() *kubeapi.Image {
+	image, _ := it.queryImageWithArch()
+	return image
 }
 
 func (it *imageTester) listImages(filter *kubeapi.ImageFilter) []*kubeapi.Image {
@@ -143,7 +158,11 @@ func TestImageStatus(t *testing.T) {
 
 	it.verifyNoImage()
 	it.pullSampleImage()
-	it.verifyImage(it.queryImage())
+	image, arch := it.queryImageWithArch()
+	it.verifyImage(image)
+	if arch != runtime.GOARCH {
+		t.Errorf("bad image arch reported by ImageStatus(): %q instead of %q", arch, runtime.GOARCH)
+	}
 }
 
 func TestRemoveImage(t *testing.T) {
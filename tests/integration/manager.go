@@ -45,6 +45,10 @@ func (m *fakeFDManager) ReleaseFDs(key string) error {
 	return nil
 }
 
+func (m *fakeFDManager) Report(key string, data interface{}) error {
+	return nil
+}
+
 type VirtletManager struct {
 	t       *testing.T
 	manager *manager.VirtletManager
@@ -0,0 +1,195 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package integration
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	kubeapi "k8s.io/kubernetes/pkg/kubelet/apis/cri/v1alpha1/runtime"
+
+	"github.com/Mirantis/virtlet/pkg/manager"
+	"github.com/Mirantis/virtlet/pkg/metadata"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/tests/criapi"
+)
+
+const (
+	virtletDBEnvVar        = "VIRTLET_TEST_DB_PATH"
+	virtletKillCount       = 4
+	virtletShutdownTimeout = 10 * time.Second
+)
+
+// TestVirtletProcess is not a real test. It's run in a child process
+// by TestVirtletTermination. It serves CRI requests like Virtlet
+// does until it's killed, and shuts down cleanly upon SIGTERM
+func TestVirtletProcess(t *testing.T) {
+	dbPath := os.Getenv(virtletDBEnvVar)
+	if dbPath == "" {
+		t.Skip("only used as a child process of TestVirtletTermination")
+	}
+	metadataStore, err := metadata.NewMetadataStore(dbPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't open the metadata store: %v\n", err)
+		os.Exit(1)
+	}
+	os.Setenv("KUBERNETES_CLUSTER_URL", "")
+	os.Setenv("VIRTLET_DISABLE_LOGGING", "true")
+	m, err := manager.NewVirtletManager(libvirtUri, "default", "http", "dir", "loop*", "", metadataStore, &fakeFDManager{})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't create VirtletManager: %v\n", err)
+		os.Exit(1)
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	shutdownDone := make(chan struct{})
+	go func() {
+		<-sigCh
+		m.Shutdown(virtletShutdownTimeout)
+		close(shutdownDone)
+	}()
+	if err := m.Serve(virtletSocket); err != nil {
+		fmt.Fprintf(os.Stderr, "VirtletManager result (expect closed network connection error): %v\n", err)
+	}
+	<-shutdownDone
+	os.Exit(0)
+}
+
+type virtletProcess struct {
+	t    *testing.T
+	cmd  *exec.Cmd
+	conn *grpc.ClientConn
+}
+
+func startVirtletProcess(t *testing.T, dbPath string) *virtletProcess {
+	// the socket is left behind by the processes killed
+	// using SIGKILL
+	if err := os.Remove(virtletSocket); err != nil && !os.IsNotExist(err) {
+		t.Fatalf("can't remove stale virtlet socket: %v", err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestVirtletProcess$")
+	cmd.Env = append(os.Environ(), virtletDBEnvVar+"="+dbPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("can't start virtlet process: %v", err)
+	}
+	if err := waitForSocket(virtletSocket); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("Couldn't connect to virtlet socket: %v", err)
+	}
+	conn, err := grpc.Dial(virtletSocket, grpc.WithInsecure(), grpc.WithDialer(utils.Dial))
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("Couldn't connect to virtlet socket: %v", err)
+	}
+	return &virtletProcess{t: t, cmd: cmd, conn: conn}
+}
+
+// attach makes the container tester use this process
+func (p *virtletProcess) attach(ct *containerTester) {
+	ct.runtimeServiceClient = kubeapi.NewRuntimeServiceClient(p.conn)
+	ct.imageServiceClient = kubeapi.NewImageServiceClient(p.conn)
+}
+
+// kill kills the process with the specified signal and waits for
+// it to exit. Upon SIGTERM, the process must exit cleanly removing
+// its socket
+func (p *virtletProcess) kill(sig syscall.Signal) {
+	if err := p.cmd.Process.Signal(sig); err != nil {
+		p.t.Fatalf("can't kill virtlet process: %v", err)
+	}
+	err := p.cmd.Wait()
+	p.conn.Close()
+	if sig != syscall.SIGTERM {
+		return
+	}
+	if err != nil {
+		p.t.Errorf("virtlet process didn't exit cleanly upon SIGTERM: %v", err)
+	}
+	if _, err := os.Stat(virtletSocket); !os.IsNotExist(err) {
+		p.t.Errorf("virtlet socket wasn't removed upon SIGTERM")
+	}
+}
+
+// TestVirtletTermination kills Virtlet process at random points
+// while it's handling RunPodSandbox requests, verifying that the
+// acknowledged pod sandboxes and the running VM survive the restarts
+func TestVirtletTermination(t *testing.T) {
+	dbPath, err := utils.Tempfile()
+	if err != nil {
+		t.Fatalf("Can't create temp file: %v", err)
+	}
+	defer os.Remove(dbPath)
+
+	sandboxes := criapi.GetSandboxes(virtletKillCount + 1)
+	ct := &containerTester{
+		t:          t,
+		sandboxes:  sandboxes,
+		containers: criapi.GetContainersConfig(sandboxes),
+		imageSpecs: []*kubeapi.ImageSpec{{Image: imageCirrosUrl}},
+	}
+	p := startVirtletProcess(t, dbPath)
+	p.attach(ct)
+	defer func() {
+		ct.cleanupContainers()
+		ct.cleanupPods()
+		p.kill(syscall.SIGTERM)
+	}()
+
+	container := ct.containers[0]
+	ct.pullImage(ct.imageSpecs[0])
+	ct.runPodSandbox(sandboxes[0])
+	ct.createContainer(sandboxes[0], container, ct.imageSpecs[0], nil)
+	ct.startContainer(container.ContainerId)
+
+	for i := 0; i < virtletKillCount; i++ {
+		sig := syscall.SIGTERM
+		if i%2 != 0 {
+			sig = syscall.SIGKILL
+		}
+		sandbox := sandboxes[i+1]
+		errCh := make(chan error, 1)
+		go func() {
+			// the request may or may not complete
+			// before the process is killed
+			_, err := ct.runtimeServiceClient.RunPodSandbox(context.Background(), &kubeapi.RunPodSandboxRequest{Config: sandbox})
+			errCh <- err
+		}()
+		time.Sleep(time.Duration(rand.Intn(500)) * time.Millisecond)
+		p.kill(sig)
+		acked := <-errCh == nil
+
+		p = startVirtletProcess(t, dbPath)
+		p.attach(ct)
+		if acked {
+			ct.verifyPodSandboxStateViaStatus(sandbox.Metadata.Uid, sandbox.Metadata.Name, kubeapi.PodSandboxState_SANDBOX_READY)
+		}
+		ct.verifyPodSandboxStateViaStatus(sandboxes[0].Metadata.Uid, sandboxes[0].Metadata.Name, kubeapi.PodSandboxState_SANDBOX_READY)
+		ct.verifyContainerStateViaStatus(container.ContainerId, container.Name, kubeapi.ContainerState_CONTAINER_RUNNING)
+	}
+}
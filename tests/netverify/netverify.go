@@ -0,0 +1,366 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package netverify contains helpers for checking that the
+// network namespace of a pod is restored to the state left by
+// CNI plugins after Virtlet tears down the VM network. The
+// helpers work both with the fake CNI client used by the network
+// tests and with real CNI plugins, but they must be run on the
+// node that hosts the pod network namespace.
+package netverify
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+// LinkSysctls lists the per-interface sysctls that are captured
+// for each link, relative to /proc/sys/net. %s is replaced with
+// the name of the link. The sysctls that aren't available in the
+// namespace are skipped
+var LinkSysctls = []string{
+	"ipv4/conf/%s/forwarding",
+	"ipv4/conf/%s/proxy_arp",
+	"ipv4/conf/%s/rp_filter",
+	"ipv4/conf/%s/accept_local",
+	"ipv4/conf/%s/arp_ignore",
+	"ipv6/conf/%s/disable_ipv6",
+}
+
+// NamespaceSysctls lists the namespace-wide sysctls that are
+// captured, relative to /proc/sys/net
+var NamespaceSysctls = []string{
+	"ipv4/ip_forward",
+	"bridge/bridge-nf-call-iptables",
+}
+
+// LinkState describes a network link in the namespace
+type LinkState struct {
+	// Name is the name of the link
+	Name string `json:"name"`
+	// Type is the netlink type of the link, e.g. veth or bridge
+	Type string `json:"type"`
+	// HardwareAddr is the MAC address of the link
+	HardwareAddr string `json:"hardwareAddr"`
+	// MTU is the MTU of the link
+	MTU int `json:"mtu"`
+	// Up is true if the link is administratively up
+	Up bool `json:"up"`
+	// Master is the name of the bridge the link is
+	// attached to, if any
+	Master string `json:"master,omitempty"`
+	// Addresses lists the IPv4 addresses of
+	// the link in CIDR notation
+	Addresses []string `json:"addresses,omitempty"`
+	// Sysctls maps the captured sysctls of the link
+	// (see LinkSysctls) to their values
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+}
+
+// RouteState describes an IPv4 route in the main routing table
+type RouteState struct {
+	// Link is the name of the outgoing link
+	Link string `json:"link,omitempty"`
+	// Dst is the destination of the route, with
+	// "default" denoting the default route
+	Dst string `json:"dst"`
+	// Gateway is the gateway of the route, if any
+	Gateway string `json:"gateway,omitempty"`
+	// Src is the preferred source address, if any
+	Src string `json:"src,omitempty"`
+	// Scope is the scope of the route
+	Scope string `json:"scope"`
+}
+
+func (r RouteState) String() string {
+	s := r.Dst
+	if r.Gateway != "" {
+		s += " via " + r.Gateway
+	}
+	if r.Link != "" {
+		s += " dev " + r.Link
+	}
+	if r.Src != "" {
+		s += " src " + r.Src
+	}
+	return s + " scope " + r.Scope
+}
+
+// Snapshot describes the network configuration of a namespace
+type Snapshot struct {
+	// Links lists the links in the namespace, sorted by name.
+	// The loopback link is not included
+	Links []LinkState `json:"links"`
+	// Routes lists the IPv4 routes from the main
+	// routing table, in sorted order
+	Routes []RouteState `json:"routes"`
+	// Sysctls maps the namespace-wide sysctls
+	// (see NamespaceSysctls) to their values
+	Sysctls map[string]string `json:"sysctls,omitempty"`
+}
+
+// Link returns the state of the link with the specified
+// name or nil if there's no such link in the snapshot
+func (s *Snapshot) Link(name string) *LinkState {
+	for n := range s.Links {
+		if s.Links[n].Name == name {
+			return &s.Links[n]
+		}
+	}
+	return nil
+}
+
+// TakeSnapshot captures the network configuration of the
+// specified network namespace
+func TakeSnapshot(netNS ns.NetNS) (*Snapshot, error) {
+	var s *Snapshot
+	if err := netNS.Do(func(ns.NetNS) error {
+		var err error
+		s, err = takeSnapshot()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// TakeSnapshotOfPath captures the network configuration of the
+// network namespace with the specified path, e.g. the path of
+// the pod network namespace
+func TakeSnapshotOfPath(nsPath string) (*Snapshot, error) {
+	netNS, err := ns.GetNS(nsPath)
+	if err != nil {
+		return nil, fmt.Errorf("can't open network namespace %q: %v", nsPath, err)
+	}
+	defer netNS.Close()
+	return TakeSnapshot(netNS)
+}
+
+func takeSnapshot() (*Snapshot, error) {
+	links, err := netlink.LinkList()
+	if err != nil {
+		return nil, fmt.Errorf("error listing links: %v", err)
+	}
+	linkNames := make(map[int]string)
+	for _, link := range links {
+		linkNames[link.Attrs().Index] = link.Attrs().Name
+	}
+
+	s := &Snapshot{Sysctls: readSysctls(NamespaceSysctls, "")}
+	for _, link := range links {
+		attrs := link.Attrs()
+		if attrs.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ls := LinkState{
+			Name:         attrs.Name,
+			Type:         link.Type(),
+			HardwareAddr: attrs.HardwareAddr.String(),
+			MTU:          attrs.MTU,
+			Up:           attrs.Flags&net.FlagUp != 0,
+			Master:       linkNames[attrs.MasterIndex],
+			Sysctls:      readSysctls(LinkSysctls, attrs.Name),
+		}
+		addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return nil, fmt.Errorf("error listing addresses of link %q: %v", attrs.Name, err)
+		}
+		for _, addr := range addrs {
+			ls.Addresses = append(ls.Addresses, addr.IPNet.String())
+		}
+		sort.Strings(ls.Addresses)
+		s.Links = append(s.Links, ls)
+	}
+	sort.Slice(s.Links, func(i, j int) bool { return s.Links[i].Name < s.Links[j].Name })
+
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("error listing routes: %v", err)
+	}
+	for _, route := range routes {
+		rs := RouteState{
+			Link:  linkNames[route.LinkIndex],
+			Dst:   "default",
+			Scope: scopeName(route.Scope),
+		}
+		if route.Dst != nil {
+			rs.Dst = route.Dst.String()
+		}
+		if route.Gw != nil {
+			rs.Gateway = route.Gw.String()
+		}
+		if route.Src != nil {
+			rs.Src = route.Src.String()
+		}
+		s.Routes = append(s.Routes, rs)
+	}
+	sort.Slice(s.Routes, func(i, j int) bool { return s.Routes[i].String() < s.Routes[j].String() })
+	return s, nil
+}
+
+func scopeName(scope netlink.Scope) string {
+	switch scope {
+	case netlink.SCOPE_UNIVERSE:
+		return "universe"
+	case netlink.SCOPE_SITE:
+		return "site"
+	case netlink.SCOPE_LINK:
+		return "link"
+	case netlink.SCOPE_HOST:
+		return "host"
+	case netlink.SCOPE_NOWHERE:
+		return "nowhere"
+	default:
+		return strconv.Itoa(int(scope))
+	}
+}
+
+// readSysctls reads the values of the specified sysctls. It must
+// be called from within the network namespace
+func readSysctls(names []string, linkName string) map[string]string {
+	r := make(map[string]string)
+	for _, name := range names {
+		if linkName != "" {
+			name = fmt.Sprintf(name, linkName)
+		}
+		bs, err := ioutil.ReadFile(filepath.Join("/proc/sys/net", name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				r[name] = fmt.Sprintf("<error: %v>", err)
+			}
+			continue
+		}
+		r[name] = strings.TrimSpace(string(bs))
+	}
+	if len(r) == 0 {
+		return nil
+	}
+	return r
+}
+
+// Diff returns the human-readable list of the differences between
+// the expected and the actual network configuration
+func Diff(expected, actual *Snapshot) []string {
+	var r []string
+	for _, el := range expected.Links {
+		al := actual.Link(el.Name)
+		if al == nil {
+			r = append(r, fmt.Sprintf("link %q is missing", el.Name))
+			continue
+		}
+		r = append(r, diffLinks(el, *al)...)
+	}
+	for _, al := range actual.Links {
+		if expected.Link(al.Name) == nil {
+			r = append(r, fmt.Sprintf("unexpected %s link %q", al.Type, al.Name))
+		}
+	}
+
+	expectedRoutes := make(map[RouteState]bool)
+	for _, route := range expected.Routes {
+		expectedRoutes[route] = true
+	}
+	actualRoutes := make(map[RouteState]bool)
+	for _, route := range actual.Routes {
+		actualRoutes[route] = true
+		if !expectedRoutes[route] {
+			r = append(r, fmt.Sprintf("unexpected route %s", route))
+		}
+	}
+	for _, route := range expected.Routes {
+		if !actualRoutes[route] {
+			r = append(r, fmt.Sprintf("route %s is missing", route))
+		}
+	}
+
+	return append(r, diffSysctls("", expected.Sysctls, actual.Sysctls)...)
+}
+
+func diffLinks(expected, actual LinkState) []string {
+	var r []string
+	mismatch := func(what string, expectedValue, actualValue interface{}) {
+		r = append(r, fmt.Sprintf("link %q: %s is %v instead of %v", expected.Name, what, actualValue, expectedValue))
+	}
+	if expected.Type != actual.Type {
+		mismatch("type", expected.Type, actual.Type)
+	}
+	if expected.HardwareAddr != actual.HardwareAddr {
+		mismatch("hardware address", expected.HardwareAddr, actual.HardwareAddr)
+	}
+	if expected.MTU != actual.MTU {
+		mismatch("MTU", expected.MTU, actual.MTU)
+	}
+	if expected.Up != actual.Up {
+		mismatch("up flag", expected.Up, actual.Up)
+	}
+	if expected.Master != actual.Master {
+		mismatch("master", fmt.Sprintf("%q", expected.Master), fmt.Sprintf("%q", actual.Master))
+	}
+	if strings.Join(expected.Addresses, ",") != strings.Join(actual.Addresses, ",") {
+		mismatch("address list", expected.Addresses, actual.Addresses)
+	}
+	return append(r, diffSysctls(expected.Name, expected.Sysctls, actual.Sysctls)...)
+}
+
+func diffSysctls(linkName string, expected, actual map[string]string) []string {
+	prefix := ""
+	if linkName != "" {
+		prefix = fmt.Sprintf("link %q: ", linkName)
+	}
+	var names []string
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range actual {
+		if _, found := expected[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var r []string
+	for _, name := range names {
+		expectedValue, expectedFound := expected[name]
+		actualValue, actualFound := actual[name]
+		switch {
+		case !actualFound:
+			r = append(r, fmt.Sprintf("%ssysctl %s is missing", prefix, name))
+		case !expectedFound:
+			r = append(r, fmt.Sprintf("%sunexpected sysctl %s", prefix, name))
+		case expectedValue != actualValue:
+			r = append(r, fmt.Sprintf("%ssysctl %s is %q instead of %q", prefix, name, actualValue, expectedValue))
+		}
+	}
+	return r
+}
+
+// VerifyRestored returns an error if the actual network
+// configuration differs from the expected one, which is
+// usually captured right after CNI ADD
+func VerifyRestored(expected, actual *Snapshot) error {
+	if diff := Diff(expected, actual); len(diff) != 0 {
+		return fmt.Errorf("network configuration is not restored:\n%s", strings.Join(diff, "\n"))
+	}
+	return nil
+}
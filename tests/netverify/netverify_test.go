@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package netverify
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+)
+
+func mustParseCIDR(t *testing.T, s string) *net.IPNet {
+	ip, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatalf("ParseCIDR(): %v", err)
+	}
+	ipNet.IP = ip
+	return ipNet
+}
+
+func TestSnapshotDiff(t *testing.T) {
+	netNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("NewNS(): %v", err)
+	}
+	defer netNS.Close()
+
+	var link netlink.Link
+	if err := netNS.Do(func(ns.NetNS) error {
+		veth := &netlink.Veth{
+			LinkAttrs: netlink.LinkAttrs{Name: "eth0", MTU: 1500},
+			PeerName:  "peer0",
+		}
+		if err := netlink.LinkAdd(veth); err != nil {
+			t.Fatalf("LinkAdd(): %v", err)
+		}
+		peer, err := netlink.LinkByName("peer0")
+		if err != nil {
+			t.Fatalf("LinkByName(): %v", err)
+		}
+		if err := netlink.LinkSetUp(peer); err != nil {
+			t.Fatalf("LinkSetUp(): %v", err)
+		}
+		link = veth
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: mustParseCIDR(t, "10.1.90.5/24")}); err != nil {
+			t.Fatalf("AddrAdd(): %v", err)
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			t.Fatalf("LinkSetUp(): %v", err)
+		}
+		if err := netlink.RouteAdd(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        net.ParseIP("10.1.90.1"),
+		}); err != nil {
+			t.Fatalf("RouteAdd(): %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Do(): %v", err)
+	}
+
+	before, err := TakeSnapshot(netNS)
+	if err != nil {
+		t.Fatalf("TakeSnapshot(): %v", err)
+	}
+	eth0 := before.Link("eth0")
+	switch {
+	case eth0 == nil:
+		t.Fatalf("eth0 not found in the snapshot")
+	case !eth0.Up || eth0.MTU != 1500 || eth0.Type != "veth":
+		t.Errorf("bad link state %#v", eth0)
+	case !reflect.DeepEqual(eth0.Addresses, []string{"10.1.90.5/24"}):
+		t.Errorf("bad address list %#v", eth0.Addresses)
+	}
+	if err := VerifyRestored(before, before); err != nil {
+		t.Errorf("VerifyRestored() failed for the same snapshot: %v", err)
+	}
+
+	if err := netNS.Do(func(ns.NetNS) error {
+		if err := netlink.RouteDel(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        net.ParseIP("10.1.90.1"),
+		}); err != nil {
+			t.Fatalf("RouteDel(): %v", err)
+		}
+		if err := netlink.LinkSetMTU(link, 1400); err != nil {
+			t.Fatalf("LinkSetMTU(): %v", err)
+		}
+		if err := netlink.LinkAdd(&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "br0"}}); err != nil {
+			t.Fatalf("LinkAdd(): %v", err)
+		}
+		if err := ioutil.WriteFile("/proc/sys/net/ipv4/conf/eth0/proxy_arp", []byte("1"), 0644); err != nil {
+			t.Fatalf("error setting proxy_arp: %v", err)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("Do(): %v", err)
+	}
+
+	after, err := TakeSnapshot(netNS)
+	if err != nil {
+		t.Fatalf("TakeSnapshot(): %v", err)
+	}
+	expectedDiff := []string{
+		`link "eth0": MTU is 1400 instead of 1500`,
+		`link "eth0": sysctl ipv4/conf/eth0/proxy_arp is "1" instead of "0"`,
+		`unexpected bridge link "br0"`,
+		`route default via 10.1.90.1 dev eth0 scope universe is missing`,
+	}
+	if diff := Diff(before, after); !reflect.DeepEqual(diff, expectedDiff) {
+		t.Errorf("bad diff:\n%#v\ninstead of\n%#v", diff, expectedDiff)
+	}
+	if err := VerifyRestored(before, after); err == nil {
+		t.Errorf("VerifyRestored() didn't fail for a changed network namespace")
+	}
+}
@@ -23,11 +23,10 @@ import (
 	"time"
 
 	"github.com/containernetworking/cni/pkg/ns"
-	cnitypes "github.com/containernetworking/cni/pkg/types"
-	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
 	"github.com/vishvananda/netlink"
 
 	"github.com/Mirantis/virtlet/pkg/nettools"
+	"github.com/Mirantis/virtlet/tests/cnifixture"
 )
 
 type dhcpTestCase struct {
@@ -40,43 +39,9 @@ func TestDhcpServer(t *testing.T) {
 	testCases := []*dhcpTestCase{
 		{
 			csn: nettools.ContainerSideNetwork{
-				Result: &cnicurrent.Result{
-					Interfaces: []*cnicurrent.Interface{
-						{
-							Name: "eth0",
-							Mac:  clientMacAddrs[0],
-							// Sandbox is clientNS dependent
-							// so it must be set in runtime
-						},
-					},
-					IPs: []*cnicurrent.IPConfig{
-						{
-							Version:   "4",
-							Interface: 0,
-							Address: net.IPNet{
-								IP:   net.IP{10, 1, 90, 5},
-								Mask: net.IPMask{255, 255, 255, 0},
-							},
-							Gateway: net.IP{10, 1, 90, 1},
-						},
-					},
-					Routes: []*cnitypes.Route{
-						{
-							Dst: net.IPNet{
-								IP:   net.IP{0, 0, 0, 0},
-								Mask: net.IPMask{0, 0, 0, 0},
-							},
-							GW: net.IP{10, 1, 90, 1},
-						},
-						{
-							Dst: net.IPNet{
-								IP:   net.IP{10, 10, 42, 0},
-								Mask: net.IPMask{255, 255, 255, 0},
-							},
-							GW: net.IP{10, 1, 90, 90},
-						},
-					},
-				},
+				// Sandbox is clientNS dependent
+				// so it must be set in runtime
+				Result: sampleCNIResult(),
 				Interfaces: []nettools.InterfaceDescription{
 					{
 						HardwareAddr: clientMac,
@@ -101,7 +66,23 @@ func TestDhcpServer(t *testing.T) {
 				"veth0: offered 10.1.90.5 from 169.254.254.2",
 			},
 		},
-		// TODO: add dns test case here
+		{
+			csn: nettools.ContainerSideNetwork{
+				Result: cnifixture.MultiInterfaceResult(1).DNS("10.96.0.10", "10.96.0.11").Result(),
+				Interfaces: []nettools.InterfaceDescription{
+					{
+						HardwareAddr: clientMac,
+						MTU:          1500,
+					},
+				},
+			},
+			expectedSubstrings: []string{
+				"new_domain_name_servers='10.96.0.10 10.96.0.11'",
+				"new_ip_address='10.1.90.5'",
+				"new_routers='10.1.90.1'",
+				"veth0: offered 10.1.90.5 from 169.254.254.2",
+			},
+		},
 	}
 
 	for _, testCase := range testCases {
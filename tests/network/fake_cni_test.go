@@ -17,6 +17,7 @@ limitations under the License.
 package network
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -29,6 +30,8 @@ import (
 
 	"github.com/Mirantis/virtlet/pkg/cni"
 	"github.com/Mirantis/virtlet/pkg/nettools"
+	"github.com/Mirantis/virtlet/tests/cnifixture"
+	"github.com/Mirantis/virtlet/tests/netverify"
 )
 
 // FakeCNIVethPair represents a veth pair created by the fake CNI
@@ -47,17 +50,34 @@ type FakeCNIClient struct {
 	removed                 bool
 	veths                   []FakeCNIVethPair
 	useBadResult            bool
+	// snapshotAfterAdd and snapshotAfterTeardown hold the
+	// configuration of the pod network namespace right after
+	// the network setup done by the fake CNI and right before
+	// removing the pod from the network, respectively
+	snapshotAfterAdd      *netverify.Snapshot
+	snapshotAfterTeardown *netverify.Snapshot
+	// namedNetworks maps the names of the additional networks
+	// to their CNI results
+	namedNetworks map[string]*cnicurrent.Result
+	// namedNetworkVeths maps the names of the attached
+	// additional networks to their veth pairs
+	namedNetworkVeths map[string]FakeCNIVethPair
+	// namedNetworkCalls lists the calls made for the
+	// additional networks, e.g. "ADD extra virtlet-eth1"
+	namedNetworkCalls []string
 }
 
 var _ cni.CNIClient = &FakeCNIClient{}
 
 func NewFakeCNIClient(info *cnicurrent.Result, hostNS ns.NetNS, podId, podName, podNS string) *FakeCNIClient {
 	return &FakeCNIClient{
-		info:    copyCNIResult(info),
-		hostNS:  hostNS,
-		podId:   podId,
-		podName: podName,
-		podNS:   podNS,
+		info:              copyCNIResult(info),
+		hostNS:            hostNS,
+		podId:             podId,
+		podName:           podName,
+		podNS:             podNS,
+		namedNetworks:     make(map[string]*cnicurrent.Result),
+		namedNetworkVeths: make(map[string]FakeCNIVethPair),
 	}
 }
 
@@ -79,7 +99,7 @@ func (c *FakeCNIClient) verifyPod(podId, podName, podNS string) {
 	}
 }
 
-func (c *FakeCNIClient) AddSandboxToNetwork(podId, podName, podNS string) (*cnicurrent.Result, error) {
+func (c *FakeCNIClient) AddSandboxToNetwork(ctx context.Context, podId, podName, podNS string) (*cnicurrent.Result, error) {
 	c.verifyPod(podId, podName, podNS)
 	if c.added {
 		panic("AddSandboxToNetwork() was already called")
@@ -97,35 +117,17 @@ func (c *FakeCNIClient) AddSandboxToNetwork(podId, podName, podNS string) (*cnic
 		if err != nil {
 			return nil, fmt.Errorf("can't get pod netns (path %q): %v", iface.Sandbox, err)
 		}
-		var vp FakeCNIVethPair
-		if err := c.hostNS.Do(func(ns.NetNS) error {
-			var err error
-			vp.HostSide, vp.ContSide, err = nettools.CreateEscapeVethPair(c.contNS, iface.Name, 1500)
-			return err
-		}); err != nil {
-			return nil, fmt.Errorf("failed to create escape veth pair: %v", err)
+		vp, err := c.setupVeth(iface, c.info)
+		if err != nil {
+			return nil, err
 		}
+		c.veths = append(c.veths, vp)
+	}
 
-		if err := c.contNS.Do(func(ns.NetNS) error {
-			hwAddr, err := net.ParseMAC(iface.Mac)
-			if err != nil {
-				return fmt.Errorf("error parsing hwaddr %q: %v", iface.Mac, err)
-			}
-			if err := nettools.SetHardwareAddr(vp.ContSide, hwAddr); err != nil {
-				return fmt.Errorf("SetHardwareAddr(): %v", err)
-			}
-			// mac address changed, reload the link
-			vp.ContSide, err = netlink.LinkByIndex(vp.ContSide.Attrs().Index)
-			if err != nil {
-				return fmt.Errorf("can't reload container veth info: %v", err)
-			}
-			if err := nettools.ConfigureLink(vp.ContSide, c.info); err != nil {
-				return fmt.Errorf("error configuring link %q: %v", iface.Name, err)
-			}
-			c.veths = append(c.veths, vp)
-			return nil
-		}); err != nil {
-			return nil, err
+	if c.contNS != nil {
+		var err error
+		if c.snapshotAfterAdd, err = netverify.TakeSnapshot(c.contNS); err != nil {
+			return nil, fmt.Errorf("can't take pod netns snapshot: %v", err)
 		}
 	}
 
@@ -137,7 +139,7 @@ func (c *FakeCNIClient) AddSandboxToNetwork(podId, podName, podNS string) (*cnic
 	return r, nil
 }
 
-func (c *FakeCNIClient) RemoveSandboxFromNetwork(podId, podName, podNS string) error {
+func (c *FakeCNIClient) RemoveSandboxFromNetwork(ctx context.Context, podId, podName, podNS string) error {
 	c.verifyPod(podId, podName, podNS)
 	if !c.added {
 		panic("RemoveSandboxFromNetwork() was called without prior AddSandboxToNetwork()")
@@ -147,39 +149,139 @@ func (c *FakeCNIClient) RemoveSandboxFromNetwork(podId, podName, podNS string) e
 	}
 
 	c.captureNetworkConfigAfterTeardown(podId)
+	if c.contNS != nil {
+		var err error
+		if c.snapshotAfterTeardown, err = netverify.TakeSnapshot(c.contNS); err != nil {
+			return fmt.Errorf("can't take pod netns snapshot: %v", err)
+		}
+	}
 	c.removed = true
 	return nil
 }
 
+// setupVeth creates a veth pair for the interface from the CNI
+// result with the container side in the pod network namespace
+// and configures the container side using the result
+func (c *FakeCNIClient) setupVeth(iface *cnicurrent.Interface, info *cnicurrent.Result) (FakeCNIVethPair, error) {
+	var vp FakeCNIVethPair
+	if err := c.hostNS.Do(func(ns.NetNS) error {
+		var err error
+		vp.HostSide, vp.ContSide, err = nettools.CreateEscapeVethPair(c.contNS, iface.Name, 1500)
+		return err
+	}); err != nil {
+		return vp, fmt.Errorf("failed to create escape veth pair: %v", err)
+	}
+
+	if err := c.contNS.Do(func(ns.NetNS) error {
+		hwAddr, err := net.ParseMAC(iface.Mac)
+		if err != nil {
+			return fmt.Errorf("error parsing hwaddr %q: %v", iface.Mac, err)
+		}
+		if err := nettools.SetHardwareAddr(vp.ContSide, hwAddr); err != nil {
+			return fmt.Errorf("SetHardwareAddr(): %v", err)
+		}
+		// mac address changed, reload the link
+		vp.ContSide, err = netlink.LinkByIndex(vp.ContSide.Attrs().Index)
+		if err != nil {
+			return fmt.Errorf("can't reload container veth info: %v", err)
+		}
+		if err := nettools.ConfigureLink(vp.ContSide, info); err != nil {
+			return fmt.Errorf("error configuring link %q: %v", iface.Name, err)
+		}
+		return nil
+	}); err != nil {
+		return vp, err
+	}
+	return vp, nil
+}
+
+// AddNamedNetwork makes the additional network with the specified
+// name available to AddSandboxToNamedNetwork(). The result must
+// contain a single interface in the pod network namespace, which
+// is renamed as requested by the caller
+func (c *FakeCNIClient) AddNamedNetwork(network string, info *cnicurrent.Result) {
+	c.namedNetworks[network] = copyCNIResult(info)
+}
+
+func (c *FakeCNIClient) AddSandboxToNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNS string) (*cnicurrent.Result, error) {
+	c.verifyPod(podId, podName, podNS)
+	c.VerifyAdded()
+	info, found := c.namedNetworks[network]
+	if !found {
+		return nil, fmt.Errorf("network %q not found", network)
+	}
+	if _, found := c.namedNetworkVeths[network]; found {
+		panic(fmt.Sprintf("AddSandboxToNamedNetwork() was already called for network %q", network))
+	}
+	c.namedNetworkCalls = append(c.namedNetworkCalls, fmt.Sprintf("ADD %s %s", network, ifName))
+	info = copyCNIResult(info)
+	if len(info.Interfaces) != 1 {
+		panic("the result for a named network must have exactly one interface")
+	}
+	info.Interfaces[0].Name = ifName
+	info.Interfaces[0].Sandbox = cni.PodNetNSPath(podId)
+	vp, err := c.setupVeth(info.Interfaces[0], info)
+	if err != nil {
+		return nil, err
+	}
+	c.namedNetworkVeths[network] = vp
+	return info, nil
+}
+
+func (c *FakeCNIClient) RemoveSandboxFromNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNS string) error {
+	c.verifyPod(podId, podName, podNS)
+	c.namedNetworkCalls = append(c.namedNetworkCalls, fmt.Sprintf("DEL %s %s", network, ifName))
+	vp, found := c.namedNetworkVeths[network]
+	if !found {
+		return nil
+	}
+	delete(c.namedNetworkVeths, network)
+	// removing either side of the veth pair removes the other one
+	return c.hostNS.Do(func(ns.NetNS) error {
+		return netlink.LinkDel(vp.HostSide)
+	})
+}
+
+// NamedNetworkCalls returns the list of the calls made for
+// the additional networks
+func (c *FakeCNIClient) NamedNetworkCalls() []string {
+	return c.namedNetworkCalls
+}
+
+func (c *FakeCNIClient) AddSandboxToNetworks(ctx context.Context, configFiles []string, podId, podName, podNS string) (*cnicurrent.Result, error) {
+	return nil, fmt.Errorf("FakeCNIClient doesn't support network selection")
+}
+
+func (c *FakeCNIClient) RemoveSandboxFromNetworks(ctx context.Context, configFiles []string, podId, podName, podNS string) error {
+	return fmt.Errorf("FakeCNIClient doesn't support network selection")
+}
+
 func (c *FakeCNIClient) captureNetworkConfigAfterTeardown(podId string) {
+	c.infoAfterTeardown = &cnicurrent.Result{}
 	if err := c.contNS.Do(func(ns.NetNS) error {
-		for _, ipConfig := range c.info.IPs {
-			ifaceIndex := ipConfig.Interface
-			if ifaceIndex > len(c.info.Interfaces) {
-				return fmt.Errorf("bad interface index %d", ifaceIndex)
+		for _, iface := range c.info.Interfaces {
+			if iface.Sandbox == "" {
+				continue
 			}
-			iface := c.info.Interfaces[ifaceIndex]
 			link, err := netlink.LinkByName(iface.Name)
 			if err != nil {
 				return fmt.Errorf("can't find link %q: %v", iface.Name, err)
 			}
 			linkInfo, err := nettools.ExtractLinkInfo(link, cni.PodNetNSPath(podId))
 			if err != nil {
-				return fmt.Errorf("error extracting link info: %v", err)
+				return fmt.Errorf("error extracting link info for %q: %v", iface.Name, err)
+			}
+			if len(linkInfo.Interfaces) != 1 {
+				return fmt.Errorf("more than one interface extracted")
 			}
-			if c.infoAfterTeardown == nil {
-				c.infoAfterTeardown = linkInfo
-			} else {
-				if len(linkInfo.Interfaces) != 1 {
-					return fmt.Errorf("more than one interface extracted")
-				}
-				if len(linkInfo.IPs) != 1 {
-					return fmt.Errorf("more than one ip config extracted")
-				}
-				linkInfo.IPs[0].Interface = len(c.infoAfterTeardown.Interfaces)
-				c.infoAfterTeardown.IPs = append(c.infoAfterTeardown.IPs, linkInfo.IPs[0])
-				c.infoAfterTeardown.Interfaces = append(c.infoAfterTeardown.Interfaces, linkInfo.Interfaces[0])
+			for _, ipConfig := range linkInfo.IPs {
+				ipConfig.Interface = len(c.infoAfterTeardown.Interfaces)
+				c.infoAfterTeardown.IPs = append(c.infoAfterTeardown.IPs, ipConfig)
 			}
+			c.infoAfterTeardown.Interfaces = append(c.infoAfterTeardown.Interfaces, linkInfo.Interfaces[0])
+			// the routes are extracted per link,
+			// so they don't overlap
+			c.infoAfterTeardown.Routes = append(c.infoAfterTeardown.Routes, linkInfo.Routes...)
 		}
 		return nil
 	}); err != nil {
@@ -217,6 +319,17 @@ func (c *FakeCNIClient) NetworkInfoAfterTeardown() *cnicurrent.Result {
 	return c.infoAfterTeardown
 }
 
+// VerifyTeardown checks that the configuration of the pod network
+// namespace, including the links, addresses, routes and sysctls,
+// was restored to the state left by the fake CNI
+func (c *FakeCNIClient) VerifyTeardown() error {
+	c.VerifyRemoved()
+	if c.snapshotAfterAdd == nil || c.snapshotAfterTeardown == nil {
+		return errors.New("pod network namespace snapshots are not available")
+	}
+	return netverify.VerifyRestored(c.snapshotAfterAdd, c.snapshotAfterTeardown)
+}
+
 func (c *FakeCNIClient) UseBadResult(useBadResult bool) {
 	c.useBadResult = useBadResult
 }
@@ -235,7 +348,7 @@ func copyCNIResult(result *cnicurrent.Result) *cnicurrent.Result {
 
 func replaceSandboxPlaceholders(result *cnicurrent.Result, podId string) {
 	for _, iface := range result.Interfaces {
-		if iface.Sandbox == "placeholder" {
+		if iface.Sandbox == cnifixture.SandboxPlaceholder {
 			iface.Sandbox = cni.PodNetNSPath(podId)
 		}
 	}
@@ -0,0 +1,178 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/nettools"
+	"github.com/Mirantis/virtlet/pkg/tapmanager"
+	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/tests/cnifixture"
+)
+
+func TestNetworkHotplug(t *testing.T) {
+	hostNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create host ns: %v", err)
+	}
+	defer hostNS.Close()
+
+	podId := utils.NewUuid()
+	cniClient := NewFakeCNIClient(sampleCNIResult(), hostNS, podId, samplePodName, samplePodNS)
+	defer cniClient.Cleanup()
+	for n, network := range []string{"extra1", "extra2"} {
+		cniClient.AddNamedNetwork(network, cnifixture.NewResult().Interface("eth0", cnifixture.MAC(n+1)).IP(fmt.Sprintf("10.%d.90.5/24", n+2), "").Result())
+	}
+
+	src, err := tapmanager.NewTapFDSource(cniClient)
+	if err != nil {
+		t.Fatalf("Error creating tap fd source: %v", err)
+	}
+	payload, err := json.Marshal(&tapmanager.GetFDPayload{
+		Description: &tapmanager.PodNetworkDesc{
+			PodId:   podId,
+			PodNs:   samplePodNS,
+			PodName: samplePodName,
+		},
+	})
+	if err != nil {
+		t.Fatalf("error marshalling the payload: %v", err)
+	}
+	fds, _, err := src.GetFDs(context.Background(), fdKey, payload)
+	if err != nil {
+		t.Fatalf("GetFDs(): %v", err)
+	}
+	defer func() {
+		if err := src.Release(fdKey); err != nil {
+			t.Errorf("Release(): %v", err)
+		}
+	}()
+	if len(fds) != 1 {
+		t.Fatalf("bad fd count %d instead of 1", len(fds))
+	}
+
+	var updatedFDs []int
+	updateFDs := func(fds []int) error {
+		updatedFDs = fds
+		return nil
+	}
+	attach := func(network string, expectedIndex int) {
+		updatedFDs = nil
+		desc, err := src.AttachNetwork(fdKey, network, updateFDs)
+		if err != nil {
+			t.Fatalf("AttachNetwork(): %v", err)
+		}
+		if desc.FdIndex != expectedIndex || desc.Type != nettools.InterfaceTypeTap || desc.HardwareAddr.String() != cnifixture.MAC(expectedIndex) {
+			t.Errorf("bad interface description for network %q: %#v", network, desc)
+		}
+		if len(updatedFDs) != expectedIndex+1 {
+			t.Errorf("bad fd count after attaching network %q: %d instead of %d", network, len(updatedFDs), expectedIndex+1)
+		}
+	}
+	detach := func(network string, expectedFDCount int) {
+		updatedFDs = nil
+		if err := src.DetachNetwork(fdKey, network, updateFDs); err != nil {
+			t.Fatalf("DetachNetwork(): %v", err)
+		}
+		if len(updatedFDs) != expectedFDCount {
+			t.Errorf("bad fd count after detaching network %q: %d instead of %d", network, len(updatedFDs), expectedFDCount)
+		}
+	}
+	vmRunning := func() bool {
+		for _, st := range src.DebugState() {
+			if st.Key == fdKey {
+				return st.VMRunning
+			}
+		}
+		t.Fatalf("pod network not found")
+		return false
+	}
+
+	// the VM is not started yet, so the interface is added
+	// to the list of the fds that are passed to vmwrapper
+	attach("extra1", 1)
+
+	// the VM is running, so the interface must be hot-plugged
+	// using the QMP socket which doesn't exist here, and the
+	// pod must be removed from the network after the failure
+	if _, err := src.GetInfo(fdKey); err != nil {
+		t.Fatalf("GetInfo(): %v", err)
+	}
+	if !vmRunning() {
+		t.Errorf("the VM is not marked as running after GetInfo()")
+	}
+	if _, err := src.AttachNetwork(fdKey, "extra2", updateFDs); err == nil {
+		t.Errorf("AttachNetwork() didn't fail for a running VM without QMP socket")
+	}
+
+	// after the VM stops, the networks are attached without hot-plug
+	report, err := json.Marshal(&tapmanager.NetdevReport{VMStopped: true})
+	if err != nil {
+		t.Fatalf("error marshalling the report: %v", err)
+	}
+	if err := src.Report(fdKey, report); err != nil {
+		t.Fatalf("Report(): %v", err)
+	}
+	if vmRunning() {
+		t.Errorf("the VM is still marked as running after it has stopped")
+	}
+	attach("extra2", 2)
+
+	if err := src.DetachNetwork(fdKey, "extra1", updateFDs); err == nil {
+		t.Errorf("DetachNetwork() didn't fail for a network that's not attached last")
+	}
+	detach("extra2", 2)
+	detach("extra1", 1)
+
+	expectedCalls := []string{
+		"ADD extra1 virtlet-eth1",
+		"ADD extra2 virtlet-eth2",
+		"DEL extra2 virtlet-eth2",
+		"ADD extra2 virtlet-eth2",
+		"DEL extra2 virtlet-eth2",
+		"DEL extra1 virtlet-eth1",
+	}
+	if calls := cniClient.NamedNetworkCalls(); !reflect.DeepEqual(calls, expectedCalls) {
+		t.Errorf("bad CNI calls for the additional networks:\n%s\nExpected:\n%s", strings.Join(calls, "\n"), strings.Join(expectedCalls, "\n"))
+	}
+
+	podNS, err := ns.GetNS(cni.PodNetNSPath(podId))
+	if err != nil {
+		t.Fatalf("can't open pod netns: %v", err)
+	}
+	defer podNS.Close()
+	if err := podNS.Do(func(ns.NetNS) error {
+		for _, name := range []string{"virtlet-eth1", "virtlet-eth2"} {
+			if _, err := netlink.LinkByName(name); err == nil {
+				t.Errorf("link %q is still present in the pod network namespace", name)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Errorf("error checking pod netns links: %v", err)
+	}
+}
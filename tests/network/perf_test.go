@@ -0,0 +1,379 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/tapmanager"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	perfRounds = 3
+)
+
+var (
+	perfReport = flag.String("perf-report", "", "append pod network setup/teardown latency records to the specified file (JSON lines)")
+	perfLabel  = flag.String("perf-label", "", "label for the latency records, e.g. git revision")
+	// perfConcurrency lists the numbers of pods that are set up
+	// and torn down at the same time
+	perfConcurrency = []int{1, 10, 50}
+)
+
+// podPoolCNIClient is a CNI client that sets up the network
+// for multiple pods using a separate FakeCNIClient for each of them
+type podPoolCNIClient struct {
+	sync.Mutex
+	info    *cnicurrent.Result
+	hostNS  ns.NetNS
+	clients map[string]*FakeCNIClient
+}
+
+var _ cni.CNIClient = &podPoolCNIClient{}
+
+func newPodPoolCNIClient(info *cnicurrent.Result, hostNS ns.NetNS) *podPoolCNIClient {
+	return &podPoolCNIClient{
+		info:    info,
+		hostNS:  hostNS,
+		clients: make(map[string]*FakeCNIClient),
+	}
+}
+
+func (c *podPoolCNIClient) newClient(podId, podName, podNS string) (*FakeCNIClient, error) {
+	c.Lock()
+	defer c.Unlock()
+	if _, found := c.clients[podId]; found {
+		return nil, fmt.Errorf("pod %q is already added to the network", podId)
+	}
+	client := NewFakeCNIClient(c.info, c.hostNS, podId, podName, podNS)
+	c.clients[podId] = client
+	return client, nil
+}
+
+func (c *podPoolCNIClient) removeClient(podId string) *FakeCNIClient {
+	c.Lock()
+	defer c.Unlock()
+	client := c.clients[podId]
+	delete(c.clients, podId)
+	return client
+}
+
+func (c *podPoolCNIClient) GetDummyNetwork() (*cnicurrent.Result, string, error) {
+	return nil, "", fmt.Errorf("GetDummyNetwork() is not implemented")
+}
+
+func (c *podPoolCNIClient) AddSandboxToNetwork(ctx context.Context, podId, podName, podNS string) (*cnicurrent.Result, error) {
+	client, err := c.newClient(podId, podName, podNS)
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.AddSandboxToNetwork(ctx, podId, podName, podNS)
+	if err != nil {
+		c.removeClient(podId)
+		client.Cleanup()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *podPoolCNIClient) RemoveSandboxFromNetwork(ctx context.Context, podId, podName, podNS string) error {
+	client := c.removeClient(podId)
+	if client == nil {
+		// like CNI DEL, removing a pod that's not
+		// added to the network is not an error
+		return nil
+	}
+	defer client.Cleanup()
+	return client.RemoveSandboxFromNetwork(ctx, podId, podName, podNS)
+}
+
+func (c *podPoolCNIClient) AddSandboxToNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNS string) (*cnicurrent.Result, error) {
+	return nil, fmt.Errorf("podPoolCNIClient doesn't support additional networks")
+}
+
+func (c *podPoolCNIClient) RemoveSandboxFromNamedNetwork(ctx context.Context, network, ifName, podId, podName, podNS string) error {
+	return fmt.Errorf("podPoolCNIClient doesn't support additional networks")
+}
+
+func (c *podPoolCNIClient) AddSandboxToNetworks(ctx context.Context, configFiles []string, podId, podName, podNS string) (*cnicurrent.Result, error) {
+	return nil, fmt.Errorf("podPoolCNIClient doesn't support network selection")
+}
+
+func (c *podPoolCNIClient) RemoveSandboxFromNetworks(ctx context.Context, configFiles []string, podId, podName, podNS string) error {
+	return fmt.Errorf("podPoolCNIClient doesn't support network selection")
+}
+
+func (c *podPoolCNIClient) Cleanup() {
+	c.Lock()
+	defer c.Unlock()
+	for _, client := range c.clients {
+		client.Cleanup()
+	}
+	c.clients = make(map[string]*FakeCNIClient)
+}
+
+// podNetworkTimings holds the latencies of the pod network
+// setup (AddFDs), tap fd retrieval (GetFDs) and teardown (ReleaseFDs)
+type podNetworkTimings struct {
+	add, get, release time.Duration
+}
+
+type podNetworkPerfTester struct {
+	hostNS    ns.NetNS
+	tmpDir    string
+	cniClient *podPoolCNIClient
+	server    *tapmanager.FDServer
+	client    *tapmanager.FDClient
+}
+
+func newPodNetworkPerfTester(tb testing.TB) *podNetworkPerfTester {
+	hostNS, err := ns.NewNS()
+	if err != nil {
+		tb.Fatalf("Failed to create host ns: %v", err)
+	}
+	pt := &podNetworkPerfTester{
+		hostNS:    hostNS,
+		cniClient: newPodPoolCNIClient(sampleCNIResult(), hostNS),
+	}
+
+	src, err := tapmanager.NewTapFDSource(pt.cniClient)
+	if err != nil {
+		pt.teardown()
+		tb.Fatalf("Error creating tap fd source: %v", err)
+	}
+
+	if pt.tmpDir, err = ioutil.TempDir("", "pass-fd-test"); err != nil {
+		pt.teardown()
+		tb.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	socketPath := filepath.Join(pt.tmpDir, "tapfdserver.sock")
+
+	pt.server = tapmanager.NewFDServer(socketPath, src)
+	if err := pt.server.Serve(); err != nil {
+		pt.server = nil
+		pt.teardown()
+		tb.Fatalf("Serve(): %v", err)
+	}
+
+	pt.client = tapmanager.NewFDClient(socketPath)
+	if err := pt.client.Connect(); err != nil {
+		pt.client = nil
+		pt.teardown()
+		tb.Fatalf("Connect(): %v", err)
+	}
+	return pt
+}
+
+func (pt *podNetworkPerfTester) teardown() {
+	if pt.client != nil {
+		pt.client.Close()
+	}
+	if pt.server != nil {
+		pt.server.Stop()
+	}
+	if pt.tmpDir != "" {
+		os.RemoveAll(pt.tmpDir)
+	}
+	pt.cniClient.Cleanup()
+	pt.hostNS.Close()
+}
+
+// runPod sets up the network for a new pod, retrieves the
+// tap fds and then tears down the network
+func (pt *podNetworkPerfTester) runPod() (podNetworkTimings, error) {
+	var timings podNetworkTimings
+	podId := utils.NewUuid()
+	key := "fdkey-" + podId
+
+	start := time.Now()
+	if _, err := pt.client.AddFDs(key, &tapmanager.GetFDPayload{
+		Description: &tapmanager.PodNetworkDesc{
+			PodId:   podId,
+			PodNs:   samplePodNS,
+			PodName: samplePodName,
+		},
+	}); err != nil {
+		return timings, fmt.Errorf("AddFDs(): %v", err)
+	}
+	timings.add = time.Since(start)
+
+	start = time.Now()
+	fds, _, err := pt.client.GetFDs(key)
+	if err != nil {
+		pt.client.ReleaseFDs(key)
+		return timings, fmt.Errorf("GetFDs(): %v", err)
+	}
+	timings.get = time.Since(start)
+	for _, fd := range fds {
+		os.NewFile(uintptr(fd), "tap-fd").Close()
+	}
+
+	start = time.Now()
+	if err := pt.client.ReleaseFDs(key); err != nil {
+		return timings, fmt.Errorf("ReleaseFDs(): %v", err)
+	}
+	timings.release = time.Since(start)
+	return timings, nil
+}
+
+// runPods handles the specified number of pods concurrently
+func (pt *podNetworkPerfTester) runPods(count int) ([]podNetworkTimings, error) {
+	var wg sync.WaitGroup
+	timings := make([]podNetworkTimings, count)
+	errs := make([]error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			timings[i], errs[i] = pt.runPod()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return timings, nil
+}
+
+// latencyStats holds latency statistics in milliseconds
+type latencyStats struct {
+	Median float64 `json:"median"`
+	P90    float64 `json:"p90"`
+	Max    float64 `json:"max"`
+}
+
+func newLatencyStats(durations []time.Duration) latencyStats {
+	if len(durations) == 0 {
+		return latencyStats{}
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	return latencyStats{
+		Median: ms(sorted[len(sorted)/2]),
+		P90:    ms(sorted[(len(sorted)*9)/10]),
+		Max:    ms(sorted[len(sorted)-1]),
+	}
+}
+
+// podNetworkPerfRecord is a single record of the perf report
+type podNetworkPerfRecord struct {
+	Time        string       `json:"time"`
+	Label       string       `json:"label,omitempty"`
+	Concurrency int          `json:"concurrency"`
+	Rounds      int          `json:"rounds"`
+	Add         latencyStats `json:"add"`
+	Get         latencyStats `json:"get"`
+	Release     latencyStats `json:"release"`
+}
+
+func appendPerfRecords(path string, records []podNetworkPerfRecord) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	encoder := json.NewEncoder(f)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestPodNetworkPerf measures the latencies of the pod network
+// setup and teardown with different numbers of pods being handled
+// at the same time. The test is skipped unless -perf-report flag
+// is specified. The results are appended to the report file so
+// they can be compared between the runs, e.g.
+// go test -run TestPodNetworkPerf . -args -perf-report /tmp/netperf.json -perf-label $(git rev-parse --short HEAD)
+func TestPodNetworkPerf(t *testing.T) {
+	if *perfReport == "" {
+		t.Skip("-perf-report is not specified")
+	}
+	var records []podNetworkPerfRecord
+	for _, concurrency := range perfConcurrency {
+		pt := newPodNetworkPerfTester(t)
+		var add, get, release []time.Duration
+		for i := 0; i < perfRounds; i++ {
+			timings, err := pt.runPods(concurrency)
+			if err != nil {
+				pt.teardown()
+				t.Fatalf("concurrency %d: %v", concurrency, err)
+			}
+			for _, tm := range timings {
+				add = append(add, tm.add)
+				get = append(get, tm.get)
+				release = append(release, tm.release)
+			}
+		}
+		pt.teardown()
+		r := podNetworkPerfRecord{
+			Time:        time.Now().UTC().Format(time.RFC3339),
+			Label:       *perfLabel,
+			Concurrency: concurrency,
+			Rounds:      perfRounds,
+			Add:         newLatencyStats(add),
+			Get:         newLatencyStats(get),
+			Release:     newLatencyStats(release),
+		}
+		t.Logf("concurrency %d: add %+v, get %+v, release %+v", concurrency, r.Add, r.Get, r.Release)
+		records = append(records, r)
+	}
+	if err := appendPerfRecords(*perfReport, records); err != nil {
+		t.Errorf("error writing perf report: %v", err)
+	}
+}
+
+// BenchmarkPodNetwork measures the time needed to set up the
+// network for several pods concurrently, retrieve the tap fds
+// and tear the network down
+func BenchmarkPodNetwork(b *testing.B) {
+	for _, concurrency := range perfConcurrency {
+		b.Run(fmt.Sprintf("pods=%d", concurrency), func(b *testing.B) {
+			pt := newPodNetworkPerfTester(b)
+			defer pt.teardown()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := pt.runPods(concurrency); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/tapmanager"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const pinnedMAC = "02:65:02:12:34:56"
+
+// verifyPinnedMAC checks that the VM interface has the pinned
+// MAC address and that another pod can't use the same address
+func verifyPinnedMAC(t *testing.T, c *tapmanager.FDClient) {
+	fds, descBytes, err := c.GetFDs(fdKey)
+	if err != nil {
+		t.Fatalf("GetFDs(): %v", err)
+	}
+	// the tap devices must not be kept open by the test
+	// process, otherwise they can't be reopened upon recovery
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+	desc, err := tapmanager.ParseInterfaceInfo(descBytes)
+	switch {
+	case err != nil:
+		t.Errorf("error parsing interface info: %v", err)
+	case len(desc) != 1:
+		t.Errorf("bad interface count %d instead of 1", len(desc))
+	case desc[0].HardwareAddr.String() != pinnedMAC:
+		t.Errorf("bad VM MAC address %s instead of %s", desc[0].HardwareAddr, pinnedMAC)
+	}
+
+	_, err = c.AddFDs("another-pod", &tapmanager.GetFDPayload{
+		Description: &tapmanager.PodNetworkDesc{
+			PodId:      utils.NewUuid(),
+			PodNs:      samplePodNS,
+			PodName:    "another-pod",
+			MACAddress: pinnedMAC,
+		},
+	})
+	if err == nil {
+		c.ReleaseFDs("another-pod")
+		t.Errorf("AddFDs() didn't fail for another pod with the same MAC address")
+	}
+}
+
+// TestPinnedMACAddressRestart verifies that the MAC address that's
+// pinned for the VM is kept and reserved after tapmanager restart
+func TestPinnedMACAddressRestart(t *testing.T) {
+	hostNS, err := ns.NewNS()
+	if err != nil {
+		t.Fatalf("Failed to create host ns: %v", err)
+	}
+	defer hostNS.Close()
+
+	tmpDir, err := ioutil.TempDir("", "pinned-mac")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "tapfdserver.sock")
+
+	podId := utils.NewUuid()
+	defer cni.DestroyNetNS(podId)
+	pnd := &tapmanager.PodNetworkDesc{
+		PodId:      podId,
+		PodNs:      samplePodNS,
+		PodName:    samplePodName,
+		MACAddress: pinnedMAC,
+	}
+
+	p := startTapManagerProcess(t, socketPath, hostNS, podId)
+	data, err := p.client.AddFDs(fdKey, &tapmanager.GetFDPayload{Description: pnd})
+	if err != nil {
+		p.kill(syscall.SIGKILL)
+		t.Fatalf("AddFDs(): %v", err)
+	}
+	var netConfig *cnicurrent.Result
+	if err := json.Unmarshal(data, &netConfig); err != nil {
+		p.kill(syscall.SIGKILL)
+		t.Fatalf("error unmarshalling CNI result: %v", err)
+	}
+	verifyPinnedMAC(t, p.client)
+	p.kill(syscall.SIGTERM)
+
+	p = startTapManagerProcess(t, socketPath, hostNS, podId)
+	defer p.kill(syscall.SIGTERM)
+	data, err = p.client.AddFDs(fdKey, &tapmanager.GetFDPayload{Description: pnd, CNIConfig: netConfig})
+	if err != nil {
+		t.Fatalf("AddFDs() failed to recover the network: %v", err)
+	}
+	var recoveredConfig *cnicurrent.Result
+	if err := json.Unmarshal(data, &recoveredConfig); err != nil {
+		t.Fatalf("error unmarshalling recovered CNI result: %v", err)
+	}
+	verifyNoDiff(t, "recovered CNI result", netConfig, recoveredConfig)
+	verifyPinnedMAC(t, p.client)
+}
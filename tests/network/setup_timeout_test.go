@@ -0,0 +1,139 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/tapmanager"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+// hangingPlugin is a CNI plugin that logs its invocations and
+// hangs upon ADD like a plugin waiting for an unavailable IPAM
+// backend would
+const hangingPlugin = `#!/bin/sh
+echo "$CNI_COMMAND $$" >>"$(dirname "$0")/log"
+if [ "$CNI_COMMAND" = ADD ]; then
+  sleep 30
+fi
+`
+
+func TestTapFDSourceSetupTimeout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "setup-timeout")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	pluginsDir := filepath.Join(tmpDir, "bin")
+	configsDir := filepath.Join(tmpDir, "net.d")
+	for _, dir := range []string{pluginsDir, configsDir} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("Mkdir(): %v", err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(pluginsDir, "hanging"), []byte(hangingPlugin), 0755); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(configsDir, "10-hanging.conf"), []byte(`{"cniVersion": "0.3.1", "name": "hanging-net", "type": "hanging"}`), 0644); err != nil {
+		t.Fatalf("WriteFile(): %v", err)
+	}
+
+	cniClient, err := cni.NewClient(pluginsDir, configsDir)
+	if err != nil {
+		t.Fatalf("cni.NewClient(): %v", err)
+	}
+	src, err := tapmanager.NewTapFDSource(cniClient)
+	if err != nil {
+		t.Fatalf("Error creating tap fd source: %v", err)
+	}
+	src.SetSetupTimeout(500 * time.Millisecond)
+
+	socketPath := filepath.Join(tmpDir, "tapfdserver.sock")
+	s := tapmanager.NewFDServer(socketPath, src)
+	if err := s.Serve(); err != nil {
+		t.Fatalf("Serve(): %v", err)
+	}
+	defer s.Stop()
+	c := tapmanager.NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		t.Fatalf("Connect(): %v", err)
+	}
+	defer c.Close()
+
+	podId := utils.NewUuid()
+	start := time.Now()
+	if _, err := c.AddFDs(fdKey, &tapmanager.GetFDPayload{
+		Description: &tapmanager.PodNetworkDesc{
+			PodId:   podId,
+			PodNs:   samplePodNS,
+			PodName: samplePodName,
+		},
+	}); err == nil {
+		t.Fatalf("AddFDs() didn't fail for a hanging CNI plugin")
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("the setup wasn't interrupted after the timeout (took %v)", d)
+	}
+
+	// CNI DEL must be done after the ADD has been killed,
+	// so it can release whatever the ADD has allocated
+	bs, err := ioutil.ReadFile(filepath.Join(pluginsDir, "log"))
+	if err != nil {
+		t.Fatalf("ReadFile(): %v", err)
+	}
+	var cmds []string
+	addPid := 0
+	for _, l := range strings.Split(strings.TrimSpace(string(bs)), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) != 2 {
+			t.Fatalf("bad plugin log line %q", l)
+		}
+		cmds = append(cmds, fields[0])
+		if fields[0] == "ADD" {
+			if addPid, err = strconv.Atoi(fields[1]); err != nil {
+				t.Fatalf("bad pid in the plugin log line %q", l)
+			}
+		}
+	}
+	if strings.Join(cmds, ",") != "ADD,DEL" {
+		t.Errorf("bad plugin invocations: %q instead of ADD,DEL", strings.Join(cmds, ","))
+	}
+	if addPid != 0 {
+		// the orphaned children may take a moment to be reaped
+		for n := 0; syscall.Kill(-addPid, 0) != syscall.ESRCH; n++ {
+			if n == 50 {
+				t.Errorf("the hanging CNI ADD is still running")
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	if _, err := os.Stat(cni.PodNetNSPath(podId)); !os.IsNotExist(err) {
+		t.Errorf("the network namespace of the pod wasn't removed")
+		cni.DestroyNetNS(podId)
+	}
+}
@@ -0,0 +1,259 @@
+/*
+Copyright 2018 Mirantis
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package network
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/ns"
+	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
+	"github.com/vishvananda/netlink"
+
+	"github.com/Mirantis/virtlet/pkg/cni"
+	"github.com/Mirantis/virtlet/pkg/tapmanager"
+	"github.com/Mirantis/virtlet/pkg/utils"
+)
+
+const (
+	tapManagerSocketEnvVar = "VIRTLET_TEST_TAPMANAGER_SOCKET"
+	tapManagerHostNSEnvVar = "VIRTLET_TEST_TAPMANAGER_HOST_NS"
+	tapManagerPodIdEnvVar  = "VIRTLET_TEST_TAPMANAGER_POD_ID"
+	tapManagerReadyLine    = "ready"
+	tapManagerKillCount    = 6
+)
+
+// TestTapManagerProcess is not a real test. It's run in a child
+// process by TestTapManagerTermination. It serves the pod networks
+// like tapmanager process of Virtlet does until it's killed, and
+// stops the DHCP servers leaving the pod networks intact upon SIGTERM
+func TestTapManagerProcess(t *testing.T) {
+	socketPath := os.Getenv(tapManagerSocketEnvVar)
+	if socketPath == "" {
+		t.Skip("only used as a child process of TestTapManagerTermination")
+	}
+	// the process runs in its own mount namespace (see
+	// startTapManagerProcess), so the sysfs mounts that are left
+	// behind when it's killed don't leak into the test process
+	// (in Virtlet, they go away together with the container,
+	// as tapmanager can't outlive virtlet process). Network
+	// namespace mounts are still propagated as "ip netns" makes
+	// /var/run/netns a shared mount
+	if err := syscall.Mount("", "/sys", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		fmt.Fprintf(os.Stderr, "can't make sysfs mount private: %v\n", err)
+		os.Exit(1)
+	}
+	hostNS, err := ns.GetNS(os.Getenv(tapManagerHostNSEnvVar))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't open host netns: %v\n", err)
+		os.Exit(1)
+	}
+	cniClient := NewFakeCNIClient(sampleCNIResult(), hostNS, os.Getenv(tapManagerPodIdEnvVar), samplePodName, samplePodNS)
+	src, err := tapmanager.NewTapFDSource(cniClient)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating tap fd source: %v\n", err)
+		os.Exit(1)
+	}
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM)
+	s := tapmanager.NewFDServer(socketPath, src)
+	if err := s.Serve(); err != nil {
+		fmt.Fprintf(os.Stderr, "Serve(): %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println(tapManagerReadyLine)
+	<-sigCh
+	// same as runTapManager() in cmd/virtlet does
+	src.Detach()
+	s.Stop()
+	os.Exit(0)
+}
+
+type tapManagerProcess struct {
+	t          *testing.T
+	cmd        *exec.Cmd
+	socketPath string
+	client     *tapmanager.FDClient
+}
+
+func startTapManagerProcess(t *testing.T, socketPath string, hostNS ns.NetNS, podId string) *tapManagerProcess {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestTapManagerProcess$")
+	cmd.Env = append(os.Environ(),
+		tapManagerSocketEnvVar+"="+socketPath,
+		tapManagerHostNSEnvVar+"="+hostNS.Path(),
+		tapManagerPodIdEnvVar+"="+podId)
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Cloneflags: syscall.CLONE_NEWNS}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("StdoutPipe(): %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("can't start tapmanager process: %v", err)
+	}
+	scanner := bufio.NewScanner(stdout)
+	ready := false
+	for !ready && scanner.Scan() {
+		ready = scanner.Text() == tapManagerReadyLine
+	}
+	if !ready {
+		cmd.Wait()
+		t.Fatalf("tapmanager process didn't start serving")
+	}
+
+	c := tapmanager.NewFDClient(socketPath)
+	if err := c.Connect(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("Connect(): %v", err)
+	}
+	return &tapManagerProcess{t: t, cmd: cmd, socketPath: socketPath, client: c}
+}
+
+// kill kills the process with the specified signal and waits for
+// it to exit. Upon SIGTERM, the process must exit cleanly removing
+// its socket
+func (p *tapManagerProcess) kill(sig syscall.Signal) {
+	if err := p.cmd.Process.Signal(sig); err != nil {
+		p.t.Fatalf("can't kill tapmanager process: %v", err)
+	}
+	err := p.cmd.Wait()
+	// the connection is already broken at this point
+	p.client.Close()
+	if sig != syscall.SIGTERM {
+		return
+	}
+	if err != nil {
+		p.t.Errorf("tapmanager process didn't exit cleanly upon SIGTERM: %v", err)
+	}
+	if _, err := os.Stat(p.socketPath); !os.IsNotExist(err) {
+		p.t.Errorf("tapmanager socket wasn't removed upon SIGTERM")
+	}
+}
+
+// verifyPodNetNS checks that the pod network namespace is still
+// there with the bridge that connects the VM to the outer network
+func verifyPodNetNS(t *testing.T, podId string) {
+	podNS, err := ns.GetNS(cni.PodNetNSPath(podId))
+	if err != nil {
+		t.Fatalf("the pod network namespace is gone: %v", err)
+	}
+	defer podNS.Close()
+	if err := podNS.Do(func(ns.NetNS) error {
+		_, err := netlink.LinkByName("br0")
+		return err
+	}); err != nil {
+		t.Fatalf("the bridge in the pod network namespace is gone: %v", err)
+	}
+}
+
+// TestTapManagerTermination kills tapmanager process at random
+// points while it's recovering the pod network, verifying that the
+// pod network stays intact and that the next tapmanager process can
+// recover it and serve DHCP for the VM
+func TestTapManagerTermination(t *testing.T) {
+	vnt := newVMNetworkTester(t, 1)
+	defer vnt.teardown()
+
+	tmpDir, err := ioutil.TempDir("", "tapmanager-termination")
+	if err != nil {
+		t.Fatalf("ioutil.TempDir(): %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	socketPath := filepath.Join(tmpDir, "tapfdserver.sock")
+
+	podId := utils.NewUuid()
+	defer cni.DestroyNetNS(podId)
+	pnd := &tapmanager.PodNetworkDesc{
+		PodId:   podId,
+		PodNs:   samplePodNS,
+		PodName: samplePodName,
+	}
+
+	// set up the pod network like RunPodSandbox does
+	p := startTapManagerProcess(t, socketPath, vnt.hostNS, podId)
+	data, err := p.client.AddFDs(fdKey, &tapmanager.GetFDPayload{Description: pnd})
+	if err != nil {
+		p.kill(syscall.SIGKILL)
+		t.Fatalf("AddFDs(): %v", err)
+	}
+	var netConfig *cnicurrent.Result
+	if err := json.Unmarshal(data, &netConfig); err != nil {
+		p.kill(syscall.SIGKILL)
+		t.Fatalf("error unmarshalling CNI result: %v", err)
+	}
+	p.kill(syscall.SIGTERM)
+	verifyPodNetNS(t, podId)
+
+	// recover the pod network like Virtlet does after restart
+	recoverPayload := &tapmanager.GetFDPayload{Description: pnd, CNIConfig: netConfig}
+	for i := 0; i < tapManagerKillCount; i++ {
+		sig := syscall.SIGTERM
+		if i%2 != 0 {
+			sig = syscall.SIGKILL
+		}
+		p := startTapManagerProcess(t, socketPath, vnt.hostNS, podId)
+		doneCh := make(chan struct{})
+		go func() {
+			// the recovery may or may not complete
+			// before the process is killed
+			p.client.AddFDs(fdKey, recoverPayload)
+			close(doneCh)
+		}()
+		time.Sleep(time.Duration(rand.Intn(200)) * time.Millisecond)
+		p.kill(sig)
+		<-doneCh
+		verifyPodNetNS(t, podId)
+	}
+
+	p = startTapManagerProcess(t, socketPath, vnt.hostNS, podId)
+	defer p.kill(syscall.SIGTERM)
+	data, err = p.client.AddFDs(fdKey, recoverPayload)
+	if err != nil {
+		t.Fatalf("AddFDs() failed to recover the network: %v", err)
+	}
+	var recoveredConfig *cnicurrent.Result
+	if err := json.Unmarshal(data, &recoveredConfig); err != nil {
+		t.Fatalf("error unmarshalling recovered CNI result: %v", err)
+	}
+	verifyNoDiff(t, "recovered CNI result", netConfig, recoveredConfig)
+
+	fds, _, err := p.client.GetFDs(fdKey)
+	if err != nil {
+		t.Fatalf("GetFDs(): %v", err)
+	}
+	var vmTaps []*os.File
+	for _, fd := range fds {
+		vmTaps = append(vmTaps, os.NewFile(uintptr(fd), "tap-fd"))
+	}
+	vnt.connectTaps(vmTaps)
+	vnt.verifyDhcp("tap0", []string{
+		"new_ip_address='10.1.90.5'",
+		"new_routers='10.1.90.1'",
+		"new_subnet_mask='255.255.255.0'",
+	})
+}
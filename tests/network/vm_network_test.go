@@ -29,7 +29,6 @@ import (
 	"time"
 
 	"github.com/containernetworking/cni/pkg/ns"
-	cnitypes "github.com/containernetworking/cni/pkg/types"
 	cnicurrent "github.com/containernetworking/cni/pkg/types/current"
 	"github.com/pmezard/go-difflib/difflib"
 	"github.com/vishvananda/netlink"
@@ -37,6 +36,7 @@ import (
 	"github.com/Mirantis/virtlet/pkg/nettools"
 	"github.com/Mirantis/virtlet/pkg/tapmanager"
 	"github.com/Mirantis/virtlet/pkg/utils"
+	"github.com/Mirantis/virtlet/tests/cnifixture"
 )
 
 const (
@@ -57,47 +57,12 @@ var clientAddrs = []string{
 }
 
 var clientMacAddrs = []string{
-	"42:a4:a6:22:80:2e",
-	"42:a4:a6:22:80:2f",
+	cnifixture.MAC(0),
+	cnifixture.MAC(1),
 }
 
 func sampleCNIResult() *cnicurrent.Result {
-	return &cnicurrent.Result{
-		Interfaces: []*cnicurrent.Interface{
-			{
-				Name:    "eth0",
-				Mac:     clientMacAddrs[0],
-				Sandbox: "placeholder",
-			},
-		},
-		IPs: []*cnicurrent.IPConfig{
-			{
-				Version:   "4",
-				Interface: 0,
-				Address: net.IPNet{
-					IP:   net.IP{10, 1, 90, 5},
-					Mask: net.IPMask{255, 255, 255, 0},
-				},
-				Gateway: net.IP{10, 1, 90, 1},
-			},
-		},
-		Routes: []*cnitypes.Route{
-			{
-				Dst: net.IPNet{
-					IP:   net.IP{0, 0, 0, 0},
-					Mask: net.IPMask{0, 0, 0, 0},
-				},
-				GW: net.IP{10, 1, 90, 1},
-			},
-			{
-				Dst: net.IPNet{
-					IP:   net.IP{10, 10, 42, 0},
-					Mask: net.IPMask{255, 255, 255, 0},
-				},
-				GW: net.IP{10, 1, 90, 90},
-			},
-		},
-	}
+	return cnifixture.MultiInterfaceResult(1).Route("10.10.42.0/24", "10.1.90.90").Result()
 }
 
 type vmNetworkTester struct {
@@ -379,62 +344,17 @@ func TestTapFDSource(t *testing.T) {
 					HardwareAddr: mustParseMAC(clientMacAddrs[0]),
 					FdIndex:      0,
 					PCIAddress:   "",
+					Name:         "eth0",
+					IPs:          []string{"10.1.90.5/24"},
+					MTU:          1500,
 				},
 			},
 		},
 		{
 			name:           "multiple cnis",
 			interfaceCount: 2,
-			info: &cnicurrent.Result{
-				Interfaces: []*cnicurrent.Interface{
-					{
-						Name:    "eth0",
-						Mac:     clientMacAddrs[0],
-						Sandbox: "placeholder",
-					},
-					{
-						Name:    "eth1",
-						Mac:     clientMacAddrs[1],
-						Sandbox: "placeholder",
-					},
-				},
-				IPs: []*cnicurrent.IPConfig{
-					{
-						Version:   "4",
-						Interface: 0,
-						Address: net.IPNet{
-							IP:   net.IP{10, 1, 90, 5},
-							Mask: net.IPMask{255, 255, 255, 0},
-						},
-						Gateway: net.IP{10, 1, 90, 1},
-					},
-					{
-						Version:   "4",
-						Interface: 1,
-						Address: net.IPNet{
-							IP:   net.IP{10, 2, 90, 5},
-							Mask: net.IPMask{255, 255, 255, 0},
-						},
-					},
-				},
-				Routes: []*cnitypes.Route{
-					{
-						Dst: net.IPNet{
-							IP:   net.IP{0, 0, 0, 0},
-							Mask: net.IPMask{0, 0, 0, 0},
-						},
-						GW: net.IP{10, 1, 90, 1},
-					},
-					{
-						Dst: net.IPNet{
-							IP:   net.IP{10, 10, 42, 0},
-							Mask: net.IPMask{255, 255, 255, 0},
-						},
-						GW: net.IP{10, 1, 90, 90},
-					},
-				},
-			},
-			tcpdumpStopOn: "10.1.90.1.4243 > 10.1.90.5.4242: UDP",
+			info:           cnifixture.MultiInterfaceResult(2).Route("10.10.42.0/24", "10.1.90.90").Result(),
+			tcpdumpStopOn:  "10.1.90.1.4243 > 10.1.90.5.4242: UDP",
 			dhcpExpectedSubstrings: [][]string{
 				{
 					"new_classless_static_routes='10.10.42.0/24 10.1.90.90'",
@@ -463,12 +383,18 @@ func TestTapFDSource(t *testing.T) {
 					HardwareAddr: mustParseMAC(clientMacAddrs[0]),
 					FdIndex:      0,
 					PCIAddress:   "",
+					Name:         "eth0",
+					IPs:          []string{"10.1.90.5/24"},
+					MTU:          1500,
 				},
 				{
 					Type:         nettools.InterfaceTypeTap,
 					HardwareAddr: mustParseMAC(clientMacAddrs[1]),
 					FdIndex:      1,
 					PCIAddress:   "",
+					Name:         "eth1",
+					IPs:          []string{"10.2.90.5/24"},
+					MTU:          1500,
 				},
 			},
 		},
@@ -493,6 +419,9 @@ func TestTapFDSource(t *testing.T) {
 					HardwareAddr: mustParseMAC(clientMacAddrs[0]),
 					FdIndex:      0,
 					PCIAddress:   "",
+					Name:         "eth0",
+					IPs:          []string{"10.1.90.5/24"},
+					MTU:          1500,
 				},
 			},
 			useBadResult: true,
@@ -544,13 +473,18 @@ func TestTapFDSource(t *testing.T) {
 					t.Fatalf("fd count mismatch: %d instead of %d", len(fds), tc.interfaceCount)
 				}
 
-				var interfaceDesc []tapmanager.InterfaceDescription
-				if err := json.Unmarshal(descBytes, &interfaceDesc); err != nil {
-					t.Errorf("error unmarshalling interface desc: %v", err)
+				if interfaceDesc, err := tapmanager.ParseInterfaceInfo(descBytes); err != nil {
+					t.Errorf("error parsing interface info: %v", err)
 				} else {
 					verifyNoDiff(t, "interfaceDesc", tc.interfaceDesc, interfaceDesc)
 				}
 
+				if queryBytes, err := c.QueryInfo(fdKey); err != nil {
+					t.Errorf("QueryInfo(): %v", err)
+				} else if !bytes.Equal(queryBytes, descBytes) {
+					t.Errorf("QueryInfo() result mismatch: %s instead of %s", queryBytes, descBytes)
+				}
+
 				vmTaps := []*os.File{}
 				for _, fd := range fds {
 					vmTap := os.NewFile(uintptr(fd), "tap-fd")
@@ -582,6 +516,9 @@ func TestTapFDSource(t *testing.T) {
 
 				infoAfterTeardown := cniClient.NetworkInfoAfterTeardown()
 				verifyNoDiff(t, "network info after teardown", expectedResult, infoAfterTeardown)
+				if err := cniClient.VerifyTeardown(); err != nil {
+					t.Error(err)
+				}
 			})
 		})
 	}